@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/importer"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/bench"
+)
+
+// benchQuery 对运行中实例执行的一类查询
+type benchQuery struct {
+	name string
+	path string
+}
+
+// benchResult 一类查询的统计
+type benchResult struct {
+	requests  int
+	errors    int
+	latencies []time.Duration
+}
+
+// runBench 对运行中的实例执行标准查询负载，可选先通过导入接口写入测试数据
+func runBench(c *client, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	duration := fs.Duration("duration", 10*time.Second, "how long to run each query")
+	concurrency := fs.Int("concurrency", 4, "concurrent requests per query")
+	write := fs.Int("write", 0, "import this many synthetic metrics first (requires the import api) and delete them afterwards")
+	agent := fs.String("agent", "", "agent id to query (default: from the written data or the latest metric)")
+	name := fs.String("name", "", "metric name to aggregate (default: from the written data or the latest metric)")
+	limit := fs.Int("limit", bench.DefaultQueryLimit, "limit of list queries")
+	fs.Parse(args)
+
+	if *concurrency <= 0 {
+		return fmt.Errorf("--concurrency must be positive")
+	}
+
+	if *write > 0 {
+		d := bench.DefaultDataset(time.Now().Add(-time.Hour))
+		defer deleteBenchAgents(c, d)
+		if err := writeBenchData(c, d, *write); err != nil {
+			return err
+		}
+		if *agent == "" {
+			*agent = bench.AgentID(0)
+		}
+		if *name == "" {
+			*name = bench.MetricName(0)
+		}
+	}
+
+	if *agent == "" || *name == "" {
+		var latest []processor.ProcessedMetric
+		if err := c.do(http.MethodGet, "/api/v1/metrics/latest?limit=1", nil, &latest); err != nil {
+			return err
+		}
+		if len(latest) == 0 {
+			return fmt.Errorf("server has no metrics, use --write or --agent and --name")
+		}
+		if *agent == "" {
+			*agent = latest[0].AgentID
+		}
+		if *name == "" {
+			*name = latest[0].Name
+		}
+	}
+
+	end := time.Now()
+	start := end.Add(-time.Hour)
+	rangeParams := "start=" + strconv.FormatInt(start.UnixMilli(), 10) + "&end=" + strconv.FormatInt(end.UnixMilli(), 10)
+	limitParam := "limit=" + strconv.Itoa(*limit)
+	queries := []benchQuery{
+		{"latest", "/api/v1/metrics/latest?" + limitParam},
+		{"agent", "/api/v1/metrics/" + url.PathEscape(*agent) + "?" + limitParam},
+		{"range", "/api/v1/metrics/range?" + rangeParams + "&" + limitParam},
+		{"labels", "/api/v1/metrics/query?match=" + url.QueryEscape("__name__="+strconv.Quote(*name)) + "&" + limitParam},
+		{"aggregate", "/api/v1/metrics/aggregate?name=" + url.QueryEscape(*name) + "&agg=avg&step=1m&" + rangeParams},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "query\trequests\terrors\treq/s\tp50\tp95\tp99\t")
+	for _, q := range queries {
+		r := runBenchQuery(c, q, *duration, *concurrency)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t\n", q.name, r.requests, r.errors,
+			float64(r.requests)/duration.Seconds(), r.percentile(0.50), r.percentile(0.95), r.percentile(0.99))
+	}
+	return w.Flush()
+}
+
+// runBenchQuery 以concurrency个并发请求重复执行查询直到duration结束
+func runBenchQuery(c *client, q benchQuery, duration time.Duration, concurrency int) *benchResult {
+	var (
+		mu     sync.Mutex
+		result benchResult
+		wg     sync.WaitGroup
+	)
+	deadline := time.Now().Add(duration)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				begin := time.Now()
+				err := c.do(http.MethodGet, q.path, nil, nil)
+				elapsed := time.Since(begin)
+
+				mu.Lock()
+				result.requests++
+				if err != nil {
+					result.errors++
+				} else {
+					result.latencies = append(result.latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return &result
+}
+
+// percentile 返回成功请求延迟的分位数，latencies需已排序
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p)
+	return r.latencies[i].Round(time.Microsecond)
+}
+
+// writeBenchData 通过导入接口写入n个合成样本并报告写入速率
+func writeBenchData(c *client, d bench.Dataset, n int) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, m := range d.Generate(0, n) {
+		ts, _ := json.Marshal(m.Timestamp.UnixMilli())
+		if err := enc.Encode(importer.Record{
+			AgentID:   m.AgentID,
+			Timestamp: ts,
+			Name:      m.Name,
+			Value:     m.Value,
+			Labels:    m.Labels,
+			Type:      m.Type,
+		}); err != nil {
+			return err
+		}
+	}
+
+	var result importer.Result
+	begin := time.Now()
+	if err := c.do(http.MethodPost, "/api/v1/admin/import?format=jsonl", &buf, &result); err != nil {
+		return fmt.Errorf("failed to write bench data: %w", err)
+	}
+	elapsed := time.Since(begin)
+	fmt.Printf("write: %d metrics in %s (%.0f metrics/s), rejected: %d\n",
+		result.Imported, elapsed.Round(time.Millisecond), float64(result.Imported)/elapsed.Seconds(), result.Rejected)
+	return nil
+}
+
+// deleteBenchAgents 删除写入的测试数据
+func deleteBenchAgents(c *client, d bench.Dataset) {
+	deleted := 0
+	for i := 0; i < d.Agents; i++ {
+		var result struct {
+			Deleted int `json:"deleted"`
+		}
+		if err := c.do(http.MethodDelete, "/api/v1/metrics/"+url.PathEscape(bench.AgentID(i)), nil, &result); err != nil {
+			fmt.Fprintf(os.Stderr, "konctl: failed to delete bench data of %s: %v\n", bench.AgentID(i), err)
+			continue
+		}
+		deleted += result.Deleted
+	}
+	fmt.Printf("deleted %d bench metrics\n", deleted)
+}
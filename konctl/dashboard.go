@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const dashboardUsage = `Usage: konctl dashboard <list|export|install> [flags]
+
+  list                                              list the pre-built Grafana dashboards
+  export [--name NAME] [--datasource UID] [--dir DIR]
+                                                    write dashboards as JSON, one NAME.json per dashboard in DIR
+                                                    (default: stdout, --name required); without --datasource
+                                                    Grafana asks for the datasource on import
+  install --grafana URL --datasource UID [--name NAME] [--health-datasource UID]
+          [--grafana-token TOKEN] [--folder UID]    create or update the dashboards through the Grafana HTTP API
+`
+
+// dashboardInfo 预置仪表盘的概要
+type dashboardInfo struct {
+	Name        string `json:"name"`
+	UID         string `json:"uid"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// runDashboard 导出或安装预置的Grafana仪表盘
+func runDashboard(c *client, output *printer, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dashboardUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("dashboard "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "dashboard name (default: all dashboards)")
+	datasource := fs.String("datasource", "", "UID of the Grafana Prometheus datasource")
+	healthDatasource := fs.String("health-datasource", "", "UID of the Prometheus datasource scraping the collector for collector-health (default: --datasource)")
+	dir := fs.String("dir", "", "directory to write the exported dashboards to")
+	grafanaURL := fs.String("grafana", "", "Grafana address, e.g. http://localhost:3000")
+	grafanaToken := fs.String("grafana-token", os.Getenv("GRAFANA_TOKEN"), "Grafana service account token (default: $GRAFANA_TOKEN)")
+	folder := fs.String("folder", "", "UID of the Grafana folder to install into")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		data, err := c.raw(http.MethodGet, "/api/v1/dashboards", nil)
+		if err != nil {
+			return err
+		}
+		if output.structured() {
+			return output.print(os.Stdout, data)
+		}
+		var infos []dashboardInfo
+		if err := json.Unmarshal(data, &infos); err != nil {
+			return err
+		}
+		for _, d := range infos {
+			fmt.Printf("%s (%s): %s\n", d.Name, d.Title, d.Description)
+		}
+		return nil
+
+	case "export":
+		if *dir == "" {
+			if *name == "" {
+				return fmt.Errorf("--name or --dir is required")
+			}
+			data, err := fetchDashboard(c, *name, *datasource, *healthDatasource)
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		names, err := dashboardNames(c, *name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			return err
+		}
+		for _, n := range names {
+			data, err := fetchDashboard(c, n, *datasource, *healthDatasource)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(*dir, n+".json")
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				return err
+			}
+			fmt.Printf("wrote %s\n", path)
+		}
+		return nil
+
+	case "install":
+		if *grafanaURL == "" || *datasource == "" {
+			return fmt.Errorf("--grafana and --datasource are required")
+		}
+		names, err := dashboardNames(c, *name)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			data, err := fetchDashboard(c, n, *datasource, *healthDatasource)
+			if err != nil {
+				return err
+			}
+			u, err := installDashboard(strings.TrimRight(*grafanaURL, "/"), *grafanaToken, *folder, data)
+			if err != nil {
+				return fmt.Errorf("install %s: %w", n, err)
+			}
+			fmt.Printf("installed %s at %s\n", n, u)
+		}
+		return nil
+
+	default:
+		fmt.Fprint(os.Stderr, dashboardUsage)
+		os.Exit(2)
+		return nil
+	}
+}
+
+// dashboardNames 返回name，name为空时返回服务端的全部预置仪表盘
+func dashboardNames(c *client, name string) ([]string, error) {
+	if name != "" {
+		return []string{name}, nil
+	}
+	var infos []dashboardInfo
+	if err := c.do(http.MethodGet, "/api/v1/dashboards", nil, &infos); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, d := range infos {
+		names[i] = d.Name
+	}
+	return names, nil
+}
+
+// fetchDashboard 获取使用指定数据源的仪表盘JSON，collector-health优先使用healthDatasource
+func fetchDashboard(c *client, name, datasource, healthDatasource string) ([]byte, error) {
+	if name == "collector-health" && healthDatasource != "" {
+		datasource = healthDatasource
+	}
+	path := "/api/v1/dashboards/" + url.PathEscape(name)
+	if datasource != "" {
+		path += "?datasource=" + url.QueryEscape(datasource)
+	}
+	data, err := c.raw(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 缩进后写入文件，便于纳入版本管理
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// installDashboard 通过Grafana的/api/dashboards/db创建或覆盖仪表盘，返回仪表盘的地址
+func installDashboard(grafanaURL, token, folder string, dashboard []byte) (string, error) {
+	body, err := json.Marshal(map[string]any{
+		"dashboard": json.RawMessage(dashboard),
+		"folderUid": folder,
+		"overwrite": true,
+		"message":   "installed by konctl",
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, grafanaURL+"/api/dashboards/db", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		URL     string `json:"url"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(data, &result)
+	if resp.StatusCode >= 300 {
+		if result.Message != "" {
+			return "", fmt.Errorf("grafana returned %s: %s", resp.Status, result.Message)
+		}
+		return "", fmt.Errorf("grafana returned %s", resp.Status)
+	}
+	return grafanaURL + result.URL, nil
+}
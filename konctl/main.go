@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/konpure/Kon-Agent-export/pkg/importer"
+)
+
+const usage = `Usage: konctl [--server URL] [--output FORMAT] [--filter EXPR] <command> [flags]
+
+Commands:
+  get       GET an API path and print the response, e.g. konctl -o table get /api/v1/metrics?limit=10
+  import    import historical metrics from a jsonl, csv or parquet file
+  bench     benchmark queries (and optionally writes) against a running instance
+  pack      list, export, import or delete alert/processing rule packs
+  dashboard list, export or install the pre-built Grafana dashboards
+
+Global flags:
+  --server URL      Kon-Agent-export API address (default http://localhost:8080)
+  -o, --output FMT  print API responses as json, yaml, table or csv instead of text
+  --filter EXPR     jq expression applied to API responses before printing, e.g. '.[] | select(.value > 90)'
+`
+
+func main() {
+	global := flag.NewFlagSet("konctl", flag.ExitOnError)
+	server := global.String("server", "http://localhost:8080", "Kon-Agent-export API address")
+	var format string
+	global.StringVar(&format, "output", "", "output format: json, yaml, table or csv")
+	global.StringVar(&format, "o", "", "shorthand for --output")
+	filter := global.String("filter", "", "jq expression applied to API responses")
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	global.Parse(os.Args[1:])
+
+	args := global.Args()
+	if len(args) == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	out, err := newPrinter(format, *filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "konctl: %v\n", err)
+		os.Exit(2)
+	}
+	client := &client{server: strings.TrimRight(*server, "/"), http: http.DefaultClient}
+
+	switch args[0] {
+	case "get":
+		err = runGet(client, out, args[1:])
+	case "import":
+		err = runImport(client, out, args[1:])
+	case "bench":
+		err = runBench(client, args[1:])
+	case "pack":
+		err = runPack(client, out, args[1:])
+	case "dashboard":
+		err = runDashboard(client, out, args[1:])
+	default:
+		global.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "konctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runGet 请求API路径并按--output输出响应，未指定格式时输出JSON
+func runGet(c *client, output *printer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: konctl get /api/v1/PATH[?QUERY]")
+	}
+	path := args[0]
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	data, err := c.raw(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	return output.print(os.Stdout, data)
+}
+
+// runImport 将历史数据文件上传到服务端导入
+func runImport(c *client, output *printer, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	file := fs.String("file", "", "file to import (metrics.jsonl, metrics.csv or metrics.parquet)")
+	format := fs.String("format", "", "file format: jsonl, csv or parquet (default: from file extension)")
+	fs.Parse(args)
+
+	if *file == "" {
+		return fmt.Errorf("--file is required")
+	}
+	if *format == "" {
+		*format = importer.FormatFromPath(*file)
+		if *format == "" {
+			return fmt.Errorf("cannot infer format of %s, use --format", *file)
+		}
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	path := "/api/v1/admin/import?format=" + url.QueryEscape(*format)
+	data, err := c.raw(http.MethodPost, path, f)
+	if err != nil {
+		return err
+	}
+	if output.structured() {
+		return output.print(os.Stdout, data)
+	}
+	var result importer.Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("read: %d, imported: %d, rejected: %d\n", result.Read, result.Imported, result.Rejected)
+	for _, msg := range result.Errors {
+		fmt.Printf("  %s\n", msg)
+	}
+	return nil
+}
+
+// client API客户端
+type client struct {
+	server string
+	http   *http.Client
+}
+
+// do 发送请求并将JSON响应解析到out
+func (c *client) do(method, path string, body io.Reader, out interface{}) error {
+	data, err := c.raw(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// raw 发送请求并返回原始响应体
+func (c *client) raw(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("server returned %s: %s", resp.Status, apiErr.Error)
+		}
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return data, nil
+}
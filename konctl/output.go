@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/itchyny/gojq"
+	"gopkg.in/yaml.v3"
+)
+
+// 输出格式
+const (
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputTable = "table"
+	outputCSV   = "csv"
+)
+
+// printer 按--output和--filter输出API响应，format为空表示使用命令自己的文本输出
+type printer struct {
+	format string
+	filter *gojq.Code
+}
+
+// newPrinter 校验输出格式并编译过滤表达式
+func newPrinter(format, filter string) (*printer, error) {
+	switch format {
+	case "", outputJSON, outputYAML, outputTable, outputCSV:
+	default:
+		return nil, fmt.Errorf("unknown output format %q, use json, yaml, table or csv", format)
+	}
+
+	p := &printer{format: format}
+	if filter != "" {
+		query, err := gojq.Parse(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		if p.filter, err = gojq.Compile(query); err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// structured 判断是否需要按格式输出，设置了--output或--filter时命令不再使用文本输出
+func (p *printer) structured() bool {
+	return p.format != "" || p.filter != nil
+}
+
+// print 解析JSON响应体，执行过滤表达式后按格式写入w，表达式产生多个结果时依次输出
+func (p *printer) print(w io.Writer, data []byte) error {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// 保留整数的原样输出，如毫秒时间戳
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	results := []any{v}
+	if p.filter != nil {
+		results = results[:0]
+		iter := p.filter.Run(v)
+		for {
+			r, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := r.(error); ok {
+				return fmt.Errorf("filter: %w", err)
+			}
+			results = append(results, r)
+		}
+	}
+
+	switch p.format {
+	case outputYAML:
+		return printYAML(w, results)
+	case outputTable:
+		return printTable(w, results)
+	case outputCSV:
+		return printCSV(w, results)
+	default:
+		return printJSON(w, results)
+	}
+}
+
+// printJSON 每个结果输出为缩进的JSON
+func printJSON(w io.Writer, results []any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	for _, r := range results {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printYAML 每个结果输出为一个YAML文档，多个结果之间用---分隔
+func printYAML(w io.Writer, results []any) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, r := range results {
+		if err := enc.Encode(yamlValue(r)); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// yamlValue 把json.Number转换为YAML的整数或浮点数，避免输出为字符串
+func yamlValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []any:
+		out := make([]any, len(v))
+		for i := range v {
+			out[i] = yamlValue(v[i])
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k := range v {
+			out[k] = yamlValue(v[k])
+		}
+		return out
+	}
+	return v
+}
+
+// printTable 按对齐的列输出表格
+func printTable(w io.Writer, results []any) error {
+	header, rows := tabulate(results)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printCSV 输出带表头的CSV
+func printCSV(w io.Writer, results []any) error {
+	header, rows := tabulate(results)
+	cw := csv.NewWriter(w)
+	if header != nil {
+		cw.Write(header)
+	}
+	cw.WriteAll(rows)
+	return cw.Error()
+}
+
+// tabulate 把结果展开为表格的行：数组中的每个元素为一行，对象的键按字母顺序作为列，
+// 嵌套的对象和数组以紧凑的JSON放在一个单元格中。结果都是标量时没有表头，每个值一行
+func tabulate(results []any) ([]string, [][]string) {
+	var items []any
+	for _, r := range results {
+		if arr, ok := r.([]any); ok {
+			items = append(items, arr...)
+		} else {
+			items = append(items, r)
+		}
+	}
+
+	columns := make(map[string]bool)
+	for _, item := range items {
+		if obj, ok := item.(map[string]any); ok {
+			for k := range obj {
+				columns[k] = true
+			}
+		}
+	}
+	if len(columns) == 0 {
+		rows := make([][]string, 0, len(items))
+		for _, item := range items {
+			rows = append(rows, []string{cell(item)})
+		}
+		return nil, rows
+	}
+
+	header := make([]string, 0, len(columns))
+	for k := range columns {
+		header = append(header, k)
+	}
+	sort.Strings(header)
+
+	rows := make([][]string, 0, len(items))
+	for _, item := range items {
+		obj, _ := item.(map[string]any)
+		row := make([]string, len(header))
+		for i, k := range header {
+			if v, ok := obj[k]; ok {
+				row[i] = cell(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return header, rows
+}
+
+// cell 单元格的文本，字符串原样输出，null为空
+func cell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	data, err := gojq.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
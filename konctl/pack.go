@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const packUsage = `Usage: konctl pack <list|export|import|delete> [flags]
+
+  list                              list installed packs
+  export --name NAME [--out FILE]   write a pack as YAML (default: stdout)
+  import --file FILE [--force]      install or upgrade a pack, --force allows downgrades
+  delete --name NAME                remove an installed pack
+`
+
+// packSummary 已安装规则包的概要
+type packSummary struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Description string    `json:"description"`
+	SLARules    int       `json:"sla_rules"`
+	Relabel     int       `json:"relabel_rules"`
+	OnChange    int       `json:"store_on_change_rules"`
+	Queries     int       `json:"queries"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// runPack 管理服务端的规则包
+func runPack(c *client, output *printer, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, packUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("pack "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "pack name")
+	file := fs.String("file", "", "pack file to import")
+	out := fs.String("out", "", "file to write the exported pack to (default: stdout)")
+	force := fs.Bool("force", false, "allow installing an older version than the installed one")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		data, err := c.raw(http.MethodGet, "/api/v1/admin/packs", nil)
+		if err != nil {
+			return err
+		}
+		if output.structured() {
+			return output.print(os.Stdout, data)
+		}
+		var summaries []packSummary
+		if err := json.Unmarshal(data, &summaries); err != nil {
+			return err
+		}
+		for _, p := range summaries {
+			fmt.Printf("%s %s: %d sla rules, %d relabel rules, %d store_on_change rules, %d queries (installed %s)\n",
+				p.Name, p.Version, p.SLARules, p.Relabel, p.OnChange, p.Queries, p.InstalledAt.Format(time.RFC3339))
+		}
+		return nil
+
+	case "export":
+		if *name == "" {
+			return fmt.Errorf("--name is required")
+		}
+		data, err := c.raw(http.MethodGet, "/api/v1/admin/packs/"+url.PathEscape(*name), nil)
+		if err != nil {
+			return err
+		}
+		if *out == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		return os.WriteFile(*out, data, 0644)
+
+	case "import":
+		if *file == "" {
+			return fmt.Errorf("--file is required")
+		}
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		path := "/api/v1/admin/packs"
+		if *force {
+			path += "?force=true"
+		}
+		data, err := c.raw(http.MethodPost, path, f)
+		if err != nil {
+			return err
+		}
+		if output.structured() {
+			return output.print(os.Stdout, data)
+		}
+		var result struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return err
+		}
+		fmt.Printf("installed %s %s\n", result.Name, result.Version)
+		return nil
+
+	case "delete":
+		if *name == "" {
+			return fmt.Errorf("--name is required")
+		}
+		return c.do(http.MethodDelete, "/api/v1/admin/packs/"+url.PathEscape(*name), nil, nil)
+
+	default:
+		fmt.Fprint(os.Stderr, packUsage)
+		os.Exit(2)
+		return nil
+	}
+}
@@ -1,69 +1,68 @@
 package main
 
 import (
-	"fmt"
-	"github.com/konpure/Kon-Agent-export/pkg/api"
+	"context"
 	"github.com/konpure/Kon-Agent-export/pkg/config"
-	"github.com/konpure/Kon-Agent-export/pkg/processor"
-	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"github.com/konpure/Kon-Agent-export/pkg/server"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
+// configPath 配置文件路径，收到SIGHUP时重新读取
+const configPath = "configs/config.yaml"
+
 func main() {
 	// load config
-	cfg, err := config.LoadConfig("configs/config.yaml")
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 	log.Println("Config loaded successfully:", cfg)
 
-	// init data processor
-	dataProcessor := processor.NewDefaultProcessor()
-	log.Println("Data processor initialized successfully")
-
-	// init data storage
-	dataStorage := storage.NewMemoryStorage(
-		cfg.Storage.MaxSize,
-		cfg.Storage.ExpireTime,
-	)
-	log.Println("Data storage initialized successfully")
-
-	// init quic server
-	InitQuicServer(dataProcessor, dataStorage)
-	log.Println("Quic server initialized successfully")
+	// init server components
+	srv, err := server.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to init server: %v", err)
+	}
 
-	// start quic server
-	quicAddr := fmt.Sprintf(":%d", cfg.Server.QUICPort)
-	go func() {
-		if err := StartQuicServer(quicAddr); err != nil {
-			log.Fatalf("Failed to start quic server: %v", err)
-		}
-	}()
-	log.Printf("Quic server started successfully on %s", quicAddr)
+	// start listeners
+	if err := srv.Start(); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
 
-	// start api server
-	httpAddr := fmt.Sprintf(":%d", cfg.Server.HTTPPort)
-	apiServer := api.NewAPIServer(dataStorage)
-	go func() {
-		if err := apiServer.Start(
-			httpAddr,
-			cfg.Server.ReadTimeout,
-			cfg.Server.WriteTimeout,
-		); err != nil {
-			log.Fatalf("Failed to start api server: %v", err)
+	// wait for interrupt signal, move listeners on SIGHUP
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case err := <-srv.Err():
+			log.Fatalf("Server failed: %v", err)
+		case sig := <-quit:
+			if sig != syscall.SIGHUP {
+				break wait
+			}
+			reloadConfig(srv)
 		}
-	}()
-	log.Printf("Api server started successfully on %s", httpAddr)
+	}
+	log.Printf("Shutting down server (timeout %s)...", cfg.Server.ShutdownTimeout)
 
-	// wait for interrupt signal
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	start := time.Now()
+	srv.Shutdown(ctx)
+	log.Printf("Server stopped in %s", time.Since(start).Round(time.Millisecond))
+}
 
-	// TODO: add graceful shutdown
-	log.Println("Server shutting down...")
+// reloadConfig 重新读取配置文件，把监听配置的变化应用到运行中的服务器
+func reloadConfig(srv *server.Server) {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Printf("Failed to reload config: %v", err)
+		return
+	}
+	srv.Reload(cfg.Server)
 }
@@ -0,0 +1,245 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// ErrInvalidToken 请求携带了未配置的令牌
+var ErrInvalidToken = errors.New("invalid token")
+
+// Policy 受限指标的访问控制策略
+//
+// 匹配某条规则的指标只对持有该规则scope的令牌可见，同时匹配多条规则时需要持有所有scope。
+// 未匹配任何规则的指标对所有请求可见，包括不带令牌的请求。
+// 令牌还可以限定Agent和标签，限定后只能看到匹配的Agent和标签的指标，用于多个团队共用一个服务器。
+type Policy struct {
+	tokens map[string]*Grant
+	rules  []config.ACLRule
+	// adminScope 访问管理和调试接口需要的scope
+	adminScope string
+}
+
+// NewPolicy 根据配置创建访问控制策略
+func NewPolicy(cfg config.ACLConfig) *Policy {
+	p := &Policy{
+		tokens:     make(map[string]*Grant, len(cfg.Tokens)),
+		rules:      cfg.Restricted,
+		adminScope: cfg.AdminScope,
+	}
+	for _, t := range cfg.Tokens {
+		p.tokens[t.Token] = p.GrantScopes(t.Scopes).Restrict(t.Agents, t.Labels)
+	}
+	return p
+}
+
+// Authenticate 返回令牌的授权，空令牌得到不含任何scope的授权
+func (p *Policy) Authenticate(token string) (*Grant, error) {
+	if token == "" {
+		return &Grant{policy: p}, nil
+	}
+	g, ok := p.tokens[token]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return g, nil
+}
+
+// GrantScopes 返回持有scopes的授权，用于已通过其他方式(如JWT)认证的请求，
+// p为nil(未启用访问控制)时授权只按Restrict的Agent和标签限定
+func (p *Policy) GrantScopes(scopes []string) *Grant {
+	g := &Grant{policy: p, scopes: make(map[string]bool, len(scopes))}
+	for _, scope := range scopes {
+		g.scopes[scope] = true
+	}
+	return g
+}
+
+// restricted 返回受限指标规则，p为nil时没有规则
+func (p *Policy) restricted() []config.ACLRule {
+	if p == nil {
+		return nil
+	}
+	return p.rules
+}
+
+// Grant 一次请求的授权，nil表示未启用访问控制
+type Grant struct {
+	policy *Policy
+	scopes map[string]bool
+	// agents 可见的Agent ID的glob模式，为空表示不限定
+	agents []string
+	// labels 可见指标必须匹配的标签选择器，值为glob，为空表示不限定
+	labels map[string]string
+}
+
+// Restrict 返回限定了Agent和标签的授权副本，agents和labels都为空时返回g本身
+func (g *Grant) Restrict(agents []string, labels map[string]string) *Grant {
+	if len(agents) == 0 && len(labels) == 0 {
+		return g
+	}
+	r := *g
+	r.agents = agents
+	r.labels = labels
+	return &r
+}
+
+// Restricted 判断授权是否限定了Agent或标签
+func (g *Grant) Restricted() bool {
+	return g != nil && (len(g.agents) > 0 || len(g.labels) > 0)
+}
+
+// Admin 判断授权是否持有管理scope，未配置管理scope时所有授权都不是管理员
+func (g *Grant) Admin() bool {
+	return g != nil && g.policy != nil && g.policy.adminScope != "" && g.scopes[g.policy.adminScope]
+}
+
+// AllowedAgent 判断授权是否可以查看Agent的数据，只检查Agent限定
+func (g *Grant) AllowedAgent(agentID string) bool {
+	if g == nil || len(g.agents) == 0 {
+		return true
+	}
+	for _, pattern := range g.agents {
+		if storage.MatchGlob(pattern, agentID) {
+			return true
+		}
+	}
+	return false
+}
+
+// OwnsAgent 判断授权是否可以访问Agent的全部数据，即未限定标签且Agent匹配，用于删除等按Agent整体操作的接口
+func (g *Grant) OwnsAgent(agentID string) bool {
+	return g == nil || (len(g.labels) == 0 && g.AllowedAgent(agentID))
+}
+
+// Allowed 判断指标对该授权是否可见
+func (g *Grant) Allowed(m *processor.ProcessedMetric) bool {
+	if g == nil {
+		return true
+	}
+	if !g.AllowedAgent(m.AgentID) || !labelsMatch(g.labels, m.Labels) {
+		return false
+	}
+	rules := g.policy.restricted()
+	for i := range rules {
+		rule := &rules[i]
+		if !g.scopes[rule.Scope] && ruleMatches(rule, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowedSeries 判断按指标名聚合、不含标签的序列是否可见，agentID为空表示跨Agent聚合
+//
+// 无法判断标签选择器，只要有匹配该指标名的规则未被授权就不可见；
+// 限定了标签的授权看不到任何聚合序列，限定了Agent的授权看不到跨Agent的聚合序列。
+func (g *Grant) AllowedSeries(agentID, name string) bool {
+	if g == nil {
+		return true
+	}
+	if len(g.labels) > 0 || (agentID == "" && len(g.agents) > 0) || !g.AllowedAgent(agentID) {
+		return false
+	}
+	rules := g.policy.restricted()
+	for i := range rules {
+		rule := &rules[i]
+		if !g.scopes[rule.Scope] && storage.MatchGlob(rule.Metric, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// SeesAll 判断授权是否可以查看全部数据，即未限定Agent和标签且持有所有受限规则的scope
+func (g *Grant) SeesAll() bool {
+	if g == nil {
+		return true
+	}
+	if g.Restricted() {
+		return false
+	}
+	for _, rule := range g.policy.restricted() {
+		if !g.scopes[rule.Scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply 把可见性条件加入存储查询条件，使limit作用于可见的数据而不是先截断再过滤
+func (g *Grant) Apply(filter *storage.Filter) {
+	if g.SeesAll() {
+		return
+	}
+	if allow := filter.Allow; allow != nil {
+		filter.Allow = func(m *processor.ProcessedMetric) bool { return allow(m) && g.Allowed(m) }
+		return
+	}
+	filter.Allow = g.Allowed
+}
+
+// Filter 返回可见的指标，有指标被移除时返回新切片，不修改metrics
+func (g *Grant) Filter(metrics []processor.ProcessedMetric) []processor.ProcessedMetric {
+	if g == nil {
+		return metrics
+	}
+	for i := range metrics {
+		if g.Allowed(&metrics[i]) {
+			continue
+		}
+		// 存储可能返回内部切片，复制后再过滤
+		result := make([]processor.ProcessedMetric, i, len(metrics)-1)
+		copy(result, metrics[:i])
+		for j := i + 1; j < len(metrics); j++ {
+			if g.Allowed(&metrics[j]) {
+				result = append(result, metrics[j])
+			}
+		}
+		return result
+	}
+	return metrics
+}
+
+// TokenFromHeader 从Authorization头中取出Bearer令牌
+func TokenFromHeader(header string) string {
+	const prefix = "bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+type grantKey struct{}
+
+// NewContext 返回携带授权的context
+func NewContext(ctx context.Context, g *Grant) context.Context {
+	return context.WithValue(ctx, grantKey{}, g)
+}
+
+// FromContext 返回context中的授权，没有时返回nil
+func FromContext(ctx context.Context) *Grant {
+	g, _ := ctx.Value(grantKey{}).(*Grant)
+	return g
+}
+
+// ruleMatches 判断指标名和标签是否匹配规则，规则中的每个标签都需要匹配
+func ruleMatches(rule *config.ACLRule, m *processor.ProcessedMetric) bool {
+	return storage.MatchGlob(rule.Metric, m.Name) && labelsMatch(rule.Labels, m.Labels)
+}
+
+// labelsMatch 判断标签是否匹配选择器，选择器中的每个标签都需要存在且匹配
+func labelsMatch(selector, labels map[string]string) bool {
+	for k, pattern := range selector {
+		v, ok := labels[k]
+		if !ok || !storage.MatchGlob(pattern, v) {
+			return false
+		}
+	}
+	return true
+}
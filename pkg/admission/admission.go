@@ -0,0 +1,237 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"golang.org/x/time/rate"
+)
+
+// ErrClosed 准入控制器已关闭
+var ErrClosed = errors.New("admission controller closed")
+
+// Stats 准入控制状态
+type Stats struct {
+	Queued   int     `json:"queued"`
+	Capacity int     `json:"capacity"`
+	Rate     float64 `json:"rate"`
+	Admitted uint64  `json:"admitted"`
+	Written  uint64  `json:"written"`
+	Blocked  uint64  `json:"blocked"`
+}
+
+// Controller 在接入和存储之间的突发缓冲区
+//
+// Submit把数据放入容量有限的缓冲区后立即返回，缓冲区满时阻塞，
+// 调用方停止读取Agent数据，由QUIC流控把压力反馈给Agent。
+// 后台协程按速率限制把缓冲区中的数据写入存储，启动后速率在RampDuration内
+// 从RampStart*Rate线性增加到Rate，避免重启后大量Agent同时补发积压数据时压垮存储。
+type Controller struct {
+	write     func([]processor.ProcessedMetric) error
+	capacity  int
+	rate      float64
+	rampStart float64
+	ramp      time.Duration
+	started   time.Time
+	limiter   *rate.Limiter
+
+	mu     sync.Mutex
+	queue  [][]processor.ProcessedMetric
+	queued int
+	freed  chan struct{}
+	notify chan struct{}
+	closed bool
+	stats  Stats
+
+	done chan struct{}
+}
+
+// NewController 创建准入控制器并启动写入协程，write为实际写入存储的函数
+func NewController(cfg config.AdmissionConfig, write func([]processor.ProcessedMetric) error) *Controller {
+	c := &Controller{
+		write:     write,
+		capacity:  cfg.BufferSize,
+		rate:      cfg.Rate,
+		rampStart: cfg.RampStart,
+		ramp:      cfg.RampDuration,
+		started:   time.Now(),
+		limiter:   rate.NewLimiter(rate.Inf, 0),
+		freed:     make(chan struct{}),
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if c.rate > 0 {
+		c.limiter = rate.NewLimiter(rate.Limit(c.currentRate()), max(int(c.rate), 1))
+	}
+
+	go c.run()
+	return c
+}
+
+// Submit 把数据放入缓冲区，缓冲区没有足够空间时阻塞直到有空间或ctx结束
+//
+// 缓冲区为空时总是接受，因此大于容量的批次也能写入。
+func (c *Controller) Submit(ctx context.Context, metrics []processor.ProcessedMetric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	blocked := false
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return ErrClosed
+		}
+		if c.queued == 0 || c.queued+len(metrics) <= c.capacity {
+			c.queue = append(c.queue, metrics)
+			c.queued += len(metrics)
+			c.stats.Admitted += uint64(len(metrics))
+			c.mu.Unlock()
+
+			select {
+			case c.notify <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+		if !blocked {
+			blocked = true
+			c.stats.Blocked++
+		}
+		freed := c.freed
+		c.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stats 返回当前状态
+func (c *Controller) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Queued = c.queued
+	stats.Capacity = c.capacity
+	stats.Rate = c.currentRate()
+	return stats
+}
+
+// Close 停止接受数据，不再限速地写出缓冲区中剩余的数据，ctx到期后返回错误
+func (c *Controller) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.limiter.SetLimit(rate.Inf)
+		close(c.freed)
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run 按速率限制把缓冲区中的数据写入存储
+func (c *Controller) run() {
+	defer close(c.done)
+
+	for {
+		batch, ok := c.next()
+		if !ok {
+			return
+		}
+
+		// 按令牌桶容量分块，使单次等待不超过burst
+		for len(batch) > 0 {
+			n := len(batch)
+			if burst := c.limiter.Burst(); c.limiter.Limit() != rate.Inf && n > burst {
+				n = burst
+			}
+			c.adjustRate()
+			c.limiter.WaitN(context.Background(), n)
+
+			if err := c.write(batch[:n]); err != nil {
+				log.Printf("Failed to save admitted metrics: %v", err)
+			}
+			batch = batch[n:]
+			c.release(n)
+		}
+	}
+}
+
+// next 取出最旧的批次，缓冲区为空时等待，关闭且已写完时返回false
+func (c *Controller) next() ([]processor.ProcessedMetric, bool) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			batch := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return batch, true
+		}
+		closed := c.closed
+		c.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		<-c.notify
+	}
+}
+
+// release 释放已写入数据占用的缓冲区空间，唤醒等待空间的Submit
+func (c *Controller) release(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.queued -= n
+	c.stats.Written += uint64(n)
+	if !c.closed {
+		close(c.freed)
+		c.freed = make(chan struct{})
+	}
+}
+
+// adjustRate 按启动后经过的时间更新写入速率，关闭后不再限速
+func (c *Controller) adjustRate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rate > 0 && !c.closed {
+		c.limiter.SetLimit(rate.Limit(c.currentRate()))
+	}
+}
+
+// currentRate 返回当前允许的写入速率，0表示不限制
+func (c *Controller) currentRate() float64 {
+	if c.rate <= 0 {
+		return 0
+	}
+	elapsed := time.Since(c.started)
+	if c.ramp <= 0 || elapsed >= c.ramp {
+		return c.rate
+	}
+	frac := c.rampStart + (1-c.rampStart)*float64(elapsed)/float64(c.ramp)
+	// 速率为0时令牌桶不再补充，至少允许每秒写入一条
+	return max(c.rate*frac, 1)
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/jwtauth"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// WithACL 按令牌的scope隐藏受限指标，查询请求携带未配置的令牌时返回401
+func WithACL(policy *acl.Policy) Option {
+	return func(s *APIServer) {
+		s.acl = policy
+	}
+}
+
+// WithJWT 接受verifier校验通过的JWT，管理接口需要adminRole，删除接口需要deleteRole或adminRole
+func WithJWT(verifier *jwtauth.Verifier, adminRole, deleteRole string) Option {
+	return func(s *APIServer) {
+		s.jwt = verifier
+		s.adminRole = adminRole
+		s.deleteRole = deleteRole
+	}
+}
+
+// authorize 解析请求的令牌并把授权放入请求context
+//
+// 启用JWT时JWT格式的令牌按签发方校验，其角色同时作为访问控制的scope，agents_claim限定可见的Agent，
+// 其余令牌按访问控制的静态令牌处理。
+func (s *APIServer) authorize(c *gin.Context) {
+	token := acl.TokenFromHeader(c.GetHeader("Authorization"))
+	if s.jwt != nil && jwtauth.LooksLikeJWT(token) {
+		id, ok := s.authenticateJWT(c, token)
+		if !ok {
+			return
+		}
+		if s.acl != nil || len(id.Agents) > 0 {
+			c.Request = c.Request.WithContext(acl.NewContext(c.Request.Context(), s.acl.GrantScopes(id.RoleList()).Restrict(id.Agents, nil)))
+		}
+		c.Next()
+		return
+	}
+	if s.acl == nil {
+		c.Next()
+		return
+	}
+
+	grant, err := s.acl.Authenticate(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request = c.Request.WithContext(acl.NewContext(c.Request.Context(), grant))
+	c.Next()
+}
+
+// authenticateJWT 校验JWT并把身份放入请求context，校验失败时输出401并返回false
+func (s *APIServer) authenticateJWT(c *gin.Context, token string) (*jwtauth.Identity, bool) {
+	id, err := s.jwt.Verify(token)
+	if err != nil {
+		log.Printf("Rejected JWT from %s: %v", c.ClientIP(), err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	c.Request = c.Request.WithContext(jwtauth.NewContext(c.Request.Context(), id))
+	return id, true
+}
+
+// requireRole 启用JWT时要求请求的令牌持有任一角色，缺少令牌返回401，角色不足返回403
+func (s *APIServer) requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.jwt == nil {
+			c.Next()
+			return
+		}
+
+		id := jwtauth.FromContext(c.Request.Context())
+		if id == nil {
+			token := acl.TokenFromHeader(c.GetHeader("Authorization"))
+			if !jwtauth.LooksLikeJWT(token) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a bearer jwt is required"})
+				return
+			}
+			var ok bool
+			if id, ok = s.authenticateJWT(c, token); !ok {
+				return
+			}
+		}
+		if !id.HasRole(roles...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token lacks the required role"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireAdmin 管理和调试接口的授权，应在authorize和requireRole之后执行
+//
+// 启用ACL时以静态令牌访问需要持有管理scope，缺少令牌返回401，scope不足返回403；
+// 通过JWT认证的请求已由requireRole检查管理角色。两种方式都不能限定Agent或标签。
+func (s *APIServer) requireAdmin(c *gin.Context) {
+	grant := acl.FromContext(c.Request.Context())
+	if s.acl != nil && jwtauth.FromContext(c.Request.Context()) == nil && !grant.Admin() {
+		if acl.TokenFromHeader(c.GetHeader("Authorization")) == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "a token with the admin scope is required"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token lacks the admin scope"})
+		return
+	}
+	s.requireUnrestricted(c)
+}
+
+// requireUnrestricted 拒绝限定了Agent或标签的令牌访问跨Agent的汇总和操作接口
+func (s *APIServer) requireUnrestricted(c *gin.Context) {
+	if acl.FromContext(c.Request.Context()).Restricted() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token is restricted to specific agents or labels"})
+		return
+	}
+	c.Next()
+}
+
+// visible 移除请求无权查看的指标
+func visible(c *gin.Context, metrics []processor.ProcessedMetric) []processor.ProcessedMetric {
+	return acl.FromContext(c.Request.Context()).Filter(metrics)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// getAggregate 在服务端按时间窗口聚合指标，避免面板拉取原始数据后自行聚合
+//
+// 参数为name、agg(avg、min、max、sum或count，默认avg)、step(窗口宽度，默认1m)、
+// start/end(毫秒，默认最近一小时)和可选的agent_id，不指定agent_id时聚合所有Agent。
+// 指数直方图指标还支持agg=quantile(配合q=0.99等估算分位数)和agg=histogram(输出合并后的直方图)。
+func (s *APIServer) getAggregate(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	now := s.clock.Now().UnixMilli()
+	start, err := strconv.ParseInt(c.DefaultQuery("start", strconv.FormatInt(now-time.Hour.Milliseconds(), 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start timestamp"})
+		return
+	}
+	end, err := strconv.ParseInt(c.DefaultQuery("end", strconv.FormatInt(now, 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end timestamp"})
+		return
+	}
+	step, err := time.ParseDuration(c.DefaultQuery("step", "1m"))
+	if err != nil || step < time.Millisecond {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid step"})
+		return
+	}
+	if end < start || (end-start)/step.Milliseconds() >= maxStepPoints {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range or too many points"})
+		return
+	}
+
+	// 聚合结果不含标签，受限规则按指标名保守判断
+	if !acl.FromContext(c.Request.Context()).AllowedSeries(c.Query("agent_id"), name) {
+		c.JSON(http.StatusOK, []storage.AggregatePoint{})
+		return
+	}
+
+	var quantile float64
+	if q := c.Query("q"); q != "" {
+		if quantile, err = strconv.ParseFloat(q, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid q"})
+			return
+		}
+	}
+
+	query := storage.AggregateQuery{
+		AgentID:  c.Query("agent_id"),
+		Name:     name,
+		Func:     c.DefaultQuery("agg", storage.AggregateAvg),
+		Quantile: quantile,
+		Step:     step,
+		Start:    time.UnixMilli(start),
+		End:      time.UnixMilli(end),
+	}
+	if err := query.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	points, err := s.store(c).Aggregate(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+	// 分位数结果不需要输出合并后的直方图
+	if query.Func == storage.AggregateQuantile {
+		for i := range points {
+			points[i].Histogram = nil
+		}
+	}
+
+	c.JSON(http.StatusOK, points)
+}
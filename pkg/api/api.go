@@ -1,27 +1,239 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/admission"
+	"github.com/konpure/Kon-Agent-export/pkg/availability"
+	"github.com/konpure/Kon-Agent-export/pkg/bans"
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/commands"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/connections"
+	"github.com/konpure/Kon-Agent-export/pkg/dedup"
+	"github.com/konpure/Kon-Agent-export/pkg/exposition"
+	"github.com/konpure/Kon-Agent-export/pkg/fleet"
+	"github.com/konpure/Kon-Agent-export/pkg/grafana"
+	"github.com/konpure/Kon-Agent-export/pkg/graphql"
+	"github.com/konpure/Kon-Agent-export/pkg/handshake"
+	"github.com/konpure/Kon-Agent-export/pkg/importer"
+	"github.com/konpure/Kon-Agent-export/pkg/influx"
+	"github.com/konpure/Kon-Agent-export/pkg/ingestrate"
+	"github.com/konpure/Kon-Agent-export/pkg/inventory"
+	"github.com/konpure/Kon-Agent-export/pkg/jwtauth"
+	"github.com/konpure/Kon-Agent-export/pkg/metadata"
+	"github.com/konpure/Kon-Agent-export/pkg/nats"
+	"github.com/konpure/Kon-Agent-export/pkg/onchange"
+	"github.com/konpure/Kon-Agent-export/pkg/otlp"
+	"github.com/konpure/Kon-Agent-export/pkg/packs"
+	"github.com/konpure/Kon-Agent-export/pkg/pinning"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/promql"
+	"github.com/konpure/Kon-Agent-export/pkg/queries"
+	"github.com/konpure/Kon-Agent-export/pkg/quota"
+	"github.com/konpure/Kon-Agent-export/pkg/remoteread"
+	"github.com/konpure/Kon-Agent-export/pkg/remotewrite"
+	"github.com/konpure/Kon-Agent-export/pkg/selfmetrics"
+	"github.com/konpure/Kon-Agent-export/pkg/sla"
+	"github.com/konpure/Kon-Agent-export/pkg/staleness"
 	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/rollup"
+	"github.com/konpure/Kon-Agent-export/pkg/stream"
+	"github.com/konpure/Kon-Agent-export/pkg/timeline"
+	"github.com/konpure/Kon-Agent-export/pkg/topk"
+	"github.com/konpure/Kon-Agent-export/pkg/udf"
+	"github.com/konpure/Kon-Agent-export/pkg/writehook"
 )
 
 // APIServer HTTP API服务器
 type APIServer struct {
-	storage storage.Storage
-	server  *http.Server
+	storage    storage.Storage
+	server     *http.Server
+	clock      clock.Clock
+	udfs       *udf.Registry
+	handshakes *handshake.Recorder
+	pins       *pinning.Registry
+	importer   *importer.Importer
+	queries    *queries.Tracker
+	sla        *sla.Tracker
+	// timeline 各Agent的活动时间线
+	timeline *timeline.Recorder
+	// connections 当前的QUIC连接
+	connections *connections.Registry
+	// bans 封禁的Agent
+	bans *bans.List
+	// quotas Agent和租户的写入配额
+	quotas *quota.Tracker
+	// mergeConflicts 按需压缩存储时默认是否合并时间戳相同但值不同的数据
+	mergeConflicts bool
+	// debug 是否提供/debug/pprof和/debug/vars
+	debug bool
+	// selfMetrics 服务器自身的指标，挂载在selfMetricsPath，为nil时不记录请求延迟
+	selfMetrics     *selfmetrics.Metrics
+	selfMetricsPath string
+	// metadata 指标的展示提示，为nil时查询结果不附带提示
+	metadata *metadata.Registry
+	// availability 按上报记录统计的Agent可用率
+	availability *availability.Tracker
+	webhook      *webhookIngest
+	otlp         *otlp.Receiver
+	otlpExport   *otlp.Exporter
+	nats         *nats.Publisher
+	influx       *influx.Receiver
+	commands     *commands.Manager
+	cors         *config.CORSConfig
+	onChange     *onchange.Filter
+	acl          *acl.Policy
+	jwt          *jwtauth.Verifier
+	adminRole    string
+	deleteRole   string
+	admission    *admission.Controller
+	rollups      *rollup.Store
+	evictions    *evictionLog
+	topk         *topk.Tracker
+	fleet        *fleet.Tracker
+	staleness    *staleness.Tracker
+	inventory    *inventory.Inventory
+	packs        *packs.Manager
+	// ingestRates 按Agent统计的接入速率水位
+	ingestRates *ingestrate.Meter
+	stream      *stream.Hub
+	chaos       *chaos.Injector
+	dedup       *dedup.Filter
+	remoteWrite *remotewrite.Forwarder
+	// writeHooks 数据写入存储后调用的钩子
+	writeHooks *writehook.Dispatcher
+	// prometheus 各序列最新值的Prometheus抓取接口，挂载在prometheusPath
+	prometheus     *exposition.Collector
+	prometheusPath string
+	// prometheusTenantPath 按租户抓取的路径前缀，为空表示未划分租户
+	prometheusTenantPath string
+	// remoteRead Prometheus remote_read接口，挂载在remoteReadPath
+	remoteRead     *remoteread.Reader
+	remoteReadPath string
+	// grafana Grafana JSON数据源接口，挂载在grafanaPath下
+	grafana     *grafana.Datasource
+	grafanaPath string
+	// graphql GraphQL查询接口，挂载在graphqlPath
+	graphql     *graphql.Schema
+	graphqlPath string
+	// promql PromQL子集查询接口，挂载在/api/v1/query和/api/v1/query_range
+	promql *promql.Engine
+	// timestampFormat 未指定timestamp_format参数时的时间戳输出格式
+	timestampFormat string
+	// routeTimeouts 按"方法 路径"索引的接口超时，方法为空的配置匹配所有方法
+	routeTimeouts map[string]config.RouteTimeoutConfig
+	// rateLimit 按客户端IP和API令牌的请求限流，为nil时不限流
+	rateLimit *rateLimiter
+	// compression 响应压缩，为nil时不压缩
+	compression *responseCompression
+	// snapshots 查询快照，为nil时不支持snapshot_id参数
+	snapshots *querySnapshots
+	// tls 不为nil时提供HTTPS，redirect在redirectPort把HTTP请求重定向到HTTPS
+	tls          *tls.Config
+	redirect     *http.Server
+	redirectPort int
+	// listenMu 保护Rebind切换的监听状态，handler是所有服务器共享的路由
+	listenMu sync.Mutex
+	addr     string
+	listener *tlsListener
+	handler  http.Handler
+	// readTimeout和writeTimeout 新建的服务器使用的超时
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// Option API服务器可选配置
+type Option func(*APIServer)
+
+// WithClock 设置API服务器使用的时钟
+func WithClock(clk clock.Clock) Option {
+	return func(s *APIServer) {
+		s.clock = clk
+	}
+}
+
+// WithCORS 允许配置的来源跨域访问API，未设置时只允许同源访问
+func WithCORS(cfg config.CORSConfig) Option {
+	return func(s *APIServer) {
+		s.cors = &cfg
+	}
+}
+
+// WithTimestampFormat 设置默认的时间戳输出格式，请求可用timestamp_format参数覆盖
+func WithTimestampFormat(format string) Option {
+	return func(s *APIServer) {
+		s.timestampFormat = format
+	}
+}
+
+// WithUDFRegistry 启用WASM处理函数管理接口
+func WithUDFRegistry(registry *udf.Registry) Option {
+	return func(s *APIServer) {
+		s.udfs = registry
+	}
+}
+
+// WithHandshakeRecorder 启用握手统计接口
+func WithHandshakeRecorder(recorder *handshake.Recorder) Option {
+	return func(s *APIServer) {
+		s.handshakes = recorder
+	}
+}
+
+// WithImporter 启用历史数据导入接口
+func WithImporter(im *importer.Importer) Option {
+	return func(s *APIServer) {
+		s.importer = im
+	}
+}
+
+// WithQueryTracker 登记运行中的查询，并启用查询管理接口
+func WithQueryTracker(tracker *queries.Tracker) Option {
+	return func(s *APIServer) {
+		s.queries = tracker
+	}
+}
+
+// WithSLATracker 启用上报新鲜度SLA报告接口
+func WithSLATracker(tracker *sla.Tracker) Option {
+	return func(s *APIServer) {
+		s.sla = tracker
+	}
+}
+
+// WithAdmission 启用接入准入控制状态接口
+func WithAdmission(controller *admission.Controller) Option {
+	return func(s *APIServer) {
+		s.admission = controller
+	}
 }
 
 // NewAPIServer 创建API服务器实例
-func NewAPIServer(storage storage.Storage) *APIServer {
-	return &APIServer{
+func NewAPIServer(storage storage.Storage, opts ...Option) *APIServer {
+	s := &APIServer{
 		storage: storage,
+		clock:   clock.Real(),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Start 启动API服务器
@@ -29,36 +241,285 @@ func (s *APIServer) Start(addr string, readTimeout, writeTimeout time.Duration)
 	// 创建Gin引擎
 	r := gin.Default()
 
-	// 配置CORS
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	// 请求延迟包括其他中间件的耗时，如限流和压缩
+	if s.selfMetrics != nil {
+		r.Use(s.observeRequest)
+	}
+
+	// 配置CORS，未配置允许的来源时不返回CORS头，浏览器只允许同源访问
+	if s.cors != nil && len(s.cors.AllowedOrigins) > 0 {
+		r.Use(cors.New(corsConfig(s.cors)))
+	}
+	if len(s.routeTimeouts) > 0 {
+		r.Use(s.applyRouteTimeouts)
+	}
+	// 限流按客户端IP计数，只信任trusted_proxies转发的X-Forwarded-For，避免客户端伪造IP绕过限流
+	if s.rateLimit != nil {
+		if err := r.SetTrustedProxies(s.rateLimit.cfg.TrustedProxies); err != nil {
+			return fmt.Errorf("invalid trusted proxies: %w", err)
+		}
+		r.Use(s.limitRate)
+	}
+	if s.compression != nil {
+		r.Use(s.compressResponse)
+	}
+
+	if s.selfMetrics != nil {
+		r.GET(s.selfMetricsPath, s.authorize, s.getSelfMetrics)
+	}
+	if s.prometheus != nil {
+		r.GET(s.prometheusPath, s.authorize, s.getPrometheusMetrics)
+		if s.prometheusTenantPath != "" {
+			r.GET(s.prometheusTenantPath+"/:tenant", s.authorize, s.getTenantPrometheusMetrics)
+		}
+	}
+	if s.otlp != nil {
+		r.POST("/v1/metrics", s.ingestOTLP)
+	}
+	if s.influx != nil {
+		r.POST(influxV2Path, s.ingestInflux)
+	}
+	if s.remoteRead != nil {
+		r.POST(s.remoteReadPath, s.authorize, s.scopeNamespace, s.useSnapshot, s.trackQuery, s.readRemote)
+	}
+	if s.grafana != nil {
+		g := r.Group(s.grafanaPath, s.authorize, s.scopeNamespace, s.useSnapshot)
+		g.GET("/", s.testGrafana)
+		g.POST("/search", s.trackQuery, s.searchGrafana)
+		g.POST("/query", s.trackQuery, s.queryGrafana)
+		g.POST("/annotations", s.trackQuery, s.annotateGrafana)
+	}
+	if s.graphql != nil {
+		r.GET(s.graphqlPath, s.authorize, s.scopeNamespace, s.useSnapshot, s.trackQuery, s.queryGraphQL)
+		r.POST(s.graphqlPath, s.authorize, s.scopeNamespace, s.useSnapshot, s.trackQuery, s.queryGraphQL)
+	}
 
-	// 定义API路由
+	// 定义API路由，/api/v2提供相同的接口，响应包装为统一的信封
 	api := r.Group("/api/v1")
-	{
-		api.GET("/metrics", s.getAllMetrics)
-		api.GET("/metrics/:agent_id", s.getMetricsByAgentID)
-		api.GET("/metrics/type/:metric_type", s.getMetricsByType)
-		api.GET("/metrics/latest", s.getLatestMetrics)
-		api.GET("/metrics/range", s.getMetricsByTimeRange)
+	s.registerAPI(api, false)
+	s.registerAPI(r.Group("/api/v2", s.envelope), true)
+
+	// 调试接口与管理API一样需要管理角色或管理scope，性能剖析和trace的持续时间可能超过写超时
+	if s.debug {
+		debug := r.Group("/debug", s.authorize, s.requireRole(s.adminRole), s.requireAdmin, s.streaming)
+		debug.GET("/vars", s.getDebugVars)
+		debug.GET("/pprof/*profile", s.getPprof)
+		debug.POST("/pprof/symbol", s.getPprof)
 	}
 
-	// 定义HTTP服务器
-	s.server = &http.Server{
-		Addr:         addr,
-		Handler:      r,
-		ReadTimeout:  readTimeout,
-		WriteTimeout: writeTimeout,
+	// 定义管理API路由，启用JWT时需要管理角色，启用ACL时静态令牌需要管理scope
+	admin := api.Group("/admin", s.authorize, s.requireRole(s.adminRole), s.requireAdmin)
+	admin.POST("/storage/cleanup", s.scopeNamespace, s.cleanupStorage)
+	admin.POST("/storage/compact", s.scopeNamespace, s.compactStorage)
+	if s.udfs != nil {
+		admin.GET("/udfs", s.listUDFs)
+		admin.PUT("/udfs/:name", s.uploadUDF)
+		admin.DELETE("/udfs/:name", s.deleteUDF)
+	}
+	if s.handshakes != nil {
+		admin.GET("/handshakes", s.getHandshakeStats)
+		admin.GET("/handshakes/failures", s.getHandshakeFailures)
+	}
+	if s.pins != nil {
+		admin.GET("/pins", s.listPins)
+		admin.GET("/pins/mismatches", s.listPinMismatches)
+		admin.DELETE("/pins/:agent_id", s.forgetPin)
+	}
+	if s.importer != nil {
+		admin.POST("/import", s.importMetrics)
+	}
+	if s.admission != nil {
+		admin.GET("/admission", s.getAdmissionStats)
+	}
+	if s.chaos != nil {
+		admin.GET("/chaos", s.getChaosStats)
+	}
+	if s.dedup != nil {
+		admin.GET("/dedup", s.getDedupStats)
+	}
+	if s.rollups != nil {
+		admin.GET("/rollups", s.getRollupStats)
+	}
+	if s.remoteWrite != nil {
+		admin.GET("/remote_write", s.getRemoteWriteStats)
+	}
+	if s.writeHooks != nil {
+		admin.GET("/write_hooks", s.getWriteHookStats)
+	}
+	if s.otlpExport != nil {
+		admin.GET("/otlp_export", s.getOTLPExportStats)
+	}
+	if s.nats != nil {
+		admin.GET("/nats", s.getNATSStats)
+	}
+	if s.evictions != nil {
+		admin.GET("/evictions", s.listEvictions)
+	}
+	if s.queries != nil {
+		admin.GET("/queries", s.listQueries)
+		admin.DELETE("/queries/:id", s.cancelQuery)
+	}
+	if s.connections != nil {
+		admin.GET("/agents", s.listConnectedAgents)
+		admin.POST("/agents/:agent_id/disconnect", s.disconnectAgent)
+	}
+	if s.bans != nil {
+		admin.GET("/bans", s.listBans)
+		admin.PUT("/bans/:agent_id", s.banAgent)
+		admin.DELETE("/bans/:agent_id", s.unbanAgent)
+	}
+	if s.quotas != nil {
+		admin.GET("/quotas", s.getQuotas)
+	}
+	if s.commands != nil {
+		admin.POST("/agents/:agent_id/commands", s.submitCommand)
+		admin.GET("/commands", s.listCommands)
+		admin.GET("/commands/:id", s.getCommand)
+		admin.GET("/commands/:id/result", s.getCommandResult)
+	}
+	if s.inventory != nil {
+		admin.POST("/inventory", s.importInventory)
+	}
+	if s.packs != nil {
+		admin.GET("/packs", s.listPacks)
+		admin.POST("/packs", s.importPack)
+		admin.GET("/packs/:name", s.exportPack)
+		admin.DELETE("/packs/:name", s.deletePack)
 	}
 
-	log.Printf("HTTP API server starting on %s", addr)
-	return s.server.ListenAndServe()
+	s.checkRouteTimeouts(r.Routes())
+
+	// 监听地址和TLS配置可以由Rebind切换，各服务器共享同一个路由
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listenMu.Lock()
+	s.handler = r
+	s.readTimeout, s.writeTimeout = readTimeout, writeTimeout
+	server := s.serve(addr, newTLSListener(ln, s.tls))
+	listener := s.listener
+	if s.tls != nil && s.redirectPort != 0 {
+		err = s.startRedirect(s.redirectPort)
+	}
+	s.listenMu.Unlock()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	log.Printf("HTTP API server starting on %s (tls: %t)", addr, s.tls != nil)
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// registerAPI 注册/api/v1和/api/v2共有的接口，envelope为true时不注册无法包装为信封的流式接口和协议固定的写入接口
+func (s *APIServer) registerAPI(api *gin.RouterGroup, envelope bool) {
+	// 查询接口登记到查询跟踪器，便于管理员取消，带snapshot_id参数时查询快照
+	query := api.Group("", s.authorize, s.scopeNamespace, s.useSnapshot, s.trackQuery)
+	if s.metadata != nil {
+		query.Use(s.attachHints)
+	}
+	query.GET("/metrics", s.getAllMetrics)
+	query.GET("/metrics/:agent_id", s.getMetricsByAgentID)
+	query.GET("/metrics/type/:metric_type", s.getMetricsByType)
+	query.GET("/metrics/latest", s.getLatestMetrics)
+	query.GET("/metrics/range", s.getMetricsByTimeRange)
+	query.GET("/metrics/query", s.getMetricsByLabels)
+	query.GET("/metrics/aggregate", s.getAggregate)
+	query.GET("/metrics/diff", s.getMetricDiff)
+	if s.topk != nil {
+		query.GET("/topk", s.getTopK)
+	}
+	if s.fleet != nil {
+		query.GET("/fleet/summary", s.requireUnrestricted, s.getFleetSummary)
+	}
+	if s.staleness != nil {
+		query.GET("/series/stale", s.getStaleSeries)
+	}
+	if s.promql != nil {
+		query.GET("/query", s.queryPromQL)
+		query.POST("/query", s.queryPromQL)
+		query.GET("/query_range", s.queryPromQLRange)
+		query.POST("/query_range", s.queryPromQLRange)
+	}
+	query.GET("/metrics/step", s.getStepSeries)
+	query.GET("/metrics/correlate", s.getCorrelations)
+	if !envelope {
+		query.GET("/metrics/export", s.streaming, s.exportMetrics)
+	}
+	if s.snapshots != nil {
+		api.POST("/snapshots", s.authorize, s.scopeNamespace, s.createSnapshot)
+		api.DELETE("/snapshots/:id", s.authorize, s.releaseSnapshot)
+	}
+
+	// 删除接口不登记到查询跟踪器，需要持有有效令牌，启用JWT时还需要删除角色，
+	// 限定了Agent的令牌只能按Agent删除可见Agent的数据
+	deleteRole := s.requireRole(s.deleteRole, s.adminRole)
+	api.DELETE("/metrics/:agent_id", s.authorize, deleteRole, s.scopeNamespace, s.deleteMetricsByAgentID)
+	api.DELETE("/metrics/type/:metric_type", s.authorize, deleteRole, s.requireUnrestricted, s.scopeNamespace, s.deleteMetricsByType)
+	api.DELETE("/metrics/range", s.authorize, deleteRole, s.requireUnrestricted, s.scopeNamespace, s.deleteMetricsByTimeRange)
+
+	api.GET("/stats", s.authorize, s.requireUnrestricted, s.scopeNamespace, s.getStats)
+	if s.metadata != nil {
+		api.GET("/hints", s.authorize, s.getHints)
+		api.GET("/hints/:name", s.authorize, s.getHint)
+	}
+	api.GET("/dashboards", s.listDashboards)
+	api.GET("/dashboards/:name", s.getDashboard)
+	if s.ingestRates != nil {
+		api.GET("/ingest/rates", s.authorize, s.requireUnrestricted, s.getIngestRates)
+	}
+	if s.stream != nil && !envelope {
+		api.GET("/stream", s.authorizeStream, s.streamMetrics)
+		api.GET("/events", s.authorizeStream, s.streaming, s.streamEvents)
+	}
+
+	if s.availability != nil {
+		api.GET("/availability", s.authorize, s.getAvailability)
+	}
+	if s.timeline != nil {
+		api.GET("/agents/:agent_id/timeline", s.authorize, s.getAgentTimeline)
+	}
+	if s.inventory != nil {
+		api.GET("/inventory", s.authorize, s.requireUnrestricted, s.getInventory)
+	}
+	if s.sla != nil {
+		api.GET("/sla", s.authorize, s.getSLAReport)
+		api.GET("/sla/alerts", s.authorize, s.getSLAAlerts)
+	}
+	if s.webhook != nil && !envelope {
+		api.POST("/ingest/webhook/:source", s.ingestWebhook)
+	}
+	if s.influx != nil && !envelope {
+		api.POST("/write", s.ingestInflux)
+	}
+	if s.packs != nil {
+		api.GET("/queries/saved", s.authorize, s.listSavedQueries)
+		api.GET("/queries/saved/:pack/:name", s.authorize, s.runSavedQuery)
+	}
+}
+
+// corsConfig 转换跨域配置，允许所有来源时不允许携带凭据
+func corsConfig(cfg *config.CORSConfig) cors.Config {
+	c := cors.Config{
+		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
+		ExposeHeaders:    []string{"Content-Length"},
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			c.AllowAllOrigins = true
+			c.AllowCredentials = false
+			return c
+		}
+	}
+	c.AllowOrigins = cfg.AllowedOrigins
+	return c
 }
 
 // getAllMetrics 获取所有监控数据
@@ -66,14 +527,30 @@ func (s *APIServer) getAllMetrics(c *gin.Context) {
 	// 获取查询参数
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
 
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if paginated(c) {
+		s.renderPage(c, view, storage.Filter{}, limit)
+		return
+	}
+
 	// 调用存储层获取最新数据
-	metrics, err := s.storage.GetLatestMetrics(limit)
+	metrics, err := s.queryList(c, view, &storage.Filter{}, limit, func() ([]processor.ProcessedMetric, error) {
+		return s.store(c).GetLatestMetrics(limit)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if s.queryCanceled(c) {
+		return
+	}
 
-	c.JSON(http.StatusOK, metrics)
+	view.render(c, metrics)
 }
 
 // getMetricsByAgentID 按Agent ID获取监控数据
@@ -88,14 +565,30 @@ func (s *APIServer) getMetricsByAgentID(c *gin.Context) {
 	// 获取查询参数
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
 
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if paginated(c) {
+		s.renderPage(c, view, storage.Filter{AgentID: agentID}, limit)
+		return
+	}
+
 	// 调用存储层获取数据
-	metrics, err := s.storage.GetMetricsByAgentID(agentID, limit)
+	metrics, err := s.queryList(c, view, &storage.Filter{AgentID: agentID}, limit, func() ([]processor.ProcessedMetric, error) {
+		return s.store(c).GetMetricsByAgentID(agentID, limit)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if s.queryCanceled(c) {
+		return
+	}
 
-	c.JSON(http.StatusOK, metrics)
+	view.render(c, metrics)
 }
 
 // getMetricsByType 按指标类型获取监控数据
@@ -110,14 +603,25 @@ func (s *APIServer) getMetricsByType(c *gin.Context) {
 	// 获取查询参数
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
 
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	// 调用存储层获取数据
-	metrics, err := s.storage.GetMetricsByType(metricType, limit)
+	metrics, err := s.queryList(c, view, &storage.Filter{Type: metricType}, limit, func() ([]processor.ProcessedMetric, error) {
+		return s.store(c).GetMetricsByType(metricType, limit)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if s.queryCanceled(c) {
+		return
+	}
 
-	c.JSON(http.StatusOK, metrics)
+	view.render(c, metrics)
 }
 
 // getLatestMetrics 获取最新监控数据
@@ -125,21 +629,45 @@ func (s *APIServer) getLatestMetrics(c *gin.Context) {
 	// 获取查询参数
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 
-	// 调用存储层获取最新数据
-	metrics, err := s.storage.GetLatestMetrics(limit)
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 调用存储层获取最新数据，排序只作用于这limit条最新数据；有指标名条件或令牌不能查看全部数据时取满足条件的最新数据
+	var filter *storage.Filter
+	if view.name != nil || !acl.FromContext(c.Request.Context()).SeesAll() {
+		filter = &storage.Filter{}
+	}
+	metrics, err := s.queryList(c, view, filter, limit, func() ([]processor.ProcessedMetric, error) {
+		return s.store(c).GetLatestMetrics(limit)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if s.queryCanceled(c) {
+		return
+	}
+	if filter != nil && view.sort == nil {
+		// 与不带条件时一致，按从旧到新输出
+		slices.Reverse(metrics)
+	}
+	if s.staleness != nil && c.Query("include_stale") != "true" {
+		metrics = slices.DeleteFunc(metrics, func(m processor.ProcessedMetric) bool {
+			return s.staleness.Stale(&m)
+		})
+	}
 
-	c.JSON(http.StatusOK, metrics)
+	view.render(c, metrics)
 }
 
 // getMetricsByTimeRange 按时间范围获取监控数据
 func (s *APIServer) getMetricsByTimeRange(c *gin.Context) {
 	// 获取查询参数
 	startStr := c.DefaultQuery("start", "0")
-	endStr := c.DefaultQuery("end", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	endStr := c.DefaultQuery("end", strconv.FormatInt(s.clock.Now().UnixMilli(), 10))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
 
 	// 解析时间戳
@@ -159,20 +687,178 @@ func (s *APIServer) getMetricsByTimeRange(c *gin.Context) {
 	startTime := time.UnixMilli(start)
 	endTime := time.UnixMilli(end)
 
+	if resolution := c.Query("resolution"); resolution != "" && resolution != "raw" {
+		s.getRollups(c, resolution, startTime, endTime, limit)
+		return
+	}
+
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := &storage.Filter{Start: startTime, End: endTime}
+	if paginated(c) {
+		s.renderPage(c, view, *filter, limit)
+		return
+	}
+
 	// 调用存储层获取数据
-	metrics, err := s.storage.GetMetricsByTimeRange(startTime, endTime, limit)
+	metrics, err := s.queryList(c, view, filter, limit, func() ([]processor.ProcessedMetric, error) {
+		return s.store(c).GetMetricsByTimeRange(startTime, endTime, limit)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+
+	view.render(c, metrics)
+}
+
+// getMetricsByLabels 按标签匹配条件获取监控数据
+//
+// 每个match参数是一个条件，如match=host="a"或match=region=~"eu-.*"，数据需满足全部条件；
+// __name__匹配指标名。
+func (s *APIServer) getMetricsByLabels(c *gin.Context) {
+	params := c.QueryArray("match")
+	if len(params) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one match parameter is required"})
+		return
+	}
+	matchers := make([]*storage.LabelMatcher, 0, len(params))
+	for _, p := range params {
+		m, err := storage.ParseLabelMatcher(p)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		matchers = append(matchers, m)
+	}
+
+	// 获取查询参数
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if view.name != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "use a __name__ matcher instead of name or name_re"})
+		return
+	}
+
+	// 调用存储层获取数据，令牌不能查看全部数据时由存储层按可见性过滤
+	var filter *storage.Filter
+	if !acl.FromContext(c.Request.Context()).SeesAll() {
+		filter = &storage.Filter{Labels: matchers}
+	}
+	metrics, err := s.queryList(c, view, filter, limit, func() ([]processor.ProcessedMetric, error) {
+		return s.store(c).GetMetricsByLabels(matchers, limit)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if s.queryCanceled(c) {
+		return
+	}
 
-	c.JSON(http.StatusOK, metrics)
+	view.render(c, metrics)
 }
 
-// Stop 停止API服务器
-func (s *APIServer) Stop() error {
-	if s.server != nil {
-		return s.server.Shutdown(nil)
+// getStats 获取存储统计
+func (s *APIServer) getStats(c *gin.Context) {
+	stats, err := s.store(c).Stats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// getHandshakeStats 获取QUIC握手统计
+func (s *APIServer) getHandshakeStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.handshakes.Stats())
+}
+
+// getHandshakeFailures 获取最近的握手失败记录
+func (s *APIServer) getHandshakeFailures(c *gin.Context) {
+	c.JSON(http.StatusOK, s.handshakes.RecentFailures())
+}
+
+// importMetrics 导入历史数据文件，请求体为文件内容，format参数指定格式
+func (s *APIServer) importMetrics(c *gin.Context) {
+	format := c.Query("format")
+	if format == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format is required"})
+		return
+	}
+
+	// 请求体可按Content-Encoding压缩
+	enc, err := codec.Get(c.GetHeader("Content-Encoding"))
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	body, err := enc.NewReader(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to decode body: " + err.Error()})
+		return
+	}
+	defer body.Close()
+
+	result, err := s.importer.Import(body, format)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, importer.ErrUnsupportedFormat) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// getAdmissionStats 获取接入缓冲区和写入速率状态
+func (s *APIServer) getAdmissionStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.admission.Stats())
+}
+
+// getSLAReport 获取上报新鲜度报告，可按agent_id过滤，启用ACL时只返回令牌可见的序列
+func (s *APIServer) getSLAReport(c *gin.Context) {
+	grant := acl.FromContext(c.Request.Context())
+	report := slices.DeleteFunc(s.sla.Report(c.Query("agent_id")), func(r sla.SeriesReport) bool {
+		return !grant.AllowedSeries(r.AgentID, r.Metric)
+	})
+	c.JSON(http.StatusOK, report)
+}
+
+// getSLAAlerts 获取最近的迟报告警，启用ACL时只返回令牌可见的序列的告警
+func (s *APIServer) getSLAAlerts(c *gin.Context) {
+	grant := acl.FromContext(c.Request.Context())
+	alerts := slices.DeleteFunc(s.sla.Alerts(), func(a sla.Alert) bool {
+		return !grant.AllowedSeries(a.AgentID, a.Metric)
+	})
+	c.JSON(http.StatusOK, alerts)
+}
+
+// Stop 停止接受新请求，等待处理中的请求完成，ctx到期后返回错误
+func (s *APIServer) Stop(ctx context.Context) error {
+	s.listenMu.Lock()
+	server, redirect := s.server, s.redirect
+	s.listenMu.Unlock()
+
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	if server != nil {
+		return server.Shutdown(ctx)
 	}
 	return nil
 }
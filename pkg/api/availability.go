@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/availability"
+)
+
+// WithAvailability 启用Agent可用率查询接口
+func WithAvailability(tracker *availability.Tracker) Option {
+	return func(s *APIServer) {
+		s.availability = tracker
+	}
+}
+
+// getAvailability 返回Agent在[start, end)内的可用率
+//
+// start和end为毫秒时间戳，默认最近24小时；step为时长(如1h)，指定时按step返回每段的可用率。
+// 指定agent_id时只返回该Agent，否则返回保留时间内上报过数据的全部Agent。
+func (s *APIServer) getAvailability(c *gin.Context) {
+	end := s.clock.Now()
+	if v := c.Query("end"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end timestamp"})
+			return
+		}
+		end = time.UnixMilli(ms)
+	}
+	start := end.Add(-24 * time.Hour)
+	if v := c.Query("start"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start timestamp"})
+			return
+		}
+		start = time.UnixMilli(ms)
+	}
+	var step time.Duration
+	if v := c.Query("step"); v != "" {
+		var err error
+		if step, err = time.ParseDuration(v); err != nil || step <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid step"})
+			return
+		}
+	}
+
+	agents := []string{c.Query("agent_id")}
+	if agents[0] == "" {
+		agents = s.availability.Agents()
+	}
+	grant := acl.FromContext(c.Request.Context())
+	result := make([]availability.Uptime, 0, len(agents))
+	for _, id := range agents {
+		if !grant.AllowedAgent(id) {
+			continue
+		}
+		uptime, ok, err := s.availability.Uptime(id, start, end, step)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if ok {
+			result = append(result, uptime)
+		}
+	}
+	if c.Query("agent_id") != "" && len(result) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no reporting history for agent in range"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/bans"
+)
+
+// WithBans 启用Agent封禁的管理接口
+func WithBans(list *bans.List) Option {
+	return func(s *APIServer) {
+		s.bans = list
+	}
+}
+
+// listBans 列出有效的封禁记录
+func (s *APIServer) listBans(c *gin.Context) {
+	c.JSON(http.StatusOK, s.bans.Bans())
+}
+
+// banAgent 封禁Agent并关闭其当前的连接，reason参数为原因，duration参数为封禁时长，不指定时一直有效
+func (s *APIServer) banAgent(c *gin.Context) {
+	var d time.Duration
+	if v := c.Query("duration"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid duration: " + v})
+			return
+		}
+	}
+
+	ban := s.bans.Ban(c.Param("agent_id"), c.Query("reason"), d)
+	disconnected := 0
+	if s.connections != nil {
+		reason := "banned by admin"
+		if ban.Reason != "" {
+			reason += ": " + ban.Reason
+		}
+		disconnected = s.connections.Disconnect(ban.AgentID, reason)
+	}
+	c.JSON(http.StatusOK, gin.H{"ban": ban, "disconnected": disconnected})
+}
+
+// unbanAgent 解除封禁，配置文件中的封禁不能通过API解除
+func (s *APIServer) unbanAgent(c *gin.Context) {
+	err := s.bans.Unban(c.Param("agent_id"))
+	switch {
+	case errors.Is(err, bans.ErrNotBanned):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, bans.ErrStatic):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
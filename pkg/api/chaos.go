@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+)
+
+// WithChaos 启用故障注入统计接口
+func WithChaos(injector *chaos.Injector) Option {
+	return func(s *APIServer) {
+		s.chaos = injector
+	}
+}
+
+// getChaosStats 返回已注入的故障次数
+func (s *APIServer) getChaosStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.chaos.Stats())
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/commands"
+)
+
+// HeaderResultContentType 命令结果下载响应中Agent声明的内容类型，响应本身总是以附件形式返回二进制数据
+const HeaderResultContentType = "X-Kon-Result-Content-Type"
+
+// commandRequest 下发命令的请求体
+type commandRequest struct {
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args"`
+}
+
+// WithCommandManager 启用Agent诊断命令接口
+func WithCommandManager(manager *commands.Manager) Option {
+	return func(s *APIServer) {
+		s.commands = manager
+	}
+}
+
+// submitCommand 向Agent下发命令，结果异步返回
+func (s *APIServer) submitCommand(c *gin.Context) {
+	var req commandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cmd, err := s.commands.Submit(c.Param("agent_id"), req.Command, req.Args)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, commands.ErrAgentNotConnected) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, cmd)
+}
+
+// listCommands 列出最近的命令，可按agent_id过滤
+func (s *APIServer) listCommands(c *gin.Context) {
+	c.JSON(http.StatusOK, s.commands.List(c.Query("agent_id")))
+}
+
+// getCommand 获取命令状态
+func (s *APIServer) getCommand(c *gin.Context) {
+	cmd, err := s.commands.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, cmd)
+}
+
+// getCommandResult 下载命令返回的结果数据
+func (s *APIServer) getCommandResult(c *gin.Context) {
+	payload, contentType, err := s.commands.Result(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	// 结果内容由Agent提供，不能让浏览器按其声明的类型解析
+	if contentType != "" {
+		c.Header(HeaderResultContentType, contentType)
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Disposition", "attachment")
+	c.Data(http.StatusOK, "application/octet-stream", payload)
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// 支持的响应压缩编码，同时接受时优先使用gzip
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// responseCompression 按Accept-Encoding压缩响应的配置和压缩器池
+type responseCompression struct {
+	cfg     config.ResponseCompressionConfig
+	gzip    sync.Pool
+	deflate sync.Pool
+}
+
+// WithResponseCompression 按客户端的Accept-Encoding用gzip或deflate压缩JSON和文本响应
+func WithResponseCompression(cfg config.ResponseCompressionConfig) Option {
+	return func(s *APIServer) {
+		s.compression = &responseCompression{cfg: cfg}
+	}
+}
+
+// compressResponse 替换响应的Writer，边写边压缩，不缓存完整的响应体
+func (s *APIServer) compressResponse(c *gin.Context) {
+	c.Header("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+	// Range请求的偏移针对未压缩的内容
+	if encoding == "" || c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" {
+		c.Next()
+		return
+	}
+
+	w := &compressWriter{ResponseWriter: c.Writer, compression: s.compression, encoding: encoding}
+	c.Writer = w
+	defer func() {
+		w.close()
+		c.Writer = w.ResponseWriter
+	}()
+	c.Next()
+}
+
+// negotiateEncoding 从Accept-Encoding中选出支持的编码，q=0表示不接受，都不支持时返回空
+func negotiateEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q > 0
+	}
+	for _, encoding := range []string{encodingGzip, encodingDeflate} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressWriter 先缓存不超过min_size的响应体，达到min_size或处理函数刷新输出时开始压缩，
+// 响应结束时仍不足min_size则原样输出，已设置Content-Encoding或不是JSON和文本的响应不压缩
+type compressWriter struct {
+	gin.ResponseWriter
+	compression *responseCompression
+	encoding    string
+
+	buf     []byte
+	decided bool
+	enc     io.WriteCloser
+}
+
+// Write 按是否压缩写入或缓存响应体
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if !w.compressible() {
+			if err := w.decide(false); err != nil {
+				return 0, err
+			}
+		} else if len(w.buf)+len(p) < w.compression.cfg.MinSize {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		} else if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// WriteString 与Write相同
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written 缓存中有数据时也视为已写入响应体
+func (w *compressWriter) Written() bool {
+	return len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+// Flush 流式接口刷新输出时不再等待min_size，已缓存和压缩器中的数据都发送给客户端
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(w.compressible())
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap 供http.ResponseController设置写超时
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// compressible 判断响应是否需要压缩
+func (w *compressWriter) compressible() bool {
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if status := w.Status(); status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json")
+}
+
+// decide 确定是否压缩并写出已缓存的数据
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		w.enc = w.compression.get(w.encoding, w.ResponseWriter)
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	if w.enc != nil {
+		_, err := w.enc.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close 响应结束时写出缓存或结束压缩流，压缩器放回池中
+func (w *compressWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.compression.put(w.encoding, w.enc)
+		w.enc = nil
+	}
+}
+
+// get 从池中取出写入dst的压缩器
+func (rc *responseCompression) get(encoding string, dst io.Writer) io.WriteCloser {
+	if encoding == encodingDeflate {
+		if fw, ok := rc.deflate.Get().(*flate.Writer); ok {
+			fw.Reset(dst)
+			return fw
+		}
+		// 级别已在启动时校验
+		fw, _ := flate.NewWriter(dst, rc.cfg.Level)
+		return fw
+	}
+	if gw, ok := rc.gzip.Get().(*gzip.Writer); ok {
+		gw.Reset(dst)
+		return gw
+	}
+	gw, _ := gzip.NewWriterLevel(dst, rc.cfg.Level)
+	return gw
+}
+
+// put 把已关闭的压缩器放回池中
+func (rc *responseCompression) put(encoding string, enc io.WriteCloser) {
+	if encoding == encodingDeflate {
+		rc.deflate.Put(enc)
+		return
+	}
+	rc.gzip.Put(enc)
+}
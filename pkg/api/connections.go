@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/connections"
+)
+
+// connectedAgent 一个QUIC连接的状态，启用诊断命令时Commands表示连接上的Agent是否可接收命令
+type connectedAgent struct {
+	connections.Info
+	Commands *bool `json:"commands,omitempty"`
+}
+
+// WithConnections 启用当前QUIC连接的查询接口
+func WithConnections(registry *connections.Registry) Option {
+	return func(s *APIServer) {
+		s.connections = registry
+	}
+}
+
+// listConnectedAgents 列出当前连接的Agent及其远端地址、流数、接收的字节数和最后一次收到数据的时间
+func (s *APIServer) listConnectedAgents(c *gin.Context) {
+	var commandAgents []string
+	if s.commands != nil {
+		commandAgents = s.commands.Agents()
+	}
+
+	infos := s.connections.List()
+	agents := make([]connectedAgent, len(infos))
+	for i, info := range infos {
+		agents[i].Info = info
+		if s.commands != nil {
+			ok := slices.ContainsFunc(info.AgentIDs, func(id string) bool {
+				_, found := slices.BinarySearch(commandAgents, id)
+				return found
+			})
+			agents[i].Commands = &ok
+		}
+	}
+	c.JSON(http.StatusOK, agents)
+}
+
+// disconnectAgent 关闭Agent的所有QUIC连接，reason参数写入关闭原因，Agent可以重新连接，需要阻止重连时使用封禁接口
+func (s *APIServer) disconnectAgent(c *gin.Context) {
+	reason := "disconnected by admin"
+	if v := c.Query("reason"); v != "" {
+		reason += ": " + v
+	}
+	n := s.connections.Disconnect(c.Param("agent_id"), reason)
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "agent is not connected"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"disconnected": n})
+}
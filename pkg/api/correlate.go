@@ -0,0 +1,128 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/correlate"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// maxCorrelateAgents agents参数最多包含的Agent数(含agent_id)，每个Agent最多读取maxStepSamples个样本
+const maxCorrelateAgents = 10
+
+// getCorrelations 计算目标序列与同一Agent(或agents指定的一组Agent)的其他序列的相关系数
+//
+// 参数为agent_id、name、agents(逗号分隔，默认只有agent_id，最多maxCorrelateAgents个)、start/end(毫秒)、
+// step(对齐间隔，默认1m)、method(pearson或spearman，默认pearson)和top(默认10)。
+func (s *APIServer) getCorrelations(c *gin.Context) {
+	agentID := c.Query("agent_id")
+	name := c.Query("name")
+	if agentID == "" || name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent_id and name are required"})
+		return
+	}
+
+	now := s.clock.Now().UnixMilli()
+	start, err := strconv.ParseInt(c.DefaultQuery("start", strconv.FormatInt(now-time.Hour.Milliseconds(), 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start timestamp"})
+		return
+	}
+	end, err := strconv.ParseInt(c.DefaultQuery("end", strconv.FormatInt(now, 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end timestamp"})
+		return
+	}
+	step, err := time.ParseDuration(c.DefaultQuery("step", "1m"))
+	if err != nil || step < time.Millisecond {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid step"})
+		return
+	}
+	if end < start || (end-start)/step.Milliseconds() >= maxStepPoints {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range or too many points"})
+		return
+	}
+	top, err := strconv.Atoi(c.DefaultQuery("top", "10"))
+	if err != nil || top <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid top"})
+		return
+	}
+	method := c.DefaultQuery("method", correlate.Pearson)
+
+	agents := []string{agentID}
+	if v := c.Query("agents"); v != "" {
+		for _, a := range strings.Split(v, ",") {
+			if a = strings.TrimSpace(a); a != "" && !slices.Contains(agents, a) {
+				agents = append(agents, a)
+			}
+		}
+	}
+	if len(agents) > maxCorrelateAgents {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "too many agents"})
+		return
+	}
+
+	startTime := time.UnixMilli(start)
+	endTime := time.UnixMilli(end)
+	samples := make([]processor.ProcessedMetric, 0)
+	for _, agent := range agents {
+		metrics, err := s.agentSamples(c, agent, startTime, endTime)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		samples = append(samples, metrics...)
+	}
+	samples = visible(c, samples)
+	if s.queryCanceled(c) {
+		return
+	}
+
+	target := correlate.SeriesKey{AgentID: agentID, Name: name}
+	series := correlate.Align(samples, step)
+	if _, ok := series[target]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no data for series"})
+		return
+	}
+	results, err := correlate.Rank(series, target, method, top)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"agent_id":     agentID,
+		"name":         name,
+		"method":       method,
+		"step":         step.String(),
+		"correlations": results,
+	})
+}
+
+// agentSamples 取出Agent在时间范围内的样本
+func (s *APIServer) agentSamples(c *gin.Context, agentID string, from, to time.Time) ([]processor.ProcessedMetric, error) {
+	if sq, ok := s.store(c).(storage.SortedQuerier); ok {
+		filter := storage.Filter{AgentID: agentID, Start: from, End: to}
+		acl.FromContext(c.Request.Context()).Apply(&filter)
+		return sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp}, maxStepSamples)
+	}
+
+	metrics, err := s.store(c).GetMetricsByTimeRange(from, to, maxStepSamples)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]processor.ProcessedMetric, 0)
+	for _, m := range metrics {
+		if m.AgentID == agentID {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
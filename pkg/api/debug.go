@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WithDebug 启用/debug/pprof和/debug/vars调试接口
+func WithDebug() Option {
+	return func(s *APIServer) {
+		s.debug = true
+	}
+}
+
+// getPprof 提供net/http/pprof的接口，Index按路径输出heap、goroutine等命名的剖析数据
+func (s *APIServer) getPprof(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// POST /debug/pprof/symbol没有profile参数
+		if c.Request.Method == http.MethodPost {
+			pprof.Symbol(c.Writer, c.Request)
+			return
+		}
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// getDebugVars 输出expvar发布的变量(cmdline、memstats)，并附加协程数、存储统计和QUIC连接的流数，
+// 服务器的变量不发布到全局的expvar，同一进程中可以组装多个服务器
+func (s *APIServer) getDebugVars(c *gin.Context) {
+	vars := make(map[string]any)
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	vars["goroutines"] = runtime.NumGoroutine()
+
+	if stats, err := s.storage.Stats(); err == nil {
+		vars["storage"] = stats
+	} else {
+		vars["storage"] = gin.H{"error": err.Error()}
+	}
+
+	if s.connections != nil {
+		conns := s.connections.List()
+		streams := 0
+		for _, info := range conns {
+			streams += info.Streams
+		}
+		vars["quic"] = gin.H{"connections": len(conns), "streams": streams}
+	}
+	c.JSON(http.StatusOK, vars)
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/dedup"
+)
+
+// WithDedup 启用重复帧过滤统计接口
+func WithDedup(filter *dedup.Filter) Option {
+	return func(s *APIServer) {
+		s.dedup = filter
+	}
+}
+
+// getDedupStats 返回检查和丢弃的帧数以及过滤器的置位比例
+func (s *APIServer) getDedupStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.dedup.Stats())
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+)
+
+// deleteMetricsByAgentID 删除Agent的全部数据，用于清理已下线的Agent
+//
+// 三个删除接口同时删除降采样数据中对应的部分，降采样数据不区分命名空间。
+func (s *APIServer) deleteMetricsByAgentID(c *gin.Context) {
+	agentID := c.Param("agent_id")
+	if !acl.FromContext(c.Request.Context()).OwnsAgent(agentID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "token is not allowed to delete this agent"})
+		return
+	}
+	n, err := s.store(c).DeleteMetricsByAgentID(agentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.rollups != nil {
+		s.rollups.DeleteByAgentID(agentID)
+	}
+	log.Printf("Deleted %d metrics of agent %s", n, agentID)
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
+
+// deleteMetricsByType 删除指定类型的全部数据
+func (s *APIServer) deleteMetricsByType(c *gin.Context) {
+	metricType := c.Param("metric_type")
+	n, err := s.store(c).DeleteMetricsByType(metricType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.rollups != nil {
+		s.rollups.DeleteByType(metricType)
+	}
+	log.Printf("Deleted %d metrics of type %s", n, metricType)
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
+
+// deleteMetricsByTimeRange 删除时间范围内的数据，start和end为毫秒时间戳且必须指定
+func (s *APIServer) deleteMetricsByTimeRange(c *gin.Context) {
+	start, err := strconv.ParseInt(c.Query("start"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start timestamp"})
+		return
+	}
+	end, err := strconv.ParseInt(c.Query("end"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end timestamp"})
+		return
+	}
+	if end < start {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end is before start"})
+		return
+	}
+
+	startTime, endTime := time.UnixMilli(start), time.UnixMilli(end)
+	n, err := s.store(c).DeleteMetricsByTimeRange(startTime, endTime)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.rollups != nil {
+		s.rollups.DeleteByTimeRange(startTime, endTime)
+	}
+	log.Printf("Deleted %d metrics between %s and %s", n, startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// diffWindow 参与比较的一个时间窗口
+type diffWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// diffSeries 一个序列在两个窗口的聚合值，某个窗口没有数据时对应的值为null
+type diffSeries struct {
+	Name          string   `json:"name"`
+	AgentID       string   `json:"agent_id,omitempty"`
+	Current       *float64 `json:"current"`
+	Baseline      *float64 `json:"baseline"`
+	CurrentCount  int      `json:"current_count"`
+	BaselineCount int      `json:"baseline_count"`
+	Delta         *float64 `json:"delta"`
+	// PercentChange 相对基准值的变化百分比，基准值为0时为null
+	PercentChange *float64 `json:"percent_change"`
+}
+
+// getMetricDiff 比较同一指标在两个时间窗口的聚合值，返回差值和变化百分比
+//
+// 参数为name(指标名，可以使用glob)、agg(avg、min、max、sum或count，默认avg)、start/end(毫秒，默认最近一小时)、
+// 可选的agent_id和by_agent(为true时每个Agent单独比较)。基准窗口默认为紧邻当前窗口之前的等长窗口，
+// offset=24h把当前窗口整体前移作为基准(如昨天同一时段)，也可以用baseline_start/baseline_end直接指定。
+// 结果按变化百分比的绝对值从大到小排列，只在一个窗口出现的序列排在最前。
+func (s *APIServer) getMetricDiff(c *gin.Context) {
+	name := c.Query("name")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	matcher, err := storage.NewNameGlob(name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := s.clock.Now().UnixMilli()
+	start, err := strconv.ParseInt(c.DefaultQuery("start", strconv.FormatInt(now-time.Hour.Milliseconds(), 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start timestamp"})
+		return
+	}
+	end, err := strconv.ParseInt(c.DefaultQuery("end", strconv.FormatInt(now, 10)), 10, 64)
+	if err != nil || end <= start {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end timestamp"})
+		return
+	}
+	current := diffWindow{Start: time.UnixMilli(start), End: time.UnixMilli(end)}
+	baseline, ok := s.baselineWindow(c, current)
+	if !ok {
+		return
+	}
+
+	fn := c.DefaultQuery("agg", storage.AggregateAvg)
+	switch fn {
+	case storage.AggregateAvg, storage.AggregateMin, storage.AggregateMax, storage.AggregateSum, storage.AggregateCount:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agg must be one of avg, min, max, sum or count"})
+		return
+	}
+	agentID := c.Query("agent_id")
+	byAgent := c.Query("by_agent") == "true"
+
+	keys, err := s.diffKeys(c, matcher, agentID, byAgent, current, baseline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	grant := acl.FromContext(c.Request.Context())
+	series := make([]diffSeries, 0, len(keys))
+	for _, k := range keys {
+		// 聚合结果不含标签，受限规则按指标名保守判断
+		if !grant.AllowedSeries(k.agentID, k.name) {
+			continue
+		}
+		d := diffSeries{Name: k.name}
+		if byAgent {
+			d.AgentID = k.agentID
+		}
+		if d.Current, d.CurrentCount, err = s.windowAggregate(c, k.name, k.agentID, fn, current); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if d.Baseline, d.BaselineCount, err = s.windowAggregate(c, k.name, k.agentID, fn, baseline); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if d.Current == nil && d.Baseline == nil {
+			continue
+		}
+		if d.Current != nil && d.Baseline != nil {
+			delta := *d.Current - *d.Baseline
+			d.Delta = &delta
+			if *d.Baseline != 0 {
+				pct := delta / math.Abs(*d.Baseline) * 100
+				d.PercentChange = &pct
+			}
+		}
+		series = append(series, d)
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+
+	sort.SliceStable(series, func(i, j int) bool {
+		return diffRank(&series[i]) > diffRank(&series[j])
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"name":     name,
+		"agg":      fn,
+		"current":  current,
+		"baseline": baseline,
+		"series":   series,
+	})
+}
+
+// baselineWindow 按offset或baseline_start/baseline_end参数确定基准窗口，参数无效时输出错误并返回false
+func (s *APIServer) baselineWindow(c *gin.Context, current diffWindow) (diffWindow, bool) {
+	if bs, be := c.Query("baseline_start"), c.Query("baseline_end"); bs != "" || be != "" {
+		if c.Query("offset") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset cannot be combined with baseline_start/baseline_end"})
+			return diffWindow{}, false
+		}
+		start, err1 := strconv.ParseInt(bs, 10, 64)
+		end, err2 := strconv.ParseInt(be, 10, 64)
+		if err1 != nil || err2 != nil || end <= start {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "baseline_start and baseline_end must both be set and baseline_end after baseline_start"})
+			return diffWindow{}, false
+		}
+		return diffWindow{Start: time.UnixMilli(start), End: time.UnixMilli(end)}, true
+	}
+
+	offset := current.End.Sub(current.Start)
+	if v := c.Query("offset"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return diffWindow{}, false
+		}
+		offset = d
+	}
+	return diffWindow{Start: current.Start.Add(-offset), End: current.End.Add(-offset)}, true
+}
+
+// diffKey 参与比较的序列，agentID为空表示聚合所有Agent
+type diffKey struct{ name, agentID string }
+
+// diffKeys 找出两个窗口中匹配的指标名(by_agent时为指标名和Agent)，指标名不含glob且不按Agent比较时不需要查询
+func (s *APIServer) diffKeys(c *gin.Context, matcher *storage.NameMatcher, agentID string, byAgent bool, windows ...diffWindow) ([]diffKey, error) {
+	if matcher.Literal() && !byAgent {
+		return []diffKey{{name: matcher.Prefix(), agentID: agentID}}, nil
+	}
+
+	seen := make(map[diffKey]bool)
+	var keys []diffKey
+	for _, w := range windows {
+		filter := storage.Filter{AgentID: agentID, Start: w.Start, End: w.End, Name: matcher}
+		var metrics []processor.ProcessedMetric
+		var err error
+		if sq, ok := s.store(c).(storage.SortedQuerier); ok {
+			metrics, err = sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, maxStepSamples)
+		} else {
+			metrics, err = s.store(c).GetMetricsByTimeRange(w.Start, w.End, maxStepSamples)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range metrics {
+			if !filter.Match(&metrics[i]) {
+				continue
+			}
+			k := diffKey{name: metrics[i].Name, agentID: agentID}
+			if byAgent {
+				k.agentID = metrics[i].AgentID
+			}
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].agentID < keys[j].agentID
+	})
+	return keys, nil
+}
+
+// windowAggregate 把整个窗口聚合为一个值，窗口内没有数据时返回nil
+func (s *APIServer) windowAggregate(c *gin.Context, name, agentID, fn string, w diffWindow) (*float64, int, error) {
+	// 窗口宽度比时间范围多1毫秒，使包含end在内的所有样本落在同一个窗口
+	q := storage.AggregateQuery{
+		AgentID: agentID,
+		Name:    name,
+		Func:    fn,
+		Step:    w.End.Sub(w.Start) + time.Millisecond,
+		Start:   w.Start,
+		End:     w.End,
+	}
+	points, err := s.store(c).Aggregate(q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 存储按窗口起点对齐时结果可能跨两个窗口，按函数合并
+	var value float64
+	count := 0
+	for _, p := range points {
+		if p.Count == 0 {
+			continue
+		}
+		switch {
+		case count == 0:
+			value = p.Value
+		case fn == storage.AggregateAvg:
+			value = (value*float64(count) + p.Value*float64(p.Count)) / float64(count+p.Count)
+		case fn == storage.AggregateMin:
+			value = math.Min(value, p.Value)
+		case fn == storage.AggregateMax:
+			value = math.Max(value, p.Value)
+		default:
+			value += p.Value
+		}
+		count += p.Count
+	}
+	if count == 0 {
+		return nil, 0, nil
+	}
+	return &value, count, nil
+}
+
+// diffRank 排序依据，只在一个窗口出现的序列最大，其次按变化百分比的绝对值
+func diffRank(d *diffSeries) float64 {
+	switch {
+	case d.Current == nil || d.Baseline == nil:
+		return math.Inf(1)
+	case d.PercentChange != nil:
+		return math.Abs(*d.PercentChange)
+	case *d.Delta != 0:
+		// 基准值为0而当前值不为0，视为最大的变化
+		return math.MaxFloat64
+	}
+	return 0
+}
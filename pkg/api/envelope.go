@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Envelope /api/v2成功响应的信封
+type Envelope struct {
+	Data interface{} `json:"data"`
+	// Count data为数组时是元素个数，为null时是0，否则是1
+	Count int `json:"count"`
+	// Cursor 还有下一页时用于获取下一页的游标，分页方式与/api/v1相同
+	Cursor     string    `json:"cursor,omitempty"`
+	Query      QueryEcho `json:"query"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+// ErrorEnvelope /api/v2错误响应的信封
+type ErrorEnvelope struct {
+	Error      APIError  `json:"error"`
+	Query      QueryEcho `json:"query"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+// APIError 错误对象，Code按HTTP状态码取固定的值，客户端按Code而不是Message判断错误类型
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+// QueryEcho 回显请求的路径和参数，参数只有一个值时为字符串，多个值时为数组
+type QueryEcho struct {
+	Method string                 `json:"method"`
+	Path   string                 `json:"path"`
+	Params map[string]string      `json:"params,omitempty"`
+	Args   map[string]interface{} `json:"args,omitempty"`
+}
+
+// errorCodes HTTP状态码对应的错误代码，未列出的4xx为bad_request，5xx为internal
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_argument",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "permission_denied",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+// errorCode 返回状态码对应的错误代码
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status < http.StatusInternalServerError {
+		return "bad_request"
+	}
+	return "internal"
+}
+
+// envelope 缓存/api/v1处理函数输出的JSON响应，包装为信封后输出
+//
+// 分页接口的{data, pagination}展开为data和cursor，错误响应的{"error": "..."}转换为错误对象。
+// 没有响应体的响应(如204)和非JSON响应原样输出。
+func (s *APIServer) envelope(c *gin.Context) {
+	w := &envelopeWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+
+	status := w.Status()
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if status < http.StatusBadRequest && (w.buf.Len() == 0 || !strings.HasSuffix(mediaType, "json")) {
+		if w.buf.Len() > 0 {
+			c.Writer.Write(w.buf.Bytes())
+		}
+		return
+	}
+
+	body := bytes.TrimSpace(w.buf.Bytes())
+	if !json.Valid(body) {
+		body = nil
+	}
+	echo := echoQuery(c)
+	now := s.clock.Now()
+
+	if status >= http.StatusBadRequest {
+		message := http.StatusText(status)
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			message = apiErr.Error
+		}
+		c.JSON(status, ErrorEnvelope{
+			Error:      APIError{Code: errorCode(status), Message: message, Status: status},
+			Query:      echo,
+			ServerTime: now,
+		})
+		return
+	}
+
+	// data保持处理函数输出的原始JSON，不改变字段顺序
+	env := Envelope{Query: echo, ServerTime: now}
+	data := json.RawMessage(body)
+	var page map[string]json.RawMessage
+	if json.Unmarshal(body, &page) == nil && len(page) == 2 && page["data"] != nil && page["pagination"] != nil {
+		var pagination Pagination
+		json.Unmarshal(page["pagination"], &pagination)
+		data = page["data"]
+		env.Cursor = pagination.NextCursor
+	}
+	switch {
+	case len(data) == 0 || string(data) == "null":
+	case data[0] == '[':
+		var items []json.RawMessage
+		json.Unmarshal(data, &items)
+		env.Data = data
+		env.Count = len(items)
+	default:
+		env.Data = data
+		env.Count = 1
+	}
+	c.JSON(status, env)
+}
+
+// echoQuery 回显请求的方法、路径、路径参数和查询参数
+func echoQuery(c *gin.Context) QueryEcho {
+	echo := QueryEcho{Method: c.Request.Method, Path: c.Request.URL.Path}
+	if len(c.Params) > 0 {
+		echo.Params = make(map[string]string, len(c.Params))
+		for _, p := range c.Params {
+			echo.Params[p.Key] = p.Value
+		}
+	}
+	if args := c.Request.URL.Query(); len(args) > 0 {
+		echo.Args = make(map[string]interface{}, len(args))
+		for k, v := range args {
+			if len(v) == 1 {
+				echo.Args[k] = v[0]
+			} else {
+				echo.Args[k] = v
+			}
+		}
+	}
+	return echo
+}
+
+// envelopeWriter 缓存处理函数输出的响应体，状态码由底层的gin.ResponseWriter保存到输出信封时
+type envelopeWriter struct {
+	gin.ResponseWriter
+	buf bytes.Buffer
+}
+
+// Write 缓存响应体
+func (w *envelopeWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// WriteString 缓存响应体
+func (w *envelopeWriter) WriteString(s string) (int, error) {
+	return w.buf.WriteString(s)
+}
+
+// Written 缓存中有数据时也视为已写入响应体
+func (w *envelopeWriter) Written() bool {
+	return w.buf.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// Flush 响应体在处理函数返回后才输出，刷新没有作用
+func (w *envelopeWriter) Flush() {}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/stream"
+)
+
+// eventsHeartbeat 没有新指标时发送注释行的间隔，防止代理因空闲断开连接
+const eventsHeartbeat = 15 * time.Second
+
+// streamEvents 以Server-Sent Events推送QUIC接入的指标，供无法使用WebSocket的浏览器看板订阅
+//
+// 每个事件的id是指标的发布序号，data是一个指标的JSON，过滤和字段参数与WebSocket接口相同。
+// 断线重连时EventSource自动带上Last-Event-ID请求头(也可用last_event_id参数)，
+// 从重放缓冲区补发之后的指标；部分指标已移出缓冲区时先发送一个gap事件。
+func (s *APIServer) streamEvents(c *gin.Context) {
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	filter := stream.Filter{
+		AgentID: c.Query("agent_id"),
+		Name:    c.Query("name"),
+		Type:    c.Query("type"),
+	}
+
+	var (
+		sub      *stream.Subscription
+		replay   []stream.Event
+		complete = true
+	)
+	if lastEventID == "" {
+		sub, err = s.stream.Subscribe(filter)
+	} else {
+		lastID, perr := strconv.ParseUint(lastEventID, 10, 64)
+		if perr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+		sub, replay, complete, err = s.stream.Resume(filter, lastID)
+	}
+	if errors.Is(err, stream.ErrTooManySubscribers) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer s.stream.Unsubscribe(sub)
+
+	rc := http.NewResponseController(c.Writer)
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	grant := acl.FromContext(c.Request.Context())
+	send := func(event string, id uint64, data any) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		s.extendWriteDeadline(c, rc)
+		if event != "" {
+			fmt.Fprintf(c.Writer, "event: %s\n", event)
+		}
+		if id > 0 {
+			fmt.Fprintf(c.Writer, "id: %d\n", id)
+		}
+		if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", payload); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if !complete {
+		if err := send("gap", 0, gin.H{"last_event_id": lastEventID}); err != nil {
+			return
+		}
+	}
+	for i := range replay {
+		if !grant.Allowed(&replay[i].Metric) {
+			continue
+		}
+		if err := send("", replay[i].ID, view.row(&replay[i].Metric)); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			s.extendWriteDeadline(c, rc)
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !grant.Allowed(&ev.Metric) {
+				continue
+			}
+			if err := send("", ev.ID, view.row(&ev.Metric)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// maxEvictionEvents 保留的最近淘汰事件数
+const maxEvictionEvents = 100
+
+// evictionLog 最近的淘汰事件
+type evictionLog struct {
+	mu     sync.Mutex
+	events []storage.EvictionEvent
+}
+
+// add 追加事件，超出上限时丢弃最早的事件
+func (l *evictionLog) add(event storage.EvictionEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, event)
+	if len(l.events) > maxEvictionEvents {
+		l.events = append(l.events[:0], l.events[len(l.events)-maxEvictionEvents:]...)
+	}
+}
+
+// list 返回事件，最新的在前
+func (l *evictionLog) list() []storage.EvictionEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]storage.EvictionEvent, 0, len(l.events))
+	for i := len(l.events) - 1; i >= 0; i-- {
+		result = append(result, l.events[i])
+	}
+	return result
+}
+
+// WithEvictions 记录存储因容量不足删除未过期数据的事件，并启用查询接口
+func WithEvictions(notifier storage.EvictionNotifier) Option {
+	return func(s *APIServer) {
+		s.evictions = &evictionLog{}
+		notifier.OnEviction(s.evictions.add)
+	}
+}
+
+// listEvictions 列出最近的淘汰事件
+func (s *APIServer) listEvictions(c *gin.Context) {
+	c.JSON(http.StatusOK, s.evictions.list())
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// exportFlushRows 导出时每输出多少条数据刷新一次响应
+const exportFlushRows = 1000
+
+// exportMetrics 以NDJSON导出满足条件的数据，格式与导入接口的jsonl格式兼容
+//
+// 可按agent_id、type、name(glob)或name_re(正则表达式)和start、end(毫秒时间戳)过滤，按时间戳从旧到新输出，
+// limit为空时导出全部，include_provenance=true时输出接入来源。响应边生成边发送，不受HTTP服务器全局写超时限制。
+func (s *APIServer) exportMetrics(c *gin.Context) {
+	filter := storage.Filter{AgentID: c.Query("agent_id"), Type: c.Query("type")}
+	name, err := parseNameMatcher(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Name = name
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"start", &filter.Start}, {"end", &filter.End}} {
+		if v := c.Query(p.name); v != "" {
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + p.name + " timestamp"})
+				return
+			}
+			*p.t = time.UnixMilli(ms)
+		}
+	}
+	limit := math.MaxInt
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be positive"})
+			return
+		}
+		limit = n
+	}
+
+	sq, ok := s.store(c).(storage.SortedQuerier)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "storage does not support export"})
+		return
+	}
+	acl.FromContext(c.Request.Context()).Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp}, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+	metrics = visible(c, metrics)
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="metrics.ndjson"`)
+	c.Status(http.StatusOK)
+
+	rc := http.NewResponseController(c.Writer)
+	enc := json.NewEncoder(c.Writer)
+	s.extendWriteDeadline(c, rc)
+	provenance := c.Query("include_provenance") == "true"
+	for i := range metrics {
+		m := &metrics[i]
+		if m.Provenance != nil && !provenance {
+			m = withoutProvenance(m)
+		}
+		if err := enc.Encode(m); err != nil {
+			return
+		}
+		if (i+1)%exportFlushRows == 0 {
+			// 查询被取消或客户端断开时停止导出
+			if c.Request.Context().Err() != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			s.extendWriteDeadline(c, rc)
+		}
+	}
+	rc.Flush()
+}
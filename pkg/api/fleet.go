@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/fleet"
+	"github.com/konpure/Kon-Agent-export/pkg/sla"
+)
+
+// WithFleet 启用Agent集群健康摘要
+func WithFleet(tracker *fleet.Tracker) Option {
+	return func(s *APIServer) {
+		s.fleet = tracker
+	}
+}
+
+// fleetSummary 集群健康摘要，附带存储容量和已启用的握手、SLA统计
+type fleetSummary struct {
+	fleet.Summary
+	Storage    storageUtilization `json:"storage"`
+	Handshakes *handshakeHealth   `json:"handshakes,omitempty"`
+	SLA        *slaHealth         `json:"sla,omitempty"`
+}
+
+// storageUtilization 存储容量使用情况，Capacity为0表示不限制
+type storageUtilization struct {
+	Total       int     `json:"total"`
+	Capacity    int     `json:"capacity"`
+	Utilization float64 `json:"utilization"`
+	MemoryBytes int64   `json:"memory_bytes,omitempty"`
+	DiskBytes   int64   `json:"disk_bytes,omitempty"`
+}
+
+// handshakeHealth 启动以来的QUIC握手失败情况
+type handshakeHealth struct {
+	Attempts    uint64  `json:"attempts"`
+	Failed      uint64  `json:"failed"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// slaHealth 上报新鲜度SLA的迟报序列数
+type slaHealth struct {
+	Series int `json:"series"`
+	Late   int `json:"late"`
+}
+
+// getFleetSummary 一次返回大屏需要的集群健康状况：Agent在线/离线数、接入速率、错误率、上报最多的Agent和存储使用率
+func (s *APIServer) getFleetSummary(c *gin.Context) {
+	stats, err := s.storage.Stats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	summary := fleetSummary{
+		Summary: s.fleet.Summary(),
+		Storage: storageUtilization{
+			Total:       stats.Total,
+			Capacity:    stats.Capacity,
+			MemoryBytes: stats.MemoryBytes,
+			DiskBytes:   stats.DiskBytes,
+		},
+	}
+	if stats.Capacity > 0 {
+		summary.Storage.Utilization = float64(stats.Total) / float64(stats.Capacity)
+	}
+
+	if s.handshakes != nil {
+		hs := s.handshakes.Stats()
+		summary.Handshakes = &handshakeHealth{Attempts: hs.Attempts, Failed: hs.Failed}
+		if hs.Attempts > 0 {
+			summary.Handshakes.FailureRate = float64(hs.Failed) / float64(hs.Attempts)
+		}
+	}
+	if s.sla != nil {
+		report := s.sla.Report("")
+		summary.SLA = &slaHealth{Series: len(report)}
+		for _, r := range report {
+			if r.Status == sla.StatusLate {
+				summary.SLA.Late++
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/grafana"
+)
+
+// WithGrafana 在path下启用兼容Grafana JSON数据源插件(SimpleJSON、Infinity)的查询接口
+func WithGrafana(ds *grafana.Datasource, path string) Option {
+	return func(s *APIServer) {
+		s.grafana = ds
+		s.grafanaPath = path
+	}
+}
+
+// testGrafana 数据源的连接测试
+func (s *APIServer) testGrafana(c *gin.Context) {
+	c.String(http.StatusOK, "OK")
+}
+
+// searchGrafana 返回指标名候选列表，用于面板中选择target
+func (s *APIServer) searchGrafana(c *gin.Context) {
+	var req grafana.SearchRequest
+	// 部分插件版本不带请求体
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	names, err := s.grafana.Search(s.store(c), req, s.clock.Now(), acl.FromContext(c.Request.Context()))
+	if s.grafanaFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, names)
+}
+
+// queryGrafana 执行面板查询，时间序列按面板interval聚合，表格返回原始数据
+func (s *APIServer) queryGrafana(c *gin.Context) {
+	var req grafana.QueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	results, err := s.grafana.Query(s.store(c), req, acl.FromContext(c.Request.Context()))
+	if s.grafanaFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// annotateGrafana 把匹配注释查询的指标数据作为注释返回
+func (s *APIServer) annotateGrafana(c *gin.Context) {
+	var req grafana.AnnotationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	annotations, err := s.grafana.Annotations(s.store(c), req, acl.FromContext(c.Request.Context()))
+	if s.grafanaFailed(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, annotations)
+}
+
+// grafanaFailed 查询出错或被取消时输出错误并返回true
+func (s *APIServer) grafanaFailed(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, grafana.ErrInvalidQuery):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, grafana.ErrUnsupported):
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		return s.queryCanceled(c)
+	}
+	return true
+}
+
+// listDashboards 列出预置的Grafana仪表盘
+func (s *APIServer) listDashboards(c *gin.Context) {
+	c.JSON(http.StatusOK, grafana.Dashboards())
+}
+
+// getDashboard 返回预置仪表盘的JSON模型，datasource参数为Grafana中Prometheus数据源的UID，
+// 未指定时返回带__inputs的导出格式，导入时在Grafana中选择数据源
+func (s *APIServer) getDashboard(c *gin.Context) {
+	dashboard, err := grafana.NewDashboard(c.Param("name"), c.Query("datasource"))
+	if errors.Is(err, grafana.ErrUnknownDashboard) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, dashboard)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/graphql"
+)
+
+// WithGraphQL 在path启用GraphQL查询接口
+func WithGraphQL(schema *graphql.Schema, path string) Option {
+	return func(s *APIServer) {
+		s.graphql = schema
+		s.graphqlPath = path
+	}
+}
+
+// queryGraphQL 执行GraphQL查询
+//
+// POST请求体为{"query","operationName","variables"}，Content-Type为application/graphql时请求体为查询文本；
+// GET请求使用同名查询参数，不带query时返回schema定义。请求无法执行时返回400，字段错误随结果在errors中返回。
+func (s *APIServer) queryGraphQL(c *gin.Context) {
+	var req graphql.Request
+	switch {
+	case c.Request.Method == http.MethodGet:
+		req.Query = c.Query("query")
+		if req.Query == "" {
+			c.String(http.StatusOK, graphql.SDL)
+			return
+		}
+		req.OperationName = c.Query("operationName")
+		if vars := c.Query("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				c.JSON(http.StatusBadRequest, graphql.Response{Errors: []graphql.Error{{Message: "invalid variables: " + err.Error()}}})
+				return
+			}
+		}
+	case strings.HasPrefix(c.ContentType(), "application/graphql"):
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, graphql.Response{Errors: []graphql.Error{{Message: err.Error()}}})
+			return
+		}
+		req.Query = string(body)
+	default:
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, graphql.Response{Errors: []graphql.Error{{Message: err.Error()}}})
+			return
+		}
+	}
+
+	resp := s.graphql.Execute(s.store(c), req, s.clock.Now(), acl.FromContext(c.Request.Context()))
+	if s.queryCanceled(c) {
+		return
+	}
+	if resp.Data == nil {
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/influx"
+)
+
+// influxV2Path InfluxDB 2.x兼容的写入接口
+const influxV2Path = "/influx/api/v2/write"
+
+// WithInflux 启用InfluxDB行协议写入接口 POST /api/v1/write 和 /influx/api/v2/write
+func WithInflux(receiver *influx.Receiver) Option {
+	return func(s *APIServer) {
+		s.influx = receiver
+	}
+}
+
+// ingestInflux 接收InfluxDB行协议数据，支持按Content-Encoding解压和precision参数
+//
+// 全部写入返回204；有无法解析的行时其余数据照常写入并返回400，与InfluxDB的partial write一致；
+// 存储写入失败返回503，超出hard模式的配额返回429，Telegraf会重试。错误响应按接口版本使用InfluxDB 1.x或2.x的格式。
+func (s *APIServer) ingestInflux(c *gin.Context) {
+	v2 := c.FullPath() == influxV2Path
+
+	password := c.Query("p")
+	if _, pass, ok := c.Request.BasicAuth(); ok {
+		password = pass
+	}
+	if !s.influx.Authorize(c.GetHeader("Authorization"), password) {
+		influxError(c, v2, http.StatusUnauthorized, "unauthorized", "invalid token")
+		return
+	}
+	unit, err := influx.Precision(c.Query("precision"))
+	if err != nil {
+		influxError(c, v2, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	maxSize := s.influx.MaxBodySize()
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSize+1))
+	if err != nil {
+		influxError(c, v2, http.StatusBadRequest, "invalid", "failed to read body")
+		return
+	}
+	enc, err := codec.Get(c.GetHeader("Content-Encoding"))
+	if err != nil {
+		influxError(c, v2, http.StatusUnsupportedMediaType, "invalid", err.Error())
+		return
+	}
+	if body, err = codec.Decompress(enc, body, maxSize); err != nil {
+		influxError(c, v2, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if int64(len(body)) > maxSize {
+		influxError(c, v2, http.StatusRequestEntityTooLarge, "request too large", "body too large")
+		return
+	}
+
+	result, err := s.influx.Write(body, unit)
+	if s.quotaExceeded(c, err) {
+		influxError(c, v2, http.StatusTooManyRequests, "too many requests", err.Error())
+		return
+	}
+	if err != nil {
+		influxError(c, v2, http.StatusServiceUnavailable, "unavailable", err.Error())
+		return
+	}
+	s.setQuotaWarnings(c, result.AgentIDs)
+	if len(result.Errors) > 0 {
+		msg := fmt.Sprintf("partial write: %d points written, %d rejected: %s",
+			result.Accepted, result.Rejected, strings.Join(result.Errors, "; "))
+		influxError(c, v2, http.StatusBadRequest, "invalid", msg)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// influxError 按InfluxDB 1.x({"error"})或2.x({"code","message"})的格式返回错误
+func influxError(c *gin.Context, v2 bool, status int, code, msg string) {
+	if v2 {
+		c.JSON(status, gin.H{"code": code, "message": msg})
+		return
+	}
+	c.JSON(status, gin.H{"error": msg})
+}
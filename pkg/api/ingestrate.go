@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/ingestrate"
+)
+
+// WithIngestRates 启用接入速率水位接口
+func WithIngestRates(meter *ingestrate.Meter) Option {
+	return func(s *APIServer) {
+		s.ingestRates = meter
+	}
+}
+
+// getIngestRates 返回全部和各Agent的接入速率水位，供HPA/KEDA抓取
+//
+// 默认输出JSON，format=prometheus时输出Prometheus文本格式。
+func (s *APIServer) getIngestRates(c *gin.Context) {
+	report := s.ingestRates.Report()
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, report)
+	case "prometheus":
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := ingestrate.WritePrometheus(c.Writer, report); err != nil {
+			c.Error(err)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or prometheus"})
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/inventory"
+)
+
+// maxInventorySize CSV清单的最大长度
+const maxInventorySize = 8 << 20
+
+// WithInventory 启用Agent清单对照
+func WithInventory(inv *inventory.Inventory) Option {
+	return func(s *APIServer) {
+		s.inventory = inv
+	}
+}
+
+// getInventory 返回清单与实际上报的Agent的对照报告，可用status=online|missing只返回该状态的清单内Agent
+func (s *APIServer) getInventory(c *gin.Context) {
+	report := s.inventory.Report()
+	if status := c.Query("status"); status != "" {
+		if status != inventory.StatusOnline && status != inventory.StatusMissing {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be online or missing"})
+			return
+		}
+		agents := report.Agents[:0]
+		for _, a := range report.Agents {
+			if a.Status == status {
+				agents = append(agents, a)
+			}
+		}
+		report.Agents = agents
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// importInventory 导入CSV格式的清单，replace=true时替换整个清单，否则按ID合并
+func (s *APIServer) importInventory(c *gin.Context) {
+	// 多读一个字节以便识别超限的清单
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxInventorySize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read inventory"})
+		return
+	}
+	if len(data) > maxInventorySize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "inventory too large"})
+		return
+	}
+
+	agents, err := inventory.ParseCSV(bytes.NewReader(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	total := s.inventory.Import(agents, c.Query("replace") == "true")
+
+	c.JSON(http.StatusOK, gin.H{"imported": len(agents), "total": total})
+}
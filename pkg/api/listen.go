@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serve 用共享的路由在listener上创建服务器并替换当前服务器，调用方需持有listenMu
+func (s *APIServer) serve(addr string, listener *tlsListener) *http.Server {
+	s.addr = addr
+	s.listener = listener
+	s.server = &http.Server{
+		Addr:         addr,
+		Handler:      s.handler,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+	}
+	return s.server
+}
+
+// Rebind 不中断服务地切换API服务器的监听地址和TLS配置，tlsConfig为nil表示明文HTTP
+//
+// 地址变化时先在新地址监听，成功后才把旧的服务器排空，新地址监听失败时继续使用旧的监听；
+// 地址不变时只替换TLS配置，之后的新连接使用新配置，已建立的连接不受影响。
+// 旧服务器处理中的请求最多等待drainTimeout，之后强制关闭。
+func (s *APIServer) Rebind(addr string, tlsConfig *tls.Config, redirectPort int, drainTimeout time.Duration) error {
+	s.listenMu.Lock()
+	defer s.listenMu.Unlock()
+
+	if s.server == nil {
+		return errors.New("api server is not running")
+	}
+
+	if addr != s.addr {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		old, oldAddr := s.server, s.addr
+		server := s.serve(addr, newTLSListener(ln, tlsConfig))
+		listener := s.listener
+		go func() {
+			if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("HTTP API server on %s stopped: %v", addr, err)
+			}
+		}()
+		go drain(old, drainTimeout)
+		log.Printf("HTTP API server moved from %s to %s, draining old listener", oldAddr, addr)
+	} else {
+		s.listener.setConfig(tlsConfig)
+	}
+	s.tls = tlsConfig
+
+	if s.redirect != nil && (tlsConfig == nil || redirectPort != s.redirectPort) {
+		go drain(s.redirect, drainTimeout)
+		s.redirect = nil
+	}
+	if tlsConfig != nil && redirectPort != 0 && s.redirect == nil {
+		return s.startRedirect(redirectPort)
+	}
+	s.redirectPort = redirectPort
+	return nil
+}
+
+// drain 等待服务器处理完请求，超过timeout后强制关闭
+func drain(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Closing %s before in-flight requests finished: %v", server.Addr, err)
+		server.Close()
+	}
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/metadata"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// projectable 可投影的列，与ProcessedMetric的JSON字段名一致
+var projectable = map[string]func(m *processor.ProcessedMetric) interface{}{
+	"agent_id":  func(m *processor.ProcessedMetric) interface{} { return m.AgentID },
+	"timestamp": func(m *processor.ProcessedMetric) interface{} { return m.Timestamp },
+	"name":      func(m *processor.ProcessedMetric) interface{} { return m.Name },
+	"value":     func(m *processor.ProcessedMetric) interface{} { return m.Value },
+	"labels":    func(m *processor.ProcessedMetric) interface{} { return m.Labels },
+	"type":      func(m *processor.ProcessedMetric) interface{} { return m.Type },
+	"payload":   func(m *processor.ProcessedMetric) interface{} { return m.Payload },
+}
+
+// 时间戳输出格式
+const (
+	TimestampRFC3339 = "rfc3339"
+	TimestampUnixMs  = "unix_ms"
+	TimestampUnixS   = "unix_s"
+)
+
+// ValidTimestampFormat 判断是否为支持的时间戳输出格式
+func ValidTimestampFormat(format string) bool {
+	switch format {
+	case TimestampRFC3339, TimestampUnixMs, TimestampUnixS:
+		return true
+	}
+	return false
+}
+
+// formattedMetric 时间戳按请求格式输出的ProcessedMetric，字段顺序与ProcessedMetric一致
+type formattedMetric struct {
+	AgentID   string            `json:"agent_id"`
+	Timestamp interface{}       `json:"timestamp"`
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels"`
+	Type      string            `json:"type"`
+	Payload   []byte            `json:"payload,omitempty"`
+	// Provenance 只在请求include_provenance=true时输出
+	Provenance *processor.Provenance `json:"provenance,omitempty"`
+	// Hints 启用指标元数据时指标的展示提示
+	Hints *metadata.Hints `json:"hints,omitempty"`
+}
+
+// listView 列表接口的排序(sort_by/order)、列投影(fields)、时间戳格式(timestamp_format)、
+// 指标名(name/name_re)和接入来源(include_provenance)参数
+type listView struct {
+	sort            *storage.SortOptions
+	fields          []string
+	timestampFormat string
+	name            *storage.NameMatcher
+	// provenance 输出数据的接入来源
+	provenance bool
+	// hints 指标的展示提示，为nil时不输出
+	hints *metadata.Registry
+}
+
+// parseListView 解析列表接口的公共查询参数，未指定timestamp_format时使用defaultFormat
+func parseListView(c *gin.Context, defaultFormat string) (*listView, error) {
+	view := &listView{timestampFormat: c.DefaultQuery("timestamp_format", defaultFormat)}
+	if view.timestampFormat == "" {
+		view.timestampFormat = TimestampRFC3339
+	}
+	if !ValidTimestampFormat(view.timestampFormat) {
+		return nil, fmt.Errorf("invalid timestamp_format %q", view.timestampFormat)
+	}
+
+	if sortBy := c.Query("sort_by"); sortBy != "" {
+		opts, err := storage.ParseSortOptions(sortBy, c.Query("order"))
+		if err != nil {
+			return nil, err
+		}
+		view.sort = &opts
+	}
+
+	name, err := parseNameMatcher(c)
+	if err != nil {
+		return nil, err
+	}
+	view.name = name
+	view.provenance = c.Query("include_provenance") == "true"
+	if registry, ok := c.Get(hintsKey); ok {
+		view.hints = registry.(*metadata.Registry)
+	}
+
+	if fields := c.Query("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			field = strings.TrimSpace(field)
+			if _, ok := projectable[field]; !ok {
+				return nil, fmt.Errorf("invalid field %q", field)
+			}
+			view.fields = append(view.fields, field)
+		}
+	}
+
+	return view, nil
+}
+
+// parseNameMatcher 解析指标名条件，name为glob(如cpu.*)，name_re为正则表达式，都需匹配整个指标名
+func parseNameMatcher(c *gin.Context) (*storage.NameMatcher, error) {
+	glob, expr := c.Query("name"), c.Query("name_re")
+	switch {
+	case glob != "" && expr != "":
+		return nil, fmt.Errorf("name and name_re cannot be used together")
+	case glob != "":
+		return storage.NewNameGlob(glob)
+	case expr != "":
+		return storage.NewNameRegexp(expr)
+	}
+	return nil, nil
+}
+
+// queryList 执行列表查询，需要排序时优先交给存储层在全部匹配数据上排序；
+// filter为nil或存储不支持时对fetch的结果排序
+//
+// 令牌不能查看全部数据时可见性条件加入filter，由存储层在截断前过滤，
+// 避免limit条数据被过滤后只剩很少甚至为空
+func (s *APIServer) queryList(c *gin.Context, view *listView, filter *storage.Filter, limit int, fetch func() ([]processor.ProcessedMetric, error)) ([]processor.ProcessedMetric, error) {
+	grant := acl.FromContext(c.Request.Context())
+	sq, ok := s.store(c).(storage.SortedQuerier)
+	if filter != nil && (view.name != nil || (!grant.SeesAll() && ok)) {
+		// fetch不支持指标名和可见性条件，由存储层过滤，未指定排序时按时间戳从新到旧
+		f := *filter
+		f.Name = view.name
+		grant.Apply(&f)
+		sort := storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}
+		if view.sort != nil {
+			sort = *view.sort
+		}
+		if !ok {
+			return nil, fmt.Errorf("storage does not support name filters")
+		}
+		return sq.QuerySorted(f, sort, limit)
+	}
+
+	if view.sort == nil {
+		return fetch()
+	}
+
+	if ok && filter != nil {
+		return sq.QuerySorted(*filter, *view.sort, limit)
+	}
+
+	metrics, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	// 存储可能返回内部切片，排序前先复制
+	sorted := make([]processor.ProcessedMetric, len(metrics))
+	copy(sorted, metrics)
+	storage.SortMetrics(sorted, *view.sort)
+	return sorted, nil
+}
+
+// render 移除受限指标后按列投影输出结果
+func (v *listView) render(c *gin.Context, metrics []processor.ProcessedMetric) {
+	c.JSON(http.StatusOK, v.rows(c, metrics))
+}
+
+// rows 移除受限指标后按列投影和时间戳格式转换结果
+func (v *listView) rows(c *gin.Context, metrics []processor.ProcessedMetric) interface{} {
+	metrics = visible(c, metrics)
+	if len(v.fields) == 0 && v.timestampFormat == TimestampRFC3339 && (v.provenance || !hasProvenance(metrics)) && !v.hasHints(metrics) {
+		return metrics
+	}
+
+	rows := make([]interface{}, len(metrics))
+	for i := range metrics {
+		rows[i] = v.row(&metrics[i])
+	}
+	return rows
+}
+
+// row 按列投影和时间戳格式转换单个指标
+func (v *listView) row(m *processor.ProcessedMetric) interface{} {
+	if len(v.fields) == 0 {
+		hints := v.lookupHints(m.Name)
+		if v.timestampFormat == TimestampRFC3339 && hints == nil {
+			if m.Provenance != nil && !v.provenance {
+				return withoutProvenance(m)
+			}
+			return m
+		}
+		f := formattedMetric{
+			AgentID:   m.AgentID,
+			Timestamp: v.timestamp(m.Timestamp),
+			Name:      m.Name,
+			Value:     m.Value,
+			Labels:    m.Labels,
+			Type:      m.Type,
+			Payload:   m.Payload,
+		}
+		if v.provenance {
+			f.Provenance = m.Provenance
+		}
+		f.Hints = hints
+		return f
+	}
+
+	row := make(map[string]interface{}, len(v.fields))
+	for _, field := range v.fields {
+		if field == "timestamp" {
+			row[field] = v.timestamp(m.Timestamp)
+			continue
+		}
+		row[field] = projectable[field](m)
+	}
+	return row
+}
+
+// hasProvenance 判断结果中是否有数据记录了接入来源
+func hasProvenance(metrics []processor.ProcessedMetric) bool {
+	for i := range metrics {
+		if metrics[i].Provenance != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHints 判断结果中是否有指标带有展示提示
+func (v *listView) hasHints(metrics []processor.ProcessedMetric) bool {
+	for i := range metrics {
+		if v.lookupHints(metrics[i].Name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupHints 返回指标的展示提示，没有提示或未启用时返回nil
+func (v *listView) lookupHints(name string) *metadata.Hints {
+	if v.hints == nil {
+		return nil
+	}
+	hints, ok := v.hints.Lookup(name)
+	if !ok {
+		return nil
+	}
+	return &hints
+}
+
+// withoutProvenance 返回不含接入来源的副本
+func withoutProvenance(m *processor.ProcessedMetric) *processor.ProcessedMetric {
+	stripped := *m
+	stripped.Provenance = nil
+	return &stripped
+}
+
+// timestamp 按请求的格式转换时间戳
+func (v *listView) timestamp(t time.Time) interface{} {
+	switch v.timestampFormat {
+	case TimestampUnixMs:
+		return t.UnixMilli()
+	case TimestampUnixS:
+		return t.Unix()
+	}
+	return t
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// WithCompaction 设置按需压缩存储时是否默认合并时间戳相同但值不同的数据，与storage.compaction.merge_conflicts一致
+func WithCompaction(mergeConflicts bool) Option {
+	return func(s *APIServer) {
+		s.mergeConflicts = mergeConflicts
+	}
+}
+
+// cleanupStorage 立即清理过期数据和超出容量的最旧数据，不等待存储的定时清理
+func (s *APIServer) cleanupStorage(c *gin.Context) {
+	n := s.store(c).CleanExpired()
+	log.Printf("Storage cleanup removed %d metrics", n)
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
+
+// compactStorage 立即删除重复数据，merge_conflicts参数覆盖配置的默认值
+func (s *APIServer) compactStorage(c *gin.Context) {
+	compactor, ok := s.store(c).(storage.Compactor)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "storage does not support compaction"})
+		return
+	}
+	mergeConflicts := s.mergeConflicts
+	if v := c.Query("merge_conflicts"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid merge_conflicts"})
+			return
+		}
+		mergeConflicts = b
+	}
+
+	n, err := compactor.Compact(mergeConflicts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "deleted": n})
+		return
+	}
+	log.Printf("Storage compaction removed %d duplicate metrics", n)
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
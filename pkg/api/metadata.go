@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/metadata"
+)
+
+// hintsKey 查询结果附带的展示提示注册表存储在gin.Context中的键
+const hintsKey = "metadata_hints"
+
+// WithMetadata 启用指标的展示提示，列表查询结果中有提示的指标附带hints字段
+func WithMetadata(registry *metadata.Registry) Option {
+	return func(s *APIServer) {
+		s.metadata = registry
+	}
+}
+
+// attachHints 让列表查询的结果附带展示提示
+func (s *APIServer) attachHints(c *gin.Context) {
+	c.Set(hintsKey, s.metadata)
+	c.Next()
+}
+
+// getHints 返回写入过的指标中有展示提示的指标，按指标名索引
+func (s *APIServer) getHints(c *gin.Context) {
+	c.JSON(http.StatusOK, s.metadata.All())
+}
+
+// getHint 返回一个指标的展示提示，没有提示时返回404
+func (s *APIServer) getHint(c *gin.Context) {
+	hints, ok := s.metadata.Lookup(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no hints for metric " + c.Param("name")})
+		return
+	}
+	c.JSON(http.StatusOK, hints)
+}
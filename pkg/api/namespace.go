@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// namespaceKey 请求限定的命名空间存储在gin.Context中的键
+const namespaceKey = "namespace_storage"
+
+// scopeNamespace 按namespace参数把请求限定在一个命名空间，未指定时查询所有命名空间
+func (s *APIServer) scopeNamespace(c *gin.Context) {
+	name := c.Query("namespace")
+	if name == "" {
+		c.Next()
+		return
+	}
+
+	ns, ok := s.storage.(storage.Namespacer)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "namespaces are not configured"})
+		return
+	}
+	st, ok := ns.Namespace(name)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown namespace: " + name})
+		return
+	}
+	c.Set(namespaceKey, st)
+	c.Next()
+}
+
+// store 返回请求使用的存储，指定了查询快照时为该快照，指定了命名空间时为该命名空间的存储
+func (s *APIServer) store(c *gin.Context) storage.Storage {
+	if st, ok := c.Get(snapshotKey); ok {
+		return st.(storage.Storage)
+	}
+	if st, ok := c.Get(namespaceKey); ok {
+		return st.(storage.Storage)
+	}
+	return s.storage
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/nats"
+)
+
+// WithNATS 启用NATS发布状态接口
+func WithNATS(publisher *nats.Publisher) Option {
+	return func(s *APIServer) {
+		s.nats = publisher
+	}
+}
+
+// getNATSStats 返回NATS发布的连接状态、队列长度和发布统计
+func (s *APIServer) getNATSStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.nats.Stats())
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/otlp"
+)
+
+// WithOTLP 启用OTLP/HTTP指标接入接口 POST /v1/metrics
+func WithOTLP(receiver *otlp.Receiver) Option {
+	return func(s *APIServer) {
+		s.otlp = receiver
+	}
+}
+
+// WithOTLPExport 启用OTLP导出状态接口
+func WithOTLPExport(exporter *otlp.Exporter) Option {
+	return func(s *APIServer) {
+		s.otlpExport = exporter
+	}
+}
+
+// getOTLPExportStats 返回OTLP导出的队列长度和发送统计
+func (s *APIServer) getOTLPExportStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.otlpExport.Stats())
+}
+
+// ingestOTLP 接收protobuf编码的OTLP/HTTP指标请求，支持按Content-Encoding解压
+//
+// 请求编码非法返回400；存储写入失败返回503，超出hard模式的配额返回429，客户端按OTLP规范重试。
+func (s *APIServer) ingestOTLP(c *gin.Context) {
+	if !s.otlp.Authorize(c.GetHeader("Authorization")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type")); mediaType != "application/x-protobuf" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "only application/x-protobuf is supported"})
+		return
+	}
+
+	maxSize := int64(s.otlp.MaxMessageSize())
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read body"})
+		return
+	}
+	if int64(len(body)) > maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body too large"})
+		return
+	}
+	enc, err := codec.Get(c.GetHeader("Content-Encoding"))
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	if body, err = codec.Decompress(enc, body, maxSize); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := s.otlp.Export(body)
+	if errors.Is(err, otlp.ErrInvalidRequest) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if s.quotaExceeded(c, err) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/x-protobuf", result.Response)
+}
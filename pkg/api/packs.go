@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/packs"
+)
+
+// maxPackSize 规则包大小上限
+const maxPackSize = 1 << 20
+
+// WithPacks 启用规则包管理和保存查询接口
+func WithPacks(manager *packs.Manager) Option {
+	return func(s *APIServer) {
+		s.packs = manager
+	}
+}
+
+// listPacks 列出已安装的规则包
+func (s *APIServer) listPacks(c *gin.Context) {
+	c.JSON(http.StatusOK, s.packs.List())
+}
+
+// exportPack 以YAML格式导出规则包
+func (s *APIServer) exportPack(c *gin.Context) {
+	name := c.Param("name")
+	data, err := s.packs.Export(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+name+`.yaml"`)
+	c.Data(http.StatusOK, "application/yaml", data)
+}
+
+// importPack 安装或升级规则包，请求体为YAML或JSON，force=true时允许降级
+func (s *APIServer) importPack(c *gin.Context) {
+	// 多读一个字节以便识别超限的规则包
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPackSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read pack"})
+		return
+	}
+	if len(data) > maxPackSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "pack too large"})
+		return
+	}
+
+	pack, err := packs.Parse(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.packs.Install(pack, c.Query("force") == "true"); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, packs.ErrDowngrade) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"name": pack.Name, "version": pack.Version})
+}
+
+// deletePack 卸载规则包
+func (s *APIServer) deletePack(c *gin.Context) {
+	if err := s.packs.Remove(c.Param("name")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, packs.ErrPackNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listSavedQueries 列出规则包中保存的查询
+func (s *APIServer) listSavedQueries(c *gin.Context) {
+	c.JSON(http.StatusOK, s.packs.Queries())
+}
+
+// runSavedQuery 重定向到保存的查询，请求中的参数覆盖保存的参数
+func (s *APIServer) runSavedQuery(c *gin.Context) {
+	q, err := s.packs.Query(c.Param("pack"), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	params := url.Values{}
+	for k, v := range q.Params {
+		params.Set(k, v)
+	}
+	for k, v := range c.Request.URL.Query() {
+		params[k] = v
+	}
+
+	target := q.Path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	c.Redirect(http.StatusTemporaryRedirect, target)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// pageCursor 分页游标，编码为不透明字符串返回给客户端
+//
+// AsOf固定第一页的查询时刻，之后写入的数据不会让后续页的偏移错位；
+// Query是查询条件的指纹，防止游标被用于另一组查询条件。
+type pageCursor struct {
+	Offset int    `json:"o"`
+	AsOf   int64  `json:"t"`
+	Query  uint64 `json:"q"`
+}
+
+// Pagination 分页响应的元数据
+type Pagination struct {
+	Limit      int    `json:"limit"`
+	Offset     int    `json:"offset"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// paginated 判断请求是否使用游标分页：带cursor参数（第一页可为空）或paginate=true
+func paginated(c *gin.Context) bool {
+	if _, ok := c.GetQuery("cursor"); ok {
+		return true
+	}
+	return c.Query("paginate") == "true"
+}
+
+// encodeCursor 将游标编码为URL安全的字符串
+func encodeCursor(cur pageCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor 解析游标字符串
+func decodeCursor(s string) (pageCursor, error) {
+	var cur pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &cur); err != nil || cur.Offset < 0 || cur.AsOf <= 0 {
+		return cur, errInvalidCursor
+	}
+	return cur, nil
+}
+
+// queryFingerprint 由路由、过滤条件和排序方式计算查询指纹
+func queryFingerprint(route string, filter storage.Filter, sort storage.SortOptions) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\x00%d\x00%s\x00%t",
+		route, filter.AgentID, filter.Type, unixMilli(filter.Start), unixMilli(filter.End), sort.Field, sort.Desc)
+	if filter.Name != nil {
+		fmt.Fprintf(h, "\x00%s", filter.Name)
+	}
+	return h.Sum64()
+}
+
+// unixMilli 零值时间返回0
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// renderPage 按游标查询一页数据并以{data, pagination}输出
+//
+// 未指定sort_by时按时间戳从新到旧排序，与不分页时的顺序一致。
+// 翻页期间查询的结束时间固定为第一页的查询时刻。
+func (s *APIServer) renderPage(c *gin.Context, view *listView, filter storage.Filter, limit int) {
+	if limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be positive"})
+		return
+	}
+
+	sort := storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}
+	if view.sort != nil {
+		sort = *view.sort
+	}
+	filter.Name = view.name
+	cur := pageCursor{AsOf: s.clock.Now().UnixMilli()}
+	token := c.Query("cursor")
+	if token != "" {
+		var err error
+		if cur, err = decodeCursor(token); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	asOf := time.UnixMilli(cur.AsOf)
+	if filter.End.IsZero() || filter.End.After(asOf) {
+		filter.End = asOf
+	}
+
+	// 指纹在固定结束时间后计算，end默认取当前时间的接口翻页时指纹不变
+	fingerprint := queryFingerprint(c.FullPath(), filter, sort)
+	if token != "" && cur.Query != fingerprint {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cursor does not match query parameters"})
+		return
+	}
+
+	sq, ok := s.store(c).(storage.SortedQuerier)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "storage does not support pagination"})
+		return
+	}
+	// 多取一条判断是否还有下一页，偏移量按可见的数据计算
+	acl.FromContext(c.Request.Context()).Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, sort, cur.Offset+limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+
+	page := Pagination{Limit: limit, Offset: cur.Offset}
+	if cur.Offset < len(metrics) {
+		metrics = metrics[cur.Offset:]
+	} else {
+		metrics = metrics[:0]
+	}
+	if len(metrics) > limit {
+		metrics = metrics[:limit]
+		page.HasMore = true
+		page.NextCursor = encodeCursor(pageCursor{Offset: cur.Offset + limit, AsOf: cur.AsOf, Query: fingerprint})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":       view.rows(c, metrics),
+		"pagination": page,
+	})
+}
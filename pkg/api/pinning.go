@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/pinning"
+)
+
+// WithPinning 启用Agent身份固定的管理接口
+func WithPinning(registry *pinning.Registry) Option {
+	return func(s *APIServer) {
+		s.pins = registry
+	}
+}
+
+// listPins 列出固定的Agent身份和身份变化计数
+func (s *APIServer) listPins(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"stats": s.pins.Stats(),
+		"pins":  s.pins.Pins(),
+	})
+}
+
+// listPinMismatches 列出最近的身份变化记录，最新的在前
+func (s *APIServer) listPinMismatches(c *gin.Context) {
+	c.JSON(http.StatusOK, s.pins.Mismatches())
+}
+
+// forgetPin 删除Agent的固定记录，Agent更换证书前调用，下次连接时固定新证书
+func (s *APIServer) forgetPin(c *gin.Context) {
+	if !s.pins.Forget(c.Param("agent_id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "agent is not pinned"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
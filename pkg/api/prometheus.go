@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/exposition"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// WithPrometheus 在path上启用Prometheus抓取接口
+func WithPrometheus(collector *exposition.Collector, path string) Option {
+	return func(s *APIServer) {
+		s.prometheus = collector
+		s.prometheusPath = path
+	}
+}
+
+// WithPrometheusTenants 在path/:tenant上按租户(存储命名空间)输出Prometheus抓取接口
+func WithPrometheusTenants(path string) Option {
+	return func(s *APIServer) {
+		s.prometheusTenantPath = path
+	}
+}
+
+// getPrometheusMetrics 以Prometheus文本格式输出每个序列的最新值，启用ACL时只输出令牌可见的序列，
+// 启用过期序列检测时不输出已过期的序列
+func (s *APIServer) getPrometheusMetrics(c *gin.Context) {
+	s.writePrometheus(c, "")
+}
+
+// getTenantPrometheusMetrics 与getPrometheusMetrics相同，但只输出tenant参数指定的租户的序列
+func (s *APIServer) getTenantPrometheusMetrics(c *gin.Context) {
+	tenant := c.Param("tenant")
+	if ns, ok := s.storage.(storage.Namespacer); !ok {
+		c.String(http.StatusNotFound, "tenants are not configured")
+		return
+	} else if _, ok := ns.Namespace(tenant); !ok {
+		c.String(http.StatusNotFound, "unknown tenant: "+tenant)
+		return
+	}
+	s.writePrometheus(c, tenant)
+}
+
+// writePrometheus 输出序列的最新值，tenant不为空时只输出该租户的序列
+func (s *APIServer) writePrometheus(c *gin.Context, tenant string) {
+	var allow func(m *processor.ProcessedMetric) bool
+	if grant := acl.FromContext(c.Request.Context()); grant != nil {
+		allow = grant.Allowed
+	}
+	if s.staleness != nil {
+		visible := allow
+		allow = func(m *processor.ProcessedMetric) bool {
+			return (visible == nil || visible(m)) && !s.staleness.Stale(m)
+		}
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	var err error
+	if tenant == "" {
+		err = s.prometheus.WritePrometheus(c.Writer, allow)
+	} else {
+		err = s.prometheus.WriteTenant(c.Writer, tenant, allow)
+	}
+	if err != nil {
+		c.Error(err)
+	}
+}
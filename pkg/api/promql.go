@@ -0,0 +1,116 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/promql"
+)
+
+// WithPromQL 在/api/v1/query和/api/v1/query_range启用PromQL子集查询接口
+func WithPromQL(engine *promql.Engine) Option {
+	return func(s *APIServer) {
+		s.promql = engine
+	}
+}
+
+// queryPromQL 在time参数指定的时刻执行查询，默认当前时间
+//
+// 参数和响应格式与Prometheus的/api/v1/query相同，可以用GET查询参数或POST表单传递。
+func (s *APIServer) queryPromQL(c *gin.Context) {
+	ts := s.clock.Now()
+	if v := promParam(c, "time"); v != "" {
+		t, err := parsePromTime(v)
+		if err != nil {
+			promError(c, http.StatusBadRequest, "bad_data", "invalid time: "+err.Error())
+			return
+		}
+		ts = t
+	}
+
+	result, err := s.promql.Instant(s.store(c), promParam(c, "query"), ts, acl.FromContext(c.Request.Context()))
+	s.renderPromQL(c, result, err)
+}
+
+// queryPromQLRange 按step在start到end之间的每个时刻执行查询
+//
+// 参数和响应格式与Prometheus的/api/v1/query_range相同，step可以是秒数或时长(如15s)。
+func (s *APIServer) queryPromQLRange(c *gin.Context) {
+	start, err := parsePromTime(promParam(c, "start"))
+	if err != nil {
+		promError(c, http.StatusBadRequest, "bad_data", "invalid start: "+err.Error())
+		return
+	}
+	end, err := parsePromTime(promParam(c, "end"))
+	if err != nil {
+		promError(c, http.StatusBadRequest, "bad_data", "invalid end: "+err.Error())
+		return
+	}
+	step, err := parsePromDuration(promParam(c, "step"))
+	if err != nil {
+		promError(c, http.StatusBadRequest, "bad_data", "invalid step: "+err.Error())
+		return
+	}
+
+	result, err := s.promql.Range(s.store(c), promParam(c, "query"), start, end, step, acl.FromContext(c.Request.Context()))
+	s.renderPromQL(c, result, err)
+}
+
+// renderPromQL 按Prometheus API的格式输出查询结果或错误
+func (s *APIServer) renderPromQL(c *gin.Context, result *promql.Result, err error) {
+	switch {
+	case errors.Is(err, promql.ErrUnsupported):
+		promError(c, http.StatusNotImplemented, "internal", err.Error())
+		return
+	case errors.Is(err, promql.ErrTooManySamples):
+		promError(c, http.StatusUnprocessableEntity, "execution", err.Error())
+		return
+	case err != nil:
+		promError(c, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": result})
+}
+
+// promError 输出Prometheus API格式的错误
+func promError(c *gin.Context, code int, errorType, msg string) {
+	c.JSON(code, gin.H{"status": "error", "errorType": errorType, "error": msg})
+}
+
+// promParam 读取POST表单或查询参数
+func promParam(c *gin.Context, name string) string {
+	if v, ok := c.GetPostForm(name); ok {
+		return v
+	}
+	return c.Query(name)
+}
+
+// parsePromTime 解析秒级Unix时间戳(可以带小数)或RFC3339时间
+func parsePromTime(v string) (time.Time, error) {
+	if sec, err := strconv.ParseFloat(v, 64); err == nil {
+		if math.IsNaN(sec) || math.IsInf(sec, 0) {
+			return time.Time{}, errors.New("timestamp out of range")
+		}
+		return time.UnixMilli(int64(math.Round(sec * 1000))), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// parsePromDuration 解析秒数(可以带小数)或PromQL形式的时长
+func parsePromDuration(v string) (time.Duration, error) {
+	if sec, err := strconv.ParseFloat(v, 64); err == nil {
+		if math.IsNaN(sec) || math.IsInf(sec, 0) {
+			return 0, errors.New("duration out of range")
+		}
+		return time.Duration(sec * float64(time.Second)), nil
+	}
+	return promql.ParseDuration(v)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/queries"
+)
+
+// trackQuery 将请求登记为运行中的查询，请求context在查询被取消时结束
+func (s *APIServer) trackQuery(c *gin.Context) {
+	if s.queries == nil {
+		c.Next()
+		return
+	}
+
+	ctx, done := s.queries.Start(c.Request.Context(), "http", c.Request.Method+" "+c.Request.URL.RequestURI(), c.ClientIP())
+	defer done()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// queryCanceled 查询已被取消时写入错误响应并返回true
+func (s *APIServer) queryCanceled(c *gin.Context) bool {
+	if err := context.Cause(c.Request.Context()); errors.Is(err, queries.ErrQueryCanceled) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return true
+	}
+	return false
+}
+
+// listQueries 列出运行中的查询
+func (s *APIServer) listQueries(c *gin.Context) {
+	c.JSON(http.StatusOK, s.queries.List())
+}
+
+// cancelQuery 取消指定查询
+func (s *APIServer) cancelQuery(c *gin.Context) {
+	if err := s.queries.Cancel(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
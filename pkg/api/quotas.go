@@ -0,0 +1,51 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/quota"
+)
+
+// HeaderQuotaWarning HTTP接入的数据超出配额时响应中的告警头，每项超出的配额一个值
+const HeaderQuotaWarning = "X-Kon-Quota-Warning"
+
+// WithQuotas 启用配额状态接口，HTTP接入的响应带有配额告警头
+func WithQuotas(tracker *quota.Tracker) Option {
+	return func(s *APIServer) {
+		s.quotas = tracker
+	}
+}
+
+// getQuotas 返回各配额规则的告警和拒绝次数以及当前窗口各Agent或租户的用量
+func (s *APIServer) getQuotas(c *gin.Context) {
+	c.JSON(http.StatusOK, s.quotas.Status())
+}
+
+// setQuotaWarnings 为写入了数据的Agent输出最近一个窗口内收到的配额告警
+func (s *APIServer) setQuotaWarnings(c *gin.Context, agentIDs []string) {
+	if s.quotas == nil {
+		return
+	}
+	for _, agentID := range agentIDs {
+		for _, w := range s.quotas.Warnings(agentID) {
+			c.Writer.Header().Add(HeaderQuotaWarning, w.String())
+		}
+	}
+}
+
+// quotaExceeded 判断写入是否因超出配额被拒绝，是时输出配额告警头和距离窗口结束的Retry-After
+func (s *APIServer) quotaExceeded(c *gin.Context, err error) bool {
+	var exceeded *quota.ExceededError
+	if s.quotas == nil || !errors.As(err, &exceeded) {
+		return false
+	}
+	for _, w := range exceeded.Warnings {
+		c.Writer.Header().Add(HeaderQuotaWarning, w.String())
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(s.quotas.RetryAfter().Seconds()))))
+	return true
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter 按客户端IP和API令牌分别限流的令牌桶
+type rateLimiter struct {
+	cfg config.RateLimitConfig
+
+	mu        sync.Mutex
+	ips       map[string]*bucket
+	keys      map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket 单个客户端的令牌桶及最近一次请求时间
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// WithRateLimit 按客户端IP和API令牌限制HTTP请求速率，超出时返回429和Retry-After
+func WithRateLimit(cfg config.RateLimitConfig) Option {
+	return func(s *APIServer) {
+		s.rateLimit = &rateLimiter{
+			cfg:  cfg,
+			ips:  make(map[string]*bucket),
+			keys: make(map[string]*bucket),
+		}
+	}
+}
+
+// limitRate 依次检查客户端IP和请求携带的令牌的令牌桶，任一桶不足时拒绝请求且不消耗另一个桶
+func (s *APIServer) limitRate(c *gin.Context) {
+	l := s.rateLimit
+	if l.exempt(c.Request.URL.Path) {
+		c.Next()
+		return
+	}
+
+	now := s.clock.Now()
+	var reservations []*rate.Reservation
+	l.mu.Lock()
+	l.sweep(now)
+	if l.cfg.PerIP > 0 {
+		reservations = append(reservations, l.reserve(l.ips, c.ClientIP(), l.cfg.PerIP, l.cfg.IPBurst, now))
+	}
+	if token := acl.TokenFromHeader(c.GetHeader("Authorization")); token != "" && l.cfg.PerKey > 0 {
+		reservations = append(reservations, l.reserve(l.keys, token, l.cfg.PerKey, l.cfg.KeyBurst, now))
+	}
+	l.mu.Unlock()
+
+	var delay time.Duration
+	for _, r := range reservations {
+		if !r.OK() {
+			delay = rate.InfDuration
+		} else if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		c.Next()
+		return
+	}
+
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+	if delay != rate.InfDuration {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+}
+
+// reserve 从key的令牌桶预留一个令牌，桶不存在时创建，调用方需持有锁
+func (l *rateLimiter) reserve(buckets map[string]*bucket, key string, limit float64, burst int, now time.Time) *rate.Reservation {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit), burst)}
+		buckets[key] = b
+	}
+	b.lastSeen = now
+	return b.limiter.ReserveN(now, 1)
+}
+
+// sweep 每隔idle_timeout删除一次空闲超过idle_timeout的令牌桶，空闲的桶已经装满，删除后重建不影响限流，调用方需持有锁
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.cfg.IdleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for _, buckets := range []map[string]*bucket{l.ips, l.keys} {
+		for key, b := range buckets {
+			if now.Sub(b.lastSeen) >= l.cfg.IdleTimeout {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// exempt 判断路径是否匹配不限流的前缀
+func (l *rateLimiter) exempt(path string) bool {
+	for _, prefix := range l.cfg.Exempt {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
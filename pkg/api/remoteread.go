@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/remoteread"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// maxRemoteReadBody remote_read请求体的最大长度
+const maxRemoteReadBody = 4 << 20
+
+// WithRemoteRead 在path上启用Prometheus remote_read接口
+func WithRemoteRead(reader *remoteread.Reader, path string) Option {
+	return func(s *APIServer) {
+		s.remoteRead = reader
+		s.remoteReadPath = path
+	}
+}
+
+// readRemote 按remote_read协议查询存储中的历史数据，namespace参数限定命名空间，启用ACL时只返回令牌可见的序列
+func (s *APIServer) readRemote(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxRemoteReadBody+1))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > maxRemoteReadBody {
+		c.String(http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	queries, err := remoteread.DecodeRequest(body)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sq, ok := s.store(c).(storage.SortedQuerier)
+	if !ok {
+		c.String(http.StatusNotImplemented, "storage does not support remote_read")
+		return
+	}
+	var allow func(m *processor.ProcessedMetric) bool
+	if grant := acl.FromContext(c.Request.Context()); grant != nil {
+		allow = grant.Allowed
+	}
+	resp, err := s.remoteRead.Read(sq, queries, allow)
+	if errors.Is(err, remoteread.ErrTooManySamples) {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+
+	c.Header("Content-Encoding", "snappy")
+	c.Data(http.StatusOK, "application/x-protobuf", resp)
+}
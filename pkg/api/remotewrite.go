@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/remotewrite"
+)
+
+// WithRemoteWrite 启用remote_write转发状态接口
+func WithRemoteWrite(forwarder *remotewrite.Forwarder) Option {
+	return func(s *APIServer) {
+		s.remoteWrite = forwarder
+	}
+}
+
+// getRemoteWriteStats 返回remote_write转发的队列长度和发送统计
+func (s *APIServer) getRemoteWriteStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.remoteWrite.Stats())
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/rollup"
+)
+
+// WithRollups 启用时间范围查询的resolution参数
+func WithRollups(store *rollup.Store) Option {
+	return func(s *APIServer) {
+		s.rollups = store
+	}
+}
+
+// getRollupStats 返回各降采样级别的状态和丢弃的迟到样本数
+func (s *APIServer) getRollupStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.rollups.Stats())
+}
+
+// getRollups 返回降采样数据，可按agent_id和name过滤，不支持排序和列投影参数
+func (s *APIServer) getRollups(c *gin.Context, resolution string, start, end time.Time, limit int) {
+	if s.rollups == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rollups are not enabled"})
+		return
+	}
+	res, err := time.ParseDuration(resolution)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid resolution"})
+		return
+	}
+	if c.Query("sort_by") != "" || c.Query("fields") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort_by and fields are not supported with resolution"})
+		return
+	}
+
+	grant := acl.FromContext(c.Request.Context())
+	points, err := s.rollups.Query(res, rollup.Query{
+		AgentID: c.Query("agent_id"),
+		Name:    c.Query("name"),
+		Start:   start,
+		End:     end,
+		Limit:   limit,
+		Visible: func(agentID, name string) bool { return grant.AllowedSeries(agentID, name) },
+	})
+	if err != nil {
+		available := make([]string, 0)
+		for _, r := range s.rollups.Resolutions() {
+			available = append(available, r.String())
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "resolutions": available})
+		return
+	}
+	if s.queryCanceled(c) {
+		return
+	}
+
+	c.JSON(http.StatusOK, points)
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/selfmetrics"
+)
+
+// WithSelfMetrics 记录API请求延迟，并在path上输出服务器自身的指标
+func WithSelfMetrics(metrics *selfmetrics.Metrics, path string) Option {
+	return func(s *APIServer) {
+		s.selfMetrics = metrics
+		s.selfMetricsPath = path
+	}
+}
+
+// observeRequest 按方法、路由模板和状态码记录请求耗时，未匹配路由的请求记为unmatched
+func (s *APIServer) observeRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	s.selfMetrics.ObserveRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+}
+
+// getSelfMetrics 以Prometheus文本格式输出服务器自身的指标
+func (s *APIServer) getSelfMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := s.selfMetrics.WritePrometheus(c.Writer); err != nil {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// snapshotKey 请求指定的查询快照存储在gin.Context中的键
+const snapshotKey = "snapshot_storage"
+
+// querySnapshots 查询快照，每个快照是创建时存储数据的只读副本
+type querySnapshots struct {
+	cfg config.QuerySnapshotsConfig
+
+	mu        sync.Mutex
+	snapshots map[string]*querySnapshot
+}
+
+// querySnapshot 一个查询快照
+type querySnapshot struct {
+	ID        string    `json:"snapshot_id"`
+	Namespace string    `json:"namespace,omitempty"`
+	Metrics   int       `json:"metrics"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	store storage.Storage
+}
+
+// WithQuerySnapshots 启用查询快照，查询接口带snapshot_id参数时读取快照而不是当前数据，
+// 仪表盘的多个面板使用同一个快照可以看到同一时刻的数据
+func WithQuerySnapshots(cfg config.QuerySnapshotsConfig) Option {
+	return func(s *APIServer) {
+		s.snapshots = &querySnapshots{
+			cfg:       cfg,
+			snapshots: make(map[string]*querySnapshot),
+		}
+	}
+}
+
+// createSnapshot 复制请求限定的命名空间或全部数据，返回快照ID和过期时间
+func (s *APIServer) createSnapshot(c *gin.Context) {
+	now := s.clock.Now()
+	q := s.snapshots
+	q.mu.Lock()
+	q.expire(now)
+	full := len(q.snapshots) >= q.cfg.MaxSnapshots
+	q.mu.Unlock()
+	if full {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many snapshots, release unused snapshots first"})
+		return
+	}
+
+	// 复制可能较慢，不持有锁，之后再次检查数量
+	st, err := storage.Freeze(s.store(c), q.cfg.MaxMetrics)
+	if errors.Is(err, storage.ErrFreezeTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stats, err := st.Stats()
+	if err != nil {
+		st.Close()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	snap := &querySnapshot{
+		ID:        newSnapshotID(),
+		Namespace: c.Query("namespace"),
+		Metrics:   stats.Total,
+		CreatedAt: now,
+		ExpiresAt: now.Add(q.cfg.TTL),
+		store:     st,
+	}
+	q.mu.Lock()
+	if len(q.snapshots) >= q.cfg.MaxSnapshots {
+		q.mu.Unlock()
+		st.Close()
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many snapshots, release unused snapshots first"})
+		return
+	}
+	q.snapshots[snap.ID] = snap
+	q.mu.Unlock()
+
+	log.Printf("Created query snapshot %s with %d metrics", snap.ID, snap.Metrics)
+	c.JSON(http.StatusCreated, snap)
+}
+
+// releaseSnapshot 释放快照，之后使用该快照的查询返回404
+func (s *APIServer) releaseSnapshot(c *gin.Context) {
+	q := s.snapshots
+	q.mu.Lock()
+	snap, ok := q.snapshots[c.Param("id")]
+	delete(q.snapshots, c.Param("id"))
+	q.mu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown snapshot"})
+		return
+	}
+	snap.store.Close()
+	c.Status(http.StatusNoContent)
+}
+
+// useSnapshot 请求带snapshot_id参数时改为查询该快照，快照的命名空间在创建时确定，忽略namespace参数
+func (s *APIServer) useSnapshot(c *gin.Context) {
+	id := c.Query("snapshot_id")
+	if id == "" {
+		c.Next()
+		return
+	}
+	if s.snapshots == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "query snapshots are not enabled"})
+		return
+	}
+
+	q := s.snapshots
+	q.mu.Lock()
+	q.expire(s.clock.Now())
+	snap, ok := q.snapshots[id]
+	q.mu.Unlock()
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "unknown or expired snapshot: " + id})
+		return
+	}
+	c.Set(snapshotKey, snap.store)
+	c.Next()
+}
+
+// expire 删除已过期的快照，调用方需持有锁
+func (q *querySnapshots) expire(now time.Time) {
+	for id, snap := range q.snapshots {
+		if !now.Before(snap.ExpiresAt) {
+			delete(q.snapshots, id)
+			snap.store.Close()
+			log.Printf("Query snapshot %s expired", id)
+		}
+	}
+}
+
+// newSnapshotID 生成随机的快照ID
+func newSnapshotID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
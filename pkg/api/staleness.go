@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/staleness"
+)
+
+// WithStaleness 启用过期序列检测，过期序列不再出现在最新值和Prometheus抓取结果中
+func WithStaleness(tracker *staleness.Tracker) Option {
+	return func(s *APIServer) {
+		s.staleness = tracker
+	}
+}
+
+// getStaleSeries 返回已标记为过期的序列和检测统计，可按agent_id过滤，启用ACL时只返回令牌可见的序列
+func (s *APIServer) getStaleSeries(c *gin.Context) {
+	grant := acl.FromContext(c.Request.Context())
+	series := slices.DeleteFunc(s.staleness.List(c.Query("agent_id")), func(st staleness.Series) bool {
+		return !grant.Allowed(&processor.ProcessedMetric{AgentID: st.AgentID, Name: st.Name, Labels: st.Labels})
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"stats":  s.staleness.Stats(),
+		"series": series,
+	})
+}
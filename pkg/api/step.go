@@ -0,0 +1,170 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/onchange"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 阶梯序列查询的限制
+const (
+	maxStepPoints   = 11000
+	maxStepSamples  = 100000
+	defaultLookback = 5 * time.Minute
+)
+
+// WithOnChangeFilter 阶梯序列查询按只保存变化值规则的heartbeat确定回看时间
+func WithOnChangeFilter(filter *onchange.Filter) Option {
+	return func(s *APIServer) {
+		s.onChange = filter
+	}
+}
+
+// stepSeries 一个标签组合的阶梯序列
+type stepSeries struct {
+	Labels map[string]string `json:"labels"`
+	Points []onchange.Point  `json:"points"`
+}
+
+// getStepSeries 按固定间隔还原序列，每个点取不晚于该时刻的最近样本值
+//
+// 用于查询只保存变化值的指标，参数为agent_id、name、start/end(毫秒)、
+// step和lookback(时长，如30s)，可以用match参数(如match=cpu="0")按标签过滤。
+// 指标名相同、标签不同的样本分别还原为一个序列，按标签排序。
+func (s *APIServer) getStepSeries(c *gin.Context) {
+	agentID := c.Query("agent_id")
+	name := c.Query("name")
+	if agentID == "" || name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "agent_id and name are required"})
+		return
+	}
+	var matchers []*storage.LabelMatcher
+	for _, p := range c.QueryArray("match") {
+		m, err := storage.ParseLabelMatcher(p)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		matchers = append(matchers, m)
+	}
+
+	now := s.clock.Now().UnixMilli()
+	start, err := strconv.ParseInt(c.DefaultQuery("start", strconv.FormatInt(now-time.Hour.Milliseconds(), 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start timestamp"})
+		return
+	}
+	end, err := strconv.ParseInt(c.DefaultQuery("end", strconv.FormatInt(now, 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end timestamp"})
+		return
+	}
+	step, err := time.ParseDuration(c.DefaultQuery("step", "1m"))
+	if err != nil || step < time.Millisecond {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid step"})
+		return
+	}
+	if end < start || (end-start)/step.Milliseconds() >= maxStepPoints {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid range or too many points"})
+		return
+	}
+
+	lookback := defaultLookback
+	if s.onChange != nil {
+		if heartbeat, ok := s.onChange.Heartbeat(agentID, name); ok && heartbeat > 0 {
+			lookback = heartbeat
+		}
+	}
+	if v := c.Query("lookback"); v != "" {
+		if lookback, err = time.ParseDuration(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid lookback"})
+			return
+		}
+	}
+
+	startTime := time.UnixMilli(start)
+	endTime := time.UnixMilli(end)
+	samples, err := s.stepSamples(c, agentID, name, matchers, startTime.Add(-lookback), endTime)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	samples = visible(c, samples)
+	if s.queryCanceled(c) {
+		return
+	}
+
+	groups := make(map[string][]processor.ProcessedMetric)
+	for _, m := range samples {
+		key := labelKey(m.Labels)
+		groups[key] = append(groups[key], m)
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]stepSeries, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		series = append(series, stepSeries{
+			Labels: group[0].Labels,
+			Points: onchange.Step(group, startTime, endTime, step, lookback),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"agent_id": agentID,
+		"name":     name,
+		"step":     step.String(),
+		"series":   series,
+	})
+}
+
+// stepSamples 取出Agent的指标在时间范围内满足标签条件的样本，按时间升序排列，
+// 过滤条件交给存储层，maxStepSamples只限制匹配的样本数
+func (s *APIServer) stepSamples(c *gin.Context, agentID, name string, matchers []*storage.LabelMatcher, from, to time.Time) ([]processor.ProcessedMetric, error) {
+	sq, ok := s.store(c).(storage.SortedQuerier)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support name filters")
+	}
+	nameMatcher, err := storage.NewNameGlob(globEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	filter := storage.Filter{AgentID: agentID, Start: from, End: to, Name: nameMatcher, Labels: matchers}
+	acl.FromContext(c.Request.Context()).Apply(&filter)
+	return sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp}, maxStepSamples)
+}
+
+// globEscape 转义glob中的特殊字符，得到只匹配s本身的模式
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(s)
+}
+
+// labelKey 按标签名排序后的标签组合，用于区分同名指标的不同序列
+func labelKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/stream"
+	"golang.org/x/net/websocket"
+)
+
+// streamWriteTimeout 向订阅者发送一条消息的最长时间，超时认为连接已断开
+const streamWriteTimeout = 10 * time.Second
+
+// WithStream 启用WebSocket和SSE实时推送接口
+func WithStream(hub *stream.Hub) Option {
+	return func(s *APIServer) {
+		s.stream = hub
+	}
+}
+
+// authorizeStream 校验推送接口的令牌，浏览器无法为WebSocket和EventSource设置请求头，允许通过token参数传递
+func (s *APIServer) authorizeStream(c *gin.Context) {
+	if (s.acl != nil || s.jwt != nil) && c.GetHeader("Authorization") == "" {
+		if token := c.Query("token"); token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	s.authorize(c)
+}
+
+// streamMetrics 通过WebSocket推送QUIC接入的指标，每条消息是一个指标的JSON
+//
+// 可按agent_id、name和type过滤，fields和timestamp_format与列表接口相同。
+// 订阅者读取过慢时丢弃新指标而不阻塞接入。
+func (s *APIServer) streamMetrics(c *gin.Context) {
+	view, err := parseListView(c, s.timestampFormat)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub, err := s.stream.Subscribe(stream.Filter{
+		AgentID: c.Query("agent_id"),
+		Name:    c.Query("name"),
+		Type:    c.Query("type"),
+	})
+	if errors.Is(err, stream.ErrTooManySubscribers) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer s.stream.Unsubscribe(sub)
+
+	grant := acl.FromContext(c.Request.Context())
+	server := websocket.Server{
+		Handshake: s.checkStreamOrigin,
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			// 清除HTTP服务器设置的读超时，订阅者可以长时间不发送数据
+			ws.SetReadDeadline(time.Time{})
+
+			// 客户端不发送数据，读到EOF或出错说明连接已关闭
+			closed := make(chan struct{})
+			go func() {
+				io.Copy(io.Discard, ws)
+				close(closed)
+			}()
+
+			for {
+				select {
+				case <-closed:
+					return
+				case ev, ok := <-sub.C:
+					if !ok {
+						return
+					}
+					if !grant.Allowed(&ev.Metric) {
+						continue
+					}
+					ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+					if err := websocket.JSON.Send(ws, view.row(&ev.Metric)); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// checkStreamOrigin 按CORS配置校验浏览器发起的WebSocket连接，未配置允许的来源时只允许同源
+func (s *APIServer) checkStreamOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	cfg.Origin = u
+	if u.Host == r.Host {
+		return nil
+	}
+	if s.cors != nil {
+		for _, allowed := range s.cors.AllowedOrigins {
+			if allowed == "*" || allowed == origin {
+				return nil
+			}
+		}
+	}
+	return errors.New("origin not allowed")
+}
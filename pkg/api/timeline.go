@@ -0,0 +1,76 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/timeline"
+)
+
+// WithTimeline 启用Agent活动时间线接口
+func WithTimeline(recorder *timeline.Recorder) Option {
+	return func(s *APIServer) {
+		s.timeline = recorder
+	}
+}
+
+// getAgentTimeline 按时间顺序返回Agent在[start, end)内的连接、断开、身份校验失败、接入错误和告警事件，
+// 以及每个时间段写入的批次数
+//
+// start和end为毫秒时间戳，默认最近24小时。启用SLA跟踪时包含该Agent的新鲜度告警。
+func (s *APIServer) getAgentTimeline(c *gin.Context) {
+	agentID := c.Param("agent_id")
+	if !acl.FromContext(c.Request.Context()).AllowedAgent(agentID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no activity recorded for agent"})
+		return
+	}
+
+	end := s.clock.Now()
+	if v := c.Query("end"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end timestamp"})
+			return
+		}
+		end = time.UnixMilli(ms)
+	}
+	start := end.Add(-24 * time.Hour)
+	if v := c.Query("start"); v != "" {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start timestamp"})
+			return
+		}
+		start = time.UnixMilli(ms)
+	}
+
+	tl, ok, err := s.timeline.Timeline(agentID, start, end)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no activity recorded for agent"})
+		return
+	}
+
+	if s.sla != nil {
+		for _, alert := range s.sla.Alerts() {
+			if alert.AgentID != agentID || alert.Time.Before(tl.Start) || !alert.Time.Before(tl.End) {
+				continue
+			}
+			tl.Events = append(tl.Events, timeline.Event{
+				Time:   alert.Time,
+				Type:   timeline.EventAlert,
+				Detail: fmt.Sprintf("%s late for %d checks, last seen %s", alert.Metric, alert.ConsecutiveLate, alert.LastSeen.Format(time.RFC3339)),
+			})
+		}
+		sort.SliceStable(tl.Events, func(i, j int) bool { return tl.Events[i].Time.Before(tl.Events[j].Time) })
+	}
+	c.JSON(http.StatusOK, tl)
+}
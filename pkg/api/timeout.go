@@ -0,0 +1,92 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// routeTimeoutKey 请求已按route_timeouts设置超时时在gin上下文中的键
+const routeTimeoutKey = "route_timeout"
+
+// WithRouteTimeouts 按接口覆盖HTTP服务器的全局读写超时
+func WithRouteTimeouts(routes []config.RouteTimeoutConfig) Option {
+	return func(s *APIServer) {
+		if len(routes) == 0 {
+			return
+		}
+		s.routeTimeouts = make(map[string]config.RouteTimeoutConfig, len(routes))
+		for _, rt := range routes {
+			s.routeTimeouts[rt.Method+" "+rt.Path] = rt
+		}
+	}
+}
+
+// applyRouteTimeouts 按请求匹配的路由设置连接的读写截止时间，先按方法和路径匹配，再只按路径匹配
+func (s *APIServer) applyRouteTimeouts(c *gin.Context) {
+	rt, ok := s.routeTimeouts[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		rt, ok = s.routeTimeouts[" "+c.FullPath()]
+	}
+	if !ok {
+		c.Next()
+		return
+	}
+
+	rc := http.NewResponseController(c.Writer)
+	if rt.ReadTimeout != 0 {
+		rc.SetReadDeadline(routeDeadline(rt.ReadTimeout))
+	}
+	if rt.WriteTimeout != 0 {
+		rc.SetWriteDeadline(routeDeadline(rt.WriteTimeout))
+	}
+	c.Set(routeTimeoutKey, true)
+	c.Next()
+}
+
+// routeDeadline 超时为负数时不限制
+func routeDeadline(d time.Duration) time.Time {
+	if d < 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// checkRouteTimeouts 提示route_timeouts中没有匹配任何路由的配置
+func (s *APIServer) checkRouteTimeouts(routes gin.RoutesInfo) {
+	for _, rt := range s.routeTimeouts {
+		found := false
+		for _, r := range routes {
+			if r.Path == rt.Path && (rt.Method == "" || r.Method == rt.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			method := rt.Method
+			if method == "" {
+				method = "*"
+			}
+			log.Printf("Route timeout for %s %s matches no API route", method, rt.Path)
+		}
+	}
+}
+
+// streaming 用于持续输出响应的接口，去掉HTTP服务器的全局写超时，
+// 改为每次输出前由extendWriteDeadline设置超时；route_timeouts中配置了该接口时以配置为准
+func (s *APIServer) streaming(c *gin.Context) {
+	if !c.GetBool(routeTimeoutKey) {
+		http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	}
+	c.Next()
+}
+
+// extendWriteDeadline 流式接口每次输出前调用，客户端在streamWriteTimeout内读不完一次输出时断开连接
+func (s *APIServer) extendWriteDeadline(c *gin.Context, rc *http.ResponseController) {
+	if !c.GetBool(routeTimeoutKey) {
+		rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// WithTLS 在API端口提供HTTPS，redirectPort非0时同时在该端口监听HTTP并重定向到HTTPS
+func WithTLS(cfg *tls.Config, redirectPort int) Option {
+	return func(s *APIServer) {
+		s.tls = cfg
+		s.redirectPort = redirectPort
+	}
+}
+
+// tlsListener 按当前TLS配置包装新连接，配置为nil时为明文HTTP，替换配置不影响已建立的连接
+type tlsListener struct {
+	net.Listener
+	config atomic.Pointer[tls.Config]
+}
+
+// newTLSListener 创建使用cfg的监听，cfg为nil时为明文HTTP
+func newTLSListener(ln net.Listener, cfg *tls.Config) *tlsListener {
+	l := &tlsListener{Listener: ln}
+	l.setConfig(cfg)
+	return l
+}
+
+// setConfig 替换之后接受的连接使用的TLS配置，未设置ALPN时同时支持HTTP/2和HTTP/1.1
+func (l *tlsListener) setConfig(cfg *tls.Config) {
+	if cfg != nil && len(cfg.NextProtos) == 0 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	l.config.Store(cfg)
+}
+
+// Accept 接受连接，启用TLS时返回TLS连接，握手在第一次读写时进行
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if cfg := l.config.Load(); cfg != nil {
+		return tls.Server(conn, cfg), nil
+	}
+	return conn, nil
+}
+
+// startRedirect 在port监听HTTP，把所有请求永久重定向到当前的HTTPS端口，调用方需持有listenMu
+func (s *APIServer) startRedirect(port int) error {
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      http.HandlerFunc(s.redirectHTTPS),
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for https redirect: %w", err)
+	}
+	s.redirect = server
+	s.redirectPort = port
+
+	log.Printf("HTTP to HTTPS redirect listening on %s", server.Addr)
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTPS redirect server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// redirectHTTPS 保留请求的主机名、路径和查询参数，端口改为当前的HTTPS端口，443时省略
+func (s *APIServer) redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	s.listenMu.Lock()
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	s.listenMu.Unlock()
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/topk"
+)
+
+// WithTopK 启用近似Top-K查询
+func WithTopK(tracker *topk.Tracker) Option {
+	return func(s *APIServer) {
+		s.topk = tracker
+	}
+}
+
+// getTopK 返回指标在标签上累计最大的k个取值
+//
+// 参数为metric、label、k(默认20)和previous(查询上一个完整窗口)。
+// 标签取值超过计数器数量时结果为近似值，approximate为true，每项的error为可能的高估量。
+func (s *APIServer) getTopK(c *gin.Context) {
+	metric := c.Query("metric")
+	label := c.Query("label")
+	if metric == "" || label == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metric and label are required"})
+		return
+	}
+	k, err := strconv.Atoi(c.DefaultQuery("k", "20"))
+	if err != nil || k <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid k"})
+		return
+	}
+	previous, _ := strconv.ParseBool(c.Query("previous"))
+
+	// 统计结果跨Agent和标签，受限规则按指标名保守判断
+	if !acl.FromContext(c.Request.Context()).AllowedSeries("", metric) {
+		c.JSON(http.StatusNotFound, gin.H{"error": topk.ErrNotTracked.Error()})
+		return
+	}
+
+	result, err := s.topk.Query(metric, label, k, previous)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, topk.ErrNotTracked) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
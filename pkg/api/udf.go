@@ -0,0 +1,47 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/udf"
+)
+
+// listUDFs 列出已加载的WASM处理函数
+func (s *APIServer) listUDFs(c *gin.Context) {
+	c.JSON(http.StatusOK, s.udfs.List())
+}
+
+// uploadUDF 上传或替换WASM处理函数，请求体为模块二进制
+func (s *APIServer) uploadUDF(c *gin.Context) {
+	name := c.Param("name")
+
+	// 多读一个字节以便识别超限的模块
+	binary, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(s.udfs.MaxModuleSize())+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read module"})
+		return
+	}
+
+	if err := s.udfs.Load(name, binary); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, udf.ErrModuleTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"name": name, "size": len(binary)})
+}
+
+// deleteUDF 卸载WASM处理函数
+func (s *APIServer) deleteUDF(c *gin.Context) {
+	if err := s.udfs.Remove(c.Param("name")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
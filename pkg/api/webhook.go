@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/importer"
+	"golang.org/x/time/rate"
+)
+
+// Webhook签名相关请求头
+//
+// 签名为 sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))，
+// timestamp为Unix秒，用于拒绝重放的旧请求。
+const (
+	HeaderWebhookTimestamp = "X-Kon-Timestamp"
+	HeaderWebhookSignature = "X-Kon-Signature"
+)
+
+// webhookIngest Webhook接入的数据源和导入器
+type webhookIngest struct {
+	importer    *importer.Importer
+	maxBodySize int64
+	maxSkew     time.Duration
+	sources     map[string]*webhookSource
+}
+
+// webhookSource 单个数据源的密钥和限流器
+type webhookSource struct {
+	secret  []byte
+	limiter *rate.Limiter
+}
+
+// WithWebhook 启用签名Webhook数据接入，im应将数据写入与QUIC相同的处理链路
+func WithWebhook(cfg config.WebhookConfig, im *importer.Importer) Option {
+	return func(s *APIServer) {
+		w := &webhookIngest{
+			importer:    im,
+			maxBodySize: cfg.MaxBodySize,
+			maxSkew:     cfg.MaxSkew,
+			sources:     make(map[string]*webhookSource, len(cfg.Sources)),
+		}
+		for _, src := range cfg.Sources {
+			w.sources[src.Name] = &webhookSource{
+				secret:  []byte(src.Secret),
+				limiter: rate.NewLimiter(rate.Limit(src.RateLimit), src.Burst),
+			}
+		}
+		s.webhook = w
+	}
+}
+
+// ingestWebhook 接收ndjson格式的指标数据，每行一条记录，格式与导入文件相同
+func (s *APIServer) ingestWebhook(c *gin.Context) {
+	name := c.Param("source")
+	src, ok := s.webhook.sources[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown webhook source"})
+		return
+	}
+
+	// 先限流再验签，避免被未签名的请求消耗计算资源
+	reservation := src.limiter.Reserve()
+	if delay := reservation.DelayFrom(s.clock.Now()); delay > 0 {
+		reservation.Cancel()
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, s.webhook.maxBodySize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read body"})
+		return
+	}
+	if int64(len(body)) > s.webhook.maxBodySize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body too large"})
+		return
+	}
+
+	if !s.verifyWebhook(c, src, body) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	// 签名针对传输的原始数据，验签后再按Content-Encoding解压
+	c.Header("Accept-Encoding", strings.Join(codec.Names(), ", "))
+	enc, err := codec.Get(c.GetHeader("Content-Encoding"))
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	body, err = codec.Decompress(enc, body, s.webhook.maxBodySize)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to decode body: " + err.Error()})
+		return
+	}
+
+	// 未携带agent_id的记录以数据源名作为Agent ID
+	result, err := s.webhook.importer.ImportAs(bytes.NewReader(body), importer.FormatJSONL, name)
+	if s.quotaExceeded(c, err) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+
+	s.setQuotaWarnings(c, result.AgentIDs)
+	c.JSON(http.StatusOK, result)
+}
+
+// verifyWebhook 校验时间戳和HMAC签名
+func (s *APIServer) verifyWebhook(c *gin.Context, src *webhookSource, body []byte) bool {
+	timestamp := c.GetHeader(HeaderWebhookTimestamp)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := s.clock.Now().Sub(time.Unix(sec, 0))
+	if skew > s.webhook.maxSkew || skew < -s.webhook.maxSkew {
+		return false
+	}
+
+	signature, ok := strings.CutPrefix(c.GetHeader(HeaderWebhookSignature), "sha256=")
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, src.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
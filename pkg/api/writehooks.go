@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/konpure/Kon-Agent-export/pkg/writehook"
+)
+
+// WithWriteHooks 启用写入钩子状态接口
+func WithWriteHooks(dispatcher *writehook.Dispatcher) Option {
+	return func(s *APIServer) {
+		s.writeHooks = dispatcher
+	}
+}
+
+// getWriteHookStats 返回各写入钩子的队列长度和调用统计
+func (s *APIServer) getWriteHookStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.writeHooks.Stats())
+}
@@ -0,0 +1,322 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/protobuf/proto"
+)
+
+// 对象格式
+const (
+	FormatNDJSON   = "ndjson"
+	FormatProtobuf = "protobuf"
+)
+
+// codecExtensions 压缩算法对应的对象键扩展名
+var codecExtensions = map[string]string{
+	codec.None:   "",
+	codec.Gzip:   ".gz",
+	codec.Zstd:   ".zst",
+	codec.Snappy: ".sz",
+	codec.LZ4:    ".lz4",
+}
+
+// uploader 上传对象的目标存储
+type uploader interface {
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+}
+
+// Archiver 把即将过期删除的数据按日期分批压缩后上传到对象存储
+//
+// 存储在CleanExpired删除数据前调用Archive，数据按时间戳的UTC日期分组，
+// 一组满batch_size条时立即上传，未满的组在flush_interval后或Close时上传。
+// 上传在调用方的协程中进行并按retries重试，仍失败时丢弃该批数据并记录日志。
+type Archiver struct {
+	format        string
+	codec         codec.Codec
+	prefix        string
+	instance      string
+	batchSize     int
+	flushInterval time.Duration
+	retries       int
+	timeout       time.Duration
+	store         uploader
+	clock         clock.Clock
+
+	mu      sync.Mutex
+	pending map[string][]processor.ProcessedMetric
+	since   time.Time
+
+	// uploadMu 串行上传，保证序号递增
+	uploadMu sync.Mutex
+	seq      uint64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New 按配置创建归档器并启动定时上传
+func New(cfg config.ArchiveConfig, clk clock.Clock) (*Archiver, error) {
+	if cfg.Format != FormatNDJSON && cfg.Format != FormatProtobuf {
+		return nil, fmt.Errorf("unknown archive format %q", cfg.Format)
+	}
+	c, err := codec.Get(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newS3Client(cfg.S3, clk)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archiver{
+		format:        cfg.Format,
+		codec:         c,
+		prefix:        strings.Trim(cfg.Prefix, "/"),
+		instance:      strconv.FormatInt(clk.Now().UnixNano(), 36),
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		retries:       cfg.Retries,
+		timeout:       cfg.UploadTimeout,
+		store:         store,
+		clock:         clk,
+		pending:       make(map[string][]processor.ProcessedMetric),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Archive 加入即将删除的数据，满一批时上传，作为存储的过期回调使用
+func (a *Archiver) Archive(metrics []processor.ProcessedMetric) {
+	var full [][]processor.ProcessedMetric
+
+	a.mu.Lock()
+	if len(a.pending) == 0 {
+		a.since = a.clock.Now()
+	}
+	for i := range metrics {
+		day := metrics[i].Timestamp.UTC().Format("2006/01/02")
+		batch := append(a.pending[day], metrics[i])
+		if len(batch) >= a.batchSize {
+			full = append(full, batch)
+			batch = nil
+		}
+		a.pending[day] = batch
+	}
+	a.mu.Unlock()
+
+	for _, batch := range full {
+		a.upload(batch)
+	}
+}
+
+// Close 上传所有未满一批的数据
+func (a *Archiver) Close() {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+		a.flush()
+	})
+}
+
+// run 定时上传等待超过flush_interval的数据
+func (a *Archiver) run() {
+	defer close(a.done)
+
+	ticker := a.clock.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			a.mu.Lock()
+			due := len(a.pending) > 0 && a.clock.Now().Sub(a.since) >= a.flushInterval
+			a.mu.Unlock()
+			if due {
+				a.flush()
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// flush 上传所有等待中的数据
+func (a *Archiver) flush() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = make(map[string][]processor.ProcessedMetric)
+	a.mu.Unlock()
+
+	for _, batch := range pending {
+		if len(batch) > 0 {
+			a.upload(batch)
+		}
+	}
+}
+
+// upload 编码、压缩并上传一批同一天的数据，失败时按retries重试
+func (a *Archiver) upload(batch []processor.ProcessedMetric) {
+	a.uploadMu.Lock()
+	defer a.uploadMu.Unlock()
+
+	body, contentType, err := a.encode(batch)
+	if err != nil {
+		log.Printf("Failed to encode %d expired metrics for archive: %v", len(batch), err)
+		return
+	}
+	a.seq++
+	key := a.key(batch, a.seq)
+
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+		err = a.store.Put(ctx, key, body, contentType)
+		cancel()
+		if err == nil {
+			log.Printf("Archived %d expired metrics to %s (%d bytes)", len(batch), key, len(body))
+			return
+		}
+		if attempt >= a.retries {
+			break
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	log.Printf("Failed to archive %d expired metrics to %s, dropping them: %v", len(batch), key, err)
+}
+
+// InjectFaults 按故障注入器的send_failure_probability让上传失败，injector为nil时不注入
+func (a *Archiver) InjectFaults(injector *chaos.Injector) {
+	if injector != nil {
+		a.store = faultyUploader{uploader: a.store, faults: injector}
+	}
+}
+
+// faultyUploader 按概率在上传前返回注入的错误
+type faultyUploader struct {
+	uploader
+	faults *chaos.Injector
+}
+
+// Put 注入失败时不上传
+func (u faultyUploader) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	if err := u.faults.FailSend("archive"); err != nil {
+		return err
+	}
+	return u.uploader.Put(ctx, key, body, contentType)
+}
+
+// key 返回对象键 prefix/YYYY/MM/DD/首条时间戳-末条时间戳-实例-序号.扩展名，时间戳为毫秒
+func (a *Archiver) key(batch []processor.ProcessedMetric, seq uint64) string {
+	first, last := batch[0].Timestamp, batch[0].Timestamp
+	for i := range batch {
+		if batch[i].Timestamp.Before(first) {
+			first = batch[i].Timestamp
+		}
+		if batch[i].Timestamp.After(last) {
+			last = batch[i].Timestamp
+		}
+	}
+
+	ext := ".ndjson"
+	if a.format == FormatProtobuf {
+		ext = ".pb"
+	}
+	name := fmt.Sprintf("%d-%d-%s-%06d%s%s", first.UnixMilli(), last.UnixMilli(), a.instance, seq, ext, codecExtensions[a.codec.Name()])
+	return path.Join(a.prefix, first.UTC().Format("2006/01/02"), name)
+}
+
+// encode 按配置的格式编码并压缩一批数据
+func (a *Archiver) encode(batch []processor.ProcessedMetric) ([]byte, string, error) {
+	var (
+		buf         bytes.Buffer
+		contentType string
+		err         error
+	)
+	switch a.format {
+	case FormatProtobuf:
+		contentType = "application/x-protobuf"
+		err = encodeProtobuf(&buf, batch)
+	default:
+		contentType = "application/x-ndjson"
+		err = encodeNDJSON(&buf, batch)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	body, err := codec.Compress(a.codec, buf.Bytes())
+	if err != nil {
+		return nil, "", err
+	}
+	return body, contentType, nil
+}
+
+// encodeNDJSON 每行一条数据，与导入接口的jsonl格式兼容
+func encodeNDJSON(buf *bytes.Buffer, batch []processor.ProcessedMetric) error {
+	enc := json.NewEncoder(buf)
+	for i := range batch {
+		if err := enc.Encode(&batch[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeProtobuf 按Agent分组写入带4字节大端长度前缀的BatchMetricsRequest，时间戳为毫秒
+func encodeProtobuf(buf *bytes.Buffer, batch []processor.ProcessedMetric) error {
+	requests := make(map[string]*protocol.BatchMetricsRequest)
+	order := make([]string, 0)
+	for i := range batch {
+		m := &batch[i]
+		req, ok := requests[m.AgentID]
+		if !ok {
+			req = &protocol.BatchMetricsRequest{AgentId: m.AgentID}
+			requests[m.AgentID] = req
+			order = append(order, m.AgentID)
+		}
+
+		metricType := m.RawType
+		if value, ok := protocol.MetricType_value[m.Type]; ok {
+			metricType = protocol.MetricType(value)
+		}
+		req.Metrics = append(req.Metrics, &protocol.Metric{
+			Timestamp: m.Timestamp.UnixMilli(),
+			Name:      m.Name,
+			Value:     m.Value,
+			Labels:    m.Labels,
+			Type:      metricType,
+			Payload:   m.Payload,
+		})
+	}
+
+	for _, agentID := range order {
+		data, err := proto.Marshal(requests[agentID])
+		if err != nil {
+			return err
+		}
+		var lengthBuf [4]byte
+		binary.BigEndian.PutUint32(lengthBuf[:], uint32(len(data)))
+		buf.Write(lengthBuf[:])
+		buf.Write(data)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// s3Client 用AWS签名V4上传对象的最小S3客户端，兼容MinIO等S3兼容存储
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	http      *http.Client
+	clock     clock.Clock
+}
+
+// newS3Client 按配置创建S3客户端
+func newS3Client(cfg config.S3Config, clk clock.Clock) (*s3Client, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	return &s3Client{
+		endpoint:  endpoint,
+		region:    cfg.Region,
+		bucket:    cfg.Bucket,
+		accessKey: cfg.AccessKeyID,
+		secretKey: cfg.SecretAccessKey,
+		pathStyle: cfg.PathStyle,
+		http:      &http.Client{},
+		clock:     clk,
+	}, nil
+}
+
+// Put 上传对象
+func (c *s3Client) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	host := c.endpoint.Host
+	uri := strings.TrimSuffix(c.endpoint.Path, "/")
+	if c.pathStyle {
+		uri += "/" + uriEncode(c.bucket)
+	} else {
+		host = c.bucket + "." + host
+	}
+	uri += "/" + uriEncode(key)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.endpoint.Scheme+"://"+host+uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256Hex(body)
+	headers := map[string]string{
+		"host":                 host,
+		"content-type":         contentType,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           c.clock.Now().UTC().Format(amzDateFormat),
+	}
+	for k, v := range headers {
+		if k != "host" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set("Authorization", signV4(http.MethodPut, uri, "", headers, payloadHash, c.region, c.accessKey, c.secretKey))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 put %s: %s: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// amzDateFormat x-amz-date头的时间格式
+const amzDateFormat = "20060102T150405Z"
+
+// signV4 计算AWS签名V4的Authorization头，headers的键为小写且全部参与签名，必须包含x-amz-date
+func signV4(method, uri, query string, headers map[string]string, payloadHash, region, accessKey, secretKey string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	canonical.WriteString(method + "\n" + uri + "\n" + query + "\n")
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+
+	amzDate := headers["x-amz-date"]
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical.String()))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return "AWS4-HMAC-SHA256 Credential=" + accessKey + "/" + scope +
+		", SignedHeaders=" + signedHeaders + ", Signature=" + signature
+}
+
+// uriEncode 按S3签名规则编码对象键，保留/和非保留字符
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
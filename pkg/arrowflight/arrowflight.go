@@ -0,0 +1,272 @@
+package arrowflight
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/flight"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/queries"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// batchRows 每个Arrow record batch的最大行数
+const batchRows = 64 * 1024
+
+// Schema 查询结果的Arrow schema
+var Schema = arrow.NewSchema([]arrow.Field{
+	{Name: "agent_id", Type: arrow.BinaryTypes.String},
+	{Name: "timestamp", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+	{Name: "name", Type: arrow.BinaryTypes.String},
+	{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "type", Type: arrow.BinaryTypes.String},
+	{Name: "labels", Type: arrow.MapOf(arrow.BinaryTypes.String, arrow.BinaryTypes.String), Nullable: true},
+}, nil)
+
+// Query 查询参数，以JSON编码在Flight Ticket或FlightDescriptor命令中
+//
+// 例如 {"agent_id":"host-1","start":1700000000000,"end":1700003600000}，
+// start/end为毫秒时间戳，end为0表示当前时间。
+type Query struct {
+	AgentID string `json:"agent_id,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Start   int64  `json:"start,omitempty"`
+	End     int64  `json:"end,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+}
+
+// Server Arrow Flight服务，以Arrow record batch返回查询结果
+type Server struct {
+	flight.BaseFlightServer
+	storage storage.Storage
+	clock   clock.Clock
+	maxRows int
+	queries *queries.Tracker
+	acl     *acl.Policy
+	mem     memory.Allocator
+	server  flight.Server
+}
+
+// NewServer 创建Arrow Flight服务，maxRows限制单次查询返回的行数，
+// tracker不为nil时每次DoGet都会登记为可取消的查询，
+// policy不为nil时按authorization元数据中的令牌隐藏受限指标
+func NewServer(storage storage.Storage, clk clock.Clock, maxRows int, tracker *queries.Tracker, policy *acl.Policy) *Server {
+	return &Server{
+		storage: storage,
+		clock:   clk,
+		maxRows: maxRows,
+		queries: tracker,
+		acl:     policy,
+		mem:     memory.DefaultAllocator,
+	}
+}
+
+// Start 在addr上启动Flight gRPC服务，阻塞直到服务停止
+func (s *Server) Start(addr string) error {
+	s.server = flight.NewServerWithMiddleware(nil)
+	if err := s.server.Init(addr); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s.server.RegisterFlightService(s)
+
+	log.Printf("Arrow Flight server starting on %s", addr)
+	return s.server.Serve()
+}
+
+// Stop 停止Flight服务，等待进行中的流结束，ctx到期后返回错误
+func (s *Server) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.server.Shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetSchema 返回查询结果的schema
+func (s *Server) GetSchema(ctx context.Context, desc *flight.FlightDescriptor) (*flight.SchemaResult, error) {
+	return &flight.SchemaResult{Schema: flight.SerializeSchema(Schema, s.mem)}, nil
+}
+
+// GetFlightInfo 描述命令对应的数据流，命令本身即为DoGet的Ticket
+func (s *Server) GetFlightInfo(ctx context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	if desc.Type != flight.DescriptorCMD {
+		return nil, status.Error(codes.InvalidArgument, "only command descriptors are supported")
+	}
+	if _, err := parseQuery(desc.Cmd); err != nil {
+		return nil, err
+	}
+
+	return &flight.FlightInfo{
+		Schema:           flight.SerializeSchema(Schema, s.mem),
+		FlightDescriptor: desc,
+		Endpoint: []*flight.FlightEndpoint{{
+			Ticket: &flight.Ticket{Ticket: desc.Cmd},
+		}},
+		TotalRecords: -1,
+		TotalBytes:   -1,
+	}, nil
+}
+
+// DoGet 执行Ticket中的查询，按时间升序返回record batch
+func (s *Server) DoGet(tkt *flight.Ticket, stream flight.FlightService_DoGetServer) error {
+	query, err := parseQuery(tkt.Ticket)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	grant, err := s.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	if s.queries != nil {
+		remote := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			remote = p.Addr.String()
+		}
+		var done func()
+		ctx, done = s.queries.Start(ctx, "flight", "DoGet "+string(tkt.Ticket), remote)
+		defer done()
+	}
+
+	metrics, err := s.query(query, grant)
+	if err != nil {
+		return status.Errorf(codes.Internal, "query failed: %v", err)
+	}
+
+	writer := flight.NewRecordWriter(stream, ipc.WithSchema(Schema), ipc.WithAllocator(s.mem))
+	defer writer.Close()
+
+	builder := array.NewRecordBuilder(s.mem, Schema)
+	defer builder.Release()
+
+	rows := 0
+	for i := range metrics {
+		appendMetric(builder, &metrics[i])
+		rows++
+		if rows == batchRows {
+			if err := context.Cause(ctx); err != nil {
+				return status.Error(codes.Canceled, err.Error())
+			}
+			if err := writeBatch(writer, builder); err != nil {
+				return err
+			}
+			rows = 0
+		}
+	}
+	if rows > 0 {
+		return writeBatch(writer, builder)
+	}
+	return nil
+}
+
+// query 从存储中取出满足条件的最新limit条数据，按时间升序排列
+//
+// 过滤条件和令牌的可见性条件交给存储层，limit作用于满足条件的数据而不是时间范围内的全部数据
+func (s *Server) query(q *Query, grant *acl.Grant) ([]processor.ProcessedMetric, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > s.maxRows {
+		limit = s.maxRows
+	}
+
+	end := s.clock.Now()
+	if q.End > 0 {
+		end = time.UnixMilli(q.End)
+	}
+
+	sq, ok := s.storage.(storage.SortedQuerier)
+	if !ok {
+		return nil, errors.New("storage does not support filtered queries")
+	}
+	filter := storage.Filter{AgentID: q.AgentID, Type: q.Type, Start: time.UnixMilli(q.Start), End: end}
+	grant.Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, limit)
+	if err != nil {
+		return nil, err
+	}
+	storage.SortMetrics(metrics, storage.SortOptions{Field: storage.SortByTimestamp})
+	return metrics, nil
+}
+
+// authenticate 按authorization元数据中的Bearer令牌返回授权，未启用访问控制时返回nil
+func (s *Server) authenticate(ctx context.Context) (*acl.Grant, error) {
+	if s.acl == nil {
+		return nil, nil
+	}
+
+	var token string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		token = acl.TokenFromHeader(values[0])
+	}
+	grant, err := s.acl.Authenticate(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return grant, nil
+}
+
+// parseQuery 解析JSON编码的查询
+func parseQuery(data []byte) (*Query, error) {
+	var q Query
+	if len(data) == 0 {
+		return &q, nil
+	}
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+	}
+	return &q, nil
+}
+
+// appendMetric 向builder追加一行
+func appendMetric(b *array.RecordBuilder, m *processor.ProcessedMetric) {
+	b.Field(0).(*array.StringBuilder).Append(m.AgentID)
+	b.Field(1).(*array.TimestampBuilder).Append(arrow.Timestamp(m.Timestamp.UnixMilli()))
+	b.Field(2).(*array.StringBuilder).Append(m.Name)
+	b.Field(3).(*array.Float64Builder).Append(m.Value)
+	b.Field(4).(*array.StringBuilder).Append(m.Type)
+
+	labels := b.Field(5).(*array.MapBuilder)
+	if len(m.Labels) == 0 {
+		labels.AppendNull()
+		return
+	}
+	labels.Append(true)
+	keys := labels.KeyBuilder().(*array.StringBuilder)
+	values := labels.ItemBuilder().(*array.StringBuilder)
+	for k, v := range m.Labels {
+		keys.Append(k)
+		values.Append(v)
+	}
+}
+
+// writeBatch 输出builder中已累积的数据
+func writeBatch(w *flight.Writer, b *array.RecordBuilder) error {
+	rec := b.NewRecordBatch()
+	defer rec.Release()
+	return w.Write(rec)
+}
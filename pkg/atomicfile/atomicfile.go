@@ -0,0 +1,38 @@
+// Package atomicfile 以先写临时文件再重命名的方式替换文件，避免进程退出或断电时留下不完整的文件
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Mode 写入的文件的权限，这些文件只由服务器读写
+const Mode os.FileMode = 0600
+
+// Write 把data写入path所在目录下的临时文件，同步到磁盘后重命名为path，目录不存在时先创建
+func Write(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(Mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
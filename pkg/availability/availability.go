@@ -0,0 +1,222 @@
+package availability
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// ErrInvalidRange 查询的时间范围或步长无效
+var ErrInvalidRange = errors.New("invalid time range")
+
+// maxPoints 单次查询最多返回的步长数
+const maxPoints = 11000
+
+// Point 一个步长内的可用率
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Uptime    float64   `json:"uptime"`
+}
+
+// Uptime 单个Agent在查询范围内的可用率
+//
+// 只统计Agent首次上报之后且在保留时间内的时间片，Slots为统计的时间片数，
+// UpSlots为其中在线的时间片数。Points按step划分，没有可统计时间片的步长不输出。
+type Uptime struct {
+	AgentID string    `json:"agent_id"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Uptime  float64   `json:"uptime"`
+	UpSlots int       `json:"up_slots"`
+	Slots   int       `json:"slots"`
+	Points  []Point   `json:"points,omitempty"`
+}
+
+// history 单个Agent的上报记录，每个时间片一位，按时间片序号对保留的时间片数取模存放
+type history struct {
+	first int64
+	last  int64
+	bits  []uint64
+}
+
+// Tracker 根据Agent的上报记录计算可用率
+//
+// 时间轴按resolution划分为时间片，Agent在时间片内或之前grace内有数据写入存储即视为该时间片在线。
+// 只保存每个时间片是否有上报，每个Agent每保留一天、分辨率为1分钟时约占180字节。
+type Tracker struct {
+	mu         sync.Mutex
+	clock      clock.Clock
+	resolution time.Duration
+	grace      int64
+	slots      int64
+	agents     map[string]*history
+}
+
+// NewTracker 创建可用率跟踪器
+func NewTracker(cfg config.AvailabilityConfig, clk clock.Clock) *Tracker {
+	resolution := max(cfg.Resolution, time.Second)
+	return &Tracker{
+		clock:      clk,
+		resolution: resolution,
+		grace:      int64((cfg.Grace + resolution - 1) / resolution),
+		slots:      max(int64(cfg.Retention/resolution), 1),
+		agents:     make(map[string]*history),
+	}
+}
+
+// Observe 记录写入存储的一批数据，应在数据写入存储后调用
+func (t *Tracker) Observe(metrics []processor.ProcessedMetric) {
+	slot := t.slot(t.clock.Now())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var prev string
+	for i := range metrics {
+		id := metrics[i].AgentID
+		if id == "" || id == prev {
+			continue
+		}
+		prev = id
+
+		h, ok := t.agents[id]
+		if !ok {
+			h = &history{first: slot, last: slot, bits: make([]uint64, (t.slots+63)/64)}
+			t.agents[id] = h
+		}
+		if slot > h.last {
+			// 清除中间没有上报的时间片在上一轮保留周期中的记录
+			for s := h.last + 1; s < slot && s <= h.last+t.slots; s++ {
+				t.clear(h, s)
+			}
+			h.last = slot
+		}
+		t.set(h, slot)
+	}
+}
+
+// Agents 返回保留时间内上报过数据的Agent
+func (t *Tracker) Agents() []string {
+	now := t.slot(t.clock.Now())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]string, 0, len(t.agents))
+	for id, h := range t.agents {
+		if h.last <= now-t.slots {
+			delete(t.agents, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Uptime 返回Agent在[start, end)内的可用率，step大于0时同时按step返回每段的可用率
+//
+// step向上取整到resolution的整数倍。Agent未上报过或范围内没有可统计的时间片时ok为false。
+func (t *Tracker) Uptime(agentID string, start, end time.Time, step time.Duration) (Uptime, bool, error) {
+	if !end.After(start) || step < 0 {
+		return Uptime{}, false, ErrInvalidRange
+	}
+	now := t.slot(t.clock.Now())
+	stepSlots := int64((step + t.resolution - 1) / t.resolution)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.agents[agentID]
+	if !ok {
+		return Uptime{}, false, nil
+	}
+
+	from := max(t.slot(start), h.first, now-t.slots+1)
+	to := min(t.slot(end.Add(-1)), now)
+	result := Uptime{AgentID: agentID, Start: start, End: end}
+	if stepSlots > 0 && to-from+1 > 0 && (to-from+1)/stepSlots > maxPoints {
+		return Uptime{}, false, ErrInvalidRange
+	}
+
+	var point Point
+	var pointUp, pointSlots int
+	for s := from; s <= to; s++ {
+		up := t.up(h, s)
+		// 当前时间片尚未结束，还没有上报时不计入
+		if s == now && !up {
+			continue
+		}
+		result.Slots++
+		if up {
+			result.UpSlots++
+		}
+
+		if stepSlots == 0 {
+			continue
+		}
+		if pointSlots > 0 && (s-from)%stepSlots == 0 {
+			point.Uptime = float64(pointUp) / float64(pointSlots)
+			result.Points = append(result.Points, point)
+			pointUp, pointSlots = 0, 0
+		}
+		if pointSlots == 0 {
+			point = Point{Timestamp: time.Unix(0, (from+(s-from)/stepSlots*stepSlots)*int64(t.resolution))}
+		}
+		pointSlots++
+		if up {
+			pointUp++
+		}
+	}
+	if pointSlots > 0 {
+		point.Uptime = float64(pointUp) / float64(pointSlots)
+		result.Points = append(result.Points, point)
+	}
+
+	if result.Slots == 0 {
+		return result, false, nil
+	}
+	result.Uptime = float64(result.UpSlots) / float64(result.Slots)
+	return result, true, nil
+}
+
+// up 判断时间片s是否在线：s或之前grace内的时间片有上报
+func (t *Tracker) up(h *history, s int64) bool {
+	for i := s; i >= s-t.grace; i-- {
+		if t.reported(h, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// reported 判断时间片s是否有上报，超出保留范围的时间片视为没有
+func (t *Tracker) reported(h *history, s int64) bool {
+	if s > h.last || s <= h.last-t.slots || s < h.first {
+		return false
+	}
+	i := s % t.slots
+	return h.bits[i/64]&(1<<(i%64)) != 0
+}
+
+// set 记录时间片s有上报
+func (t *Tracker) set(h *history, s int64) {
+	i := s % t.slots
+	h.bits[i/64] |= 1 << (i % 64)
+}
+
+// clear 清除时间片s的记录
+func (t *Tracker) clear(h *history, s int64) {
+	i := s % t.slots
+	h.bits[i/64] &^= 1 << (i % 64)
+}
+
+// slot 返回时间所在的时间片
+func (t *Tracker) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(t.resolution)
+}
@@ -0,0 +1,201 @@
+// Package bans 记录被封禁的Agent ID，封禁的Agent发送第一个数据帧时服务器关闭连接，
+// 用于不重启服务器即可切断异常刷数据的Agent
+package bans
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/atomicfile"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+var (
+	// ErrBanned Agent已被封禁
+	ErrBanned = errors.New("agent is banned")
+	// ErrNotBanned Agent没有被封禁
+	ErrNotBanned = errors.New("agent is not banned")
+	// ErrStatic 封禁来自配置文件，只能修改配置后重启解除
+	ErrStatic = errors.New("agent is banned in the config file")
+)
+
+// Ban 一条封禁记录
+type Ban struct {
+	AgentID  string    `json:"agent_id"`
+	Reason   string    `json:"reason,omitempty"`
+	BannedAt time.Time `json:"banned_at"`
+	// Until 封禁的截止时间，为空时一直有效
+	Until *time.Time `json:"until,omitempty"`
+	// Static 是否来自配置文件
+	Static bool `json:"static,omitempty"`
+	// Rejected 封禁后被拒绝的连接数，不保存到文件
+	Rejected uint64 `json:"rejected"`
+}
+
+// List 封禁列表，配置了文件时在封禁和解除后保存，配置文件中的封禁不保存
+type List struct {
+	mu    sync.Mutex
+	clock clock.Clock
+	file  string
+	bans  map[string]*Ban
+}
+
+// NewList 创建封禁列表，读取已保存的封禁并加入配置文件中的Agent，无法读取文件时返回错误
+func NewList(cfg config.BanConfig, clk clock.Clock) (*List, error) {
+	l := &List{
+		clock: clk,
+		file:  cfg.File,
+		bans:  make(map[string]*Ban),
+	}
+
+	if l.file != "" {
+		data, err := os.ReadFile(l.file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read bans: %w", err)
+		}
+		if err == nil {
+			var bans []*Ban
+			if err := json.Unmarshal(data, &bans); err != nil {
+				return nil, fmt.Errorf("failed to parse bans %s: %w", l.file, err)
+			}
+			for _, ban := range bans {
+				l.bans[ban.AgentID] = ban
+			}
+		}
+	}
+
+	now := clk.Now()
+	for _, agentID := range cfg.Agents {
+		l.bans[agentID] = &Ban{AgentID: agentID, Reason: "banned in config", BannedAt: now, Static: true}
+	}
+	return l, nil
+}
+
+// Ban 封禁Agent，d大于0时封禁在d之后自动解除，再次封禁时覆盖原来的原因和截止时间。
+// 配置文件中的封禁保持不变
+func (l *List) Ban(agentID, reason string, d time.Duration) Ban {
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ban, ok := l.bans[agentID]; ok && ban.Static {
+		return *ban
+	}
+	ban := &Ban{AgentID: agentID, Reason: reason, BannedAt: now}
+	if d > 0 {
+		until := now.Add(d)
+		ban.Until = &until
+	}
+	l.bans[agentID] = ban
+	log.Printf("Banned agent %s (reason: %s, duration: %s)", agentID, reason, describe(d))
+	l.save()
+	return *ban
+}
+
+// Unban 解除封禁，没有封禁时返回ErrNotBanned，封禁来自配置文件时返回ErrStatic
+func (l *List) Unban(agentID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ban, ok := l.bans[agentID]
+	if !ok || l.expired(ban) {
+		return ErrNotBanned
+	}
+	if ban.Static {
+		return ErrStatic
+	}
+	delete(l.bans, agentID)
+	log.Printf("Unbanned agent %s", agentID)
+	l.save()
+	return nil
+}
+
+// Check 检查Agent是否被封禁，是时计入拒绝次数并返回ErrBanned，调用方应关闭连接
+func (l *List) Check(agentID string) error {
+	if agentID == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ban, ok := l.bans[agentID]
+	if !ok {
+		return nil
+	}
+	if l.expired(ban) {
+		delete(l.bans, agentID)
+		log.Printf("Ban of agent %s expired", agentID)
+		l.save()
+		return nil
+	}
+	ban.Rejected++
+	if ban.Reason == "" {
+		return fmt.Errorf("%w: %s", ErrBanned, agentID)
+	}
+	return fmt.Errorf("%w: %s: %s", ErrBanned, agentID, ban.Reason)
+}
+
+// Bans 返回有效的封禁记录，按Agent ID排序
+func (l *List) Bans() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if !l.expired(ban) {
+			result = append(result, *ban)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].AgentID < result[j].AgentID
+	})
+	return result
+}
+
+// expired 判断封禁是否已过截止时间，调用方需持有锁
+func (l *List) expired(ban *Ban) bool {
+	return ban.Until != nil && !l.clock.Now().Before(*ban.Until)
+}
+
+// save 保存API添加的封禁，调用方需持有锁。保存失败只记录日志，内存中的封禁仍然有效
+func (l *List) save() {
+	if l.file == "" {
+		return
+	}
+	bans := make([]*Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if !ban.Static {
+			saved := *ban
+			saved.Rejected = 0
+			bans = append(bans, &saved)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].AgentID < bans[j].AgentID
+	})
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err == nil {
+		err = atomicfile.Write(l.file, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save agent bans to %s: %v", l.file, err)
+	}
+}
+
+// describe 返回用于日志的封禁时长
+func describe(d time.Duration) string {
+	if d <= 0 {
+		return "permanent"
+	}
+	return d.String()
+}
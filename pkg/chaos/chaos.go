@@ -0,0 +1,103 @@
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// ErrInjected 故障注入产生的错误
+var ErrInjected = errors.New("injected fault")
+
+// Stats 已注入的故障次数
+type Stats struct {
+	DelayedWrites uint64            `json:"delayed_writes"`
+	DroppedFrames uint64            `json:"dropped_frames"`
+	FailedSends   map[string]uint64 `json:"failed_sends"`
+}
+
+// Injector 按配置的概率注入故障，用于验证Agent重试和服务器背压，只应在测试环境启用
+//
+// 方法对nil接收者安全，未启用故障注入时调用方可以直接传nil。
+type Injector struct {
+	cfg config.ChaosConfig
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+
+	delayedWrites atomic.Uint64
+	droppedFrames atomic.Uint64
+	failedSends   sync.Map // 目标名称 -> *atomic.Uint64
+}
+
+// NewInjector 创建故障注入器，seed为0时使用当前时间作为随机数种子
+func NewInjector(cfg config.ChaosConfig) *Injector {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{cfg: cfg, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// hit 以概率p返回true
+func (i *Injector) hit(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rnd.Float64() < p
+}
+
+// DelayWrite 按storage_delay.probability在写入存储前等待min到max之间的随机时长
+func (i *Injector) DelayWrite() {
+	if i == nil || !i.hit(i.cfg.StorageDelay.Probability) {
+		return
+	}
+	delay := i.cfg.StorageDelay.Min
+	if span := i.cfg.StorageDelay.Max - i.cfg.StorageDelay.Min; span > 0 {
+		i.mu.Lock()
+		delay += time.Duration(i.rnd.Int63n(int64(span)))
+		i.mu.Unlock()
+	}
+	i.delayedWrites.Add(1)
+	time.Sleep(delay)
+}
+
+// DropFrame 按frame_drop_probability判断是否丢弃收到的QUIC数据帧
+func (i *Injector) DropFrame() bool {
+	if i == nil || !i.hit(i.cfg.FrameDropProbability) {
+		return false
+	}
+	i.droppedFrames.Add(1)
+	return true
+}
+
+// FailSend 按send_failure_probability判断向target发送数据是否失败，失败时返回ErrInjected
+func (i *Injector) FailSend(target string) error {
+	if i == nil || !i.hit(i.cfg.SendFailureProbability) {
+		return nil
+	}
+	counter, _ := i.failedSends.LoadOrStore(target, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+	return fmt.Errorf("send to %s: %w", target, ErrInjected)
+}
+
+// Stats 返回已注入的故障次数
+func (i *Injector) Stats() Stats {
+	stats := Stats{
+		DelayedWrites: i.delayedWrites.Load(),
+		DroppedFrames: i.droppedFrames.Load(),
+		FailedSends:   make(map[string]uint64),
+	}
+	i.failedSends.Range(func(key, value any) bool {
+		stats.FailedSends[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return stats
+}
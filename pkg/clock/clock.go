@@ -0,0 +1,153 @@
+package clock
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// Clock 时间源接口，所有依赖当前时间的逻辑都应通过它获取时间
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker 定时器接口
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real 返回使用系统时间的时钟
+func Real() Clock {
+	return realClock{}
+}
+
+// NewFromConfig 根据配置创建时钟，配置了frozen_at时返回冻结时钟用于回放分析
+func NewFromConfig(cfg config.ClockConfig) (Clock, error) {
+	if cfg.FrozenAt == "" {
+		return Real(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, cfg.FrozenAt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clock.frozen_at: %w", err)
+	}
+	return NewFake(t), nil
+}
+
+// realClock 系统时钟实现
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{t: time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r *realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r *realTicker) Stop() {
+	r.t.Stop()
+}
+
+// Fake 可手动控制的时钟，时间只在调用Set/Advance时变化
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFake 创建停在指定时间的时钟
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now 返回当前的模拟时间
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTicker 创建由模拟时间驱动的定时器
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTicker{
+		clock:    f,
+		c:        make(chan time.Time, 1),
+		interval: d,
+		next:     f.now.Add(d),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance 将模拟时间向前推进d，并触发所有到期的定时器
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set 将模拟时间设置为t，并触发所有到期的定时器
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = t
+	for _, ticker := range f.tickers {
+		if ticker.next.After(t) {
+			continue
+		}
+		// 与time.Ticker一致：消费者跟不上时丢弃多余的tick
+		select {
+		case ticker.c <- t:
+		default:
+		}
+		for !ticker.next.After(t) {
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+}
+
+func (f *Fake) removeTicker(t *fakeTicker) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, ticker := range f.tickers {
+		if ticker == t {
+			f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock    *Fake
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.removeTicker(t)
+}
@@ -0,0 +1,206 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// 内置压缩算法名称
+const (
+	None   = "none"
+	Gzip   = "gzip"
+	Zstd   = "zstd"
+	Snappy = "snappy"
+	LZ4    = "lz4"
+)
+
+// ErrUnknownCodec 未注册的压缩算法
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Codec 流式压缩算法
+type Codec interface {
+	// Name 返回算法名称，与HTTP Content-Encoding和配置中的名称一致
+	Name() string
+	// NewWriter 返回压缩写入器，Close时写出剩余数据但不关闭w
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader 返回解压读取器
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+func init() {
+	Register(noneCodec{})
+	Register(gzipCodec{})
+	Register(zstdCodec{})
+	Register(snappyCodec{})
+	Register(lz4Codec{})
+}
+
+// Register 注册压缩算法，重复注册会panic
+func Register(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	name := c.Name()
+	if _, dup := codecs[name]; dup {
+		panic("codec: Register called twice for " + name)
+	}
+	codecs[name] = c
+}
+
+// Get 按名称查找压缩算法，空名称等同于none
+func Get(name string) (Codec, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || name == "identity" {
+		name = None
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// Names 返回已注册的压缩算法名称
+func Names() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Compress 压缩整块数据
+func Compress(c Codec, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress 解压整块数据，解压后超过maxSize字节时返回错误，maxSize<=0表示不限制
+func Decompress(c Codec, data []byte, maxSize int64) ([]byte, error) {
+	r, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > maxSize {
+		return nil, fmt.Errorf("decompressed data exceeds %d bytes", maxSize)
+	}
+	return out, nil
+}
+
+// noneCodec 不压缩
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return None }
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gzipCodec gzip压缩
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return Gzip }
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdCodec zstd压缩
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return Zstd }
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// snappyCodec snappy分帧格式
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return Snappy }
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(w, s2.WriterSnappyCompat()), nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(r)), nil
+}
+
+// lz4Codec lz4分帧格式
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return LZ4 }
+
+func (lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return lz4.NewWriter(w), nil
+}
+
+func (lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(r)), nil
+}
@@ -0,0 +1,333 @@
+package commands
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/quic-go/quic-go"
+	"google.golang.org/protobuf/proto"
+)
+
+// 命令状态
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// 命令错误
+var (
+	ErrCommandNotFound   = errors.New("command not found")
+	ErrAgentNotConnected = errors.New("agent not connected")
+	ErrEmptyCommand      = errors.New("command is required")
+	ErrResultTooLarge    = errors.New("command result too large")
+	ErrNoResultPayload   = errors.New("command has no result payload")
+	ErrResultIDMismatch  = errors.New("command result id does not match")
+)
+
+// Command 下发给Agent的命令及其执行结果
+type Command struct {
+	ID          string            `json:"id"`
+	AgentID     string            `json:"agent_id"`
+	Command     string            `json:"command"`
+	Args        map[string]string `json:"args,omitempty"`
+	Status      string            `json:"status"`
+	Error       string            `json:"error,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	PayloadSize int               `json:"payload_size"`
+	CreatedAt   time.Time         `json:"created_at"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+
+	payload []byte
+}
+
+// Manager 跟踪Agent连接，通过QUIC双向流下发命令并保存结果
+//
+// 服务器在Agent的连接上打开一条双向流，写入带长度前缀的AgentCommand，
+// Agent在同一条流上回复带长度前缀的CommandResult。
+type Manager struct {
+	mu         sync.Mutex
+	clock      clock.Clock
+	timeout    time.Duration
+	maxResults int
+	maxSize    int
+	nextID     uint64
+	conns      map[string]*quic.Conn
+	commands   map[string]*Command
+	order      []string
+}
+
+// NewManager 创建命令管理器
+func NewManager(cfg config.CommandsConfig, clk clock.Clock) *Manager {
+	return &Manager{
+		clock:      clk,
+		timeout:    cfg.Timeout,
+		maxResults: cfg.MaxResults,
+		maxSize:    cfg.MaxResultSize,
+		conns:      make(map[string]*quic.Conn),
+		commands:   make(map[string]*Command),
+	}
+}
+
+// Register 记录Agent当前使用的连接，收到该Agent的数据时调用
+func (m *Manager) Register(agentID string, conn *quic.Conn) {
+	if agentID == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[agentID] = conn
+}
+
+// Unregister 连接关闭时移除使用该连接的Agent
+func (m *Manager) Unregister(conn *quic.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for agentID, c := range m.conns {
+		if c == conn {
+			delete(m.conns, agentID)
+		}
+	}
+}
+
+// Agents 返回当前可接收命令的Agent
+func (m *Manager) Agents() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	agents := make([]string, 0, len(m.conns))
+	for agentID := range m.conns {
+		agents = append(agents, agentID)
+	}
+	sort.Strings(agents)
+	return agents
+}
+
+// Submit 向Agent下发命令，立即返回，结果通过Get查询
+func (m *Manager) Submit(agentID, command string, args map[string]string) (Command, error) {
+	if command == "" {
+		return Command{}, ErrEmptyCommand
+	}
+
+	m.mu.Lock()
+	conn, ok := m.conns[agentID]
+	if !ok {
+		m.mu.Unlock()
+		return Command{}, ErrAgentNotConnected
+	}
+
+	m.nextID++
+	cmd := &Command{
+		ID:        strconv.FormatUint(m.nextID, 10),
+		AgentID:   agentID,
+		Command:   command,
+		Args:      args,
+		Status:    StatusRunning,
+		CreatedAt: m.clock.Now(),
+	}
+	m.add(cmd)
+	snapshot := *cmd
+	m.mu.Unlock()
+
+	go m.execute(conn, cmd)
+	return snapshot, nil
+}
+
+// Get 返回命令状态
+func (m *Manager) Get(id string) (Command, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cmd, ok := m.commands[id]
+	if !ok {
+		return Command{}, ErrCommandNotFound
+	}
+	return *cmd, nil
+}
+
+// Result 返回命令结果数据及其类型
+func (m *Manager) Result(id string) ([]byte, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cmd, ok := m.commands[id]
+	if !ok {
+		return nil, "", ErrCommandNotFound
+	}
+	if cmd.payload == nil {
+		return nil, "", ErrNoResultPayload
+	}
+	return cmd.payload, cmd.ContentType, nil
+}
+
+// List 返回保留的命令，最新的在前，agentID非空时只返回该Agent的命令
+func (m *Manager) List(agentID string) []Command {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]Command, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		cmd := m.commands[m.order[i]]
+		if agentID != "" && cmd.AgentID != agentID {
+			continue
+		}
+		result = append(result, *cmd)
+	}
+	return result
+}
+
+// add 保存命令，超出上限时丢弃最早的命令，调用方需持有锁
+func (m *Manager) add(cmd *Command) {
+	m.commands[cmd.ID] = cmd
+	m.order = append(m.order, cmd.ID)
+	for len(m.order) > m.maxResults {
+		delete(m.commands, m.order[0])
+		m.order = m.order[1:]
+	}
+}
+
+// execute 在新的双向流上发送命令并等待结果
+func (m *Manager) execute(conn *quic.Conn, cmd *Command) {
+	result, err := m.roundTrip(conn, cmd)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.clock.Now()
+	cmd.CompletedAt = &now
+	switch {
+	case err != nil:
+		cmd.Status = StatusFailed
+		cmd.Error = err.Error()
+	case !result.Success:
+		cmd.Status = StatusFailed
+		cmd.Error = result.Error
+	default:
+		cmd.Status = StatusSucceeded
+	}
+	if result != nil && len(result.Payload) > 0 {
+		cmd.payload = result.Payload
+		cmd.ContentType = result.ContentType
+		cmd.PayloadSize = len(result.Payload)
+	}
+
+	if cmd.Status == StatusFailed {
+		log.Printf("Command %s (%s) on agent %s failed: %s", cmd.ID, cmd.Command, cmd.AgentID, cmd.Error)
+	}
+}
+
+// roundTrip 写入命令帧并读取结果帧
+func (m *Manager) roundTrip(conn *quic.Conn, cmd *Command) (*protocol.CommandResult, error) {
+	ctx, cancel := context.WithTimeout(conn.Context(), m.timeout)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.CancelRead(0)
+
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	data, err := proto.Marshal(&protocol.AgentCommand{
+		Id:        cmd.ID,
+		Command:   cmd.Command,
+		Args:      cmd.Args,
+		TimeoutMs: m.timeout.Milliseconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(stream, data); err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+	// 关闭发送方向，Agent读到EOF即可开始执行
+	stream.Close()
+
+	data, err = readFrame(stream, m.maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result: %w", err)
+	}
+
+	var result protocol.CommandResult
+	if err := proto.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode result: %w", err)
+	}
+	if result.Id != cmd.ID {
+		return nil, ErrResultIDMismatch
+	}
+	return &result, nil
+}
+
+// Notify 在新的双向流上向Agent发送不需要结果的命令
+//
+// 发送后等待Agent回复或关闭流，直到ctx结束，确保命令在连接关闭前送达。
+func Notify(ctx context.Context, conn *quic.Conn, cmd *protocol.AgentCommand) error {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.CancelRead(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	data, err := proto.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(stream, data); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	stream.Close()
+
+	// 回复内容不重要，读到任何数据或EOF即说明命令已送达
+	var b [1]byte
+	if _, err := stream.Read(b[:]); err != nil && err != io.EOF {
+		return fmt.Errorf("no acknowledgement: %w", err)
+	}
+	return nil
+}
+
+// writeFrame 写入4字节大端长度前缀和数据
+func writeFrame(w io.Writer, data []byte) error {
+	var lengthBuf [4]byte
+	binary.BigEndian.PutUint32(lengthBuf[:], uint32(len(data)))
+	if _, err := w.Write(lengthBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame 读取带4字节大端长度前缀的数据
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var lengthBuf [4]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if int64(length) > int64(maxSize) {
+		return nil, ErrResultTooLarge
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
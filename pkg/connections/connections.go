@@ -0,0 +1,173 @@
+// Package connections 记录当前的QUIC连接及其Agent ID、远端地址、流数、接收的字节数和最后一次收到数据的时间，
+// 供运维查看此刻连接了哪些Agent
+package connections
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+)
+
+// Info 一个连接的状态
+type Info struct {
+	// AgentIDs 连接上出现过的Agent ID，收到第一个数据帧之前为空
+	AgentIDs    []string  `json:"agent_ids"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// Streams 正在处理的单向流数，TotalStreams 连接建立以来接受的流数
+	Streams      int    `json:"streams"`
+	TotalStreams uint64 `json:"total_streams"`
+	// Frames和Bytes 收到的数据帧数和字节数(含长度前缀)
+	Frames      uint64     `json:"frames"`
+	Bytes       uint64     `json:"bytes"`
+	LastMessage *time.Time `json:"last_message,omitempty"`
+}
+
+// Session 单个连接的状态，流的处理协程并发更新
+type Session struct {
+	clock       clock.Clock
+	remoteAddr  string
+	connectedAt time.Time
+	// close 以reason为原因关闭连接
+	close func(reason string)
+
+	mu       sync.Mutex
+	agentIDs []string
+
+	streams      atomic.Int64
+	totalStreams atomic.Uint64
+	frames       atomic.Uint64
+	bytes        atomic.Uint64
+	// lastMessage 最后一次收到数据帧的Unix纳秒时间，0表示还没有收到
+	lastMessage atomic.Int64
+}
+
+// Registry 当前的连接
+type Registry struct {
+	clock clock.Clock
+
+	mu       sync.Mutex
+	sessions map[*Session]struct{}
+}
+
+// NewRegistry 创建连接登记表
+func NewRegistry(clk clock.Clock) *Registry {
+	return &Registry{clock: clk, sessions: make(map[*Session]struct{})}
+}
+
+// Add 登记新建立的连接，close用于管理员断开连接
+func (r *Registry) Add(remoteAddr string, close func(reason string)) *Session {
+	s := &Session{clock: r.clock, remoteAddr: remoteAddr, connectedAt: r.clock.Now(), close: close}
+	r.mu.Lock()
+	r.sessions[s] = struct{}{}
+	r.mu.Unlock()
+	return s
+}
+
+// Remove 移除已关闭的连接
+func (r *Registry) Remove(s *Session) {
+	r.mu.Lock()
+	delete(r.sessions, s)
+	r.mu.Unlock()
+}
+
+// Disconnect 以reason为原因关闭出现过agentID的所有连接，返回关闭的连接数
+func (r *Registry) Disconnect(agentID, reason string) int {
+	r.mu.Lock()
+	var matched []*Session
+	for s := range r.sessions {
+		if slices.Contains(s.AgentIDs(), agentID) {
+			matched = append(matched, s)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range matched {
+		s.close(reason)
+	}
+	return len(matched)
+}
+
+// List 返回当前连接的状态，按第一个Agent ID和建立时间排序，还没有Agent ID的连接排在最后
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	infos := make([]Info, 0, len(r.sessions))
+	for s := range r.sessions {
+		infos = append(infos, s.Info())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if len(a.AgentIDs) == 0 || len(b.AgentIDs) == 0 {
+			if len(a.AgentIDs) != len(b.AgentIDs) {
+				return len(b.AgentIDs) == 0
+			}
+		} else if a.AgentIDs[0] != b.AgentIDs[0] {
+			return a.AgentIDs[0] < b.AgentIDs[0]
+		}
+		return a.ConnectedAt.Before(b.ConnectedAt)
+	})
+	return infos
+}
+
+// Identify 记录连接上出现的Agent ID，第一次出现时返回true
+func (s *Session) Identify(agentID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.agentIDs, agentID) {
+		return false
+	}
+	s.agentIDs = append(s.agentIDs, agentID)
+	return true
+}
+
+// AgentIDs 返回连接上出现过的Agent ID
+func (s *Session) AgentIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.agentIDs)
+}
+
+// StreamOpened 记录接受了一个流
+func (s *Session) StreamOpened() {
+	s.streams.Add(1)
+	s.totalStreams.Add(1)
+}
+
+// StreamClosed 记录一个流处理结束
+func (s *Session) StreamClosed() {
+	s.streams.Add(-1)
+}
+
+// Received 记录收到一个n字节的数据帧
+func (s *Session) Received(n int) {
+	s.frames.Add(1)
+	s.bytes.Add(uint64(n))
+	s.lastMessage.Store(s.clock.Now().UnixNano())
+}
+
+// Info 返回连接的状态
+func (s *Session) Info() Info {
+	info := Info{
+		AgentIDs:     s.AgentIDs(),
+		RemoteAddr:   s.remoteAddr,
+		ConnectedAt:  s.connectedAt,
+		Streams:      int(s.streams.Load()),
+		TotalStreams: s.totalStreams.Load(),
+		Frames:       s.frames.Load(),
+		Bytes:        s.bytes.Load(),
+	}
+	if info.AgentIDs == nil {
+		info.AgentIDs = []string{}
+	}
+	if ns := s.lastMessage.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		info.LastMessage = &t
+	}
+	return info
+}
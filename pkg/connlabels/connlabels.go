@@ -0,0 +1,68 @@
+package connlabels
+
+import (
+	"net"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/quic-go/quic-go"
+)
+
+// 注入的标签名，覆盖Agent上报的同名标签
+const (
+	LabelRemoteIP    = "conn_remote_ip"
+	LabelTLSIdentity = "conn_tls_identity"
+	LabelALPN        = "conn_alpn"
+	LabelQUICVersion = "conn_quic_version"
+	LabelListener    = "conn_listener"
+)
+
+// FromConn 由连接生成标签：对端IP、客户端证书的CN、协商的ALPN和QUIC版本以及监听器名称
+//
+// 服务器只请求而不校验客户端证书，tls_identity仅用于审计，不能作为身份认证。
+// Agent未提供证书时不生成tls_identity。
+func FromConn(conn *quic.Conn, listener string) map[string]string {
+	labels := map[string]string{
+		LabelListener: listener,
+	}
+
+	if ip := RemoteIP(conn); ip != "" {
+		labels[LabelRemoteIP] = ip
+	}
+
+	state := conn.ConnectionState()
+	labels[LabelQUICVersion] = state.Version.String()
+	if state.TLS.NegotiatedProtocol != "" {
+		labels[LabelALPN] = state.TLS.NegotiatedProtocol
+	}
+	if certs := state.TLS.PeerCertificates; len(certs) > 0 && certs[0].Subject.CommonName != "" {
+		labels[LabelTLSIdentity] = certs[0].Subject.CommonName
+	}
+	return labels
+}
+
+// RemoteIP 返回连接的对端IP，地址不含端口时原样返回，未知时返回空字符串
+func RemoteIP(conn *quic.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// Apply 把连接标签写入每条数据，Agent上报的同名标签被覆盖
+func Apply(metrics []processor.ProcessedMetric, labels map[string]string) {
+	for i := range metrics {
+		m := &metrics[i]
+		merged := make(map[string]string, len(m.Labels)+len(labels))
+		for k, v := range m.Labels {
+			merged[k] = v
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		m.Labels = merged
+	}
+}
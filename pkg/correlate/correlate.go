@@ -0,0 +1,186 @@
+package correlate
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// 相关系数算法
+const (
+	Pearson  = "pearson"
+	Spearman = "spearman"
+)
+
+// MinPoints 计算相关系数所需的最少对齐点数
+const MinPoints = 3
+
+// ErrUnknownMethod 不支持的相关系数算法
+var ErrUnknownMethod = errors.New("unknown correlation method")
+
+// SeriesKey 序列标识，同一Agent的同名指标视为一个序列
+type SeriesKey struct {
+	AgentID string `json:"agent_id"`
+	Name    string `json:"name"`
+}
+
+// Result 一个序列与目标序列的相关性
+type Result struct {
+	SeriesKey
+	Coefficient float64 `json:"coefficient"`
+	Points      int     `json:"points"`
+}
+
+// Align 把样本按step分桶并对桶内的值取平均，返回每个序列从桶起点到平均值的映射
+func Align(samples []processor.ProcessedMetric, step time.Duration) map[SeriesKey]map[int64]float64 {
+	type acc struct {
+		sum   float64
+		count int
+	}
+	buckets := make(map[SeriesKey]map[int64]*acc)
+	for i := range samples {
+		m := &samples[i]
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		key := SeriesKey{AgentID: m.AgentID, Name: m.Name}
+		series, ok := buckets[key]
+		if !ok {
+			series = make(map[int64]*acc)
+			buckets[key] = series
+		}
+		t := m.Timestamp.Truncate(step).UnixNano()
+		a, ok := series[t]
+		if !ok {
+			a = &acc{}
+			series[t] = a
+		}
+		a.sum += m.Value
+		a.count++
+	}
+
+	result := make(map[SeriesKey]map[int64]float64, len(buckets))
+	for key, series := range buckets {
+		values := make(map[int64]float64, len(series))
+		for t, a := range series {
+			values[t] = a.sum / float64(a.count)
+		}
+		result[key] = values
+	}
+	return result
+}
+
+// Rank 计算target与其他每个序列在共同时间桶上的相关系数，按绝对值从大到小返回前top个
+//
+// 共同时间桶少于MinPoints或任一序列没有变化的序列会被忽略。
+func Rank(series map[SeriesKey]map[int64]float64, target SeriesKey, method string, top int) ([]Result, error) {
+	var coef func(x, y []float64) float64
+	switch method {
+	case Pearson:
+		coef = pearson
+	case Spearman:
+		coef = spearman
+	default:
+		return nil, ErrUnknownMethod
+	}
+
+	base := series[target]
+	results := make([]Result, 0)
+	for key, other := range series {
+		if key == target {
+			continue
+		}
+
+		times := make([]int64, 0, len(base))
+		for t := range base {
+			if _, ok := other[t]; ok {
+				times = append(times, t)
+			}
+		}
+		if len(times) < MinPoints {
+			continue
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+		x := make([]float64, len(times))
+		y := make([]float64, len(times))
+		for i, t := range times {
+			x[i], y[i] = base[t], other[t]
+		}
+		r := coef(x, y)
+		if math.IsNaN(r) {
+			continue
+		}
+		results = append(results, Result{SeriesKey: key, Coefficient: r, Points: len(times)})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := math.Abs(results[i].Coefficient), math.Abs(results[j].Coefficient)
+		if a != b {
+			return a > b
+		}
+		if results[i].AgentID != results[j].AgentID {
+			return results[i].AgentID < results[j].AgentID
+		}
+		return results[i].Name < results[j].Name
+	})
+	if top > 0 && len(results) > top {
+		results = results[:top]
+	}
+	return results, nil
+}
+
+// pearson 皮尔逊相关系数，任一序列方差为0时返回NaN
+func pearson(x, y []float64) float64 {
+	n := float64(len(x))
+	var meanX, meanY float64
+	for i := range x {
+		meanX += x[i]
+		meanY += y[i]
+	}
+	meanX /= n
+	meanY /= n
+
+	var cov, varX, varY float64
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+// spearman 斯皮尔曼秩相关系数，即秩的皮尔逊相关系数
+func spearman(x, y []float64) float64 {
+	return pearson(ranks(x), ranks(y))
+}
+
+// ranks 返回每个值的秩，相同的值取平均秩
+func ranks(values []float64) []float64 {
+	idx := make([]int, len(values))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return values[idx[a]] < values[idx[b]] })
+
+	result := make([]float64, len(values))
+	for i := 0; i < len(idx); {
+		j := i
+		for j+1 < len(idx) && values[idx[j+1]] == values[idx[i]] {
+			j++
+		}
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			result[idx[k]] = rank
+		}
+		i = j + 1
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package debugtap
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/sampling"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"golang.org/x/time/rate"
+)
+
+// entry 输出到日志的一条指标，负载只输出长度
+type entry struct {
+	AgentID      string            `json:"agent_id"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Name         string            `json:"name"`
+	Value        float64           `json:"value"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Type         string            `json:"type"`
+	PayloadBytes int               `json:"payload_bytes,omitempty"`
+}
+
+// Tap 把经过全部处理阶段的指标按比例抽样输出到日志的处理阶段，用于在生产环境核对处理规则的效果
+//
+// 应作为最后一个阶段，输出的是重写标签、补充信息等处理之后、写入存储之前的数据。
+// 只输出agent和metric(glob)匹配的指标，每秒最多输出max_per_second条，不会丢弃指标。
+// 默认按序列抽样，输出的是同一批序列的全部样本，便于连续跟踪一个序列的处理结果。
+type Tap struct {
+	agent   string
+	metric  string
+	rate    float64
+	sampler sampling.Sampler
+	limiter *rate.Limiter
+
+	// suppressed 抽中但因超过每秒上限未输出的条数，下次输出时附在日志中
+	suppressed atomic.Uint64
+}
+
+// NewTap 创建抽样输出指标的处理阶段，抽样算法未注册时返回错误
+func NewTap(cfg config.DebugTapConfig) (*Tap, error) {
+	sampler, err := sampling.Get(cfg.Sampler)
+	if err != nil {
+		return nil, err
+	}
+	return &Tap{
+		agent:   cfg.Agent,
+		metric:  cfg.Metric,
+		rate:    cfg.SampleRate,
+		sampler: sampler,
+		limiter: rate.NewLimiter(rate.Limit(cfg.MaxPerSecond), cfg.MaxPerSecond),
+	}, nil
+}
+
+// Name 返回阶段名称
+func (t *Tap) Name() string {
+	return "debug_tap"
+}
+
+// Process 按比例抽样输出指标，总是保留指标
+func (t *Tap) Process(m *processor.ProcessedMetric) (bool, error) {
+	if !storage.MatchGlob(t.agent, m.AgentID) || !storage.MatchGlob(t.metric, m.Name) || !t.sampler.Sample(m, t.rate) {
+		return true, nil
+	}
+	if !t.limiter.Allow() {
+		t.suppressed.Add(1)
+		return true, nil
+	}
+
+	line, err := json.Marshal(entry{
+		AgentID:      m.AgentID,
+		Timestamp:    m.Timestamp,
+		Name:         m.Name,
+		Value:        m.Value,
+		Labels:       m.Labels,
+		Type:         m.Type,
+		PayloadBytes: len(m.Payload),
+	})
+	if err != nil {
+		// NaN等无法编码为JSON的值不影响处理
+		return true, nil
+	}
+	if n := t.suppressed.Swap(0); n > 0 {
+		log.Printf("Debug tap: %s (%d sampled metrics suppressed by max_per_second)", line, n)
+		return true, nil
+	}
+	log.Printf("Debug tap: %s", line)
+	return true, nil
+}
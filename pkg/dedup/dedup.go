@@ -0,0 +1,192 @@
+// Package dedup 用按时间分段的布隆过滤器判断最近是否收到过同一个数据帧，
+// Agent重连后重发未确认的批次时，重复的帧在O(1)时间内被识别
+package dedup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// Stats 去重统计
+type Stats struct {
+	Checked    uint64 `json:"checked"`
+	Duplicates uint64 `json:"duplicates"`
+	// FalsePositives 布隆过滤器判断为可能重复、但未记录过其哈希的帧数，这些帧照常写入
+	FalsePositives uint64 `json:"false_positives"`
+	Rotations      uint64 `json:"rotations"`
+	// BitsPerSegment和Hashes 每个分段的位数和哈希函数个数，由expected_frames和false_positive_rate计算
+	BitsPerSegment uint64 `json:"bits_per_segment"`
+	Hashes         int    `json:"hashes"`
+	// Fill 当前分段中置位的比例
+	Fill float64 `json:"fill"`
+	// FalsePositiveRate 按当前分段的置位比例估算的误判率，写入超过expected_frames时高于配置值
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+}
+
+// Filter 由当前和上一个分段组成的布隆过滤器，每隔window轮换一次
+//
+// 帧在写入后至少被记住window，最多2*window。布隆过滤器只会误判为重复，不会漏判，
+// 大多数新帧在布隆过滤器中即可排除；判断为可能重复时再查分段中记录的128位哈希，
+// 确认后才视为重复，误判的帧不会被丢弃。false_positive_rate只影响需要确认的比例，
+// 哈希集合占用的内存与每个窗口内的帧数成正比。
+type Filter struct {
+	mu        sync.Mutex
+	clock     clock.Clock
+	window    time.Duration
+	bits      uint64
+	hashes    int
+	current   *bloom
+	previous  *bloom
+	rotatedAt time.Time
+	stats     Stats
+}
+
+// NewFilter 按每个窗口预计的帧数和误判率创建过滤器，误判率不在(0, 1)内时返回错误
+func NewFilter(cfg config.DedupConfig, clk clock.Clock) (*Filter, error) {
+	if cfg.FalsePositiveRate <= 0 || cfg.FalsePositiveRate >= 1 {
+		return nil, fmt.Errorf("false_positive_rate must be between 0 and 1, got %g", cfg.FalsePositiveRate)
+	}
+	n := float64(cfg.ExpectedFrames)
+	bits := uint64(math.Ceil(-n*math.Log(cfg.FalsePositiveRate)/(math.Ln2*math.Ln2)/64)) * 64
+	hashes := int(math.Max(1, math.Round(float64(bits)/n*math.Ln2)))
+	return &Filter{
+		clock:     clk,
+		window:    cfg.Window,
+		bits:      bits,
+		hashes:    hashes,
+		current:   newBloom(bits),
+		previous:  newBloom(bits),
+		rotatedAt: clk.Now(),
+	}, nil
+}
+
+// Test 判断最近是否记录过相同内容的帧，不记录该帧
+func (f *Filter) Test(frame []byte) bool {
+	h1, h2 := hash(frame)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rotate(f.clock.Now())
+	f.stats.Checked++
+	if !f.current.test(h1, h2, f.hashes) && !f.previous.test(h1, h2, f.hashes) {
+		return false
+	}
+	if !f.current.contains(h1, h2) && !f.previous.contains(h1, h2) {
+		f.stats.FalsePositives++
+		return false
+	}
+	f.stats.Duplicates++
+	return true
+}
+
+// Add 记录帧，应在帧的数据写入存储后调用，写入失败的帧不记录，Agent重发时仍会写入
+func (f *Filter) Add(frame []byte) {
+	h1, h2 := hash(frame)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rotate(f.clock.Now())
+	f.current.add(h1, h2, f.hashes)
+}
+
+// Stats 返回统计快照
+func (f *Filter) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rotate(f.clock.Now())
+	stats := f.stats
+	stats.BitsPerSegment = f.bits
+	stats.Hashes = f.hashes
+	stats.Fill = float64(f.current.set) / float64(f.bits)
+	stats.FalsePositiveRate = math.Pow(stats.Fill, float64(f.hashes))
+	return stats
+}
+
+// rotate 当前分段满window后变为上一个分段，超过2*window时两个分段都已过期，调用方需持有锁
+func (f *Filter) rotate(now time.Time) {
+	elapsed := now.Sub(f.rotatedAt)
+	if elapsed < f.window {
+		return
+	}
+	if elapsed >= 2*f.window {
+		f.current.reset()
+	}
+	f.current, f.previous = f.previous, f.current
+	f.current.reset()
+	f.rotatedAt = now
+	f.stats.Rotations++
+}
+
+// hash 计算帧内容的128位哈希
+func hash(frame []byte) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write(frame)
+	var sum [16]byte
+	return split(h.Sum(sum[:0]))
+}
+
+// split 把128位哈希拆成两个64位值，按双重哈希生成k个位置
+func split(sum []byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
+
+// bloom 固定位数的布隆过滤器分段，同时记录加入的帧的128位哈希用于确认
+type bloom struct {
+	words []uint64
+	set   uint64
+	// frames 加入的帧的哈希
+	frames map[[2]uint64]struct{}
+}
+
+// newBloom 创建bits位的分段，bits为64的倍数
+func newBloom(bits uint64) *bloom {
+	return &bloom{words: make([]uint64, bits/64), frames: make(map[[2]uint64]struct{})}
+}
+
+// contains 判断是否加入过哈希相同的帧
+func (b *bloom) contains(h1, h2 uint64) bool {
+	_, ok := b.frames[[2]uint64{h1, h2}]
+	return ok
+}
+
+// test 判断k个位置是否都已置位
+func (b *bloom) test(h1, h2 uint64, k int) bool {
+	bits := uint64(len(b.words)) * 64
+	for i := 0; i < k; i++ {
+		pos := (h1 + uint64(i)*h2) % bits
+		if b.words[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add 置位k个位置并记录哈希
+func (b *bloom) add(h1, h2 uint64, k int) {
+	b.frames[[2]uint64{h1, h2}] = struct{}{}
+	bits := uint64(len(b.words)) * 64
+	for i := 0; i < k; i++ {
+		pos := (h1 + uint64(i)*h2) % bits
+		if mask := uint64(1) << (pos % 64); b.words[pos/64]&mask == 0 {
+			b.words[pos/64] |= mask
+			b.set++
+		}
+	}
+}
+
+// reset 清空所有位和记录的哈希
+func (b *bloom) reset() {
+	clear(b.words)
+	clear(b.frames)
+	b.set = 0
+}
@@ -0,0 +1,186 @@
+package discovery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultService 服务器默认通告的服务类型
+const DefaultService = "_kon-agent._udp"
+
+// defaultBrowseTimeout ctx没有截止时间时等待回复的时间
+const defaultBrowseTimeout = 2 * time.Second
+
+// Endpoint 发现的服务器
+type Endpoint struct {
+	Instance string            `json:"instance"`
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	Addrs    []net.IP          `json:"addrs"`
+	TXT      map[string]string `json:"txt,omitempty"`
+}
+
+// Addr 返回可用于QUIC拨号的host:port，优先使用IPv4地址，没有地址记录时使用主机名
+func (e Endpoint) Addr() string {
+	host := strings.TrimSuffix(e.Host, ".")
+	for _, ip := range e.Addrs {
+		if ip.To4() != nil {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(e.Port))
+		}
+	}
+	if len(e.Addrs) > 0 {
+		host = e.Addrs[0].String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(e.Port))
+}
+
+// Browse 在本地网络查询通告service服务类型的服务器，收集到ctx结束(没有截止时间时为2秒)，按实例名排序返回
+//
+// 查询从临时端口发出，响应方按普通DNS单播回复，不需要占用5353端口。
+func Browse(ctx context.Context, service string) ([]Endpoint, error) {
+	if service == "" {
+		service = DefaultService
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(service, ".") + ".local.")
+	if err != nil {
+		return nil, fmt.Errorf("invalid service %q: %w", service, err)
+	}
+
+	var id [2]byte
+	rand.Read(id[:])
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:])},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	msg, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mdns socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(msg, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("failed to send mdns query: %w", err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultBrowseTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	c := newCollector(name.String())
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		c.add(buf[:n])
+	}
+	return c.endpoints(), nil
+}
+
+// collector 汇总多个回复中的记录
+type collector struct {
+	service   string
+	instances map[string]bool
+	srv       map[string]dnsmessage.SRVResource
+	txt       map[string][]string
+	addrs     map[string][]net.IP
+}
+
+func newCollector(service string) *collector {
+	return &collector{
+		service:   strings.ToLower(service),
+		instances: make(map[string]bool),
+		srv:       make(map[string]dnsmessage.SRVResource),
+		txt:       make(map[string][]string),
+		addrs:     make(map[string][]net.IP),
+	}
+}
+
+// add 记录一个回复中的PTR、SRV、TXT、A和AAAA记录，TTL为0的记录表示撤销
+func (c *collector) add(data []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(data); err != nil || !msg.Response {
+		return
+	}
+	for _, r := range append(msg.Answers, msg.Additionals...) {
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == c.service {
+				c.instances[strings.ToLower(body.PTR.String())] = r.Header.TTL > 0
+			}
+		case *dnsmessage.SRVResource:
+			c.srv[name] = *body
+		case *dnsmessage.TXTResource:
+			c.txt[name] = body.TXT
+		case *dnsmessage.AResource:
+			c.addrs[name] = appendIP(c.addrs[name], net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			c.addrs[name] = appendIP(c.addrs[name], net.IP(body.AAAA[:]))
+		}
+	}
+}
+
+// endpoints 返回有SRV记录且未撤销的实例
+func (c *collector) endpoints() []Endpoint {
+	endpoints := make([]Endpoint, 0, len(c.instances))
+	for instance, alive := range c.instances {
+		srv, ok := c.srv[instance]
+		if !alive || !ok {
+			continue
+		}
+		host := strings.ToLower(srv.Target.String())
+		e := Endpoint{
+			Instance: strings.TrimSuffix(strings.TrimSuffix(instance, "."+c.service), "."),
+			Host:     host,
+			Port:     int(srv.Port),
+			Addrs:    c.addrs[host],
+		}
+		for _, kv := range c.txt[instance] {
+			if kv == "" {
+				continue
+			}
+			if e.TXT == nil {
+				e.TXT = make(map[string]string)
+			}
+			k, v, _ := strings.Cut(kv, "=")
+			e.TXT[k] = v
+		}
+		endpoints = append(endpoints, e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Instance < endpoints[j].Instance })
+	return endpoints
+}
+
+// appendIP 添加不重复的地址
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
@@ -0,0 +1,405 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// mDNS的组播地址和端口
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// servicesName DNS-SD列举所有服务类型的名称
+const servicesName = "_services._dns-sd._udp.local."
+
+// classCacheFlush mDNS中唯一记录的cache-flush位，查询中同一位表示要求单播回复(QU)
+const classCacheFlush = 0x8000
+
+// legacyTTL 回复非5353端口的普通DNS查询时使用的最长TTL
+const legacyTTL = 10
+
+// announceCount和announceInterval 启动时主动通告的次数和间隔
+const (
+	announceCount    = 2
+	announceInterval = time.Second
+)
+
+// Advertiser 通过mDNS/DNS-SD在本地网络通告QUIC接入地址
+//
+// 响应服务类型的PTR查询和实例的SRV、TXT查询以及主机名的A、AAAA查询，启动时主动通告，关闭时发送TTL为0的记录撤销通告。
+// 只使用IPv4组播，AAAA记录随回复一起发送。
+type Advertiser struct {
+	conn     *net.UDPConn
+	pc       *ipv4.PacketConn
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	ttl      uint32
+	txt      []string
+	addrs    []net.IP
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewAdvertiser 在配置的网卡上加入mDNS组播组并开始通告端口port
+func NewAdvertiser(cfg config.DiscoveryConfig, port int) (*Advertiser, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	hostLabel := label(strings.SplitN(hostname, ".", 2)[0])
+	instance := cfg.Instance
+	if instance == "" {
+		instance = hostLabel
+	}
+
+	a := &Advertiser{
+		port: uint16(port),
+		ttl:  uint32(cfg.TTL / time.Second),
+		txt:  txtRecords(cfg.TXT),
+		done: make(chan struct{}),
+	}
+	service := strings.TrimSuffix(cfg.Service, ".") + ".local."
+	if a.service, err = dnsmessage.NewName(service); err != nil {
+		return nil, fmt.Errorf("invalid service %q: %w", cfg.Service, err)
+	}
+	if a.instance, err = dnsmessage.NewName(label(instance) + "." + service); err != nil {
+		return nil, fmt.Errorf("invalid instance %q: %w", instance, err)
+	}
+	if a.host, err = dnsmessage.NewName(hostLabel + ".local."); err != nil {
+		return nil, fmt.Errorf("invalid hostname %q: %w", hostname, err)
+	}
+
+	var ifi *net.Interface
+	if cfg.Interface != "" {
+		if ifi, err = net.InterfaceByName(cfg.Interface); err != nil {
+			return nil, fmt.Errorf("invalid interface %q: %w", cfg.Interface, err)
+		}
+	}
+	if a.addrs, err = interfaceAddrs(ifi); err != nil {
+		return nil, err
+	}
+	if len(a.addrs) == 0 {
+		return nil, errors.New("no usable interface address to advertise")
+	}
+
+	if a.conn, err = net.ListenMulticastUDP("udp4", ifi, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("failed to join mdns group: %w", err)
+	}
+	a.pc = ipv4.NewPacketConn(a.conn)
+	if ifi != nil {
+		a.pc.SetMulticastInterface(ifi)
+	}
+	a.pc.SetMulticastTTL(255)
+	// 同一主机上的Agent也能发现服务器
+	a.pc.SetMulticastLoopback(true)
+
+	go a.serve()
+	go a.announce()
+	return a, nil
+}
+
+// Instance 返回通告的服务实例名
+func (a *Advertiser) Instance() string {
+	return a.instance.String()
+}
+
+// Close 撤销通告并停止响应查询
+func (a *Advertiser) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.done)
+		if msg, e := a.response(0, nil, a.records(0), nil); e == nil {
+			a.conn.WriteToUDP(msg, mdnsGroup)
+		}
+		err = a.conn.Close()
+	})
+	return err
+}
+
+// announce 启动时主动通告全部记录
+func (a *Advertiser) announce() {
+	for i := 0; i < announceCount; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(announceInterval):
+			case <-a.done:
+				return
+			}
+		}
+		msg, err := a.response(0, nil, a.records(a.ttl), nil)
+		if err != nil {
+			log.Printf("Failed to build mdns announcement: %v", err)
+			return
+		}
+		if _, err := a.conn.WriteToUDP(msg, mdnsGroup); err != nil {
+			log.Printf("Failed to send mdns announcement: %v", err)
+		}
+	}
+}
+
+// serve 读取并回复查询，直到连接关闭
+func (a *Advertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-a.done:
+			default:
+				log.Printf("mDNS advertiser stopped: %v", err)
+			}
+			return
+		}
+		a.handle(buf[:n], src)
+	}
+}
+
+// handle 回复一个查询报文，不涉及通告内容的查询被忽略
+//
+// 来自5353以外端口的查询按普通DNS单播回复(带原查询ID和问题，TTL不超过10秒)，
+// 设置了QU位的查询单播回复，其余组播回复。
+func (a *Advertiser) handle(data []byte, src *net.UDPAddr) {
+	var p dnsmessage.Parser
+	h, err := p.Start(data)
+	if err != nil || h.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	legacy := src.Port != mdnsGroup.Port
+	ttl := a.ttl
+	if legacy && ttl > legacyTTL {
+		ttl = legacyTTL
+	}
+	var answers, extra []dnsmessage.Resource
+	unicast := legacy
+	for _, q := range questions {
+		// 普通DNS回复不能带cache-flush位
+		ans, add := a.answer(q, ttl, !legacy)
+		if len(ans) == 0 {
+			continue
+		}
+		answers = append(answers, ans...)
+		extra = append(extra, add...)
+		if q.Class&classCacheFlush != 0 {
+			unicast = true
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	var id uint16
+	var echo []dnsmessage.Question
+	if legacy {
+		id, echo = h.ID, questions
+	}
+	msg, err := a.response(id, echo, answers, dedupe(extra, answers))
+	if err != nil {
+		return
+	}
+	dst := mdnsGroup
+	if unicast {
+		dst = src
+	}
+	a.conn.WriteToUDP(msg, dst)
+}
+
+// answer 返回一个问题的回答和附加记录
+func (a *Advertiser) answer(q dnsmessage.Question, ttl uint32, flush bool) (answers, extra []dnsmessage.Resource) {
+	if q.Class&^classCacheFlush != dnsmessage.ClassINET && q.Class&^classCacheFlush != dnsmessage.ClassANY {
+		return nil, nil
+	}
+	match := func(t dnsmessage.Type) bool { return q.Type == t || q.Type == dnsmessage.TypeALL }
+
+	switch {
+	case sameName(q.Name, a.service.String()) && match(dnsmessage.TypePTR):
+		answers = append(answers, a.ptr(ttl))
+		extra = append(extra, a.srv(ttl, flush), a.text(ttl, flush))
+		extra = append(extra, a.hostRecords(ttl, flush)...)
+	case sameName(q.Name, servicesName) && match(dnsmessage.TypePTR):
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(servicesName), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.PTRResource{PTR: a.service},
+		})
+	case sameName(q.Name, a.instance.String()):
+		if match(dnsmessage.TypeSRV) {
+			answers = append(answers, a.srv(ttl, flush))
+		}
+		if match(dnsmessage.TypeTXT) {
+			answers = append(answers, a.text(ttl, flush))
+		}
+		extra = append(extra, a.hostRecords(ttl, flush)...)
+	case sameName(q.Name, a.host.String()):
+		for _, r := range a.hostRecords(ttl, flush) {
+			if match(r.Header.Type) {
+				answers = append(answers, r)
+			}
+		}
+	}
+	return answers, extra
+}
+
+// records 通告或撤销时发送的全部记录
+func (a *Advertiser) records(ttl uint32) []dnsmessage.Resource {
+	records := []dnsmessage.Resource{a.ptr(ttl), a.srv(ttl, true), a.text(ttl, true)}
+	return append(records, a.hostRecords(ttl, true)...)
+}
+
+// ptr 服务类型指向实例的PTR记录，多个服务器共享同一名称，不设置cache-flush位
+func (a *Advertiser) ptr(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: a.service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: a.instance},
+	}
+}
+
+// srv 实例的SRV记录，指向主机名和QUIC端口
+func (a *Advertiser) srv(ttl uint32, flush bool) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeSRV, Class: class(flush), TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Target: a.host, Port: a.port},
+	}
+}
+
+// text 实例的TXT记录
+func (a *Advertiser) text(ttl uint32, flush bool) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeTXT, Class: class(flush), TTL: ttl},
+		Body:   &dnsmessage.TXTResource{TXT: a.txt},
+	}
+}
+
+// hostRecords 主机名的A和AAAA记录
+func (a *Advertiser) hostRecords(ttl uint32, flush bool) []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0, len(a.addrs))
+	for _, ip := range a.addrs {
+		h := dnsmessage.ResourceHeader{Name: a.host, Class: class(flush), TTL: ttl}
+		if ip4 := ip.To4(); ip4 != nil {
+			h.Type = dnsmessage.TypeA
+			records = append(records, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+		} else {
+			h.Type = dnsmessage.TypeAAAA
+			records = append(records, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+		}
+	}
+	return records
+}
+
+// response 编码回复报文
+func (a *Advertiser) response(id uint16, questions []dnsmessage.Question, answers, extra []dnsmessage.Resource) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions:   questions,
+		Answers:     answers,
+		Additionals: extra,
+	}
+	return msg.Pack()
+}
+
+// interfaceAddrs 返回网卡的单播地址，ifi为nil时返回所有已启用的非回环网卡的地址，没有时使用回环地址
+func interfaceAddrs(ifi *net.Interface) ([]net.IP, error) {
+	var ifaces []net.Interface
+	if ifi != nil {
+		ifaces = []net.Interface{*ifi}
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interfaces: %w", err)
+		}
+		ifaces = all
+	}
+
+	var addrs, loopback []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		list, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalMulticast() || (ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast()) {
+				continue
+			}
+			if ipnet.IP.IsLoopback() {
+				loopback = append(loopback, ipnet.IP)
+			} else {
+				addrs = append(addrs, ipnet.IP)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return loopback, nil
+	}
+	return addrs, nil
+}
+
+// txtRecords 把键值转换为按键排序的key=value列表，TXT记录不能为空
+func txtRecords(kv map[string]string) []string {
+	txt := make([]string, 0, len(kv)+1)
+	for k, v := range kv {
+		txt = append(txt, k+"="+v)
+	}
+	sort.Strings(txt)
+	if len(txt) == 0 {
+		txt = append(txt, "")
+	}
+	return txt
+}
+
+// label 把名称转换为单个DNS标签，点号替换为连字符，超长部分截断
+func label(s string) string {
+	s = strings.ReplaceAll(s, ".", "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// dedupe 移除附加记录中与回答重复的记录
+func dedupe(extra, answers []dnsmessage.Resource) []dnsmessage.Resource {
+	seen := make(map[string]bool)
+	for _, r := range answers {
+		seen[r.GoString()] = true
+	}
+	result := extra[:0]
+	for _, r := range extra {
+		if key := r.GoString(); !seen[key] {
+			seen[key] = true
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// class 记录的类，flush为true时设置cache-flush位
+func class(flush bool) dnsmessage.Class {
+	if flush {
+		return dnsmessage.ClassINET | classCacheFlush
+	}
+	return dnsmessage.ClassINET
+}
+
+// sameName 不区分大小写比较名称
+func sameName(n dnsmessage.Name, s string) bool {
+	return strings.EqualFold(n.String(), s)
+}
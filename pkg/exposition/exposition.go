@@ -0,0 +1,341 @@
+package exposition
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/histogram"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+)
+
+// Prometheus指标类型
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+	TypeSummary = "summary"
+	TypeUntyped = "untyped"
+)
+
+// promType 返回指标类型对应的Prometheus类型
+//
+// NETWORK_PACKETS是Agent累计的包数，作为counter；指数直方图输出_count和_sum，
+// 作为不带分位数的summary；其余类型是采样时刻的取值，作为gauge。
+func promType(t protocol.MetricType) string {
+	switch t {
+	case protocol.MetricType_NETWORK_PACKETS:
+		return TypeCounter
+	case protocol.MetricType_EXPONENTIAL_HISTOGRAM:
+		return TypeSummary
+	default:
+		return TypeGauge
+	}
+}
+
+// sample 一个序列的最新值，metric保存序列的标识用于权限判断，不含负载
+type sample struct {
+	metric    processor.ProcessedMetric
+	tenant    string
+	family    string
+	labels    string
+	typ       string
+	value     float64
+	count     uint64
+	timestamp time.Time
+	seen      time.Time
+}
+
+// Collector 保存每个序列(Agent ID、指标名和标签)的最新值，以Prometheus文本格式输出
+//
+// 设置了租户划分时每个序列带有租户标签，可以按租户分别输出，供中心Prometheus联邦抓取；
+// external_labels添加到所有序列。数据自带的同名标签加exported_前缀保留。
+type Collector struct {
+	mu          sync.Mutex
+	clock       clock.Clock
+	prefix      string
+	staleAfter  time.Duration
+	maxSeries   int
+	timestamps  bool
+	tenantLabel string
+	external    []label
+	tenantOf    func(m *processor.ProcessedMetric) string
+	series      map[string]*sample
+	dropped     uint64
+}
+
+// label 输出时添加到序列的标签
+type label struct {
+	name  string
+	value string
+}
+
+// NewCollector 创建序列最新值的收集器
+func NewCollector(cfg config.PrometheusConfig, clk clock.Clock) *Collector {
+	c := &Collector{
+		clock:       clk,
+		prefix:      cfg.Prefix,
+		staleAfter:  cfg.StaleAfter,
+		maxSeries:   cfg.MaxSeries,
+		timestamps:  cfg.Timestamps,
+		tenantLabel: SanitizeLabel(cfg.TenantLabel),
+		series:      make(map[string]*sample),
+	}
+	for name, value := range cfg.ExternalLabels {
+		c.external = append(c.external, label{SanitizeLabel(name), value})
+	}
+	sort.Slice(c.external, func(i, j int) bool { return c.external[i].name < c.external[j].name })
+	return c
+}
+
+// SetTenants 按tenantOf划分序列所属的租户，应在Observe之前调用
+func (c *Collector) SetTenants(tenantOf func(m *processor.ProcessedMetric) string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tenantOf = tenantOf
+}
+
+// Observe 记录写入存储的一批数据，应在数据写入存储后调用
+//
+// 同一序列只保留时间戳最新的值，补发的旧数据不会覆盖新值。
+func (c *Collector) Observe(metrics []processor.ProcessedMetric) {
+	now := c.clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range metrics {
+		m := &metrics[i]
+		var tenant string
+		if c.tenantOf != nil {
+			tenant = c.tenantOf(m)
+		}
+		family := c.prefix + SanitizeName(m.Name)
+		labels := c.formatLabels(m.AgentID, tenant, m.Labels)
+		key := family + labels
+
+		s, ok := c.series[key]
+		if !ok {
+			if c.maxSeries > 0 && len(c.series) >= c.maxSeries {
+				c.dropped++
+				continue
+			}
+			s = &sample{
+				metric: processor.ProcessedMetric{AgentID: m.AgentID, Name: m.Name, Labels: m.Labels, Type: m.Type, RawType: m.RawType},
+				tenant: tenant,
+				family: family,
+				labels: labels,
+			}
+			c.series[key] = s
+		} else if m.Timestamp.Before(s.timestamp) {
+			continue
+		}
+
+		s.typ = promType(m.RawType)
+		s.value, s.count = m.Value, 0
+		if m.RawType == protocol.MetricType_EXPONENTIAL_HISTOGRAM {
+			h, err := histogram.Unmarshal(m.Payload)
+			if err != nil {
+				delete(c.series, key)
+				continue
+			}
+			s.count, s.value = h.Count, math.NaN()
+			if h.Sum != nil {
+				s.value = *h.Sum
+			}
+		}
+		s.timestamp, s.seen = m.Timestamp, now
+	}
+}
+
+// WritePrometheus 以Prometheus文本格式输出各序列的最新值，allow为nil时输出全部序列，否则只输出allow返回true的序列
+//
+// 超过stale_after未更新的序列被删除，Prometheus随后将其标记为过期。
+// 同名序列的类型不一致时该指标族作为untyped输出。
+func (c *Collector) WritePrometheus(w io.Writer, allow func(m *processor.ProcessedMetric) bool) error {
+	return c.write(w, "", allow)
+}
+
+// WriteTenant 与WritePrometheus相同，但只输出属于tenant的序列
+func (c *Collector) WriteTenant(w io.Writer, tenant string, allow func(m *processor.ProcessedMetric) bool) error {
+	return c.write(w, tenant, allow)
+}
+
+// write 输出序列的最新值，tenant不为空时只输出该租户的序列
+func (c *Collector) write(w io.Writer, tenant string, allow func(m *processor.ProcessedMetric) bool) error {
+	now := c.clock.Now()
+
+	c.mu.Lock()
+	families := make(map[string][]sample)
+	for key, s := range c.series {
+		if c.staleAfter > 0 && now.Sub(s.seen) > c.staleAfter {
+			delete(c.series, key)
+			continue
+		}
+		if tenant != "" && s.tenant != tenant {
+			continue
+		}
+		families[s.family] = append(families[s.family], *s)
+	}
+	dropped := c.dropped
+	c.mu.Unlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		samples := families[name]
+		if allow != nil {
+			kept := samples[:0]
+			for _, s := range samples {
+				if allow(&s.metric) {
+					kept = append(kept, s)
+				}
+			}
+			samples = kept
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+
+		typ := samples[0].typ
+		for _, s := range samples[1:] {
+			if s.typ != typ {
+				typ = TypeUntyped
+				break
+			}
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+		for _, s := range samples {
+			if s.typ == TypeSummary {
+				if typ == TypeSummary {
+					c.writeSample(&b, name+"_sum", s.labels, s.value, s.timestamp)
+					c.writeSample(&b, name+"_count", s.labels, float64(s.count), s.timestamp)
+				}
+				continue
+			}
+			c.writeSample(&b, name, s.labels, s.value, s.timestamp)
+		}
+	}
+
+	b.WriteString("# HELP kon_exposition_dropped_series_total Series not exposed because max_series was reached.\n")
+	b.WriteString("# TYPE kon_exposition_dropped_series_total counter\n")
+	fmt.Fprintf(&b, "kon_exposition_dropped_series_total %d\n", dropped)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeSample 输出一行样本，启用timestamps时附带毫秒时间戳
+func (c *Collector) writeSample(b *strings.Builder, name, labels string, value float64, ts time.Time) {
+	b.WriteString(name)
+	b.WriteString(labels)
+	b.WriteByte(' ')
+	b.WriteString(formatValue(value))
+	if c.timestamps {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(ts.UnixMilli(), 10))
+	}
+	b.WriteByte('\n')
+}
+
+// formatValue 按Prometheus文本格式输出浮点数
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatLabels 输出标签集，依次为agent_id、租户标签、external_labels和排序后的数据标签；
+// 数据自带的同名标签加exported_前缀，如agent_id改名为exported_agent_id
+func (c *Collector) formatLabels(agentID, tenant string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(`{agent_id="`)
+	b.WriteString(EscapeLabelValue(agentID))
+	b.WriteByte('"')
+	reserved := map[string]bool{"agent_id": true}
+	write := func(name, value string) {
+		b.WriteByte(',')
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(EscapeLabelValue(value))
+		b.WriteByte('"')
+	}
+	if tenant != "" && c.tenantLabel != "" {
+		write(c.tenantLabel, tenant)
+		reserved[c.tenantLabel] = true
+	}
+	for _, l := range c.external {
+		if !reserved[l.name] {
+			write(l.name, l.value)
+			reserved[l.name] = true
+		}
+	}
+	for _, name := range names {
+		label := SanitizeLabel(name)
+		if reserved[label] {
+			label = "exported_" + label
+		}
+		write(label, labels[name])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// SanitizeName 把指标名转换为合法的Prometheus指标名，非法字符替换为下划线
+func SanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabel 把标签名转换为合法的Prometheus标签名
+func SanitizeLabel(name string) string {
+	return sanitize(name, false)
+}
+
+// sanitize 只保留[a-zA-Z0-9_](指标名还允许冒号)，开头的数字也替换为下划线
+func sanitize(s string, colon bool) string {
+	if s == "" {
+		return "_"
+	}
+	b := []byte(s)
+	for i, ch := range b {
+		valid := ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
+			(i > 0 && ch >= '0' && ch <= '9') || (colon && ch == ':')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// labelEscaper 转义Prometheus标签值
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// EscapeLabelValue 按Prometheus文本格式转义标签值中的反斜杠、双引号和换行
+func EscapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,179 @@
+// Package fanout 把接入的数据分发到各导出端，每个导出端在分发时按自己的转换规则改写数据，
+// 不影响存储、其他导出端和接入钩子看到的数据
+package fanout
+
+import (
+	"fmt"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 转换动作
+const (
+	ActionKeep         = "keep"
+	ActionDrop         = "drop"
+	ActionStripPayload = "strip_payload"
+	ActionDropLabels   = "drop_labels"
+	ActionSetLabels    = "set_labels"
+	ActionRename       = "rename"
+)
+
+// Sink 导出端接收一批数据的函数，与接入钩子的签名相同
+type Sink func(metrics []processor.ProcessedMetric)
+
+// Router 按导出端分发数据，没有转换规则的导出端直接收到原始数据
+type Router struct {
+	routes []route
+}
+
+// route 单个导出端及其转换规则
+type route struct {
+	name  string
+	rules []config.ExportRule
+	sink  Sink
+}
+
+// NewRouter 创建导出路由
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Add 添加导出端，规则的动作未知、缺少动作需要的参数或glob无效时返回错误
+func (r *Router) Add(name string, rules []config.ExportRule, sink Sink) error {
+	for i, rule := range rules {
+		if err := validate(rule); err != nil {
+			return fmt.Errorf("%s transform rule %d: %w", name, i+1, err)
+		}
+	}
+	r.routes = append(r.routes, route{name: name, rules: rules, sink: sink})
+	return nil
+}
+
+// Len 返回导出端数量
+func (r *Router) Len() int {
+	return len(r.routes)
+}
+
+// Dispatch 把一批数据按各导出端的规则转换后发送，用作接入钩子
+func (r *Router) Dispatch(metrics []processor.ProcessedMetric) {
+	for i := range r.routes {
+		rt := &r.routes[i]
+		if len(rt.rules) == 0 {
+			rt.sink(metrics)
+			continue
+		}
+		if out := Transform(rt.rules, metrics); len(out) > 0 {
+			rt.sink(out)
+		}
+	}
+}
+
+// Transform 按顺序对每条数据执行规则，返回转换后的副本，不修改metrics及其标签
+func Transform(rules []config.ExportRule, metrics []processor.ProcessedMetric) []processor.ProcessedMetric {
+	out := make([]processor.ProcessedMetric, 0, len(metrics))
+	for i := range metrics {
+		m := metrics[i]
+		if apply(rules, &m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// apply 对m执行规则，m为原数据的浅拷贝，修改标签前先复制，返回false表示丢弃
+func apply(rules []config.ExportRule, m *processor.ProcessedMetric) bool {
+	copied := false
+	cloneLabels := func() {
+		if copied {
+			return
+		}
+		labels := make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+		m.Labels = labels
+		copied = true
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		matched := matches(rule, m)
+		if rule.Action == ActionKeep {
+			if !matched {
+				return false
+			}
+			continue
+		}
+		if !matched {
+			continue
+		}
+
+		switch rule.Action {
+		case ActionDrop:
+			return false
+		case ActionStripPayload:
+			m.Payload = nil
+		case ActionDropLabels:
+			cloneLabels()
+			for _, name := range rule.LabelNames {
+				delete(m.Labels, name)
+			}
+		case ActionSetLabels:
+			cloneLabels()
+			for k, v := range rule.SetLabels {
+				m.Labels[k] = v
+			}
+		case ActionRename:
+			m.Name = rule.Name
+		}
+	}
+	return true
+}
+
+// matches 判断数据是否满足规则的所有条件
+func matches(rule *config.ExportRule, m *processor.ProcessedMetric) bool {
+	if !storage.MatchGlob(rule.Agent, m.AgentID) || !storage.MatchGlob(rule.Metric, m.Name) || !storage.MatchGlob(rule.Type, m.Type) {
+		return false
+	}
+	for k, pattern := range rule.Labels {
+		v, ok := m.Labels[k]
+		if !ok || !storage.MatchGlob(pattern, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate 检查规则的动作、参数和glob
+func validate(rule config.ExportRule) error {
+	switch rule.Action {
+	case ActionKeep, ActionDrop, ActionStripPayload:
+	case ActionDropLabels:
+		if len(rule.LabelNames) == 0 {
+			return fmt.Errorf("action %s requires label_names", rule.Action)
+		}
+	case ActionSetLabels:
+		if len(rule.SetLabels) == 0 {
+			return fmt.Errorf("action %s requires set_labels", rule.Action)
+		}
+	case ActionRename:
+		if rule.Name == "" {
+			return fmt.Errorf("action %s requires name", rule.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	patterns := []string{rule.Agent, rule.Metric, rule.Type}
+	for _, v := range rule.Labels {
+		patterns = append(patterns, v)
+	}
+	for _, pattern := range patterns {
+		if err := storage.ValidateGlob(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
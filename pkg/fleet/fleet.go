@@ -0,0 +1,251 @@
+package fleet
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// slots 统计窗口划分的时间片数量
+const slots = 60
+
+// AgentCounts Agent数量，最近offline_after内上报过数据的Agent为在线
+type AgentCounts struct {
+	Total   int `json:"total"`
+	Online  int `json:"online"`
+	Offline int `json:"offline"`
+}
+
+// Rates 统计窗口内的接入速率
+//
+// ErrorRate为失败的接入请求占全部接入请求的比例，一个请求是Agent发送的一帧数据。
+type Rates struct {
+	SamplesPerSecond  float64 `json:"samples_per_second"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	ErrorsPerSecond   float64 `json:"errors_per_second"`
+	ErrorRate         float64 `json:"error_rate"`
+}
+
+// AgentActivity 单个Agent在统计窗口内的接入情况
+type AgentActivity struct {
+	AgentID          string    `json:"agent_id"`
+	Online           bool      `json:"online"`
+	LastSeen         time.Time `json:"last_seen"`
+	Samples          int64     `json:"samples"`
+	SamplesPerSecond float64   `json:"samples_per_second"`
+	Errors           int64     `json:"errors"`
+}
+
+// Summary Agent集群健康摘要
+type Summary struct {
+	GeneratedAt time.Time   `json:"generated_at"`
+	Window      string      `json:"window"`
+	Agents      AgentCounts `json:"agents"`
+	Ingest      Rates       `json:"ingest"`
+	// TopNoisy 统计窗口内上报样本最多的Agent
+	TopNoisy []AgentActivity `json:"top_noisy_agents"`
+	// Offline 离线的Agent，最近离线的在前
+	Offline []AgentActivity `json:"offline_agents"`
+}
+
+// ring 按时间片累计的计数，只保留最近slots个时间片
+type ring struct {
+	counts [slots]int64
+	stamps [slots]int64
+}
+
+// add 在时间片slot上累计n
+func (r *ring) add(slot, n int64) {
+	i := slot % slots
+	if r.stamps[i] != slot {
+		r.stamps[i] = slot
+		r.counts[i] = 0
+	}
+	r.counts[i] += n
+}
+
+// sum 返回截至时间片slot的最近slots个时间片的累计
+func (r *ring) sum(slot int64) int64 {
+	var total int64
+	for i := range r.counts {
+		if r.stamps[i] > slot-slots && r.stamps[i] <= slot {
+			total += r.counts[i]
+		}
+	}
+	return total
+}
+
+// agent 单个Agent的接入统计
+type agent struct {
+	lastSeen time.Time
+	samples  ring
+	errors   ring
+}
+
+// Tracker 跟踪Agent的上报时间、接入速率和错误，汇总为集群健康摘要
+type Tracker struct {
+	mu           sync.Mutex
+	clock        clock.Clock
+	window       time.Duration
+	slotWidth    time.Duration
+	offlineAfter time.Duration
+	retain       time.Duration
+	topN         int
+	started      time.Time
+	agents       map[string]*agent
+	samples      ring
+	requests     ring
+	errors       ring
+}
+
+// NewTracker 创建集群健康跟踪器
+func NewTracker(cfg config.FleetConfig, clk clock.Clock) *Tracker {
+	return &Tracker{
+		clock:        clk,
+		window:       cfg.Window,
+		slotWidth:    max(cfg.Window/slots, time.Millisecond),
+		offlineAfter: cfg.OfflineAfter,
+		retain:       cfg.Retain,
+		topN:         cfg.TopN,
+		started:      clk.Now(),
+		agents:       make(map[string]*agent),
+	}
+}
+
+// Observe 记录写入存储的一批数据，应在数据写入存储后调用
+func (t *Tracker) Observe(metrics []processor.ProcessedMetric) {
+	now := t.clock.Now()
+	slot := t.slot(now)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.requests.add(slot, 1)
+	t.samples.add(slot, int64(len(metrics)))
+	for i := range metrics {
+		if metrics[i].AgentID == "" {
+			continue
+		}
+		a := t.agent(metrics[i].AgentID)
+		a.lastSeen = now
+		a.samples.add(slot, 1)
+	}
+}
+
+// RecordError 记录一次失败的接入请求，agentID为空表示无法确定来源
+func (t *Tracker) RecordError(agentID string) {
+	slot := t.slot(t.clock.Now())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.requests.add(slot, 1)
+	t.errors.add(slot, 1)
+	if agentID != "" {
+		t.agent(agentID).errors.add(slot, 1)
+	}
+}
+
+// Summary 返回集群健康摘要，同时忘记超过retain未上报的Agent
+func (t *Tracker) Summary() Summary {
+	now := t.clock.Now()
+	slot := t.slot(now)
+	seconds := t.elapsed(now).Seconds()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summary := Summary{
+		GeneratedAt: now,
+		Window:      t.window.String(),
+		TopNoisy:    make([]AgentActivity, 0),
+		Offline:     make([]AgentActivity, 0),
+	}
+
+	samples, requests, errors := t.samples.sum(slot), t.requests.sum(slot), t.errors.sum(slot)
+	summary.Ingest = Rates{
+		SamplesPerSecond:  float64(samples) / seconds,
+		RequestsPerSecond: float64(requests) / seconds,
+		ErrorsPerSecond:   float64(errors) / seconds,
+	}
+	if requests > 0 {
+		summary.Ingest.ErrorRate = float64(errors) / float64(requests)
+	}
+
+	active := make([]AgentActivity, 0, len(t.agents))
+	for id, a := range t.agents {
+		// 只有错误没有成功上报的Agent没有lastSeen
+		idle := now.Sub(a.lastSeen)
+		if t.retain > 0 && idle > t.retain && a.errors.sum(slot) == 0 {
+			delete(t.agents, id)
+			continue
+		}
+
+		activity := AgentActivity{
+			AgentID:  id,
+			Online:   !a.lastSeen.IsZero() && idle <= t.offlineAfter,
+			LastSeen: a.lastSeen,
+			Samples:  a.samples.sum(slot),
+			Errors:   a.errors.sum(slot),
+		}
+		activity.SamplesPerSecond = float64(activity.Samples) / seconds
+
+		summary.Agents.Total++
+		if activity.Online {
+			summary.Agents.Online++
+		} else {
+			summary.Agents.Offline++
+			summary.Offline = append(summary.Offline, activity)
+		}
+		if activity.Samples > 0 {
+			active = append(active, activity)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].Samples != active[j].Samples {
+			return active[i].Samples > active[j].Samples
+		}
+		return active[i].AgentID < active[j].AgentID
+	})
+	if len(active) > t.topN {
+		active = active[:t.topN]
+	}
+	summary.TopNoisy = active
+
+	sort.Slice(summary.Offline, func(i, j int) bool {
+		return summary.Offline[i].LastSeen.After(summary.Offline[j].LastSeen)
+	})
+	if len(summary.Offline) > t.topN {
+		summary.Offline = summary.Offline[:t.topN]
+	}
+	return summary
+}
+
+// agent 返回Agent的统计，不存在时创建，调用方需持有锁
+func (t *Tracker) agent(id string) *agent {
+	a, ok := t.agents[id]
+	if !ok {
+		a = &agent{}
+		t.agents[id] = a
+	}
+	return a
+}
+
+// slot 返回时间所在的时间片
+func (t *Tracker) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(t.slotWidth)
+}
+
+// elapsed 返回计算速率使用的时长，启动后不足一个统计窗口时使用已运行的时长
+func (t *Tracker) elapsed(now time.Time) time.Duration {
+	d := now.Sub(t.started)
+	if d > t.window {
+		d = t.window
+	}
+	return max(d, time.Second)
+}
@@ -0,0 +1,313 @@
+package grafana
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrUnknownDashboard 没有该名称的预置仪表盘
+var ErrUnknownDashboard = errors.New("unknown dashboard")
+
+// datasourceInput 未指定数据源UID时仪表盘引用的导入变量，Grafana导入时提示选择数据源
+const datasourceInput = "${DS_KON}"
+
+// DashboardInfo 预置仪表盘的名称和说明
+type DashboardInfo struct {
+	Name        string `json:"name"`
+	UID         string `json:"uid"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// Dashboard Grafana仪表盘的JSON模型
+type Dashboard struct {
+	// Inputs 未指定数据源UID时的导入变量
+	Inputs        []input    `json:"__inputs,omitempty"`
+	UID           string     `json:"uid"`
+	Title         string     `json:"title"`
+	Description   string     `json:"description"`
+	Tags          []string   `json:"tags"`
+	Timezone      string     `json:"timezone"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Refresh       string     `json:"refresh"`
+	Time          timeRange  `json:"time"`
+	Templating    templating `json:"templating"`
+	Panels        []panel    `json:"panels"`
+}
+
+type input struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+type timeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type templating struct {
+	List []variable `json:"list"`
+}
+
+// variable 仪表盘变量，textbox由用户输入，custom从Query的逗号分隔列表中选择
+type variable struct {
+	Name    string `json:"name"`
+	Label   string `json:"label"`
+	Type    string `json:"type"`
+	Query   string `json:"query"`
+	Current option `json:"current"`
+}
+
+type option struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+type panel struct {
+	ID          int           `json:"id"`
+	Type        string        `json:"type"`
+	Title       string        `json:"title"`
+	Description string        `json:"description,omitempty"`
+	GridPos     gridPos       `json:"gridPos"`
+	Datasource  datasourceRef `json:"datasource"`
+	Targets     []target      `json:"targets"`
+	FieldConfig fieldConfig   `json:"fieldConfig"`
+}
+
+type gridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type datasourceRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type target struct {
+	RefID        string        `json:"refId"`
+	Datasource   datasourceRef `json:"datasource"`
+	Expr         string        `json:"expr"`
+	LegendFormat string        `json:"legendFormat,omitempty"`
+	Instant      bool          `json:"instant,omitempty"`
+	Format       string        `json:"format,omitempty"`
+}
+
+type fieldConfig struct {
+	Defaults  fieldDefaults `json:"defaults"`
+	Overrides []any         `json:"overrides"`
+}
+
+type fieldDefaults struct {
+	Unit  string `json:"unit,omitempty"`
+	Links []link `json:"links,omitempty"`
+}
+
+type link struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// dashboardSpec 预置仪表盘的定义，面板的数据源在生成时填入。
+// rate()的结果与Prometheus一样不带__name__，图例使用完整的标签集
+type dashboardSpec struct {
+	DashboardInfo
+	variables []variable
+	panels    []panel
+}
+
+// 预置仪表盘，fleet-overview和agent-drilldown通过/api/v1/query_range查询存储中的数据，
+// collector-health查询抓取了采集器/api/v1/ingest/rates?format=prometheus和Prometheus抓取接口的Prometheus
+var dashboards = map[string]dashboardSpec{
+	"fleet-overview": {
+		DashboardInfo: DashboardInfo{
+			UID:         "kon-fleet-overview",
+			Title:       "Kon fleet overview",
+			Description: "Selected metrics across all agents. Uses a Prometheus datasource pointing at the Kon-Agent-export PromQL API (promql.enabled).",
+		},
+		variables: []variable{
+			textbox("metric", "Metric (regex)", ".*cpu.*"),
+			textbox("counter", "Counter (regex)", ".*packets.*"),
+		},
+		panels: []panel{
+			{
+				Type:    "timeseries",
+				Title:   "$metric by agent",
+				GridPos: gridPos{H: 9, W: 24},
+				Targets: []target{{Expr: `{__name__=~"$metric"}`, LegendFormat: "{{agent_id}} {{__name__}}"}},
+			},
+			{
+				Type:    "timeseries",
+				Title:   "$counter per second by agent",
+				GridPos: gridPos{H: 9, W: 12, Y: 9},
+				Targets: []target{{Expr: `rate({__name__=~"$counter"}[$__rate_interval])`}},
+				FieldConfig: fieldConfig{
+					Defaults: fieldDefaults{Unit: "ops"},
+				},
+			},
+			{
+				Type:        "table",
+				Title:       "Latest $metric",
+				Description: "Click an agent to open the agent drill-down dashboard.",
+				GridPos:     gridPos{H: 9, W: 12, X: 12, Y: 9},
+				Targets:     []target{{Expr: `{__name__=~"$metric"}`, Instant: true, Format: "table"}},
+				FieldConfig: fieldConfig{
+					Defaults: fieldDefaults{Links: []link{{
+						Title: "Agent drill-down",
+						URL:   "/d/kon-agent-drilldown?var-agent=${__data.fields.agent_id}&${__url_time_range}",
+					}}},
+				},
+			},
+		},
+	},
+	"agent-drilldown": {
+		DashboardInfo: DashboardInfo{
+			UID:         "kon-agent-drilldown",
+			Title:       "Kon agent drill-down",
+			Description: "All metrics reported by one agent. Uses a Prometheus datasource pointing at the Kon-Agent-export PromQL API (promql.enabled).",
+		},
+		variables: []variable{
+			textbox("agent", "Agent ID", ""),
+			textbox("metric", "Metric (regex)", ".+"),
+			textbox("counter", "Counter (regex)", ".*packets.*"),
+		},
+		panels: []panel{
+			{
+				Type:    "timeseries",
+				Title:   "Metrics of $agent",
+				GridPos: gridPos{H: 10, W: 24},
+				Targets: []target{{Expr: `{agent_id="$agent", __name__=~"$metric"}`, LegendFormat: "{{__name__}}"}},
+			},
+			{
+				Type:    "timeseries",
+				Title:   "Counters per second of $agent",
+				GridPos: gridPos{H: 9, W: 12, Y: 10},
+				Targets: []target{{Expr: `rate({agent_id="$agent", __name__=~"$counter"}[$__rate_interval])`}},
+				FieldConfig: fieldConfig{
+					Defaults: fieldDefaults{Unit: "ops"},
+				},
+			},
+			{
+				Type:    "table",
+				Title:   "Latest values of $agent",
+				GridPos: gridPos{H: 9, W: 12, X: 12, Y: 10},
+				Targets: []target{{Expr: `{agent_id="$agent", __name__=~"$metric"}`, Instant: true, Format: "table"}},
+			},
+		},
+	},
+	"collector-health": {
+		DashboardInfo: DashboardInfo{
+			UID:   "kon-collector-health",
+			Title: "Kon collector health",
+			Description: "Ingest rates of the collector itself. Uses a Prometheus server scraping /api/v1/ingest/rates?format=prometheus " +
+				"(ingest_rate.enabled) and the Prometheus exposition path (prometheus.enabled).",
+		},
+		variables: []variable{
+			{Name: "window", Label: "Window", Type: "custom", Query: "1m,5m,15m", Current: option{Text: "5m", Value: "5m"}},
+		},
+		panels: []panel{
+			{
+				Type:    "stat",
+				Title:   "Active agents",
+				GridPos: gridPos{H: 5, W: 8},
+				Targets: []target{{Expr: `kon_ingest_agents`}},
+			},
+			{
+				Type:    "stat",
+				Title:   "Current ingest rate",
+				GridPos: gridPos{H: 5, W: 8, X: 8},
+				Targets: []target{{Expr: `kon_ingest_current_samples_per_second{agent_id=""}`}},
+				FieldConfig: fieldConfig{
+					Defaults: fieldDefaults{Unit: "ops"},
+				},
+			},
+			{
+				Type:    "stat",
+				Title:   "Series dropped from exposition",
+				GridPos: gridPos{H: 5, W: 8, X: 16},
+				Targets: []target{{Expr: `kon_exposition_dropped_series_total`}},
+			},
+			{
+				Type:    "timeseries",
+				Title:   "Ingest rate over $window (avg, peak, low)",
+				GridPos: gridPos{H: 9, W: 12, Y: 5},
+				Targets: []target{{Expr: `kon_ingest_samples_per_second{agent_id="", window="$window"}`, LegendFormat: "{{stat}}"}},
+				FieldConfig: fieldConfig{
+					Defaults: fieldDefaults{Unit: "ops"},
+				},
+			},
+			{
+				Type:    "timeseries",
+				Title:   "Ingest rate by agent",
+				GridPos: gridPos{H: 9, W: 12, X: 12, Y: 5},
+				Targets: []target{{Expr: `kon_ingest_current_samples_per_second{agent_id!=""}`, LegendFormat: "{{agent_id}}"}},
+				FieldConfig: fieldConfig{
+					Defaults: fieldDefaults{Unit: "ops"},
+				},
+			},
+		},
+	},
+}
+
+// Dashboards 返回预置仪表盘列表，按名称排序
+func Dashboards() []DashboardInfo {
+	infos := make([]DashboardInfo, 0, len(dashboards))
+	for name, spec := range dashboards {
+		info := spec.DashboardInfo
+		info.Name = name
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// NewDashboard 生成预置仪表盘，面板使用UID为datasourceUID的Prometheus数据源。
+// datasourceUID为空时生成带__inputs的导出格式，在Grafana中导入时选择数据源
+func NewDashboard(name, datasourceUID string) (*Dashboard, error) {
+	spec, ok := dashboards[name]
+	if !ok {
+		return nil, ErrUnknownDashboard
+	}
+
+	d := &Dashboard{
+		UID:           spec.UID,
+		Title:         spec.Title,
+		Description:   spec.Description,
+		Tags:          []string{"kon"},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          timeRange{From: "now-6h", To: "now"},
+		Templating:    templating{List: append([]variable{}, spec.variables...)},
+		Panels:        make([]panel, len(spec.panels)),
+	}
+	if datasourceUID == "" {
+		datasourceUID = datasourceInput
+		d.Inputs = []input{{Name: "DS_KON", Label: "Kon-Agent-export", Type: "datasource", PluginID: "prometheus"}}
+	}
+
+	ds := datasourceRef{Type: "prometheus", UID: datasourceUID}
+	for i, p := range spec.panels {
+		p.ID = i + 1
+		p.Datasource = ds
+		p.Targets = append([]target{}, p.Targets...)
+		for j := range p.Targets {
+			p.Targets[j].RefID = string(rune('A' + j))
+			p.Targets[j].Datasource = ds
+		}
+		if p.FieldConfig.Overrides == nil {
+			p.FieldConfig.Overrides = []any{}
+		}
+		d.Panels[i] = p
+	}
+	return d, nil
+}
+
+// textbox 用户输入的变量
+func textbox(name, label, value string) variable {
+	return variable{Name: name, Label: label, Type: "textbox", Query: value, Current: option{Text: value, Value: value}}
+}
@@ -0,0 +1,433 @@
+package grafana
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// ErrInvalidQuery 请求中的查询无法执行
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ErrUnsupported 存储不支持按条件排序查询，无法列出指标名和原始数据
+var ErrUnsupported = errors.New("storage does not support grafana queries")
+
+// 查询类型
+const (
+	TypeTimeSeries = "timeserie"
+	TypeTable      = "table"
+)
+
+// maxPoints 单个序列最多输出的点数，面板时间范围过大时加宽聚合窗口
+const maxPoints = 11000
+
+// maxAnnotations 单次注释查询最多返回的注释数
+const maxAnnotations = 1000
+
+// Range 面板的时间范围
+type Range struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Target 面板中的一个查询
+//
+// Target为指标名，可以使用glob(如cpu.*)同时查询多个指标；Payload(旧版插件为Data)为查询选项。
+type Target struct {
+	Target  string          `json:"target"`
+	RefID   string          `json:"refId"`
+	Type    string          `json:"type"`
+	Hide    bool            `json:"hide"`
+	Payload json.RawMessage `json:"payload"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Options 查询选项，写在Target的payload中
+type Options struct {
+	// AgentID 只查询该Agent的数据
+	AgentID string `json:"agent_id"`
+	// Agg 聚合函数，与/api/v1/metrics/aggregate的agg参数相同，默认avg
+	Agg string `json:"agg"`
+	// Quantile agg为quantile时的分位数
+	Quantile float64 `json:"q"`
+	// ByAgent 为每个Agent输出一个序列，否则同名指标聚合为一个序列
+	ByAgent bool `json:"by_agent"`
+}
+
+// QueryRequest /query的请求
+type QueryRequest struct {
+	Range         Range    `json:"range"`
+	IntervalMs    int64    `json:"intervalMs"`
+	MaxDataPoints int      `json:"maxDataPoints"`
+	Targets       []Target `json:"targets"`
+}
+
+// SearchRequest /search的请求，Target为空时列出全部指标名
+type SearchRequest struct {
+	Target string `json:"target"`
+}
+
+// AnnotationRequest /annotations的请求，Annotation为面板中的注释定义，原样回填到结果中
+type AnnotationRequest struct {
+	Range      Range           `json:"range"`
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+// TimeSeries 时间序列结果，每个点为[取值, 毫秒时间戳]
+type TimeSeries struct {
+	Target     string       `json:"target"`
+	RefID      string       `json:"refId,omitempty"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// Column 表格的列
+type Column struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// Table 表格结果
+type Table struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []Column        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Annotation 一条注释
+type Annotation struct {
+	Annotation json.RawMessage `json:"annotation,omitempty"`
+	Time       int64           `json:"time"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+}
+
+// tableColumns 原始数据表格的列
+var tableColumns = []Column{
+	{Text: "time", Type: "time"},
+	{Text: "agent_id", Type: "string"},
+	{Text: "name", Type: "string"},
+	{Text: "value", Type: "number"},
+	{Text: "labels", Type: "string"},
+}
+
+// Datasource 把Grafana JSON数据源插件的请求转换为存储的聚合和范围查询
+//
+// 时间序列查询按面板的interval聚合，表格查询返回原始数据，注释查询把匹配的指标数据显示为注释。
+// grant不为nil时只返回令牌可见的数据，聚合结果不含标签，按指标名保守判断。
+type Datasource struct {
+	maxSamples   int
+	searchWindow time.Duration
+}
+
+// NewDatasource 创建Grafana数据源
+func NewDatasource(cfg config.GrafanaConfig) *Datasource {
+	return &Datasource{maxSamples: cfg.MaxSamples, searchWindow: cfg.SearchWindow}
+}
+
+// Search 返回最近search_window内上报过的指标名，target含*或?时按glob匹配，否则按子串匹配，不区分大小写
+func (d *Datasource) Search(store storage.Storage, req SearchRequest, now time.Time, grant *acl.Grant) ([]string, error) {
+	sq, ok := store.(storage.SortedQuerier)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	filter := storage.Filter{Start: now.Add(-d.searchWindow)}
+	match := func(string) bool { return true }
+	if target := strings.TrimSpace(req.Target); strings.ContainsAny(target, "*?") {
+		matcher, err := storage.NewNameGlob(target)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+		filter.Name = matcher
+	} else if target != "" {
+		target = strings.ToLower(target)
+		match = func(name string) bool { return strings.Contains(strings.ToLower(name), target) }
+	}
+
+	grant.Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, d.maxSamples)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for i := range metrics {
+		m := &metrics[i]
+		if seen[m.Name] || !match(m.Name) {
+			continue
+		}
+		seen[m.Name] = true
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Query 依次执行面板中未隐藏的查询，结果为TimeSeries或Table
+func (d *Datasource) Query(store storage.Storage, req QueryRequest, grant *acl.Grant) ([]interface{}, error) {
+	if req.Range.To.Before(req.Range.From) {
+		return nil, fmt.Errorf("%w: range.to is before range.from", ErrInvalidQuery)
+	}
+	step := d.step(req)
+
+	results := make([]interface{}, 0, len(req.Targets))
+	for _, t := range req.Targets {
+		if t.Hide || strings.TrimSpace(t.Target) == "" {
+			continue
+		}
+		opts, err := parseOptions(t)
+		if err != nil {
+			return nil, err
+		}
+
+		switch t.Type {
+		case "", TypeTimeSeries, "timeseries":
+			series, err := d.timeSeries(store, t, opts, req.Range, step, grant)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range series {
+				results = append(results, s)
+			}
+		case TypeTable:
+			table, err := d.table(store, t, opts, req, grant)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, table)
+		default:
+			return nil, fmt.Errorf("%w: unsupported target type %q", ErrInvalidQuery, t.Type)
+		}
+	}
+	return results, nil
+}
+
+// Annotations 把时间范围内匹配注释query(指标名glob，为空时使用注释名称)的数据转换为注释，最新的在前
+func (d *Datasource) Annotations(store storage.Storage, req AnnotationRequest, grant *acl.Grant) ([]Annotation, error) {
+	var def struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+	if len(req.Annotation) > 0 {
+		if err := json.Unmarshal(req.Annotation, &def); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+	}
+	pattern := strings.TrimSpace(def.Query)
+	if pattern == "" {
+		pattern = strings.TrimSpace(def.Name)
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("%w: annotation query is required", ErrInvalidQuery)
+	}
+	matcher, err := storage.NewNameGlob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	sq, ok := store.(storage.SortedQuerier)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	filter := storage.Filter{Start: req.Range.From, End: req.Range.To, Name: matcher}
+	grant.Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, maxAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := make([]Annotation, 0, len(metrics))
+	for i := range metrics {
+		m := &metrics[i]
+		tags := []string{"agent_id:" + m.AgentID}
+		for _, k := range sortedKeys(m.Labels) {
+			tags = append(tags, k+":"+m.Labels[k])
+		}
+		annotations = append(annotations, Annotation{
+			Annotation: req.Annotation,
+			Time:       m.Timestamp.UnixMilli(),
+			Title:      m.Name,
+			Text:       fmt.Sprintf("%s = %s (agent %s)", m.Name, strconv.FormatFloat(m.Value, 'g', -1, 64), m.AgentID),
+			Tags:       tags,
+		})
+	}
+	return annotations, nil
+}
+
+// step 聚合窗口宽度，取面板interval和时间范围除以点数上限中的较大者，不小于1毫秒
+func (d *Datasource) step(req QueryRequest) time.Duration {
+	step := time.Duration(req.IntervalMs) * time.Millisecond
+	points := maxPoints
+	if req.MaxDataPoints > 0 && req.MaxDataPoints < points {
+		points = req.MaxDataPoints
+	}
+	if span := req.Range.To.Sub(req.Range.From); span/time.Duration(points) >= step {
+		// 向上取整到毫秒，保证点数不超过上限
+		step = (span/time.Duration(points) + time.Millisecond).Truncate(time.Millisecond)
+	}
+	return max(step, time.Millisecond)
+}
+
+// timeSeries 对target匹配的每个指标(by_agent时为每个Agent的每个指标)执行一次聚合查询
+func (d *Datasource) timeSeries(store storage.Storage, t Target, opts Options, r Range, step time.Duration, grant *acl.Grant) ([]TimeSeries, error) {
+	matcher, err := storage.NewNameGlob(t.Target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	type key struct{ name, agentID string }
+	var keys []key
+	if matcher.Literal() && !opts.ByAgent {
+		keys = []key{{name: matcher.Prefix(), agentID: opts.AgentID}}
+	} else {
+		// glob和by_agent需要先从时间范围内的数据中找出实际的指标名和Agent
+		sq, ok := store.(storage.SortedQuerier)
+		if !ok {
+			return nil, ErrUnsupported
+		}
+		filter := storage.Filter{AgentID: opts.AgentID, Start: r.From, End: r.To, Name: matcher}
+		metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, d.maxSamples)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[key]bool)
+		for i := range metrics {
+			k := key{name: metrics[i].Name, agentID: opts.AgentID}
+			if opts.ByAgent {
+				k.agentID = metrics[i].AgentID
+			}
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].name != keys[j].name {
+				return keys[i].name < keys[j].name
+			}
+			return keys[i].agentID < keys[j].agentID
+		})
+	}
+
+	series := make([]TimeSeries, 0, len(keys))
+	for _, k := range keys {
+		if !grant.AllowedSeries(k.agentID, k.name) {
+			continue
+		}
+		q := storage.AggregateQuery{
+			AgentID:  k.agentID,
+			Name:     k.name,
+			Func:     opts.Agg,
+			Quantile: opts.Quantile,
+			Step:     step,
+			Start:    r.From,
+			End:      r.To,
+		}
+		if err := q.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+		points, err := store.Aggregate(q)
+		if err != nil {
+			return nil, err
+		}
+
+		s := TimeSeries{Target: k.name, RefID: t.RefID, Datapoints: make([][2]float64, len(points))}
+		if opts.ByAgent {
+			s.Target = fmt.Sprintf("%s{agent_id=%q}", k.name, k.agentID)
+		}
+		for i, p := range points {
+			s.Datapoints[i] = [2]float64{p.Value, float64(p.Timestamp.UnixMilli())}
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// table 返回target匹配的原始数据，最新的在前，最多maxDataPoints条且不超过max_samples
+func (d *Datasource) table(store storage.Storage, t Target, opts Options, req QueryRequest, grant *acl.Grant) (*Table, error) {
+	matcher, err := storage.NewNameGlob(t.Target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	sq, ok := store.(storage.SortedQuerier)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	limit := d.maxSamples
+	if req.MaxDataPoints > 0 && req.MaxDataPoints < limit {
+		limit = req.MaxDataPoints
+	}
+	filter := storage.Filter{AgentID: opts.AgentID, Start: req.Range.From, End: req.Range.To, Name: matcher}
+	grant.Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &Table{Type: TypeTable, RefID: t.RefID, Columns: tableColumns, Rows: make([][]interface{}, 0, len(metrics))}
+	for i := range metrics {
+		m := &metrics[i]
+		table.Rows = append(table.Rows, []interface{}{m.Timestamp.UnixMilli(), m.AgentID, m.Name, m.Value, formatLabels(m)})
+	}
+	return table, nil
+}
+
+// parseOptions 解析查询选项，新版插件的payload可能是JSON文本
+func parseOptions(t Target) (Options, error) {
+	opts := Options{Agg: storage.AggregateAvg}
+	raw := t.Payload
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = t.Data
+	}
+	if len(raw) > 0 && raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return opts, fmt.Errorf("%w: target %s: %v", ErrInvalidQuery, t.RefID, err)
+		}
+		raw = json.RawMessage(text)
+	}
+	if len(strings.TrimSpace(string(raw))) == 0 || string(raw) == "null" {
+		return opts, nil
+	}
+	if err := json.Unmarshal(raw, &opts); err != nil {
+		return opts, fmt.Errorf("%w: target %s: invalid payload: %v", ErrInvalidQuery, t.RefID, err)
+	}
+	if opts.Agg == "" {
+		opts.Agg = storage.AggregateAvg
+	}
+	return opts, nil
+}
+
+// formatLabels 把标签格式化为按名称排序的k=v,k=v
+func formatLabels(m *processor.ProcessedMetric) string {
+	var b strings.Builder
+	for i, k := range sortedKeys(m.Labels) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(m.Labels[k])
+	}
+	return b.String()
+}
+
+// sortedKeys 返回按名称排序的标签名
+func sortedKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,487 @@
+// Package graphql 实现只读查询使用的GraphQL子集
+//
+// 支持query操作、参数、别名、变量、具名和内联片段、@include/@skip指令和__typename，
+// 不支持mutation、subscription和内省(__schema、__type)。类型检查由各对象的Resolve完成。
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Request GraphQL over HTTP的请求
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Error 查询错误，Path为出错字段在结果中的路径
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Response 查询结果，请求无法执行时Data为nil
+type Response struct {
+	Data   interface{} `json:"data"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// Object GraphQL对象类型
+//
+// Resolve返回字段的值：Object或[]Object需要子字段选择，其余值按JSON标量输出。
+// 未知字段应返回ErrUnknownField包装的错误。
+type Object interface {
+	TypeName() string
+	Resolve(field string, args Args) (interface{}, error)
+}
+
+// ErrUnknownField 对象没有请求的字段
+var ErrUnknownField = errors.New("unknown field")
+
+// Executor 执行查询，MaxDepth限制选择集的嵌套深度
+type Executor struct {
+	MaxDepth int
+}
+
+// Execute 解析并执行请求，字段出错时该字段为null并在Errors中记录，不影响其它字段
+func (e *Executor) Execute(root Object, req Request) Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+	vars, err := op.coerceVariables(req.Variables)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	x := &execution{doc: doc, vars: vars, maxDepth: e.MaxDepth}
+	data, err := x.object(root, op.selection, nil, 1)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+	return Response{Data: data, Errors: x.errors}
+}
+
+// operation 按名称选择要执行的操作，文档只有一个操作时名称可以为空
+func (d *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, fmt.Errorf("operationName is required when the document has multiple operations")
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// coerceVariables 合并请求中的变量和声明的默认值，检查必填变量
+func (op *operation) coerceVariables(values map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{}, len(op.variables))
+	for _, def := range op.variables {
+		v, ok := values[def.name]
+		switch {
+		case ok:
+			vars[def.name] = v
+		case def.hasDef:
+			vars[def.name] = def.defValue
+		}
+		if vars[def.name] == nil && def.nonNull {
+			return nil, fmt.Errorf("variable $%s of type %s is required", def.name, def.typ)
+		}
+	}
+	return vars, nil
+}
+
+// execution 一次查询的执行状态
+type execution struct {
+	doc      *document
+	vars     map[string]interface{}
+	maxDepth int
+	errors   []Error
+}
+
+// collected 合并后的同名字段，同一结果键的多次选择合并子选择集
+type collected struct {
+	key    string
+	fields []*field
+}
+
+// object 按选择集解析对象的字段，结果按字段在查询中的顺序输出
+func (x *execution) object(obj Object, sels []selection, path []interface{}, depth int) (*orderedMap, error) {
+	if x.maxDepth > 0 && depth > x.maxDepth {
+		return nil, fmt.Errorf("query exceeds maximum depth %d", x.maxDepth)
+	}
+	groups, err := x.collect(obj.TypeName(), sels, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &orderedMap{}
+	for _, g := range groups {
+		f := g.fields[0]
+		fieldPath := append(append([]interface{}(nil), path...), g.key)
+		if f.name == "__typename" {
+			result.set(g.key, obj.TypeName())
+			continue
+		}
+		args, err := x.arguments(f.args)
+		if err != nil {
+			return nil, err
+		}
+		value, err := obj.Resolve(f.name, args)
+		if errors.Is(err, ErrUnknownField) {
+			return nil, fmt.Errorf("cannot query field %q on type %q", f.name, obj.TypeName())
+		}
+		if err != nil {
+			x.fail(fieldPath, err)
+			result.set(g.key, nil)
+			continue
+		}
+
+		var sub []selection
+		for _, gf := range g.fields {
+			sub = append(sub, gf.selection...)
+		}
+		completed, err := x.complete(f, value, sub, fieldPath, depth)
+		if err != nil {
+			return nil, err
+		}
+		result.set(g.key, completed)
+	}
+	return result, nil
+}
+
+// complete 把解析函数返回的值转换为输出，对象按子选择集继续解析
+func (x *execution) complete(f *field, value interface{}, sub []selection, path []interface{}, depth int) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case Object:
+		if len(sub) == 0 {
+			return nil, fmt.Errorf("field %q of type %q must have a selection of subfields", f.name, v.TypeName())
+		}
+		return x.object(v, sub, path, depth+1)
+	case []Object:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			if len(sub) == 0 {
+				return nil, fmt.Errorf("field %q of type %q must have a selection of subfields", f.name, item.TypeName())
+			}
+			out, err := x.object(item, sub, append(path, i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = out
+		}
+		return list, nil
+	case float64:
+		// JSON不能表示NaN和Inf
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, nil
+		}
+	}
+	if len(sub) > 0 {
+		return nil, fmt.Errorf("field %q must not have a selection since it is a scalar", f.name)
+	}
+	return value, nil
+}
+
+// collect 展开片段，按结果键合并字段，typeName用于判断片段的类型条件
+func (x *execution) collect(typeName string, sels []selection, groups []*collected, visited map[string]bool) ([]*collected, error) {
+	for _, sel := range sels {
+		include, err := x.included(sel.directives)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+
+		switch {
+		case sel.field != nil:
+			key := sel.field.key()
+			var group *collected
+			for _, g := range groups {
+				if g.key == key {
+					group = g
+					break
+				}
+			}
+			if group == nil {
+				group = &collected{key: key}
+				groups = append(groups, group)
+			} else if group.fields[0].name != sel.field.name {
+				return nil, fmt.Errorf("fields %q and %q conflict because they are different fields", key, sel.field.name)
+			}
+			group.fields = append(group.fields, sel.field)
+		case sel.spread != "":
+			frag, ok := x.doc.fragments[sel.spread]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %q", sel.spread)
+			}
+			if visited[sel.spread] {
+				continue
+			}
+			visited[sel.spread] = true
+			include, err := x.included(frag.directives)
+			if err != nil {
+				return nil, err
+			}
+			if !include || frag.typeCondition != typeName {
+				continue
+			}
+			if groups, err = x.collect(typeName, frag.selection, groups, visited); err != nil {
+				return nil, err
+			}
+		case sel.inline != nil:
+			if sel.inline.typeCondition != "" && sel.inline.typeCondition != typeName {
+				continue
+			}
+			if groups, err = x.collect(typeName, sel.inline.selection, groups, visited); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return groups, nil
+}
+
+// included 按@skip(if:)和@include(if:)判断是否选择
+func (x *execution) included(dirs []directive) (bool, error) {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		args, err := x.arguments(d.args)
+		if err != nil {
+			return false, err
+		}
+		cond, ok := args["if"].(bool)
+		if !ok {
+			return false, fmt.Errorf("directive @%s requires a boolean argument \"if\"", d.name)
+		}
+		if cond == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// arguments 替换参数中的变量，未提供的变量视为未传该参数
+func (x *execution) arguments(list []argument) (Args, error) {
+	args := make(Args, len(list))
+	for _, a := range list {
+		if _, dup := args[a.name]; dup {
+			return nil, fmt.Errorf("there can be only one argument named %q", a.name)
+		}
+		if name, ok := a.value.(variable); ok {
+			v, defined := x.vars[string(name)]
+			if !defined {
+				if !x.declared(string(name)) {
+					return nil, fmt.Errorf("variable $%s is not defined", name)
+				}
+				continue
+			}
+			args[a.name] = v
+			continue
+		}
+		v, err := x.resolveValue(a.value)
+		if err != nil {
+			return nil, err
+		}
+		args[a.name] = v
+	}
+	return args, nil
+}
+
+// declared 判断变量是否在某个操作中声明过
+func (x *execution) declared(name string) bool {
+	for _, op := range x.doc.operations {
+		for _, def := range op.variables {
+			if def.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveValue 替换列表和输入对象中嵌套的变量，枚举值转为字符串
+func (x *execution) resolveValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case variable:
+		value, ok := x.vars[string(v)]
+		if !ok && !x.declared(string(v)) {
+			return nil, fmt.Errorf("variable $%s is not defined", v)
+		}
+		return value, nil
+	case enum:
+		return string(v), nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := x.resolveValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			resolved, err := x.resolveValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// fail 记录字段错误
+func (x *execution) fail(path []interface{}, err error) {
+	x.errors = append(x.errors, Error{Message: err.Error(), Path: append([]interface{}(nil), path...)})
+}
+
+// orderedMap 按插入顺序输出键的JSON对象
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *orderedMap) set(key string, value interface{}) {
+	if m.values == nil {
+		m.values = make(map[string]interface{})
+	}
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// MarshalJSON 按字段选择的顺序输出
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Args 字段参数，整数为int64，浮点数为float64，变量中的数字为float64
+type Args map[string]interface{}
+
+// String 返回字符串参数，未传或为null时返回def
+func (a Args) String(name, def string) (string, error) {
+	v, ok := a[name]
+	if !ok || v == nil {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %q must be a string", name)
+	}
+	return s, nil
+}
+
+// Int 返回整数参数，未传或为null时返回def
+func (a Args) Int(name string, def int64) (int64, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v), nil
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be an integer", name)
+}
+
+// Float 返回浮点数参数，未传或为null时返回def
+func (a Args) Float(name string, def float64) (float64, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return def, nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be a number", name)
+}
+
+// Bool 返回布尔参数，未传或为null时返回def
+func (a Args) Bool(name string, def bool) (bool, error) {
+	v, ok := a[name]
+	if !ok || v == nil {
+		return def, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("argument %q must be a boolean", name)
+	}
+	return b, nil
+}
+
+// Check 检查是否传入了未声明的参数
+func (a Args) Check(allowed ...string) error {
+	var unknown []string
+	for name := range a {
+		found := false
+		for _, n := range allowed {
+			if n == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown argument %q", unknown[0])
+	}
+	return nil
+}
@@ -0,0 +1,700 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// document 解析后的查询文档
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+// operation 一个查询操作
+type operation struct {
+	name      string
+	variables []variableDef
+	selection []selection
+}
+
+// variableDef 操作声明的变量，typ为类型的原文
+type variableDef struct {
+	name     string
+	typ      string
+	nonNull  bool
+	defValue interface{}
+	hasDef   bool
+}
+
+// fragment 具名片段
+type fragment struct {
+	typeCondition string
+	directives    []directive
+	selection     []selection
+}
+
+// selection 字段、片段引用或内联片段之一
+type selection struct {
+	field *field
+	// spread 片段引用的片段名
+	spread string
+	// inline 内联片段
+	inline     *fragment
+	directives []directive
+}
+
+// field 查询的字段
+type field struct {
+	alias     string
+	name      string
+	args      []argument
+	selection []selection
+}
+
+// key 字段在结果中的名称
+func (f *field) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+// argument 字段或指令的参数
+type argument struct {
+	name  string
+	value interface{}
+}
+
+// directive 字段或片段上的指令
+type directive struct {
+	name string
+	args []argument
+}
+
+// variable 引用变量的参数值
+type variable string
+
+// enum 枚举值，作为字符串传给解析函数
+type enum string
+
+// 词法单元类型
+const (
+	tokEOF = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind  int
+	value string
+	pos   int
+}
+
+// parser 递归下降解析查询文本
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+// parse 解析查询文档，不支持mutation和subscription
+func parse(src string) (*document, error) {
+	p := &parser{src: strings.TrimPrefix(src, "\ufeff")}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	doc := &document{fragments: make(map[string]*fragment)}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.peekPunct("{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{selection: sel})
+		case p.tok.kind == tokName && p.tok.value == "query":
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.tok.kind == tokName && p.tok.value == "fragment":
+			name, frag, err := p.fragmentDefinition()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, fmt.Errorf("there can be only one fragment named %q", name)
+			}
+			doc.fragments[name] = frag
+		case p.tok.kind == tokName && (p.tok.value == "mutation" || p.tok.value == "subscription"):
+			return nil, fmt.Errorf("%s operations are not supported", p.tok.value)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("document has no operation")
+	}
+	return doc, nil
+}
+
+// operation query Name? VariableDefinitions? Directives? SelectionSet
+func (p *parser) operation() (*operation, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	op := &operation{}
+	if p.tok.kind == tokName {
+		op.name = p.tok.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peekPunct("(") {
+		defs, err := p.variableDefinitions()
+		if err != nil {
+			return nil, err
+		}
+		op.variables = defs
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selection = sel
+	return op, nil
+}
+
+// variableDefinitions ( $name: Type = default ... )
+func (p *parser) variableDefinitions() ([]variableDef, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var defs []variableDef
+	for !p.peekPunct(")") {
+		if err := p.expectPunct("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		start := p.tok.pos
+		if err := p.typeRef(); err != nil {
+			return nil, err
+		}
+		typ := strings.TrimSpace(p.src[start:p.tok.pos])
+		def := variableDef{name: name, typ: typ, nonNull: strings.HasSuffix(typ, "!")}
+		if p.peekPunct("=") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if def.defValue, err = p.value(true); err != nil {
+				return nil, err
+			}
+			def.hasDef = true
+		}
+		defs = append(defs, def)
+	}
+	return defs, p.next()
+}
+
+// typeRef Name、[Type]，可带!
+func (p *parser) typeRef() error {
+	if p.peekPunct("[") {
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peekPunct("!") {
+		return p.next()
+	}
+	return nil
+}
+
+// fragmentDefinition fragment Name on Type Directives? SelectionSet
+func (p *parser) fragmentDefinition() (string, *fragment, error) {
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "on" {
+		return "", nil, fmt.Errorf("fragment cannot be named \"on\"")
+	}
+	if on, err := p.name(); err != nil || on != "on" {
+		return "", nil, fmt.Errorf("expected \"on\" after fragment name %s", name)
+	}
+	frag := &fragment{}
+	if frag.typeCondition, err = p.name(); err != nil {
+		return "", nil, err
+	}
+	if frag.directives, err = p.directives(); err != nil {
+		return "", nil, err
+	}
+	if frag.selection, err = p.selectionSet(); err != nil {
+		return "", nil, err
+	}
+	return name, frag, nil
+}
+
+// selectionSet { Selection+ }
+func (p *parser) selectionSet() ([]selection, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+	var sels []selection
+	for !p.peekPunct("}") {
+		if p.tok.kind == tokEOF {
+			return nil, p.unexpected()
+		}
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("syntax error at %d: empty selection set", p.tok.pos)
+	}
+	return sels, p.next()
+}
+
+// selection Field、...FragmentName或... on Type { }
+func (p *parser) selection() (selection, error) {
+	if p.peekPunct("...") {
+		if err := p.next(); err != nil {
+			return selection{}, err
+		}
+		if p.tok.kind == tokName && p.tok.value != "on" {
+			name := p.tok.value
+			if err := p.next(); err != nil {
+				return selection{}, err
+			}
+			dirs, err := p.directives()
+			return selection{spread: name, directives: dirs}, err
+		}
+		frag := &fragment{}
+		if p.tok.kind == tokName && p.tok.value == "on" {
+			if err := p.next(); err != nil {
+				return selection{}, err
+			}
+			var err error
+			if frag.typeCondition, err = p.name(); err != nil {
+				return selection{}, err
+			}
+		}
+		dirs, err := p.directives()
+		if err != nil {
+			return selection{}, err
+		}
+		if frag.selection, err = p.selectionSet(); err != nil {
+			return selection{}, err
+		}
+		return selection{inline: frag, directives: dirs}, nil
+	}
+
+	f := &field{}
+	name, err := p.name()
+	if err != nil {
+		return selection{}, err
+	}
+	if p.peekPunct(":") {
+		if err := p.next(); err != nil {
+			return selection{}, err
+		}
+		f.alias = name
+		if name, err = p.name(); err != nil {
+			return selection{}, err
+		}
+	}
+	f.name = name
+	if p.peekPunct("(") {
+		if f.args, err = p.arguments(false); err != nil {
+			return selection{}, err
+		}
+	}
+	dirs, err := p.directives()
+	if err != nil {
+		return selection{}, err
+	}
+	if p.peekPunct("{") {
+		if f.selection, err = p.selectionSet(); err != nil {
+			return selection{}, err
+		}
+	}
+	return selection{field: f, directives: dirs}, nil
+}
+
+// arguments ( name: Value ... )
+func (p *parser) arguments(constant bool) ([]argument, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var args []argument
+	for !p.peekPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(constant)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, argument{name: name, value: v})
+	}
+	return args, p.next()
+}
+
+// directives @name(args)...
+func (p *parser) directives() ([]directive, error) {
+	var dirs []directive
+	for p.peekPunct("@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		d := directive{name: name}
+		if p.peekPunct("(") {
+			if d.args, err = p.arguments(false); err != nil {
+				return nil, err
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// value 参数值，constant为true时不允许引用变量
+func (p *parser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokInt:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("syntax error at %d: invalid int %s", tok.pos, tok.value)
+		}
+		return n, p.next()
+	case tokFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("syntax error at %d: invalid float %s", tok.pos, tok.value)
+		}
+		return f, p.next()
+	case tokString:
+		return tok.value, p.next()
+	case tokName:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		switch tok.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return enum(tok.value), nil
+	case tokPunct:
+		switch tok.value {
+		case "$":
+			if constant {
+				return nil, fmt.Errorf("syntax error at %d: unexpected variable", tok.pos)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			return variable(name), err
+		case "[":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			list := make([]interface{}, 0)
+			for !p.peekPunct("]") {
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, p.next()
+		case "{":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			obj := make(map[string]interface{})
+			for !p.peekPunct("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectPunct(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			return obj, p.next()
+		}
+	}
+	return nil, p.unexpected()
+}
+
+// name 读取一个名称
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.next()
+}
+
+func (p *parser) peekPunct(s string) bool {
+	return p.tok.kind == tokPunct && p.tok.value == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	if !p.peekPunct(s) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokEOF {
+		return fmt.Errorf("syntax error: unexpected end of document")
+	}
+	return fmt.Errorf("syntax error at %d: unexpected %q", p.tok.pos, p.tok.value)
+}
+
+// next 读取下一个词法单元，跳过空白、逗号和注释
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+			continue
+		}
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		break
+	}
+
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return nil
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = token{kind: tokPunct, value: "...", pos: start}
+	case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = token{kind: tokPunct, value: string(c), pos: start}
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = token{kind: tokName, value: p.src[start:p.pos], pos: start}
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	case c == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			return p.blockString()
+		}
+		return p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		return fmt.Errorf("syntax error at %d: unexpected character %q", start, r)
+	}
+	return nil
+}
+
+// number 整数或浮点数
+func (p *parser) number() error {
+	start := p.pos
+	kind := tokInt
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	if digits() == 0 {
+		return fmt.Errorf("syntax error at %d: invalid number", start)
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		p.pos++
+		kind = tokFloat
+		if digits() == 0 {
+			return fmt.Errorf("syntax error at %d: invalid number", start)
+		}
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		kind = tokFloat
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			return fmt.Errorf("syntax error at %d: invalid number", start)
+		}
+	}
+	if p.pos < len(p.src) && (isNameChar(p.src[p.pos]) || p.src[p.pos] == '.') {
+		return fmt.Errorf("syntax error at %d: invalid number", start)
+	}
+	p.tok = token{kind: kind, value: p.src[start:p.pos], pos: start}
+	return nil
+}
+
+// string 带转义的单行字符串
+func (p *parser) string() error {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			return fmt.Errorf("syntax error at %d: unterminated string", start)
+		}
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			p.tok = token{kind: tokString, value: b.String(), pos: start}
+			return nil
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				return fmt.Errorf("syntax error at %d: unterminated string", start)
+			}
+			esc := p.src[p.pos+1]
+			p.pos += 2
+			switch esc {
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return fmt.Errorf("syntax error at %d: invalid unicode escape", p.pos)
+				}
+				code, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					return fmt.Errorf("syntax error at %d: invalid unicode escape", p.pos)
+				}
+				b.WriteRune(rune(code))
+				p.pos += 4
+			default:
+				return fmt.Errorf("syntax error at %d: invalid escape \\%c", p.pos-1, esc)
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// blockString """多行字符串"""，去掉公共缩进和首尾空行
+func (p *parser) blockString() error {
+	start := p.pos
+	p.pos += 3
+	end := strings.Index(p.src[p.pos:], `"""`)
+	for end > 0 && p.src[p.pos+end-1] == '\\' {
+		next := strings.Index(p.src[p.pos+end+3:], `"""`)
+		if next < 0 {
+			end = -1
+			break
+		}
+		end += 3 + next
+	}
+	if end < 0 {
+		return fmt.Errorf("syntax error at %d: unterminated string", start)
+	}
+	raw := strings.ReplaceAll(p.src[p.pos:p.pos+end], `\"""`, `"""`)
+	p.pos += end + 3
+
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = ""
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	p.tok = token{kind: tokString, value: strings.Join(lines, "\n"), pos: start}
+	return nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
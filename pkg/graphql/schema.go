@@ -0,0 +1,542 @@
+package graphql
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// ErrUnsupported 存储不支持按条件排序查询
+var ErrUnsupported = errors.New("storage does not support graphql queries")
+
+// maxPoints 单次聚合最多输出的窗口数
+const maxPoints = 11000
+
+// SDL 查询的schema，GET请求不带query时返回，供前端生成类型
+const SDL = `type Query {
+  metrics(agent_id: String, type: String, name: String, start: Float, end: Float, limit: Int = 100, sort_by: String = "timestamp", order: String = "desc"): [Metric!]!
+  latest(agent_id: String, name: String, lookback: String = "1h"): [Metric!]!
+  agents: [Agent!]!
+  agent(id: String!): Agent
+  aggregate(name: String!, agent_id: String, agg: String = "avg", q: Float, step: String = "1m", start: Float, end: Float): [AggregatePoint!]!
+}
+
+type Agent {
+  id: String!
+  metric_count: Int!
+  last_seen: String
+  metrics(type: String, name: String, start: Float, end: Float, limit: Int = 100, sort_by: String = "timestamp", order: String = "desc"): [Metric!]!
+  latest(name: String, lookback: String = "1h"): [Metric!]!
+  aggregate(name: String!, agg: String = "avg", q: Float, step: String = "1m", start: Float, end: Float): [AggregatePoint!]!
+}
+
+type Metric {
+  agent_id: String!
+  agent: Agent!
+  name: String!
+  value: Float
+  type: String!
+  timestamp: String!
+  timestamp_ms: Float!
+  labels: JSON!
+  label(name: String!): String
+}
+
+type AggregatePoint {
+  timestamp: String!
+  timestamp_ms: Float!
+  value: Float
+  count: Int!
+}
+
+# name参数为glob，*匹配任意字符串，?匹配单个字符；start/end为毫秒时间戳；labels为标签名到取值的对象
+scalar JSON
+`
+
+// Schema 指标、Agent和聚合结果的GraphQL schema
+//
+// 前端可以在一次请求中只取需要的字段，例如每个Agent最新的CPU取值及其标签。
+// grant不为nil时只返回令牌可见的数据，聚合结果不含标签，按指标名保守判断。
+type Schema struct {
+	executor   Executor
+	maxSamples int
+}
+
+// NewSchema 创建GraphQL schema
+func NewSchema(cfg config.GraphQLConfig) *Schema {
+	return &Schema{executor: Executor{MaxDepth: cfg.MaxDepth}, maxSamples: cfg.MaxSamples}
+}
+
+// Execute 在store上执行请求
+func (s *Schema) Execute(store storage.Storage, req Request, now time.Time, grant *acl.Grant) Response {
+	return s.executor.Execute(&query{schema: s, store: store, now: now, grant: grant}, req)
+}
+
+// query 根对象，同时保存一次请求内共享的状态
+type query struct {
+	schema *Schema
+	store  storage.Storage
+	now    time.Time
+	grant  *acl.Grant
+	// counts 按Agent统计的可见数据条数，首次需要时计算
+	counts map[string]int
+}
+
+func (q *query) TypeName() string { return "Query" }
+
+func (q *query) Resolve(field string, args Args) (interface{}, error) {
+	switch field {
+	case "metrics":
+		return q.metrics("", args)
+	case "latest":
+		return q.latest("", args)
+	case "agents":
+		if err := args.Check(); err != nil {
+			return nil, err
+		}
+		counts, err := q.agentCounts()
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0, len(counts))
+		for id := range counts {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		agents := make([]Object, len(ids))
+		for i, id := range ids {
+			agents[i] = &agent{q: q, id: id}
+		}
+		return agents, nil
+	case "agent":
+		if err := args.Check("id"); err != nil {
+			return nil, err
+		}
+		id, err := args.String("id", "")
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, fmt.Errorf("argument \"id\" is required")
+		}
+		counts, err := q.agentCounts()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := counts[id]; !ok {
+			return nil, nil
+		}
+		return &agent{q: q, id: id}, nil
+	case "aggregate":
+		return q.aggregate("", args)
+	}
+	return nil, ErrUnknownField
+}
+
+// sorted 返回存储的排序查询接口
+func (q *query) sorted() (storage.SortedQuerier, error) {
+	sq, ok := q.store.(storage.SortedQuerier)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return sq, nil
+}
+
+// metrics 按条件查询原始数据，agentID不为空时限定为该Agent
+func (q *query) metrics(agentID string, args Args) ([]Object, error) {
+	allowed := []string{"type", "name", "start", "end", "limit", "sort_by", "order"}
+	if agentID == "" {
+		allowed = append(allowed, "agent_id")
+	}
+	if err := args.Check(allowed...); err != nil {
+		return nil, err
+	}
+	filter, err := q.filter(agentID, args)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Type, err = args.String("type", ""); err != nil {
+		return nil, err
+	}
+	limit, err := args.Int("limit", 100)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > int64(q.schema.maxSamples) {
+		return nil, fmt.Errorf("limit must be between 1 and %d", q.schema.maxSamples)
+	}
+	field, err := args.String("sort_by", storage.SortByTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	order, err := args.String("order", "desc")
+	if err != nil {
+		return nil, err
+	}
+	opts, err := storage.ParseSortOptions(field, order)
+	if err != nil {
+		return nil, err
+	}
+
+	sq, err := q.sorted()
+	if err != nil {
+		return nil, err
+	}
+	q.grant.Apply(&filter)
+	result, err := sq.QuerySorted(filter, opts, int(limit))
+	if err != nil {
+		return nil, err
+	}
+	return q.objects(result), nil
+}
+
+// latest 返回lookback内每个序列(Agent、指标名和标签相同)的最新一条数据，按Agent和指标名排序
+func (q *query) latest(agentID string, args Args) ([]Object, error) {
+	allowed := []string{"name", "lookback"}
+	if agentID == "" {
+		allowed = append(allowed, "agent_id")
+	}
+	if err := args.Check(allowed...); err != nil {
+		return nil, err
+	}
+	filter, err := q.filter(agentID, args)
+	if err != nil {
+		return nil, err
+	}
+	lookback, err := args.String("lookback", "1h")
+	if err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(lookback)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid lookback %q", lookback)
+	}
+	filter.Start = q.now.Add(-d)
+
+	sq, err := q.sorted()
+	if err != nil {
+		return nil, err
+	}
+	q.grant.Apply(&filter)
+	result, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, q.schema.maxSamples)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	latest := make([]processor.ProcessedMetric, 0)
+	for i := range result {
+		m := &result[i]
+		key := processor.SeriesKey(m)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		latest = append(latest, *m)
+	}
+	sort.SliceStable(latest, func(i, j int) bool {
+		if latest[i].AgentID != latest[j].AgentID {
+			return latest[i].AgentID < latest[j].AgentID
+		}
+		return latest[i].Name < latest[j].Name
+	})
+	return q.objects(latest), nil
+}
+
+// aggregate 按时间窗口聚合，参数与/api/v1/metrics/aggregate相同
+func (q *query) aggregate(agentID string, args Args) ([]Object, error) {
+	allowed := []string{"name", "agg", "q", "step", "start", "end"}
+	if agentID == "" {
+		allowed = append(allowed, "agent_id")
+	}
+	if err := args.Check(allowed...); err != nil {
+		return nil, err
+	}
+	name, err := args.String("name", "")
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("argument \"name\" is required")
+	}
+	if agentID == "" {
+		if agentID, err = args.String("agent_id", ""); err != nil {
+			return nil, err
+		}
+	}
+	start, end, err := q.timeRange(args, q.now.Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	stepText, err := args.String("step", "1m")
+	if err != nil {
+		return nil, err
+	}
+	step, err := time.ParseDuration(stepText)
+	if err != nil || step < time.Millisecond {
+		return nil, fmt.Errorf("invalid step %q", stepText)
+	}
+	if end.Sub(start)/step >= maxPoints {
+		return nil, fmt.Errorf("too many points, increase step or narrow the range")
+	}
+	fn, err := args.String("agg", storage.AggregateAvg)
+	if err != nil {
+		return nil, err
+	}
+	quantile, err := args.Float("q", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	aq := storage.AggregateQuery{
+		AgentID:  agentID,
+		Name:     name,
+		Func:     fn,
+		Quantile: quantile,
+		Step:     step,
+		Start:    start,
+		End:      end,
+	}
+	if err := aq.Validate(); err != nil {
+		return nil, err
+	}
+	if aq.Func == storage.AggregateHistogram {
+		return nil, fmt.Errorf("agg histogram is not supported, use /api/v1/metrics/aggregate")
+	}
+	if !q.grant.AllowedSeries(agentID, name) {
+		return []Object{}, nil
+	}
+	points, err := q.store.Aggregate(aq)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]Object, len(points))
+	for i := range points {
+		objects[i] = &point{p: points[i]}
+	}
+	return objects, nil
+}
+
+// filter 解析agent_id、name、start和end参数
+func (q *query) filter(agentID string, args Args) (storage.Filter, error) {
+	filter := storage.Filter{AgentID: agentID}
+	if agentID == "" {
+		id, err := args.String("agent_id", "")
+		if err != nil {
+			return filter, err
+		}
+		filter.AgentID = id
+	}
+	if err := nameFilter(&filter, args); err != nil {
+		return filter, err
+	}
+	if _, ok := args["start"]; ok {
+		start, err := args.Float("start", 0)
+		if err != nil {
+			return filter, err
+		}
+		filter.Start = time.UnixMilli(int64(start))
+	}
+	if _, ok := args["end"]; ok {
+		end, err := args.Float("end", 0)
+		if err != nil {
+			return filter, err
+		}
+		filter.End = time.UnixMilli(int64(end))
+	}
+	return filter, nil
+}
+
+// timeRange 解析毫秒时间戳start和end，默认从defStart到当前时间
+func (q *query) timeRange(args Args, defStart time.Time) (time.Time, time.Time, error) {
+	start, err := args.Float("start", float64(defStart.UnixMilli()))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end, err := args.Float("end", float64(q.now.UnixMilli()))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if end < start {
+		return time.Time{}, time.Time{}, fmt.Errorf("end is before start")
+	}
+	return time.UnixMilli(int64(start)), time.UnixMilli(int64(end)), nil
+}
+
+// agentCounts 返回有数据的Agent及其数据条数
+//
+// 不限制权限时直接使用存储统计，否则只统计令牌可见的数据(最多max_samples条)。
+func (q *query) agentCounts() (map[string]int, error) {
+	if q.counts != nil {
+		return q.counts, nil
+	}
+	if q.grant == nil {
+		stats, err := q.store.Stats()
+		if err != nil {
+			return nil, err
+		}
+		q.counts = stats.ByAgent
+		if q.counts == nil {
+			q.counts = make(map[string]int)
+		}
+		return q.counts, nil
+	}
+
+	sq, err := q.sorted()
+	if err != nil {
+		return nil, err
+	}
+	var filter storage.Filter
+	q.grant.Apply(&filter)
+	result, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, q.schema.maxSamples)
+	if err != nil {
+		return nil, err
+	}
+	q.counts = make(map[string]int)
+	for i := range result {
+		q.counts[result[i].AgentID]++
+	}
+	return q.counts, nil
+}
+
+// objects 把数据包装为Metric对象
+func (q *query) objects(metrics []processor.ProcessedMetric) []Object {
+	objects := make([]Object, len(metrics))
+	for i := range metrics {
+		objects[i] = &metric{q: q, m: &metrics[i]}
+	}
+	return objects
+}
+
+// nameFilter 把name参数解析为glob匹配条件
+func nameFilter(filter *storage.Filter, args Args) error {
+	name, err := args.String("name", "")
+	if err != nil || name == "" {
+		return err
+	}
+	matcher, err := storage.NewNameGlob(name)
+	if err != nil {
+		return err
+	}
+	filter.Name = matcher
+	return nil
+}
+
+// agent Agent对象
+type agent struct {
+	q  *query
+	id string
+}
+
+func (a *agent) TypeName() string { return "Agent" }
+
+func (a *agent) Resolve(field string, args Args) (interface{}, error) {
+	switch field {
+	case "id":
+		return a.id, nil
+	case "metric_count":
+		counts, err := a.q.agentCounts()
+		if err != nil {
+			return nil, err
+		}
+		return counts[a.id], nil
+	case "last_seen":
+		return a.lastSeen()
+	case "metrics":
+		return a.q.metrics(a.id, args)
+	case "latest":
+		return a.q.latest(a.id, args)
+	case "aggregate":
+		return a.q.aggregate(a.id, args)
+	}
+	return nil, ErrUnknownField
+}
+
+// lastSeen 返回Agent最新一条可见数据的时间，没有数据时为nil
+func (a *agent) lastSeen() (interface{}, error) {
+	sq, err := a.q.sorted()
+	if err != nil {
+		return nil, err
+	}
+	filter := storage.Filter{AgentID: a.id}
+	a.q.grant.Apply(&filter)
+	result, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return result[0].Timestamp.Format(time.RFC3339Nano), nil
+}
+
+// metric Metric对象
+type metric struct {
+	q *query
+	m *processor.ProcessedMetric
+}
+
+func (m *metric) TypeName() string { return "Metric" }
+
+func (m *metric) Resolve(field string, args Args) (interface{}, error) {
+	switch field {
+	case "agent_id":
+		return m.m.AgentID, nil
+	case "agent":
+		return &agent{q: m.q, id: m.m.AgentID}, nil
+	case "name":
+		return m.m.Name, nil
+	case "value":
+		return m.m.Value, nil
+	case "type":
+		return m.m.Type, nil
+	case "timestamp":
+		return m.m.Timestamp.Format(time.RFC3339Nano), nil
+	case "timestamp_ms":
+		return m.m.Timestamp.UnixMilli(), nil
+	case "labels":
+		if m.m.Labels == nil {
+			return map[string]string{}, nil
+		}
+		return m.m.Labels, nil
+	case "label":
+		if err := args.Check("name"); err != nil {
+			return nil, err
+		}
+		name, err := args.String("name", "")
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := m.m.Labels[name]; ok {
+			return v, nil
+		}
+		return nil, nil
+	}
+	return nil, ErrUnknownField
+}
+
+// point AggregatePoint对象
+type point struct {
+	p storage.AggregatePoint
+}
+
+func (p *point) TypeName() string { return "AggregatePoint" }
+
+func (p *point) Resolve(field string, args Args) (interface{}, error) {
+	switch field {
+	case "timestamp":
+		return p.p.Timestamp.Format(time.RFC3339Nano), nil
+	case "timestamp_ms":
+		return p.p.Timestamp.UnixMilli(), nil
+	case "value":
+		return p.p.Value, nil
+	case "count":
+		return p.p.Count, nil
+	}
+	return nil, ErrUnknownField
+}
@@ -0,0 +1,298 @@
+package grpcquery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/queries"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/serialization"
+	"github.com/konpure/Kon-Agent-export/pkg/stream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// 未指定limit时的默认值，与HTTP接口一致
+const (
+	defaultLatestLimit = 10
+	defaultLimit       = 100
+)
+
+// Server 与HTTP查询接口对应的gRPC查询服务，数据以protocol.StoredMetric返回
+type Server struct {
+	protocol.UnimplementedQueryServiceServer
+	storage storage.Storage
+	clock   clock.Clock
+	maxRows int
+	queries *queries.Tracker
+	acl     *acl.Policy
+	hub     *stream.Hub
+	server  *grpc.Server
+	// stopping 关闭时通知进行中的订阅结束
+	stopping chan struct{}
+}
+
+// NewServer 创建gRPC查询服务，maxRows限制单次查询返回的条数，
+// tracker不为nil时每次查询都会登记为可取消的查询，
+// policy不为nil时按authorization元数据中的令牌隐藏受限指标，
+// hub为nil时Subscribe返回Unavailable
+func NewServer(storage storage.Storage, clk clock.Clock, maxRows int, tracker *queries.Tracker, policy *acl.Policy, hub *stream.Hub) *Server {
+	s := &Server{
+		storage:  storage,
+		clock:    clk,
+		maxRows:  maxRows,
+		queries:  tracker,
+		acl:      policy,
+		hub:      hub,
+		stopping: make(chan struct{}),
+	}
+	s.server = grpc.NewServer()
+	protocol.RegisterQueryServiceServer(s.server, s)
+	return s
+}
+
+// Start 在addr上启动gRPC查询服务，阻塞直到服务停止
+func (s *Server) Start(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	log.Printf("gRPC query server starting on %s", addr)
+	return s.server.Serve(lis)
+}
+
+// Stop 结束进行中的订阅，等待其余请求结束，ctx到期后强制关闭
+func (s *Server) Stop(ctx context.Context) error {
+	close(s.stopping)
+
+	done := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
+
+// GetLatestMetrics 返回最新的limit条数据，按时间从旧到新
+func (s *Server) GetLatestMetrics(ctx context.Context, req *protocol.LatestMetricsRequest) (*protocol.QueryMetricsResponse, error) {
+	limit := s.limit(req.GetLimit(), defaultLatestLimit)
+	return s.query(ctx, req.GetNamespace(), fmt.Sprintf("GetLatestMetrics limit=%d", req.GetLimit()), listQuery{
+		limit:     limit,
+		ascending: true,
+		fetch: func(st storage.Storage) ([]processor.ProcessedMetric, error) {
+			return st.GetLatestMetrics(limit)
+		},
+	})
+}
+
+// GetMetricsByAgentID 返回Agent最新的limit条数据
+func (s *Server) GetMetricsByAgentID(ctx context.Context, req *protocol.AgentMetricsRequest) (*protocol.QueryMetricsResponse, error) {
+	if req.GetAgentId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	limit := s.limit(req.GetLimit(), defaultLimit)
+	return s.query(ctx, req.GetNamespace(), fmt.Sprintf("GetMetricsByAgentID agent_id=%s limit=%d", req.GetAgentId(), req.GetLimit()), listQuery{
+		filter: storage.Filter{AgentID: req.GetAgentId()},
+		limit:  limit,
+		fetch: func(st storage.Storage) ([]processor.ProcessedMetric, error) {
+			return st.GetMetricsByAgentID(req.GetAgentId(), limit)
+		},
+	})
+}
+
+// GetMetricsByTimeRange 返回时间范围内的数据
+func (s *Server) GetMetricsByTimeRange(ctx context.Context, req *protocol.TimeRangeRequest) (*protocol.QueryMetricsResponse, error) {
+	end := s.clock.Now()
+	if req.GetEndMs() > 0 {
+		end = time.UnixMilli(req.GetEndMs())
+	}
+	start := time.UnixMilli(req.GetStartMs())
+	if end.Before(start) {
+		return nil, status.Error(codes.InvalidArgument, "end is before start")
+	}
+	desc := fmt.Sprintf("GetMetricsByTimeRange start=%d end=%d limit=%d", req.GetStartMs(), req.GetEndMs(), req.GetLimit())
+	limit := s.limit(req.GetLimit(), defaultLimit)
+	return s.query(ctx, req.GetNamespace(), desc, listQuery{
+		filter: storage.Filter{Start: start, End: end},
+		limit:  limit,
+		fetch: func(st storage.Storage) ([]processor.ProcessedMetric, error) {
+			return st.GetMetricsByTimeRange(start, end, limit)
+		},
+	})
+}
+
+// Subscribe 推送接入的数据，last_id不为0时先重放序号大于last_id的数据，客户端断开或服务停止时结束
+func (s *Server) Subscribe(req *protocol.SubscribeRequest, out grpc.ServerStreamingServer[protocol.MetricEvent]) error {
+	if s.hub == nil {
+		return status.Error(codes.Unavailable, "live metric stream is not enabled")
+	}
+	ctx := out.Context()
+	grant, err := s.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := stream.Filter{AgentID: req.GetAgentId(), Name: req.GetName(), Type: req.GetType()}
+	var sub *stream.Subscription
+	var replay []stream.Event
+	if req.GetLastId() > 0 {
+		sub, replay, _, err = s.hub.Resume(filter, req.GetLastId())
+	} else {
+		sub, err = s.hub.Subscribe(filter)
+	}
+	if errors.Is(err, stream.ErrTooManySubscribers) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer s.hub.Unsubscribe(sub)
+
+	send := func(ev *stream.Event) error {
+		if !grant.Allowed(&ev.Metric) {
+			return nil
+		}
+		return out.Send(&protocol.MetricEvent{Id: ev.ID, Metric: serialization.ToStored(&ev.Metric)})
+	}
+	for i := range replay {
+		if err := send(&replay[i]); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.stopping:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case ev, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			if err := send(&ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// listQuery 一次列表查询，令牌可以查看全部数据时调用fetch，
+// 否则由存储层按filter和可见性条件过滤后取最新的limit条
+type listQuery struct {
+	filter storage.Filter
+	limit  int
+	// ascending 结果按时间从旧到新排列，否则从新到旧
+	ascending bool
+	fetch     func(storage.Storage) ([]processor.ProcessedMetric, error)
+}
+
+// run 执行查询，可见性条件在截断之前判断，避免limit条数据被过滤后只剩很少甚至为空
+func (q *listQuery) run(st storage.Storage, grant *acl.Grant) ([]processor.ProcessedMetric, error) {
+	sq, ok := st.(storage.SortedQuerier)
+	if grant.SeesAll() || !ok {
+		return q.fetch(st)
+	}
+	filter := q.filter
+	grant.Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp, Desc: true}, q.limit)
+	if err == nil && q.ascending {
+		slices.Reverse(metrics)
+	}
+	return metrics, err
+}
+
+// query 在请求的命名空间中执行查询，过滤令牌不可见的数据
+func (s *Server) query(ctx context.Context, namespace, desc string, q listQuery) (*protocol.QueryMetricsResponse, error) {
+	grant, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.namespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if s.queries != nil {
+		remote := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			remote = p.Addr.String()
+		}
+		var done func()
+		ctx, done = s.queries.Start(ctx, "grpc", desc, remote)
+		defer done()
+	}
+
+	metrics, err := q.run(st, grant)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "query failed: %v", err)
+	}
+	if err := context.Cause(ctx); err != nil {
+		return nil, status.Error(codes.Canceled, err.Error())
+	}
+	metrics = grant.Filter(metrics)
+
+	resp := &protocol.QueryMetricsResponse{Metrics: make([]*protocol.StoredMetric, len(metrics))}
+	for i := range metrics {
+		resp.Metrics[i] = serialization.ToStored(&metrics[i])
+	}
+	return resp, nil
+}
+
+// namespace 返回命名空间的存储，name为空时返回全部数据的存储
+func (s *Server) namespace(name string) (storage.Storage, error) {
+	if name == "" {
+		return s.storage, nil
+	}
+	ns, ok := s.storage.(storage.Namespacer)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "namespaces are not configured")
+	}
+	st, ok := ns.Namespace(name)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown namespace: "+name)
+	}
+	return st, nil
+}
+
+// limit 返回不超过maxRows的条数，未指定时使用def
+func (s *Server) limit(limit int32, def int) int {
+	if limit <= 0 {
+		return min(def, s.maxRows)
+	}
+	return min(int(limit), s.maxRows)
+}
+
+// authenticate 按authorization元数据中的Bearer令牌返回授权，未启用访问控制时返回nil
+func (s *Server) authenticate(ctx context.Context) (*acl.Grant, error) {
+	if s.acl == nil {
+		return nil, nil
+	}
+
+	var token string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		token = acl.TokenFromHeader(values[0])
+	}
+	grant, err := s.acl.Authenticate(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return grant, nil
+}
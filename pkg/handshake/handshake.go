@@ -0,0 +1,269 @@
+package handshake
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/quic-go/quic-go"
+)
+
+// 握手失败原因分类
+const (
+	ReasonTimeout     = "timeout"
+	ReasonALPN        = "alpn"
+	ReasonCertificate = "certificate"
+	ReasonVersion     = "version"
+	ReasonTLS         = "tls"
+	ReasonClosed      = "closed"
+	ReasonOther       = "other"
+)
+
+// durationBuckets 握手耗时直方图的上界(毫秒)
+var durationBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// Failure 单次握手失败记录
+type Failure struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	Reason     string        `json:"reason"`
+	Error      string        `json:"error"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Bucket 直方图桶，LE为上界(毫秒)，0表示+Inf
+type Bucket struct {
+	LE    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+// Stats 握手统计快照
+type Stats struct {
+	Attempts         uint64            `json:"attempts"`
+	Succeeded        uint64            `json:"succeeded"`
+	Failed           uint64            `json:"failed"`
+	FailuresByReason map[string]uint64 `json:"failures_by_reason"`
+	QUICVersions     map[string]uint64 `json:"quic_versions"`
+	TLSVersions      map[string]uint64 `json:"tls_versions"`
+	CipherSuites     map[string]uint64 `json:"cipher_suites"`
+	DurationBuckets  []Bucket          `json:"duration_buckets_ms"`
+	DurationSumMs    float64           `json:"duration_sum_ms"`
+}
+
+// Recorder 记录QUIC/TLS握手耗时、协商结果和失败原因
+type Recorder struct {
+	mu         sync.Mutex
+	clock      clock.Clock
+	stats      Stats
+	buckets    []uint64
+	failures   []Failure
+	maxRecent  int
+	nextRecent int
+}
+
+// attempt 一次进行中的握手
+type attempt struct {
+	start    time.Time
+	remote   string
+	complete chan struct{}
+}
+
+type attemptKey struct{}
+
+// NewRecorder 创建握手记录器，最多保留maxRecent条最近的失败记录
+func NewRecorder(maxRecent int, clk clock.Clock) *Recorder {
+	return &Recorder{
+		clock: clk,
+		stats: Stats{
+			FailuresByReason: make(map[string]uint64),
+			QUICVersions:     make(map[string]uint64),
+			TLSVersions:      make(map[string]uint64),
+			CipherSuites:     make(map[string]uint64),
+		},
+		buckets:   make([]uint64, len(durationBuckets)+1),
+		failures:  make([]Failure, 0, maxRecent),
+		maxRecent: maxRecent,
+	}
+}
+
+// ConnContext 用作quic.Transport.ConnContext，在收到客户端Initial包时开始计时
+func (r *Recorder) ConnContext(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+	a := &attempt{
+		start:    r.clock.Now(),
+		remote:   info.RemoteAddr.String(),
+		complete: make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	r.stats.Attempts++
+	r.mu.Unlock()
+
+	// 握手失败时quic-go会以失败原因取消该context
+	ctx = context.WithValue(ctx, attemptKey{}, a)
+	go r.watch(ctx, a)
+
+	return ctx, nil
+}
+
+// Completed 在连接被Accept后调用，记录握手耗时和协商结果
+func (r *Recorder) Completed(conn *quic.Conn) {
+	a, ok := conn.Context().Value(attemptKey{}).(*attempt)
+	if !ok {
+		return
+	}
+	close(a.complete)
+
+	duration := r.clock.Now().Sub(a.start)
+	state := conn.ConnectionState()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Succeeded++
+	r.stats.QUICVersions[state.Version.String()]++
+	r.stats.TLSVersions[tls.VersionName(state.TLS.Version)]++
+	r.stats.CipherSuites[tls.CipherSuiteName(state.TLS.CipherSuite)]++
+	r.observe(duration)
+}
+
+// Stats 返回当前统计快照
+func (r *Recorder) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.FailuresByReason = copyCounts(r.stats.FailuresByReason)
+	stats.QUICVersions = copyCounts(r.stats.QUICVersions)
+	stats.TLSVersions = copyCounts(r.stats.TLSVersions)
+	stats.CipherSuites = copyCounts(r.stats.CipherSuites)
+
+	stats.DurationBuckets = make([]Bucket, 0, len(r.buckets))
+	var cumulative uint64
+	for i, count := range r.buckets {
+		cumulative += count
+		le := 0.0
+		if i < len(durationBuckets) {
+			le = durationBuckets[i]
+		}
+		stats.DurationBuckets = append(stats.DurationBuckets, Bucket{LE: le, Count: cumulative})
+	}
+
+	return stats
+}
+
+// RecentFailures 返回最近的握手失败记录，最新的在前
+func (r *Recorder) RecentFailures() []Failure {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]Failure, 0, len(r.failures))
+	for i := 0; i < len(r.failures); i++ {
+		idx := (r.nextRecent - 1 - i + len(r.failures)) % len(r.failures)
+		result = append(result, r.failures[idx])
+	}
+	return result
+}
+
+// watch 等待握手完成或失败
+func (r *Recorder) watch(ctx context.Context, a *attempt) {
+	select {
+	case <-a.complete:
+	case <-ctx.Done():
+		r.recordFailure(a, context.Cause(ctx))
+	}
+}
+
+// recordFailure 记录一次握手失败
+func (r *Recorder) recordFailure(a *attempt, err error) {
+	now := r.clock.Now()
+	failure := Failure{
+		Time:       now,
+		RemoteAddr: a.remote,
+		Reason:     Classify(err),
+		Duration:   now.Sub(a.start),
+	}
+	if err != nil {
+		failure.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Failed++
+	r.stats.FailuresByReason[failure.Reason]++
+
+	if r.maxRecent <= 0 {
+		return
+	}
+	if len(r.failures) < r.maxRecent {
+		r.failures = append(r.failures, failure)
+	} else {
+		r.failures[r.nextRecent] = failure
+	}
+	r.nextRecent = (r.nextRecent + 1) % r.maxRecent
+}
+
+// observe 记录握手耗时，调用方需持有锁
+func (r *Recorder) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	r.stats.DurationSumMs += ms
+
+	for i, le := range durationBuckets {
+		if ms <= le {
+			r.buckets[i]++
+			return
+		}
+	}
+	r.buckets[len(durationBuckets)]++
+}
+
+// Classify 将握手错误归类为失败原因
+func Classify(err error) string {
+	var (
+		handshakeTimeout *quic.HandshakeTimeoutError
+		idleTimeout      *quic.IdleTimeoutError
+		transportErr     *quic.TransportError
+		applicationErr   *quic.ApplicationError
+	)
+
+	switch {
+	case err == nil:
+		return ReasonOther
+	case errors.As(err, &handshakeTimeout), errors.As(err, &idleTimeout):
+		return ReasonTimeout
+	case errors.As(err, &transportErr):
+		if !transportErr.ErrorCode.IsCryptoError() {
+			return ReasonOther
+		}
+		return classifyAlert(uint8(transportErr.ErrorCode - quic.TransportErrorCode(0x100)))
+	case errors.As(err, &applicationErr):
+		return ReasonClosed
+	default:
+		return ReasonOther
+	}
+}
+
+// classifyAlert 按TLS alert码分类
+func classifyAlert(alert uint8) string {
+	switch alert {
+	case 120: // no_application_protocol
+		return ReasonALPN
+	case 42, 43, 44, 45, 46, 48, 116: // bad/unsupported/revoked/expired/unknown certificate, unknown_ca, certificate_required
+		return ReasonCertificate
+	case 70: // protocol_version
+		return ReasonVersion
+	default:
+		return ReasonTLS
+	}
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	result := make(map[string]uint64, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
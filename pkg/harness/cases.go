@@ -0,0 +1,188 @@
+package harness
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Case 声明式的端到端用例：在新启动的服务器上依次发送Send中的数据帧，然后逐条检查Expect
+//
+//	cases:
+//	  - name: cpu ingest
+//	    send:
+//	      - agent_id: agent-1
+//	        metrics:
+//	          - {name: cpu0, value: 12.5, type: CPU_USAGE, labels: {host: a}}
+//	      - file: fixtures/old_agent.hex
+//	    expect:
+//	      - path: /api/v1/metrics/agent-1
+//	        jq: "[.[].name]"
+//	        equals: [cpu0]
+type Case struct {
+	Name string `yaml:"name"`
+	// Config 在默认配置上覆盖的配置，格式与configs/config.yaml相同
+	Config yaml.Node     `yaml:"config"`
+	Send   []Batch       `yaml:"send"`
+	Expect []Expectation `yaml:"expect"`
+
+	// dir 用例文件所在的目录，Batch.File相对于该目录
+	dir string
+}
+
+// Batch 一个数据帧，由AgentID和Metrics组成BatchMetricsRequest，或从File读取已编码的数据帧
+type Batch struct {
+	AgentID string   `yaml:"agent_id"`
+	Metrics []Metric `yaml:"metrics"`
+	// File protobuf编码的数据帧，.hex文件为十六进制文本(#开头的行是注释)，其他文件按原始字节读取
+	File string `yaml:"file"`
+}
+
+// Metric 数据帧中的一个指标
+type Metric struct {
+	Name  string  `yaml:"name"`
+	Value float64 `yaml:"value"`
+	// Type 指标类型的枚举名，如CPU_USAGE，默认为CPU_USAGE
+	Type   string            `yaml:"type"`
+	Labels map[string]string `yaml:"labels"`
+	// Age 指标时间戳早于发送时间的时长，默认使用发送时间
+	Age time.Duration `yaml:"age"`
+}
+
+// caseFile 用例文件的格式
+type caseFile struct {
+	Cases []Case `yaml:"cases"`
+}
+
+// LoadCases 读取YAML用例文件
+func LoadCases(path string) ([]Case, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file caseFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for i := range file.Cases {
+		c := &file.Cases[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("case-%d", i+1)
+		}
+		c.dir = filepath.Dir(path)
+	}
+	return file.Cases, nil
+}
+
+// RunFile 读取用例文件，每个用例作为子测试在新启动的服务器上运行，opts应用于每个服务器
+func RunFile(t *testing.T, path string, opts ...Option) {
+	t.Helper()
+
+	cases, err := LoadCases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) == 0 {
+		t.Fatalf("no cases in %s", path)
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			c.Run(t, opts...)
+		})
+	}
+}
+
+// Run 在新启动的服务器上运行用例
+func (c *Case) Run(tb testing.TB, opts ...Option) {
+	tb.Helper()
+
+	if !c.Config.IsZero() {
+		opts = append(opts, WithConfig(func(cfg *config.Config) {
+			if err := c.Config.Decode(cfg); err != nil {
+				tb.Fatalf("harness: invalid config: %v", err)
+			}
+		}))
+	}
+	s := Start(tb, opts...)
+
+	now := time.Now()
+	frames := make([][]byte, len(c.Send))
+	for i, batch := range c.Send {
+		data, err := batch.frame(c.dir, now)
+		if err != nil {
+			tb.Fatalf("harness: send[%d]: %v", i, err)
+		}
+		frames[i] = data
+	}
+	if len(frames) > 0 {
+		s.SendFrames(frames...)
+	}
+
+	for _, e := range c.Expect {
+		s.Expect(e)
+	}
+}
+
+// frame 返回编码后的数据帧
+func (b Batch) frame(dir string, now time.Time) ([]byte, error) {
+	if b.File != "" {
+		if b.AgentID != "" || len(b.Metrics) > 0 {
+			return nil, fmt.Errorf("file cannot be combined with agent_id or metrics")
+		}
+		return readFrame(filepath.Join(dir, b.File))
+	}
+
+	req := &protocol.BatchMetricsRequest{AgentId: b.AgentID, Timestamp: now.UnixMilli()}
+	for _, m := range b.Metrics {
+		metricType := protocol.MetricType_CPU_USAGE
+		if m.Type != "" {
+			v, ok := protocol.MetricType_value[m.Type]
+			if !ok {
+				return nil, fmt.Errorf("unknown metric type %q", m.Type)
+			}
+			metricType = protocol.MetricType(v)
+		}
+		req.Metrics = append(req.Metrics, &protocol.Metric{
+			Timestamp: now.Add(-m.Age).UnixMilli(),
+			Name:      m.Name,
+			Value:     m.Value,
+			Labels:    m.Labels,
+			Type:      metricType,
+		})
+	}
+	return proto.Marshal(req)
+}
+
+// readFrame 读取数据帧文件，.hex文件的格式与pkg/protocol/compat/testdata中的样本相同
+func readFrame(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) != ".hex" {
+		return raw, nil
+	}
+
+	var hexData strings.Builder
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		hexData.WriteString(line)
+	}
+	data, err := hex.DecodeString(hexData.String())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, nil
+}
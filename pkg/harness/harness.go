@@ -0,0 +1,440 @@
+// Package harness 在测试进程内启动完整的服务器(随机端口、内存存储)，通过真实的QUIC连接发送protobuf数据帧，
+// 再通过HTTP API检查查询结果，用于对自定义处理阶段和导出做端到端测试
+//
+//	func TestMyStage(t *testing.T) {
+//		s := harness.Start(t, harness.WithServerOptions(server.WithStages(myStage{})))
+//		s.Send(&protocol.BatchMetricsRequest{AgentId: "agent-1", Metrics: metrics})
+//		s.Expect(harness.Expectation{Path: "/api/v1/metrics/agent-1", JQ: "length", Equals: 3})
+//	}
+//
+// 也可以用YAML文件声明用例，见RunFile。
+package harness
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/itchyny/gojq"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/server"
+	"github.com/quic-go/quic-go"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultTimeout Expect等待响应满足期望的默认时间，数据写入存储是异步的
+const DefaultTimeout = 5 * time.Second
+
+// startTimeout 等待监听就绪的时间
+const startTimeout = 10 * time.Second
+
+// running QUIC接入的状态是包级变量，同一进程中同时只运行一个测试服务器，并行的测试依次启动
+var running sync.Mutex
+
+// Option 自定义测试服务器
+type Option func(*options)
+
+type options struct {
+	configure     []func(cfg *config.Config)
+	serverOptions []server.Option
+	compression   string
+}
+
+// WithConfig 启动前修改配置，在分配端口和存储目录之后调用，可以覆盖它们
+func WithConfig(fn func(cfg *config.Config)) Option {
+	return func(o *options) {
+		o.configure = append(o.configure, fn)
+	}
+}
+
+// WithServerOptions 组装服务器时使用的选项，如server.WithStages和server.WithSink
+func WithServerOptions(opts ...server.Option) Option {
+	return func(o *options) {
+		o.serverOptions = append(o.serverOptions, opts...)
+	}
+}
+
+// WithFrameCompression 连接时协商按name压缩数据帧，Send和SendFrames发送的帧先压缩再加长度前缀
+func WithFrameCompression(name string) Option {
+	return func(o *options) {
+		o.compression = name
+	}
+}
+
+// Server 运行中的测试服务器，测试结束时自动关闭
+type Server struct {
+	tb       testing.TB
+	srv      *server.Server
+	cfg      *config.Config
+	quicAddr string
+	baseURL  string
+	client   *http.Client
+	conn     *quic.Conn
+	// codec 数据帧的压缩算法，不压缩时为nil
+	codec codec.Codec
+}
+
+// Start 使用默认配置、随机端口和临时目录中的内存存储启动服务器，等待QUIC和HTTP监听就绪后返回
+func Start(tb testing.TB, opts ...Option) *Server {
+	tb.Helper()
+
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	running.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			running.Unlock()
+		}
+	}()
+
+	cfg := config.Default()
+	cfg.Server.QUICPort = freePort(tb, "udp")
+	cfg.Server.HTTPPort = freePort(tb, "tcp")
+	cfg.Server.ShutdownTimeout = DefaultTimeout
+	cfg.Storage.Type = "memory"
+	cfg.Storage.FilePath = tb.TempDir()
+	for _, fn := range o.configure {
+		fn(cfg)
+	}
+
+	// 不输出gin的调试信息
+	gin.SetMode(gin.TestMode)
+	srv, err := server.New(cfg, o.serverOptions...)
+	if err != nil {
+		tb.Fatalf("harness: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		tb.Fatalf("harness: %v", err)
+	}
+
+	s := &Server{
+		tb:       tb,
+		srv:      srv,
+		cfg:      cfg,
+		quicAddr: fmt.Sprintf("127.0.0.1:%d", cfg.Server.QUICPort),
+		baseURL:  fmt.Sprintf("http://127.0.0.1:%d", cfg.Server.HTTPPort),
+		client:   &http.Client{Timeout: DefaultTimeout},
+	}
+	if cfg.Server.TLS.Enabled {
+		s.baseURL = fmt.Sprintf("https://127.0.0.1:%d", cfg.Server.HTTPPort)
+		s.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	if o.compression != "" {
+		if s.codec, err = codec.Get(o.compression); err != nil {
+			tb.Fatalf("harness: %v", err)
+		}
+	}
+	locked = false
+	tb.Cleanup(s.stop)
+
+	if err := s.waitReady(); err != nil {
+		tb.Fatalf("harness: %v", err)
+	}
+	return s
+}
+
+// waitReady 等待HTTP API响应并建立QUIC连接
+func (s *Server) waitReady() error {
+	deadline := time.Now().Add(startTimeout)
+	for {
+		select {
+		case err := <-s.srv.Err():
+			return err
+		default:
+		}
+
+		if s.conn == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			conn, err := quic.DialAddr(ctx, s.quicAddr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{s.alpn()}}, nil)
+			cancel()
+			if err == nil {
+				s.conn = conn
+			}
+		}
+		if s.conn != nil {
+			if resp, err := s.client.Get(s.baseURL + "/api/v1/stats"); err == nil {
+				resp.Body.Close()
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server not ready on quic %s and http %s after %s", s.quicAddr, s.baseURL, startTimeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// alpn 返回连接使用的ALPN协议
+func (s *Server) alpn() string {
+	if s.codec == nil {
+		return "kon-agent"
+	}
+	return "kon-agent+" + s.codec.Name()
+}
+
+// stop 断开QUIC连接后关闭服务器
+func (s *Server) stop() {
+	defer running.Unlock()
+
+	if s.conn != nil {
+		s.conn.CloseWithError(0, "test finished")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	s.srv.Shutdown(ctx)
+}
+
+// Config 返回服务器使用的配置
+func (s *Server) Config() *config.Config {
+	return s.cfg
+}
+
+// URL 返回HTTP API的地址，如http://127.0.0.1:41234
+func (s *Server) URL() string {
+	return s.baseURL
+}
+
+// QUICAddr 返回QUIC接入地址，用于测试自己的Agent客户端
+func (s *Server) QUICAddr() string {
+	return s.quicAddr
+}
+
+// Server 返回被测试的服务器，可以直接访问其存储
+func (s *Server) Server() *server.Server {
+	return s.srv
+}
+
+// Send 把每个请求编码为一个数据帧，在新的单向流上依次发送
+func (s *Server) Send(batches ...*protocol.BatchMetricsRequest) {
+	s.tb.Helper()
+
+	frames := make([][]byte, len(batches))
+	for i, batch := range batches {
+		data, err := proto.Marshal(batch)
+		if err != nil {
+			s.tb.Fatalf("harness: failed to marshal batch: %v", err)
+		}
+		frames[i] = data
+	}
+	s.SendFrames(frames...)
+}
+
+// SendFrames 在新的单向流上依次发送已编码的数据帧，用于发送旧版本Agent的线格式样本或畸形数据
+func (s *Server) SendFrames(frames ...[]byte) {
+	s.tb.Helper()
+
+	stream, err := s.conn.OpenUniStream()
+	if err != nil {
+		s.tb.Fatalf("harness: failed to open stream: %v", err)
+	}
+	for _, data := range frames {
+		if s.codec != nil {
+			if data, err = codec.Compress(s.codec, data); err != nil {
+				s.tb.Fatalf("harness: failed to compress frame: %v", err)
+			}
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+		if _, err := stream.Write(append(length[:], data...)); err != nil {
+			s.tb.Fatalf("harness: failed to send frame: %v", err)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		s.tb.Fatalf("harness: failed to close stream: %v", err)
+	}
+}
+
+// Do 发送HTTP请求，返回状态码和响应体
+func (s *Server) Do(method, path string, body io.Reader, header http.Header) (int, []byte) {
+	s.tb.Helper()
+
+	req, err := http.NewRequest(method, s.baseURL+path, body)
+	if err != nil {
+		s.tb.Fatalf("harness: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.tb.Fatalf("harness: %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.tb.Fatalf("harness: %s %s: %v", method, path, err)
+	}
+	return resp.StatusCode, data
+}
+
+// Get 发送GET请求，返回状态码和响应体
+func (s *Server) Get(path string) (int, []byte) {
+	s.tb.Helper()
+	return s.Do(http.MethodGet, path, nil, nil)
+}
+
+// Expectation 对一个API请求结果的期望
+type Expectation struct {
+	// Method 请求方法，默认为GET
+	Method string `yaml:"method"`
+	Path   string `yaml:"path"`
+	// Body 请求体
+	Body    string            `yaml:"body"`
+	Headers map[string]string `yaml:"headers"`
+	// Status 期望的状态码，默认为200
+	Status int `yaml:"status"`
+	// JQ 对JSON响应体求值的jq表达式，产生多个结果时按数组比较，为空时比较整个响应体
+	JQ string `yaml:"jq"`
+	// Equals 期望的值，与结果按JSON比较，为空时只检查状态码
+	Equals any `yaml:"equals"`
+	// Timeout 等待响应满足期望的时间，默认为DefaultTimeout
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Expect 反复发送请求直到响应满足期望，超时后报告最后一次的响应
+func (s *Server) Expect(e Expectation) {
+	s.tb.Helper()
+
+	method := e.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	status := e.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	header := make(http.Header)
+	for key, value := range e.Headers {
+		header.Set(key, value)
+	}
+
+	var code *gojq.Code
+	if e.JQ != "" {
+		query, err := gojq.Parse(e.JQ)
+		if err == nil {
+			code, err = gojq.Compile(query)
+		}
+		if err != nil {
+			s.tb.Fatalf("harness: invalid jq %q: %v", e.JQ, err)
+		}
+	}
+	want, err := normalize(e.Equals)
+	if err != nil {
+		s.tb.Fatalf("harness: invalid expected value: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		got, body := s.Do(method, e.Path, strings.NewReader(e.Body), header)
+		mismatch := ""
+		if got != status {
+			mismatch = fmt.Sprintf("status %d, want %d: %s", got, status, body)
+		} else if e.Equals != nil {
+			mismatch = compare(code, body, want)
+		}
+		if mismatch == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.tb.Errorf("%s %s: %s (after %s)", method, e.Path, mismatch, timeout)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// compare 对响应体求值后与期望的值比较，不一致时返回说明
+func compare(code *gojq.Code, body []byte, want any) string {
+	var input any
+	if err := json.Unmarshal(body, &input); err != nil {
+		return fmt.Sprintf("response is not json: %v: %s", err, body)
+	}
+
+	result := input
+	if code != nil {
+		var results []any
+		iter := code.Run(input)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				return fmt.Sprintf("jq: %v: %s", err, body)
+			}
+			results = append(results, v)
+		}
+		switch len(results) {
+		case 0:
+			result = nil
+		case 1:
+			result = results[0]
+		default:
+			result = results
+		}
+	}
+
+	got, err := normalize(result)
+	if err != nil {
+		return err.Error()
+	}
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		return fmt.Sprintf("got %s, want %s", gotJSON, wantJSON)
+	}
+	return ""
+}
+
+// normalize 经过JSON往返，使YAML和jq产生的数字、映射类型一致
+func normalize(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+// freePort 返回当前空闲的端口，监听后立即关闭
+func freePort(tb testing.TB, network string) int {
+	tb.Helper()
+
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatalf("harness: %v", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("harness: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,255 @@
+package harness
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/server"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestCases 运行testdata/cases.yaml中的声明式用例
+func TestCases(t *testing.T) {
+	RunFile(t, "testdata/cases.yaml")
+}
+
+// regionStage 给每个指标加上region标签，丢弃名为drop的指标
+type regionStage struct{}
+
+func (regionStage) Name() string { return "region" }
+
+func (regionStage) Process(m *processor.ProcessedMetric) (bool, error) {
+	if m.Name == "drop" {
+		return false, nil
+	}
+	if m.Labels == nil {
+		m.Labels = make(map[string]string)
+	}
+	m.Labels["region"] = "eu"
+	return true, nil
+}
+
+// TestCustomStageAndSink 自定义处理阶段的结果写入存储，自定义导出按转换规则收到数据
+func TestCustomStageAndSink(t *testing.T) {
+	var mu sync.Mutex
+	var exported []processor.ProcessedMetric
+	sink := func(metrics []processor.ProcessedMetric) {
+		mu.Lock()
+		defer mu.Unlock()
+		exported = append(exported, metrics...)
+	}
+	rules := []config.ExportRule{{Metric: "mem*", Action: "drop"}}
+
+	s := Start(t, WithServerOptions(
+		server.WithStages(regionStage{}),
+		server.WithSink("test", rules, sink),
+	))
+	now := time.Now().UnixMilli()
+	s.Send(&protocol.BatchMetricsRequest{
+		AgentId: "agent-1",
+		Metrics: []*protocol.Metric{
+			{Timestamp: now, Name: "cpu0", Value: 1},
+			{Timestamp: now, Name: "mem", Value: 2, Type: protocol.MetricType_MEMORY_USAGE},
+			{Timestamp: now, Name: "drop", Value: 3},
+		},
+	})
+
+	s.Expect(Expectation{
+		Path:   "/api/v1/metrics/agent-1",
+		JQ:     "[.[] | {name, region: .labels.region}] | sort_by(.name)",
+		Equals: []any{map[string]any{"name": "cpu0", "region": "eu"}, map[string]any{"name": "mem", "region": "eu"}},
+	})
+
+	// 导出在写入存储之后调用
+	deadline := time.Now().Add(DefaultTimeout)
+	for {
+		mu.Lock()
+		got := append([]processor.ProcessedMetric(nil), exported...)
+		mu.Unlock()
+		if len(got) == 1 && got[0].Name == "cpu0" {
+			return
+		}
+		if len(got) > 1 || time.Now().After(deadline) {
+			t.Fatalf("exported %+v, want only cpu0", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRestart 同一进程中可以依次启动多个服务器，上一个服务器写入的数据和接入钩子不会保留
+func TestRestart(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		t.Run("run", func(t *testing.T) {
+			s := Start(t)
+			s.Send(&protocol.BatchMetricsRequest{AgentId: "agent-1", Metrics: []*protocol.Metric{{Timestamp: time.Now().UnixMilli(), Name: "cpu0", Value: 1}}})
+			s.Expect(Expectation{Path: "/api/v1/stats", JQ: ".total", Equals: 1})
+		})
+	}
+}
+
+// TestSelfMetrics 服务器自身的指标统计接入的数据和API请求
+func TestSelfMetrics(t *testing.T) {
+	s := Start(t, WithConfig(func(cfg *config.Config) {
+		cfg.SelfMetrics.Enabled = true
+	}))
+	now := time.Now().UnixMilli()
+	s.Send(&protocol.BatchMetricsRequest{AgentId: "agent-1", Metrics: []*protocol.Metric{{Timestamp: now, Name: "cpu0", Value: 1}, {Timestamp: now, Name: "cpu1", Value: 2}}})
+	s.Expect(Expectation{Path: "/api/v1/stats", JQ: ".total", Equals: 2})
+
+	want := []string{
+		"kon_internal_quic_frames_received_total 1\n",
+		"kon_internal_quic_batches_total 1\n",
+		"kon_internal_ingested_metrics_total 2\n",
+		"kon_internal_storage_metrics 2\n",
+		`kon_internal_http_request_duration_seconds_count{method="GET",route="/api/v1/stats",code="200"}`,
+	}
+	code, body := s.Get(s.Config().SelfMetrics.Path)
+	if code != 200 {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	for _, line := range want {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("self metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+// TestDedupRetryAfterRejection 超出配额被拒绝的帧没有写入存储，下一个窗口内重发的相同帧不被当作重复丢弃
+func TestDedupRetryAfterRejection(t *testing.T) {
+	window := 500 * time.Millisecond
+	s := Start(t, WithConfig(func(cfg *config.Config) {
+		cfg.Dedup.Enabled = true
+		cfg.Quotas.Enabled = true
+		cfg.Quotas.Window = window
+		cfg.Quotas.Rules = []config.QuotaRule{{Name: "agent", Scope: "agent", MaxMetrics: 2, Mode: "hard"}}
+	}))
+
+	now := time.Now().UnixMilli()
+	first, err := proto.Marshal(&protocol.BatchMetricsRequest{AgentId: "agent-1", Metrics: []*protocol.Metric{{Timestamp: now, Name: "cpu0", Value: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err := proto.Marshal(&protocol.BatchMetricsRequest{AgentId: "agent-1", Metrics: []*protocol.Metric{{Timestamp: now, Name: "cpu1", Value: 2}, {Timestamp: now, Name: "cpu2", Value: 3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第二帧使窗口内的指标数超出上限而被拒绝
+	s.SendFrames(first, retried)
+	s.Expect(Expectation{Path: "/api/v1/stats", JQ: ".total", Equals: 1})
+
+	time.Sleep(window)
+	s.SendFrames(retried)
+	s.Expect(Expectation{Path: "/api/v1/stats", JQ: ".total", Equals: 3})
+}
+
+// TestCompression 按配置的压缩算法协商QUIC数据帧压缩、写快照和块文件，重启后按文件头解压
+func TestCompression(t *testing.T) {
+	for _, typ := range []string{"memory", "block"} {
+		t.Run(typ, func(t *testing.T) {
+			dir := t.TempDir()
+			configure := WithConfig(func(cfg *config.Config) {
+				cfg.Compression = "zstd"
+				cfg.Storage.Type = typ
+				cfg.Storage.FilePath = dir
+				cfg.Storage.Snapshot.Enabled = true
+				cfg.Storage.Snapshot.Compression = "zstd"
+				cfg.Storage.Block.Compression = "zstd"
+			})
+
+			t.Run("write", func(t *testing.T) {
+				s := Start(t, configure, WithFrameCompression("zstd"))
+				if proto := s.conn.ConnectionState().TLS.NegotiatedProtocol; proto != "kon-agent+zstd" {
+					t.Fatalf("negotiated %q", proto)
+				}
+				now := time.Now().UnixMilli()
+				s.Send(&protocol.BatchMetricsRequest{AgentId: "agent-1", Metrics: []*protocol.Metric{{Timestamp: now, Name: "cpu0", Value: 1}, {Timestamp: now, Name: "cpu1", Value: 2}}})
+				s.Expect(Expectation{Path: "/api/v1/stats", JQ: ".total", Equals: 2})
+			})
+
+			var found bool
+			filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() && (d.Name() == "metrics.snapshot" || d.Name() == "data") {
+					data, _ := os.ReadFile(path)
+					found = found || bytes.Contains(data, []byte(`"codec":"zstd"`))
+				}
+				return nil
+			})
+			if !found {
+				t.Fatalf("no zstd compressed %s file in %s", typ, dir)
+			}
+
+			t.Run("read", func(t *testing.T) {
+				s := Start(t, configure)
+				s.Expect(Expectation{Path: "/api/v1/metrics/agent-1", JQ: "[.[].name] | sort", Equals: []any{"cpu0", "cpu1"}})
+			})
+		})
+	}
+}
+
+// TestImportHistory 导入的历史数据写在较新的数据之后也按时间过期，并不受lateness限制地补入降采样
+func TestImportHistory(t *testing.T) {
+	s := Start(t, WithConfig(func(cfg *config.Config) {
+		cfg.Storage.ExpireTime = time.Hour
+		cfg.Storage.Rollups = []config.RollupConfig{{Resolution: time.Minute, Retention: 24 * time.Hour, Lateness: 10 * time.Minute}}
+	}))
+	now := time.Now()
+	s.Send(&protocol.BatchMetricsRequest{AgentId: "agent-1", Metrics: []*protocol.Metric{{Timestamp: now.UnixMilli(), Name: "cpu0", Value: 1}}})
+	s.Expect(Expectation{Path: "/api/v1/stats", JQ: ".total", Equals: 1})
+
+	rows := fmt.Sprintf(`{"agent_id":"agent-2","timestamp":%d,"name":"cpu0","value":2}`+"\n"+
+		`{"agent_id":"agent-3","timestamp":%d,"name":"cpu0","value":3}`+"\n",
+		now.Add(-30*time.Minute).UnixMilli(), now.Add(-2*time.Hour).UnixMilli())
+	s.Expect(Expectation{Method: "POST", Path: "/api/v1/admin/import?format=jsonl", Body: rows, JQ: ".imported", Equals: 2})
+	s.Expect(Expectation{Path: "/api/v1/metrics/range?resolution=1m", JQ: "[.[].agent_id] | sort", Equals: []any{"agent-1", "agent-2", "agent-3"}})
+
+	s.Expect(Expectation{Method: "POST", Path: "/api/v1/admin/storage/cleanup", JQ: ".deleted", Equals: 1})
+	s.Expect(Expectation{Path: "/api/v1/metrics", JQ: "[.[].agent_id] | sort", Equals: []any{"agent-1", "agent-2"}})
+}
+
+// TestPacks 规则包中的relabel规则安装后立即生效，保存的查询需要有效的令牌
+func TestPacks(t *testing.T) {
+	s := Start(t, WithConfig(func(cfg *config.Config) {
+		cfg.Packs.Enabled = true
+		cfg.Packs.Dir = t.TempDir()
+		cfg.Relabel.Enabled = true
+		cfg.ACL.Enabled = true
+		cfg.ACL.Tokens = []config.ACLToken{{Token: "admin", Scopes: []string{"admin"}}, {Token: "team-a", Agents: []string{"team-a-*"}}}
+	}))
+	pack := `schema: kon-pack/v1
+name: hosts
+version: 1.0.0
+relabel:
+  - source_labels: [hostname]
+    target_label: host
+  - regex: hostname
+    action: labeldrop
+  - source_labels: [__name__]
+    regex: "debug_.*"
+    action: drop
+queries:
+  - name: latest
+    path: /api/v1/metrics/latest
+`
+	s.Expect(Expectation{Method: "POST", Path: "/api/v1/admin/packs", Body: pack, Headers: map[string]string{"Authorization": "Bearer admin"}, JQ: ".version", Equals: "1.0.0"})
+
+	now := time.Now().UnixMilli()
+	s.Send(&protocol.BatchMetricsRequest{AgentId: "team-a-1", Metrics: []*protocol.Metric{
+		{Timestamp: now, Name: "cpu0", Value: 1, Labels: map[string]string{"hostname": "a"}},
+		{Timestamp: now, Name: "debug_loop", Value: 2},
+	}})
+	s.Expect(Expectation{Path: "/api/v1/metrics/team-a-1", JQ: "[.[] | {name, labels}]", Equals: []any{map[string]any{"name": "cpu0", "labels": map[string]any{"host": "a"}}}})
+
+	s.Expect(Expectation{Path: "/api/v1/queries/saved", Headers: map[string]string{"Authorization": "Bearer bogus"}, Status: 401})
+	s.Expect(Expectation{Path: "/api/v1/queries/saved", Headers: map[string]string{"Authorization": "Bearer team-a"}, JQ: "[.[].name]", Equals: []any{"latest"}})
+}
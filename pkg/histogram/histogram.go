@@ -0,0 +1,487 @@
+package histogram
+
+import (
+	"errors"
+	"math"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MaxBuckets 合并后每一侧最多保留的桶数，超出时降低精度(scale)，与OpenTelemetry SDK的默认值一致
+const MaxBuckets = 160
+
+// ErrInvalidHistogram 数据不是合法的指数直方图
+var ErrInvalidHistogram = errors.New("invalid exponential histogram")
+
+// OTLP ExponentialHistogramDataPoint的字段编号
+const (
+	fieldCount         = 4
+	fieldSum           = 5
+	fieldScale         = 6
+	fieldZeroCount     = 7
+	fieldPositive      = 8
+	fieldNegative      = 9
+	fieldMin           = 12
+	fieldMax           = 13
+	fieldZeroThreshold = 14
+
+	fieldBucketOffset = 1
+	fieldBucketCounts = 2
+)
+
+// Buckets 一侧的桶，第i个计数对应下标Offset+i的桶
+//
+// scale下下标为index的桶覆盖(base^index, base^(index+1)]，base = 2^(2^-scale)。
+type Buckets struct {
+	Offset int32    `json:"offset"`
+	Counts []uint64 `json:"bucket_counts"`
+}
+
+// Exponential OTLP风格的指数直方图
+//
+// 指标的Payload保存OTLP ExponentialHistogramDataPoint的protobuf编码，
+// 导出时无需转换即可原样发送。属性和时间戳由Metric本身携带，
+// Unmarshal只读取合并和估算分位数需要的字段，exemplar等其他字段被跳过。
+type Exponential struct {
+	Count         uint64   `json:"count"`
+	Sum           *float64 `json:"sum,omitempty"`
+	Scale         int32    `json:"scale"`
+	ZeroCount     uint64   `json:"zero_count"`
+	ZeroThreshold float64  `json:"zero_threshold,omitempty"`
+	Positive      Buckets  `json:"positive"`
+	Negative      Buckets  `json:"negative"`
+	Min           *float64 `json:"min,omitempty"`
+	Max           *float64 `json:"max,omitempty"`
+}
+
+// Unmarshal 解析OTLP ExponentialHistogramDataPoint编码，未知字段被跳过
+func Unmarshal(data []byte) (*Exponential, error) {
+	h := &Exponential{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, ErrInvalidHistogram
+		}
+		data = data[n:]
+
+		switch {
+		case num == fieldCount && typ == protowire.Fixed64Type:
+			h.Count, n = protowire.ConsumeFixed64(data)
+		case num == fieldZeroCount && typ == protowire.Fixed64Type:
+			h.ZeroCount, n = protowire.ConsumeFixed64(data)
+		case num == fieldScale && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			h.Scale = int32(protowire.DecodeZigZag(v))
+		case (num == fieldSum || num == fieldMin || num == fieldMax || num == fieldZeroThreshold) && typ == protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(data)
+			f := math.Float64frombits(v)
+			switch num {
+			case fieldSum:
+				h.Sum = &f
+			case fieldMin:
+				h.Min = &f
+			case fieldMax:
+				h.Max = &f
+			default:
+				h.ZeroThreshold = f
+			}
+		case (num == fieldPositive || num == fieldNegative) && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(data)
+			if n < 0 {
+				return nil, ErrInvalidHistogram
+			}
+			b, err := unmarshalBuckets(v)
+			if err != nil {
+				return nil, err
+			}
+			if num == fieldPositive {
+				h.Positive = b
+			} else {
+				h.Negative = b
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, ErrInvalidHistogram
+		}
+		data = data[n:]
+	}
+
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// unmarshalBuckets 解析Buckets消息，bucket_counts兼容packed和非packed编码
+func unmarshalBuckets(data []byte) (Buckets, error) {
+	var b Buckets
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return b, ErrInvalidHistogram
+		}
+		data = data[n:]
+
+		switch {
+		case num == fieldBucketOffset && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			b.Offset = int32(protowire.DecodeZigZag(v))
+		case num == fieldBucketCounts && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			b.Counts = append(b.Counts, v)
+		case num == fieldBucketCounts && typ == protowire.BytesType:
+			var packed []byte
+			packed, n = protowire.ConsumeBytes(data)
+			for len(packed) > 0 {
+				v, m := protowire.ConsumeVarint(packed)
+				if m < 0 {
+					return b, ErrInvalidHistogram
+				}
+				b.Counts = append(b.Counts, v)
+				packed = packed[m:]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return b, ErrInvalidHistogram
+		}
+		data = data[n:]
+	}
+	return b, nil
+}
+
+// validate 检查scale范围和计数是否一致
+func (h *Exponential) validate() error {
+	if h.Scale < -10 || h.Scale > 20 {
+		return ErrInvalidHistogram
+	}
+	total := h.ZeroCount
+	for _, c := range h.Positive.Counts {
+		total += c
+	}
+	for _, c := range h.Negative.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return ErrInvalidHistogram
+	}
+	return nil
+}
+
+// Marshal 编码为OTLP ExponentialHistogramDataPoint，bucket_counts使用packed编码
+func (h *Exponential) Marshal() []byte {
+	var b []byte
+	if h.Count != 0 {
+		b = protowire.AppendTag(b, fieldCount, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, h.Count)
+	}
+	if h.Sum != nil {
+		b = protowire.AppendTag(b, fieldSum, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*h.Sum))
+	}
+	if h.Scale != 0 {
+		b = protowire.AppendTag(b, fieldScale, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(h.Scale)))
+	}
+	if h.ZeroCount != 0 {
+		b = protowire.AppendTag(b, fieldZeroCount, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, h.ZeroCount)
+	}
+	if len(h.Positive.Counts) > 0 {
+		b = protowire.AppendTag(b, fieldPositive, protowire.BytesType)
+		b = protowire.AppendBytes(b, h.Positive.marshal())
+	}
+	if len(h.Negative.Counts) > 0 {
+		b = protowire.AppendTag(b, fieldNegative, protowire.BytesType)
+		b = protowire.AppendBytes(b, h.Negative.marshal())
+	}
+	if h.Min != nil {
+		b = protowire.AppendTag(b, fieldMin, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*h.Min))
+	}
+	if h.Max != nil {
+		b = protowire.AppendTag(b, fieldMax, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*h.Max))
+	}
+	if h.ZeroThreshold != 0 {
+		b = protowire.AppendTag(b, fieldZeroThreshold, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(h.ZeroThreshold))
+	}
+	return b
+}
+
+// marshal 编码Buckets消息
+func (b *Buckets) marshal() []byte {
+	var out []byte
+	if b.Offset != 0 {
+		out = protowire.AppendTag(out, fieldBucketOffset, protowire.VarintType)
+		out = protowire.AppendVarint(out, protowire.EncodeZigZag(int64(b.Offset)))
+	}
+	var packed []byte
+	for _, c := range b.Counts {
+		packed = protowire.AppendVarint(packed, c)
+	}
+	out = protowire.AppendTag(out, fieldBucketCounts, protowire.BytesType)
+	return protowire.AppendBytes(out, packed)
+}
+
+// Merge 把other合并进h
+//
+// scale取两者中较低的一个，合并后一侧的桶数超过MaxBuckets时继续降低scale；
+// zero_threshold取较大值，完全落在零桶范围内的桶计入zero_count。
+func (h *Exponential) Merge(other *Exponential) {
+	if other.Count == 0 && other.ZeroThreshold <= h.ZeroThreshold {
+		return
+	}
+	if h.Count == 0 && h.ZeroThreshold <= other.ZeroThreshold {
+		*h = *other.clone()
+		return
+	}
+
+	o := other.clone()
+	threshold := max(h.ZeroThreshold, o.ZeroThreshold)
+	h.widenZero(threshold)
+	o.widenZero(threshold)
+
+	scale := min(h.Scale, o.Scale)
+	for scale > -10 && (span(&h.Positive, h.Scale, &o.Positive, o.Scale, scale) > MaxBuckets ||
+		span(&h.Negative, h.Scale, &o.Negative, o.Scale, scale) > MaxBuckets) {
+		scale--
+	}
+	h.downscale(scale)
+	o.downscale(scale)
+
+	h.Positive.merge(&o.Positive)
+	h.Negative.merge(&o.Negative)
+	h.Count += o.Count
+	h.ZeroCount += o.ZeroCount
+
+	if h.Sum != nil && o.Sum != nil {
+		*h.Sum += *o.Sum
+	} else {
+		h.Sum = nil
+	}
+	h.Min = pick(h.Min, o.Min, math.Min)
+	h.Max = pick(h.Max, o.Max, math.Max)
+}
+
+// clone 深拷贝，合并时不修改other
+func (h *Exponential) clone() *Exponential {
+	c := *h
+	c.Positive.Counts = slices.Clone(h.Positive.Counts)
+	c.Negative.Counts = slices.Clone(h.Negative.Counts)
+	if h.Sum != nil {
+		v := *h.Sum
+		c.Sum = &v
+	}
+	if h.Min != nil {
+		v := *h.Min
+		c.Min = &v
+	}
+	if h.Max != nil {
+		v := *h.Max
+		c.Max = &v
+	}
+	return &c
+}
+
+// pick 两者都存在时取fn的结果，否则取存在的一个
+func pick(a, b *float64, fn func(x, y float64) float64) *float64 {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+	v := fn(*a, *b)
+	return &v
+}
+
+// widenZero 把零桶范围扩大到threshold，上界不超过threshold的桶计入zero_count
+func (h *Exponential) widenZero(threshold float64) {
+	if threshold <= h.ZeroThreshold {
+		return
+	}
+	h.ZeroThreshold = threshold
+	h.ZeroCount += h.Positive.trimBelow(h.Scale, threshold)
+	h.ZeroCount += h.Negative.trimBelow(h.Scale, threshold)
+}
+
+// trimBelow 移除上界不超过threshold的桶，返回移除的计数
+func (b *Buckets) trimBelow(scale int32, threshold float64) uint64 {
+	var removed uint64
+	i := 0
+	for i < len(b.Counts) && upperBound(b.Offset+int32(i), scale) <= threshold {
+		removed += b.Counts[i]
+		i++
+	}
+	b.Counts = b.Counts[i:]
+	b.Offset += int32(i)
+	return removed
+}
+
+// downscale 把scale降低到target，相邻的桶合并
+func (h *Exponential) downscale(target int32) {
+	if target >= h.Scale {
+		return
+	}
+	shift := h.Scale - target
+	h.Positive.downscale(shift)
+	h.Negative.downscale(shift)
+	h.Scale = target
+}
+
+// downscale 下标右移shift位，合并落入同一新桶的计数
+func (b *Buckets) downscale(shift int32) {
+	if len(b.Counts) == 0 {
+		b.Offset >>= shift
+		return
+	}
+	first := b.Offset >> shift
+	last := (b.Offset + int32(len(b.Counts)) - 1) >> shift
+	counts := make([]uint64, last-first+1)
+	for i, c := range b.Counts {
+		counts[((b.Offset+int32(i))>>shift)-first] += c
+	}
+	b.Offset = first
+	b.Counts = counts
+}
+
+// merge 合并相同scale的桶
+func (b *Buckets) merge(other *Buckets) {
+	if len(other.Counts) == 0 {
+		return
+	}
+	if len(b.Counts) == 0 {
+		b.Offset = other.Offset
+		b.Counts = slices.Clone(other.Counts)
+		return
+	}
+
+	first := min(b.Offset, other.Offset)
+	last := max(b.Offset+int32(len(b.Counts)), other.Offset+int32(len(other.Counts)))
+	counts := make([]uint64, last-first)
+	for i, c := range b.Counts {
+		counts[b.Offset-first+int32(i)] += c
+	}
+	for i, c := range other.Counts {
+		counts[other.Offset-first+int32(i)] += c
+	}
+	b.Offset = first
+	b.Counts = counts
+}
+
+// span 两组桶降到scale后覆盖的下标数
+func span(a *Buckets, aScale int32, b *Buckets, bScale int32, scale int32) int32 {
+	first, last := int32(math.MaxInt32), int32(math.MinInt32)
+	for _, side := range []struct {
+		b     *Buckets
+		shift int32
+	}{{a, aScale - scale}, {b, bScale - scale}} {
+		if len(side.b.Counts) == 0 {
+			continue
+		}
+		first = min(first, side.b.Offset>>side.shift)
+		last = max(last, (side.b.Offset+int32(len(side.b.Counts))-1)>>side.shift)
+	}
+	if first > last {
+		return 0
+	}
+	return last - first + 1
+}
+
+// lowerBound 下标为index的桶的下界
+func lowerBound(index, scale int32) float64 {
+	return math.Exp2(float64(index) * math.Exp2(-float64(scale)))
+}
+
+// upperBound 下标为index的桶的上界
+func upperBound(index, scale int32) float64 {
+	return lowerBound(index+1, scale)
+}
+
+// Quantile 估算分位数q(0到1)，目标样本所在桶内按线性插值，结果限制在min和max之间
+//
+// 直方图为空时返回NaN。
+func (h *Exponential) Quantile(q float64) float64 {
+	if h.Count == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	q = math.Max(0, math.Min(1, q))
+	if q == 0 && h.Min != nil {
+		return *h.Min
+	}
+	if q == 1 && h.Max != nil {
+		return *h.Max
+	}
+
+	rank := q * float64(h.Count)
+	var cum float64
+	value := math.NaN()
+
+	// 负数从绝对值最大的桶开始，然后是零桶，最后是正数
+	for i := len(h.Negative.Counts) - 1; i >= 0 && math.IsNaN(value); i-- {
+		c := float64(h.Negative.Counts[i])
+		if c > 0 && cum+c >= rank {
+			index := h.Negative.Offset + int32(i)
+			lower, upper := lowerBound(index, h.Scale), upperBound(index, h.Scale)
+			value = -(upper - (upper-lower)*(rank-cum)/c)
+		}
+		cum += c
+	}
+	if math.IsNaN(value) {
+		c := float64(h.ZeroCount)
+		if c > 0 && cum+c >= rank {
+			value = 0
+		}
+		cum += c
+	}
+	for i := 0; i < len(h.Positive.Counts) && math.IsNaN(value); i++ {
+		c := float64(h.Positive.Counts[i])
+		if c > 0 && cum+c >= rank {
+			index := h.Positive.Offset + int32(i)
+			lower, upper := lowerBound(index, h.Scale), upperBound(index, h.Scale)
+			value = lower + (upper-lower)*(rank-cum)/c
+		}
+		cum += c
+	}
+	if math.IsNaN(value) {
+		// 浮点误差导致没有命中时取最后一个非空桶的上界
+		value = h.upper()
+	}
+
+	if h.Min != nil {
+		value = math.Max(value, *h.Min)
+	}
+	if h.Max != nil {
+		value = math.Min(value, *h.Max)
+	}
+	return value
+}
+
+// upper 最大非空桶的上界
+func (h *Exponential) upper() float64 {
+	for i := len(h.Positive.Counts) - 1; i >= 0; i-- {
+		if h.Positive.Counts[i] > 0 {
+			return upperBound(h.Positive.Offset+int32(i), h.Scale)
+		}
+	}
+	if h.ZeroCount > 0 {
+		return 0
+	}
+	for i := range h.Negative.Counts {
+		if h.Negative.Counts[i] > 0 {
+			return -lowerBound(h.Negative.Offset+int32(i), h.Scale)
+		}
+	}
+	return math.NaN()
+}
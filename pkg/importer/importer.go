@@ -0,0 +1,429 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"github.com/parquet-go/parquet-go"
+)
+
+// 支持的文件格式
+const (
+	FormatJSONL   = "jsonl"
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// batchSize 每批提交给处理器的指标数量
+const batchSize = 1000
+
+// maxErrors 结果中最多保留的错误信息条数
+const maxErrors = 20
+
+// ErrUnsupportedFormat 不支持的文件格式
+var ErrUnsupportedFormat = errors.New("unsupported import format")
+
+// Record 导入文件中的一行数据
+//
+// 时间戳支持毫秒整数或RFC3339字符串，类型为protocol.MetricType的名称。
+// CSV中labels写作 k1=v1;k2=v2。
+type Record struct {
+	AgentID   string            `json:"agent_id"`
+	Timestamp json.RawMessage   `json:"timestamp"`
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels"`
+	Type      string            `json:"type"`
+}
+
+// parquetRecord Parquet文件的行结构，timestamp为毫秒时间戳
+type parquetRecord struct {
+	AgentID   string            `parquet:"agent_id,optional"`
+	Timestamp int64             `parquet:"timestamp"`
+	Name      string            `parquet:"name"`
+	Value     float64           `parquet:"value"`
+	Labels    map[string]string `parquet:"labels,optional"`
+	Type      string            `parquet:"type,optional"`
+}
+
+// Result 导入结果
+type Result struct {
+	Read     int      `json:"read"`
+	Imported int      `json:"imported"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+	// AgentIDs 写入了数据的Agent ID
+	AgentIDs []string `json:"-"`
+}
+
+// FormatFromPath 根据文件扩展名推断格式
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson", ".json":
+		return FormatJSONL
+	case ".csv":
+		return FormatCSV
+	case ".parquet":
+		return FormatParquet
+	default:
+		return ""
+	}
+}
+
+// Importer 将历史数据文件经过处理器写入存储
+type Importer struct {
+	processor processor.Processor
+	storage   storage.Storage
+	// hooks 每批数据写入存储后调用，如把历史数据补入降采样
+	hooks []func([]processor.ProcessedMetric)
+}
+
+// NewImporter 创建导入器
+func NewImporter(processor processor.Processor, storage storage.Storage) *Importer {
+	return &Importer{
+		processor: processor,
+		storage:   storage,
+	}
+}
+
+// OnImported 注册每批数据写入存储后调用的钩子，需在导入前注册
+func (im *Importer) OnImported(hook func([]processor.ProcessedMetric)) {
+	im.hooks = append(im.hooks, hook)
+}
+
+// Import 按指定格式读取r中的数据并导入
+func (im *Importer) Import(r io.Reader, format string) (*Result, error) {
+	return im.ImportAs(r, format, "")
+}
+
+// ImportAs 与Import相同，但未携带agent_id的记录归属于defaultAgentID
+func (im *Importer) ImportAs(r io.Reader, format, defaultAgentID string) (*Result, error) {
+	result := &Result{}
+	batcher := &batcher{
+		importer:       im,
+		result:         result,
+		batches:        make(map[string]*protocol.BatchMetricsRequest),
+		defaultAgentID: defaultAgentID,
+	}
+
+	var err error
+	switch format {
+	case FormatJSONL:
+		err = readJSONL(r, batcher)
+	case FormatCSV:
+		err = readCSV(r, batcher)
+	case FormatParquet:
+		err = readParquet(r, batcher)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return result, err
+	}
+
+	return result, batcher.flushAll()
+}
+
+// batcher 按Agent ID聚合数据并分批提交
+type batcher struct {
+	importer       *Importer
+	result         *Result
+	batches        map[string]*protocol.BatchMetricsRequest
+	defaultAgentID string
+}
+
+// add 添加一条记录，line为行号，用于错误提示
+func (b *batcher) add(line int, record *Record, timestampMs int64) error {
+	b.result.Read++
+
+	metric, err := toMetric(record, timestampMs)
+	if err != nil {
+		b.reject(fmt.Sprintf("line %d: %v", line, err))
+		return nil
+	}
+
+	agentID := record.AgentID
+	if agentID == "" {
+		agentID = b.defaultAgentID
+	}
+
+	batch, ok := b.batches[agentID]
+	if !ok {
+		batch = &protocol.BatchMetricsRequest{AgentId: agentID}
+		b.batches[agentID] = batch
+	}
+	batch.Metrics = append(batch.Metrics, metric)
+
+	if len(batch.Metrics) >= batchSize {
+		return b.flush(batch)
+	}
+	return nil
+}
+
+// flush 处理并保存一批数据
+func (b *batcher) flush(batch *protocol.BatchMetricsRequest) error {
+	if len(batch.Metrics) == 0 {
+		return nil
+	}
+
+	processed, err := b.importer.processor.ProcessBatchRequest(batch)
+	if err != nil {
+		return fmt.Errorf("failed to process batch: %w", err)
+	}
+	if err := b.importer.storage.SaveMetrics(processed); err != nil {
+		return fmt.Errorf("failed to save batch: %w", err)
+	}
+	for _, hook := range b.importer.hooks {
+		hook(processed)
+	}
+
+	// 处理器会丢弃校验失败的数据
+	b.result.Imported += len(processed)
+	if !slices.Contains(b.result.AgentIDs, batch.AgentId) {
+		b.result.AgentIDs = append(b.result.AgentIDs, batch.AgentId)
+	}
+	b.result.Rejected += len(batch.Metrics) - len(processed)
+	batch.Metrics = batch.Metrics[:0]
+	return nil
+}
+
+// flushAll 提交所有未满的批次
+func (b *batcher) flushAll() error {
+	for _, batch := range b.batches {
+		if err := b.flush(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *batcher) reject(msg string) {
+	b.result.Rejected++
+	if len(b.result.Errors) < maxErrors {
+		b.result.Errors = append(b.result.Errors, msg)
+	}
+}
+
+// readJSONL 读取每行一个JSON对象的文件
+func readJSONL(r io.Reader, b *batcher) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			b.result.Read++
+			b.reject(fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+
+		timestampMs, err := parseTimestamp(strings.Trim(string(record.Timestamp), `"`))
+		if err != nil {
+			b.result.Read++
+			b.reject(fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		if err := b.add(line, &record, timestampMs); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readCSV 读取带表头的CSV文件
+func readCSV(r io.Reader, b *batcher) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read csv header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, required := range []string{"timestamp", "name", "value"} {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("csv header missing column %q", required)
+		}
+	}
+
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	line := 1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if err != nil {
+			b.result.Read++
+			b.reject(fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+
+		value, err := strconv.ParseFloat(field(row, "value"), 64)
+		if err != nil {
+			b.result.Read++
+			b.reject(fmt.Sprintf("line %d: invalid value", line))
+			continue
+		}
+		timestampMs, err := parseTimestamp(field(row, "timestamp"))
+		if err != nil {
+			b.result.Read++
+			b.reject(fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+
+		record := &Record{
+			AgentID: field(row, "agent_id"),
+			Name:    field(row, "name"),
+			Value:   value,
+			Labels:  parseLabels(field(row, "labels")),
+			Type:    field(row, "type"),
+		}
+		if err := b.add(line, record, timestampMs); err != nil {
+			return err
+		}
+	}
+}
+
+// readParquet 读取Parquet文件，需要随机访问，非文件输入会先写入临时文件
+func readParquet(r io.Reader, b *batcher) error {
+	file, ok := r.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "kon-import-*.parquet")
+		if err != nil {
+			return fmt.Errorf("failed to create temp file: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if _, err := io.Copy(tmp, r); err != nil {
+			return fmt.Errorf("failed to spool parquet data: %w", err)
+		}
+		file = tmp
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to open parquet file: %w", err)
+	}
+
+	reader := parquet.NewGenericReader[parquetRecord](pf)
+	defer reader.Close()
+
+	rows := make([]parquetRecord, batchSize)
+	line := 0
+	for {
+		n, err := reader.Read(rows)
+		for i := 0; i < n; i++ {
+			line++
+			row := &rows[i]
+			record := &Record{
+				AgentID: row.AgentID,
+				Name:    row.Name,
+				Value:   row.Value,
+				Labels:  row.Labels,
+				Type:    row.Type,
+			}
+			if addErr := b.add(line, record, row.Timestamp); addErr != nil {
+				return addErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read parquet rows: %w", err)
+		}
+	}
+}
+
+// toMetric 将导入记录转换为协议指标
+func toMetric(record *Record, timestampMs int64) (*protocol.Metric, error) {
+	// 处理器也会丢弃没有时间戳的数据，这里提前检查以便报告行号
+	if timestampMs <= 0 {
+		return nil, errors.New("timestamp is required")
+	}
+
+	metricType := protocol.MetricType_CPU_USAGE
+	if record.Type != "" {
+		value, ok := protocol.MetricType_value[strings.ToUpper(record.Type)]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric type %q", record.Type)
+		}
+		metricType = protocol.MetricType(value)
+	}
+
+	return &protocol.Metric{
+		Timestamp: timestampMs,
+		Name:      record.Name,
+		Value:     record.Value,
+		Labels:    record.Labels,
+		Type:      metricType,
+	}, nil
+}
+
+// parseTimestamp 解析毫秒时间戳或RFC3339时间
+func parseTimestamp(s string) (int64, error) {
+	if s == "" || s == "null" {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return t.UnixMilli(), nil
+}
+
+// parseLabels 解析 k1=v1;k2=v2 格式的标签
+func parseLabels(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return labels
+}
@@ -0,0 +1,188 @@
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 行协议中各部分需要转义的字符
+const (
+	measurementEscapes = ", "
+	keyEscapes         = ",= "
+)
+
+// precisions 时间戳精度参数对应的单位，包括v1的n、u、m、h和v2的ns、us、ms、s
+var precisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// tag 一个标签
+type tag struct {
+	key   string
+	value string
+}
+
+// field 一个数值字段，字符串字段不是指标，解析时跳过
+type field struct {
+	key   string
+	value float64
+}
+
+// point 一行数据
+type point struct {
+	measurement string
+	tags        []tag
+	fields      []field
+	// timestamp 纳秒时间戳，0表示未指定
+	timestamp int64
+}
+
+// Precision 返回precision参数对应的时间戳单位
+func Precision(precision string) (time.Duration, error) {
+	unit, ok := precisions[precision]
+	if !ok {
+		return 0, fmt.Errorf("invalid precision %q", precision)
+	}
+	return unit, nil
+}
+
+// parseLine 解析一行行协议
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// 字段值可以是浮点数、带i后缀的整数、带u后缀的无符号整数、布尔值或双引号包围的字符串。
+// 只有字符串字段的行返回的fields为空。
+func parseLine(line string, unit time.Duration) (*point, error) {
+	p := &point{}
+	var i int
+	p.measurement, i = scan(line, 0, measurementEscapes, ", ")
+	if p.measurement == "" {
+		return nil, errors.New("missing measurement")
+	}
+
+	for i < len(line) && line[i] == ',' {
+		var t tag
+		if t.key, i = scan(line, i+1, keyEscapes, ",= "); i >= len(line) || line[i] != '=' || t.key == "" {
+			return nil, errors.New("invalid tag")
+		}
+		if t.value, i = scan(line, i+1, keyEscapes, ",= "); t.value == "" || (i < len(line) && line[i] == '=') {
+			return nil, fmt.Errorf("invalid value for tag %q", t.key)
+		}
+		p.tags = append(p.tags, t)
+	}
+	if i >= len(line) || line[i] != ' ' {
+		return nil, errors.New("missing fields")
+	}
+
+	hasField := false
+	for {
+		var key string
+		if key, i = scan(line, i+1, keyEscapes, ",= "); i >= len(line) || line[i] != '=' || key == "" {
+			return nil, errors.New("invalid field")
+		}
+		value, isString, next, err := fieldValue(line, i+1)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for field %q: %w", key, err)
+		}
+		hasField = true
+		if !isString {
+			p.fields = append(p.fields, field{key: key, value: value})
+		}
+		i = next
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+	}
+	if !hasField {
+		return nil, errors.New("missing fields")
+	}
+
+	if rest := strings.TrimSpace(line[i:]); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", rest)
+		}
+		if ts != 0 && (ts > math.MaxInt64/int64(unit) || ts < math.MinInt64/int64(unit)) {
+			return nil, fmt.Errorf("timestamp %d out of range", ts)
+		}
+		p.timestamp = ts * int64(unit)
+	}
+	return p, nil
+}
+
+// scan 从start开始读取到未转义的stops中的字符或行尾，反斜杠加escapes中的字符表示该字符本身
+func scan(line string, start int, escapes, stops string) (string, int) {
+	var b strings.Builder
+	i := start
+	for i < len(line) {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte(escapes, line[i+1]) >= 0 {
+			b.WriteByte(line[i+1])
+			i += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String(), i
+}
+
+// fieldValue 解析从start开始的字段值，返回数值、是否为字符串和值之后的位置
+func fieldValue(line string, start int) (float64, bool, int, error) {
+	if start < len(line) && line[start] == '"' {
+		for i := start + 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return 0, true, i + 1, nil
+			}
+		}
+		return 0, false, 0, errors.New("unterminated string")
+	}
+
+	end := start
+	for end < len(line) && line[end] != ',' && line[end] != ' ' {
+		end++
+	}
+	raw := line[start:end]
+	if raw == "" {
+		return 0, false, 0, errors.New("empty value")
+	}
+
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, false, end, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, false, end, nil
+	}
+	switch raw[len(raw)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(n), false, end, err
+	case 'u':
+		n, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return float64(n), false, end, err
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		err = errors.New("NaN and Inf are not supported")
+	}
+	return v, false, end, err
+}
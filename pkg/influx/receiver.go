@@ -0,0 +1,190 @@
+package influx
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// maxErrors 结果中最多保留的解析错误数
+const maxErrors = 10
+
+// Result 一次写入请求的接入结果
+type Result struct {
+	// Accepted 写入存储的指标数
+	Accepted int `json:"accepted"`
+	// Rejected 无法解析的行数与被处理器丢弃的指标数之和
+	Rejected int `json:"rejected"`
+	// Errors 前maxErrors行无法解析的行号和原因
+	Errors []string `json:"errors,omitempty"`
+	// AgentIDs 写入了数据的Agent ID
+	AgentIDs []string `json:"-"`
+}
+
+// Receiver InfluxDB行协议接收器
+//
+// 每个数值字段转换为一个指标，指标名为measurement_field，字段名为value时为measurement，
+// 整数、无符号整数和布尔值(1或0)按浮点数保存，字符串字段被忽略。
+// Agent ID取agent_id_tags中第一个非空的标签，该标签不再作为普通标签，都没有时为default_agent_id；
+// 其余标签原样作为指标标签。指标都作为CPU_USAGE类型，经过与QUIC相同的处理器写入存储。
+// 没有时间戳的行使用接收时间。
+type Receiver struct {
+	processor      processor.Processor
+	storage        storage.Storage
+	clock          clock.Clock
+	agentIDTags    []string
+	defaultAgentID string
+	token          string
+	maxBodySize    int64
+}
+
+// NewReceiver 创建行协议接收器，storage应触发接入钩子
+func NewReceiver(cfg config.InfluxConfig, processor processor.Processor, storage storage.Storage, clk clock.Clock) *Receiver {
+	return &Receiver{
+		processor:      processor,
+		storage:        storage,
+		clock:          clk,
+		agentIDTags:    cfg.AgentIDTags,
+		defaultAgentID: cfg.DefaultAgentID,
+		token:          cfg.Token,
+		maxBodySize:    cfg.MaxBodySize,
+	}
+}
+
+// MaxBodySize 返回请求解压后的最大长度
+func (r *Receiver) MaxBodySize() int64 {
+	return r.maxBodySize
+}
+
+// Authorize 校验请求携带的令牌，未配置token时总是通过
+//
+// header为Authorization请求头，支持Token、Bearer和Basic(校验密码)，password为v1的p参数。
+func (r *Receiver) Authorize(header, password string) bool {
+	if r.token == "" {
+		return true
+	}
+	if token, ok := strings.CutPrefix(header, "Token "); ok {
+		password = token
+	} else if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		password = token
+	}
+	return password != "" && subtle.ConstantTimeCompare([]byte(password), []byte(r.token)) == 1
+}
+
+// Write 接入行协议数据，unit为时间戳单位
+//
+// 无法解析的行被跳过并记录在Result.Errors中，其余数据照常写入；返回错误说明数据处理或写入存储失败。
+func (r *Receiver) Write(body []byte, unit time.Duration) (*Result, error) {
+	result := &Result{}
+	now := r.clock.Now().UnixMilli()
+	batches := make(map[string]*protocol.BatchMetricsRequest)
+	var order []string
+
+	for n, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := parseLine(line, unit)
+		if err != nil {
+			result.Rejected++
+			if len(result.Errors) < maxErrors {
+				result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", n+1, err))
+			}
+			continue
+		}
+
+		timestamp := p.timestamp / int64(time.Millisecond)
+		if p.timestamp == 0 {
+			timestamp = now
+		}
+		agentID, labels := r.split(p.tags)
+		batch, ok := batches[agentID]
+		if !ok {
+			batch = &protocol.BatchMetricsRequest{AgentId: agentID}
+			batches[agentID] = batch
+			order = append(order, agentID)
+		}
+		for i, f := range p.fields {
+			name := p.measurement
+			if f.key != "value" {
+				name += "_" + f.key
+			}
+			// 同一行的指标各自持有标签，避免处理阶段修改标签时相互影响
+			if i > 0 {
+				labels = cloneLabels(labels)
+			}
+			batch.Metrics = append(batch.Metrics, &protocol.Metric{
+				Timestamp: timestamp,
+				Name:      name,
+				Value:     f.value,
+				Labels:    labels,
+				Type:      protocol.MetricType_CPU_USAGE,
+			})
+		}
+	}
+
+	for _, agentID := range order {
+		batch := batches[agentID]
+		if len(batch.Metrics) == 0 {
+			continue
+		}
+		processed, err := r.processor.ProcessBatchRequest(batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process batch: %w", err)
+		}
+		if err := r.storage.SaveMetrics(processed); err != nil {
+			return nil, fmt.Errorf("failed to save batch: %w", err)
+		}
+		result.Accepted += len(processed)
+		result.AgentIDs = append(result.AgentIDs, agentID)
+		// 处理器会丢弃校验失败的数据
+		result.Rejected += len(batch.Metrics) - len(processed)
+	}
+	return result, nil
+}
+
+// split 从标签中取出Agent ID，返回Agent ID和其余标签
+func (r *Receiver) split(tags []tag) (string, map[string]string) {
+	agentID, agentTag := r.defaultAgentID, ""
+	for _, name := range r.agentIDTags {
+		if v := tagValue(tags, name); v != "" {
+			agentID, agentTag = v, name
+			break
+		}
+	}
+
+	labels := make(map[string]string, len(tags))
+	for _, t := range tags {
+		if t.key != agentTag {
+			labels[t.key] = t.value
+		}
+	}
+	return agentID, labels
+}
+
+// tagValue 返回标签的值，不存在时为空
+func tagValue(tags []tag, key string) string {
+	for _, t := range tags {
+		if t.key == key {
+			return t.value
+		}
+	}
+	return ""
+}
+
+// cloneLabels 复制标签
+func cloneLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,307 @@
+package ingestrate
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/exposition"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// Watermark 一个移动窗口内的接入速率(样本/秒)
+//
+// Avg为窗口内的平均速率，Peak和Low为窗口内单个时间片速率的最高和最低水位。
+type Watermark struct {
+	Avg  float64 `json:"avg"`
+	Peak float64 `json:"peak"`
+	Low  float64 `json:"low"`
+}
+
+// Rates 接入速率，Current为最近一个完整时间片的速率，Windows按窗口时长(如"5m")索引
+type Rates struct {
+	Current float64              `json:"current"`
+	Windows map[string]Watermark `json:"windows"`
+}
+
+// Report 全部和各Agent的接入速率
+//
+// Agents按Agent ID索引，便于KEDA等按JSON路径取值，如agents.agent-1.windows.1m.avg；
+// 超过max_agents后新出现的Agent只计入Total，Untracked为这部分Agent的数量。
+type Report struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Resolution  string           `json:"resolution"`
+	Total       Rates            `json:"total"`
+	Agents      map[string]Rates `json:"agents"`
+	Untracked   int              `json:"untracked_agents"`
+}
+
+// ring 按时间片累计的样本数，只保留最近len(counts)个时间片
+type ring struct {
+	counts []int64
+	stamps []int64
+}
+
+// newRing 创建保留n个时间片的计数
+func newRing(n int) *ring {
+	return &ring{counts: make([]int64, n), stamps: make([]int64, n)}
+}
+
+// add 在时间片slot上累计n
+func (r *ring) add(slot, n int64) {
+	i := slot % int64(len(r.counts))
+	if r.stamps[i] != slot {
+		r.stamps[i] = slot
+		r.counts[i] = 0
+	}
+	r.counts[i] += n
+}
+
+// at 返回时间片slot的计数，已被覆盖或没有数据时为0
+func (r *ring) at(slot int64) int64 {
+	i := slot % int64(len(r.counts))
+	if r.stamps[i] != slot {
+		return 0
+	}
+	return r.counts[i]
+}
+
+// Meter 按Agent统计接入速率的移动窗口水位，供HPA/KEDA等自动扩缩容抓取
+type Meter struct {
+	mu         sync.Mutex
+	clock      clock.Clock
+	resolution time.Duration
+	windows    []time.Duration
+	maxAgents  int
+	started    int64
+	total      *ring
+	agents     map[string]*ring
+	untracked  map[string]int64
+}
+
+// NewMeter 创建接入速率统计，窗口向上取整到resolution的整数倍
+func NewMeter(cfg config.IngestRateConfig, clk clock.Clock) *Meter {
+	resolution := max(cfg.Resolution, time.Second)
+	windows := make([]time.Duration, 0, len(cfg.Windows))
+	for _, w := range cfg.Windows {
+		w = max((w+resolution-1)/resolution*resolution, resolution)
+		if !slices.Contains(windows, w) {
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+
+	m := &Meter{
+		clock:      clk,
+		resolution: resolution,
+		windows:    windows,
+		maxAgents:  cfg.MaxAgents,
+		agents:     make(map[string]*ring),
+		untracked:  make(map[string]int64),
+	}
+	m.started = m.slot(clk.Now())
+	m.total = m.newRing()
+	return m
+}
+
+// Observe 记录写入存储的一批数据，应在数据写入存储后调用
+func (m *Meter) Observe(metrics []processor.ProcessedMetric) {
+	slot := m.slot(m.clock.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.total.add(slot, int64(len(metrics)))
+	for i := range metrics {
+		id := metrics[i].AgentID
+		if id == "" {
+			continue
+		}
+		r, ok := m.agents[id]
+		if !ok {
+			if m.maxAgents > 0 && len(m.agents) >= m.maxAgents {
+				m.untracked[id] = slot
+				continue
+			}
+			r = m.newRing()
+			m.agents[id] = r
+			delete(m.untracked, id)
+		}
+		r.add(slot, 1)
+	}
+}
+
+// Report 返回各窗口的接入速率，同时忘记最长窗口内没有数据的Agent
+func (m *Meter) Report() Report {
+	now := m.clock.Now()
+	slot := m.slot(now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := Report{
+		GeneratedAt: now,
+		Resolution:  m.resolution.String(),
+		Total:       m.rates(m.total, slot),
+		Agents:      make(map[string]Rates, len(m.agents)),
+	}
+
+	oldest := slot - m.slots()
+	for id, r := range m.agents {
+		if !m.active(r, slot) {
+			delete(m.agents, id)
+			continue
+		}
+		report.Agents[id] = m.rates(r, slot)
+	}
+	for id, last := range m.untracked {
+		if last < oldest {
+			delete(m.untracked, id)
+		}
+	}
+	report.Untracked = len(m.untracked)
+	return report
+}
+
+// rates 计算截至时间片slot(不含)的各窗口速率，启动后不足一个窗口时只统计已运行的时间片
+func (m *Meter) rates(r *ring, slot int64) Rates {
+	seconds := m.resolution.Seconds()
+	rates := Rates{Windows: make(map[string]Watermark, len(m.windows))}
+	if slot > m.started {
+		rates.Current = float64(r.at(slot-1)) / seconds
+	}
+
+	for _, w := range m.windows {
+		n := min(int64(w/m.resolution), slot-m.started)
+		if n <= 0 {
+			rates.Windows[formatWindow(w)] = Watermark{}
+			continue
+		}
+
+		var sum, peak, low int64
+		for i := int64(1); i <= n; i++ {
+			c := r.at(slot - i)
+			sum += c
+			if i == 1 || c > peak {
+				peak = c
+			}
+			if i == 1 || c < low {
+				low = c
+			}
+		}
+		rates.Windows[formatWindow(w)] = Watermark{
+			Avg:  float64(sum) / (float64(n) * seconds),
+			Peak: float64(peak) / seconds,
+			Low:  float64(low) / seconds,
+		}
+	}
+	return rates
+}
+
+// active 判断最长窗口内是否有数据，包括当前时间片
+func (m *Meter) active(r *ring, slot int64) bool {
+	for i := int64(0); i <= m.slots(); i++ {
+		if r.at(slot-i) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// slots 最长窗口包含的时间片数量
+func (m *Meter) slots() int64 {
+	if len(m.windows) == 0 {
+		return 1
+	}
+	return int64(m.windows[len(m.windows)-1] / m.resolution)
+}
+
+// newRing 创建能覆盖最长窗口和当前时间片的计数
+func (m *Meter) newRing() *ring {
+	return newRing(int(m.slots()) + 1)
+}
+
+// slot 返回时间所在的时间片
+func (m *Meter) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(m.resolution)
+}
+
+// WritePrometheus 以Prometheus文本格式输出接入速率，供prometheus-adapter等转换为HPA外部指标
+func WritePrometheus(w io.Writer, report Report) error {
+	var b strings.Builder
+	b.WriteString("# HELP kon_ingest_samples_per_second Samples ingested per second over a moving window.\n")
+	b.WriteString("# TYPE kon_ingest_samples_per_second gauge\n")
+	writeWindows(&b, "", report.Total)
+	for _, id := range sortedAgents(report) {
+		writeWindows(&b, id, report.Agents[id])
+	}
+
+	b.WriteString("# HELP kon_ingest_current_samples_per_second Samples ingested per second in the last complete slot.\n")
+	b.WriteString("# TYPE kon_ingest_current_samples_per_second gauge\n")
+	fmt.Fprintf(&b, "kon_ingest_current_samples_per_second %g\n", report.Total.Current)
+	for _, id := range sortedAgents(report) {
+		fmt.Fprintf(&b, "kon_ingest_current_samples_per_second{agent_id=\"%s\"} %g\n", exposition.EscapeLabelValue(id), report.Agents[id].Current)
+	}
+
+	b.WriteString("# HELP kon_ingest_agents Agents with ingest in the longest window.\n")
+	b.WriteString("# TYPE kon_ingest_agents gauge\n")
+	fmt.Fprintf(&b, "kon_ingest_agents %d\n", len(report.Agents)+report.Untracked)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeWindows 输出一组速率的各窗口水位，agentID为空表示全部Agent
+func writeWindows(b *strings.Builder, agentID string, rates Rates) {
+	windows := make([]string, 0, len(rates.Windows))
+	for w := range rates.Windows {
+		windows = append(windows, w)
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		di, _ := time.ParseDuration(windows[i])
+		dj, _ := time.ParseDuration(windows[j])
+		return di < dj
+	})
+
+	agent := ""
+	if agentID != "" {
+		agent = fmt.Sprintf("agent_id=\"%s\",", exposition.EscapeLabelValue(agentID))
+	}
+	for _, w := range windows {
+		wm := rates.Windows[w]
+		for _, stat := range []struct {
+			name  string
+			value float64
+		}{{"avg", wm.Avg}, {"peak", wm.Peak}, {"low", wm.Low}} {
+			fmt.Fprintf(b, "kon_ingest_samples_per_second{%swindow=\"%s\",stat=\"%s\"} %g\n", agent, w, stat.name, stat.value)
+		}
+	}
+}
+
+// sortedAgents 按Agent ID排序，使输出稳定
+func sortedAgents(report Report) []string {
+	ids := make([]string, 0, len(report.Agents))
+	for id := range report.Agents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// formatWindow 窗口时长的简短写法，如1m、1h30m
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
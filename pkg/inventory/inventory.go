@@ -0,0 +1,298 @@
+package inventory
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// Agent状态
+const (
+	StatusOnline  = "online"
+	StatusMissing = "missing"
+)
+
+// Agent 清单中预期存在的Agent
+//
+// Labels为预期标签，Agent上报的数据带有同名标签但取值不同时在报告中列出。
+type Agent struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name,omitempty"`
+	Owner    string            `json:"owner,omitempty"`
+	Location string            `json:"location,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// AgentStatus 清单中Agent的对照结果
+type AgentStatus struct {
+	Agent
+	Status string `json:"status"`
+	// LastSeen 最后一次上报的时间，从未上报时为空
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// MismatchedLabels 与预期取值不同的标签最近一次上报的取值
+	MismatchedLabels map[string]string `json:"mismatched_labels,omitempty"`
+}
+
+// UnknownAgent 上报了数据但不在清单中的Agent
+type UnknownAgent struct {
+	AgentID  string    `json:"agent_id"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Counts 对照结果的数量
+type Counts struct {
+	Expected   int `json:"expected"`
+	Online     int `json:"online"`
+	Missing    int `json:"missing"`
+	Unknown    int `json:"unknown"`
+	Mismatched int `json:"mismatched"`
+}
+
+// Report 清单与实际上报的Agent的对照报告
+type Report struct {
+	GeneratedAt time.Time     `json:"generated_at"`
+	Summary     Counts        `json:"summary"`
+	Agents      []AgentStatus `json:"agents"`
+	// Unknown 不在清单中的Agent，最近上报的在前
+	Unknown []UnknownAgent `json:"unknown"`
+}
+
+// seen 单个Agent的上报情况
+type seen struct {
+	lastSeen time.Time
+	// mismatched 与预期取值不同的标签最近一次上报的取值
+	mismatched map[string]string
+}
+
+// Inventory 预期的Agent清单，与实际上报的Agent对照
+//
+// 清单来自配置中的agents和file，也可以通过CSV导入更新。
+// 清单中最近missing_after内上报过数据的Agent为在线，否则为缺失；不在清单中的Agent超过retain未上报后不再报告。
+type Inventory struct {
+	mu           sync.Mutex
+	clock        clock.Clock
+	missingAfter time.Duration
+	retain       time.Duration
+	agents       map[string]Agent
+	seen         map[string]*seen
+}
+
+// New 创建Agent清单，加载配置中的agents和file，ID相同时以file为准
+func New(cfg config.InventoryConfig, clk clock.Clock) (*Inventory, error) {
+	inv := &Inventory{
+		clock:        clk,
+		missingAfter: cfg.MissingAfter,
+		retain:       cfg.Retain,
+		agents:       make(map[string]Agent),
+		seen:         make(map[string]*seen),
+	}
+	for _, a := range cfg.Agents {
+		if a.ID == "" {
+			return nil, errors.New("inventory agent without id")
+		}
+		inv.agents[a.ID] = Agent{ID: a.ID, Name: a.Name, Owner: a.Owner, Location: a.Location, Labels: a.Labels}
+	}
+
+	if cfg.File != "" {
+		f, err := os.Open(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open inventory file: %w", err)
+		}
+		defer f.Close()
+
+		agents, err := ParseCSV(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load inventory file %s: %w", cfg.File, err)
+		}
+		for _, a := range agents {
+			inv.agents[a.ID] = a
+		}
+	}
+	return inv, nil
+}
+
+// ParseCSV 解析CSV格式的清单
+//
+// 首行为列名，id列必填，name、owner、location列可选，其余列作为预期标签，空值的标签被忽略。
+func ParseCSV(r io.Reader) ([]Agent, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	idColumn := -1
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if header[i] == "id" {
+			idColumn = i
+		}
+	}
+	if idColumn < 0 {
+		return nil, errors.New("missing id column")
+	}
+
+	var agents []Agent
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return agents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		a := Agent{ID: strings.TrimSpace(record[idColumn])}
+		if a.ID == "" {
+			return nil, fmt.Errorf("line %d: empty id", line)
+		}
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			switch header[i] {
+			case "id":
+			case "name":
+				a.Name = value
+			case "owner":
+				a.Owner = value
+			case "location":
+				a.Location = value
+			default:
+				if value == "" {
+					continue
+				}
+				if a.Labels == nil {
+					a.Labels = make(map[string]string)
+				}
+				a.Labels[header[i]] = value
+			}
+		}
+		agents = append(agents, a)
+	}
+}
+
+// Import 导入清单，replace为true时替换整个清单(包括配置中声明的Agent)，否则按ID合并；返回导入后的清单大小
+func (inv *Inventory) Import(agents []Agent, replace bool) int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if replace {
+		inv.agents = make(map[string]Agent, len(agents))
+	}
+	for _, a := range agents {
+		inv.agents[a.ID] = a
+		// 预期标签可能已变化，重新对照
+		if s, ok := inv.seen[a.ID]; ok {
+			s.mismatched = nil
+		}
+	}
+	return len(inv.agents)
+}
+
+// Observe 记录写入存储的一批数据，应在数据写入存储后调用
+func (inv *Inventory) Observe(metrics []processor.ProcessedMetric) {
+	now := inv.clock.Now()
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	for i := range metrics {
+		m := &metrics[i]
+		if m.AgentID == "" {
+			continue
+		}
+		s, ok := inv.seen[m.AgentID]
+		if !ok {
+			s = &seen{}
+			inv.seen[m.AgentID] = s
+		}
+		s.lastSeen = now
+
+		for name, expected := range inv.agents[m.AgentID].Labels {
+			value, ok := m.Labels[name]
+			if !ok {
+				continue
+			}
+			if value != expected {
+				if s.mismatched == nil {
+					s.mismatched = make(map[string]string)
+				}
+				s.mismatched[name] = value
+			} else {
+				delete(s.mismatched, name)
+			}
+		}
+	}
+}
+
+// Report 返回清单与实际上报的Agent的对照报告，清单中的Agent按ID排序
+func (inv *Inventory) Report() Report {
+	now := inv.clock.Now()
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	report := Report{
+		GeneratedAt: now,
+		Agents:      make([]AgentStatus, 0, len(inv.agents)),
+		Unknown:     make([]UnknownAgent, 0),
+	}
+	for id, a := range inv.agents {
+		status := AgentStatus{Agent: a, Status: StatusMissing}
+		if s, ok := inv.seen[id]; ok {
+			lastSeen := s.lastSeen
+			status.LastSeen = &lastSeen
+			if now.Sub(lastSeen) <= inv.missingAfter {
+				status.Status = StatusOnline
+			}
+			if len(s.mismatched) > 0 {
+				status.MismatchedLabels = make(map[string]string, len(s.mismatched))
+				for name, value := range s.mismatched {
+					status.MismatchedLabels[name] = value
+				}
+				report.Summary.Mismatched++
+			}
+		}
+		if status.Status == StatusOnline {
+			report.Summary.Online++
+		} else {
+			report.Summary.Missing++
+		}
+		report.Agents = append(report.Agents, status)
+	}
+	for id, s := range inv.seen {
+		if _, ok := inv.agents[id]; ok {
+			continue
+		}
+		if inv.retain > 0 && now.Sub(s.lastSeen) > inv.retain {
+			delete(inv.seen, id)
+			continue
+		}
+		report.Unknown = append(report.Unknown, UnknownAgent{AgentID: id, LastSeen: s.lastSeen})
+	}
+	report.Summary.Expected = len(report.Agents)
+	report.Summary.Unknown = len(report.Unknown)
+
+	sort.Slice(report.Agents, func(i, j int) bool { return report.Agents[i].ID < report.Agents[j].ID })
+	sort.Slice(report.Unknown, func(i, j int) bool {
+		if !report.Unknown[i].LastSeen.Equal(report.Unknown[j].LastSeen) {
+			return report.Unknown[i].LastSeen.After(report.Unknown[j].LastSeen)
+		}
+		return report.Unknown[i].AgentID < report.Unknown[j].AgentID
+	})
+	return report
+}
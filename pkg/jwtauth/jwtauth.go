@@ -0,0 +1,320 @@
+// Package jwtauth 按OIDC签发方的JWKS校验JWT，并把声明映射为角色
+package jwtauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// ErrInvalidToken 令牌格式、签名或声明校验失败
+var ErrInvalidToken = errors.New("invalid jwt")
+
+// minRefetchInterval 遇到未知kid时重新获取JWKS的最小间隔，避免伪造的kid导致频繁请求签发方
+const minRefetchInterval = time.Minute
+
+// maxJWKSSize JWKS和OIDC discovery响应的最大长度
+const maxJWKSSize = 1 << 20
+
+// signatureAlgorithms 接受的签名算法，不接受none和HMAC签名
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// Identity 通过校验的令牌代表的身份
+type Identity struct {
+	Subject string
+	// Roles 由角色声明映射得到的角色
+	Roles map[string]bool
+	// Agents 由agents_claim取出的可见Agent ID的glob模式，为空表示不限定
+	Agents []string
+}
+
+// HasRole 判断身份是否持有任一角色，nil表示未认证
+func (id *Identity) HasRole(roles ...string) bool {
+	if id == nil {
+		return false
+	}
+	for _, role := range roles {
+		if id.Roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleList 返回排序后的角色
+func (id *Identity) RoleList() []string {
+	if id == nil {
+		return nil
+	}
+	roles := make([]string, 0, len(id.Roles))
+	for role := range id.Roles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Verifier JWT校验器
+//
+// 签名公钥从jwks_url获取，未配置时按OIDC discovery从issuer的/.well-known/openid-configuration取得。
+// 公钥每隔refresh_interval重新获取，令牌使用未知的kid时也会提前获取(每分钟最多一次)，签发方轮换密钥后无需重启。
+// 签名和JWK的解析与校验使用go-jose，支持RS256/384/512、PS256/384/512、ES256/384/512和EdDSA签名，不接受none和HMAC签名。
+type Verifier struct {
+	cfg    config.JWTConfig
+	clk    clock.Clock
+	client *http.Client
+
+	mu      sync.Mutex
+	jwksURL string
+	// keys 按JWKS中的顺序保存，没有kid的公钥不会互相覆盖
+	keys    []jose.JSONWebKey
+	fetched time.Time
+}
+
+// NewVerifier 创建JWT校验器，issuer和jwks_url都未配置时返回错误
+func NewVerifier(cfg config.JWTConfig, clk clock.Clock) (*Verifier, error) {
+	if cfg.Issuer == "" && cfg.JWKSURL == "" {
+		return nil, errors.New("jwt: issuer or jwks_url is required")
+	}
+	return &Verifier{
+		cfg:     cfg,
+		clk:     clk,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		jwksURL: cfg.JWKSURL,
+	}, nil
+}
+
+// LooksLikeJWT 判断令牌是否为JWT格式，用于和静态令牌区分
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// Verify 校验令牌的签名、签发方、受众和有效期，返回令牌代表的身份
+func (v *Verifier) Verify(token string) (*Identity, error) {
+	tok, err := jwt.ParseSigned(token, signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	h := tok.Headers[0]
+
+	keys, err := v.keysFor(h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	for _, k := range keys {
+		// 密钥限定了算法时只校验该算法的签名
+		if k.Algorithm != "" && k.Algorithm != h.Algorithm {
+			continue
+		}
+		if err := tok.Claims(k.Key); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature verification failed", ErrInvalidToken)
+	}
+
+	// 签名已校验，解码声明
+	var std jwt.Claims
+	var claims map[string]interface{}
+	if err := tok.UnsafeClaimsWithoutVerification(&std, &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	if err := v.checkClaims(std); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	id := &Identity{Subject: std.Subject, Roles: v.roles(claims)}
+	if v.cfg.AgentsClaim != "" {
+		id.Agents = claimValues(claims, v.cfg.AgentsClaim)
+	}
+	return id, nil
+}
+
+// checkClaims 校验iss、aud、exp和nbf，时间比较允许leeway的误差，exp必须存在
+func (v *Verifier) checkClaims(claims jwt.Claims) error {
+	if claims.Expiry == nil {
+		return errors.New("exp claim is required")
+	}
+	expected := jwt.Expected{Issuer: v.cfg.Issuer, Time: v.clk.Now()}
+	if v.cfg.Audience != "" {
+		expected.AnyAudience = jwt.Audience{v.cfg.Audience}
+	}
+	return claims.ValidateWithLeeway(expected, v.cfg.Leeway)
+}
+
+// roles 按roles_claim取出声明的取值并按role_mapping映射为角色，未配置映射时取值本身就是角色
+func (v *Verifier) roles(claims map[string]interface{}) map[string]bool {
+	roles := make(map[string]bool)
+	for _, val := range claimValues(claims, v.cfg.RolesClaim) {
+		if v.cfg.RoleMapping == nil {
+			roles[val] = true
+			continue
+		}
+		for _, role := range v.cfg.RoleMapping[val] {
+			roles[role] = true
+		}
+	}
+	return roles
+}
+
+// claimValues 取出path指定的声明的字符串取值
+//
+// path可以用"."访问嵌套的声明，如realm_access.roles；取值为字符串时按空格分隔。
+func claimValues(claims map[string]interface{}, path string) []string {
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[key]
+	}
+
+	var values []string
+	switch val := value.(type) {
+	case string:
+		values = strings.Fields(val)
+	case []interface{}:
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// keysFor 返回可能签发令牌的公钥，kid为空时返回全部公钥
+func (v *Verifier) keysFor(kid string) ([]jose.JSONWebKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.clk.Now()
+	if v.keys == nil || now.Sub(v.fetched) >= v.cfg.RefreshInterval {
+		if err := v.fetch(); err != nil && v.keys == nil {
+			return nil, err
+		}
+	}
+	if kid == "" {
+		return v.keys, nil
+	}
+	keys := v.withKeyID(kid)
+	if len(keys) == 0 && now.Sub(v.fetched) >= minRefetchInterval {
+		// 签发方可能已轮换密钥，失败时继续使用已有的公钥
+		_ = v.fetch()
+		keys = v.withKeyID(kid)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: unknown key id %q", ErrInvalidToken, kid)
+	}
+	return keys, nil
+}
+
+// withKeyID 返回kid相同的公钥，调用方需持有锁
+func (v *Verifier) withKeyID(kid string) []jose.JSONWebKey {
+	var keys []jose.JSONWebKey
+	for _, k := range v.keys {
+		if k.KeyID == kid {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// fetch 获取JWKS，失败时保留已有的公钥，调用方需持有锁
+func (v *Verifier) fetch() error {
+	// 即使失败也记录时间，签发方不可用时不在每个请求上重试
+	v.fetched = v.clk.Now()
+
+	if v.jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.cfg.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("oidc discovery: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("oidc discovery: jwks_uri is missing")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := v.getJSON(v.jwksURL, &set); err != nil {
+		return fmt.Errorf("fetch jwks: %w", err)
+	}
+	keys := make([]jose.JSONWebKey, 0, len(set.Keys))
+	for _, raw := range set.Keys {
+		var k jose.JSONWebKey
+		if err := k.UnmarshalJSON(raw); err != nil {
+			// 跳过不支持的密钥类型
+			continue
+		}
+		// 只使用签名密钥的公钥部分，对称密钥的Public()无效而被跳过
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub := k.Public(); pub.Valid() {
+			keys = append(keys, pub)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("fetch jwks: no usable signing keys")
+	}
+	v.keys = keys
+	return nil
+}
+
+// getJSON 请求url并解码JSON响应
+func (v *Verifier) getJSON(url string, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), v.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(out)
+}
+
+type identityKey struct{}
+
+// NewContext 返回携带身份的context
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext 返回context中的身份，没有时返回nil
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
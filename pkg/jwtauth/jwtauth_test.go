@@ -0,0 +1,219 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+const testIssuer = "https://issuer.example"
+
+// testKeys 测试用的签名密钥
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// jwksServer 返回可替换内容的JWKS服务
+type jwksServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys []jose.JSONWebKey
+}
+
+func newJWKSServer(t *testing.T, keys ...jose.JSONWebKey) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKeys(keys ...jose.JSONWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func newTestVerifier(t *testing.T, jwksURL string, clk clock.Clock) *Verifier {
+	t.Helper()
+	v, err := NewVerifier(config.JWTConfig{
+		Issuer:          testIssuer,
+		JWKSURL:         jwksURL,
+		Audience:        "kon",
+		RolesClaim:      "roles",
+		Leeway:          30 * time.Second,
+		RefreshInterval: time.Hour,
+		Timeout:         5 * time.Second,
+	}, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// sign 用key按alg签发令牌，kid为空时不设置kid头
+func sign(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// TestVerify 校验签名算法与密钥、有效期、签发方、受众和kid
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	jwks := newJWKSServer(t,
+		jose.JSONWebKey{Key: &keys.rsa.PublicKey, KeyID: "rsa", Algorithm: string(jose.RS256), Use: "sig"},
+		jose.JSONWebKey{Key: &keys.ec.PublicKey, KeyID: "ec", Use: "sig"},
+	)
+	now := time.Unix(1_700_000_000, 0)
+	v := newTestVerifier(t, jwks.URL, clock.NewFake(now))
+
+	claims := func(edit func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   testIssuer,
+			"aud":   "kon",
+			"sub":   "alice",
+			"exp":   now.Add(time.Hour).Unix(),
+			"roles": []string{"admin"},
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	segment := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"rs256", sign(t, jose.RS256, keys.rsa, "rsa", claims(nil)), true},
+		{"es256", sign(t, jose.ES256, keys.ec, "ec", claims(nil)), true},
+		{"audience list", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "kon"} })), true},
+		{"expired within leeway", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-10 * time.Second).Unix() })), true},
+		{"alg does not match key type", sign(t, jose.ES256, keys.ec, "rsa", claims(nil)), false},
+		{"alg not allowed for key", sign(t, jose.PS256, keys.rsa, "rsa", claims(nil)), false},
+		{"signed by another key", sign(t, jose.RS256, newTestKeys(t).rsa, "rsa", claims(nil)), false},
+		{"hmac", sign(t, jose.HS256, []byte("0123456789abcdef0123456789abcdef"), "rsa", claims(nil)), false},
+		{"none", segment(map[string]string{"alg": "none", "kid": "rsa"}) + "." + segment(claims(nil)) + ".", false},
+		{"expired", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() })), false},
+		{"missing exp", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { delete(c, "exp") })), false},
+		{"not valid yet", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(5 * time.Minute).Unix() })), false},
+		{"nbf within leeway", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(10 * time.Second).Unix() })), true},
+		{"wrong audience", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { c["aud"] = "other" })), false},
+		{"missing audience", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { delete(c, "aud") })), false},
+		{"wrong issuer", sign(t, jose.ES256, keys.ec, "ec", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" })), false},
+		{"unknown kid", sign(t, jose.ES256, keys.ec, "missing", claims(nil)), false},
+		{"malformed", "eyJhbGciOiJSUzI1NiJ9.e30", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := v.Verify(tt.token)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("Verify() error = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if id.Subject != "alice" || !id.HasRole("admin") {
+				t.Fatalf("Verify() = %+v, want subject alice with role admin", id)
+			}
+		})
+	}
+}
+
+// TestRotatedKey 签发方轮换密钥后，未知kid的令牌在重新获取JWKS后通过校验，重新获取每分钟最多一次
+func TestRotatedKey(t *testing.T) {
+	oldKeys, newKeys := newTestKeys(t), newTestKeys(t)
+	jwks := newJWKSServer(t, jose.JSONWebKey{Key: &oldKeys.ec.PublicKey, KeyID: "v1"})
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	v := newTestVerifier(t, jwks.URL, clk)
+	claims := map[string]interface{}{"iss": testIssuer, "aud": "kon", "exp": clk.Now().Add(24 * time.Hour).Unix()}
+
+	if _, err := v.Verify(sign(t, jose.ES256, oldKeys.ec, "v1", claims)); err != nil {
+		t.Fatalf("old key: %v", err)
+	}
+
+	jwks.setKeys(jose.JSONWebKey{Key: &newKeys.ec.PublicKey, KeyID: "v2"})
+	rotated := sign(t, jose.ES256, newKeys.ec, "v2", claims)
+	if _, err := v.Verify(rotated); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("rotated key before refetch interval: error = %v, want ErrInvalidToken", err)
+	}
+
+	clk.Advance(minRefetchInterval)
+	if _, err := v.Verify(rotated); err != nil {
+		t.Fatalf("rotated key after refetch interval: %v", err)
+	}
+	if _, err := v.Verify(sign(t, jose.ES256, oldKeys.ec, "v1", claims)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("retired key: error = %v, want ErrInvalidToken", err)
+	}
+}
+
+// TestKeysWithoutKid JWKS中没有kid的多个公钥都可以校验没有kid的令牌
+func TestKeysWithoutKid(t *testing.T) {
+	keys := newTestKeys(t)
+	jwks := newJWKSServer(t,
+		jose.JSONWebKey{Key: &keys.rsa.PublicKey},
+		jose.JSONWebKey{Key: &keys.ec.PublicKey},
+	)
+	clk := clock.NewFake(time.Unix(1_700_000_000, 0))
+	v := newTestVerifier(t, jwks.URL, clk)
+	claims := map[string]interface{}{"iss": testIssuer, "aud": "kon", "exp": clk.Now().Add(time.Hour).Unix()}
+
+	if _, err := v.Verify(sign(t, jose.RS256, keys.rsa, "", claims)); err != nil {
+		t.Fatalf("rsa key: %v", err)
+	}
+	if _, err := v.Verify(sign(t, jose.ES256, keys.ec, "", claims)); err != nil {
+		t.Fatalf("ec key: %v", err)
+	}
+}
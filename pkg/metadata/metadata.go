@@ -0,0 +1,176 @@
+// Package metadata 记录指标的展示提示(单位、小数位数、推荐的图表类型)，供查询结果和界面使用
+package metadata
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// Agent声明提示使用的保留标签，写入存储前移除
+const (
+	UnitLabel     = "__unit__"
+	DecimalsLabel = "__decimals__"
+	ChartLabel    = "__chart__"
+)
+
+// maxDecimals 小数位数的上限
+const maxDecimals = 20
+
+// charts 支持的图表类型
+var charts = map[string]bool{
+	"line": true, "area": true, "bar": true, "gauge": true, "stat": true, "table": true, "heatmap": true,
+}
+
+// Hints 一个指标的展示提示，未设置的字段为空
+type Hints struct {
+	Unit     string `json:"unit,omitempty"`
+	Decimals *int   `json:"decimals,omitempty"`
+	Chart    string `json:"chart,omitempty"`
+}
+
+// IsZero 判断是否没有设置任何字段
+func (h Hints) IsZero() bool {
+	return h.Unit == "" && h.Decimals == nil && h.Chart == ""
+}
+
+// merge 用o中设置的字段覆盖h
+func (h Hints) merge(o Hints) Hints {
+	if o.Unit != "" {
+		h.Unit = o.Unit
+	}
+	if o.Decimals != nil {
+		h.Decimals = o.Decimals
+	}
+	if o.Chart != "" {
+		h.Chart = o.Chart
+	}
+	return h
+}
+
+// Registry 指标元数据注册表，同时作为处理阶段从指标上读取并移除Agent声明提示的保留标签
+//
+// 每个指标名的提示由Agent最近一次声明的各字段和第一个匹配的配置规则合并而成，
+// 配置规则中设置的字段优先。Agent的声明只保存在内存中，重启后需要Agent重新声明。
+type Registry struct {
+	rules []config.MetricHint
+
+	mu sync.RWMutex
+	// declared Agent声明的提示，按指标名索引
+	declared map[string]Hints
+	// resolved 合并后的提示，按写入过的指标名索引，没有提示的指标也记录以免重复匹配规则
+	resolved map[string]Hints
+}
+
+// NewRegistry 创建注册表，配置规则中的图表类型和小数位数无效时返回错误
+func NewRegistry(cfg config.MetadataConfig) (*Registry, error) {
+	for i, rule := range cfg.Hints {
+		if err := storage.ValidateGlob(rule.Metric); err != nil {
+			return nil, fmt.Errorf("hints[%d]: invalid metric pattern %q: %w", i, rule.Metric, err)
+		}
+		if rule.Chart != "" && !charts[rule.Chart] {
+			return nil, fmt.Errorf("hints[%d]: unknown chart type %q", i, rule.Chart)
+		}
+		if rule.Decimals != nil && (*rule.Decimals < 0 || *rule.Decimals > maxDecimals) {
+			return nil, fmt.Errorf("hints[%d]: decimals must be between 0 and %d", i, maxDecimals)
+		}
+	}
+	return &Registry{
+		rules:    cfg.Hints,
+		declared: make(map[string]Hints),
+		resolved: make(map[string]Hints),
+	}, nil
+}
+
+// Name 返回阶段名称
+func (r *Registry) Name() string {
+	return "metadata"
+}
+
+// Process 移除保留标签并记录其中声明的提示，无效的取值被忽略，不会丢弃指标
+func (r *Registry) Process(m *processor.ProcessedMetric) (bool, error) {
+	declared, ok := parseLabels(m.Labels)
+	if ok {
+		delete(m.Labels, UnitLabel)
+		delete(m.Labels, DecimalsLabel)
+		delete(m.Labels, ChartLabel)
+	}
+
+	if !ok || declared.IsZero() {
+		r.mu.RLock()
+		_, known := r.resolved[m.Name]
+		r.mu.RUnlock()
+		if known {
+			return true, nil
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !declared.IsZero() {
+		r.declared[m.Name] = r.declared[m.Name].merge(declared)
+	}
+	r.resolved[m.Name] = r.resolve(m.Name)
+	return true, nil
+}
+
+// Lookup 返回指标的提示，没有任何提示时返回false
+func (r *Registry) Lookup(name string) (Hints, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hints, ok := r.resolved[name]
+	if !ok {
+		// 尚未写入过的指标只匹配配置规则
+		hints = r.resolve(name)
+	}
+	return hints, !hints.IsZero()
+}
+
+// All 返回写入过的指标中有提示的指标，按指标名索引
+func (r *Registry) All() map[string]Hints {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make(map[string]Hints)
+	for name, hints := range r.resolved {
+		if !hints.IsZero() {
+			all[name] = hints
+		}
+	}
+	return all
+}
+
+// resolve 合并Agent声明的提示和第一个匹配的配置规则，调用方需持有锁
+func (r *Registry) resolve(name string) Hints {
+	hints := r.declared[name]
+	for _, rule := range r.rules {
+		if storage.MatchGlob(rule.Metric, name) {
+			return hints.merge(Hints{Unit: rule.Unit, Decimals: rule.Decimals, Chart: rule.Chart})
+		}
+	}
+	return hints
+}
+
+// parseLabels 读取保留标签中声明的提示，没有保留标签时返回false
+func parseLabels(labels map[string]string) (Hints, bool) {
+	unit, hasUnit := labels[UnitLabel]
+	decimals, hasDecimals := labels[DecimalsLabel]
+	chart, hasChart := labels[ChartLabel]
+	if !hasUnit && !hasDecimals && !hasChart {
+		return Hints{}, false
+	}
+
+	hints := Hints{Unit: unit}
+	if n, err := strconv.Atoi(decimals); err == nil && n >= 0 && n <= maxDecimals {
+		hints.Decimals = &n
+	}
+	if charts[chart] {
+		hints.Chart = chart
+	}
+	return hints, true
+}
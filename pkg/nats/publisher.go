@@ -0,0 +1,585 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// retentions 配置中的保留策略对应的JetStream取值
+var retentions = map[string]jetstream.RetentionPolicy{
+	"limits":    jetstream.LimitsPolicy,
+	"interest":  jetstream.InterestPolicy,
+	"workqueue": jetstream.WorkQueuePolicy,
+}
+
+// storages 配置中的存储方式对应的JetStream取值
+var storages = map[string]jetstream.StorageType{
+	"file":   jetstream.FileStorage,
+	"memory": jetstream.MemoryStorage,
+}
+
+// PublishStats 发布统计
+type PublishStats struct {
+	// Connected 当前是否已连接到服务器
+	Connected bool `json:"connected"`
+	// Queued 等待发布的指标数
+	Queued int `json:"queued"`
+	// Sent 已发布成功(启用JetStream时为已确认)的指标数
+	Sent uint64 `json:"sent_metrics"`
+	// Messages 已发布成功的消息数
+	Messages uint64 `json:"messages"`
+	// Failed 重试后仍发布失败而丢弃的指标数
+	Failed uint64 `json:"failed_metrics"`
+	// Dropped 队列已满而丢弃的指标数
+	Dropped uint64 `json:"dropped_metrics"`
+	// Retries 发布失败后的重试次数
+	Retries uint64 `json:"retries"`
+	// Connects 建立连接的次数
+	Connects  uint64     `json:"connects"`
+	LastSend  *time.Time `json:"last_send,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// permanentError 重试也不会成功的错误，如数据无法编码为JSON
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// message 发布到一个主题的一组指标，data为JSON数组
+type message struct {
+	subject string
+	metrics []processor.ProcessedMetric
+	data    []byte
+}
+
+// Publisher 把写入存储的数据发布到NATS，其他内部服务订阅主题即可获得数据，无需轮询HTTP接口
+//
+// 一批数据按主题分组，每个主题发布一条消息，内容是与查询接口相同格式的指标JSON数组。
+// 主题由subject模板生成，Agent ID和类型中的.、*、>和空白替换为下划线。
+// 启用JetStream时连接后自动创建或更新流，并异步发布后等待每条消息的确认，只重发未确认的消息。
+// 连接断开后不由客户端自动重连，而是在下一次发布时重新连接，以便按退避策略重试并统计。
+// Publish把数据放入队列后立即返回，队列满时丢弃新数据；后台协程攒够max_batch_size条或等待
+// batch_timeout后发布一批，失败时断开重连并按min_backoff到max_backoff指数退避重试。
+type Publisher struct {
+	cfg    config.NATSConfig
+	clock  clock.Clock
+	faults *chaos.Injector
+	// conn 和 js 只由后台协程使用
+	conn *nats.Conn
+	js   jetstream.JetStream
+
+	mu    sync.Mutex
+	queue []processor.ProcessedMetric
+	stats PublishStats
+	// asyncErr 服务器异步报告的错误(如没有发布权限)，由下一次发布返回
+	asyncErr error
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	// ctx 在Close超时时取消，中断正在进行的重试
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewPublisher 校验配置并启动后台发布协程，连接在第一次发布时建立，faults为nil时不注入故障
+func NewPublisher(cfg config.NATSConfig, clk clock.Clock, faults *chaos.Injector) (*Publisher, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("nats servers are empty")
+	}
+	for _, server := range cfg.Servers {
+		if _, err := parseServer(server); err != nil {
+			return nil, fmt.Errorf("invalid nats server %q: %w", redact(server), err)
+		}
+	}
+	if !validSubject(expandSubject(cfg.Subject, "agent", "type")) {
+		return nil, fmt.Errorf("invalid nats subject %q", cfg.Subject)
+	}
+	if js := cfg.JetStream; js.Enabled {
+		if js.Stream == "" || strings.ContainsAny(js.Stream, ".*> \t") {
+			return nil, fmt.Errorf("invalid jetstream stream name %q", js.Stream)
+		}
+		if _, ok := storages[js.Storage]; !ok {
+			return nil, fmt.Errorf("invalid jetstream storage %q", js.Storage)
+		}
+		if _, ok := retentions[js.Retention]; !ok {
+			return nil, fmt.Errorf("invalid jetstream retention %q", js.Retention)
+		}
+	}
+
+	p := &Publisher{
+		cfg:    cfg,
+		clock:  clk,
+		faults: faults,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	go p.run()
+	return p, nil
+}
+
+// Publish 把一批写入存储的数据放入发布队列，应在数据写入存储后调用
+func (p *Publisher) Publish(metrics []processor.ProcessedMetric) {
+	p.mu.Lock()
+	if room := p.cfg.QueueSize - len(p.queue); len(metrics) > room {
+		p.stats.Dropped += uint64(len(metrics) - max(room, 0))
+		metrics = metrics[:max(room, 0)]
+	}
+	p.queue = append(p.queue, metrics...)
+	full := len(p.queue) >= p.cfg.MaxBatchSize
+	p.mu.Unlock()
+
+	if full {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stats 返回发布统计
+func (p *Publisher) Stats() PublishStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Queued = len(p.queue)
+	return stats
+}
+
+// Close 发布队列中剩余的数据后断开连接，ctx结束时放弃未发布的数据
+func (p *Publisher) Close(ctx context.Context) error {
+	close(p.stop)
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		return fmt.Errorf("nats: %d metrics not published: %w", p.Stats().Queued, ctx.Err())
+	}
+}
+
+// run 后台发布协程
+func (p *Publisher) run() {
+	defer close(p.done)
+	defer p.disconnect()
+	ticker := time.NewTicker(p.cfg.BatchTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			p.flush(true)
+			return
+		case <-p.wake:
+			p.flush(false)
+		case <-ticker.C:
+			p.flush(true)
+		}
+	}
+}
+
+// flush 发布队列中的数据，all为false时只发布攒满max_batch_size条的批次
+func (p *Publisher) flush(all bool) {
+	for p.ctx.Err() == nil {
+		p.mu.Lock()
+		n := len(p.queue)
+		if n == 0 || (!all && n < p.cfg.MaxBatchSize) {
+			p.mu.Unlock()
+			return
+		}
+		batch := p.queue[:min(n, p.cfg.MaxBatchSize)]
+		p.queue = p.queue[len(batch):]
+		p.mu.Unlock()
+
+		p.send(batch)
+	}
+}
+
+// send 发布一批数据，失败时重连并指数退避重试未成功的消息
+func (p *Publisher) send(batch []processor.ProcessedMetric) {
+	msgs, err := p.group(batch)
+	if err == nil {
+		err = p.retry(&msgs)
+		if err == nil {
+			return
+		}
+	}
+
+	var failed []processor.ProcessedMetric
+	for _, m := range msgs {
+		failed = append(failed, m.metrics...)
+	}
+	p.discard(failed, err)
+}
+
+// discard 记录无法发布而丢弃的指标
+func (p *Publisher) discard(metrics []processor.ProcessedMetric, err error) {
+	p.mu.Lock()
+	p.stats.Failed += uint64(len(metrics))
+	p.stats.LastError = err.Error()
+	p.mu.Unlock()
+	log.Printf("Failed to publish %d metrics to NATS, dropping them: %v", len(metrics), err)
+}
+
+// retry 发布msgs，失败时指数退避重试，msgs更新为仍未成功的消息
+func (p *Publisher) retry(msgs *[]message) error {
+	backoff := p.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		var err error
+		if *msgs, err = p.publish(*msgs); err == nil {
+			return nil
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= p.cfg.MaxRetries {
+			return err
+		}
+
+		p.mu.Lock()
+		p.stats.Retries++
+		p.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-p.ctx.Done():
+			return err
+		}
+		backoff = min(backoff*2, p.cfg.MaxBackoff)
+	}
+}
+
+// group 按主题分组并编码一批数据，主题按第一次出现的顺序排列
+func (p *Publisher) group(batch []processor.ProcessedMetric) ([]message, error) {
+	type key struct{ agentID, typ string }
+	index := make(map[key]int)
+	var msgs []message
+	for i := range batch {
+		k := key{batch[i].AgentID, batch[i].Type}
+		j, ok := index[k]
+		if !ok {
+			j = len(msgs)
+			index[k] = j
+			msgs = append(msgs, message{subject: expandSubject(p.cfg.Subject, k.agentID, k.typ)})
+		}
+		msgs[j].metrics = append(msgs[j].metrics, batch[i])
+	}
+	for i := range msgs {
+		data, err := json.Marshal(msgs[i].metrics)
+		if err != nil {
+			return msgs, permanentError{err}
+		}
+		msgs[i].data = data
+	}
+	return msgs, nil
+}
+
+// publish 发布一组消息，返回未成功的消息和第一个错误
+func (p *Publisher) publish(msgs []message) ([]message, error) {
+	if err := p.faults.FailSend("nats"); err != nil {
+		return msgs, err
+	}
+	nc, err := p.connect()
+	if err != nil {
+		return msgs, err
+	}
+	maxPayload := nc.MaxPayload()
+	msgs, oversized := split(msgs, maxPayload)
+	for _, m := range oversized {
+		p.discard(m.metrics, fmt.Errorf("metric %s of agent %s exceeds server max_payload %d", m.metrics[0].Name, m.metrics[0].AgentID, maxPayload))
+	}
+
+	if !p.cfg.JetStream.Enabled {
+		for _, m := range msgs {
+			if err := nc.Publish(m.subject, m.data); err != nil {
+				return msgs, p.connError(err)
+			}
+		}
+		// 服务器按顺序处理，收到PONG说明之前的消息都已处理，权限错误也已报告
+		if err := nc.FlushTimeout(p.cfg.Timeout); err != nil {
+			return msgs, p.connError(err)
+		}
+		if err := p.takeAsyncErr(); err != nil {
+			return msgs, err
+		}
+		p.delivered(msgs)
+		return nil, nil
+	}
+
+	acks := make([]jetstream.PubAckFuture, len(msgs))
+	for i, m := range msgs {
+		ack, err := p.js.PublishAsync(m.subject, m.data)
+		if err != nil {
+			return msgs, p.connError(err)
+		}
+		acks[i] = ack
+	}
+
+	var pending, acked []message
+	var firstErr error
+	for i, m := range msgs {
+		// 超时由WithPublishAsyncTimeout保证，连接断开时同样返回错误
+		select {
+		case <-acks[i].Ok():
+			acked = append(acked, m)
+			continue
+		case err = <-acks[i].Err():
+		}
+		pending = append(pending, m)
+		if firstErr == nil {
+			firstErr = fmt.Errorf("jetstream publish: %w", err)
+		}
+	}
+	p.delivered(acked)
+	if firstErr != nil {
+		return pending, p.connError(firstErr)
+	}
+	return nil, nil
+}
+
+// delivered 记录发布成功的消息
+func (p *Publisher) delivered(msgs []message) {
+	if len(msgs) == 0 {
+		return
+	}
+	now := p.clock.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range msgs {
+		p.stats.Sent += uint64(len(m.metrics))
+	}
+	p.stats.Messages += uint64(len(msgs))
+	p.stats.LastSend = &now
+}
+
+// connect 返回可用的连接，没有时连接服务器，启用JetStream时确保流存在
+func (p *Publisher) connect() (*nats.Conn, error) {
+	if p.conn != nil {
+		if p.conn.IsConnected() {
+			return p.conn, nil
+		}
+		p.disconnect()
+	}
+
+	opts := []nats.Option{
+		nats.Name("kon-agent-export"),
+		nats.Timeout(p.cfg.Timeout),
+		nats.NoReconnect(),
+		nats.ErrorHandler(p.onAsyncError),
+	}
+	if p.cfg.Token != "" {
+		opts = append(opts, nats.Token(p.cfg.Token))
+	}
+	nc, err := nats.Connect(strings.Join(p.cfg.Servers, ","), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if p.cfg.JetStream.Enabled {
+		js, err := jetstream.New(nc, jetstream.WithPublishAsyncTimeout(p.cfg.Timeout))
+		if err == nil {
+			err = p.ensureStream(js)
+		}
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		p.js = js
+	}
+
+	p.conn = nc
+	p.mu.Lock()
+	p.stats.Connected = true
+	p.stats.Connects++
+	p.asyncErr = nil
+	p.mu.Unlock()
+	log.Printf("Connected to NATS server for publishing")
+	return nc, nil
+}
+
+// onAsyncError 记录服务器异步报告的错误，在客户端的回调协程中调用
+func (p *Publisher) onAsyncError(_ *nats.Conn, _ *nats.Subscription, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.asyncErr == nil {
+		p.asyncErr = fmt.Errorf("server error: %w", err)
+	}
+}
+
+// takeAsyncErr 返回并清除服务器异步报告的错误
+func (p *Publisher) takeAsyncErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.asyncErr
+	p.asyncErr = nil
+	return err
+}
+
+// connError 连接已断开时关闭连接，下一次发布时重连，返回err
+func (p *Publisher) connError(err error) error {
+	if p.conn != nil && !p.conn.IsConnected() {
+		p.disconnect()
+	}
+	return err
+}
+
+// disconnect 关闭当前连接
+func (p *Publisher) disconnect() {
+	if p.conn == nil {
+		return
+	}
+	p.conn.Close()
+	p.conn = nil
+	p.js = nil
+	p.mu.Lock()
+	p.stats.Connected = false
+	p.mu.Unlock()
+}
+
+// ensureStream 创建JetStream流，同名的流已存在且配置不同时按配置更新
+func (p *Publisher) ensureStream(js jetstream.JetStream) error {
+	cfg := p.cfg.JetStream
+	stream := jetstream.StreamConfig{
+		Name:      cfg.Stream,
+		Subjects:  cfg.Subjects,
+		Retention: retentions[cfg.Retention],
+		Storage:   storages[cfg.Storage],
+		Discard:   jetstream.DiscardOld,
+		MaxAge:    cfg.MaxAge,
+		MaxBytes:  unlimited(cfg.MaxBytes),
+		MaxMsgs:   unlimited(cfg.MaxMsgs),
+		Replicas:  cfg.Replicas,
+	}
+	if len(stream.Subjects) == 0 {
+		stream.Subjects = []string{streamSubject(p.cfg.Subject)}
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, p.cfg.Timeout)
+	defer cancel()
+	if _, err := js.CreateOrUpdateStream(ctx, stream); err != nil {
+		if errors.Is(err, jetstream.ErrJetStreamNotEnabled) || errors.Is(err, nats.ErrNoResponders) || errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("jetstream stream %s: no response from jetstream api, is jetstream enabled on the server?", cfg.Stream)
+		}
+		return fmt.Errorf("jetstream stream %s: %w", cfg.Stream, err)
+	}
+	return nil
+}
+
+// parseServer 解析服务器地址，缺少协议时为nats://，只支持nats://和tls://
+func parseServer(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "nats://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	return u, nil
+}
+
+// redact 去掉地址中的密码，用于错误信息
+func redact(server string) string {
+	u, err := parseServer(server)
+	if err != nil {
+		return server
+	}
+	return u.Redacted()
+}
+
+// split 把超过服务器max_payload的消息拆成多条，返回拆分后的消息和单个指标仍超过上限的消息
+func split(msgs []message, maxPayload int64) ([]message, []message) {
+	if maxPayload <= 0 {
+		return msgs, nil
+	}
+	var out, oversized []message
+	for _, m := range msgs {
+		if int64(len(m.data)) <= maxPayload {
+			out = append(out, m)
+			continue
+		}
+		if len(m.metrics) == 1 {
+			oversized = append(oversized, m)
+			continue
+		}
+		half := len(m.metrics) / 2
+		var parts []message
+		for _, metrics := range [][]processor.ProcessedMetric{m.metrics[:half], m.metrics[half:]} {
+			// 整组已编码成功，其中一部分也能编码
+			data, _ := json.Marshal(metrics)
+			parts = append(parts, message{subject: m.subject, metrics: metrics, data: data})
+		}
+		parts, tooLarge := split(parts, maxPayload)
+		out = append(out, parts...)
+		oversized = append(oversized, tooLarge...)
+	}
+	return out, oversized
+}
+
+// unlimited JetStream中-1表示不限制
+func unlimited(n int64) int64 {
+	if n <= 0 {
+		return -1
+	}
+	return n
+}
+
+// subjectToken 把取值转换为主题中的一段，.、*、>和空白替换为下划线
+func subjectToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '*' || r == '>' || r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// expandSubject 把模板中的{agent_id}和{type}替换为对应的主题段
+func expandSubject(template, agentID, typ string) string {
+	return strings.NewReplacer("{agent_id}", subjectToken(agentID), "{type}", subjectToken(typ)).Replace(template)
+}
+
+// streamSubject 由模板得出流包含的主题，含占位符的段替换为*
+func streamSubject(template string) string {
+	tokens := strings.Split(template, ".")
+	for i, t := range tokens {
+		if strings.Contains(t, "{") {
+			tokens[i] = "*"
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// validSubject 判断是否为可以发布的主题：各段非空，不含通配符和空白
+func validSubject(subject string) bool {
+	for _, t := range strings.Split(subject, ".") {
+		if t == "" || t == "*" || t == ">" || strings.ContainsAny(t, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
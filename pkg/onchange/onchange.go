@@ -0,0 +1,129 @@
+package onchange
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// Point 阶梯序列中的一个点
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// last 序列最近一次保存的样本
+type last struct {
+	value float64
+	time  time.Time
+}
+
+// Filter 只保存值变化超过阈值的样本的处理阶段，用于变化缓慢的gauge
+//
+// 未变化的样本被丢弃，查询时用Step按最近一次保存的值还原阶梯序列。
+// 规则设置了heartbeat时，即使值未变化也至少每隔heartbeat保存一次，
+// 以便区分"值未变化"和"序列已停止上报"。
+type Filter struct {
+	mu     sync.Mutex
+	rules  []config.OnChangeRule
+	series map[string]*last
+}
+
+// NewFilter 创建按规则过滤未变化样本的处理阶段
+func NewFilter(cfg config.OnChangeConfig) *Filter {
+	return &Filter{
+		rules:  cfg.Rules,
+		series: make(map[string]*last),
+	}
+}
+
+// Name 返回阶段名称
+func (f *Filter) Name() string {
+	return "store_on_change"
+}
+
+// Process 值相对上次保存的样本变化不超过delta且未到heartbeat时丢弃样本
+func (f *Filter) Process(m *processor.ProcessedMetric) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rule := f.match(m.AgentID, m.Name)
+	if rule == nil {
+		return true, nil
+	}
+
+	key := processor.SeriesKey(m)
+
+	prev, ok := f.series[key]
+	if ok && !m.Timestamp.Before(prev.time) {
+		changed := math.Abs(m.Value-prev.value) > rule.Delta || math.IsNaN(m.Value) != math.IsNaN(prev.value)
+		due := rule.Heartbeat > 0 && m.Timestamp.Sub(prev.time) >= rule.Heartbeat
+		if !changed && !due {
+			return false, nil
+		}
+	}
+	if !ok || !m.Timestamp.Before(prev.time) {
+		f.series[key] = &last{value: m.Value, time: m.Timestamp}
+	}
+	return true, nil
+}
+
+// Heartbeat 返回匹配规则的heartbeat，没有匹配的规则时返回false
+func (f *Filter) Heartbeat(agentID, metric string) (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rule := f.match(agentID, metric)
+	if rule == nil {
+		return 0, false
+	}
+	return rule.Heartbeat, true
+}
+
+// SetRules 替换规则，已保存的序列状态保留，值变化仍与上次保存的样本比较
+func (f *Filter) SetRules(rules []config.OnChangeRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = rules
+}
+
+// match 返回第一个匹配的规则，调用方需持有锁
+func (f *Filter) match(agentID, metric string) *config.OnChangeRule {
+	for i := range f.rules {
+		rule := &f.rules[i]
+		if storage.MatchGlob(rule.Agent, agentID) && storage.MatchGlob(rule.Metric, metric) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Step 用按时间升序排列的样本还原从start到end每隔step的阶梯序列
+//
+// 每个点取不晚于该时刻的最近样本的值；最近样本早于lookback时认为序列已中断，
+// 不输出该点。lookback<=0表示不限制。
+func Step(samples []processor.ProcessedMetric, start, end time.Time, step, lookback time.Duration) []Point {
+	points := make([]Point, 0)
+	if step <= 0 || end.Before(start) {
+		return points
+	}
+
+	i := -1
+	for t := start; !t.After(end); t = t.Add(step) {
+		for i+1 < len(samples) && !samples[i+1].Timestamp.After(t) {
+			i++
+		}
+		if i < 0 {
+			continue
+		}
+		if lookback > 0 && t.Sub(samples[i].Timestamp) > lookback {
+			continue
+		}
+		points = append(points, Point{Timestamp: t, Value: samples[i].Value})
+	}
+	return points
+}
@@ -0,0 +1,515 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/konpure/Kon-Agent-export/pkg/histogram"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ErrInvalidRequest 请求不是合法的ExportMetricsServiceRequest编码
+var ErrInvalidRequest = errors.New("invalid OTLP metrics request")
+
+// aggregationTemporalityCumulative AggregationTemporality.CUMULATIVE
+const aggregationTemporalityCumulative = 2
+
+// flagNoRecordedValue DataPointFlags.NO_RECORDED_VALUE，标记数据点没有取值(如序列已结束)，这样的数据点被忽略
+const flagNoRecordedValue = 1
+
+// field 消息中的一个字段，varint和fixed字段的值在n中，bytes字段的值在v中
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	v   []byte
+	n   uint64
+}
+
+// fields 依次处理消息中的字段，编码非法时返回ErrInvalidRequest
+func fields(data []byte, fn func(f field)) error {
+	for len(data) > 0 {
+		num, typ, l := protowire.ConsumeTag(data)
+		if l < 0 {
+			return ErrInvalidRequest
+		}
+		data = data[l:]
+
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.n, l = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			f.n, l = protowire.ConsumeFixed64(data)
+		case protowire.Fixed32Type:
+			var n uint32
+			n, l = protowire.ConsumeFixed32(data)
+			f.n = uint64(n)
+		case protowire.BytesType:
+			f.v, l = protowire.ConsumeBytes(data)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if l < 0 {
+			return ErrInvalidRequest
+		}
+		data = data[l:]
+		fn(f)
+	}
+	return nil
+}
+
+// decoder 把ExportMetricsServiceRequest转换为按Agent ID分组的指标
+type decoder struct {
+	r       *Receiver
+	batches map[string]*protocol.BatchMetricsRequest
+	order   []string
+	// rejected 无法转换的数据点数
+	rejected int
+	err      error
+}
+
+// decodeRequest 解码ExportMetricsServiceRequest
+//
+//	ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//	ResourceMetrics             { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//	Resource                    { repeated KeyValue attributes = 1; }
+//	ScopeMetrics                { repeated Metric metrics = 2; }
+func (d *decoder) decodeRequest(data []byte) error {
+	err := fields(data, func(f field) {
+		if f.num == 1 && f.typ == protowire.BytesType {
+			d.check(d.decodeResourceMetrics(f.v))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return d.err
+}
+
+// check 记录第一个错误
+func (d *decoder) check(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// decodeResourceMetrics 解码ResourceMetrics，先读取资源属性再处理其中的指标
+func (d *decoder) decodeResourceMetrics(data []byte) error {
+	var resource map[string]string
+	var scopes [][]byte
+	err := fields(data, func(f field) {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			d.check(fields(f.v, func(f field) {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					if resource == nil {
+						resource = make(map[string]string)
+					}
+					d.check(decodeKeyValue(f.v, resource))
+				}
+			}))
+		case f.num == 2 && f.typ == protowire.BytesType:
+			scopes = append(scopes, f.v)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	batch := d.batch(d.r.agentID(resource))
+	base := d.r.resourceLabels(resource)
+	for _, scope := range scopes {
+		err := fields(scope, func(f field) {
+			if f.num == 2 && f.typ == protowire.BytesType {
+				d.check(d.decodeMetric(f.v, batch, base))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch 返回Agent的批次
+func (d *decoder) batch(agentID string) *protocol.BatchMetricsRequest {
+	b, ok := d.batches[agentID]
+	if !ok {
+		b = &protocol.BatchMetricsRequest{AgentId: agentID}
+		d.batches[agentID] = b
+		d.order = append(d.order, agentID)
+	}
+	return b
+}
+
+// decodeMetric 解码Metric
+//
+//	Metric { string name = 1; oneof data { Gauge gauge = 5; Sum sum = 7; Histogram histogram = 9;
+//	         ExponentialHistogram exponential_histogram = 10; Summary summary = 11; } }
+//	Gauge/Summary        { repeated DataPoint data_points = 1; }
+//	Sum                  { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+//	(Exponential)Histogram { repeated DataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; }
+func (d *decoder) decodeMetric(data []byte, batch *protocol.BatchMetricsRequest, base map[string]string) error {
+	var name string
+	var kind protowire.Number
+	var body []byte
+	err := fields(data, func(f field) {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			name = string(f.v)
+		case f.typ == protowire.BytesType && (f.num == 5 || f.num == 7 || f.num == 9 || f.num == 10 || f.num == 11):
+			kind, body = f.num, f.v
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var points [][]byte
+	var temporality uint64
+	var monotonic bool
+	err = fields(body, func(f field) {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			points = append(points, f.v)
+		case f.num == 2 && f.typ == protowire.VarintType:
+			temporality = f.n
+		case f.num == 3 && f.typ == protowire.VarintType:
+			monotonic = f.n != 0
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// 累计的单调计数作为counter(NETWORK_PACKETS)，其余数值作为gauge(CPU_USAGE)
+	counterType := protocol.MetricType_CPU_USAGE
+	if temporality == aggregationTemporalityCumulative {
+		counterType = protocol.MetricType_NETWORK_PACKETS
+	}
+	for _, point := range points {
+		var err error
+		switch kind {
+		case 5:
+			err = d.numberPoint(batch, name, protocol.MetricType_CPU_USAGE, point, base)
+		case 7:
+			typ := protocol.MetricType_CPU_USAGE
+			if monotonic {
+				typ = counterType
+			}
+			err = d.numberPoint(batch, name, typ, point, base)
+		case 9:
+			err = d.histogramPoint(batch, name, counterType, point, base)
+		case 10:
+			err = d.exponentialPoint(batch, name, point, base)
+		case 11:
+			err = d.summaryPoint(batch, name, point, base)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// point 数据点的公共字段
+type point struct {
+	labels    map[string]string
+	timestamp int64
+	skip      bool
+}
+
+// decodePoint 读取数据点的属性、时间和标志，属性和标志的字段编号因数据点类型而异
+func decodePoint(f field, p *point, attrs, flags protowire.Number) error {
+	switch {
+	case f.num == attrs && f.typ == protowire.BytesType:
+		return decodeKeyValue(f.v, p.labels)
+	case f.num == 3 && f.typ == protowire.Fixed64Type:
+		p.timestamp = int64(f.n / 1e6)
+	case f.num == flags && f.typ == protowire.VarintType:
+		p.skip = f.n&flagNoRecordedValue != 0
+	}
+	return nil
+}
+
+// newPoint 创建带资源标签的数据点，数据点的属性覆盖同名的资源标签
+func newPoint(base map[string]string) point {
+	labels := make(map[string]string, len(base))
+	for k, v := range base {
+		labels[k] = v
+	}
+	return point{labels: labels}
+}
+
+// add 添加一条指标，extra中的标签覆盖数据点的同名标签；
+// 同一数据点转换出的多条指标各自复制标签，处理阶段可以原地修改
+func (d *decoder) add(batch *protocol.BatchMetricsRequest, p *point, name string, typ protocol.MetricType, value float64, extra ...string) {
+	labels := make(map[string]string, len(p.labels)+len(extra)/2)
+	for k, v := range p.labels {
+		labels[k] = v
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels[extra[i]] = extra[i+1]
+	}
+	batch.Metrics = append(batch.Metrics, &protocol.Metric{
+		Timestamp: p.timestamp,
+		Name:      name,
+		Value:     value,
+		Labels:    labels,
+		Type:      typ,
+	})
+}
+
+// numberPoint 转换NumberDataPoint
+//
+//	NumberDataPoint { repeated KeyValue attributes = 7; fixed64 time_unix_nano = 3;
+//	                  oneof value { double as_double = 4; sfixed64 as_int = 6; } uint32 flags = 8; }
+func (d *decoder) numberPoint(batch *protocol.BatchMetricsRequest, name string, typ protocol.MetricType, data []byte, base map[string]string) error {
+	p := newPoint(base)
+	var value float64
+	var hasValue bool
+	var perr error
+	err := fields(data, func(f field) {
+		switch {
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			value, hasValue = math.Float64frombits(f.n), true
+		case f.num == 6 && f.typ == protowire.Fixed64Type:
+			value, hasValue = float64(int64(f.n)), true
+		default:
+			if err := decodePoint(f, &p, 7, 8); err != nil && perr == nil {
+				perr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if perr != nil {
+		return perr
+	}
+	if p.skip {
+		return nil
+	}
+	if !hasValue {
+		d.rejected++
+		return nil
+	}
+	d.add(batch, &p, name, typ, value)
+	return nil
+}
+
+// histogramPoint 把HistogramDataPoint转换为Prometheus风格的_count、_sum和累计的_bucket{le}序列
+//
+//	HistogramDataPoint { repeated KeyValue attributes = 9; fixed64 time_unix_nano = 3; fixed64 count = 4; double sum = 5;
+//	                     repeated fixed64 bucket_counts = 6; repeated double explicit_bounds = 7; uint32 flags = 10; }
+func (d *decoder) histogramPoint(batch *protocol.BatchMetricsRequest, name string, typ protocol.MetricType, data []byte, base map[string]string) error {
+	p := newPoint(base)
+	var count uint64
+	var sum *float64
+	var counts []uint64
+	var bounds []float64
+	var perr error
+	err := fields(data, func(f field) {
+		switch {
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			count = f.n
+		case f.num == 5 && f.typ == protowire.Fixed64Type:
+			v := math.Float64frombits(f.n)
+			sum = &v
+		case f.num == 6 && f.typ == protowire.Fixed64Type:
+			counts = append(counts, f.n)
+		case f.num == 6 && f.typ == protowire.BytesType:
+			for b := f.v; len(b) >= 8; b = b[8:] {
+				v, _ := protowire.ConsumeFixed64(b)
+				counts = append(counts, v)
+			}
+		case f.num == 7 && f.typ == protowire.Fixed64Type:
+			bounds = append(bounds, math.Float64frombits(f.n))
+		case f.num == 7 && f.typ == protowire.BytesType:
+			for b := f.v; len(b) >= 8; b = b[8:] {
+				v, _ := protowire.ConsumeFixed64(b)
+				bounds = append(bounds, math.Float64frombits(v))
+			}
+		default:
+			if err := decodePoint(f, &p, 9, 10); err != nil && perr == nil {
+				perr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if perr != nil {
+		return perr
+	}
+	if p.skip {
+		return nil
+	}
+	if len(counts) > 0 && len(counts) != len(bounds)+1 {
+		d.rejected++
+		return nil
+	}
+
+	d.add(batch, &p, name+"_count", typ, float64(count))
+	if sum != nil {
+		d.add(batch, &p, name+"_sum", typ, *sum)
+	}
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		}
+		d.add(batch, &p, name+"_bucket", typ, float64(cumulative), "le", le)
+	}
+	return nil
+}
+
+// exponentialPoint 转换ExponentialHistogramDataPoint，去掉属性和exemplar后作为EXPONENTIAL_HISTOGRAM的payload
+//
+//	ExponentialHistogramDataPoint { repeated KeyValue attributes = 1; fixed64 time_unix_nano = 3; uint32 flags = 10; ... }
+func (d *decoder) exponentialPoint(batch *protocol.BatchMetricsRequest, name string, data []byte, base map[string]string) error {
+	p := newPoint(base)
+	var perr error
+	err := fields(data, func(f field) {
+		if err := decodePoint(f, &p, 1, 10); err != nil && perr == nil {
+			perr = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if perr != nil {
+		return perr
+	}
+	if p.skip {
+		return nil
+	}
+	h, err := histogram.Unmarshal(data)
+	if err != nil {
+		d.rejected++
+		return nil
+	}
+
+	var value float64
+	if h.Sum != nil {
+		value = *h.Sum
+	}
+	d.add(batch, &p, name, protocol.MetricType_EXPONENTIAL_HISTOGRAM, value)
+	batch.Metrics[len(batch.Metrics)-1].Payload = h.Marshal()
+	return nil
+}
+
+// summaryPoint 把SummaryDataPoint转换为_count、_sum和带quantile标签的分位数序列
+//
+//	SummaryDataPoint { repeated KeyValue attributes = 7; fixed64 time_unix_nano = 3; fixed64 count = 4; double sum = 5;
+//	                   repeated ValueAtQuantile quantile_values = 6; uint32 flags = 8; }
+//	ValueAtQuantile  { double quantile = 1; double value = 2; }
+func (d *decoder) summaryPoint(batch *protocol.BatchMetricsRequest, name string, data []byte, base map[string]string) error {
+	p := newPoint(base)
+	var count uint64
+	var sum float64
+	var quantiles [][2]float64
+	var perr error
+	err := fields(data, func(f field) {
+		switch {
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			count = f.n
+		case f.num == 5 && f.typ == protowire.Fixed64Type:
+			sum = math.Float64frombits(f.n)
+		case f.num == 6 && f.typ == protowire.BytesType:
+			var q [2]float64
+			if err := fields(f.v, func(f field) {
+				if (f.num == 1 || f.num == 2) && f.typ == protowire.Fixed64Type {
+					q[f.num-1] = math.Float64frombits(f.n)
+				}
+			}); err != nil && perr == nil {
+				perr = err
+			}
+			quantiles = append(quantiles, q)
+		default:
+			if err := decodePoint(f, &p, 7, 8); err != nil && perr == nil {
+				perr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if perr != nil {
+		return perr
+	}
+	if p.skip {
+		return nil
+	}
+
+	// Summary总是累计值
+	d.add(batch, &p, name+"_count", protocol.MetricType_NETWORK_PACKETS, float64(count))
+	d.add(batch, &p, name+"_sum", protocol.MetricType_NETWORK_PACKETS, sum)
+	for _, q := range quantiles {
+		d.add(batch, &p, name, protocol.MetricType_CPU_USAGE, q[1], "quantile", strconv.FormatFloat(q[0], 'g', -1, 64))
+	}
+	return nil
+}
+
+// decodeKeyValue 解码KeyValue放入labels，数组和键值列表等无法表示为字符串的值被跳过
+//
+//	KeyValue { string key = 1; AnyValue value = 2; }
+//	AnyValue { oneof value { string string_value = 1; bool bool_value = 2; int64 int_value = 3;
+//	           double double_value = 4; ArrayValue array_value = 5; KeyValueList kvlist_value = 6; bytes bytes_value = 7; } }
+func decodeKeyValue(data []byte, labels map[string]string) error {
+	var key, value string
+	var ok bool
+	err := fields(data, func(f field) {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			key = string(f.v)
+		case f.num == 2 && f.typ == protowire.BytesType:
+			value, ok = "", false
+			fields(f.v, func(f field) {
+				switch {
+				case f.num == 1 && f.typ == protowire.BytesType:
+					value, ok = string(f.v), true
+				case f.num == 2 && f.typ == protowire.VarintType:
+					value, ok = strconv.FormatBool(f.n != 0), true
+				case f.num == 3 && f.typ == protowire.VarintType:
+					value, ok = strconv.FormatInt(int64(f.n), 10), true
+				case f.num == 4 && f.typ == protowire.Fixed64Type:
+					value, ok = strconv.FormatFloat(math.Float64frombits(f.n), 'g', -1, 64), true
+				case f.num == 7 && f.typ == protowire.BytesType:
+					value, ok = base64.StdEncoding.EncodeToString(f.v), true
+				}
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if key != "" && ok {
+		labels[key] = value
+	}
+	return nil
+}
+
+// encodeResponse 编码ExportMetricsServiceResponse，有数据点被拒绝时填写partial_success
+//
+//	ExportMetricsServiceResponse { ExportMetricsPartialSuccess partial_success = 1; }
+//	ExportMetricsPartialSuccess  { int64 rejected_data_points = 1; string error_message = 2; }
+func encodeResponse(rejected int, message string) []byte {
+	if rejected == 0 {
+		return nil
+	}
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, message)
+
+	var buf []byte
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, partial)
+}
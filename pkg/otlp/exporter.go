@@ -0,0 +1,491 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// 导出协议
+const (
+	ProtocolHTTP = "http/protobuf"
+	ProtocolGRPC = "grpc"
+)
+
+// exportMethod MetricsService.Export的gRPC方法名
+const exportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// aggregationTemporalityDelta AggregationTemporality.DELTA
+const aggregationTemporalityDelta = 1
+
+// scopeName 导出数据的InstrumentationScope名称
+const scopeName = "github.com/konpure/Kon-Agent-export"
+
+// ExportStats 导出统计
+type ExportStats struct {
+	// Queued 等待发送的指标数
+	Queued int `json:"queued"`
+	// Sent 已发送成功的指标数
+	Sent uint64 `json:"sent_metrics"`
+	// Failed 重试后仍发送失败而丢弃的指标数
+	Failed uint64 `json:"failed_metrics"`
+	// Dropped 队列已满而丢弃的指标数
+	Dropped uint64 `json:"dropped_metrics"`
+	// Rejected 接收端在partial_success中报告拒绝的数据点数
+	Rejected uint64 `json:"rejected_data_points"`
+	// Retries 发送失败后的重试次数
+	Retries   uint64     `json:"retries"`
+	LastSend  *time.Time `json:"last_send,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// permanentError 重试也不会成功的错误，如请求被拒绝
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Exporter 把写入存储的数据转换为OTLP推送到OpenTelemetry Collector，使服务器可以接入下游的可观测性流水线
+//
+// 每个Agent是一个Resource，Agent ID写入agent_id_attribute资源属性。
+// NETWORK_PACKETS作为累计的单调Sum，指数直方图作为增量的ExponentialHistogram，其余类型作为Gauge。
+// Export把数据放入队列后立即返回，队列满时丢弃新数据；后台协程攒够max_batch_size条或等待
+// batch_timeout后发送一批，失败时按min_backoff到max_backoff指数退避重试，不可重试的错误直接丢弃。
+type Exporter struct {
+	cfg      config.OTLPExportConfig
+	client   *http.Client
+	conn     *grpc.ClientConn
+	compress codec.Codec
+	clock    clock.Clock
+	faults   *chaos.Injector
+
+	mu    sync.Mutex
+	queue []processor.ProcessedMetric
+	stats ExportStats
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	// ctx 在Close超时时取消，中断正在进行的重试
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewExporter 创建OTLP导出器并启动后台发送协程，faults为nil时不注入故障
+func NewExporter(cfg config.OTLPExportConfig, clk clock.Clock, faults *chaos.Injector) (*Exporter, error) {
+	compress, err := codec.Get(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		cfg:      cfg,
+		compress: compress,
+		clock:    clk,
+		faults:   faults,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	switch cfg.Protocol {
+	case ProtocolHTTP:
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid otlp_export endpoint %q", cfg.Endpoint)
+		}
+		e.client = &http.Client{Timeout: cfg.Timeout}
+	case ProtocolGRPC:
+		if compress.Name() != codec.None && compress.Name() != codec.Gzip {
+			return nil, fmt.Errorf("otlp_export compression %q is not supported over grpc", cfg.Compression)
+		}
+		creds := credentials.NewTLS(&tls.Config{})
+		if cfg.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		opts := []grpc.CallOption{grpc.ForceCodec(rawCodec{})}
+		if compress.Name() == codec.Gzip {
+			opts = append(opts, grpc.UseCompressor("gzip"))
+		}
+		e.conn, err = grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds), grpc.WithDefaultCallOptions(opts...))
+		if err != nil {
+			return nil, fmt.Errorf("invalid otlp_export endpoint %q: %w", cfg.Endpoint, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid otlp_export protocol %q", cfg.Protocol)
+	}
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	go e.run()
+	return e, nil
+}
+
+// Export 把一批写入存储的数据放入发送队列，应在数据写入存储后调用
+func (e *Exporter) Export(metrics []processor.ProcessedMetric) {
+	e.mu.Lock()
+	if room := e.cfg.QueueSize - len(e.queue); len(metrics) > room {
+		e.stats.Dropped += uint64(len(metrics) - max(room, 0))
+		metrics = metrics[:max(room, 0)]
+	}
+	e.queue = append(e.queue, metrics...)
+	full := len(e.queue) >= e.cfg.MaxBatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stats 返回导出统计
+func (e *Exporter) Stats() ExportStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := e.stats
+	stats.Queued = len(e.queue)
+	return stats
+}
+
+// Close 发送队列中剩余的数据后停止，ctx结束时放弃未发送的数据
+func (e *Exporter) Close(ctx context.Context) error {
+	close(e.stop)
+	defer func() {
+		if e.conn != nil {
+			e.conn.Close()
+		}
+	}()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		e.cancel()
+		<-e.done
+		return fmt.Errorf("otlp_export: %d metrics not sent: %w", e.Stats().Queued, ctx.Err())
+	}
+}
+
+// run 后台发送协程
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.cfg.BatchTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			e.flush(true)
+			return
+		case <-e.wake:
+			e.flush(false)
+		case <-ticker.C:
+			e.flush(true)
+		}
+	}
+}
+
+// flush 发送队列中的数据，all为false时只发送攒满max_batch_size条的批次
+func (e *Exporter) flush(all bool) {
+	for e.ctx.Err() == nil {
+		e.mu.Lock()
+		n := len(e.queue)
+		if n == 0 || (!all && n < e.cfg.MaxBatchSize) {
+			e.mu.Unlock()
+			return
+		}
+		batch := e.queue[:min(n, e.cfg.MaxBatchSize)]
+		e.queue = e.queue[len(batch):]
+		e.mu.Unlock()
+
+		e.send(batch)
+	}
+}
+
+// send 发送一批数据，失败时指数退避重试
+func (e *Exporter) send(batch []processor.ProcessedMetric) {
+	body := e.encodeRequest(batch)
+	backoff := e.cfg.MinBackoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var rejected int64
+		if rejected, err = e.post(body); err == nil {
+			now := e.clock.Now()
+			e.mu.Lock()
+			e.stats.Sent += uint64(len(batch))
+			e.stats.Rejected += uint64(rejected)
+			e.stats.LastSend = &now
+			e.mu.Unlock()
+			return
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= e.cfg.MaxRetries {
+			break
+		}
+
+		e.mu.Lock()
+		e.stats.Retries++
+		e.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-e.ctx.Done():
+		}
+		if e.ctx.Err() != nil {
+			break
+		}
+		backoff = min(backoff*2, e.cfg.MaxBackoff)
+	}
+
+	e.mu.Lock()
+	e.stats.Failed += uint64(len(batch))
+	e.stats.LastError = err.Error()
+	e.mu.Unlock()
+	log.Printf("Failed to export %d metrics to OTLP endpoint, dropping them: %v", len(batch), err)
+}
+
+// post 发送一次请求，返回接收端报告拒绝的数据点数
+func (e *Exporter) post(body []byte) (int64, error) {
+	if err := e.faults.FailSend("otlp_export"); err != nil {
+		return 0, err
+	}
+	if e.conn != nil {
+		return e.postGRPC(body)
+	}
+	return e.postHTTP(body)
+}
+
+// postHTTP 按OTLP/HTTP发送，429、502、503、504可以重试，其余非2xx响应为permanentError
+func (e *Exporter) postHTTP(body []byte) (int64, error) {
+	if e.compress.Name() != codec.None {
+		compressed, err := codec.Compress(e.compress, body)
+		if err != nil {
+			return 0, permanentError{err}
+		}
+		body = compressed
+	}
+
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if e.compress.Name() != codec.None {
+		req.Header.Set("Content-Encoding", e.compress.Name())
+	}
+	req.Header.Set("User-Agent", "kon-agent-export")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 == 2 {
+		return decodeResponse(data), nil
+	}
+
+	err = fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(data[:min(len(data), 512)])))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return 0, err
+	}
+	return 0, permanentError{err}
+}
+
+// postGRPC 按OTLP/gRPC发送，只有规范中列出的状态码可以重试
+func (e *Exporter) postGRPC(body []byte) (int64, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.cfg.Timeout)
+	defer cancel()
+	for k, v := range e.cfg.Headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(k), v)
+	}
+
+	var resp []byte
+	err := e.conn.Invoke(ctx, exportMethod, &body, &resp)
+	if err == nil {
+		return decodeResponse(resp), nil
+	}
+	switch status.Code(err) {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return 0, err
+	}
+	return 0, permanentError{err}
+}
+
+// decodeResponse 返回ExportMetricsServiceResponse中partial_success报告拒绝的数据点数
+func decodeResponse(data []byte) int64 {
+	var rejected int64
+	fields(data, func(f field) {
+		if f.num == 1 && f.typ == protowire.BytesType {
+			fields(f.v, func(f field) {
+				if f.num == 1 && f.typ == protowire.VarintType {
+					rejected = int64(f.n)
+				}
+			})
+		}
+	})
+	return rejected
+}
+
+// encodeRequest 编码ExportMetricsServiceRequest，每个Agent一个ResourceMetrics，同名同类型的数据合并为一个Metric
+func (e *Exporter) encodeRequest(batch []processor.ProcessedMetric) []byte {
+	type metricKey struct {
+		name string
+		typ  protocol.MetricType
+	}
+	type resource struct {
+		metrics map[metricKey][]*processor.ProcessedMetric
+		order   []metricKey
+	}
+	resources := make(map[string]*resource)
+	var agents []string
+	for i := range batch {
+		m := &batch[i]
+		r, ok := resources[m.AgentID]
+		if !ok {
+			r = &resource{metrics: make(map[metricKey][]*processor.ProcessedMetric)}
+			resources[m.AgentID] = r
+			agents = append(agents, m.AgentID)
+		}
+		key := metricKey{m.Name, m.RawType}
+		if _, ok := r.metrics[key]; !ok {
+			r.order = append(r.order, key)
+		}
+		r.metrics[key] = append(r.metrics[key], m)
+	}
+
+	var buf, rm, scope, metric, data []byte
+	for _, agentID := range agents {
+		r := resources[agentID]
+
+		scope = protowire.AppendTag(scope[:0], 1, protowire.BytesType)
+		scope = protowire.AppendBytes(scope, protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), scopeName))
+		for _, key := range r.order {
+			data = data[:0]
+			for _, m := range r.metrics[key] {
+				data = protowire.AppendTag(data, 1, protowire.BytesType)
+				data = protowire.AppendBytes(data, encodePoint(m))
+			}
+			var kind protowire.Number
+			switch key.typ {
+			case protocol.MetricType_NETWORK_PACKETS:
+				kind = 7
+				data = protowire.AppendTag(data, 2, protowire.VarintType)
+				data = protowire.AppendVarint(data, aggregationTemporalityCumulative)
+				data = protowire.AppendTag(data, 3, protowire.VarintType)
+				data = protowire.AppendVarint(data, 1)
+			case protocol.MetricType_EXPONENTIAL_HISTOGRAM:
+				kind = 10
+				data = protowire.AppendTag(data, 2, protowire.VarintType)
+				data = protowire.AppendVarint(data, aggregationTemporalityDelta)
+			default:
+				kind = 5
+			}
+			metric = protowire.AppendTag(metric[:0], 1, protowire.BytesType)
+			metric = protowire.AppendString(metric, key.name)
+			metric = protowire.AppendTag(metric, kind, protowire.BytesType)
+			metric = protowire.AppendBytes(metric, data)
+			scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+			scope = protowire.AppendBytes(scope, metric)
+		}
+
+		rm = protowire.AppendTag(rm[:0], 1, protowire.BytesType)
+		rm = protowire.AppendBytes(rm, e.encodeResource(agentID))
+		rm = protowire.AppendTag(rm, 2, protowire.BytesType)
+		rm = protowire.AppendBytes(rm, scope)
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, rm)
+	}
+	return buf
+}
+
+// encodeResource 编码Resource，包括Agent ID和resource_attributes，属性按名称排序
+func (e *Exporter) encodeResource(agentID string) []byte {
+	names := make([]string, 0, len(e.cfg.ResourceAttributes))
+	for k := range e.cfg.ResourceAttributes {
+		if k != e.cfg.AgentIDAttribute {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	b := appendKeyValue(nil, 1, e.cfg.AgentIDAttribute, agentID)
+	for _, k := range names {
+		b = appendKeyValue(b, 1, k, e.cfg.ResourceAttributes[k])
+	}
+	return b
+}
+
+// encodePoint 编码数据点，指数直方图在payload(ExponentialHistogramDataPoint)后追加属性和时间，
+// 其余类型编码为NumberDataPoint
+func encodePoint(m *processor.ProcessedMetric) []byte {
+	attrs := protowire.Number(7)
+	var b []byte
+	if m.RawType == protocol.MetricType_EXPONENTIAL_HISTOGRAM {
+		attrs = 1
+		b = append(b, m.Payload...)
+	}
+
+	names := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		b = appendKeyValue(b, attrs, k, m.Labels[k])
+	}
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(m.Timestamp.UnixNano()))
+	if m.RawType != protocol.MetricType_EXPONENTIAL_HISTOGRAM {
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(m.Value))
+	}
+	return b
+}
+
+// appendKeyValue 追加字符串类型的KeyValue字段
+func appendKeyValue(b []byte, num protowire.Number, key, value string) []byte {
+	var av []byte
+	av = protowire.AppendTag(av, 1, protowire.BytesType)
+	av = protowire.AppendString(av, value)
+
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, av)
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, kv)
+}
@@ -0,0 +1,205 @@
+package otlp
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // OTLP exporter默认使用gzip压缩
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Result 一次导出请求的接入结果
+type Result struct {
+	// Accepted 写入存储的指标数
+	Accepted int
+	// Rejected 无法转换或被处理器丢弃的数据点数
+	Rejected int
+	// Response 编码后的ExportMetricsServiceResponse
+	Response []byte
+}
+
+// Receiver OpenTelemetry OTLP指标接收器
+//
+// 把ExportMetricsServiceRequest中的数据点转换为指标，经过与QUIC相同的处理器写入存储。
+// Agent ID取资源属性中agent_id_attributes的第一个非空值，都没有时为default_agent_id；
+// 数据点属性作为标签，resource_labels中的资源属性也作为标签。
+// Gauge和非单调Sum作为CPU_USAGE，累计的单调Sum作为NETWORK_PACKETS；
+// Histogram转换为_count、_sum和_bucket{le}，Summary转换为_count、_sum和{quantile}，
+// ExponentialHistogram原样作为EXPONENTIAL_HISTOGRAM。
+type Receiver struct {
+	processor         processor.Processor
+	storage           storage.Storage
+	agentIDAttributes []string
+	defaultAgentID    string
+	labels            []string
+	token             string
+	maxMessageSize    int
+	server            *grpc.Server
+}
+
+// NewReceiver 创建OTLP接收器，storage应触发接入钩子
+func NewReceiver(cfg config.OTLPConfig, processor processor.Processor, storage storage.Storage) *Receiver {
+	r := &Receiver{
+		processor:         processor,
+		storage:           storage,
+		agentIDAttributes: cfg.AgentIDAttributes,
+		defaultAgentID:    cfg.DefaultAgentID,
+		labels:            cfg.ResourceLabels,
+		token:             cfg.Token,
+		maxMessageSize:    cfg.MaxMessageSize,
+	}
+	r.server = grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.MaxRecvMsgSize(cfg.MaxMessageSize))
+	r.server.RegisterService(&serviceDesc, r)
+	return r
+}
+
+// MaxMessageSize 返回请求的最大长度
+func (r *Receiver) MaxMessageSize() int {
+	return r.maxMessageSize
+}
+
+// Authorize 校验请求的Bearer令牌，未配置token时总是通过
+func (r *Receiver) Authorize(header string) bool {
+	if r.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(r.token)) == 1
+}
+
+// Export 接入一个protobuf编码的ExportMetricsServiceRequest，请求编码非法时返回ErrInvalidRequest
+func (r *Receiver) Export(data []byte) (*Result, error) {
+	d := &decoder{r: r, batches: make(map[string]*protocol.BatchMetricsRequest)}
+	if err := d.decodeRequest(data); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Rejected: d.rejected}
+	for _, agentID := range d.order {
+		batch := d.batches[agentID]
+		if len(batch.Metrics) == 0 {
+			continue
+		}
+		processed, err := r.processor.ProcessBatchRequest(batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process batch: %w", err)
+		}
+		if err := r.storage.SaveMetrics(processed); err != nil {
+			return nil, fmt.Errorf("failed to save batch: %w", err)
+		}
+		result.Accepted += len(processed)
+		// 处理器会丢弃校验失败的数据
+		result.Rejected += len(batch.Metrics) - len(processed)
+	}
+	if result.Rejected > 0 {
+		result.Response = encodeResponse(result.Rejected, "data points could not be converted or were dropped by the processor")
+	}
+	return result, nil
+}
+
+// agentID 返回资源对应的Agent ID
+func (r *Receiver) agentID(resource map[string]string) string {
+	for _, attr := range r.agentIDAttributes {
+		if id := resource[attr]; id != "" {
+			return id
+		}
+	}
+	return r.defaultAgentID
+}
+
+// resourceLabels 返回作为标签的资源属性
+func (r *Receiver) resourceLabels(resource map[string]string) map[string]string {
+	labels := make(map[string]string, len(r.labels))
+	for _, attr := range r.labels {
+		if v, ok := resource[attr]; ok {
+			labels[attr] = v
+		}
+	}
+	return labels
+}
+
+// rawCodec 不解析消息体的gRPC编解码器，消息由decoder按OTLP的protobuf定义解码
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) { return *v.(*[]byte), nil }
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// serviceDesc opentelemetry.proto.collector.metrics.v1.MetricsService
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Export",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			var req []byte
+			if err := dec(&req); err != nil {
+				return nil, err
+			}
+			return srv.(*Receiver).exportGRPC(ctx, req)
+		},
+	}},
+	Metadata: "opentelemetry/proto/collector/metrics/v1/metrics_service.proto",
+}
+
+// exportGRPC 处理OTLP/gRPC的Export调用
+func (r *Receiver) exportGRPC(ctx context.Context, req []byte) (*[]byte, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if !r.Authorize(strings.Join(md.Get("authorization"), "")) {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	result, err := r.Export(req)
+	if errors.Is(err, ErrInvalidRequest) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		// 存储暂时不可用，客户端可以重试
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &result.Response, nil
+}
+
+// Start 在addr上启动OTLP/gRPC服务，阻塞直到服务停止
+func (r *Receiver) Start(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	log.Printf("OTLP gRPC receiver starting on %s", addr)
+	return r.server.Serve(lis)
+}
+
+// Stop 停止OTLP/gRPC服务，等待进行中的请求结束，ctx到期后强制关闭
+func (r *Receiver) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.server.Stop()
+		return ctx.Err()
+	}
+}
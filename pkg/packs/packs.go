@@ -0,0 +1,383 @@
+package packs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/atomicfile"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/relabel"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema 当前规则包格式，格式不兼容变化时递增
+const Schema = "kon-pack/v1"
+
+// 规则包错误
+var (
+	ErrPackNotFound  = errors.New("pack not found")
+	ErrQueryNotFound = errors.New("saved query not found")
+	ErrDowngrade     = errors.New("pack is older than the installed version")
+)
+
+var (
+	namePattern    = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	versionPattern = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)$`)
+)
+
+// Pack 可在不同部署之间共享的一组告警规则、处理规则和保存的查询
+//
+// 告警规则即上报新鲜度SLA规则，处理规则即relabel和store_on_change规则，与配置文件中的格式相同。
+type Pack struct {
+	Schema      string                `yaml:"schema" json:"schema"`
+	Name        string                `yaml:"name" json:"name"`
+	Version     string                `yaml:"version" json:"version"`
+	Description string                `yaml:"description,omitempty" json:"description,omitempty"`
+	SLARules    []config.SLARule      `yaml:"sla_rules,omitempty" json:"-"`
+	Relabel     []config.RelabelRule  `yaml:"relabel,omitempty" json:"-"`
+	OnChange    []config.OnChangeRule `yaml:"store_on_change,omitempty" json:"-"`
+	Queries     []SavedQuery          `yaml:"queries,omitempty" json:"-"`
+	InstalledAt time.Time             `yaml:"installed_at,omitempty" json:"-"`
+}
+
+// SavedQuery 保存的查询，Path为 /api/v1 下的查询接口，Params为查询参数
+type SavedQuery struct {
+	Name        string            `yaml:"name" json:"name"`
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Path        string            `yaml:"path" json:"path"`
+	Params      map[string]string `yaml:"params,omitempty" json:"params,omitempty"`
+}
+
+// Summary 已安装规则包的概要
+type Summary struct {
+	Name        string    `json:"name"`
+	Version     string    `json:"version"`
+	Description string    `json:"description,omitempty"`
+	SLARules    int       `json:"sla_rules"`
+	Relabel     int       `json:"relabel_rules"`
+	OnChange    int       `json:"store_on_change_rules"`
+	Queries     int       `json:"queries"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// Query 带所属规则包的保存查询
+type Query struct {
+	Pack string `json:"pack"`
+	SavedQuery
+}
+
+// Manager 管理已安装的规则包，每个规则包保存为目录下的一个YAML文件
+//
+// 安装、卸载后调用变更钩子，由调用方把规则包中的规则应用到对应模块。
+type Manager struct {
+	mu    sync.RWMutex
+	dir   string
+	clock clock.Clock
+	packs map[string]*Pack
+	hooks []func([]Pack)
+}
+
+// NewManager 创建规则包管理器并加载目录中已安装的规则包
+func NewManager(cfg config.PacksConfig, clk clock.Clock) (*Manager, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create packs dir: %w", err)
+	}
+
+	m := &Manager{
+		dir:   cfg.Dir,
+		clock: clk,
+		packs: make(map[string]*Pack),
+	}
+
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pack, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		m.packs[pack.Name] = pack
+	}
+	return m, nil
+}
+
+// Parse 解析并校验YAML或JSON格式的规则包
+func Parse(data []byte) (*Pack, error) {
+	var pack Pack
+	if err := yaml.Unmarshal(data, &pack); err != nil {
+		return nil, fmt.Errorf("invalid pack: %w", err)
+	}
+	if err := pack.validate(); err != nil {
+		return nil, err
+	}
+	return &pack, nil
+}
+
+// OnChange 注册规则包变化时调用的钩子，参数为按名称排序的所有已安装规则包
+func (m *Manager) OnChange(hook func([]Pack)) {
+	m.mu.Lock()
+	m.hooks = append(m.hooks, hook)
+	m.mu.Unlock()
+
+	hook(m.Packs())
+}
+
+// Install 安装或升级规则包，版本低于已安装版本时需要force
+func (m *Manager) Install(pack *Pack, force bool) error {
+	if err := pack.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if old, ok := m.packs[pack.Name]; ok && !force && compareVersions(pack.Version, old.Version) < 0 {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s %s < %s", ErrDowngrade, pack.Name, pack.Version, old.Version)
+	}
+
+	installed := *pack
+	installed.InstalledAt = m.clock.Now().UTC()
+	data, err := marshal(&installed)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	if err := atomicfile.Write(m.path(pack.Name), data); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	m.packs[pack.Name] = &installed
+	m.mu.Unlock()
+
+	log.Printf("Installed pack %s %s", pack.Name, pack.Version)
+	m.notify()
+	return nil
+}
+
+// Remove 卸载规则包
+func (m *Manager) Remove(name string) error {
+	m.mu.Lock()
+	if _, ok := m.packs[name]; !ok {
+		m.mu.Unlock()
+		return ErrPackNotFound
+	}
+	if err := os.Remove(m.path(name)); err != nil && !os.IsNotExist(err) {
+		m.mu.Unlock()
+		return err
+	}
+	delete(m.packs, name)
+	m.mu.Unlock()
+
+	log.Printf("Removed pack %s", name)
+	m.notify()
+	return nil
+}
+
+// Export 导出规则包，结果可以直接在其他部署中安装
+func (m *Manager) Export(name string) ([]byte, error) {
+	m.mu.RLock()
+	pack, ok := m.packs[name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrPackNotFound
+	}
+
+	exported := *pack
+	exported.InstalledAt = time.Time{}
+	return marshal(&exported)
+}
+
+// List 返回已安装规则包的概要，按名称排序
+func (m *Manager) List() []Summary {
+	packs := m.Packs()
+	summaries := make([]Summary, 0, len(packs))
+	for _, p := range packs {
+		summaries = append(summaries, Summary{
+			Name:        p.Name,
+			Version:     p.Version,
+			Description: p.Description,
+			SLARules:    len(p.SLARules),
+			Relabel:     len(p.Relabel),
+			OnChange:    len(p.OnChange),
+			Queries:     len(p.Queries),
+			InstalledAt: p.InstalledAt,
+		})
+	}
+	return summaries
+}
+
+// Packs 返回所有已安装的规则包，按名称排序
+func (m *Manager) Packs() []Pack {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	packs := make([]Pack, 0, len(m.packs))
+	for _, p := range m.packs {
+		packs = append(packs, *p)
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].Name < packs[j].Name })
+	return packs
+}
+
+// Queries 返回所有规则包中保存的查询
+func (m *Manager) Queries() []Query {
+	queries := make([]Query, 0)
+	for _, p := range m.Packs() {
+		for _, q := range p.Queries {
+			queries = append(queries, Query{Pack: p.Name, SavedQuery: q})
+		}
+	}
+	return queries
+}
+
+// Query 按规则包和名称查找保存的查询
+func (m *Manager) Query(pack, name string) (Query, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, ok := m.packs[pack]
+	if !ok {
+		return Query{}, ErrQueryNotFound
+	}
+	for _, q := range p.Queries {
+		if q.Name == name {
+			return Query{Pack: p.Name, SavedQuery: q}, nil
+		}
+	}
+	return Query{}, ErrQueryNotFound
+}
+
+// SLARules 在配置的规则之后追加规则包中的新鲜度规则，配置的规则优先匹配
+func SLARules(base []config.SLARule, packs []Pack) []config.SLARule {
+	rules := append([]config.SLARule(nil), base...)
+	for _, p := range packs {
+		rules = append(rules, p.SLARules...)
+	}
+	return rules
+}
+
+// RelabelRules 在配置的规则之后追加规则包中的relabel规则，按规则包名称的顺序执行
+func RelabelRules(base []config.RelabelRule, packs []Pack) []config.RelabelRule {
+	rules := append([]config.RelabelRule(nil), base...)
+	for _, p := range packs {
+		rules = append(rules, p.Relabel...)
+	}
+	return rules
+}
+
+// OnChangeRules 在配置的规则之后追加规则包中的store_on_change规则，配置的规则优先匹配
+func OnChangeRules(base []config.OnChangeRule, packs []Pack) []config.OnChangeRule {
+	rules := append([]config.OnChangeRule(nil), base...)
+	for _, p := range packs {
+		rules = append(rules, p.OnChange...)
+	}
+	return rules
+}
+
+// notify 调用变更钩子
+func (m *Manager) notify() {
+	m.mu.RLock()
+	hooks := m.hooks
+	m.mu.RUnlock()
+
+	packs := m.Packs()
+	for _, hook := range hooks {
+		hook(packs)
+	}
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.dir, name+".yaml")
+}
+
+// validate 校验规则包，并为新鲜度规则填充与配置文件相同的默认值
+func (p *Pack) validate() error {
+	if p.Schema != Schema {
+		return fmt.Errorf("unsupported pack schema %q, expected %q", p.Schema, Schema)
+	}
+	if !namePattern.MatchString(p.Name) {
+		return fmt.Errorf("invalid pack name %q", p.Name)
+	}
+	if !versionPattern.MatchString(p.Version) {
+		return fmt.Errorf("invalid pack version %q, expected MAJOR.MINOR.PATCH", p.Version)
+	}
+
+	for i := range p.SLARules {
+		rule := &p.SLARules[i]
+		if rule.Interval < 0 || rule.Grace < 0 {
+			return fmt.Errorf("sla rule %d: interval and grace must not be negative", i)
+		}
+		if rule.Interval == 0 {
+			rule.Interval = time.Minute
+		}
+	}
+	if err := relabel.Validate(p.Relabel); err != nil {
+		return err
+	}
+	for i, rule := range p.OnChange {
+		if rule.Delta < 0 || rule.Heartbeat < 0 {
+			return fmt.Errorf("store_on_change rule %d: delta and heartbeat must not be negative", i)
+		}
+	}
+
+	seen := make(map[string]bool, len(p.Queries))
+	for _, q := range p.Queries {
+		if !namePattern.MatchString(q.Name) {
+			return fmt.Errorf("invalid query name %q", q.Name)
+		}
+		if seen[q.Name] {
+			return fmt.Errorf("duplicate query %q", q.Name)
+		}
+		seen[q.Name] = true
+		if !strings.HasPrefix(q.Path, "/api/v1/") {
+			return fmt.Errorf("query %s: path must start with /api/v1/", q.Name)
+		}
+	}
+	return nil
+}
+
+// compareVersions 比较两个MAJOR.MINOR.PATCH版本号
+func compareVersions(a, b string) int {
+	pa, pb := versionPattern.FindStringSubmatch(a), versionPattern.FindStringSubmatch(b)
+	for i := 1; i <= 3; i++ {
+		x, _ := strconv.Atoi(pa[i])
+		y, _ := strconv.Atoi(pb[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// marshal 按配置文件的缩进格式编码规则包
+func marshal(pack *Pack) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(pack); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
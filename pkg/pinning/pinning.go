@@ -0,0 +1,267 @@
+// Package pinning 在Agent首次连接时记录其客户端证书指纹(TOFU)，之后同一Agent ID的身份变化时告警或拒绝
+package pinning
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/atomicfile"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// 身份变化时的处理方式
+const (
+	ModeAlert = "alert"
+	ModeDeny  = "deny"
+)
+
+// maxMismatches 保留的最近身份变化记录条数
+const maxMismatches = 200
+
+// ErrIdentityChanged Agent的身份与固定的指纹不一致
+var ErrIdentityChanged = errors.New("agent identity changed")
+
+// Identity 连接的身份，Agent未提供客户端证书时Fingerprint为空
+type Identity struct {
+	// Fingerprint 客户端证书(DER)的SHA-256，格式为 sha256:<hex>
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Subject 客户端证书的CN，仅用于展示
+	Subject string `json:"subject,omitempty"`
+}
+
+// FromTLS 由TLS连接状态生成身份，服务器只请求不校验客户端证书，指纹只能用于识别变化
+func FromTLS(state tls.ConnectionState) Identity {
+	if len(state.PeerCertificates) == 0 {
+		return Identity{}
+	}
+	cert := state.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	return Identity{
+		Fingerprint: "sha256:" + hex.EncodeToString(sum[:]),
+		Subject:     cert.Subject.CommonName,
+	}
+}
+
+// Pin 固定的Agent身份
+type Pin struct {
+	AgentID string `json:"agent_id"`
+	Identity
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// RemoteIP 固定时的对端IP
+	RemoteIP string `json:"remote_ip,omitempty"`
+}
+
+// Mismatch 一次身份变化记录
+type Mismatch struct {
+	Time     time.Time `json:"time"`
+	AgentID  string    `json:"agent_id"`
+	Expected Identity  `json:"expected"`
+	Actual   Identity  `json:"actual"`
+	RemoteIP string    `json:"remote_ip,omitempty"`
+	// Denied 是否拒绝了该连接的数据
+	Denied bool `json:"denied"`
+}
+
+// Stats 固定和身份变化的计数
+type Stats struct {
+	Pinned     int    `json:"pinned"`
+	Mismatches uint64 `json:"mismatches"`
+	Denied     uint64 `json:"denied"`
+}
+
+// Registry 记录每个Agent ID首次出现时的身份，配置了文件时在固定和删除后保存
+//
+// 首次没有提供客户端证书的Agent按无证书固定，之后提供证书时自动改为固定该证书，
+// 已固定证书的Agent更换证书或不再提供证书都视为身份变化。更换证书前需先删除原来的固定记录。
+type Registry struct {
+	mu         sync.Mutex
+	clock      clock.Clock
+	deny       bool
+	file       string
+	pins       map[string]*Pin
+	mismatches []Mismatch
+	stats      Stats
+}
+
+// NewRegistry 创建指纹固定记录，mode无效或无法读取已保存的文件时返回错误
+func NewRegistry(cfg config.PinningConfig, clk clock.Clock) (*Registry, error) {
+	if cfg.Mode != ModeAlert && cfg.Mode != ModeDeny {
+		return nil, fmt.Errorf("invalid pinning mode %q, must be %s or %s", cfg.Mode, ModeAlert, ModeDeny)
+	}
+
+	r := &Registry{
+		clock: clk,
+		deny:  cfg.Mode == ModeDeny,
+		file:  cfg.File,
+		pins:  make(map[string]*Pin),
+	}
+	if r.file == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(r.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pins: %w", err)
+	}
+	var pins []*Pin
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("failed to parse pins %s: %w", r.file, err)
+	}
+	for _, pin := range pins {
+		r.pins[pin.AgentID] = pin
+	}
+	return r, nil
+}
+
+// Check 检查Agent的身份，首次出现时固定，与固定的身份不一致时记录变化，
+// deny模式下返回ErrIdentityChanged，调用方应丢弃数据并关闭连接
+func (r *Registry) Check(agentID string, id Identity, remoteIP string) error {
+	if agentID == "" {
+		return nil
+	}
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pin, ok := r.pins[agentID]
+	switch {
+	case !ok:
+		r.pins[agentID] = &Pin{AgentID: agentID, Identity: id, FirstSeen: now, LastSeen: now, RemoteIP: remoteIP}
+		log.Printf("Pinned agent %s to %s", agentID, describe(id))
+		r.save()
+		return nil
+	case pin.Fingerprint == id.Fingerprint:
+		pin.LastSeen = now
+		return nil
+	case pin.Fingerprint == "":
+		// 无证书的固定不能识别冒充，Agent开始提供证书时直接固定该证书
+		log.Printf("Agent %s presented a client certificate, re-pinned to %s", agentID, describe(id))
+		pin.Identity = id
+		pin.LastSeen = now
+		pin.RemoteIP = remoteIP
+		r.save()
+		return nil
+	}
+
+	r.stats.Mismatches++
+	if r.deny {
+		r.stats.Denied++
+	}
+	log.Printf("Agent %s identity changed: pinned %s, got %s from %s (denied: %t)",
+		agentID, describe(pin.Identity), describe(id), remoteIP, r.deny)
+	r.mismatches = append(r.mismatches, Mismatch{
+		Time:     now,
+		AgentID:  agentID,
+		Expected: pin.Identity,
+		Actual:   id,
+		RemoteIP: remoteIP,
+		Denied:   r.deny,
+	})
+	if len(r.mismatches) > maxMismatches {
+		r.mismatches = r.mismatches[len(r.mismatches)-maxMismatches:]
+	}
+
+	if r.deny {
+		return fmt.Errorf("%w: %s", ErrIdentityChanged, agentID)
+	}
+	return nil
+}
+
+// Pins 返回所有固定记录，按Agent ID排序
+func (r *Registry) Pins() []Pin {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]Pin, 0, len(r.pins))
+	for _, pin := range r.pins {
+		result = append(result, *pin)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].AgentID < result[j].AgentID
+	})
+	return result
+}
+
+// Forget 删除Agent的固定记录，Agent下次连接时重新固定，记录不存在时返回false
+func (r *Registry) Forget(agentID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.pins[agentID]; !ok {
+		return false
+	}
+	delete(r.pins, agentID)
+	log.Printf("Removed identity pin for agent %s", agentID)
+	r.save()
+	return true
+}
+
+// Mismatches 返回最近的身份变化记录，最新的在前
+func (r *Registry) Mismatches() []Mismatch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]Mismatch, len(r.mismatches))
+	for i, m := range r.mismatches {
+		result[len(r.mismatches)-1-i] = m
+	}
+	return result
+}
+
+// Stats 返回计数快照
+func (r *Registry) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.Pinned = len(r.pins)
+	return stats
+}
+
+// save 保存固定记录，调用方需持有锁。保存失败只记录日志，内存中的记录仍然有效
+func (r *Registry) save() {
+	if r.file == "" {
+		return
+	}
+	pins := make([]*Pin, 0, len(r.pins))
+	for _, pin := range r.pins {
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].AgentID < pins[j].AgentID
+	})
+
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err == nil {
+		err = atomicfile.Write(r.file, data)
+	}
+	if err != nil {
+		log.Printf("Failed to save agent identity pins to %s: %v", r.file, err)
+	}
+}
+
+// describe 返回用于日志的身份描述
+func describe(id Identity) string {
+	if id.Fingerprint == "" {
+		return "no client certificate"
+	}
+	if id.Subject == "" {
+		return id.Fingerprint
+	}
+	return fmt.Sprintf("%s (CN=%s)", id.Fingerprint, id.Subject)
+}
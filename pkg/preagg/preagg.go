@@ -0,0 +1,253 @@
+package preagg
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 聚合函数
+const (
+	FuncAvg   = "avg"
+	FuncMin   = "min"
+	FuncMax   = "max"
+	FuncSum   = "sum"
+	FuncCount = "count"
+	FuncLast  = "last"
+)
+
+// window 一个序列正在聚合的窗口
+type window struct {
+	rule *config.PreAggregateRule
+	// start 窗口起点，按样本时间戳对齐到Window
+	start time.Time
+	// opened 收到窗口第一个样本的服务器时间，按此判断窗口何时关闭，不受Agent时钟偏差影响
+	opened time.Time
+	// first 窗口第一个样本，输出的数据沿用其Agent、标签、类型和接入来源
+	first processor.ProcessedMetric
+	count int
+	sum   float64
+	min   float64
+	max   float64
+	last  float64
+	// lastTime 窗口内时间戳最晚的样本时间
+	lastTime time.Time
+}
+
+// Aggregator 写入存储前把高频序列按窗口预聚合，避免亚秒级上报的gauge占满存储容量
+//
+// 匹配规则的样本不直接写入，而是在内存中累计到所在窗口；序列出现下一个窗口的样本，
+// 或窗口打开后超过Window+Grace时，按规则的每个函数输出一条时间戳为窗口起点的数据。
+// 带直方图负载的样本和早于当前窗口的迟到样本原样写入。
+type Aggregator struct {
+	mu     sync.Mutex
+	rules  []config.PreAggregateRule
+	grace  time.Duration
+	clk    clock.Clock
+	write  func([]processor.ProcessedMetric) error
+	series map[string]*window
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAggregator 创建预聚合器，write用于写入到期的窗口，规则中有不支持的函数时返回错误
+func NewAggregator(cfg config.PreAggregateConfig, clk clock.Clock, write func([]processor.ProcessedMetric) error) (*Aggregator, error) {
+	interval := cfg.Grace
+	for _, rule := range cfg.Rules {
+		if rule.Window <= 0 {
+			return nil, fmt.Errorf("pre_aggregate rule %s: window must be positive", rule.Metric)
+		}
+		if len(rule.Funcs) == 0 {
+			return nil, fmt.Errorf("pre_aggregate rule %s: funcs is required", rule.Metric)
+		}
+		for _, fn := range rule.Funcs {
+			switch fn {
+			case FuncAvg, FuncMin, FuncMax, FuncSum, FuncCount, FuncLast:
+			default:
+				return nil, fmt.Errorf("pre_aggregate rule %s: unsupported func %q", rule.Metric, fn)
+			}
+		}
+		interval = min(interval, rule.Window)
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	a := &Aggregator{
+		rules:  cfg.Rules,
+		grace:  cfg.Grace,
+		clk:    clk,
+		write:  write,
+		series: make(map[string]*window),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go a.run(interval)
+	return a, nil
+}
+
+// Add 累计匹配规则的样本，返回需要立即写入的数据：不匹配的样本、迟到样本和因新窗口开始而关闭的窗口
+func (a *Aggregator) Add(metrics []processor.ProcessedMetric) []processor.ProcessedMetric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.clk.Now()
+	out := make([]processor.ProcessedMetric, 0, len(metrics))
+	for i := range metrics {
+		m := &metrics[i]
+		rule := a.match(m)
+		if rule == nil {
+			out = append(out, *m)
+			continue
+		}
+
+		start := m.Timestamp.Truncate(rule.Window)
+		key := processor.SeriesKey(m)
+		w, ok := a.series[key]
+		switch {
+		case ok && start.Equal(w.start):
+		case ok && start.Before(w.start):
+			// 所在窗口已经写入，保留原始样本
+			out = append(out, *m)
+			continue
+		default:
+			if ok {
+				out = append(out, w.emit()...)
+			}
+			w = &window{rule: rule, start: start, opened: now, first: *m}
+			a.series[key] = w
+		}
+		w.add(m)
+	}
+	return out
+}
+
+// Pending 返回正在聚合的窗口数
+func (a *Aggregator) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.series)
+}
+
+// Close 停止定时检查，写入所有未关闭的窗口
+func (a *Aggregator) Close() error {
+	close(a.stop)
+	<-a.done
+
+	a.mu.Lock()
+	out := a.expire(time.Time{}, true)
+	a.mu.Unlock()
+	if len(out) == 0 {
+		return nil
+	}
+	return a.write(out)
+}
+
+// run 定时写入到期的窗口，使停止上报的序列的最后一个窗口也能写入
+func (a *Aggregator) run(interval time.Duration) {
+	defer close(a.done)
+	ticker := a.clk.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C():
+			a.mu.Lock()
+			out := a.expire(a.clk.Now(), false)
+			a.mu.Unlock()
+			if len(out) == 0 {
+				continue
+			}
+			if err := a.write(out); err != nil {
+				log.Printf("Failed to write %d pre-aggregated metrics: %v", len(out), err)
+			}
+		}
+	}
+}
+
+// expire 取出打开时间超过Window+Grace的窗口，all为true时取出全部，调用方需持有锁
+func (a *Aggregator) expire(now time.Time, all bool) []processor.ProcessedMetric {
+	keys := make([]string, 0)
+	for key, w := range a.series {
+		if all || now.Sub(w.opened) >= w.rule.Window+a.grace {
+			keys = append(keys, key)
+		}
+	}
+	// 按序列排序，写入顺序稳定
+	sort.Strings(keys)
+
+	var out []processor.ProcessedMetric
+	for _, key := range keys {
+		out = append(out, a.series[key].emit()...)
+		delete(a.series, key)
+	}
+	return out
+}
+
+// match 返回第一个匹配的规则，带直方图负载的样本不聚合，调用方需持有锁
+func (a *Aggregator) match(m *processor.ProcessedMetric) *config.PreAggregateRule {
+	if len(m.Payload) > 0 {
+		return nil
+	}
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if storage.MatchGlob(rule.Agent, m.AgentID) && storage.MatchGlob(rule.Metric, m.Name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// add 累计一个样本
+func (w *window) add(m *processor.ProcessedMetric) {
+	if w.count == 0 {
+		w.min, w.max = m.Value, m.Value
+	}
+	w.count++
+	w.sum += m.Value
+	w.min = math.Min(w.min, m.Value)
+	w.max = math.Max(w.max, m.Value)
+	if !m.Timestamp.Before(w.lastTime) {
+		w.last = m.Value
+		w.lastTime = m.Timestamp
+	}
+}
+
+// emit 按规则的每个函数输出一条数据，第一个函数沿用原指标名
+func (w *window) emit() []processor.ProcessedMetric {
+	out := make([]processor.ProcessedMetric, 0, len(w.rule.Funcs))
+	for i, fn := range w.rule.Funcs {
+		m := w.first
+		m.Timestamp = w.start
+		if i > 0 {
+			m.Name = w.first.Name + "_" + fn
+		}
+		switch fn {
+		case FuncAvg:
+			m.Value = w.sum / float64(w.count)
+		case FuncMin:
+			m.Value = w.min
+		case FuncMax:
+			m.Value = w.max
+		case FuncSum:
+			m.Value = w.sum
+		case FuncCount:
+			m.Value = float64(w.count)
+		case FuncLast:
+			m.Value = w.last
+		}
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,192 @@
+package processor
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// 处理阶段错误
+var (
+	ErrStageTimeout  = errors.New("stage timed out")
+	ErrStageBypassed = errors.New("stage bypassed by circuit breaker")
+	ErrMetricTimeout = errors.New("metric processing timed out")
+)
+
+// guardedStage 为处理阶段加上并发限制、超时和熔断
+//
+// 超时和截止时间使用系统时间而不是注入的时钟，冻结时钟时仍然有效。
+type guardedStage struct {
+	stage Stage
+	cfg   config.StageConfig
+	clock clock.Clock
+	sem   chan struct{}
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newGuardedStage(stage Stage, cfg config.StageConfig, clk clock.Clock) *guardedStage {
+	g := &guardedStage{
+		stage: stage,
+		cfg:   cfg,
+		clock: clk,
+	}
+	if cfg.Workers > 0 {
+		g.sem = make(chan struct{}, cfg.Workers)
+	}
+	return g
+}
+
+// process 执行阶段，deadline为指标整体处理的截止时间，零值表示不限制
+func (g *guardedStage) process(metric *ProcessedMetric, deadline time.Time) (bool, error) {
+	if !g.allow() {
+		return true, ErrStageBypassed
+	}
+
+	timeout := g.cfg.Timeout
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return true, ErrMetricTimeout
+		}
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	if timeout == 0 {
+		if g.sem != nil {
+			g.sem <- struct{}{}
+			defer func() { <-g.sem }()
+		}
+		keep, err := g.stage.Process(metric)
+		g.record(err)
+		return keep, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if g.sem != nil {
+		select {
+		case g.sem <- struct{}{}:
+		case <-timer.C:
+			g.record(ErrStageTimeout)
+			return true, ErrStageTimeout
+		}
+	}
+
+	// 在副本上执行，超时后阶段仍在运行也不会修改原指标
+	work := *metric
+	if metric.Labels != nil {
+		work.Labels = make(map[string]string, len(metric.Labels))
+		for k, v := range metric.Labels {
+			work.Labels[k] = v
+		}
+	}
+
+	type result struct {
+		keep bool
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if g.sem != nil {
+			defer func() { <-g.sem }()
+		}
+		keep, err := g.stage.Process(&work)
+		done <- result{keep, err}
+	}()
+
+	select {
+	case r := <-done:
+		g.record(r.err)
+		if r.err == nil {
+			*metric = work
+		}
+		return r.keep, r.err
+	case <-timer.C:
+		g.record(ErrStageTimeout)
+		return true, ErrStageTimeout
+	}
+}
+
+// allow 判断熔断器是否放行，熔断到期后只放行一个探测请求
+func (g *guardedStage) allow() bool {
+	if g.cfg.BreakerThreshold <= 0 {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.failures < g.cfg.BreakerThreshold {
+		return true
+	}
+	if g.probing || g.clock.Now().Before(g.openUntil) {
+		return false
+	}
+	g.probing = true
+	return true
+}
+
+// record 记录执行结果，连续失败达到阈值时打开熔断器
+func (g *guardedStage) record(err error) {
+	if g.cfg.BreakerThreshold <= 0 {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.probing = false
+	if err == nil {
+		if g.failures >= g.cfg.BreakerThreshold {
+			log.Printf("Stage %s recovered, circuit breaker closed", g.stage.Name())
+		}
+		g.failures = 0
+		return
+	}
+
+	g.failures++
+	if g.failures >= g.cfg.BreakerThreshold {
+		g.openUntil = g.clock.Now().Add(g.cfg.BreakerCooldown)
+		if g.failures == g.cfg.BreakerThreshold {
+			log.Printf("Stage %s failed %d times in a row, bypassing for %s: %v",
+				g.stage.Name(), g.failures, g.cfg.BreakerCooldown, err)
+		}
+	}
+}
+
+// parallel 用最多workers个协程对0..n-1执行fn
+func (p *DefaultProcessor) parallel(n int, fn func(i int)) {
+	workers := p.workers
+	if workers > n {
+		workers = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
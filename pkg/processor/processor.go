@@ -1,9 +1,16 @@
 package processor
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/histogram"
 	"github.com/konpure/Kon-Agent-export/pkg/protocol"
 )
 
@@ -17,6 +24,42 @@ type ProcessedMetric struct {
 	Type      string              `json:"type"`
 	RawType   protocol.MetricType `json:"-"`
 	Payload   []byte              `json:"payload,omitempty"`
+	// Provenance 接入来源，同一批数据共享同一个值，未记录时为nil
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// Provenance 一批数据的接入来源，用于追查可疑数据
+type Provenance struct {
+	// BatchID 批次标识，同一批写入的数据相同
+	BatchID  string `json:"batch_id"`
+	ConnID   string `json:"conn_id,omitempty"`
+	Listener string `json:"listener,omitempty"`
+	SourceIP string `json:"source_ip,omitempty"`
+	// ReceivedAt 读完数据帧的时间
+	ReceivedAt time.Time `json:"received_at"`
+	// DecodeDuration 解码数据帧的耗时
+	DecodeDuration time.Duration `json:"decode_duration_ns"`
+}
+
+// SeriesKey 由Agent ID、指标名和按名称排序的标签组成的序列标识，各组成部分以\x00分隔
+func SeriesKey(m *ProcessedMetric) string {
+	var b strings.Builder
+	b.WriteString(m.AgentID)
+	b.WriteByte(0)
+	b.WriteString(m.Name)
+
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(m.Labels[k])
+	}
+	return b.String()
 }
 
 // Processor 数据处理接口
@@ -25,32 +68,79 @@ type Processor interface {
 	ProcessSingleMetric(agentID string, metric *protocol.Metric) (*ProcessedMetric, error)
 }
 
+// Stage 处理阶段接口，在指标校验和转换之后依次执行
+type Stage interface {
+	// Name 返回阶段名称，用于日志
+	Name() string
+	// Process 处理单个指标，可以原地修改指标；返回false表示丢弃该指标
+	Process(metric *ProcessedMetric) (bool, error)
+}
+
 // DefaultProcessor 默认数据处理器
-type DefaultProcessor struct{}
+type DefaultProcessor struct {
+	stages        []*guardedStage
+	workers       int
+	metricTimeout time.Duration
+}
 
 // NewDefaultProcessor 创建默认数据处理器
 func NewDefaultProcessor() Processor {
-	return &DefaultProcessor{}
+	return NewDefaultProcessorWithClock(clock.Real())
+}
+
+// NewDefaultProcessorWithClock 创建数据处理器，stages按顺序执行，时钟用于处理阶段的熔断计时
+func NewDefaultProcessorWithClock(clk clock.Clock, stages ...Stage) Processor {
+	return NewDefaultProcessorWithConfig(clk, config.ProcessorConfig{Workers: 1}, stages...)
+}
+
+// NewDefaultProcessorWithConfig 创建按配置限制并发、超时和熔断的数据处理器，stages按顺序执行
+func NewDefaultProcessorWithConfig(clk clock.Clock, cfg config.ProcessorConfig, stages ...Stage) Processor {
+	p := &DefaultProcessor{
+		workers:       cfg.Workers,
+		metricTimeout: cfg.MetricTimeout,
+	}
+	if p.workers < 1 {
+		p.workers = 1
+	}
+	for _, stage := range stages {
+		p.stages = append(p.stages, newGuardedStage(stage, cfg.Stages[stage.Name()], clk))
+	}
+	return p
 }
 
 // ProcessBatchRequest 处理批量监控数据请求
 func (p *DefaultProcessor) ProcessBatchRequest(req *protocol.BatchMetricsRequest) ([]ProcessedMetric, error) {
-	processedMetrics := make([]ProcessedMetric, 0, len(req.Metrics))
+	results := make([]*ProcessedMetric, len(req.Metrics))
 
 	// 处理每个监控数据
-	for _, metric := range req.Metrics {
-		processedMetric, err := p.ProcessSingleMetric(req.AgentId, metric)
+	process := func(i int) {
+		processedMetric, err := p.ProcessSingleMetric(req.AgentId, req.Metrics[i])
 		if err != nil {
 			log.Printf("Failed to process metric: %v", err)
-			continue
+			return
+		}
+		results[i] = processedMetric
+	}
+	if p.workers > 1 && len(req.Metrics) > 1 {
+		p.parallel(len(req.Metrics), process)
+	} else {
+		for i := range req.Metrics {
+			process(i)
+		}
+	}
+
+	// 跳过处理失败和被处理阶段丢弃的数据
+	processedMetrics := make([]ProcessedMetric, 0, len(req.Metrics))
+	for _, m := range results {
+		if m != nil {
+			processedMetrics = append(processedMetrics, *m)
 		}
-		processedMetrics = append(processedMetrics, *processedMetric)
 	}
 
 	return processedMetrics, nil
 }
 
-// ProcessSingleMetric 处理单个监控数据
+// ProcessSingleMetric 处理单个监控数据，指标被处理阶段丢弃时返回nil
 func (p *DefaultProcessor) ProcessSingleMetric(agentID string, metric *protocol.Metric) (*ProcessedMetric, error) {
 	// 验证数据完整性
 	if err := p.validateMetric(metric); err != nil {
@@ -75,7 +165,31 @@ func (p *DefaultProcessor) ProcessSingleMetric(agentID string, metric *protocol.
 		Payload:   metric.Payload,
 	}
 
-	// 可以在这里添加额外的处理逻辑，如数据聚合、过滤等
+	// 执行处理阶段，可选阶段出错、超时或被熔断时保留该阶段之前的结果继续处理，
+	// 必需阶段出错时丢弃该指标
+	var deadline time.Time
+	if p.metricTimeout > 0 {
+		deadline = time.Now().Add(p.metricTimeout)
+	}
+	for _, stage := range p.stages {
+		keep, err := stage.process(processedMetric, deadline)
+		if err != nil {
+			if stage.cfg.Required {
+				return nil, fmt.Errorf("stage %s failed on metric %s: %w", stage.stage.Name(), processedMetric.Name, err)
+			}
+			if errors.Is(err, ErrMetricTimeout) {
+				log.Printf("Metric %s exceeded processing timeout %s, skipping remaining stages", processedMetric.Name, p.metricTimeout)
+				break
+			}
+			if !errors.Is(err, ErrStageBypassed) {
+				log.Printf("Stage %s failed on metric %s: %v", stage.stage.Name(), processedMetric.Name, err)
+			}
+			continue
+		}
+		if !keep {
+			return nil, nil
+		}
+	}
 
 	return processedMetric, nil
 }
@@ -91,10 +205,17 @@ func (p *DefaultProcessor) validateMetric(metric *protocol.Metric) error {
 	}
 
 	// 检查指标类型是否有效
-	if metric.Type < protocol.MetricType_CPU_USAGE || metric.Type > protocol.MetricType_EBPF_RAW {
+	if metric.Type < protocol.MetricType_CPU_USAGE || metric.Type > protocol.MetricType_EXPONENTIAL_HISTOGRAM {
 		return ErrInvalidMetricType
 	}
 
+	// 指数直方图的payload必须是合法的OTLP ExponentialHistogramDataPoint
+	if metric.Type == protocol.MetricType_EXPONENTIAL_HISTOGRAM {
+		if _, err := histogram.Unmarshal(metric.Payload); err != nil {
+			return ErrInvalidHistogram
+		}
+	}
+
 	return nil
 }
 
@@ -103,6 +224,7 @@ var (
 	ErrEmptyMetricName   = &MetricError{"metric name is empty"}
 	ErrInvalidTimestamp  = &MetricError{"invalid timestamp"}
 	ErrInvalidMetricType = &MetricError{"invalid metric type"}
+	ErrInvalidHistogram  = &MetricError{"invalid exponential histogram payload"}
 )
 
 // MetricError 指标错误结构
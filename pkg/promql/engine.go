@@ -0,0 +1,330 @@
+// Package promql 实现一个很小的PromQL子集，使存储可以直接作为Prometheus数据源查询
+//
+// 支持带标签条件的序列选择器、范围选择器以及rate()和avg_over_time()两个函数，
+// 结果格式与Prometheus HTTP API的/api/v1/query和/api/v1/query_range相同。
+package promql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// ErrUnsupported 存储不支持按条件排序查询
+var ErrUnsupported = errors.New("storage does not support promql queries")
+
+// ErrTooManySamples 查询读取的数据超过max_samples
+var ErrTooManySamples = errors.New("too many samples")
+
+// maxPoints 范围查询单个序列最多输出的点数，与Prometheus相同
+const maxPoints = 11000
+
+// 结果类型
+const (
+	ValueTypeVector = "vector"
+	ValueTypeMatrix = "matrix"
+)
+
+// Result 查询结果，序列化后为Prometheus API响应中的data字段
+type Result struct {
+	ResultType string        `json:"resultType"`
+	Result     []SeriesValue `json:"result"`
+}
+
+// SeriesValue 结果中的一个序列，瞬时向量只有Value，范围向量只有Values
+type SeriesValue struct {
+	Metric map[string]string `json:"metric"`
+	Value  *Point            `json:"value,omitempty"`
+	Values []Point           `json:"values,omitempty"`
+}
+
+// Point 一个点，序列化为[秒级时间戳, "值"]
+type Point struct {
+	T int64
+	V float64
+}
+
+// MarshalJSON 按Prometheus API的格式输出，值为字符串以表示NaN和Inf
+func (p Point) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 32)
+	b = append(b, '[')
+	b = strconv.AppendFloat(b, float64(p.T)/1000, 'f', -1, 64)
+	b = append(b, ',', '"')
+	switch {
+	case math.IsNaN(p.V):
+		b = append(b, "NaN"...)
+	case math.IsInf(p.V, 1):
+		b = append(b, "+Inf"...)
+	case math.IsInf(p.V, -1):
+		b = append(b, "-Inf"...)
+	default:
+		b = strconv.AppendFloat(b, p.V, 'f', -1, 64)
+	}
+	b = append(b, '"', ']')
+	return b, nil
+}
+
+// Engine 在存储上执行查询
+//
+// 序列由指标名(__name__)、Agent ID(agent_id)和数据的标签组成，数据自带的agent_id标签改名为exported_agent_id。
+// 瞬时选择器取每个时刻之前lookback_delta内的最新样本；rate按范围内首尾样本计算每秒增长率，
+// 处理计数器重置但不向范围边界外推；带直方图负载的数据不参与计算。
+type Engine struct {
+	maxSamples int
+	lookback   time.Duration
+}
+
+// NewEngine 创建查询引擎
+func NewEngine(cfg config.PromQLConfig) *Engine {
+	return &Engine{maxSamples: cfg.MaxSamples, lookback: cfg.LookbackDelta}
+}
+
+// Instant 在ts时刻执行查询，范围选择器返回范围内的原始样本
+func (e *Engine) Instant(store storage.Storage, query string, ts time.Time, grant *acl.Grant) (*Result, error) {
+	expr, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	series, err := e.load(store, expr, ts, ts, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	t := ts.UnixMilli()
+	if expr.Matrix() {
+		result := &Result{ResultType: ValueTypeMatrix, Result: make([]SeriesValue, 0, len(series))}
+		for _, s := range series {
+			lo, hi := s.window(t, expr.Range)
+			if lo < hi {
+				result.Result = append(result.Result, SeriesValue{Metric: s.labels, Values: s.points[lo:hi]})
+			}
+		}
+		return result, nil
+	}
+
+	result := &Result{ResultType: ValueTypeVector, Result: make([]SeriesValue, 0, len(series))}
+	for _, s := range series {
+		if v, ok := e.eval(expr, s, t); ok {
+			result.Result = append(result.Result, SeriesValue{Metric: e.metric(expr, s), Value: &Point{T: t, V: v}})
+		}
+	}
+	return result, nil
+}
+
+// Range 按step在[start, end]的每个时刻执行查询，表达式的结果必须是瞬时向量
+func (e *Engine) Range(store storage.Storage, query string, start, end time.Time, step time.Duration, grant *acl.Grant) (*Result, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("end is before start")
+	}
+	if end.Sub(start)/step >= maxPoints {
+		return nil, fmt.Errorf("exceeded maximum resolution of %d points per series, use a larger step", maxPoints)
+	}
+	expr, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	if expr.Matrix() {
+		return nil, fmt.Errorf("range queries require an instant vector expression, got a range selector")
+	}
+	series, err := e.load(store, expr, start, end, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{ResultType: ValueTypeMatrix, Result: make([]SeriesValue, 0, len(series))}
+	for _, s := range series {
+		var values []Point
+		for t := start.UnixMilli(); t <= end.UnixMilli(); t += step.Milliseconds() {
+			if v, ok := e.eval(expr, s, t); ok {
+				values = append(values, Point{T: t, V: v})
+			}
+		}
+		if len(values) > 0 {
+			result.Result = append(result.Result, SeriesValue{Metric: e.metric(expr, s), Values: values})
+		}
+	}
+	return result, nil
+}
+
+// series 一个序列的样本，按时间升序且时间戳不重复
+type series struct {
+	labels map[string]string
+	points []Point
+}
+
+// window 返回时间范围(t-d, t]内的样本下标区间
+func (s *series) window(t int64, d time.Duration) (int, int) {
+	lo := sort.Search(len(s.points), func(i int) bool { return s.points[i].T > t-d.Milliseconds() })
+	hi := sort.Search(len(s.points), func(i int) bool { return s.points[i].T > t })
+	return lo, hi
+}
+
+// eval 计算序列在t时刻的值，没有足够的样本时返回false
+func (e *Engine) eval(expr *Expr, s *series, t int64) (float64, bool) {
+	switch expr.Func {
+	case FuncRate:
+		lo, hi := s.window(t, expr.Range)
+		if hi-lo < 2 {
+			return 0, false
+		}
+		var increase float64
+		for i := lo + 1; i < hi; i++ {
+			delta := s.points[i].V - s.points[i-1].V
+			if delta < 0 {
+				// 计数器重置，重置后的值即为增长量
+				delta = s.points[i].V
+			}
+			increase += delta
+		}
+		return increase / (float64(s.points[hi-1].T-s.points[lo].T) / 1000), true
+	case FuncAvgOverTime:
+		lo, hi := s.window(t, expr.Range)
+		if lo == hi {
+			return 0, false
+		}
+		var sum float64
+		for _, p := range s.points[lo:hi] {
+			sum += p.V
+		}
+		return sum / float64(hi-lo), true
+	}
+
+	_, hi := s.window(t, e.lookback)
+	if hi == 0 || s.points[hi-1].T <= t-e.lookback.Milliseconds() {
+		return 0, false
+	}
+	return s.points[hi-1].V, true
+}
+
+// metric 结果中序列的标签，函数的结果不含指标名
+func (e *Engine) metric(expr *Expr, s *series) map[string]string {
+	if expr.Func == "" {
+		return s.labels
+	}
+	labels := make(map[string]string, len(s.labels))
+	for k, v := range s.labels {
+		if k != storage.MetricNameLabel {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// load 读取计算[start, end]内各时刻所需的样本，按标签分组为序列，结果按标签排序
+func (e *Engine) load(store storage.Storage, expr *Expr, start, end time.Time, grant *acl.Grant) ([]*series, error) {
+	sq, ok := store.(storage.SortedQuerier)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	lookback := e.lookback
+	if expr.Range > 0 {
+		lookback = expr.Range
+	}
+	// agent_id和指标名的等值或正则匹配在存储层过滤，其余条件在分组时匹配
+	filter := storage.Filter{Start: start.Add(-lookback), End: end}
+	for _, m := range expr.Matchers {
+		switch {
+		case m.Name == "agent_id" && m.Type == storage.MatchEqual:
+			filter.AgentID = m.Value
+		case m.Name == storage.MetricNameLabel && m.Type == storage.MatchEqual:
+			filter.Name, _ = storage.NewNameRegexp(regexp.QuoteMeta(m.Value))
+		case m.Name == storage.MetricNameLabel && m.Type == storage.MatchRegexp && filter.Name == nil:
+			filter.Name, _ = storage.NewNameRegexp(m.Value)
+		}
+	}
+	grant.Apply(&filter)
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp}, e.maxSamples+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) > e.maxSamples {
+		return nil, fmt.Errorf("%w: query reads more than %d samples", ErrTooManySamples, e.maxSamples)
+	}
+
+	index := make(map[string]*series)
+	var key strings.Builder
+	for i := range metrics {
+		m := &metrics[i]
+		if len(m.Payload) > 0 {
+			continue
+		}
+		labels := seriesLabels(m)
+		if !matches(labels, expr.Matchers) {
+			continue
+		}
+
+		names := make([]string, 0, len(labels))
+		for k := range labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		key.Reset()
+		for _, k := range names {
+			key.WriteString(k)
+			key.WriteByte(0)
+			key.WriteString(labels[k])
+			key.WriteByte(0)
+		}
+		s, ok := index[key.String()]
+		if !ok {
+			s = &series{labels: labels}
+			index[key.String()] = s
+		}
+		ts := m.Timestamp.UnixMilli()
+		// 同一毫秒的重复数据只保留最后写入的一条
+		if n := len(s.points); n > 0 && s.points[n-1].T == ts {
+			s.points[n-1].V = m.Value
+			continue
+		}
+		s.points = append(s.points, Point{T: ts, V: m.Value})
+	}
+
+	keys := make([]string, 0, len(index))
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*series, len(keys))
+	for i, k := range keys {
+		result[i] = index[k]
+	}
+	return result, nil
+}
+
+// seriesLabels 返回数据所属序列的标签，包括__name__和agent_id
+func seriesLabels(m *processor.ProcessedMetric) map[string]string {
+	labels := make(map[string]string, len(m.Labels)+2)
+	for k, v := range m.Labels {
+		if k == "agent_id" {
+			k = "exported_agent_id"
+		}
+		labels[k] = v
+	}
+	labels[storage.MetricNameLabel] = m.Name
+	labels["agent_id"] = m.AgentID
+	return labels
+}
+
+// matches 判断标签集是否满足全部匹配条件，不存在的标签按空字符串匹配
+func matches(labels map[string]string, matchers []*storage.LabelMatcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
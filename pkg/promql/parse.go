@@ -0,0 +1,312 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 支持的函数
+const (
+	FuncRate        = "rate"
+	FuncAvgOverTime = "avg_over_time"
+)
+
+// Expr 解析后的表达式：一个序列选择器，可以带时间范围，外面可以包一层函数
+type Expr struct {
+	// Func 函数名，为空表示只有选择器
+	Func string
+	// Matchers 选择器的匹配条件，指标名转换为__name__的等值匹配
+	Matchers []*storage.LabelMatcher
+	// Range 范围选择器的时间范围，0表示瞬时选择器
+	Range time.Duration
+}
+
+// Matrix 判断表达式的结果是否为范围向量
+func (e *Expr) Matrix() bool {
+	return e.Func == "" && e.Range > 0
+}
+
+// Parse 解析查询表达式
+//
+// 语法为 metric{label="value", ...}[5m]，指标名和标签条件至少有一个，匹配方式为=、!=、=~和!~，
+// 指标名除PromQL允许的字符外还可以包含"."。rate和avg_over_time的参数必须是范围选择器。
+func Parse(query string) (*Expr, error) {
+	p := &parser{input: query}
+	p.skipSpace()
+
+	expr := &Expr{}
+	name := p.ident()
+	p.skipSpace()
+	if name != "" && p.peek() == '(' {
+		switch name {
+		case FuncRate, FuncAvgOverTime:
+		default:
+			return nil, p.errorf("unknown function %q", name)
+		}
+		p.pos++
+		expr.Func = name
+		p.skipSpace()
+		name = p.ident()
+		p.skipSpace()
+	}
+
+	if name != "" {
+		m, err := storage.NewLabelMatcher(storage.MetricNameLabel, storage.MatchEqual, name)
+		if err != nil {
+			return nil, err
+		}
+		expr.Matchers = append(expr.Matchers, m)
+	}
+	if p.peek() == '{' {
+		p.pos++
+		matchers, err := p.matchers()
+		if err != nil {
+			return nil, err
+		}
+		expr.Matchers = append(expr.Matchers, matchers...)
+		p.skipSpace()
+	}
+	if len(expr.Matchers) == 0 {
+		return nil, p.errorf("expected a metric name or label matchers")
+	}
+	empty := true
+	for _, m := range expr.Matchers {
+		empty = empty && m.Matches("")
+	}
+	if empty {
+		return nil, p.errorf("selector must contain at least one matcher that does not match the empty string")
+	}
+
+	if p.peek() == '[' {
+		p.pos++
+		end := strings.IndexByte(p.input[p.pos:], ']')
+		if end < 0 {
+			return nil, p.errorf("unclosed range")
+		}
+		d, err := ParseDuration(strings.TrimSpace(p.input[p.pos : p.pos+end]))
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if d <= 0 {
+			return nil, p.errorf("range must be positive")
+		}
+		expr.Range = d
+		p.pos += end + 1
+		p.skipSpace()
+	}
+
+	if expr.Func != "" {
+		if expr.Range == 0 {
+			return nil, p.errorf("%s expects a range selector such as metric[5m]", expr.Func)
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		p.skipSpace()
+	}
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return expr, nil
+}
+
+// ParseDuration 解析PromQL形式的时长，如30s、5m、1h30m，单位为ms、s、m、h、d、w和y
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+		{"m", time.Minute},
+		{"h", time.Hour},
+		{"d", 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"y", 365 * 24 * time.Hour},
+	}
+
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+
+		found := false
+		for _, u := range units {
+			if strings.HasPrefix(rest, u.suffix) {
+				total += time.Duration(n) * u.unit
+				rest = rest[len(u.suffix):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	return total, nil
+}
+
+// parser 查询表达式的解析状态
+type parser struct {
+	input string
+	pos   int
+}
+
+// errorf 返回带位置的解析错误
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at char %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// peek 返回当前字符，已到结尾时返回0
+func (p *parser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// ident 读取指标名、函数名或标签名，没有时返回空字符串
+func (p *parser) ident() string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		ch := p.input[p.pos]
+		letter := ch == '_' || ch == ':' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+		if !letter && (p.pos == start || !(ch == '.' || (ch >= '0' && ch <= '9'))) {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// matchers 读取{}中的标签条件，左括号已读取
+func (p *parser) matchers() ([]*storage.LabelMatcher, error) {
+	var matchers []*storage.LabelMatcher
+	for {
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.pos++
+			return matchers, nil
+		}
+
+		name := p.ident()
+		if name == "" {
+			return nil, p.errorf("expected label name")
+		}
+		p.skipSpace()
+		var matchType string
+		for _, t := range []string{storage.MatchRegexp, storage.MatchNotRegexp, storage.MatchNotEqual, storage.MatchEqual} {
+			if strings.HasPrefix(p.input[p.pos:], t) {
+				matchType = t
+				break
+			}
+		}
+		if matchType == "" {
+			return nil, p.errorf("expected =, !=, =~ or !~ after label %s", name)
+		}
+		p.pos += len(matchType)
+		p.skipSpace()
+		value, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		m, err := storage.NewLabelMatcher(name, matchType, value)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		matchers = append(matchers, m)
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+		default:
+			return nil, p.errorf("expected , or }")
+		}
+	}
+}
+
+// str 读取双引号、单引号或反引号括起的字符串，反引号内不处理转义
+func (p *parser) str() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.errorf("expected quoted string")
+	}
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.input) {
+		ch := p.input[p.pos]
+		if ch == '\\' && quote != '`' {
+			p.pos += 2
+			continue
+		}
+		p.pos++
+		if ch != quote {
+			continue
+		}
+		text := p.input[start:p.pos]
+		if quote == '`' {
+			return text[1 : len(text)-1], nil
+		}
+		if quote == '\'' {
+			text = doubleQuote(text)
+		}
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			p.pos = start
+			return "", p.errorf("invalid string %s", text)
+		}
+		return value, nil
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+// doubleQuote 把单引号字符串转换为双引号字符串，之后可以按Go的规则处理转义
+func doubleQuote(text string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	inner := text[1 : len(text)-1]
+	for i := 0; i < len(inner); i++ {
+		switch {
+		case inner[i] == '\\' && i+1 < len(inner) && inner[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case inner[i] == '\\' && i+1 < len(inner):
+			b.WriteString(inner[i : i+2])
+			i++
+		case inner[i] == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(inner[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
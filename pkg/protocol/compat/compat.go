@@ -0,0 +1,250 @@
+package compat
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// 数据帧的消息类型
+const (
+	// ShapeBatch 当前Agent发送的BatchMetricsRequest
+	ShapeBatch = "batch"
+	// ShapeSingle 早期Agent每帧发送一个Metric，没有Agent ID
+	ShapeSingle = "single"
+)
+
+// ErrAmbiguousFrame 数据帧同时带有只属于BatchMetricsRequest和只属于Metric的字段
+var ErrAmbiguousFrame = errors.New("frame has both batch and single metric fields")
+
+// messages 可以配置字段映射的消息，键为配置中的消息名
+var messages = map[string]protoreflect.MessageDescriptor{
+	"Metric":              (&protocol.Metric{}).ProtoReflect().Descriptor(),
+	"BatchMetricsRequest": (&protocol.BatchMetricsRequest{}).ProtoReflect().Descriptor(),
+}
+
+// Frame 解码后的数据帧，Batch和Metric只有一个非nil
+type Frame struct {
+	Shape  string
+	Batch  *protocol.BatchMetricsRequest
+	Metric *protocol.Metric
+	// Remapped 按字段映射改写的字段数
+	Remapped int
+}
+
+// Decoder 兼容旧版本Agent线格式的数据帧解码器
+//
+// QUIC数据帧没有类型标记，解码器按字段号和线类型区分BatchMetricsRequest和单个Metric。
+// 字段改名不影响线格式；字段改号后旧Agent发送的字段在新schema中是未知字段，会被静默丢弃，
+// 配置shims把旧字段号映射为当前字段号后，这些字段可以继续解码。零值可用，不做字段映射。
+type Decoder struct {
+	// shims 消息全名 -> 旧字段号 -> 当前字段号
+	shims map[protoreflect.FullName]map[protowire.Number]protowire.Number
+}
+
+// NewDecoder 按字段映射创建解码器
+//
+// 旧字段号不能是当前schema中仍在使用的字段，新字段号必须存在。
+func NewDecoder(shims []config.FieldShim) (*Decoder, error) {
+	d := &Decoder{}
+	for _, shim := range shims {
+		md, ok := messages[shim.Message]
+		if !ok {
+			return nil, fmt.Errorf("protocol shim: unknown message %q", shim.Message)
+		}
+		from, to := protowire.Number(shim.From), protowire.Number(shim.To)
+		if !from.IsValid() {
+			return nil, fmt.Errorf("protocol shim: invalid field number %d for %s", shim.From, shim.Message)
+		}
+		if md.Fields().ByNumber(from) != nil {
+			return nil, fmt.Errorf("protocol shim: field %d of %s is still in use", shim.From, shim.Message)
+		}
+		if md.Fields().ByNumber(to) == nil {
+			return nil, fmt.Errorf("protocol shim: %s has no field %d", shim.Message, shim.To)
+		}
+
+		if d.shims == nil {
+			d.shims = make(map[protoreflect.FullName]map[protowire.Number]protowire.Number)
+		}
+		fields := d.shims[md.FullName()]
+		if fields == nil {
+			fields = make(map[protowire.Number]protowire.Number)
+			d.shims[md.FullName()] = fields
+		}
+		if _, dup := fields[from]; dup {
+			return nil, fmt.Errorf("protocol shim: field %d of %s is mapped twice", shim.From, shim.Message)
+		}
+		fields[from] = to
+	}
+	return d, nil
+}
+
+// Decode 识别数据帧的消息类型并解码
+//
+// 只带有agent_id(或name)一个字段的帧无法区分，按BatchMetricsRequest解码，与引入批量发送前的行为一致。
+func (d *Decoder) Decode(data []byte) (*Frame, error) {
+	shape, err := d.classify(data)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := &Frame{Shape: shape}
+	var msg proto.Message
+	if shape == ShapeSingle {
+		frame.Metric = &protocol.Metric{}
+		msg = frame.Metric
+	} else {
+		frame.Batch = &protocol.BatchMetricsRequest{}
+		msg = frame.Batch
+	}
+
+	wire := data
+	if len(d.shims) > 0 {
+		wire, frame.Remapped, err = d.rewrite(data, msg.ProtoReflect().Descriptor())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := proto.Unmarshal(wire, msg); err != nil {
+		// 与引入兼容层前一致，BatchMetricsRequest解析失败时再尝试单个Metric
+		if shape == ShapeBatch {
+			if metric, ok := d.fallback(data); ok {
+				return metric, nil
+			}
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// fallback 把无法解析为BatchMetricsRequest的数据帧按单个Metric解析
+func (d *Decoder) fallback(data []byte) (*Frame, bool) {
+	frame := &Frame{Shape: ShapeSingle, Metric: &protocol.Metric{}}
+	if len(d.shims) > 0 {
+		var err error
+		data, frame.Remapped, err = d.rewrite(data, frame.Metric.ProtoReflect().Descriptor())
+		if err != nil {
+			return nil, false
+		}
+	}
+	if err := proto.Unmarshal(data, frame.Metric); err != nil {
+		return nil, false
+	}
+	return frame, true
+}
+
+// classify 按顶层字段判断数据帧是BatchMetricsRequest还是Metric
+//
+// BatchMetricsRequest的字段1是嵌套消息、字段3是varint；Metric的字段1是varint、字段3是fixed64，
+// 字段4到6不在BatchMetricsRequest中。两者的字段2都是字符串，无法用来区分。
+func (d *Decoder) classify(data []byte) (string, error) {
+	batchMD, metricMD := messages["BatchMetricsRequest"], messages["Metric"]
+	batch, single := false, false
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, data[n:])
+		if m < 0 {
+			return "", protowire.ParseError(m)
+		}
+		data = data[n+m:]
+
+		switch d.number(batchMD, num) {
+		case 1:
+			batch = batch || typ == protowire.BytesType
+		case 3:
+			batch = batch || typ == protowire.VarintType
+		}
+		switch d.number(metricMD, num) {
+		case 1, 5:
+			single = single || typ == protowire.VarintType
+		case 3:
+			single = single || typ == protowire.Fixed64Type
+		case 4, 6:
+			single = single || typ == protowire.BytesType
+		}
+	}
+
+	switch {
+	case batch && single:
+		return "", ErrAmbiguousFrame
+	case single:
+		return ShapeSingle, nil
+	default:
+		return ShapeBatch, nil
+	}
+}
+
+// number 返回字段在当前schema中的字段号
+func (d *Decoder) number(md protoreflect.MessageDescriptor, num protowire.Number) protowire.Number {
+	if to, ok := d.shims[md.FullName()][num]; ok {
+		return to
+	}
+	return num
+}
+
+// rewrite 把消息及其嵌套消息中的旧字段号改写为当前字段号，线类型与当前字段不符的不改写
+func (d *Decoder) rewrite(data []byte, md protoreflect.MessageDescriptor) ([]byte, int, error) {
+	out := make([]byte, 0, len(data))
+	remapped := 0
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, 0, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(num, typ, data[n:])
+		if m < 0 {
+			return nil, 0, protowire.ParseError(m)
+		}
+		value := data[n : n+m]
+		data = data[n+m:]
+
+		if to, ok := d.shims[md.FullName()][num]; ok && wireTypeMatches(md.Fields().ByNumber(to), typ) {
+			num = to
+			remapped++
+		}
+
+		out = protowire.AppendTag(out, num, typ)
+		fd := md.Fields().ByNumber(num)
+		if fd == nil || fd.Message() == nil || typ != protowire.BytesType {
+			out = append(out, value...)
+			continue
+		}
+		inner, _ := protowire.ConsumeBytes(value)
+		rewritten, k, err := d.rewrite(inner, fd.Message())
+		if err != nil {
+			return nil, 0, err
+		}
+		out = protowire.AppendBytes(out, rewritten)
+		remapped += k
+	}
+	return out, remapped, nil
+}
+
+// wireTypeMatches 判断线类型能否解码为字段，repeated标量字段也接受打包的bytes
+func wireTypeMatches(fd protoreflect.FieldDescriptor, typ protowire.Type) bool {
+	switch fd.Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind, protoreflect.MessageKind:
+		return typ == protowire.BytesType
+	case protoreflect.GroupKind:
+		return typ == protowire.StartGroupType
+	}
+	if fd.IsList() && typ == protowire.BytesType {
+		return true
+	}
+	switch fd.Kind() {
+	case protoreflect.DoubleKind, protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind:
+		return typ == protowire.Fixed64Type
+	case protoreflect.FloatKind, protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind:
+		return typ == protowire.Fixed32Type
+	default:
+		return typ == protowire.VarintType
+	}
+}
@@ -0,0 +1,212 @@
+package compat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// decoded 解码结果的稳定JSON表示
+type decoded struct {
+	Shape     string          `json:"shape"`
+	Remapped  int             `json:"remapped"`
+	AgentID   string          `json:"agent_id,omitempty"`
+	Timestamp int64           `json:"timestamp,omitempty"`
+	Metrics   []decodedMetric `json:"metrics"`
+}
+
+type decodedMetric struct {
+	Timestamp int64             `json:"timestamp"`
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Type      string            `json:"type"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Payload   string            `json:"payload,omitempty"`
+}
+
+// TestGoldenFrames 用旧版本Agent的线格式样本校验当前schema的解码结果
+//
+// testdata/*.hex是冻结的原始数据帧，不能重新生成；schema变化导致解码结果变化时，
+// 确认兼容后用 go test ./pkg/protocol/compat -update 更新*.golden.json。
+func TestGoldenFrames(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".hex")
+		t.Run(name, func(t *testing.T) {
+			data, shims := readFixture(t, file)
+			d, err := NewDecoder(shims)
+			if err != nil {
+				t.Fatalf("NewDecoder: %v", err)
+			}
+			frame, err := d.Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			got, err := json.MarshalIndent(toDecoded(frame), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(file, ".hex") + ".golden.json"
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("missing golden file, run with -update: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded frame differs from %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// TestShimsRequired 没有字段映射时，改号的字段被当作未知字段丢弃
+func TestShimsRequired(t *testing.T) {
+	data, _ := readFixture(t, "testdata/single_renumbered_payload.hex")
+	frame, err := (&Decoder{}).Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Shape != ShapeSingle {
+		t.Fatalf("shape = %s, want %s", frame.Shape, ShapeSingle)
+	}
+	if len(frame.Metric.Payload) != 0 || frame.Remapped != 0 {
+		t.Fatalf("payload decoded without shim: %x", frame.Metric.Payload)
+	}
+}
+
+func TestAmbiguousFrame(t *testing.T) {
+	// 字段1为嵌套消息只属于BatchMetricsRequest，字段6只属于Metric
+	var data []byte
+	data = protowire.AppendTag(data, 1, protowire.BytesType)
+	data = protowire.AppendBytes(data, nil)
+	data = protowire.AppendTag(data, 6, protowire.BytesType)
+	data = protowire.AppendBytes(data, []byte{1})
+
+	if _, err := (&Decoder{}).Decode(data); !errors.Is(err, ErrAmbiguousFrame) {
+		t.Fatalf("err = %v, want %v", err, ErrAmbiguousFrame)
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	data, _ := readFixture(t, "testdata/batch.hex")
+	if _, err := (&Decoder{}).Decode(data[:len(data)-3]); err == nil {
+		t.Fatal("truncated frame decoded without error")
+	}
+}
+
+func TestNewDecoderValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		shims []config.FieldShim
+	}{
+		{"unknown message", []config.FieldShim{{Message: "AgentCommand", From: 9, To: 1}}},
+		{"from in use", []config.FieldShim{{Message: "Metric", From: 2, To: 6}}},
+		{"to undefined", []config.FieldShim{{Message: "Metric", From: 16, To: 17}}},
+		{"invalid from", []config.FieldShim{{Message: "Metric", From: 0, To: 6}}},
+		{"duplicate from", []config.FieldShim{
+			{Message: "Metric", From: 16, To: 6},
+			{Message: "Metric", From: 16, To: 4},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDecoder(tt.shims); err == nil {
+				t.Fatal("NewDecoder accepted invalid shims")
+			}
+		})
+	}
+}
+
+// readFixture 读取hex样本，#开头的行是说明，"# shims: Message:from=to ..."配置字段映射
+func readFixture(t *testing.T, file string) ([]byte, []config.FieldShim) {
+	t.Helper()
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hexData strings.Builder
+	var shims []config.FieldShim
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if spec, ok := strings.CutPrefix(line, "# shims:"); ok {
+			for _, field := range strings.Fields(spec) {
+				shims = append(shims, parseShim(t, field))
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		hexData.WriteString(line)
+	}
+
+	data, err := hex.DecodeString(hexData.String())
+	if err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	return data, shims
+}
+
+func parseShim(t *testing.T, spec string) config.FieldShim {
+	t.Helper()
+
+	message, numbers, ok := strings.Cut(spec, ":")
+	from, to, ok2 := strings.Cut(numbers, "=")
+	f, err := strconv.ParseInt(from, 10, 32)
+	g, err2 := strconv.ParseInt(to, 10, 32)
+	if !ok || !ok2 || err != nil || err2 != nil {
+		t.Fatalf("invalid shim %q", spec)
+	}
+	return config.FieldShim{Message: message, From: int32(f), To: int32(g)}
+}
+
+func toDecoded(frame *Frame) decoded {
+	out := decoded{Shape: frame.Shape, Remapped: frame.Remapped, Metrics: []decodedMetric{}}
+	metrics := []*protocol.Metric{frame.Metric}
+	if frame.Batch != nil {
+		out.AgentID = frame.Batch.AgentId
+		out.Timestamp = frame.Batch.Timestamp
+		metrics = frame.Batch.Metrics
+	}
+	for _, m := range metrics {
+		out.Metrics = append(out.Metrics, decodedMetric{
+			Timestamp: m.Timestamp,
+			Name:      m.Name,
+			Value:     m.Value,
+			Type:      m.Type.String(),
+			Labels:    m.Labels,
+			Payload:   hex.EncodeToString(m.Payload),
+		})
+	}
+	return out
+}
@@ -24,10 +24,11 @@ const (
 type MetricType int32
 
 const (
-	MetricType_CPU_USAGE       MetricType = 0
-	MetricType_MEMORY_USAGE    MetricType = 1
-	MetricType_NETWORK_PACKETS MetricType = 2
-	MetricType_EBPF_RAW        MetricType = 3
+	MetricType_CPU_USAGE             MetricType = 0
+	MetricType_MEMORY_USAGE          MetricType = 1
+	MetricType_NETWORK_PACKETS       MetricType = 2
+	MetricType_EBPF_RAW              MetricType = 3
+	MetricType_EXPONENTIAL_HISTOGRAM MetricType = 4
 )
 
 // Enum value maps for MetricType.
@@ -37,12 +38,14 @@ var (
 		1: "MEMORY_USAGE",
 		2: "NETWORK_PACKETS",
 		3: "EBPF_RAW",
+		4: "EXPONENTIAL_HISTOGRAM",
 	}
 	MetricType_value = map[string]int32{
-		"CPU_USAGE":       0,
-		"MEMORY_USAGE":    1,
-		"NETWORK_PACKETS": 2,
-		"EBPF_RAW":        3,
+		"CPU_USAGE":             0,
+		"MEMORY_USAGE":          1,
+		"NETWORK_PACKETS":       2,
+		"EBPF_RAW":              3,
+		"EXPONENTIAL_HISTOGRAM": 4,
 	}
 )
 
@@ -373,6 +376,752 @@ func (x *BatchMetricsResponse) GetRejectedCount() int32 {
 	return 0
 }
 
+type AgentCommand struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Command       string                 `protobuf:"bytes,2,opt,name=command,proto3" json:"command,omitempty"`
+	Args          map[string]string      `protobuf:"bytes,3,rep,name=args,proto3" json:"args,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	TimeoutMs     int64                  `protobuf:"varint,4,opt,name=timeout_ms,json=timeoutMs,proto3" json:"timeout_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentCommand) Reset() {
+	*x = AgentCommand{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentCommand) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentCommand) ProtoMessage() {}
+
+func (x *AgentCommand) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentCommand.ProtoReflect.Descriptor instead.
+func (*AgentCommand) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AgentCommand) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *AgentCommand) GetCommand() string {
+	if x != nil {
+		return x.Command
+	}
+	return ""
+}
+
+func (x *AgentCommand) GetArgs() map[string]string {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+func (x *AgentCommand) GetTimeoutMs() int64 {
+	if x != nil {
+		return x.TimeoutMs
+	}
+	return 0
+}
+
+type CommandResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Success       bool                   `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	Payload       []byte                 `protobuf:"bytes,4,opt,name=payload,proto3" json:"payload,omitempty"`
+	ContentType   string                 `protobuf:"bytes,5,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommandResult) Reset() {
+	*x = CommandResult{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommandResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommandResult) ProtoMessage() {}
+
+func (x *CommandResult) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommandResult.ProtoReflect.Descriptor instead.
+func (*CommandResult) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CommandResult) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *CommandResult) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *CommandResult) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *CommandResult) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *CommandResult) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+type StoredMetric struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	AgentId     string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	TimestampNs int64                  `protobuf:"varint,2,opt,name=timestamp_ns,json=timestampNs,proto3" json:"timestamp_ns,omitempty"`
+	Name        string                 `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	Value       float64                `protobuf:"fixed64,4,opt,name=value,proto3" json:"value,omitempty"`
+	Labels      map[string]string      `protobuf:"bytes,5,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Type        string                 `protobuf:"bytes,6,opt,name=type,proto3" json:"type,omitempty"`
+	RawType     MetricType             `protobuf:"varint,7,opt,name=raw_type,json=rawType,proto3,enum=protocol.MetricType" json:"raw_type,omitempty"`
+	Payload     []byte                 `protobuf:"bytes,8,opt,name=payload,proto3" json:"payload,omitempty"`
+	// payload_ref 非0时负载为所在MetricSnapshot中payloads[payload_ref-1]，payload为空
+	PayloadRef uint32 `protobuf:"varint,9,opt,name=payload_ref,json=payloadRef,proto3" json:"payload_ref,omitempty"`
+	// provenance 所在批次的接入来源，未记录时为空
+	Provenance    *Provenance `protobuf:"bytes,10,opt,name=provenance,proto3" json:"provenance,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StoredMetric) Reset() {
+	*x = StoredMetric{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StoredMetric) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StoredMetric) ProtoMessage() {}
+
+func (x *StoredMetric) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StoredMetric.ProtoReflect.Descriptor instead.
+func (*StoredMetric) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *StoredMetric) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *StoredMetric) GetTimestampNs() int64 {
+	if x != nil {
+		return x.TimestampNs
+	}
+	return 0
+}
+
+func (x *StoredMetric) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *StoredMetric) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *StoredMetric) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *StoredMetric) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *StoredMetric) GetRawType() MetricType {
+	if x != nil {
+		return x.RawType
+	}
+	return MetricType_CPU_USAGE
+}
+
+func (x *StoredMetric) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *StoredMetric) GetPayloadRef() uint32 {
+	if x != nil {
+		return x.PayloadRef
+	}
+	return 0
+}
+
+func (x *StoredMetric) GetProvenance() *Provenance {
+	if x != nil {
+		return x.Provenance
+	}
+	return nil
+}
+
+type Provenance struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	BatchId          string                 `protobuf:"bytes,1,opt,name=batch_id,json=batchId,proto3" json:"batch_id,omitempty"`
+	ConnId           string                 `protobuf:"bytes,2,opt,name=conn_id,json=connId,proto3" json:"conn_id,omitempty"`
+	Listener         string                 `protobuf:"bytes,3,opt,name=listener,proto3" json:"listener,omitempty"`
+	SourceIp         string                 `protobuf:"bytes,4,opt,name=source_ip,json=sourceIp,proto3" json:"source_ip,omitempty"`
+	ReceivedAtNs     int64                  `protobuf:"varint,5,opt,name=received_at_ns,json=receivedAtNs,proto3" json:"received_at_ns,omitempty"`
+	DecodeDurationNs int64                  `protobuf:"varint,6,opt,name=decode_duration_ns,json=decodeDurationNs,proto3" json:"decode_duration_ns,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Provenance) Reset() {
+	*x = Provenance{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Provenance) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Provenance) ProtoMessage() {}
+
+func (x *Provenance) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Provenance.ProtoReflect.Descriptor instead.
+func (*Provenance) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Provenance) GetBatchId() string {
+	if x != nil {
+		return x.BatchId
+	}
+	return ""
+}
+
+func (x *Provenance) GetConnId() string {
+	if x != nil {
+		return x.ConnId
+	}
+	return ""
+}
+
+func (x *Provenance) GetListener() string {
+	if x != nil {
+		return x.Listener
+	}
+	return ""
+}
+
+func (x *Provenance) GetSourceIp() string {
+	if x != nil {
+		return x.SourceIp
+	}
+	return ""
+}
+
+func (x *Provenance) GetReceivedAtNs() int64 {
+	if x != nil {
+		return x.ReceivedAtNs
+	}
+	return 0
+}
+
+func (x *Provenance) GetDecodeDurationNs() int64 {
+	if x != nil {
+		return x.DecodeDurationNs
+	}
+	return 0
+}
+
+type MetricSnapshot struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Metrics []*StoredMetric        `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	// payloads 同一快照记录中去重后的负载
+	Payloads      [][]byte `protobuf:"bytes,2,rep,name=payloads,proto3" json:"payloads,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MetricSnapshot) Reset() {
+	*x = MetricSnapshot{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MetricSnapshot) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetricSnapshot) ProtoMessage() {}
+
+func (x *MetricSnapshot) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetricSnapshot.ProtoReflect.Descriptor instead.
+func (*MetricSnapshot) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *MetricSnapshot) GetMetrics() []*StoredMetric {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+func (x *MetricSnapshot) GetPayloads() [][]byte {
+	if x != nil {
+		return x.Payloads
+	}
+	return nil
+}
+
+// limit为0时使用与HTTP接口相同的默认值，namespace为空时查询所有命名空间
+type LatestMetricsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Limit         int32                  `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	Namespace     string                 `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LatestMetricsRequest) Reset() {
+	*x = LatestMetricsRequest{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LatestMetricsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LatestMetricsRequest) ProtoMessage() {}
+
+func (x *LatestMetricsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LatestMetricsRequest.ProtoReflect.Descriptor instead.
+func (*LatestMetricsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *LatestMetricsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *LatestMetricsRequest) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+type AgentMetricsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Limit         int32                  `protobuf:"varint,2,opt,name=limit,proto3" json:"limit,omitempty"`
+	Namespace     string                 `protobuf:"bytes,3,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentMetricsRequest) Reset() {
+	*x = AgentMetricsRequest{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentMetricsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentMetricsRequest) ProtoMessage() {}
+
+func (x *AgentMetricsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentMetricsRequest.ProtoReflect.Descriptor instead.
+func (*AgentMetricsRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *AgentMetricsRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *AgentMetricsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *AgentMetricsRequest) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+// start_ms/end_ms为毫秒时间戳，end_ms为0表示当前时间
+type TimeRangeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	StartMs       int64                  `protobuf:"varint,1,opt,name=start_ms,json=startMs,proto3" json:"start_ms,omitempty"`
+	EndMs         int64                  `protobuf:"varint,2,opt,name=end_ms,json=endMs,proto3" json:"end_ms,omitempty"`
+	Limit         int32                  `protobuf:"varint,3,opt,name=limit,proto3" json:"limit,omitempty"`
+	Namespace     string                 `protobuf:"bytes,4,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TimeRangeRequest) Reset() {
+	*x = TimeRangeRequest{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TimeRangeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TimeRangeRequest) ProtoMessage() {}
+
+func (x *TimeRangeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TimeRangeRequest.ProtoReflect.Descriptor instead.
+func (*TimeRangeRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *TimeRangeRequest) GetStartMs() int64 {
+	if x != nil {
+		return x.StartMs
+	}
+	return 0
+}
+
+func (x *TimeRangeRequest) GetEndMs() int64 {
+	if x != nil {
+		return x.EndMs
+	}
+	return 0
+}
+
+func (x *TimeRangeRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *TimeRangeRequest) GetNamespace() string {
+	if x != nil {
+		return x.Namespace
+	}
+	return ""
+}
+
+type QueryMetricsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Metrics       []*StoredMetric        `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryMetricsResponse) Reset() {
+	*x = QueryMetricsResponse{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryMetricsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryMetricsResponse) ProtoMessage() {}
+
+func (x *QueryMetricsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryMetricsResponse.ProtoReflect.Descriptor instead.
+func (*QueryMetricsResponse) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *QueryMetricsResponse) GetMetrics() []*StoredMetric {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+// 空字段匹配所有，last_id不为0时先重放序号大于last_id的指标
+type SubscribeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Type          string                 `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	LastId        uint64                 `protobuf:"varint,4,opt,name=last_id,json=lastId,proto3" json:"last_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *SubscribeRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *SubscribeRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *SubscribeRequest) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *SubscribeRequest) GetLastId() uint64 {
+	if x != nil {
+		return x.LastId
+	}
+	return 0
+}
+
+type MetricEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Metric        *StoredMetric          `protobuf:"bytes,2,opt,name=metric,proto3" json:"metric,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MetricEvent) Reset() {
+	*x = MetricEvent{}
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MetricEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetricEvent) ProtoMessage() {}
+
+func (x *MetricEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_pkg_protocol_metrics_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetricEvent.ProtoReflect.Descriptor instead.
+func (*MetricEvent) Descriptor() ([]byte, []int) {
+	return file_pkg_protocol_metrics_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *MetricEvent) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *MetricEvent) GetMetric() *StoredMetric {
+	if x != nil {
+		return x.Metric
+	}
+	return nil
+}
+
 var File_pkg_protocol_metrics_proto protoreflect.FileDescriptor
 
 const file_pkg_protocol_metrics_proto_rawDesc = "" +
@@ -400,15 +1149,87 @@ const file_pkg_protocol_metrics_proto_rawDesc = "" +
 	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
 	"\amessage\x18\x02 \x01(\tR\amessage\x12%\n" +
 	"\x0eaccepted_count\x18\x03 \x01(\x05R\racceptedCount\x12%\n" +
-	"\x0erejected_count\x18\x04 \x01(\x05R\rrejectedCount*P\n" +
+	"\x0erejected_count\x18\x04 \x01(\x05R\rrejectedCount\"\xc6\x01\n" +
+	"\fAgentCommand\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x18\n" +
+	"\acommand\x18\x02 \x01(\tR\acommand\x124\n" +
+	"\x04args\x18\x03 \x03(\v2 .protocol.AgentCommand.ArgsEntryR\x04args\x12\x1d\n" +
+	"\n" +
+	"timeout_ms\x18\x04 \x01(\x03R\ttimeoutMs\x1a7\n" +
+	"\tArgsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x8c\x01\n" +
+	"\rCommandResult\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x18\n" +
+	"\asuccess\x18\x02 \x01(\bR\asuccess\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\x12\x18\n" +
+	"\apayload\x18\x04 \x01(\fR\apayload\x12!\n" +
+	"\fcontent_type\x18\x05 \x01(\tR\vcontentType\"\xa3\x03\n" +
+	"\fStoredMetric\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12!\n" +
+	"\ftimestamp_ns\x18\x02 \x01(\x03R\vtimestampNs\x12\x12\n" +
+	"\x04name\x18\x03 \x01(\tR\x04name\x12\x14\n" +
+	"\x05value\x18\x04 \x01(\x01R\x05value\x12:\n" +
+	"\x06labels\x18\x05 \x03(\v2\".protocol.StoredMetric.LabelsEntryR\x06labels\x12\x12\n" +
+	"\x04type\x18\x06 \x01(\tR\x04type\x12/\n" +
+	"\braw_type\x18\a \x01(\x0e2\x14.protocol.MetricTypeR\arawType\x12\x18\n" +
+	"\apayload\x18\b \x01(\fR\apayload\x12\x1f\n" +
+	"\vpayload_ref\x18\t \x01(\rR\n" +
+	"payloadRef\x124\n" +
+	"\n" +
+	"provenance\x18\n" +
+	" \x01(\v2\x14.protocol.ProvenanceR\n" +
+	"provenance\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xcd\x01\n" +
+	"\n" +
+	"Provenance\x12\x19\n" +
+	"\bbatch_id\x18\x01 \x01(\tR\abatchId\x12\x17\n" +
+	"\aconn_id\x18\x02 \x01(\tR\x06connId\x12\x1a\n" +
+	"\blistener\x18\x03 \x01(\tR\blistener\x12\x1b\n" +
+	"\tsource_ip\x18\x04 \x01(\tR\bsourceIp\x12$\n" +
+	"\x0ereceived_at_ns\x18\x05 \x01(\x03R\freceivedAtNs\x12,\n" +
+	"\x12decode_duration_ns\x18\x06 \x01(\x03R\x10decodeDurationNs\"^\n" +
+	"\x0eMetricSnapshot\x120\n" +
+	"\ametrics\x18\x01 \x03(\v2\x16.protocol.StoredMetricR\ametrics\x12\x1a\n" +
+	"\bpayloads\x18\x02 \x03(\fR\bpayloads\"J\n" +
+	"\x14LatestMetricsRequest\x12\x14\n" +
+	"\x05limit\x18\x01 \x01(\x05R\x05limit\x12\x1c\n" +
+	"\tnamespace\x18\x02 \x01(\tR\tnamespace\"d\n" +
+	"\x13AgentMetricsRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x14\n" +
+	"\x05limit\x18\x02 \x01(\x05R\x05limit\x12\x1c\n" +
+	"\tnamespace\x18\x03 \x01(\tR\tnamespace\"x\n" +
+	"\x10TimeRangeRequest\x12\x19\n" +
+	"\bstart_ms\x18\x01 \x01(\x03R\astartMs\x12\x15\n" +
+	"\x06end_ms\x18\x02 \x01(\x03R\x05endMs\x12\x14\n" +
+	"\x05limit\x18\x03 \x01(\x05R\x05limit\x12\x1c\n" +
+	"\tnamespace\x18\x04 \x01(\tR\tnamespace\"H\n" +
+	"\x14QueryMetricsResponse\x120\n" +
+	"\ametrics\x18\x01 \x03(\v2\x16.protocol.StoredMetricR\ametrics\"n\n" +
+	"\x10SubscribeRequest\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x03 \x01(\tR\x04type\x12\x17\n" +
+	"\alast_id\x18\x04 \x01(\x04R\x06lastId\"M\n" +
+	"\vMetricEvent\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12.\n" +
+	"\x06metric\x18\x02 \x01(\v2\x16.protocol.StoredMetricR\x06metric*k\n" +
 	"\n" +
 	"MetricType\x12\r\n" +
 	"\tCPU_USAGE\x10\x00\x12\x10\n" +
 	"\fMEMORY_USAGE\x10\x01\x12\x13\n" +
 	"\x0fNETWORK_PACKETS\x10\x02\x12\f\n" +
-	"\bEBPF_RAW\x10\x032c\n" +
+	"\bEBPF_RAW\x10\x03\x12\x19\n" +
+	"\x15EXPONENTIAL_HISTOGRAM\x10\x042c\n" +
 	"\x0eMetricsService\x12Q\n" +
-	"\x10SendBatchMetrics\x12\x1d.protocol.BatchMetricsRequest\x1a\x1e.protocol.BatchMetricsResponseB+Z)github.com/konpure/Kon-Agent/pkg/protocolb\x06proto3"
+	"\x10SendBatchMetrics\x12\x1d.protocol.BatchMetricsRequest\x1a\x1e.protocol.BatchMetricsResponse2\xcf\x02\n" +
+	"\fQueryService\x12R\n" +
+	"\x10GetLatestMetrics\x12\x1e.protocol.LatestMetricsRequest\x1a\x1e.protocol.QueryMetricsResponse\x12T\n" +
+	"\x13GetMetricsByAgentID\x12\x1d.protocol.AgentMetricsRequest\x1a\x1e.protocol.QueryMetricsResponse\x12S\n" +
+	"\x15GetMetricsByTimeRange\x12\x1a.protocol.TimeRangeRequest\x1a\x1e.protocol.QueryMetricsResponse\x12@\n" +
+	"\tSubscribe\x12\x1a.protocol.SubscribeRequest\x1a\x15.protocol.MetricEvent0\x01B+Z)github.com/konpure/Kon-Agent/pkg/protocolb\x06proto3"
 
 var (
 	file_pkg_protocol_metrics_proto_rawDescOnce sync.Once
@@ -423,7 +1244,7 @@ func file_pkg_protocol_metrics_proto_rawDescGZIP() []byte {
 }
 
 var file_pkg_protocol_metrics_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_pkg_protocol_metrics_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_pkg_protocol_metrics_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
 var file_pkg_protocol_metrics_proto_goTypes = []any{
 	(MetricType)(0),              // 0: protocol.MetricType
 	(*Metric)(nil),               // 1: protocol.Metric
@@ -431,20 +1252,48 @@ var file_pkg_protocol_metrics_proto_goTypes = []any{
 	(*MetricsResponse)(nil),      // 3: protocol.MetricsResponse
 	(*BatchMetricsRequest)(nil),  // 4: protocol.BatchMetricsRequest
 	(*BatchMetricsResponse)(nil), // 5: protocol.BatchMetricsResponse
-	nil,                          // 6: protocol.Metric.LabelsEntry
+	(*AgentCommand)(nil),         // 6: protocol.AgentCommand
+	(*CommandResult)(nil),        // 7: protocol.CommandResult
+	(*StoredMetric)(nil),         // 8: protocol.StoredMetric
+	(*Provenance)(nil),           // 9: protocol.Provenance
+	(*MetricSnapshot)(nil),       // 10: protocol.MetricSnapshot
+	(*LatestMetricsRequest)(nil), // 11: protocol.LatestMetricsRequest
+	(*AgentMetricsRequest)(nil),  // 12: protocol.AgentMetricsRequest
+	(*TimeRangeRequest)(nil),     // 13: protocol.TimeRangeRequest
+	(*QueryMetricsResponse)(nil), // 14: protocol.QueryMetricsResponse
+	(*SubscribeRequest)(nil),     // 15: protocol.SubscribeRequest
+	(*MetricEvent)(nil),          // 16: protocol.MetricEvent
+	nil,                          // 17: protocol.Metric.LabelsEntry
+	nil,                          // 18: protocol.AgentCommand.ArgsEntry
+	nil,                          // 19: protocol.StoredMetric.LabelsEntry
 }
 var file_pkg_protocol_metrics_proto_depIdxs = []int32{
-	6, // 0: protocol.Metric.labels:type_name -> protocol.Metric.LabelsEntry
-	0, // 1: protocol.Metric.type:type_name -> protocol.MetricType
-	1, // 2: protocol.MetricsResponse.metrics:type_name -> protocol.Metric
-	1, // 3: protocol.BatchMetricsRequest.metrics:type_name -> protocol.Metric
-	4, // 4: protocol.MetricsService.SendBatchMetrics:input_type -> protocol.BatchMetricsRequest
-	5, // 5: protocol.MetricsService.SendBatchMetrics:output_type -> protocol.BatchMetricsResponse
-	5, // [5:6] is the sub-list for method output_type
-	4, // [4:5] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	17, // 0: protocol.Metric.labels:type_name -> protocol.Metric.LabelsEntry
+	0,  // 1: protocol.Metric.type:type_name -> protocol.MetricType
+	1,  // 2: protocol.MetricsResponse.metrics:type_name -> protocol.Metric
+	1,  // 3: protocol.BatchMetricsRequest.metrics:type_name -> protocol.Metric
+	18, // 4: protocol.AgentCommand.args:type_name -> protocol.AgentCommand.ArgsEntry
+	19, // 5: protocol.StoredMetric.labels:type_name -> protocol.StoredMetric.LabelsEntry
+	0,  // 6: protocol.StoredMetric.raw_type:type_name -> protocol.MetricType
+	9,  // 7: protocol.StoredMetric.provenance:type_name -> protocol.Provenance
+	8,  // 8: protocol.MetricSnapshot.metrics:type_name -> protocol.StoredMetric
+	8,  // 9: protocol.QueryMetricsResponse.metrics:type_name -> protocol.StoredMetric
+	8,  // 10: protocol.MetricEvent.metric:type_name -> protocol.StoredMetric
+	4,  // 11: protocol.MetricsService.SendBatchMetrics:input_type -> protocol.BatchMetricsRequest
+	11, // 12: protocol.QueryService.GetLatestMetrics:input_type -> protocol.LatestMetricsRequest
+	12, // 13: protocol.QueryService.GetMetricsByAgentID:input_type -> protocol.AgentMetricsRequest
+	13, // 14: protocol.QueryService.GetMetricsByTimeRange:input_type -> protocol.TimeRangeRequest
+	15, // 15: protocol.QueryService.Subscribe:input_type -> protocol.SubscribeRequest
+	5,  // 16: protocol.MetricsService.SendBatchMetrics:output_type -> protocol.BatchMetricsResponse
+	14, // 17: protocol.QueryService.GetLatestMetrics:output_type -> protocol.QueryMetricsResponse
+	14, // 18: protocol.QueryService.GetMetricsByAgentID:output_type -> protocol.QueryMetricsResponse
+	14, // 19: protocol.QueryService.GetMetricsByTimeRange:output_type -> protocol.QueryMetricsResponse
+	16, // 20: protocol.QueryService.Subscribe:output_type -> protocol.MetricEvent
+	16, // [16:21] is the sub-list for method output_type
+	11, // [11:16] is the sub-list for method input_type
+	11, // [11:11] is the sub-list for extension type_name
+	11, // [11:11] is the sub-list for extension extendee
+	0,  // [0:11] is the sub-list for field type_name
 }
 
 func init() { file_pkg_protocol_metrics_proto_init() }
@@ -458,9 +1307,9 @@ func file_pkg_protocol_metrics_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pkg_protocol_metrics_proto_rawDesc), len(file_pkg_protocol_metrics_proto_rawDesc)),
 			NumEnums:      1,
-			NumMessages:   6,
+			NumMessages:   19,
 			NumExtensions: 0,
-			NumServices:   1,
+			NumServices:   2,
 		},
 		GoTypes:           file_pkg_protocol_metrics_proto_goTypes,
 		DependencyIndexes: file_pkg_protocol_metrics_proto_depIdxs,
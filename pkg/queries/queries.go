@@ -0,0 +1,109 @@
+package queries
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+)
+
+// ErrQueryNotFound 查询不存在或已结束
+var ErrQueryNotFound = errors.New("query not found")
+
+// ErrQueryCanceled 查询被管理员取消
+var ErrQueryCanceled = errors.New("query canceled by operator")
+
+// Info 运行中查询的信息
+type Info struct {
+	ID          string    `json:"id"`
+	Source      string    `json:"source"`
+	Description string    `json:"description"`
+	RemoteAddr  string    `json:"remote_addr"`
+	StartedAt   time.Time `json:"started_at"`
+	Elapsed     string    `json:"elapsed"`
+}
+
+// Tracker 跟踪运行中的查询，支持按ID取消
+type Tracker struct {
+	mu      sync.Mutex
+	nextID  uint64
+	running map[string]*query
+	clock   clock.Clock
+}
+
+type query struct {
+	info   Info
+	cancel context.CancelCauseFunc
+}
+
+// NewTracker 创建查询跟踪器
+func NewTracker(clk clock.Clock) *Tracker {
+	return &Tracker{
+		running: make(map[string]*query),
+		clock:   clk,
+	}
+}
+
+// Start 登记一个查询，返回可被取消的context和结束时必须调用的done函数
+func (t *Tracker) Start(ctx context.Context, source, description, remoteAddr string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	t.mu.Lock()
+	t.nextID++
+	id := strconv.FormatUint(t.nextID, 10)
+	t.running[id] = &query{
+		info: Info{
+			ID:          id,
+			Source:      source,
+			Description: description,
+			RemoteAddr:  remoteAddr,
+			StartedAt:   t.clock.Now(),
+		},
+		cancel: cancel,
+	}
+	t.mu.Unlock()
+
+	done := func() {
+		t.mu.Lock()
+		delete(t.running, id)
+		t.mu.Unlock()
+		cancel(nil)
+	}
+	return ctx, done
+}
+
+// List 列出运行中的查询，按开始时间排序
+func (t *Tracker) List() []Info {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	result := make([]Info, 0, len(t.running))
+	for _, q := range t.running {
+		info := q.info
+		info.Elapsed = now.Sub(info.StartedAt).String()
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result
+}
+
+// Cancel 取消指定查询
+func (t *Tracker) Cancel(id string) error {
+	t.mu.Lock()
+	q, ok := t.running[id]
+	t.mu.Unlock()
+
+	if !ok {
+		return ErrQueryNotFound
+	}
+	q.cancel(ErrQueryCanceled)
+	return nil
+}
@@ -0,0 +1,460 @@
+// Package quota 按Agent或租户统计每个窗口写入的指标数和序列数，超出配额时告警或拒绝写入。
+// 平台可以先以soft模式观察哪些Agent会超出配额，再切换为带宽限期的hard模式，避免直接拒绝整个集群的数据
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// ErrExceeded 批次超出了hard模式且宽限期已结束的配额，整批被拒绝
+var ErrExceeded = errors.New("quota exceeded")
+
+// ExceededError 批次被拒绝的原因，errors.Is(err, ErrExceeded)为true
+type ExceededError struct {
+	// Warnings 这批数据超出的所有配额，包括只告警的配额
+	Warnings []Warning
+}
+
+func (e *ExceededError) Error() string {
+	for _, w := range e.Warnings {
+		if w.Enforced {
+			return fmt.Sprintf("%v: %s", ErrExceeded, w)
+		}
+	}
+	return ErrExceeded.Error()
+}
+
+// Is 使errors.Is(err, ErrExceeded)成立
+func (e *ExceededError) Is(target error) bool {
+	return target == ErrExceeded
+}
+
+// 统计范围
+const (
+	ScopeAgent  = "agent"
+	ScopeTenant = "tenant"
+)
+
+// 规则模式
+const (
+	ModeSoft = "soft"
+	ModeHard = "hard"
+)
+
+// 超出的限制
+const (
+	LimitMetrics = "metrics"
+	LimitSeries  = "series"
+)
+
+// Warning 一批数据超出的一项配额
+type Warning struct {
+	Rule  string `json:"rule"`
+	Scope string `json:"scope"`
+	// Key 超出配额的Agent ID或租户名称
+	Key string `json:"key"`
+	// AgentID 超出配额的数据所属的Agent
+	AgentID string `json:"agent_id"`
+	Limit   string `json:"limit"`
+	// Used 加上这批数据后窗口内的用量
+	Used int `json:"used"`
+	Max  int `json:"max"`
+	// Enforced 为true时这批数据被拒绝
+	Enforced bool `json:"enforced"`
+	// EnforceAt hard模式宽限期结束的时间，soft模式为nil
+	EnforceAt *time.Time `json:"enforce_at,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+// String 以"key=value; ..."的形式输出，用于日志、响应头和时间线事件
+func (w Warning) String() string {
+	s := fmt.Sprintf("rule=%s; scope=%s; key=%s; limit=%s; used=%d; max=%d; enforced=%t",
+		w.Rule, w.Scope, w.Key, w.Limit, w.Used, w.Max, w.Enforced)
+	if w.EnforceAt != nil {
+		s += "; enforce_at=" + w.EnforceAt.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// Status 各规则的配置、统计和当前窗口的用量
+type Status struct {
+	Window string       `json:"window"`
+	Rules  []RuleStatus `json:"rules"`
+}
+
+// RuleStatus 单条规则的状态
+type RuleStatus struct {
+	Name        string `json:"name"`
+	Scope       string `json:"scope"`
+	Match       string `json:"match,omitempty"`
+	Mode        string `json:"mode"`
+	MaxMetrics  int    `json:"max_metrics,omitempty"`
+	MaxSeries   int    `json:"max_series,omitempty"`
+	GracePeriod string `json:"grace_period,omitempty"`
+	// Warnings 超出配额但只告警的次数，Rejections 因该规则被拒绝的批次数
+	Warnings   uint64 `json:"warnings"`
+	Rejections uint64 `json:"rejections"`
+	// Usage 当前窗口有写入或仍在宽限期内的Agent或租户，按Key排序
+	Usage []Usage `json:"usage"`
+}
+
+// Usage 一个Agent或租户在当前窗口的用量
+type Usage struct {
+	Key     string `json:"key"`
+	Metrics int    `json:"metrics"`
+	Series  int    `json:"series,omitempty"`
+	// Exceeded 当前窗口内是否超出过配额
+	Exceeded bool `json:"exceeded"`
+	// GraceStart 本轮第一次超出配额的时间，EnforceAt hard模式开始拒绝的时间
+	GraceStart *time.Time `json:"grace_start,omitempty"`
+	EnforceAt  *time.Time `json:"enforce_at,omitempty"`
+}
+
+// usage 一个Agent或租户的计数，window为计数所在的窗口序号
+type usage struct {
+	window  int64
+	metrics int
+	series  map[string]struct{}
+	// graceStart 本轮第一次超出配额的时间，lastExceeded 最近一次超出的时间
+	graceStart   time.Time
+	lastExceeded time.Time
+}
+
+// rule 一条规则及其各Agent或租户的计数
+type rule struct {
+	config.QuotaRule
+	keys       map[string]*usage
+	warnings   uint64
+	rejections uint64
+}
+
+// Tracker 配额统计
+type Tracker struct {
+	mu           sync.Mutex
+	clock        clock.Clock
+	window       time.Duration
+	hintInterval time.Duration
+	maxKeys      int
+	rules        []*rule
+	tenantOf     func(m *processor.ProcessedMetric) string
+	// recent 各Agent最近一个窗口内的告警，供HTTP接入输出响应头
+	recent map[string][]Warning
+	// hinted 各Agent最近一次告警通知的时间
+	hinted map[string]time.Time
+	pruned int64
+}
+
+// NewTracker 校验规则并创建配额统计
+func NewTracker(cfg config.QuotaConfig, clk clock.Clock) (*Tracker, error) {
+	t := &Tracker{
+		clock:        clk,
+		window:       cfg.Window,
+		hintInterval: cfg.HintInterval,
+		maxKeys:      cfg.MaxKeys,
+		recent:       make(map[string][]Warning),
+		hinted:       make(map[string]time.Time),
+	}
+	names := make(map[string]bool)
+	for _, rc := range cfg.Rules {
+		if rc.Name == "" {
+			return nil, errors.New("quota rule name is required")
+		}
+		if names[rc.Name] {
+			return nil, fmt.Errorf("duplicate quota rule %q", rc.Name)
+		}
+		names[rc.Name] = true
+		if rc.Scope != ScopeAgent && rc.Scope != ScopeTenant {
+			return nil, fmt.Errorf("quota rule %q: unknown scope %q, use agent or tenant", rc.Name, rc.Scope)
+		}
+		if rc.Mode != ModeSoft && rc.Mode != ModeHard {
+			return nil, fmt.Errorf("quota rule %q: unknown mode %q, use soft or hard", rc.Name, rc.Mode)
+		}
+		if err := storage.ValidateGlob(rc.Match); err != nil {
+			return nil, fmt.Errorf("quota rule %q: invalid match %q: %w", rc.Name, rc.Match, err)
+		}
+		if rc.MaxMetrics <= 0 && rc.MaxSeries <= 0 {
+			return nil, fmt.Errorf("quota rule %q: max_metrics or max_series is required", rc.Name)
+		}
+		t.rules = append(t.rules, &rule{QuotaRule: rc, keys: make(map[string]*usage)})
+	}
+	return t, nil
+}
+
+// SetTenants 按tenantOf划分数据所属的租户，未设置时所有数据属于default租户，应在Check之前调用
+func (t *Tracker) SetTenants(tenantOf func(m *processor.ProcessedMetric) string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tenantOf = tenantOf
+}
+
+// pending 一批数据在一条规则的一个Agent或租户上的增量
+type pending struct {
+	rule    *rule
+	key     string
+	agentID string
+	usage   *usage
+	metrics int
+	series  map[string]struct{}
+}
+
+// Check 在写入存储前检查一批数据，返回这批数据超出的配额
+//
+// 没有超出hard模式且宽限期已结束的配额时计入用量，否则整批不计入并返回*ExceededError，调用方应丢弃这批数据。
+func (t *Tracker) Check(metrics []processor.ProcessedMetric) ([]Warning, error) {
+	now := t.clock.Now()
+	window := now.UnixNano() / int64(t.window)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now, window)
+
+	var batch []*pending
+	index := make(map[*rule]map[string]*pending)
+	for i := range metrics {
+		m := &metrics[i]
+		for _, r := range t.rules {
+			key := m.AgentID
+			if r.Scope == ScopeTenant {
+				key = t.tenant(m)
+			}
+			if !storage.MatchGlob(r.Match, key) {
+				continue
+			}
+			p, ok := index[r][key]
+			if !ok {
+				u := t.usage(r, key, window)
+				if u == nil {
+					continue
+				}
+				p = &pending{rule: r, key: key, agentID: m.AgentID, usage: u, series: make(map[string]struct{})}
+				if index[r] == nil {
+					index[r] = make(map[string]*pending)
+				}
+				index[r][key] = p
+				batch = append(batch, p)
+			}
+			p.metrics++
+			if r.MaxSeries > 0 {
+				sk := processor.SeriesKey(m)
+				if _, seen := p.usage.series[sk]; !seen {
+					p.series[sk] = struct{}{}
+				}
+			}
+		}
+	}
+
+	var warnings []Warning
+	rejected := false
+	for _, p := range batch {
+		r, u := p.rule, p.usage
+		var exceeded []Warning
+		if used := u.metrics + p.metrics; r.MaxMetrics > 0 && used > r.MaxMetrics {
+			exceeded = append(exceeded, Warning{Limit: LimitMetrics, Used: used, Max: r.MaxMetrics})
+		}
+		if used := len(u.series) + len(p.series); r.MaxSeries > 0 && used > r.MaxSeries {
+			exceeded = append(exceeded, Warning{Limit: LimitSeries, Used: used, Max: r.MaxSeries})
+		}
+		if len(exceeded) == 0 {
+			continue
+		}
+
+		// 有一个完整窗口没有超出配额时重新计算宽限期
+		if u.graceStart.IsZero() || now.Sub(u.lastExceeded) > t.window {
+			u.graceStart = now
+		}
+		u.lastExceeded = now
+		for _, w := range exceeded {
+			w.Rule, w.Scope, w.Key, w.AgentID, w.Time = r.Name, r.Scope, p.key, p.agentID, now
+			if r.Mode == ModeHard {
+				enforceAt := u.graceStart.Add(r.GracePeriod)
+				w.EnforceAt = &enforceAt
+				w.Enforced = !now.Before(enforceAt)
+			}
+			if w.Enforced {
+				rejected = true
+				r.rejections++
+			} else {
+				r.warnings++
+			}
+			warnings = append(warnings, w)
+			t.remember(w)
+		}
+	}
+	if rejected {
+		return warnings, &ExceededError{Warnings: warnings}
+	}
+
+	for _, p := range batch {
+		p.usage.metrics += p.metrics
+		for sk := range p.series {
+			p.usage.series[sk] = struct{}{}
+		}
+	}
+	return warnings, nil
+}
+
+// Warnings 返回Agent最近一个窗口内收到的告警，同一规则、Key和限制只保留最新的一条
+func (t *Tracker) Warnings(agentID string) []Warning {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var warnings []Warning
+	for _, w := range t.recent[agentID] {
+		if now.Sub(w.Time) < t.window {
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+// RetryAfter 返回距离当前窗口结束的时间，被拒绝的客户端应在此之后重试
+func (t *Tracker) RetryAfter() time.Duration {
+	now := t.clock.Now().UnixNano()
+	return time.Duration(int64(t.window) - now%int64(t.window))
+}
+
+// Hint 判断是否应通知Agent的告警，距离上次通知不足hint_interval时返回false，否则记录本次通知并返回true
+func (t *Tracker) Hint(agentID string) bool {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if last, ok := t.hinted[agentID]; ok && now.Sub(last) < t.hintInterval {
+		return false
+	}
+	t.hinted[agentID] = now
+	return true
+}
+
+// Status 返回各规则的状态
+func (t *Tracker) Status() Status {
+	now := t.clock.Now()
+	window := now.UnixNano() / int64(t.window)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status := Status{Window: t.window.String(), Rules: make([]RuleStatus, 0, len(t.rules))}
+	for _, r := range t.rules {
+		rs := RuleStatus{
+			Name:       r.Name,
+			Scope:      r.Scope,
+			Match:      r.Match,
+			Mode:       r.Mode,
+			MaxMetrics: r.MaxMetrics,
+			MaxSeries:  r.MaxSeries,
+			Warnings:   r.warnings,
+			Rejections: r.rejections,
+			Usage:      []Usage{},
+		}
+		if r.Mode == ModeHard {
+			rs.GracePeriod = r.GracePeriod.String()
+		}
+		for key, u := range r.keys {
+			inGrace := !u.graceStart.IsZero() && now.Sub(u.lastExceeded) <= t.window
+			if u.window != window && !inGrace {
+				continue
+			}
+			usage := Usage{Key: key, Exceeded: u.lastExceeded.UnixNano()/int64(t.window) == window}
+			if u.window == window {
+				usage.Metrics, usage.Series = u.metrics, len(u.series)
+			}
+			if inGrace {
+				graceStart := u.graceStart
+				usage.GraceStart = &graceStart
+				if r.Mode == ModeHard {
+					enforceAt := graceStart.Add(r.GracePeriod)
+					usage.EnforceAt = &enforceAt
+				}
+			}
+			rs.Usage = append(rs.Usage, usage)
+		}
+		sort.Slice(rs.Usage, func(i, j int) bool { return rs.Usage[i].Key < rs.Usage[j].Key })
+		status.Rules = append(status.Rules, rs)
+	}
+	return status
+}
+
+// usage 返回规则在Key上的计数，进入新窗口时清零，Key数达到上限时返回nil，调用方需持有锁
+func (t *Tracker) usage(r *rule, key string, window int64) *usage {
+	u, ok := r.keys[key]
+	if !ok {
+		if t.maxKeys > 0 && len(r.keys) >= t.maxKeys {
+			return nil
+		}
+		u = &usage{window: window}
+		r.keys[key] = u
+	}
+	if u.window != window || u.series == nil {
+		u.window = window
+		u.metrics = 0
+		u.series = make(map[string]struct{})
+	}
+	return u
+}
+
+// remember 记录Agent收到的告警，替换同一规则、Key和限制的旧告警，调用方需持有锁
+func (t *Tracker) remember(w Warning) {
+	recent := t.recent[w.AgentID]
+	for i := range recent {
+		if recent[i].Rule == w.Rule && recent[i].Key == w.Key && recent[i].Limit == w.Limit {
+			recent[i] = w
+			return
+		}
+	}
+	t.recent[w.AgentID] = append(recent, w)
+}
+
+// prune 每个窗口开始时删除上个窗口之前没有写入且不在宽限期内的计数、过期的告警和通知记录，调用方需持有锁
+func (t *Tracker) prune(now time.Time, window int64) {
+	if window == t.pruned {
+		return
+	}
+	t.pruned = window
+	for _, r := range t.rules {
+		for key, u := range r.keys {
+			if u.window < window-1 && now.Sub(u.lastExceeded) > t.window {
+				delete(r.keys, key)
+			}
+		}
+	}
+	for agentID, recent := range t.recent {
+		kept := recent[:0]
+		for _, w := range recent {
+			if now.Sub(w.Time) < t.window {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.recent, agentID)
+		} else {
+			t.recent[agentID] = kept
+		}
+	}
+	for agentID, last := range t.hinted {
+		if now.Sub(last) >= t.hintInterval {
+			delete(t.hinted, agentID)
+		}
+	}
+}
+
+// tenant 返回数据所属的租户，调用方需持有锁
+func (t *Tracker) tenant(m *processor.ProcessedMetric) string {
+	if t.tenantOf == nil {
+		return storage.DefaultNamespace
+	}
+	return t.tenantOf(m)
+}
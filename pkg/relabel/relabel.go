@@ -0,0 +1,188 @@
+// Package relabel 按与Prometheus metric_relabel_configs相同语义的规则改写接入数据的指标名和标签
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// 规则中表示指标名和Agent ID的标签名
+const (
+	NameLabel  = "__name__"
+	AgentLabel = "__agent_id__"
+)
+
+// 改写动作
+const (
+	Replace   = "replace"
+	Keep      = "keep"
+	Drop      = "drop"
+	LabelDrop = "labeldrop"
+	LabelKeep = "labelkeep"
+)
+
+// rule 填充默认值并编译正则表达式后的规则
+type rule struct {
+	config.RelabelRule
+	regex *regexp.Regexp
+}
+
+// Stage 按顺序执行改写规则的处理阶段，规则可以在运行时替换
+//
+// replace把匹配的源标签取值按replacement写入target_label，keep和drop按源标签取值保留或丢弃数据，
+// labeldrop和labelkeep按标签名删除或只保留匹配的标签。
+type Stage struct {
+	mu    sync.RWMutex
+	rules []rule
+}
+
+// NewStage 创建改写阶段，规则无效时返回错误
+func NewStage(rules []config.RelabelRule) (*Stage, error) {
+	s := &Stage{}
+	if err := s.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate 校验规则
+func Validate(rules []config.RelabelRule) error {
+	_, err := compile(rules)
+	return err
+}
+
+// SetRules 替换改写规则，规则无效时保留原有规则并返回错误
+func (s *Stage) SetRules(rules []config.RelabelRule) error {
+	compiled, err := compile(rules)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.rules = compiled
+	s.mu.Unlock()
+	return nil
+}
+
+// Name 返回阶段名称
+func (s *Stage) Name() string {
+	return "relabel"
+}
+
+// Process 依次执行规则，keep或drop规则丢弃数据时返回false
+func (s *Stage) Process(m *processor.ProcessedMetric) (bool, error) {
+	s.mu.RLock()
+	rules := s.rules
+	s.mu.RUnlock()
+
+	for i := range rules {
+		if !rules[i].apply(m) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compile 填充默认值并校验规则
+func compile(rules []config.RelabelRule) ([]rule, error) {
+	compiled := make([]rule, 0, len(rules))
+	for i, r := range rules {
+		if r.Action == "" {
+			r.Action = Replace
+		}
+		if r.Separator == "" {
+			r.Separator = ";"
+		}
+		if r.Regex == "" {
+			r.Regex = "(.*)"
+		}
+		if r.Replacement == "" {
+			r.Replacement = "$1"
+		}
+		re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex: %w", i, err)
+		}
+
+		switch r.Action {
+		case Replace:
+			if r.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: replace requires target_label", i)
+			}
+			if r.TargetLabel == AgentLabel {
+				return nil, fmt.Errorf("relabel rule %d: %s cannot be rewritten", i, AgentLabel)
+			}
+		case Keep, Drop:
+			if len(r.SourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel rule %d: %s requires source_labels", i, r.Action)
+			}
+		case LabelDrop, LabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q", i, r.Action)
+		}
+		compiled = append(compiled, rule{RelabelRule: r, regex: re})
+	}
+	return compiled, nil
+}
+
+// apply 对数据执行规则，返回false表示丢弃数据
+func (r *rule) apply(m *processor.ProcessedMetric) bool {
+	switch r.Action {
+	case LabelDrop, LabelKeep:
+		for name := range m.Labels {
+			if r.regex.MatchString(name) == (r.Action == LabelDrop) {
+				delete(m.Labels, name)
+			}
+		}
+		return true
+	}
+
+	value := r.source(m)
+	match := r.regex.FindStringSubmatchIndex(value)
+	switch r.Action {
+	case Keep:
+		return match != nil
+	case Drop:
+		return match == nil
+	}
+	if match == nil {
+		return true
+	}
+
+	result := string(r.regex.ExpandString(nil, r.Replacement, value, match))
+	switch {
+	case r.TargetLabel == NameLabel:
+		// 指标名不能为空，替换结果为空时保持原名
+		if result != "" {
+			m.Name = result
+		}
+	case result == "":
+		delete(m.Labels, r.TargetLabel)
+	default:
+		if m.Labels == nil {
+			m.Labels = make(map[string]string)
+		}
+		m.Labels[r.TargetLabel] = result
+	}
+	return true
+}
+
+// source 返回源标签取值用分隔符连接的结果
+func (r *rule) source(m *processor.ProcessedMetric) string {
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		switch name {
+		case NameLabel:
+			values[i] = m.Name
+		case AgentLabel:
+			values[i] = m.AgentID
+		default:
+			values[i] = m.Labels[name]
+		}
+	}
+	return strings.Join(values, r.Separator)
+}
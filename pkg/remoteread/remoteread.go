@@ -0,0 +1,357 @@
+package remoteread
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/exposition"
+	"github.com/konpure/Kon-Agent-export/pkg/histogram"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ErrTooManySamples 查询读取的数据超过max_samples
+var ErrTooManySamples = errors.New("too many samples")
+
+// responseTypeSamples ReadRequest.ResponseType.SAMPLES，只支持这种响应格式
+const responseTypeSamples = 0
+
+// matchTypes 按remote_read中LabelMatcher.Type的取值顺序排列的匹配方式
+var matchTypes = []string{storage.MatchEqual, storage.MatchNotEqual, storage.MatchRegexp, storage.MatchNotRegexp}
+
+// Query 一个查询，时间范围为[Start, End]
+type Query struct {
+	Start    time.Time
+	End      time.Time
+	Matchers []*storage.LabelMatcher
+}
+
+// label 一个标签
+type label struct {
+	name  string
+	value string
+}
+
+// sample 一个样本
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+// series 一个序列，labels按名称排序并包含__name__
+type series struct {
+	labels  []label
+	samples []sample
+}
+
+// Reader 按Prometheus remote_read协议查询存储中的数据
+//
+// 指标名和标签的转换规则与remote_write相同：指标名加prefix前缀并转换为合法名称，
+// Agent ID作为agent_id标签，指数直方图转换为_sum和_count两个序列。
+// 只支持SAMPLES响应格式，请求只接受流式分块格式时返回错误。
+type Reader struct {
+	prefix     string
+	maxSamples int
+}
+
+// NewReader 创建remote_read查询器
+func NewReader(cfg config.RemoteReadConfig) *Reader {
+	return &Reader{prefix: cfg.Prefix, maxSamples: cfg.MaxSamples}
+}
+
+// DecodeRequest 解码snappy压缩的prometheus.ReadRequest
+//
+//	ReadRequest  { repeated Query queries = 1; repeated ResponseType accepted_response_types = 2; }
+//	Query        { int64 start_timestamp_ms = 1; int64 end_timestamp_ms = 2; repeated LabelMatcher matchers = 3; }
+//	LabelMatcher { Type type = 1; string name = 2; string value = 3; }
+func DecodeRequest(body []byte) ([]Query, error) {
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("decode snappy: %w", err)
+	}
+
+	var queries []Query
+	var accepted []uint64
+	err = walk(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			q, err := decodeQuery(v)
+			if err != nil {
+				return err
+			}
+			queries = append(queries, q)
+		case num == 2 && typ == protowire.VarintType:
+			accepted = append(accepted, n)
+		case num == 2 && typ == protowire.BytesType:
+			// packed repeated enum
+			for len(v) > 0 {
+				t, l := protowire.ConsumeVarint(v)
+				if l < 0 {
+					return protowire.ParseError(l)
+				}
+				accepted = append(accepted, t)
+				v = v[l:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(accepted) > 0 {
+		found := false
+		for _, t := range accepted {
+			found = found || t == responseTypeSamples
+		}
+		if !found {
+			return nil, errors.New("only the SAMPLES response type is supported")
+		}
+	}
+	return queries, nil
+}
+
+// decodeQuery 解码prometheus.Query
+func decodeQuery(data []byte) (Query, error) {
+	var q Query
+	err := walk(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			q.Start = time.UnixMilli(int64(n))
+		case num == 2 && typ == protowire.VarintType:
+			q.End = time.UnixMilli(int64(n))
+		case num == 3 && typ == protowire.BytesType:
+			m, err := decodeMatcher(v)
+			if err != nil {
+				return err
+			}
+			q.Matchers = append(q.Matchers, m)
+		}
+		return nil
+	})
+	return q, err
+}
+
+// decodeMatcher 解码prometheus.LabelMatcher
+func decodeMatcher(data []byte) (*storage.LabelMatcher, error) {
+	var matchType uint64
+	var name, value string
+	err := walk(data, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			matchType = n
+		case num == 2 && typ == protowire.BytesType:
+			name = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			value = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if matchType >= uint64(len(matchTypes)) {
+		return nil, fmt.Errorf("invalid matcher type %d", matchType)
+	}
+	return storage.NewLabelMatcher(name, matchTypes[matchType], value)
+}
+
+// walk 依次处理消息中的字段，varint字段的值放在n中，bytes字段的值放在v中，其余类型跳过
+func walk(data []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(data) > 0 {
+		num, typ, l := protowire.ConsumeTag(data)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		data = data[l:]
+
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(data)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		data = data[l:]
+
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			if err := fn(num, typ, v, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read 依次执行查询，返回snappy压缩的prometheus.ReadResponse
+//
+// allow不为nil时只返回allow为true的数据。查询读取的数据超过max_samples时返回ErrTooManySamples。
+func (r *Reader) Read(sq storage.SortedQuerier, queries []Query, allow func(m *processor.ProcessedMetric) bool) ([]byte, error) {
+	var buf, result []byte
+	for _, q := range queries {
+		found, err := r.query(sq, q, allow)
+		if err != nil {
+			return nil, err
+		}
+		result = result[:0]
+		for _, s := range found {
+			result = protowire.AppendTag(result, 1, protowire.BytesType)
+			result = protowire.AppendBytes(result, encodeSeries(s))
+		}
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, result)
+	}
+	return snappy.Encode(nil, buf), nil
+}
+
+// query 执行一个查询，返回按标签排序的序列，序列内的样本按时间升序且时间戳不重复
+func (r *Reader) query(sq storage.SortedQuerier, q Query, allow func(m *processor.ProcessedMetric) bool) ([]*series, error) {
+	// agent_id的等值匹配在存储层过滤，其余条件在转换为序列后匹配
+	filter := storage.Filter{Start: q.Start, End: q.End}
+	for _, m := range q.Matchers {
+		if m.Name == "agent_id" && m.Type == storage.MatchEqual {
+			filter.AgentID = m.Value
+		}
+	}
+	// 不可见的数据不计入max_samples
+	filter.Allow = allow
+	metrics, err := sq.QuerySorted(filter, storage.SortOptions{Field: storage.SortByTimestamp}, r.maxSamples+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) > r.maxSamples {
+		return nil, fmt.Errorf("%w: query reads more than %d samples", ErrTooManySamples, r.maxSamples)
+	}
+
+	index := make(map[string]*series)
+	var key strings.Builder
+	add := func(name string, m *processor.ProcessedMetric, value float64) {
+		labels := r.labels(name, m)
+		if !matches(labels, q.Matchers) {
+			return
+		}
+		key.Reset()
+		for _, l := range labels {
+			key.WriteString(l.name)
+			key.WriteByte(0)
+			key.WriteString(l.value)
+			key.WriteByte(0)
+		}
+		s, ok := index[key.String()]
+		if !ok {
+			s = &series{labels: labels}
+			index[key.String()] = s
+		}
+		ts := m.Timestamp.UnixMilli()
+		// 同一毫秒的重复数据只保留最后写入的一条
+		if n := len(s.samples); n > 0 && s.samples[n-1].timestamp == ts {
+			s.samples[n-1].value = value
+			return
+		}
+		s.samples = append(s.samples, sample{value: value, timestamp: ts})
+	}
+
+	for i := range metrics {
+		m := &metrics[i]
+		name := r.prefix + exposition.SanitizeName(m.Name)
+		if m.RawType != protocol.MetricType_EXPONENTIAL_HISTOGRAM {
+			add(name, m, m.Value)
+			continue
+		}
+		h, err := histogram.Unmarshal(m.Payload)
+		if err != nil {
+			continue
+		}
+		if h.Sum != nil {
+			add(name+"_sum", m, *h.Sum)
+		}
+		add(name+"_count", m, float64(h.Count))
+	}
+
+	keys := make([]string, 0, len(index))
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]*series, len(keys))
+	for i, k := range keys {
+		result[i] = index[k]
+	}
+	return result, nil
+}
+
+// labels 返回按名称排序的标签，包括__name__和agent_id，数据自带的agent_id标签改名为exported_agent_id
+func (r *Reader) labels(name string, m *processor.ProcessedMetric) []label {
+	labels := make([]label, 0, len(m.Labels)+2)
+	labels = append(labels, label{storage.MetricNameLabel, name}, label{"agent_id", m.AgentID})
+	seen := map[string]bool{storage.MetricNameLabel: true, "agent_id": true}
+	for k, v := range m.Labels {
+		k = exposition.SanitizeLabel(k)
+		if k == "agent_id" {
+			k = "exported_agent_id"
+		}
+		if !seen[k] {
+			seen[k] = true
+			labels = append(labels, label{k, v})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// matches 判断标签集是否满足全部匹配条件，不存在的标签按空字符串匹配
+func matches(labels []label, matchers []*storage.LabelMatcher) bool {
+	for _, m := range matchers {
+		value := ""
+		for _, l := range labels {
+			if l.name == m.Name {
+				value = l.value
+				break
+			}
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeSeries 编码prometheus.TimeSeries
+//
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label      { string name = 1; string value = 2; }
+//	Sample     { double value = 1; int64 timestamp = 2; }
+func encodeSeries(s *series) []byte {
+	var ts, msg []byte
+	for _, l := range s.labels {
+		msg = protowire.AppendTag(msg[:0], 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, l.name)
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, l.value)
+		ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+	}
+	for _, smp := range s.samples {
+		msg = protowire.AppendTag(msg[:0], 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(smp.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(smp.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+	}
+	return ts
+}
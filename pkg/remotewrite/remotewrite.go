@@ -0,0 +1,377 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/exposition"
+	"github.com/konpure/Kon-Agent-export/pkg/histogram"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Stats 转发统计
+type Stats struct {
+	// Queued 等待发送的样本数
+	Queued int `json:"queued"`
+	// Sent 已发送成功的样本数
+	Sent uint64 `json:"sent_samples"`
+	// Failed 重试后仍发送失败而丢弃的样本数
+	Failed uint64 `json:"failed_samples"`
+	// Dropped 队列已满而丢弃的样本数
+	Dropped uint64 `json:"dropped_samples"`
+	// Retries 发送失败后的重试次数
+	Retries   uint64     `json:"retries"`
+	LastSend  *time.Time `json:"last_send,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// label 一个标签
+type label struct {
+	name  string
+	value string
+}
+
+// sample 一个待发送的样本，labels按名称排序并包含__name__
+type sample struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// permanentError 重试也不会成功的错误，如请求被拒绝(4xx)
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Forwarder 把写入存储的数据按Prometheus remote_write协议转发，使服务器可以作为接入现有TSDB的桥梁
+//
+// Forward把数据转换为样本放入队列后立即返回，不阻塞接入；队列满时丢弃新样本。
+// 后台协程攒够max_samples_per_send条或等待batch_send_deadline后发送一批，
+// 失败时按min_backoff到max_backoff指数退避重试，4xx(429除外)不重试。
+type Forwarder struct {
+	cfg    config.RemoteWriteConfig
+	url    string
+	client *http.Client
+	clock  clock.Clock
+	faults *chaos.Injector
+
+	mu    sync.Mutex
+	queue []sample
+	stats Stats
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	// ctx 在Close超时时取消，中断正在进行的重试
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewForwarder 创建转发器并启动后台发送协程，faults为nil时不注入故障
+func NewForwarder(cfg config.RemoteWriteConfig, clk clock.Clock, faults *chaos.Injector) (*Forwarder, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid remote_write url %q", cfg.URL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Forwarder{
+		cfg:    cfg,
+		url:    u.String(),
+		client: &http.Client{Timeout: cfg.Timeout},
+		clock:  clk,
+		faults: faults,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go f.run()
+	return f, nil
+}
+
+// Forward 把一批写入存储的数据放入发送队列，应在数据写入存储后调用
+func (f *Forwarder) Forward(metrics []processor.ProcessedMetric) {
+	samples := make([]sample, 0, len(metrics))
+	for i := range metrics {
+		samples = f.appendSamples(samples, &metrics[i])
+	}
+
+	f.mu.Lock()
+	if room := f.cfg.QueueSize - len(f.queue); len(samples) > room {
+		f.stats.Dropped += uint64(len(samples) - max(room, 0))
+		samples = samples[:max(room, 0)]
+	}
+	f.queue = append(f.queue, samples...)
+	full := len(f.queue) >= f.cfg.MaxSamplesPerSend
+	f.mu.Unlock()
+
+	if full {
+		select {
+		case f.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// appendSamples 把指标转换为样本，指数直方图转换为_sum和_count两个序列
+func (f *Forwarder) appendSamples(samples []sample, m *processor.ProcessedMetric) []sample {
+	name := f.cfg.Prefix + exposition.SanitizeName(m.Name)
+	ts := m.Timestamp.UnixMilli()
+
+	if m.RawType != protocol.MetricType_EXPONENTIAL_HISTOGRAM {
+		return append(samples, sample{labels: f.labels(name, m), value: m.Value, timestamp: ts})
+	}
+	h, err := histogram.Unmarshal(m.Payload)
+	if err != nil {
+		return samples
+	}
+	if h.Sum != nil {
+		samples = append(samples, sample{labels: f.labels(name+"_sum", m), value: *h.Sum, timestamp: ts})
+	}
+	return append(samples, sample{labels: f.labels(name+"_count", m), value: float64(h.Count), timestamp: ts})
+}
+
+// labels 返回按名称排序的标签，包括__name__、agent_id和external_labels，
+// 数据自带的agent_id标签改名为exported_agent_id，external_labels不覆盖数据自带的标签
+func (f *Forwarder) labels(name string, m *processor.ProcessedMetric) []label {
+	labels := make([]label, 0, len(m.Labels)+len(f.cfg.ExternalLabels)+2)
+	labels = append(labels, label{"__name__", name}, label{"agent_id", m.AgentID})
+	seen := map[string]bool{"__name__": true, "agent_id": true}
+	for k, v := range m.Labels {
+		k = exposition.SanitizeLabel(k)
+		if k == "agent_id" {
+			k = "exported_agent_id"
+		}
+		if !seen[k] {
+			seen[k] = true
+			labels = append(labels, label{k, v})
+		}
+	}
+	for k, v := range f.cfg.ExternalLabels {
+		if !seen[k] {
+			labels = append(labels, label{k, v})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// Stats 返回转发统计
+func (f *Forwarder) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := f.stats
+	stats.Queued = len(f.queue)
+	return stats
+}
+
+// Close 发送队列中剩余的样本后停止，ctx结束时放弃未发送的样本
+func (f *Forwarder) Close(ctx context.Context) error {
+	close(f.stop)
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		f.cancel()
+		<-f.done
+		return fmt.Errorf("remote_write: %d samples not sent: %w", f.Stats().Queued, ctx.Err())
+	}
+}
+
+// run 后台发送协程
+func (f *Forwarder) run() {
+	defer close(f.done)
+	ticker := time.NewTicker(f.cfg.BatchSendDeadline)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			f.flush(true)
+			return
+		case <-f.wake:
+			f.flush(false)
+		case <-ticker.C:
+			f.flush(true)
+		}
+	}
+}
+
+// flush 发送队列中的样本，all为false时只发送攒满max_samples_per_send条的批次
+func (f *Forwarder) flush(all bool) {
+	for f.ctx.Err() == nil {
+		f.mu.Lock()
+		n := len(f.queue)
+		if n == 0 || (!all && n < f.cfg.MaxSamplesPerSend) {
+			f.mu.Unlock()
+			return
+		}
+		batch := f.queue[:min(n, f.cfg.MaxSamplesPerSend)]
+		f.queue = f.queue[len(batch):]
+		f.mu.Unlock()
+
+		f.send(batch)
+	}
+}
+
+// send 发送一批样本，失败时指数退避重试
+func (f *Forwarder) send(batch []sample) {
+	body := snappy.Encode(nil, encodeWriteRequest(batch))
+	backoff := f.cfg.MinBackoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = f.post(body); err == nil {
+			now := f.clock.Now()
+			f.mu.Lock()
+			f.stats.Sent += uint64(len(batch))
+			f.stats.LastSend = &now
+			f.mu.Unlock()
+			return
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= f.cfg.MaxRetries {
+			break
+		}
+
+		f.mu.Lock()
+		f.stats.Retries++
+		f.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-f.ctx.Done():
+		}
+		if f.ctx.Err() != nil {
+			break
+		}
+		backoff = min(backoff*2, f.cfg.MaxBackoff)
+	}
+
+	f.mu.Lock()
+	f.stats.Failed += uint64(len(batch))
+	f.stats.LastError = err.Error()
+	f.mu.Unlock()
+	log.Printf("Failed to forward %d samples to remote_write endpoint, dropping them: %v", len(batch), err)
+}
+
+// post 发送一次请求，非2xx响应返回错误，4xx(429除外)为permanentError
+func (f *Forwarder) post(body []byte) error {
+	if err := f.faults.FailSend("remote_write"); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "kon-agent-export")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range f.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case f.cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+f.cfg.BearerToken)
+	case f.cfg.BasicAuth.Username != "":
+		req.SetBasicAuth(f.cfg.BasicAuth.Username, f.cfg.BasicAuth.Password)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// encodeWriteRequest 编码prometheus.WriteRequest，标签相同的样本合并为一个TimeSeries并按时间排序
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []sample) []byte {
+	type series struct {
+		labels  []label
+		samples []sample
+	}
+	var order []*series
+	index := make(map[string]*series)
+	var key strings.Builder
+	for i := range samples {
+		key.Reset()
+		for _, l := range samples[i].labels {
+			key.WriteString(l.name)
+			key.WriteByte(0)
+			key.WriteString(l.value)
+			key.WriteByte(0)
+		}
+		s, ok := index[key.String()]
+		if !ok {
+			s = &series{labels: samples[i].labels}
+			index[key.String()] = s
+			order = append(order, s)
+		}
+		s.samples = append(s.samples, samples[i])
+	}
+
+	var buf, ts, msg []byte
+	for _, s := range order {
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].timestamp < s.samples[j].timestamp })
+
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = protowire.AppendTag(msg[:0], 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		for _, smp := range s.samples {
+			msg = protowire.AppendTag(msg[:0], 1, protowire.Fixed64Type)
+			msg = protowire.AppendFixed64(msg, math.Float64bits(smp.value))
+			msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+			msg = protowire.AppendVarint(msg, uint64(smp.timestamp))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, ts)
+	}
+	return buf
+}
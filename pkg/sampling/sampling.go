@@ -0,0 +1,162 @@
+// Package sampling 提供按比例保留指标的抽样算法和丢弃未抽中序列的处理阶段
+package sampling
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 内置抽样算法名称
+const (
+	Hash   = "hash"
+	Random = "random"
+)
+
+// ErrUnknownSampler 未注册的抽样算法
+var ErrUnknownSampler = errors.New("unknown sampler")
+
+// Sampler 抽样算法
+type Sampler interface {
+	// Name 返回算法名称，与配置中的名称一致
+	Name() string
+	// Sample 以rate(0~1)的比例返回true
+	Sample(m *processor.ProcessedMetric, rate float64) bool
+}
+
+var (
+	samplersMu sync.RWMutex
+	samplers   = make(map[string]Sampler)
+)
+
+func init() {
+	Register(hashSampler{})
+	Register(randomSampler{})
+}
+
+// Register 注册抽样算法，重复注册会panic
+func Register(s Sampler) {
+	samplersMu.Lock()
+	defer samplersMu.Unlock()
+
+	name := s.Name()
+	if _, dup := samplers[name]; dup {
+		panic("sampling: Register called twice for " + name)
+	}
+	samplers[name] = s
+}
+
+// Get 按名称查找抽样算法，空名称等同于hash
+func Get(name string) (Sampler, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = Hash
+	}
+
+	samplersMu.RLock()
+	defer samplersMu.RUnlock()
+
+	s, ok := samplers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSampler, name)
+	}
+	return s, nil
+}
+
+// hashSampler 按序列标识的哈希值抽样，同一序列在重启后和不同副本上的结果相同
+//
+// 序列标识由Agent ID、指标名和排序后的标签组成，哈希值映射到[0,1)后小于rate的序列被保留，
+// 因此提高rate时原来保留的序列仍然保留，抽样后的序列可以完整地用于统计。
+type hashSampler struct{}
+
+func (hashSampler) Name() string { return Hash }
+
+func (hashSampler) Sample(m *processor.ProcessedMetric, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	return SeriesFraction(m) < rate
+}
+
+// randomSampler 每个样本独立随机抽样，同一序列的样本会被部分保留
+type randomSampler struct{}
+
+func (randomSampler) Name() string { return Random }
+
+func (randomSampler) Sample(_ *processor.ProcessedMetric, rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// SeriesFraction 把序列标识的哈希值均匀映射到[0,1)，结果只取决于序列标识
+func SeriesFraction(m *processor.ProcessedMetric) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.AgentID))
+	h.Write([]byte{0})
+	h.Write([]byte(m.Name))
+
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte{0})
+		h.Write([]byte(k))
+		h.Write([]byte{'='})
+		h.Write([]byte(m.Labels[k]))
+	}
+	// FNV的高位对结尾几个字节的变化不敏感，先按murmur3的fmix64打散再取高53位
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x>>11) / (1 << 53)
+}
+
+// Stage 按规则抽样保留序列的处理阶段，未抽中的指标被丢弃
+//
+// 规则按顺序匹配第一条，不匹配任何规则的指标全部保留。
+type Stage struct {
+	sampler Sampler
+	rules   []config.SamplingRule
+}
+
+// NewStage 创建抽样处理阶段，抽样算法未注册或比例不在[0,1]内时返回错误
+func NewStage(cfg config.SamplingConfig) (*Stage, error) {
+	sampler, err := Get(cfg.Sampler)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Rate < 0 || rule.Rate > 1 {
+			return nil, fmt.Errorf("sampling rule %s: rate must be between 0 and 1", rule.Metric)
+		}
+	}
+	return &Stage{sampler: sampler, rules: cfg.Rules}, nil
+}
+
+// Name 返回阶段名称
+func (s *Stage) Name() string {
+	return "sampling"
+}
+
+// Process 丢弃匹配规则但未抽中的指标
+func (s *Stage) Process(m *processor.ProcessedMetric) (bool, error) {
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if storage.MatchGlob(rule.Agent, m.AgentID) && storage.MatchGlob(rule.Metric, m.Name) {
+			return s.sampler.Sample(m, rule.Rate), nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,264 @@
+package selfmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/konpure/Kon-Agent-export/pkg/exposition"
+)
+
+// Counter 只增不减的计数
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Add 累加v，v应不小于0
+func (c *Counter) Add(v float64) {
+	for {
+		old := c.bits.Load()
+		if c.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Inc 加1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value 返回当前值
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func (c *Counter) write(b *strings.Builder, name, labels string) {
+	writeSample(b, name, labels, c.Value())
+}
+
+// Gauge 可增可减的当前值
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set 设置当前值
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Value 返回当前值
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) write(b *strings.Builder, name, labels string) {
+	writeSample(b, name, labels, g.Value())
+}
+
+// Histogram 按上界分桶统计观测值的分布
+type Histogram struct {
+	// bounds 各桶的上界，升序，不含+Inf
+	bounds []float64
+	// counts 落在各桶(含+Inf桶)的观测数，输出时累加
+	counts []atomic.Uint64
+	sum    Counter
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	h.sum.Add(v)
+}
+
+func (h *Histogram) write(b *strings.Builder, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		writeSample(b, name+"_bucket", labels+sep+`le="`+le+`"`, float64(cumulative))
+	}
+	writeSample(b, name+"_sum", labels, h.sum.Value())
+	writeSample(b, name+"_count", labels, float64(cumulative))
+}
+
+// metric 一个序列
+type metric interface {
+	write(b *strings.Builder, name, labels string)
+}
+
+// family 同名的一组序列，按标签值区分
+type family struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	newMetric  func() metric
+
+	mu     sync.Mutex
+	series map[string]metric
+}
+
+// with 返回标签值对应的序列，不存在时创建
+func (f *family) with(values []string) metric {
+	if len(values) != len(f.labelNames) {
+		panic(fmt.Sprintf("selfmetrics: %s has %d labels, got %d values", f.name, len(f.labelNames), len(values)))
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = f.labelNames[i] + `="` + exposition.EscapeLabelValue(v) + `"`
+	}
+	key := strings.Join(pairs, ",")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.series[key]
+	if !ok {
+		m = f.newMetric()
+		f.series[key] = m
+	}
+	return m
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	f.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+	for _, key := range keys {
+		f.mu.Lock()
+		m := f.series[key]
+		f.mu.Unlock()
+		m.write(b, f.name, key)
+	}
+}
+
+// CounterVec 按标签区分的一组计数
+type CounterVec struct {
+	f *family
+}
+
+// With 返回标签值对应的计数，标签值按注册时的标签名顺序
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+// HistogramVec 按标签区分的一组直方图
+type HistogramVec struct {
+	f *family
+}
+
+// With 返回标签值对应的直方图，标签值按注册时的标签名顺序
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.with(values).(*Histogram)
+}
+
+// Registry 一组指标，抓取时按注册顺序以Prometheus文本格式输出
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	// scrapeHooks 输出前调用，用于更新从其他组件读取的Gauge
+	scrapeHooks []func()
+}
+
+// NewRegistry 创建空的指标集合
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(name, help, typ string, labelNames []string, newMetric func() metric) *family {
+	f := &family{name: name, help: help, typ: typ, labelNames: labelNames, newMetric: newMetric, series: make(map[string]metric)}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+// NewCounter 注册没有标签的计数
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// NewCounterVec 注册按标签区分的计数
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, "counter", labelNames, func() metric { return &Counter{} })}
+}
+
+// NewGauge 注册没有标签的Gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	f := r.register(name, help, "gauge", nil, func() metric { return &Gauge{} })
+	return f.with(nil).(*Gauge)
+}
+
+// NewHistogram 注册没有标签的直方图，bounds为升序的桶上界
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+	return r.NewHistogramVec(name, help, bounds).With()
+}
+
+// NewHistogramVec 注册按标签区分的直方图，bounds为升序的桶上界
+func (r *Registry) NewHistogramVec(name, help string, bounds []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{r.register(name, help, "histogram", labelNames, func() metric { return newHistogram(bounds) })}
+}
+
+// OnScrape 注册每次输出前调用的函数
+func (r *Registry) OnScrape(fn func()) {
+	r.mu.Lock()
+	r.scrapeHooks = append(r.scrapeHooks, fn)
+	r.mu.Unlock()
+}
+
+// WritePrometheus 调用OnScrape注册的函数后以Prometheus文本格式输出全部指标，没有序列的指标不输出
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	hooks := append([]func(){}, r.scrapeHooks...)
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeSample 输出一行样本，labels为不带花括号的标签对
+func writeSample(b *strings.Builder, name, labels string, value float64) {
+	b.WriteString(name)
+	if labels != "" {
+		b.WriteByte('{')
+		b.WriteString(labels)
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte('\n')
+}
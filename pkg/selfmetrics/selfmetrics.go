@@ -0,0 +1,160 @@
+// Package selfmetrics 记录服务器自身的运行指标(接入的数据帧、解码错误、写入速率、存储容量和淘汰、API延迟)，
+// 以Prometheus文本格式输出，用于监控采集服务器本身
+package selfmetrics
+
+import (
+	"io"
+	"log"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// requestBuckets API请求耗时的桶上界(秒)
+var requestBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// batchBuckets 每次写入存储的指标数的桶上界
+var batchBuckets = []float64{1, 10, 50, 100, 500, 1000, 5000, 10000}
+
+// Metrics 服务器自身的指标，方法可以在nil上调用，未启用时不记录
+type Metrics struct {
+	registry *Registry
+
+	framesReceived *Counter
+	frameBytes     *Counter
+	decodeErrors   *Counter
+	batches        *Counter
+	ingestErrors   *Counter
+	ingested       *Counter
+	writeSize      *Histogram
+	evicted        *CounterVec
+	requests       *HistogramVec
+}
+
+// New 创建服务器自身的指标，同时输出Go运行时的协程数和堆内存
+func New() *Metrics {
+	r := NewRegistry()
+	m := &Metrics{
+		registry:       r,
+		framesReceived: r.NewCounter("kon_internal_quic_frames_received_total", "QUIC data frames received from agents."),
+		frameBytes:     r.NewCounter("kon_internal_quic_received_bytes_total", "Bytes of QUIC data frames received, including length prefixes."),
+		decodeErrors:   r.NewCounter("kon_internal_quic_decode_errors_total", "QUIC data frames that could not be decoded."),
+		batches:        r.NewCounter("kon_internal_quic_batches_total", "QUIC data frames carrying a batch of metrics."),
+		ingestErrors:   r.NewCounter("kon_internal_ingest_errors_total", "Frames that could not be decoded, processed or stored."),
+		ingested:       r.NewCounter("kon_internal_ingested_metrics_total", "Metrics written to storage by all real-time ingest paths; rate() gives metrics per second."),
+		writeSize:      r.NewHistogram("kon_internal_ingest_write_metrics", "Metrics per storage write.", batchBuckets),
+		evicted:        r.NewCounterVec("kon_internal_storage_evicted_metrics_total", "Metrics deleted by storage before they expired.", "reason"),
+		requests:       r.NewHistogramVec("kon_internal_http_request_duration_seconds", "HTTP API request latency.", requestBuckets, "method", "route", "code"),
+	}
+
+	goroutines := r.NewGauge("kon_internal_goroutines", "Goroutines that currently exist.")
+	heap := r.NewGauge("kon_internal_heap_alloc_bytes", "Bytes of allocated heap objects.")
+	r.OnScrape(func() {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		goroutines.Set(float64(runtime.NumGoroutine()))
+		heap.Set(float64(stats.HeapAlloc))
+	})
+	return m
+}
+
+// FrameReceived 记录收到一个size字节的QUIC数据帧
+func (m *Metrics) FrameReceived(size int) {
+	if m == nil {
+		return
+	}
+	m.framesReceived.Inc()
+	m.frameBytes.Add(float64(size))
+}
+
+// DecodeError 记录一个无法解码的QUIC数据帧
+func (m *Metrics) DecodeError() {
+	if m == nil {
+		return
+	}
+	m.decodeErrors.Inc()
+}
+
+// Batch 记录一个批量数据帧
+func (m *Metrics) Batch() {
+	if m == nil {
+		return
+	}
+	m.batches.Inc()
+}
+
+// IngestFailed 记录一次接入失败，注册为接入失败钩子
+func (m *Metrics) IngestFailed(string) {
+	if m == nil {
+		return
+	}
+	m.ingestErrors.Inc()
+}
+
+// Observe 记录写入存储的数据，注册为接入钩子
+func (m *Metrics) Observe(metrics []processor.ProcessedMetric) {
+	if m == nil {
+		return
+	}
+	m.ingested.Add(float64(len(metrics)))
+	m.writeSize.Observe(float64(len(metrics)))
+}
+
+// ObserveRequest 记录一个HTTP请求的耗时，route为匹配的路由模板，避免按请求路径产生大量序列
+func (m *Metrics) ObserveRequest(method, route string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.With(method, route, strconv.Itoa(code)).Observe(d.Seconds())
+}
+
+// WatchStorage 输出存储的数据量、容量和占用的内存、磁盘，并统计过期前被淘汰的数据
+func (m *Metrics) WatchStorage(s storage.Storage) {
+	if m == nil {
+		return
+	}
+	r := m.registry
+	total := r.NewGauge("kon_internal_storage_metrics", "Metrics currently in storage.")
+	capacity := r.NewGauge("kon_internal_storage_capacity", "Maximum number of metrics storage keeps (max_size).")
+	memory := r.NewGauge("kon_internal_storage_memory_bytes", "Estimated memory used by storage.")
+	disk := r.NewGauge("kon_internal_storage_disk_bytes", "Disk space used by storage.")
+	r.OnScrape(func() {
+		stats, err := s.Stats()
+		if err != nil {
+			log.Printf("Failed to read storage stats for self metrics: %v", err)
+			return
+		}
+		total.Set(float64(stats.Total))
+		capacity.Set(float64(stats.Capacity))
+		memory.Set(float64(stats.MemoryBytes))
+		disk.Set(float64(stats.DiskBytes))
+	})
+
+	if notifier, ok := s.(storage.EvictionNotifier); ok {
+		notifier.OnEviction(func(event storage.EvictionEvent) {
+			m.evicted.With(event.Reason).Add(float64(event.Count))
+		})
+	}
+}
+
+// WatchQUIC 输出当前的QUIC连接数和正在处理的流数，fn在每次抓取时调用
+func (m *Metrics) WatchQUIC(fn func() (conns, streams int)) {
+	if m == nil {
+		return
+	}
+	connections := m.registry.NewGauge("kon_internal_quic_connections", "Open QUIC connections from agents.")
+	streams := m.registry.NewGauge("kon_internal_quic_streams", "QUIC streams currently being read.")
+	m.registry.OnScrape(func() {
+		c, s := fn()
+		connections.Set(float64(c))
+		streams.Set(float64(s))
+	})
+}
+
+// WritePrometheus 以Prometheus文本格式输出全部指标
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	return m.registry.WritePrometheus(w)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/discovery"
+)
+
+// httpTLSConfig 创建HTTP API的TLS配置，未配置证书文件时与QUIC服务器一样生成自签名证书
+func httpTLSConfig(cfg config.HTTPTLSConfig) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case cfg.CertFile == "" && cfg.KeyFile == "":
+		log.Printf("No https certificate configured, using a self-signed certificate")
+		cert, err = generateSelfSignedCert()
+	case cfg.CertFile == "" || cfg.KeyFile == "":
+		err = errors.New("cert_file and key_file must be set together")
+	default:
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Reload 把next中QUIC端口、HTTP端口和HTTP TLS配置的变化应用到运行中的监听
+//
+// 新监听建立后才排空旧的监听，失败时保留原来的监听，服务器只记录已生效的配置。
+// 配置了证书文件时总是重新加载证书，更换证书后重新加载即可生效。其他配置仍需重启才能生效。
+func (s *Server) Reload(next config.ServerConfig) {
+	current := &s.cfg.Server
+	log.Printf("Reloading listener config (quic port %d, http port %d, tls %t)", next.QUICPort, next.HTTPPort, next.TLS.Enabled)
+
+	if next.QUICPort != current.QUICPort {
+		addr := fmt.Sprintf(":%d", next.QUICPort)
+		if err := RebindQuicServer(addr, current.ShutdownTimeout); err != nil {
+			log.Printf("Failed to move quic server to %s: %v", addr, err)
+		} else {
+			current.QUICPort = next.QUICPort
+			readvertise(current, &s.advertiser)
+		}
+	}
+
+	if next.HTTPPort == current.HTTPPort && next.TLS == current.TLS && next.TLS.CertFile == "" {
+		return
+	}
+	var tlsConfig *tls.Config
+	if next.TLS.Enabled {
+		var err error
+		tlsConfig, err = httpTLSConfig(next.TLS)
+		if err != nil {
+			log.Printf("Failed to load https certificate, keeping current api listener: %v", err)
+			return
+		}
+	}
+	addr := fmt.Sprintf(":%d", next.HTTPPort)
+	if err := s.apiServer.Rebind(addr, tlsConfig, next.TLS.RedirectPort, current.ShutdownTimeout); err != nil {
+		log.Printf("Failed to rebind api server to %s: %v", addr, err)
+		return
+	}
+	current.HTTPPort = next.HTTPPort
+	current.TLS = next.TLS
+	log.Printf("Api server listening on %s (tls: %t)", addr, next.TLS.Enabled)
+}
+
+// readvertise 按新的QUIC端口重新通告mDNS
+func readvertise(current *config.ServerConfig, advertiser **discovery.Advertiser) {
+	if *advertiser == nil {
+		return
+	}
+	(*advertiser).Close()
+	*advertiser = nil
+	a, err := discovery.NewAdvertiser(current.Discovery, current.QUICPort)
+	if err != nil {
+		log.Printf("Failed to re-advertise quic endpoint via mDNS: %v", err)
+		return
+	}
+	*advertiser = a
+}
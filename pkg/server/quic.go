@@ -0,0 +1,1092 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/konpure/Kon-Agent-export/pkg/admission"
+	"github.com/konpure/Kon-Agent-export/pkg/bans"
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/commands"
+	"github.com/konpure/Kon-Agent-export/pkg/connections"
+	"github.com/konpure/Kon-Agent-export/pkg/connlabels"
+	"github.com/konpure/Kon-Agent-export/pkg/dedup"
+	"github.com/konpure/Kon-Agent-export/pkg/handshake"
+	"github.com/konpure/Kon-Agent-export/pkg/pinning"
+	"github.com/konpure/Kon-Agent-export/pkg/preagg"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol/compat"
+	"github.com/konpure/Kon-Agent-export/pkg/quota"
+	"github.com/konpure/Kon-Agent-export/pkg/selfmetrics"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"github.com/konpure/Kon-Agent-export/pkg/timeline"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/quic-go/quic-go"
+)
+
+var (
+	dataProcessor     processor.Processor
+	dataStorage       storage.Storage
+	handshakeRecorder *handshake.Recorder
+	connRegistry      *connections.Registry
+	ingestHooks       []func([]processor.ProcessedMetric)
+	ingestErrorHooks  []func(agentID string)
+	commandManager    *commands.Manager
+	handoffEndpoints  []string
+	admissionCtrl     *admission.Controller
+	// faults 测试用的故障注入器，为nil时不注入
+	faults       *chaos.Injector
+	connListener string
+	frameDecoder = &compat.Decoder{}
+	// provenanceListener 不为空时记录每批数据的接入来源
+	provenanceListener string
+	// preAggregator 不为nil时匹配规则的高频样本先预聚合再写入存储
+	preAggregator *preagg.Aggregator
+	// identityPins 不为nil时检查每个Agent ID的客户端证书指纹是否与首次连接时一致
+	identityPins *pinning.Registry
+	// frameDedup 不为nil时丢弃最近收到过的相同数据帧
+	frameDedup *dedup.Filter
+	// agentTimeline 不为nil时记录Agent的连接、断开和身份校验失败事件
+	agentTimeline *timeline.Recorder
+	// quotas 不为nil时写入存储前检查Agent和租户的配额
+	quotas *quota.Tracker
+	// agentBans 不为nil时关闭被封禁的Agent的连接
+	agentBans *bans.List
+	// selfMetrics 服务器自身的指标，为nil时不记录
+	selfMetrics *selfmetrics.Metrics
+	// frameCompression Agent支持多种数据帧压缩算法时优先协商的算法
+	frameCompression = codec.None
+)
+
+// alpnProtocol QUIC连接的ALPN协议名，协商为"kon-agent+算法名"时连接上的每个数据帧在长度前缀之后按该算法压缩
+const alpnProtocol = "kon-agent"
+
+// maxFrameSize 数据帧(解压后)的大小上限
+const maxFrameSize = 10 * 1024 * 1024
+
+// errCodeIdentityChanged Agent身份与固定的指纹不一致时关闭连接使用的应用错误码
+const errCodeIdentityChanged quic.ApplicationErrorCode = 0x10
+
+// errCodeDisconnected 管理员断开或封禁Agent时关闭连接使用的应用错误码
+const errCodeDisconnected quic.ApplicationErrorCode = 0x11
+
+// 关闭流程使用的服务器状态
+var (
+	shuttingDown  atomic.Bool
+	activeMu      sync.Mutex
+	quicTransport *quic.Transport
+	quicListener  *quic.Listener
+	// quicTLS 监听使用的TLS配置，切换监听地址时沿用同一个证书
+	quicTLS       *tls.Config
+	activeConns   = make(map[*quic.Conn]struct{})
+	activeStreams = make(map[*activeStream]struct{})
+	streamsWG     sync.WaitGroup
+	// connsWG 接受连接的循环和连接处理协程，关闭时等待它们退出，之后才能重置上面的状态
+	connsWG sync.WaitGroup
+)
+
+// activeStream 正在处理的单向流，idle表示正在等待下一帧
+type activeStream struct {
+	conn   *quic.Conn
+	stream *quic.ReceiveStream
+	labels map[string]string
+	// source 连接的接入来源，未启用时为nil，每批数据在其基础上补充批次信息
+	source *processor.Provenance
+	// identity 连接的客户端证书身份，仅在启用身份固定时使用
+	identity pinning.Identity
+	idle     atomic.Bool
+	// session 连接在登记表中的状态，同一连接的流共享
+	session *connections.Session
+	// codec 连接协商的数据帧压缩算法，不压缩时为nil
+	codec codec.Codec
+}
+
+// resetQuicServer 恢复QUIC接入的初始状态，同一进程中再次组装服务器(如端到端测试)时由New调用
+func resetQuicServer() {
+	ingestHooks, ingestErrorHooks = nil, nil
+	commandManager, handoffEndpoints, admissionCtrl, faults = nil, nil, nil, nil
+	connListener, provenanceListener = "", ""
+	frameDecoder = &compat.Decoder{}
+	frameCompression = codec.None
+	preAggregator, identityPins, frameDedup, agentTimeline, quotas, agentBans = nil, nil, nil, nil, nil, nil
+	selfMetrics = nil
+
+	activeMu.Lock()
+	shuttingDown.Store(false)
+	quicTransport, quicListener, quicTLS = nil, nil, nil
+	activeConns = make(map[*quic.Conn]struct{})
+	activeStreams = make(map[*activeStream]struct{})
+	activeMu.Unlock()
+}
+
+func InitQuicServer(processor processor.Processor, storage storage.Storage, recorder *handshake.Recorder, registry *connections.Registry) {
+	dataProcessor = processor
+	dataStorage = storage
+	handshakeRecorder = recorder
+	connRegistry = registry
+}
+
+// OnMetricsIngested 注册在QUIC数据写入存储后调用的钩子，需在启动服务器前注册
+func OnMetricsIngested(hook func([]processor.ProcessedMetric)) {
+	ingestHooks = append(ingestHooks, hook)
+}
+
+// OnIngestError 注册QUIC数据帧无法解析、处理或写入存储时调用的钩子，agentID为空表示无法确定来源，需在启动服务器前注册
+func OnIngestError(hook func(agentID string)) {
+	ingestErrorHooks = append(ingestErrorHooks, hook)
+}
+
+// ingestFailed 通知钩子一次接入失败
+func ingestFailed(agentID string) {
+	for _, hook := range ingestErrorHooks {
+		hook(agentID)
+	}
+}
+
+// EnableCommands 记录发送数据的Agent连接，使管理员可以向其下发诊断命令，需在启动服务器前调用
+func EnableCommands(manager *commands.Manager) {
+	commandManager = manager
+}
+
+// SetHandoffEndpoints 设置优雅退出时通知Agent改连的备用地址
+func SetHandoffEndpoints(endpoints []string) {
+	handoffEndpoints = endpoints
+}
+
+// EnableAdmission QUIC接入的数据经过准入控制器的缓冲区写入存储，需在启动服务器前调用
+func EnableAdmission(controller *admission.Controller) {
+	admissionCtrl = controller
+}
+
+// EnableConnLabels 为QUIC接入的数据附加连接标签，listener为监听器名称，需在启动服务器前调用
+func EnableConnLabels(listener string) {
+	connListener = listener
+}
+
+// EnablePinning 固定每个Agent ID首次连接时的客户端证书指纹，需在启动服务器前调用
+func EnablePinning(registry *pinning.Registry) {
+	identityPins = registry
+}
+
+// EnableBans 关闭被封禁的Agent的连接，需在启动服务器前调用
+func EnableBans(list *bans.List) {
+	agentBans = list
+}
+
+// EnableProvenance 记录QUIC接入的每批数据的接入来源，listener为监听器名称，需在启动服务器前调用
+func EnableProvenance(listener string) {
+	provenanceListener = listener
+}
+
+// EnablePreAggregation 实时接入的数据经过预聚合器写入存储，需在启动服务器前调用
+func EnablePreAggregation(aggregator *preagg.Aggregator) {
+	preAggregator = aggregator
+}
+
+// EnableDedup 丢弃最近收到过的相同数据帧，需在启动服务器前调用
+func EnableDedup(filter *dedup.Filter) {
+	frameDedup = filter
+}
+
+// EnableTimeline 记录Agent的连接、断开和身份校验失败事件，需在启动服务器前调用
+func EnableTimeline(recorder *timeline.Recorder) {
+	agentTimeline = recorder
+}
+
+// EnableQuotas 写入存储前检查QUIC和HTTP接入的数据是否超出配额，需在启动服务器前调用
+func EnableQuotas(tracker *quota.Tracker) {
+	quotas = tracker
+}
+
+// SetFrameDecoder 设置解码QUIC数据帧的兼容层，用于接收字段改号前的旧版本Agent，需在启动服务器前调用
+func SetFrameDecoder(decoder *compat.Decoder) {
+	frameDecoder = decoder
+}
+
+// SetFrameCompression 设置协商数据帧压缩时优先选择的算法，Agent不支持时使用不压缩或Agent支持的其他算法，需在启动服务器前调用
+func SetFrameCompression(name string) {
+	frameCompression = name
+}
+
+// nextProtos 返回服务器支持的ALPN协议，按优先顺序为配置的压缩算法、不压缩、其他已注册的压缩算法
+func nextProtos() []string {
+	protos := make([]string, 0)
+	if c, err := codec.Get(frameCompression); err == nil && c.Name() != codec.None {
+		protos = append(protos, alpnProtocol+"+"+c.Name())
+	}
+	protos = append(protos, alpnProtocol)
+	for _, name := range codec.Names() {
+		if proto := alpnProtocol + "+" + name; name != codec.None && !slices.Contains(protos, proto) {
+			protos = append(protos, proto)
+		}
+	}
+	return protos
+}
+
+// frameCodec 返回连接协商的数据帧压缩算法，未协商压缩时返回nil
+func frameCodec(conn *quic.Conn) codec.Codec {
+	name, ok := strings.CutPrefix(conn.ConnectionState().TLS.NegotiatedProtocol, alpnProtocol+"+")
+	if !ok {
+		return nil
+	}
+	c, err := codec.Get(name)
+	if err != nil || c.Name() == codec.None {
+		return nil
+	}
+	return c
+}
+
+// EnableSelfMetrics 记录收到的数据帧和解码错误，需在启动服务器前调用
+func EnableSelfMetrics(metrics *selfmetrics.Metrics) {
+	selfMetrics = metrics
+}
+
+// quicActivity 返回当前的QUIC连接数和正在处理的流数
+func quicActivity() (conns, streams int) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	return len(activeConns), len(activeStreams)
+}
+
+// EnableChaos 按配置的概率丢弃QUIC数据帧和延迟存储写入，需在启动服务器前调用
+func EnableChaos(injector *chaos.Injector) {
+	faults = injector
+}
+
+// storeMetrics 保存QUIC接入的数据，启用准入控制时放入缓冲区，缓冲区满时阻塞直到ctx结束
+func storeMetrics(ctx context.Context, metrics []processor.ProcessedMetric) error {
+	if admissionCtrl != nil {
+		return admissionCtrl.Submit(ctx, metrics)
+	}
+	return saveMetrics(metrics)
+}
+
+// saveMetrics 保存数据并通知钩子，启用预聚合时只写入不需要聚合的数据和已关闭的窗口
+func saveMetrics(metrics []processor.ProcessedMetric) error {
+	if preAggregator != nil {
+		if metrics = preAggregator.Add(metrics); len(metrics) == 0 {
+			return nil
+		}
+	}
+	return writeMetrics(metrics)
+}
+
+// writeMetrics 写入存储并通知钩子，预聚合器写入到期的窗口时直接调用
+func writeMetrics(metrics []processor.ProcessedMetric) error {
+	faults.DelayWrite()
+	if err := dataStorage.SaveMetrics(metrics); err != nil {
+		return err
+	}
+	for _, hook := range ingestHooks {
+		hook(metrics)
+	}
+	return nil
+}
+
+// ingestStorage 写入时同样触发接入钩子的存储，供QUIC之外的实时接入链路使用
+type ingestStorage struct {
+	storage.Storage
+}
+
+// SaveMetrics 检查配额后保存数据并通知钩子
+func (ingestStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	if _, _, err := checkQuotas(metrics); err != nil {
+		return err
+	}
+	return saveMetrics(metrics)
+}
+
+// checkQuotas 写入存储前检查一批数据的配额，超出时按hint_interval记录日志和时间线事件，
+// notify为true表示同时应通知Agent。超出hard模式且宽限期已结束的配额时返回*quota.ExceededError
+func checkQuotas(metrics []processor.ProcessedMetric) (warnings []quota.Warning, notify bool, err error) {
+	if quotas == nil || len(metrics) == 0 {
+		return nil, false, nil
+	}
+	warnings, err = quotas.Check(metrics)
+	if len(warnings) == 0 || !quotas.Hint(warnings[0].AgentID) {
+		return warnings, false, err
+	}
+	for _, w := range warnings {
+		log.Printf("Agent %s exceeded quota: %s", w.AgentID, w)
+		if agentTimeline != nil {
+			eventType := timeline.EventQuotaWarning
+			if w.Enforced {
+				eventType = timeline.EventQuotaExceeded
+			}
+			agentTimeline.Record(w.AgentID, eventType, "", w.String())
+		}
+	}
+	return warnings, true, err
+}
+
+// func main() {
+// StartQuicServer(":7843")
+// }
+
+/**
+func main() {
+	// 生成自签名证书
+	tlsCert, err := generateSelfSignedCert()
+	if err != nil {
+		log.Fatal("Failed to generate certificate:", err)
+	}
+
+	// TLS配置
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   []string{"kon-agent"},
+		Rand:         rand.Reader,
+		MinVersion:   tls.VersionTLS13,
+		MaxVersion:   tls.VersionTLS13,
+	}
+
+	// QUIC监听配置
+	quicConfig := &quic.Config{
+		MaxIncomingStreams:    1000,
+		MaxIncomingUniStreams: 1000,
+		KeepAlivePeriod:       10 * time.Second,
+	}
+
+	// 监听QUIC连接
+	listener, err := quic.ListenAddr(":7843", tlsConfig, quicConfig)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	fmt.Println("QUIC server listening on :7843")
+
+	for {
+		// 接受新连接
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+
+		fmt.Println("New connection established")
+
+		// 处理连接
+		go handleConnection(conn)
+	}
+}
+**/
+
+// StartQuicServer 启动QUIC服务器
+func StartQuicServer(addr string) error {
+	// 生成自签名证书
+	tlsCert, err := generateSelfSignedCert()
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate: %w", err)
+	}
+
+	// TLS配置
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   nextProtos(),
+		Rand:         rand.Reader,
+		MinVersion:   tls.VersionTLS13,
+		MaxVersion:   tls.VersionTLS13,
+	}
+	// 启用连接标签或身份固定时请求客户端证书以记录TLS身份，不提供证书的Agent仍可连接
+	if connListener != "" || identityPins != nil {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+
+	transport, listener, err := listenQuic(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	activeMu.Lock()
+	if shuttingDown.Load() {
+		activeMu.Unlock()
+		listener.Close()
+		transport.Close()
+		return nil
+	}
+	quicTLS = tlsConfig
+	quicTransport = transport
+	quicListener = listener
+	connsWG.Add(1)
+	activeMu.Unlock()
+	defer connsWG.Done()
+
+	fmt.Printf("QUIC server listening on %s\n", addr)
+	return acceptQuic(listener)
+}
+
+// listenQuic 在addr监听QUIC连接，通过Transport记录每个连接的握手过程
+func listenQuic(addr string, tlsConfig *tls.Config) (*quic.Transport, *quic.Listener, error) {
+	// QUIC监听配置
+	quicConfig := &quic.Config{
+		MaxIncomingStreams:    1000,
+		MaxIncomingUniStreams: 1000,
+		KeepAlivePeriod:       10 * time.Second,
+	}
+
+	// 监听UDP端口
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve address: %w", err)
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	// transport由StopQuicServer在连接排空后关闭
+	transport := &quic.Transport{
+		Conn:        udpConn,
+		ConnContext: handshakeRecorder.ConnContext,
+	}
+
+	// 监听QUIC连接
+	listener, err := transport.Listen(tlsConfig, quicConfig)
+	if err != nil {
+		transport.Close()
+		return nil, nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	return transport, listener, nil
+}
+
+// acceptQuic 接受连接直到监听关闭
+func acceptQuic(listener *quic.Listener) error {
+	for {
+		// 接受新连接
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+
+		handshakeRecorder.Completed(conn)
+		fmt.Println("New connection established")
+
+		// 关闭过程中不再处理新连接
+		activeMu.Lock()
+		if shuttingDown.Load() {
+			activeMu.Unlock()
+			conn.CloseWithError(0, "server shutting down")
+			continue
+		}
+		connsWG.Add(1)
+		activeMu.Unlock()
+
+		// 处理连接
+		go func() {
+			defer connsWG.Done()
+			handleConnection(conn)
+		}()
+	}
+}
+
+// RebindQuicServer 把QUIC服务器切换到addr，使用原来的证书
+//
+// 先在新地址监听，成功后旧的监听停止接受连接，旧地址上已建立的连接继续接入数据，
+// 全部断开或超过drainTimeout后关闭旧的Transport。新地址监听失败时继续使用旧的监听。
+func RebindQuicServer(addr string, drainTimeout time.Duration) error {
+	activeMu.Lock()
+	tlsConfig := quicTLS
+	activeMu.Unlock()
+	if tlsConfig == nil {
+		return errors.New("quic server is not running")
+	}
+	transport, listener, err := listenQuic(addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	activeMu.Lock()
+	if shuttingDown.Load() {
+		activeMu.Unlock()
+		listener.Close()
+		transport.Close()
+		return errors.New("quic server is shutting down")
+	}
+	oldTransport, oldListener := quicTransport, quicListener
+	quicTransport, quicListener = transport, listener
+	connsWG.Add(1)
+	activeMu.Unlock()
+
+	go func() {
+		defer connsWG.Done()
+		if err := acceptQuic(listener); err != nil {
+			log.Printf("Quic server on %s stopped: %v", addr, err)
+		}
+	}()
+	oldListener.Close()
+	go drainTransport(oldTransport, drainTimeout)
+
+	log.Printf("Quic server moved from %s to %s, draining old connections", oldTransport.Conn.LocalAddr(), addr)
+	return nil
+}
+
+// drainTransport 等待旧Transport上的连接全部断开，超过timeout后关闭Transport并断开剩余连接，
+// 新旧监听的端口总是不同
+func drainTransport(transport *quic.Transport, timeout time.Duration) {
+	// 连接的本地地址是收包的具体地址，按端口区分新旧监听
+	local := transport.Conn.LocalAddr().String()
+	port := transport.Conn.LocalAddr().(*net.UDPAddr).Port
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		remaining := 0
+		activeMu.Lock()
+		for conn := range activeConns {
+			if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.Port == port {
+				remaining++
+			}
+		}
+		activeMu.Unlock()
+
+		if remaining == 0 || !time.Now().Before(deadline) {
+			if remaining > 0 {
+				log.Printf("Closing %d quic connections still on old listener %s", remaining, local)
+			}
+			transport.Close()
+			return
+		}
+	}
+}
+
+// 生成自签名证书
+func generateSelfSignedCert() (tls.Certificate, error) {
+	// 生成私钥
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	// 创建证书模板
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName:   "localhost",
+			Organization: []string{"Kon-Agent"},
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:  x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+		},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+
+	// 创建自签名证书
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	// 编码证书和私钥
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: derBytes,
+	})
+
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	privPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privBytes,
+	})
+
+	// 加载证书
+	return tls.X509KeyPair(certPEM, privPEM)
+}
+
+func handleConnection(conn interface{}) {
+	// 在quic-go v0.54.0中，listener.Accept() 返回 *quic.Conn 类型
+	quicConn, ok := conn.(*quic.Conn)
+	if !ok {
+		log.Printf("Invalid connection type: %T", conn)
+		return
+	}
+	defer quicConn.CloseWithError(0, "")
+
+	activeMu.Lock()
+	if shuttingDown.Load() {
+		activeMu.Unlock()
+		return
+	}
+	activeConns[quicConn] = struct{}{}
+	activeMu.Unlock()
+
+	session := connRegistry.Add(quicConn.RemoteAddr().String(), func(reason string) {
+		quicConn.CloseWithError(errCodeDisconnected, reason)
+	})
+	defer func() {
+		activeMu.Lock()
+		delete(activeConns, quicConn)
+		activeMu.Unlock()
+		connRegistry.Remove(session)
+		if commandManager != nil {
+			commandManager.Unregister(quicConn)
+		}
+	}()
+
+	var labels map[string]string
+	if connListener != "" {
+		labels = connlabels.FromConn(quicConn, connListener)
+	}
+	var source *processor.Provenance
+	if provenanceListener != "" {
+		source = &processor.Provenance{Listener: provenanceListener, SourceIP: connlabels.RemoteIP(quicConn)}
+		if id, ok := quicConn.Context().Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID); ok {
+			source.ConnID = strconv.FormatUint(uint64(id), 10)
+		}
+	}
+
+	var identity pinning.Identity
+	if identityPins != nil {
+		identity = pinning.FromTLS(quicConn.ConnectionState().TLS)
+	}
+	compression := frameCodec(quicConn)
+
+	for {
+		// 接受新流 - 对于接收单向流，应该使用 AcceptUniStream
+		stream, err := quicConn.AcceptUniStream(quicConn.Context())
+		if err != nil {
+			if !shuttingDown.Load() {
+				log.Printf("Failed to accept unidirectional stream: %v", err)
+			}
+			if agentTimeline != nil {
+				for _, id := range session.AgentIDs() {
+					agentTimeline.Record(id, timeline.EventDisconnected, quicConn.RemoteAddr().String(), err.Error())
+				}
+			}
+			return
+		}
+
+		// 关闭过程中不再接受新流
+		activeMu.Lock()
+		if shuttingDown.Load() {
+			activeMu.Unlock()
+			stream.CancelRead(0)
+			continue
+		}
+		as := &activeStream{conn: quicConn, stream: stream, labels: labels, source: source, identity: identity, session: session, codec: compression}
+		activeStreams[as] = struct{}{}
+		session.StreamOpened()
+		streamsWG.Add(1)
+		activeMu.Unlock()
+
+		fmt.Printf("New unidirectional stream accepted: ID=%d\n", stream.StreamID())
+
+		// 处理单向流
+		go handleUniStream(as)
+	}
+}
+
+// StopQuicServer 停止接受新连接和新流，等待处理中的数据帧写入存储后关闭所有连接
+func StopQuicServer(ctx context.Context) error {
+	activeMu.Lock()
+	shuttingDown.Store(true)
+	if quicListener != nil {
+		quicListener.Close()
+	}
+	conns := make([]*quic.Conn, 0, len(activeConns))
+	for conn := range activeConns {
+		conns = append(conns, conn)
+	}
+	// 中断空闲等待下一帧的流，正在读取帧的流会在处理完当前帧后退出
+	for as := range activeStreams {
+		if as.idle.Load() {
+			as.stream.SetReadDeadline(time.Now())
+		}
+	}
+	activeMu.Unlock()
+
+	// 先通知Agent改连备用地址，Agent无需等待超时即可切换
+	closeReason := "server shutting down"
+	if len(handoffEndpoints) > 0 {
+		sendHandoff(ctx, conns)
+		closeReason += "; reconnect to " + strings.Join(handoffEndpoints, ",")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		streamsWG.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out draining quic streams: %w", ctx.Err())
+	}
+
+	activeMu.Lock()
+	for conn := range activeConns {
+		conn.CloseWithError(0, closeReason)
+	}
+	transport := quicTransport
+	activeMu.Unlock()
+
+	if transport != nil {
+		transport.Close()
+	}
+
+	// 连接关闭后处理协程很快退出，等待它们以免下一次组装服务器时重置的状态仍被使用
+	stopped := make(chan struct{})
+	go func() {
+		connsWG.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		if err == nil {
+			err = fmt.Errorf("timed out waiting for quic connections: %w", ctx.Err())
+		}
+	}
+	return err
+}
+
+// sendHandoff 并发向所有连接发送reconnect命令，args中endpoints为逗号分隔的备用地址
+func sendHandoff(ctx context.Context, conns []*quic.Conn) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	cmd := &protocol.AgentCommand{
+		Command: "reconnect",
+		Args:    map[string]string{"endpoints": strings.Join(handoffEndpoints, ",")},
+	}
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *quic.Conn) {
+			defer wg.Done()
+			if err := commands.Notify(ctx, conn, cmd); err != nil {
+				log.Printf("Failed to send handoff to %s: %v", conn.RemoteAddr(), err)
+			}
+		}(conn)
+	}
+	wg.Wait()
+	log.Printf("Sent reconnect hint (%s) to %d agents", strings.Join(handoffEndpoints, ","), len(conns))
+}
+
+func handleUniStream(as *activeStream) {
+	stream := as.stream
+
+	// 在quic-go v0.54.0中，ReceiveStream可能没有Close方法
+	// 使用stream.CancelRead()来取消读取并释放资源
+	defer stream.CancelRead(0)
+	defer func() {
+		activeMu.Lock()
+		delete(activeStreams, as)
+		activeMu.Unlock()
+		as.session.StreamClosed()
+		streamsWG.Done()
+	}()
+
+	// 直接使用stream指针的方法来读取数据
+	reader := stream
+
+	for {
+		// 关闭过程中处理完当前帧即退出
+		as.idle.Store(true)
+		if shuttingDown.Load() {
+			return
+		}
+
+		// 读取4字节的长度前缀
+		var lengthBuf [4]byte
+		_, err := io.ReadFull(reader, lengthBuf[:])
+		as.idle.Store(false)
+		if err != nil {
+			if err == io.EOF {
+				fmt.Printf("Stream %d closed normally\n", stream.StreamID())
+				return
+			}
+			if shuttingDown.Load() {
+				return
+			}
+			log.Printf("Failed to read length prefix from stream %d: %v", stream.StreamID(), err)
+			return
+		}
+
+		// 解析长度
+		length := binary.BigEndian.Uint32(lengthBuf[:])
+		if length > maxFrameSize { // 限制最大10MB
+			log.Printf("Data too large from stream %d: %d bytes", stream.StreamID(), length)
+			ingestFailed("")
+			return
+		}
+
+		// 读取实际数据
+		data := make([]byte, length)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			log.Printf("Failed to read data from stream %d: %v", stream.StreamID(), err)
+			return
+		}
+		receivedAt := time.Now()
+		as.session.Received(len(lengthBuf) + len(data))
+		selfMetrics.FrameReceived(len(lengthBuf) + len(data))
+		if faults.DropFrame() {
+			log.Printf("Fault injection: dropped %d-byte frame from stream %d", length, stream.StreamID())
+			continue
+		}
+		if as.codec != nil {
+			if data, err = codec.Decompress(as.codec, data, maxFrameSize); err != nil {
+				log.Printf("Failed to decompress %s frame from stream %d: %v", as.codec.Name(), stream.StreamID(), err)
+				selfMetrics.DecodeError()
+				ingestFailed("")
+				continue
+			}
+		}
+
+		// 解析Protobuf数据
+		// 按字段区分BatchMetricsRequest和旧版本Agent发送的单个Metric
+		frame, err := frameDecoder.Decode(data)
+		decodeDuration := time.Since(receivedAt)
+		if err != nil {
+			log.Printf("Failed to unmarshal data from stream %d: %v", stream.StreamID(), err)
+			selfMetrics.DecodeError()
+			ingestFailed("")
+			// 输出原始数据供调试
+			fmt.Printf("Received from stream %d:\n", stream.StreamID())
+			fmt.Printf("Hex: %x\n", data)
+			fmt.Printf("Raw (binary data, may contain garbled text): %s\n", string(data))
+			fmt.Println("---")
+			continue
+		}
+
+		if metric := frame.Metric; metric != nil {
+			// 处理单个数据
+			processedMetric, err := dataProcessor.ProcessSingleMetric("", metric)
+			if err != nil {
+				log.Printf("Failed to process single metric: %v", err)
+				ingestFailed("")
+			} else if processedMetric != nil {
+				if !as.checkBan(processedMetric.AgentID) || !as.checkIdentity(processedMetric.AgentID) {
+					return
+				}
+				as.identified(processedMetric.AgentID)
+				if duplicateFrame(data, processedMetric.AgentID) {
+					continue
+				}
+				metrics := []processor.ProcessedMetric{*processedMetric}
+				if as.labels != nil {
+					connlabels.Apply(metrics, as.labels)
+				}
+				as.attachProvenance(metrics, receivedAt, decodeDuration)
+				// 保存到存储
+				if as.applyQuotas(metrics) {
+					err = storeMetrics(as.conn.Context(), metrics)
+					if err != nil {
+						log.Printf("Failed to save single metric: %v", err)
+						ingestFailed(processedMetric.AgentID)
+					} else {
+						rememberFrame(data)
+					}
+				}
+			}
+
+			// 成功解析为单个Metric
+			fmt.Printf("Received Metric from stream %d:\n", stream.StreamID())
+			fmt.Printf("Name: %s\n", metric.Name)
+			fmt.Printf("Value: %.2f\n", metric.Value)
+			fmt.Printf("Timestamp: %d\n", metric.Timestamp)
+			fmt.Printf("Type: %s\n", metric.Type.String())
+			if len(metric.Labels) > 0 {
+				fmt.Printf("Labels: %v\n", metric.Labels)
+			}
+			fmt.Println("---")
+		} else {
+			batchReq := frame.Batch
+			selfMetrics.Batch()
+			// 先检查封禁和身份，避免被封禁或冒充的连接被登记为该Agent的命令通道
+			if !as.checkBan(batchReq.AgentId) || !as.checkIdentity(batchReq.AgentId) {
+				return
+			}
+			as.identified(batchReq.AgentId)
+			if commandManager != nil {
+				commandManager.Register(batchReq.AgentId, as.conn)
+			}
+			// 重连后重发的批次仍需登记命令通道，之后再去重
+			if duplicateFrame(data, batchReq.AgentId) {
+				continue
+			}
+
+			// 处理批量数据
+			processedMetrics, err := dataProcessor.ProcessBatchRequest(batchReq)
+			if err != nil {
+				log.Printf("Failed to process batch metrics: %v", err)
+				ingestFailed(batchReq.AgentId)
+				continue
+			}
+			if as.labels != nil {
+				connlabels.Apply(processedMetrics, as.labels)
+			}
+			as.attachProvenance(processedMetrics, receivedAt, decodeDuration)
+			if !as.applyQuotas(processedMetrics) {
+				continue
+			}
+
+			// 保存到存储
+			err = storeMetrics(as.conn.Context(), processedMetrics)
+			if err != nil {
+				log.Printf("Failed to save batch metrics: %v", err)
+				ingestFailed(batchReq.AgentId)
+			} else {
+				rememberFrame(data)
+			}
+
+			// 成功解析为BatchMetricsRequest
+			fmt.Printf("Received BatchMetricsRequest from stream %d:\n", stream.StreamID())
+			fmt.Printf("Agent ID: %s\n", batchReq.AgentId)
+			fmt.Printf("Timestamp: %d\n", batchReq.Timestamp)
+			fmt.Printf("Metrics count: %d\n", len(batchReq.Metrics))
+			for i, metric := range batchReq.Metrics {
+				fmt.Printf("  Metric %d: %s=%.2f (type: %s)\n", i+1, metric.Name, metric.Value, metric.Type.String())
+			}
+			fmt.Println("---")
+		}
+	}
+}
+
+// duplicateFrame 判断数据帧是否与最近写入存储的帧重复，重复时记录日志
+func duplicateFrame(data []byte, agentID string) bool {
+	if frameDedup == nil || !frameDedup.Test(data) {
+		return false
+	}
+	log.Printf("Dropped duplicate %d-byte frame from agent %s", len(data), agentID)
+	return true
+}
+
+// rememberFrame 记录已写入存储的数据帧，未写入的帧(处理失败、超出配额或存储出错)不记录，重发时仍会写入
+func rememberFrame(data []byte) {
+	if frameDedup != nil {
+		frameDedup.Add(data)
+	}
+}
+
+// checkBan 检查Agent是否被封禁，是时丢弃数据、关闭连接并返回false
+func (as *activeStream) checkBan(agentID string) bool {
+	if agentBans == nil {
+		return true
+	}
+	err := agentBans.Check(agentID)
+	if err == nil {
+		return true
+	}
+	log.Printf("Closing connection from %s: %v", as.conn.RemoteAddr(), err)
+	as.conn.CloseWithError(errCodeDisconnected, err.Error())
+	return false
+}
+
+// checkIdentity 检查连接的身份是否与agentID固定的指纹一致，
+// 不一致且为deny模式时丢弃数据、关闭连接并返回false
+func (as *activeStream) checkIdentity(agentID string) bool {
+	if identityPins == nil {
+		return true
+	}
+	err := identityPins.Check(agentID, as.identity, connlabels.RemoteIP(as.conn))
+	if err == nil {
+		return true
+	}
+	ingestFailed(agentID)
+	if agentTimeline != nil {
+		agentTimeline.Record(agentID, timeline.EventAuthFailed, as.conn.RemoteAddr().String(), err.Error())
+	}
+	as.conn.CloseWithError(errCodeIdentityChanged, err.Error())
+	return false
+}
+
+// identified 在连接登记表中记录Agent ID，第一次出现时记录连接事件，连接关闭时为这些Agent记录断开事件
+func (as *activeStream) identified(agentID string) {
+	if as.session.Identify(agentID) && agentTimeline != nil {
+		agentTimeline.Record(agentID, timeline.EventConnected, as.conn.RemoteAddr().String(), "")
+	}
+}
+
+// applyQuotas 检查一批数据的配额，需要通知时在后台向Agent发送quota_warning命令，返回false表示这批数据被拒绝
+func (as *activeStream) applyQuotas(metrics []processor.ProcessedMetric) bool {
+	warnings, notify, err := checkQuotas(metrics)
+	if notify {
+		go sendQuotaWarnings(as.conn, warnings)
+	}
+	return err == nil
+}
+
+// sendQuotaWarnings 为每项超出的配额向Agent发送一个quota_warning命令，
+// args包含规则、范围、Key、限制、用量、上限、是否已拒绝和hard模式开始拒绝的时间
+func sendQuotaWarnings(conn *quic.Conn, warnings []quota.Warning) {
+	ctx, cancel := context.WithTimeout(conn.Context(), time.Second)
+	defer cancel()
+
+	for _, w := range warnings {
+		args := map[string]string{
+			"rule":     w.Rule,
+			"scope":    w.Scope,
+			"key":      w.Key,
+			"limit":    w.Limit,
+			"used":     strconv.Itoa(w.Used),
+			"max":      strconv.Itoa(w.Max),
+			"enforced": strconv.FormatBool(w.Enforced),
+		}
+		if w.EnforceAt != nil {
+			args["enforce_at"] = w.EnforceAt.UTC().Format(time.RFC3339)
+		}
+		if err := commands.Notify(ctx, conn, &protocol.AgentCommand{Command: "quota_warning", Args: args}); err != nil {
+			log.Printf("Failed to send quota warning to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// attachProvenance 为一批数据附加接入来源，同一批数据共享同一个值
+func (as *activeStream) attachProvenance(metrics []processor.ProcessedMetric, receivedAt time.Time, decodeDuration time.Duration) {
+	if as.source == nil {
+		return
+	}
+	p := *as.source
+	p.BatchID = newBatchID()
+	p.ReceivedAt = receivedAt
+	p.DecodeDuration = decodeDuration
+	for i := range metrics {
+		metrics[i].Provenance = &p
+	}
+}
+
+// newBatchID 生成随机的批次标识
+func newBatchID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
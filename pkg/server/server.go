@@ -0,0 +1,892 @@
+// Package server 按配置组装完整的服务器：QUIC接入、HTTP API以及配置启用的其他接入、导出和查询服务。
+// main和进程内的端到端测试(pkg/harness)使用同一套组装逻辑
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/acl"
+	"github.com/konpure/Kon-Agent-export/pkg/admission"
+	"github.com/konpure/Kon-Agent-export/pkg/api"
+	"github.com/konpure/Kon-Agent-export/pkg/archive"
+	"github.com/konpure/Kon-Agent-export/pkg/arrowflight"
+	"github.com/konpure/Kon-Agent-export/pkg/availability"
+	"github.com/konpure/Kon-Agent-export/pkg/bans"
+	"github.com/konpure/Kon-Agent-export/pkg/chaos"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/commands"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/connections"
+	"github.com/konpure/Kon-Agent-export/pkg/debugtap"
+	"github.com/konpure/Kon-Agent-export/pkg/dedup"
+	"github.com/konpure/Kon-Agent-export/pkg/discovery"
+	"github.com/konpure/Kon-Agent-export/pkg/exposition"
+	"github.com/konpure/Kon-Agent-export/pkg/fanout"
+	"github.com/konpure/Kon-Agent-export/pkg/fleet"
+	"github.com/konpure/Kon-Agent-export/pkg/grafana"
+	"github.com/konpure/Kon-Agent-export/pkg/graphql"
+	"github.com/konpure/Kon-Agent-export/pkg/grpcquery"
+	"github.com/konpure/Kon-Agent-export/pkg/handshake"
+	"github.com/konpure/Kon-Agent-export/pkg/importer"
+	"github.com/konpure/Kon-Agent-export/pkg/influx"
+	"github.com/konpure/Kon-Agent-export/pkg/ingestrate"
+	"github.com/konpure/Kon-Agent-export/pkg/inventory"
+	"github.com/konpure/Kon-Agent-export/pkg/jwtauth"
+	"github.com/konpure/Kon-Agent-export/pkg/metadata"
+	"github.com/konpure/Kon-Agent-export/pkg/nats"
+	"github.com/konpure/Kon-Agent-export/pkg/onchange"
+	"github.com/konpure/Kon-Agent-export/pkg/otlp"
+	"github.com/konpure/Kon-Agent-export/pkg/packs"
+	"github.com/konpure/Kon-Agent-export/pkg/pinning"
+	"github.com/konpure/Kon-Agent-export/pkg/preagg"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/promql"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol/compat"
+	"github.com/konpure/Kon-Agent-export/pkg/queries"
+	"github.com/konpure/Kon-Agent-export/pkg/quota"
+	"github.com/konpure/Kon-Agent-export/pkg/relabel"
+	"github.com/konpure/Kon-Agent-export/pkg/remoteread"
+	"github.com/konpure/Kon-Agent-export/pkg/remotewrite"
+	"github.com/konpure/Kon-Agent-export/pkg/sampling"
+	"github.com/konpure/Kon-Agent-export/pkg/selfmetrics"
+	"github.com/konpure/Kon-Agent-export/pkg/sla"
+	"github.com/konpure/Kon-Agent-export/pkg/staleness"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/rollup"
+	_ "github.com/konpure/Kon-Agent-export/pkg/storage/sqlite"
+	"github.com/konpure/Kon-Agent-export/pkg/stream"
+	"github.com/konpure/Kon-Agent-export/pkg/timeline"
+	"github.com/konpure/Kon-Agent-export/pkg/topk"
+	"github.com/konpure/Kon-Agent-export/pkg/udf"
+	"github.com/konpure/Kon-Agent-export/pkg/writehook"
+)
+
+// Option 自定义服务器的组装，用于在测试或嵌入时加入自定义的处理阶段和导出
+type Option func(*options)
+
+type options struct {
+	stages     []processor.Stage
+	sinks      []sinkOption
+	apiOptions []api.Option
+}
+
+type sinkOption struct {
+	name  string
+	rules []config.ExportRule
+	sink  fanout.Sink
+}
+
+// WithStages 在配置启用的处理阶段之后追加处理阶段
+func WithStages(stages ...processor.Stage) Option {
+	return func(o *options) {
+		o.stages = append(o.stages, stages...)
+	}
+}
+
+// WithSink 与配置的导出一样通过导出路由把写入存储的数据发送给sink，rules为发送前的转换规则
+func WithSink(name string, rules []config.ExportRule, sink fanout.Sink) Option {
+	return func(o *options) {
+		o.sinks = append(o.sinks, sinkOption{name: name, rules: rules, sink: sink})
+	}
+}
+
+// WithAPIOptions 追加HTTP API的选项
+func WithAPIOptions(opts ...api.Option) Option {
+	return func(o *options) {
+		o.apiOptions = append(o.apiOptions, opts...)
+	}
+}
+
+// Server 按配置组装的服务器
+//
+// QUIC接入的状态保存在包级变量中，同一进程中同时只能运行一个Server。
+type Server struct {
+	cfg        *config.Config
+	storage    storage.Storage
+	apiServer  *api.APIServer
+	advertiser *discovery.Advertiser
+	// errs 后台监听启动失败或意外退出的错误
+	errs chan error
+
+	otlpReceiver    *otlp.Receiver
+	flightServer    *arrowflight.Server
+	grpcQueryServer *grpcquery.Server
+
+	// 关闭时需要排空或关闭的组件，未启用时为nil
+	udfRegistry         *udf.Registry
+	admissionController *admission.Controller
+	preAggregate        *preagg.Aggregator
+	forwarder           *remotewrite.Forwarder
+	otlpExporter        *otlp.Exporter
+	natsPublisher       *nats.Publisher
+	writeHooks          *writehook.Dispatcher
+	archiver            *archive.Archiver
+
+	// background 启动时运行的后台任务，关闭stop后退出
+	background []func(stop <-chan struct{})
+	stop       chan struct{}
+}
+
+// New 按配置创建服务器的全部组件，配置无效时返回错误，返回错误时已创建的组件不会被关闭
+func New(cfg *config.Config, opts ...Option) (*Server, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	resetQuicServer()
+
+	s := &Server{
+		cfg:  cfg,
+		errs: make(chan error, 8),
+		stop: make(chan struct{}),
+	}
+
+	// init clock
+	clk, err := clock.NewFromConfig(cfg.Clock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init clock: %w", err)
+	}
+	if cfg.Clock.FrozenAt != "" {
+		log.Printf("Clock frozen at %s", cfg.Clock.FrozenAt)
+	}
+
+	// check compression codec
+	if _, err := codec.Get(cfg.Compression); err != nil {
+		return nil, fmt.Errorf("invalid compression config: %w", err)
+	}
+
+	// init wasm processing functions
+	var stages []processor.Stage
+	if !api.ValidTimestampFormat(cfg.Server.TimestampFormat) {
+		return nil, fmt.Errorf("invalid server.timestamp_format %q", cfg.Server.TimestampFormat)
+	}
+	apiOptions := []api.Option{api.WithClock(clk), api.WithCORS(cfg.Server.CORS), api.WithTimestampFormat(cfg.Server.TimestampFormat), api.WithRouteTimeouts(cfg.Server.RouteTimeouts)}
+	if cfg.Server.RateLimit.Enabled {
+		apiOptions = append(apiOptions, api.WithRateLimit(cfg.Server.RateLimit))
+		log.Printf("HTTP rate limiting enabled (%.0f/s per ip, %.0f/s per api key)", cfg.Server.RateLimit.PerIP, cfg.Server.RateLimit.PerKey)
+	}
+	if cfg.Server.ResponseCompression.Enabled {
+		if level := cfg.Server.ResponseCompression.Level; level < -1 || level > 9 {
+			return nil, fmt.Errorf("invalid server.response_compression.level %d", level)
+		}
+		apiOptions = append(apiOptions, api.WithResponseCompression(cfg.Server.ResponseCompression))
+	}
+	if cfg.Server.TLS.Enabled {
+		httpTLS, err := httpTLSConfig(cfg.Server.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load https certificate: %w", err)
+		}
+		apiOptions = append(apiOptions, api.WithTLS(httpTLS, cfg.Server.TLS.RedirectPort))
+	}
+	// init metric metadata, runs first so other stages never see the reserved hint labels
+	if cfg.Metadata.Enabled {
+		metadataRegistry, err := metadata.NewRegistry(cfg.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata config: %w", err)
+		}
+		stages = append(stages, metadataRegistry)
+		apiOptions = append(apiOptions, api.WithMetadata(metadataRegistry))
+		log.Printf("Metric metadata enabled with %d hint rules", len(cfg.Metadata.Hints))
+	}
+	if cfg.UDF.Enabled {
+		s.udfRegistry = udf.NewRegistry(cfg.UDF, clk)
+		stages = append(stages, s.udfRegistry)
+		apiOptions = append(apiOptions, api.WithUDFRegistry(s.udfRegistry))
+		log.Println("WASM processing functions enabled")
+	}
+
+	// init rule packs, their rules are appended after the configured ones
+	var packManager *packs.Manager
+	if cfg.Packs.Enabled {
+		packManager, err = packs.NewManager(cfg.Packs, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init rule packs: %w", err)
+		}
+		apiOptions = append(apiOptions, api.WithPacks(packManager))
+		log.Printf("Rule packs enabled with %d installed packs in %s", len(packManager.List()), cfg.Packs.Dir)
+	}
+
+	// init relabeling, runs before sampling and store-on-change so they see the rewritten series
+	if cfg.Relabel.Enabled {
+		relabeler, err := relabel.NewStage(cfg.Relabel.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relabel rules: %w", err)
+		}
+		if packManager != nil {
+			packManager.OnChange(func(installed []packs.Pack) {
+				if err := relabeler.SetRules(packs.RelabelRules(cfg.Relabel.Rules, installed)); err != nil {
+					log.Printf("Failed to apply relabel rules from packs: %v", err)
+				}
+			})
+		}
+		stages = append(stages, relabeler)
+		log.Printf("Relabeling enabled with %d rules", len(cfg.Relabel.Rules))
+	}
+
+	// init series sampling, runs before store-on-change so dropped series are not tracked
+	if cfg.Sampling.Enabled {
+		sampler, err := sampling.NewStage(cfg.Sampling)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init sampling: %w", err)
+		}
+		stages = append(stages, sampler)
+		log.Printf("Sampling enabled with %d rules using the %s sampler", len(cfg.Sampling.Rules), cfg.Sampling.Sampler)
+	}
+
+	// init store-on-change filter, runs after user-defined functions
+	if cfg.OnChange.Enabled {
+		onChangeFilter := onchange.NewFilter(cfg.OnChange)
+		if packManager != nil {
+			packManager.OnChange(func(installed []packs.Pack) {
+				onChangeFilter.SetRules(packs.OnChangeRules(cfg.OnChange.Rules, installed))
+			})
+		}
+		stages = append(stages, onChangeFilter)
+		apiOptions = append(apiOptions, api.WithOnChangeFilter(onChangeFilter))
+		log.Printf("Store-on-change enabled with %d rules", len(cfg.OnChange.Rules))
+	}
+
+	// custom stages run after the configured ones
+	stages = append(stages, o.stages...)
+
+	// init debug tap, runs last so it logs metrics as they will be stored
+	if cfg.DebugTap.Enabled {
+		tap, err := debugtap.NewTap(cfg.DebugTap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init debug tap: %w", err)
+		}
+		stages = append(stages, tap)
+		log.Printf("Debug tap enabled, logging %.2f%% of processed metrics", cfg.DebugTap.SampleRate*100)
+	}
+
+	// init data processor
+	dataProcessor := processor.NewDefaultProcessorWithConfig(clk, cfg.Processor, stages...)
+	log.Println("Data processor initialized successfully")
+
+	// init data storage
+	dataStorage, err := storage.NewStorageWithClock(cfg.Storage, clk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init storage: %w", err)
+	}
+	s.storage = dataStorage
+	log.Printf("Data storage (%s) initialized successfully", cfg.Storage.Type)
+
+	// init self metrics of the server
+	if cfg.SelfMetrics.Enabled {
+		metrics := selfmetrics.New()
+		metrics.WatchStorage(dataStorage)
+		metrics.WatchQUIC(quicActivity)
+		EnableSelfMetrics(metrics)
+		OnMetricsIngested(metrics.Observe)
+		OnIngestError(metrics.IngestFailed)
+		apiOptions = append(apiOptions, api.WithSelfMetrics(metrics, cfg.SelfMetrics.Path))
+		log.Printf("Self metrics enabled at %s", cfg.SelfMetrics.Path)
+	}
+
+	// report data lost to max_size before it expires
+	if notifier, ok := dataStorage.(storage.EvictionNotifier); ok {
+		notifier.OnEviction(func(event storage.EvictionEvent) {
+			data, _ := json.Marshal(event)
+			log.Printf("Retention alert: %s", data)
+		})
+		apiOptions = append(apiOptions, api.WithEvictions(notifier))
+	}
+
+	// init fault injection for resilience testing
+	var faults *chaos.Injector
+	if cfg.Chaos.Enabled {
+		faults = chaos.NewInjector(cfg.Chaos)
+		apiOptions = append(apiOptions, api.WithChaos(faults))
+		log.Printf("WARNING: fault injection enabled (storage delay %.2f, frame drop %.2f, send failure %.2f), do not use in production",
+			cfg.Chaos.StorageDelay.Probability, cfg.Chaos.FrameDropProbability, cfg.Chaos.SendFailureProbability)
+	}
+
+	// archive expired metrics to object storage before they are deleted
+	if cfg.Storage.Archive.Enabled {
+		notifier, ok := dataStorage.(storage.ExpiryNotifier)
+		if !ok {
+			return nil, fmt.Errorf("storage type %s does not support archiving", cfg.Storage.Type)
+		}
+		s.archiver, err = archive.New(cfg.Storage.Archive, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init archive: %w", err)
+		}
+		s.archiver.InjectFaults(faults)
+		notifier.OnExpire(s.archiver.Archive)
+		log.Printf("Archiving expired metrics to bucket %s as %s", cfg.Storage.Archive.S3.Bucket, cfg.Storage.Archive.Format)
+	}
+
+	// init duplicate compaction
+	if cfg.Storage.Compaction.Enabled {
+		compactor, ok := dataStorage.(storage.Compactor)
+		if !ok {
+			return nil, fmt.Errorf("storage type %s does not support compaction", cfg.Storage.Type)
+		}
+		s.background = append(s.background, func(stop <-chan struct{}) {
+			storage.RunCompaction(compactor, cfg.Storage.Compaction.Interval, cfg.Storage.Compaction.MergeConflicts, clk, stop)
+		})
+		log.Printf("Storage compaction enabled every %s", cfg.Storage.Compaction.Interval)
+	}
+
+	// on-demand compaction through the admin api uses the same merge setting
+	apiOptions = append(apiOptions, api.WithCompaction(cfg.Storage.Compaction.MergeConflicts))
+
+	// init rollups of ingested metrics
+	var rollups *rollup.Store
+	if len(cfg.Storage.Rollups) > 0 {
+		rollups, err = rollup.New(cfg.Storage.Rollups, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init rollups: %w", err)
+		}
+		OnMetricsIngested(rollups.Observe)
+		apiOptions = append(apiOptions, api.WithRollups(rollups))
+		log.Printf("Rollups enabled at resolutions %v", rollups.Resolutions())
+	}
+
+	// init approximate top-k of high-cardinality labels
+	if cfg.TopK.Enabled {
+		tracker := topk.NewTracker(cfg.TopK, clk)
+		OnMetricsIngested(tracker.Observe)
+		apiOptions = append(apiOptions, api.WithTopK(tracker))
+		log.Printf("Top-k tracking enabled with %d rules (capacity %d, window %s)", len(cfg.TopK.Rules), cfg.TopK.Capacity, cfg.TopK.Window)
+	}
+
+	// init fleet health summary
+	if cfg.Fleet.Enabled {
+		fleetTracker := fleet.NewTracker(cfg.Fleet, clk)
+		OnMetricsIngested(fleetTracker.Observe)
+		OnIngestError(fleetTracker.RecordError)
+		apiOptions = append(apiOptions, api.WithFleet(fleetTracker))
+		log.Printf("Fleet summary enabled (window %s, offline after %s)", cfg.Fleet.Window, cfg.Fleet.OfflineAfter)
+	}
+
+	// init agent inventory
+	if cfg.Inventory.Enabled {
+		agentInventory, err := inventory.New(cfg.Inventory, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init inventory: %w", err)
+		}
+		OnMetricsIngested(agentInventory.Observe)
+		apiOptions = append(apiOptions, api.WithInventory(agentInventory))
+		log.Printf("Agent inventory enabled with %d agents (missing after %s)", agentInventory.Report().Summary.Expected, cfg.Inventory.MissingAfter)
+	}
+
+	// init stale series detection
+	if cfg.Staleness.Enabled {
+		stalenessTracker := staleness.NewTracker(cfg.Staleness, clk)
+		OnMetricsIngested(stalenessTracker.Observe)
+		s.background = append(s.background, stalenessTracker.Run)
+		apiOptions = append(apiOptions, api.WithStaleness(stalenessTracker))
+		log.Printf("Stale series detection enabled (after %s, check interval %s)", cfg.Staleness.After, cfg.Staleness.CheckInterval)
+	}
+
+	// init ingest rate watermarks
+	if cfg.IngestRate.Enabled {
+		meter := ingestrate.NewMeter(cfg.IngestRate, clk)
+		OnMetricsIngested(meter.Observe)
+		apiOptions = append(apiOptions, api.WithIngestRates(meter))
+		log.Printf("Ingest rate watermarks enabled (resolution %s, windows %v)", cfg.IngestRate.Resolution, cfg.IngestRate.Windows)
+	}
+
+	// init live metric stream
+	var streamHub *stream.Hub
+	if cfg.Stream.Enabled {
+		streamHub = stream.NewHub(cfg.Stream)
+		OnMetricsIngested(streamHub.Publish)
+		apiOptions = append(apiOptions, api.WithStream(streamHub))
+		log.Printf("Live metric stream enabled (buffer %d, max subscribers %d, replay %d)", cfg.Stream.Buffer, cfg.Stream.MaxSubscribers, max(cfg.Stream.Replay, 0))
+	}
+
+	// init prometheus exposition
+	if cfg.Prometheus.Enabled {
+		collector := exposition.NewCollector(cfg.Prometheus, clk)
+		// storage namespaces double as tenants, each with its own scrape path
+		if ns, ok := dataStorage.(storage.Namespacer); ok {
+			collector.SetTenants(ns.NamespaceOf)
+			apiOptions = append(apiOptions, api.WithPrometheusTenants(cfg.Prometheus.TenantPath))
+			log.Printf("Prometheus tenant exposition enabled at %s/:tenant for %d namespaces", cfg.Prometheus.TenantPath, len(ns.Namespaces()))
+		}
+		OnMetricsIngested(collector.Observe)
+		apiOptions = append(apiOptions, api.WithPrometheus(collector, cfg.Prometheus.Path))
+		log.Printf("Prometheus exposition enabled at %s (stale after %s, max series %d)", cfg.Prometheus.Path, cfg.Prometheus.StaleAfter, cfg.Prometheus.MaxSeries)
+	}
+
+	// init export sinks, each receives ingested metrics through the export router with its own transform rules
+	exportRouter := fanout.NewRouter()
+
+	// init prometheus remote_write forwarding
+	if cfg.RemoteWrite.Enabled {
+		s.forwarder, err = remotewrite.NewForwarder(cfg.RemoteWrite, clk, faults)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init remote_write: %w", err)
+		}
+		if err := exportRouter.Add("remote_write", cfg.RemoteWrite.Transform, s.forwarder.Forward); err != nil {
+			return nil, fmt.Errorf("failed to init remote_write transform: %w", err)
+		}
+		apiOptions = append(apiOptions, api.WithRemoteWrite(s.forwarder))
+		log.Printf("Forwarding metrics to remote_write endpoint %s", cfg.RemoteWrite.URL)
+	}
+
+	// init otlp export
+	if cfg.OTLPExport.Enabled {
+		s.otlpExporter, err = otlp.NewExporter(cfg.OTLPExport, clk, faults)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init otlp export: %w", err)
+		}
+		if err := exportRouter.Add("otlp_export", cfg.OTLPExport.Transform, s.otlpExporter.Export); err != nil {
+			return nil, fmt.Errorf("failed to init otlp_export transform: %w", err)
+		}
+		apiOptions = append(apiOptions, api.WithOTLPExport(s.otlpExporter))
+		log.Printf("Exporting metrics to OTLP endpoint %s (%s)", cfg.OTLPExport.Endpoint, cfg.OTLPExport.Protocol)
+	}
+
+	// init nats publishing
+	if cfg.NATS.Enabled {
+		s.natsPublisher, err = nats.NewPublisher(cfg.NATS, clk, faults)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init nats publishing: %w", err)
+		}
+		if err := exportRouter.Add("nats", cfg.NATS.Transform, s.natsPublisher.Publish); err != nil {
+			return nil, fmt.Errorf("failed to init nats transform: %w", err)
+		}
+		apiOptions = append(apiOptions, api.WithNATS(s.natsPublisher))
+		log.Printf("Publishing metrics to NATS subject %s (jetstream %t)", cfg.NATS.Subject, cfg.NATS.JetStream.Enabled)
+	}
+
+	// custom sinks go through the same router
+	for _, sink := range o.sinks {
+		if err := exportRouter.Add(sink.name, sink.rules, sink.sink); err != nil {
+			return nil, fmt.Errorf("failed to init %s transform: %w", sink.name, err)
+		}
+	}
+	if exportRouter.Len() > 0 {
+		OnMetricsIngested(exportRouter.Dispatch)
+	}
+
+	// init write hooks
+	if cfg.WriteHooks.Enabled {
+		s.writeHooks, err = writehook.NewDispatcher(cfg.WriteHooks, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init write hooks: %w", err)
+		}
+		OnMetricsIngested(s.writeHooks.Observe)
+		apiOptions = append(apiOptions, api.WithWriteHooks(s.writeHooks))
+		log.Printf("Write hooks enabled (%d hooks)", len(cfg.WriteHooks.Hooks))
+	}
+
+	// init prometheus remote_read endpoint
+	if cfg.RemoteRead.Enabled {
+		apiOptions = append(apiOptions, api.WithRemoteRead(remoteread.NewReader(cfg.RemoteRead), cfg.RemoteRead.Path))
+		log.Printf("Prometheus remote_read enabled at %s (max samples %d)", cfg.RemoteRead.Path, cfg.RemoteRead.MaxSamples)
+	}
+
+	// init grafana json datasource endpoints
+	if cfg.Grafana.Enabled {
+		apiOptions = append(apiOptions, api.WithGrafana(grafana.NewDatasource(cfg.Grafana), cfg.Grafana.Path))
+		log.Printf("Grafana JSON datasource enabled at %s", cfg.Grafana.Path)
+	}
+
+	// init graphql query endpoint
+	if cfg.GraphQL.Enabled {
+		apiOptions = append(apiOptions, api.WithGraphQL(graphql.NewSchema(cfg.GraphQL), cfg.GraphQL.Path))
+		log.Printf("GraphQL endpoint enabled at %s", cfg.GraphQL.Path)
+	}
+
+	// init promql query endpoint
+	if cfg.PromQL.Enabled {
+		apiOptions = append(apiOptions, api.WithPromQL(promql.NewEngine(cfg.PromQL)))
+		log.Printf("PromQL endpoints enabled at /api/v1/query and /api/v1/query_range")
+	}
+
+	// init query snapshots
+	if cfg.QuerySnapshots.Enabled {
+		apiOptions = append(apiOptions, api.WithQuerySnapshots(cfg.QuerySnapshots))
+		log.Printf("Query snapshots enabled, ttl %s, max %d snapshots", cfg.QuerySnapshots.TTL, cfg.QuerySnapshots.MaxSnapshots)
+	}
+
+	// init pprof and expvar endpoints
+	if cfg.Server.Debug.Enabled {
+		apiOptions = append(apiOptions, api.WithDebug())
+		log.Println("Debug endpoints enabled at /debug/pprof and /debug/vars")
+	}
+
+	// init query tracker
+	queryTracker := queries.NewTracker(clk)
+	apiOptions = append(apiOptions, api.WithQueryTracker(queryTracker))
+
+	// init history importer, backfilled history also feeds the rollups regardless of lateness
+	historyImporter := importer.NewImporter(dataProcessor, dataStorage)
+	if rollups != nil {
+		historyImporter.OnImported(rollups.Backfill)
+	}
+	apiOptions = append(apiOptions, api.WithImporter(historyImporter))
+
+	// init handshake recorder
+	handshakeRecorder := handshake.NewRecorder(100, clk)
+	apiOptions = append(apiOptions, api.WithHandshakeRecorder(handshakeRecorder))
+
+	// init registry of connected agents
+	connRegistry := connections.NewRegistry(clk)
+	apiOptions = append(apiOptions, api.WithConnections(connRegistry))
+
+	// init agent ban list
+	banList, err := bans.NewList(cfg.Server.Bans, clk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init agent ban list: %w", err)
+	}
+	EnableBans(banList)
+	apiOptions = append(apiOptions, api.WithBans(banList))
+	if n := len(banList.Bans()); n > 0 {
+		log.Printf("Loaded %d agent bans", n)
+	}
+
+	// init agent availability tracking
+	var availabilityTracker *availability.Tracker
+	if cfg.Availability.Enabled {
+		availabilityTracker = availability.NewTracker(cfg.Availability, clk)
+		OnMetricsIngested(availabilityTracker.Observe)
+		apiOptions = append(apiOptions, api.WithAvailability(availabilityTracker))
+		log.Printf("Agent availability tracking enabled (resolution %s, grace %s, retention %s)", cfg.Availability.Resolution, cfg.Availability.Grace, cfg.Availability.Retention)
+	}
+
+	// init agent activity timeline
+	if cfg.Timeline.Enabled {
+		recorder := timeline.NewRecorder(cfg.Timeline, clk)
+		EnableTimeline(recorder)
+		OnMetricsIngested(recorder.Observe)
+		OnIngestError(recorder.IngestFailed)
+		apiOptions = append(apiOptions, api.WithTimeline(recorder))
+		log.Printf("Agent activity timeline enabled (interval %s, retention %s)", cfg.Timeline.Interval, cfg.Timeline.Retention)
+	}
+
+	// init write quotas, after the timeline so quota warnings are recorded as agent events
+	if cfg.Quotas.Enabled {
+		tracker, err := quota.NewTracker(cfg.Quotas, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init quotas: %w", err)
+		}
+		// storage namespaces double as tenants
+		if ns, ok := dataStorage.(storage.Namespacer); ok {
+			tracker.SetTenants(ns.NamespaceOf)
+		}
+		EnableQuotas(tracker)
+		apiOptions = append(apiOptions, api.WithQuotas(tracker))
+		log.Printf("Write quotas enabled (%d rules, window %s)", len(cfg.Quotas.Rules), cfg.Quotas.Window)
+	}
+
+	// init freshness sla tracker
+	if cfg.SLA.Enabled {
+		slaTracker := sla.NewTracker(cfg.SLA, clk)
+		if availabilityTracker != nil {
+			slaTracker.SetUptime(func(agentID string, start, end time.Time) (float64, bool) {
+				uptime, ok, _ := availabilityTracker.Uptime(agentID, start, end, 0)
+				return uptime.Uptime, ok
+			})
+		}
+		if packManager != nil {
+			packManager.OnChange(func(installed []packs.Pack) {
+				slaTracker.SetRules(packs.SLARules(cfg.SLA.Rules, installed))
+			})
+		}
+		OnMetricsIngested(slaTracker.Observe)
+		s.background = append(s.background, slaTracker.Run)
+		apiOptions = append(apiOptions, api.WithSLATracker(slaTracker))
+		log.Println("Freshness SLA tracking enabled")
+	}
+
+	// init webhook ingest
+	if cfg.Webhook.Enabled {
+		webhookImporter := importer.NewImporter(dataProcessor, ingestStorage{dataStorage})
+		apiOptions = append(apiOptions, api.WithWebhook(cfg.Webhook, webhookImporter))
+		log.Printf("Webhook ingest enabled for %d sources", len(cfg.Webhook.Sources))
+	}
+
+	// init otlp metrics receiver
+	if cfg.OTLP.Enabled {
+		s.otlpReceiver = otlp.NewReceiver(cfg.OTLP, dataProcessor, ingestStorage{dataStorage})
+		if cfg.OTLP.HTTP {
+			apiOptions = append(apiOptions, api.WithOTLP(s.otlpReceiver))
+		}
+	}
+
+	// init influxdb line protocol ingest
+	if cfg.Influx.Enabled {
+		influxReceiver := influx.NewReceiver(cfg.Influx, dataProcessor, ingestStorage{dataStorage}, clk)
+		apiOptions = append(apiOptions, api.WithInflux(influxReceiver))
+		log.Println("InfluxDB line protocol ingest enabled")
+	}
+
+	// init agent diagnostic commands
+	if cfg.Commands.Enabled {
+		commandManager := commands.NewManager(cfg.Commands, clk)
+		EnableCommands(commandManager)
+		apiOptions = append(apiOptions, api.WithCommandManager(commandManager))
+		log.Println("Agent diagnostic commands enabled")
+	}
+
+	// init metric access control
+	var aclPolicy *acl.Policy
+	if cfg.ACL.Enabled {
+		aclPolicy = acl.NewPolicy(cfg.ACL)
+		apiOptions = append(apiOptions, api.WithACL(aclPolicy))
+		log.Printf("Metric access control enabled with %d restricted rules", len(cfg.ACL.Restricted))
+	}
+
+	// init jwt authentication
+	if cfg.JWT.Enabled {
+		verifier, err := jwtauth.NewVerifier(cfg.JWT, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init jwt authentication: %w", err)
+		}
+		apiOptions = append(apiOptions, api.WithJWT(verifier, cfg.JWT.AdminRole, cfg.JWT.DeleteRole))
+		log.Printf("JWT authentication enabled for issuer %q, admin role %q, delete role %q", cfg.JWT.Issuer, cfg.JWT.AdminRole, cfg.JWT.DeleteRole)
+	}
+
+	// init pre-aggregation of high-frequency series, applies to every real-time ingest path
+	if cfg.PreAggregate.Enabled {
+		s.preAggregate, err = preagg.NewAggregator(cfg.PreAggregate, clk, writeMetrics)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init pre-aggregation: %w", err)
+		}
+		EnablePreAggregation(s.preAggregate)
+		log.Printf("Pre-aggregation enabled with %d rules", len(cfg.PreAggregate.Rules))
+	}
+
+	// init duplicate frame filter for batches resent after reconnects
+	if cfg.Dedup.Enabled {
+		frameFilter, err := dedup.NewFilter(cfg.Dedup, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init dedup: %w", err)
+		}
+		EnableDedup(frameFilter)
+		apiOptions = append(apiOptions, api.WithDedup(frameFilter))
+		log.Printf("Duplicate frame filter enabled (window %s, false positive rate %g)", cfg.Dedup.Window, cfg.Dedup.FalsePositiveRate)
+	}
+
+	// init admission control for agent reconnect storms
+	if cfg.Admission.Enabled {
+		s.admissionController = admission.NewController(cfg.Admission, saveMetrics)
+		EnableAdmission(s.admissionController)
+		apiOptions = append(apiOptions, api.WithAdmission(s.admissionController))
+		log.Printf("Admission control enabled (buffer %d, rate %.0f/s)", cfg.Admission.BufferSize, cfg.Admission.Rate)
+	}
+
+	// init quic server
+	InitQuicServer(dataProcessor, dataStorage, handshakeRecorder, connRegistry)
+	SetHandoffEndpoints(cfg.Server.HandoffEndpoints)
+	EnableChaos(faults)
+	if cfg.Server.ConnLabels.Enabled {
+		EnableConnLabels(cfg.Server.ConnLabels.Listener)
+		log.Printf("Connection labels enabled for listener %q", cfg.Server.ConnLabels.Listener)
+	}
+	if cfg.Server.Provenance.Enabled {
+		EnableProvenance(cfg.Server.Provenance.Listener)
+		log.Printf("Batch provenance recording enabled for listener %q", cfg.Server.Provenance.Listener)
+	}
+	if cfg.Server.Pinning.Enabled {
+		pins, err := pinning.NewRegistry(cfg.Server.Pinning, clk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init agent identity pinning: %w", err)
+		}
+		EnablePinning(pins)
+		apiOptions = append(apiOptions, api.WithPinning(pins))
+		log.Printf("Agent identity pinning enabled in %s mode (%d pinned)", cfg.Server.Pinning.Mode, pins.Stats().Pinned)
+	}
+
+	// init protocol compatibility shims
+	if len(cfg.Protocol.Shims) > 0 {
+		decoder, err := compat.NewDecoder(cfg.Protocol.Shims)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init protocol shims: %w", err)
+		}
+		SetFrameDecoder(decoder)
+		log.Printf("Protocol compatibility enabled with %d field shims", len(cfg.Protocol.Shims))
+	}
+	SetFrameCompression(cfg.Compression)
+	log.Println("Quic server initialized successfully")
+
+	// init query servers
+	s.apiServer = api.NewAPIServer(dataStorage, append(apiOptions, o.apiOptions...)...)
+	if cfg.Flight.Enabled {
+		s.flightServer = arrowflight.NewServer(dataStorage, clk, cfg.Flight.MaxRows, queryTracker, aclPolicy)
+	}
+	if cfg.GRPCQuery.Enabled {
+		s.grpcQueryServer = grpcquery.NewServer(dataStorage, clk, cfg.GRPCQuery.MaxRows, queryTracker, aclPolicy, streamHub)
+	}
+	return s, nil
+}
+
+// Start 在后台启动各个监听和后台任务，监听失败或意外退出的错误通过Err返回
+func (s *Server) Start() error {
+	cfg := s.cfg
+	for _, run := range s.background {
+		go run(s.stop)
+	}
+
+	// start quic server
+	quicAddr := fmt.Sprintf(":%d", cfg.Server.QUICPort)
+	s.run("quic server", func() error { return StartQuicServer(quicAddr) })
+	log.Printf("Quic server started successfully on %s", quicAddr)
+
+	// init mdns advertisement
+	if cfg.Server.Discovery.Enabled {
+		advertiser, err := discovery.NewAdvertiser(cfg.Server.Discovery, cfg.Server.QUICPort)
+		if err != nil {
+			return fmt.Errorf("failed to init mdns advertisement: %w", err)
+		}
+		s.advertiser = advertiser
+		log.Printf("Advertising quic endpoint via mDNS as %s", advertiser.Instance())
+	}
+
+	// start api server
+	httpAddr := fmt.Sprintf(":%d", cfg.Server.HTTPPort)
+	s.run("api server", func() error {
+		return s.apiServer.Start(httpAddr, cfg.Server.ReadTimeout, cfg.Server.WriteTimeout)
+	})
+	log.Printf("Api server started successfully on %s", httpAddr)
+
+	// start arrow flight server
+	if s.flightServer != nil {
+		flightAddr := fmt.Sprintf(":%d", cfg.Flight.Port)
+		s.run("arrow flight server", func() error { return s.flightServer.Start(flightAddr) })
+		log.Printf("Arrow flight server started successfully on %s", flightAddr)
+	}
+
+	// start grpc query server
+	if s.grpcQueryServer != nil {
+		grpcQueryAddr := fmt.Sprintf(":%d", cfg.GRPCQuery.Port)
+		s.run("grpc query server", func() error { return s.grpcQueryServer.Start(grpcQueryAddr) })
+		log.Printf("gRPC query server started successfully on %s", grpcQueryAddr)
+	}
+
+	// start otlp grpc receiver
+	if s.otlpReceiver != nil {
+		otlpAddr := fmt.Sprintf(":%d", cfg.OTLP.GRPCPort)
+		s.run("otlp receiver", func() error { return s.otlpReceiver.Start(otlpAddr) })
+		log.Printf("OTLP receiver started successfully on %s (http: %v)", otlpAddr, cfg.OTLP.HTTP)
+	}
+	return nil
+}
+
+// run 在后台运行监听，返回错误时发送到errs
+func (s *Server) run(name string, serve func() error) {
+	go func() {
+		if err := serve(); err != nil {
+			select {
+			case s.errs <- fmt.Errorf("failed to start %s: %w", name, err):
+			default:
+				log.Printf("Failed to start %s: %v", name, err)
+			}
+		}
+	}()
+}
+
+// Err 返回后台监听启动失败或意外退出的错误，服务器此时已无法正常工作
+func (s *Server) Err() <-chan error {
+	return s.errs
+}
+
+// Storage 返回服务器使用的存储
+func (s *Server) Storage() storage.Storage {
+	return s.storage
+}
+
+// Shutdown 按依赖顺序停止接入、排空缓冲和导出队列并关闭存储，ctx到期后不再等待排空
+func (s *Server) Shutdown(ctx context.Context) {
+	// withdraw the mdns advertisement so agents stop discovering this server
+	if s.advertiser != nil {
+		s.advertiser.Close()
+	}
+
+	// stop accepting agents and drain in-flight streams into storage
+	if err := StopQuicServer(ctx); err != nil {
+		log.Printf("Quic server shutdown: %v", err)
+	}
+
+	// write out metrics still waiting in the admission buffer
+	if s.admissionController != nil {
+		if err := s.admissionController.Close(ctx); err != nil {
+			log.Printf("Admission buffer flush: %v", err)
+		}
+	}
+
+	// finish in-flight otlp exports
+	if s.otlpReceiver != nil {
+		if err := s.otlpReceiver.Stop(ctx); err != nil {
+			log.Printf("OTLP receiver shutdown: %v", err)
+		}
+	}
+
+	// finish in-flight http requests (including webhook and otlp ingest)
+	if err := s.apiServer.Stop(ctx); err != nil {
+		log.Printf("Api server shutdown: %v", err)
+	}
+
+	// write out pre-aggregation windows that are still open
+	if s.preAggregate != nil {
+		if err := s.preAggregate.Close(); err != nil {
+			log.Printf("Pre-aggregation flush: %v", err)
+		}
+	}
+
+	// send samples still queued for remote_write
+	if s.forwarder != nil {
+		if err := s.forwarder.Close(ctx); err != nil {
+			log.Printf("Remote write flush: %v", err)
+		}
+	}
+
+	// send metrics still queued for otlp export
+	if s.otlpExporter != nil {
+		if err := s.otlpExporter.Close(ctx); err != nil {
+			log.Printf("OTLP export flush: %v", err)
+		}
+	}
+
+	// publish metrics still queued for nats
+	if s.natsPublisher != nil {
+		if err := s.natsPublisher.Close(ctx); err != nil {
+			log.Printf("NATS publish flush: %v", err)
+		}
+	}
+
+	// run write hooks for events still queued
+	if s.writeHooks != nil {
+		if err := s.writeHooks.Close(ctx); err != nil {
+			log.Printf("Write hooks flush: %v", err)
+		}
+	}
+
+	if s.flightServer != nil {
+		if err := s.flightServer.Stop(ctx); err != nil {
+			log.Printf("Arrow flight server shutdown: %v", err)
+		}
+	}
+
+	if s.grpcQueryServer != nil {
+		if err := s.grpcQueryServer.Stop(ctx); err != nil {
+			log.Printf("gRPC query server shutdown: %v", err)
+		}
+	}
+
+	close(s.stop)
+
+	// flush storage after all writers have stopped
+	if err := s.storage.Close(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
+	}
+
+	// upload expired metrics still waiting for a full batch
+	if s.archiver != nil {
+		s.archiver.Close()
+	}
+
+	if s.udfRegistry != nil {
+		s.udfRegistry.Close()
+	}
+}
@@ -0,0 +1,265 @@
+package sla
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 序列状态
+const (
+	StatusFresh = "fresh"
+	StatusLate  = "late"
+)
+
+// maxAlerts 保留的最近告警条数
+const maxAlerts = 200
+
+// SeriesReport 单个序列的新鲜度报告
+type SeriesReport struct {
+	AgentID          string    `json:"agent_id"`
+	Metric           string    `json:"metric"`
+	ExpectedInterval string    `json:"expected_interval"`
+	LastSeen         time.Time `json:"last_seen"`
+	Checks           uint64    `json:"checks"`
+	FreshChecks      uint64    `json:"fresh_checks"`
+	Compliance       float64   `json:"compliance"`
+	ConsecutiveLate  int       `json:"consecutive_late"`
+	LateEpisodes     uint64    `json:"late_episodes"`
+	Status           string    `json:"status"`
+	// AgentUptime 开始跟踪该序列以来Agent的可用率，未启用可用率统计时为空
+	AgentUptime *float64 `json:"agent_uptime,omitempty"`
+}
+
+// UptimeFunc 返回Agent在[start, end)内的可用率，没有数据时ok为false
+type UptimeFunc func(agentID string, start, end time.Time) (uptime float64, ok bool)
+
+// Alert 序列连续迟报的告警
+type Alert struct {
+	Time            time.Time `json:"time"`
+	AgentID         string    `json:"agent_id"`
+	Metric          string    `json:"metric"`
+	LastSeen        time.Time `json:"last_seen"`
+	ConsecutiveLate int       `json:"consecutive_late"`
+}
+
+// series 跟踪中的序列状态
+type series struct {
+	agentID         string
+	metric          string
+	rule            *config.SLARule
+	since           time.Time
+	lastSeen        time.Time
+	checks          uint64
+	freshChecks     uint64
+	consecutiveLate int
+	lateEpisodes    uint64
+	alerted         bool
+}
+
+// Tracker 按规则跟踪每个Agent/指标的上报新鲜度
+type Tracker struct {
+	mu             sync.Mutex
+	rules          []config.SLARule
+	alertThreshold int
+	checkInterval  time.Duration
+	clock          clock.Clock
+	series         map[string]*series
+	alerts         []Alert
+	uptime         UptimeFunc
+}
+
+// NewTracker 创建新鲜度跟踪器
+func NewTracker(cfg config.SLAConfig, clk clock.Clock) *Tracker {
+	return &Tracker{
+		rules:          cfg.Rules,
+		alertThreshold: cfg.AlertThreshold,
+		checkInterval:  cfg.CheckInterval,
+		clock:          clk,
+		series:         make(map[string]*series),
+	}
+}
+
+// SetUptime 设置Agent可用率的来源，报告中附带每个序列所属Agent的可用率，需在开始跟踪前调用
+func (t *Tracker) SetUptime(fn UptimeFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uptime = fn
+}
+
+// SetRules 替换新鲜度规则，已跟踪的序列重新匹配规则，不再匹配任何规则的序列停止跟踪
+func (t *Tracker) SetRules(rules []config.SLARule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rules = rules
+	for key, s := range t.series {
+		rule := t.match(s.agentID, s.metric)
+		if rule == nil {
+			delete(t.series, key)
+			continue
+		}
+		s.rule = rule
+	}
+}
+
+// Observe 记录新到达的指标，应在数据写入存储后调用
+func (t *Tracker) Observe(metrics []processor.ProcessedMetric) {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range metrics {
+		m := &metrics[i]
+		key := m.AgentID + "\x00" + m.Name
+
+		s, ok := t.series[key]
+		if !ok {
+			rule := t.match(m.AgentID, m.Name)
+			if rule == nil {
+				continue
+			}
+			s = &series{agentID: m.AgentID, metric: m.Name, rule: rule, since: now}
+			t.series[key] = s
+		}
+		s.lastSeen = now
+	}
+}
+
+// Run 按检查间隔周期性评估所有序列，直到stop被关闭
+func (t *Tracker) Run(stop <-chan struct{}) {
+	ticker := t.clock.NewTicker(t.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			t.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check 评估一次所有序列的新鲜度
+func (t *Tracker) Check() {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.series {
+		s.checks++
+		if now.Sub(s.lastSeen) <= s.rule.Interval+s.rule.Grace {
+			s.freshChecks++
+			s.consecutiveLate = 0
+			s.alerted = false
+			continue
+		}
+
+		if s.consecutiveLate == 0 {
+			s.lateEpisodes++
+		}
+		s.consecutiveLate++
+
+		if s.consecutiveLate >= t.alertThreshold && !s.alerted {
+			s.alerted = true
+			t.addAlert(Alert{
+				Time:            now,
+				AgentID:         s.agentID,
+				Metric:          s.metric,
+				LastSeen:        s.lastSeen,
+				ConsecutiveLate: s.consecutiveLate,
+			})
+		}
+	}
+}
+
+// Report 返回所有序列的新鲜度报告，agentID非空时只返回该Agent的序列
+func (t *Tracker) Report(agentID string) []SeriesReport {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]SeriesReport, 0, len(t.series))
+	for _, s := range t.series {
+		if agentID != "" && s.agentID != agentID {
+			continue
+		}
+
+		report := SeriesReport{
+			AgentID:          s.agentID,
+			Metric:           s.metric,
+			ExpectedInterval: s.rule.Interval.String(),
+			LastSeen:         s.lastSeen,
+			Checks:           s.checks,
+			FreshChecks:      s.freshChecks,
+			Compliance:       1,
+			ConsecutiveLate:  s.consecutiveLate,
+			LateEpisodes:     s.lateEpisodes,
+			Status:           StatusFresh,
+		}
+		if s.checks > 0 {
+			report.Compliance = float64(s.freshChecks) / float64(s.checks)
+		}
+		if s.consecutiveLate > 0 {
+			report.Status = StatusLate
+		}
+		if t.uptime != nil {
+			if uptime, ok := t.uptime(s.agentID, s.since, now); ok {
+				report.AgentUptime = &uptime
+			}
+		}
+		result = append(result, report)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AgentID != result[j].AgentID {
+			return result[i].AgentID < result[j].AgentID
+		}
+		return result[i].Metric < result[j].Metric
+	})
+	return result
+}
+
+// Alerts 返回最近的告警，最新的在前
+func (t *Tracker) Alerts() []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]Alert, len(t.alerts))
+	for i, alert := range t.alerts {
+		result[len(t.alerts)-1-i] = alert
+	}
+	return result
+}
+
+// addAlert 记录告警，调用方需持有锁
+func (t *Tracker) addAlert(alert Alert) {
+	log.Printf("SLA alert: agent %s metric %s late for %d consecutive checks (last seen %s)",
+		alert.AgentID, alert.Metric, alert.ConsecutiveLate, alert.LastSeen.Format(time.RFC3339))
+
+	t.alerts = append(t.alerts, alert)
+	if len(t.alerts) > maxAlerts {
+		t.alerts = t.alerts[len(t.alerts)-maxAlerts:]
+	}
+}
+
+// match 返回第一个匹配的规则
+func (t *Tracker) match(agentID, metric string) *config.SLARule {
+	for i := range t.rules {
+		rule := &t.rules[i]
+		if storage.MatchGlob(rule.Agent, agentID) && storage.MatchGlob(rule.Metric, metric) {
+			return rule
+		}
+	}
+	return nil
+}
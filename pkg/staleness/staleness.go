@@ -0,0 +1,208 @@
+package staleness
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// Series 一个已标记为过期的序列
+type Series struct {
+	AgentID string            `json:"agent_id"`
+	Name    string            `json:"name"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// LastSeen 序列最后一次上报的时间
+	LastSeen time.Time `json:"last_seen"`
+	// StaleSince 标记为过期的时间
+	StaleSince time.Time `json:"stale_since"`
+}
+
+// Stats 过期检测的统计
+type Stats struct {
+	// Series 跟踪的序列数
+	Series int `json:"series"`
+	// Stale 当前标记为过期的序列数
+	Stale int `json:"stale"`
+	// Tombstoned 启动以来标记为过期的次数
+	Tombstoned uint64 `json:"tombstoned_total"`
+	// Revived 过期后又收到数据而恢复的次数
+	Revived uint64 `json:"revived_total"`
+	// Dropped 达到max_series后未跟踪的新序列数
+	Dropped uint64 `json:"dropped_total"`
+}
+
+// series 单个序列的上报情况
+type series struct {
+	metric   processor.ProcessedMetric
+	lastSeen time.Time
+	// staleSince 不为零时序列已标记为过期
+	staleSince time.Time
+}
+
+// Tracker 检测停止上报的序列
+//
+// Agent仍在上报其他数据、而某个序列超过after没有新数据时，该序列在下一次检查时被标记为过期(墓碑)，
+// 不再出现在最新值视图和Prometheus抓取结果中，避免已消失的序列一直输出最后的取值。
+// 整个Agent停止上报时不标记其序列，由集群健康摘要和可用率统计反映。序列收到新数据后立即恢复。
+type Tracker struct {
+	mu        sync.Mutex
+	clock     clock.Clock
+	after     time.Duration
+	interval  time.Duration
+	retain    time.Duration
+	maxSeries int
+	// agents 各Agent最后一次上报的时间
+	agents     map[string]time.Time
+	series     map[string]*series
+	tombstoned uint64
+	revived    uint64
+	dropped    uint64
+}
+
+// NewTracker 创建过期序列检测器
+func NewTracker(cfg config.StalenessConfig, clk clock.Clock) *Tracker {
+	return &Tracker{
+		clock:     clk,
+		after:     cfg.After,
+		interval:  cfg.CheckInterval,
+		retain:    cfg.Retain,
+		maxSeries: cfg.MaxSeries,
+		agents:    make(map[string]time.Time),
+		series:    make(map[string]*series),
+	}
+}
+
+// Observe 记录写入存储的一批数据，应在数据写入存储后调用
+func (t *Tracker) Observe(metrics []processor.ProcessedMetric) {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range metrics {
+		m := &metrics[i]
+		if m.AgentID == "" {
+			continue
+		}
+		t.agents[m.AgentID] = now
+
+		key := processor.SeriesKey(m)
+		s, ok := t.series[key]
+		if !ok {
+			if t.maxSeries > 0 && len(t.series) >= t.maxSeries {
+				t.dropped++
+				continue
+			}
+			s = &series{metric: processor.ProcessedMetric{AgentID: m.AgentID, Name: m.Name, Labels: m.Labels}}
+			t.series[key] = s
+		}
+		if !s.staleSince.IsZero() {
+			s.staleSince = time.Time{}
+			t.revived++
+		}
+		s.lastSeen = now
+	}
+}
+
+// Run 每隔check_interval检查一次过期序列，直到stop关闭
+func (t *Tracker) Run(stop <-chan struct{}) {
+	ticker := t.clock.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			t.Check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check 标记过期序列，并清理超过retain未上报的序列和Agent
+func (t *Tracker) Check() {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, s := range t.series {
+		if t.retain > 0 && now.Sub(s.lastSeen) > t.retain {
+			delete(t.series, key)
+			continue
+		}
+		if s.staleSince.IsZero() && t.agents[s.metric.AgentID].Sub(s.lastSeen) > t.after {
+			s.staleSince = now
+			t.tombstoned++
+		}
+	}
+	for agentID, lastSeen := range t.agents {
+		if t.retain > 0 && now.Sub(lastSeen) > t.retain {
+			delete(t.agents, agentID)
+		}
+	}
+}
+
+// Stale 判断数据所属的序列是否已标记为过期
+func (t *Tracker) Stale(m *processor.ProcessedMetric) bool {
+	key := processor.SeriesKey(m)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.series[key]
+	return ok && !s.staleSince.IsZero()
+}
+
+// List 返回已标记为过期的序列，agentID不为空时只返回该Agent的序列，最近过期的在前
+func (t *Tracker) List(agentID string) []Series {
+	t.mu.Lock()
+	list := make([]Series, 0)
+	for _, s := range t.series {
+		if s.staleSince.IsZero() || (agentID != "" && s.metric.AgentID != agentID) {
+			continue
+		}
+		list = append(list, Series{
+			AgentID:    s.metric.AgentID,
+			Name:       s.metric.Name,
+			Labels:     s.metric.Labels,
+			LastSeen:   s.lastSeen,
+			StaleSince: s.staleSince,
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].StaleSince.Equal(list[j].StaleSince) {
+			return list[i].StaleSince.After(list[j].StaleSince)
+		}
+		if list[i].AgentID != list[j].AgentID {
+			return list[i].AgentID < list[j].AgentID
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Stats 返回过期检测的统计
+func (t *Tracker) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := Stats{
+		Series:     len(t.series),
+		Tombstoned: t.tombstoned,
+		Revived:    t.revived,
+		Dropped:    t.dropped,
+	}
+	for _, s := range t.series {
+		if !s.staleSince.IsZero() {
+			stats.Stale++
+		}
+	}
+	return stats
+}
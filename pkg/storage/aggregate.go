@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/histogram"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+)
+
+// 聚合函数
+const (
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateSum   = "sum"
+	AggregateCount = "count"
+	// AggregateQuantile 合并窗口内的指数直方图后估算Quantile分位数
+	AggregateQuantile = "quantile"
+	// AggregateHistogram 输出窗口内合并后的指数直方图，Value为观测总数
+	AggregateHistogram = "histogram"
+)
+
+// AggregateQuery 聚合查询条件，AgentID为空时聚合所有Agent的同名指标
+//
+// 直方图聚合函数只使用EXPONENTIAL_HISTOGRAM类型的样本，Quantile为0到1之间的分位数。
+type AggregateQuery struct {
+	AgentID  string
+	Name     string
+	Func     string
+	Quantile float64
+	Step     time.Duration
+	Start    time.Time
+	End      time.Time
+}
+
+// Validate 检查聚合函数和时间窗口
+func (q *AggregateQuery) Validate() error {
+	switch q.Func {
+	case AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateHistogram:
+	case AggregateQuantile:
+		if q.Quantile < 0 || q.Quantile > 1 || math.IsNaN(q.Quantile) {
+			return fmt.Errorf("quantile must be between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("invalid aggregate function %q", q.Func)
+	}
+	if q.Step <= 0 {
+		return fmt.Errorf("step must be positive")
+	}
+	if q.End.Before(q.Start) {
+		return fmt.Errorf("end is before start")
+	}
+	return nil
+}
+
+// HistogramFunc 判断聚合函数是否作用于指数直方图
+func (q *AggregateQuery) HistogramFunc() bool {
+	return q.Func == AggregateQuantile || q.Func == AggregateHistogram
+}
+
+// AggregatePoint 一个时间窗口的聚合结果，Timestamp为窗口起点，Count为窗口内的样本数
+//
+// 直方图聚合函数的结果同时带有合并后的直方图，用于跨存储合并。
+type AggregatePoint struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Value     float64                `json:"value"`
+	Count     int                    `json:"count"`
+	Histogram *histogram.Exponential `json:"histogram,omitempty"`
+}
+
+// aggregator 累计一个窗口内的样本
+type aggregator struct {
+	sum, min, max float64
+	count         int
+	hist          *histogram.Exponential
+}
+
+// add 累计一个样本
+func (a *aggregator) add(v float64) {
+	if a.count == 0 {
+		a.min, a.max = v, v
+	}
+	a.sum += v
+	a.min = math.Min(a.min, v)
+	a.max = math.Max(a.max, v)
+	a.count++
+}
+
+// addHistogram 合并一个直方图样本
+func (a *aggregator) addHistogram(h *histogram.Exponential) {
+	if a.hist == nil {
+		a.hist = &histogram.Exponential{}
+	}
+	a.hist.Merge(h)
+	a.count++
+}
+
+// value 返回聚合函数的结果
+func (a *aggregator) value(q *AggregateQuery) float64 {
+	switch q.Func {
+	case AggregateQuantile:
+		return a.hist.Quantile(q.Quantile)
+	case AggregateHistogram:
+		return float64(a.hist.Count)
+	case AggregateMin:
+		return a.min
+	case AggregateMax:
+		return a.max
+	case AggregateSum:
+		return a.sum
+	case AggregateCount:
+		return float64(a.count)
+	}
+	return a.sum / float64(a.count)
+}
+
+// WindowAggregator 按从start开始、宽度为step的窗口累计样本，供在内存中聚合的存储使用
+type WindowAggregator struct {
+	query   AggregateQuery
+	filter  Filter
+	buckets map[int64]*aggregator
+}
+
+// NewWindowAggregator 创建窗口聚合器，调用方需先校验查询
+func NewWindowAggregator(q AggregateQuery) *WindowAggregator {
+	return &WindowAggregator{
+		query:   q,
+		filter:  Filter{AgentID: q.AgentID, Start: q.Start, End: q.End},
+		buckets: make(map[int64]*aggregator),
+	}
+}
+
+// Add 累计满足查询条件的样本，直方图聚合函数跳过非直方图和无法解析的样本
+func (w *WindowAggregator) Add(m *processor.ProcessedMetric) {
+	if m.Name != w.query.Name || !w.filter.Match(m) {
+		return
+	}
+
+	var h *histogram.Exponential
+	if w.query.HistogramFunc() {
+		if m.RawType != protocol.MetricType_EXPONENTIAL_HISTOGRAM {
+			return
+		}
+		var err error
+		if h, err = histogram.Unmarshal(m.Payload); err != nil {
+			return
+		}
+	}
+
+	b := int64(m.Timestamp.Sub(w.query.Start) / w.query.Step)
+	agg, ok := w.buckets[b]
+	if !ok {
+		agg = &aggregator{}
+		w.buckets[b] = agg
+	}
+	if h != nil {
+		agg.addHistogram(h)
+	} else {
+		agg.add(m.Value)
+	}
+}
+
+// Points 返回有样本的窗口的聚合结果，按时间升序
+func (w *WindowAggregator) Points() []AggregatePoint {
+	keys := make([]int64, 0, len(w.buckets))
+	for b := range w.buckets {
+		keys = append(keys, b)
+	}
+	slices.Sort(keys)
+
+	points := make([]AggregatePoint, len(keys))
+	for i, b := range keys {
+		agg := w.buckets[b]
+		points[i] = AggregatePoint{
+			Timestamp: w.query.Start.Add(time.Duration(b) * w.query.Step),
+			Value:     agg.value(&w.query),
+			Count:     agg.count,
+			Histogram: agg.hist,
+		}
+	}
+	return points
+}
+
+// Aggregate 按从start开始、宽度为step的窗口聚合指标，没有样本的窗口不输出，结果按时间升序
+func (s *MemoryStorage) Aggregate(q AggregateQuery) ([]AggregatePoint, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	w := NewWindowAggregator(q)
+	for i := 0; i < s.count; i++ {
+		w.Add(s.at(i))
+	}
+	s.mu.RUnlock()
+
+	return w.Points(), nil
+}
+
+// mergeAggregates 合并同一查询在不同存储上的结果，同一窗口的平均值按样本数加权，
+// 直方图合并后重新计算结果
+func mergeAggregates(q AggregateQuery, results ...[]AggregatePoint) []AggregatePoint {
+	buckets := make(map[time.Time]*AggregatePoint)
+	for _, points := range results {
+		for _, p := range points {
+			key := p.Timestamp.UTC()
+			b, ok := buckets[key]
+			if !ok {
+				p := p
+				buckets[key] = &p
+				continue
+			}
+			switch q.Func {
+			case AggregateQuantile, AggregateHistogram:
+				merged := &histogram.Exponential{}
+				merged.Merge(b.Histogram)
+				merged.Merge(p.Histogram)
+				b.Histogram = merged
+				if q.Func == AggregateQuantile {
+					b.Value = merged.Quantile(q.Quantile)
+				} else {
+					b.Value = float64(merged.Count)
+				}
+			case AggregateMin:
+				b.Value = min(b.Value, p.Value)
+			case AggregateMax:
+				b.Value = max(b.Value, p.Value)
+			case AggregateSum, AggregateCount:
+				b.Value += p.Value
+			default:
+				b.Value = (b.Value*float64(b.Count) + p.Value*float64(p.Count)) / float64(b.Count+p.Count)
+			}
+			b.Count += p.Count
+		}
+	}
+
+	points := make([]AggregatePoint, 0, len(buckets))
+	for _, b := range buckets {
+		points = append(points, *b)
+	}
+	slices.SortFunc(points, func(a, b AggregatePoint) int { return a.Timestamp.Compare(b.Timestamp) })
+	return points
+}
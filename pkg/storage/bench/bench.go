@@ -0,0 +1,210 @@
+// Package bench 定义存储后端的标准写入和查询负载，用于用go test -bench客观比较不同后端和淘汰策略
+package bench
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 负载的默认规模
+const (
+	DefaultAgents         = 10
+	DefaultSeriesPerAgent = 20
+	DefaultBatchSize      = 100
+	DefaultPreload        = 50000
+	DefaultQueryLimit     = 100
+)
+
+// Dataset 生成的测试数据的形状：每个Agent有SeriesPerAgent个序列，每隔Interval每个序列产生一个样本
+type Dataset struct {
+	Agents         int
+	SeriesPerAgent int
+	Start          time.Time
+	Interval       time.Duration
+}
+
+// DefaultDataset 返回默认规模的数据集，样本时间戳从start开始
+func DefaultDataset(start time.Time) Dataset {
+	return Dataset{
+		Agents:         DefaultAgents,
+		SeriesPerAgent: DefaultSeriesPerAgent,
+		Start:          start,
+		Interval:       10 * time.Second,
+	}
+}
+
+// AgentID 返回第i个Agent的ID
+func AgentID(i int) string {
+	return fmt.Sprintf("bench-agent-%d", i)
+}
+
+// MetricName 返回第i个序列的指标名
+func MetricName(i int) string {
+	return fmt.Sprintf("bench_metric_%d", i)
+}
+
+// Generate 生成从第offset个样本开始的n个样本，按时间戳轮流写入所有序列
+func (d Dataset) Generate(offset, n int) []processor.ProcessedMetric {
+	series := d.Agents * d.SeriesPerAgent
+	metrics := make([]processor.ProcessedMetric, n)
+	for i := range metrics {
+		k := offset + i
+		s := k % series
+		agent, metric := s/d.SeriesPerAgent, s%d.SeriesPerAgent
+		metrics[i] = processor.ProcessedMetric{
+			AgentID:   AgentID(agent),
+			Timestamp: d.Start.Add(time.Duration(k/series) * d.Interval),
+			Name:      MetricName(metric),
+			Value:     float64(k % 100),
+			Labels:    map[string]string{"host": AgentID(agent), "zone": fmt.Sprintf("zone-%d", agent%3)},
+			Type:      "CPU_USAGE",
+		}
+	}
+	return metrics
+}
+
+// Span 返回前n个样本覆盖的时间范围
+func (d Dataset) Span(n int) (time.Time, time.Time) {
+	series := d.Agents * d.SeriesPerAgent
+	return d.Start, d.Start.Add(time.Duration((n-1)/series) * d.Interval)
+}
+
+// Factory 为一个负载创建空的存储实例，maxSize为容量，实例由调用方通过b.Cleanup关闭
+type Factory func(b *testing.B, maxSize int) storage.Storage
+
+// Workload 一个标准负载
+type Workload struct {
+	Name string
+	Run  func(b *testing.B, newStorage Factory)
+}
+
+// Workloads 返回所有标准负载
+//
+// 写入负载的每次操作写入一个样本；write/evict在容量已满时写入，衡量淘汰开销。
+// 查询负载先写入DefaultPreload个样本，每次操作执行一次查询。
+func Workloads() []Workload {
+	return []Workload{
+		{Name: "write/batch", Run: benchWrite(false)},
+		{Name: "write/evict", Run: benchWrite(true)},
+		{Name: "query/latest", Run: benchQuery(func(s storage.Storage, d Dataset) error {
+			_, err := s.GetLatestMetrics(DefaultQueryLimit)
+			return err
+		})},
+		{Name: "query/agent", Run: benchQuery(func(s storage.Storage, d Dataset) error {
+			_, err := s.GetMetricsByAgentID(queryAgent, DefaultQueryLimit)
+			return err
+		})},
+		{Name: "query/type", Run: benchQuery(func(s storage.Storage, d Dataset) error {
+			_, err := s.GetMetricsByType("CPU_USAGE", DefaultQueryLimit)
+			return err
+		})},
+		{Name: "query/range", Run: benchQuery(func(s storage.Storage, d Dataset) error {
+			// 最早的十分之一数据，需要跳过大部分较新的数据
+			start, end := d.Span(DefaultPreload)
+			_, err := s.GetMetricsByTimeRange(start, start.Add(end.Sub(start)/10), DefaultQueryLimit)
+			return err
+		})},
+		{Name: "query/labels", Run: benchQuery(func(s storage.Storage, d Dataset) error {
+			_, err := s.GetMetricsByLabels(zoneMatcher, DefaultQueryLimit)
+			return err
+		})},
+		{Name: "query/aggregate", Run: benchQuery(func(s storage.Storage, d Dataset) error {
+			start, end := d.Span(DefaultPreload)
+			_, err := s.Aggregate(storage.AggregateQuery{
+				Name:  MetricName(0),
+				Func:  storage.AggregateAvg,
+				Step:  time.Minute,
+				Start: start,
+				End:   end,
+			})
+			return err
+		})},
+	}
+}
+
+// queryAgent 按Agent ID查询的目标，预先生成避免计入查询开销
+var queryAgent = AgentID(DefaultAgents / 2)
+
+// zoneMatcher 匹配三分之一Agent的标签条件
+var zoneMatcher = []*storage.LabelMatcher{mustMatcher("zone", storage.MatchRegexp, "zone-[1]")}
+
+func mustMatcher(name, matchType, value string) *storage.LabelMatcher {
+	m, err := storage.NewLabelMatcher(name, matchType, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Run 把所有标准负载作为子基准测试运行
+func Run(b *testing.B, newStorage Factory) {
+	for _, w := range Workloads() {
+		b.Run(w.Name, func(b *testing.B) {
+			w.Run(b, newStorage)
+		})
+	}
+}
+
+// benchWrite 按DefaultBatchSize分批写入b.N个样本，full为true时先写满容量
+//
+// 写入的批次从DefaultPreload个预先生成的样本中循环取用，避免生成数据的开销计入结果。
+func benchWrite(full bool) func(b *testing.B, newStorage Factory) {
+	return func(b *testing.B, newStorage Factory) {
+		d := DefaultDataset(time.Now().Add(-time.Hour))
+		capacity := b.N + DefaultPreload
+		if full {
+			capacity = DefaultPreload
+		}
+		s := newStorage(b, capacity)
+
+		offset := 0
+		if full {
+			preload(b, s, d, DefaultPreload)
+			offset = DefaultPreload
+		}
+		data := d.Generate(offset, DefaultPreload)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for n := 0; n < b.N; n += DefaultBatchSize {
+			i := n % len(data)
+			batch := data[i:min(i+DefaultBatchSize, i+b.N-n, len(data))]
+			if err := s.SaveMetrics(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "metrics/s")
+	}
+}
+
+// benchQuery 写入DefaultPreload个样本后重复执行查询
+func benchQuery(query func(s storage.Storage, d Dataset) error) func(b *testing.B, newStorage Factory) {
+	return func(b *testing.B, newStorage Factory) {
+		d := DefaultDataset(time.Now().Add(-time.Hour))
+		s := newStorage(b, DefaultPreload)
+		preload(b, s, d, DefaultPreload)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := query(s, d); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// preload 分批写入前n个样本
+func preload(b *testing.B, s storage.Storage, d Dataset, n int) {
+	const batch = 1000
+	for i := 0; i < n; i += batch {
+		if err := s.SaveMetrics(d.Generate(i, min(batch, n-i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
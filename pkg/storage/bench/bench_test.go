@@ -0,0 +1,215 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	_ "github.com/konpure/Kon-Agent-export/pkg/storage/sqlite"
+)
+
+func TestMain(m *testing.M) {
+	// 存储每次写入都会记录日志，基准测试中关闭
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// backends 基准测试的后端，memory额外以启用预写日志和不同分片数的方式运行
+func backends() map[string]func(cfg *config.StorageConfig) {
+	variants := map[string]func(cfg *config.StorageConfig){
+		"memory-wal": func(cfg *config.StorageConfig) {
+			cfg.Type = "memory"
+			cfg.WAL.Enabled = true
+		},
+	}
+	for _, shards := range []config.ShardConfig{
+		{Count: 4, By: storage.ShardByAgent},
+		{Count: 16, By: storage.ShardByAgent},
+		{Count: 4, By: storage.ShardByTime, Interval: 10 * time.Minute},
+	} {
+		variants[fmt.Sprintf("memory-shards-%s-%d", shards.By, shards.Count)] = func(cfg *config.StorageConfig) {
+			cfg.Type = "memory"
+			cfg.Shards = shards
+		}
+	}
+	for _, name := range storage.Backends() {
+		variants[name] = func(cfg *config.StorageConfig) { cfg.Type = name }
+	}
+	return variants
+}
+
+// newFactory 返回按cfg创建存储的Factory，数据目录为测试临时目录
+func newFactory(configure func(cfg *config.StorageConfig)) Factory {
+	return func(b *testing.B, maxSize int) storage.Storage {
+		cfg := config.StorageConfig{
+			MaxSize:    maxSize,
+			ExpireTime: 24 * time.Hour,
+			FilePath:   b.TempDir(),
+		}
+		cfg.WAL.SegmentSize = 64 << 20
+		cfg.Tiered = config.TieredConfig{HotWindow: time.Hour, Hot: "memory", Cold: "sqlite", SpillInterval: time.Minute}
+		cfg.Block.Duration = 2 * time.Hour
+		configure(&cfg)
+
+		s, err := storage.NewStorage(cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { s.Close() })
+		return s
+	}
+}
+
+func BenchmarkStorage(b *testing.B) {
+	variants := backends()
+	names := make([]string, 0, len(variants))
+	for name := range variants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b.Run(name, func(b *testing.B) {
+			Run(b, newFactory(variants[name]))
+		})
+	}
+}
+
+// TestMemoryWriteAllocs 容量已满时内存存储写入不应按样本分配内存
+func TestMemoryWriteAllocs(t *testing.T) {
+	d := DefaultDataset(time.Now().Add(-time.Hour))
+	s := storage.NewMemoryStorage(1000, 24*time.Hour)
+	defer s.Close()
+	if err := s.SaveMetrics(d.Generate(0, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := d.Generate(1000, DefaultBatchSize)
+	allocs := testing.AllocsPerRun(100, func() {
+		s.SaveMetrics(batch)
+	})
+	if allocs > DefaultBatchSize/10 {
+		t.Errorf("SaveMetrics of %d metrics allocated %.0f times, want at most %d", DefaultBatchSize, allocs, DefaultBatchSize/10)
+	}
+}
+
+// TestMemoryIndexedQueryAllocs 按Agent ID查询只分配结果，不随数据量增长
+func TestMemoryIndexedQueryAllocs(t *testing.T) {
+	d := DefaultDataset(time.Now().Add(-time.Hour))
+	s := storage.NewMemoryStorage(DefaultPreload, 24*time.Hour)
+	defer s.Close()
+	if err := s.SaveMetrics(d.Generate(0, DefaultPreload)); err != nil {
+		t.Fatal(err)
+	}
+
+	agentID := AgentID(0)
+	allocs := testing.AllocsPerRun(100, func() {
+		s.GetMetricsByAgentID(agentID, DefaultQueryLimit)
+	})
+	if allocs > 1 {
+		t.Errorf("GetMetricsByAgentID allocated %.0f times, want at most 1", allocs)
+	}
+}
+
+// TestShardedQueries 分片存储的查询结果与单个内存存储一致，并列的数据顺序可能不同，只比较排序字段
+func TestShardedQueries(t *testing.T) {
+	d := DefaultDataset(time.Now().Add(-time.Hour))
+	metrics := d.Generate(0, 10000)
+	start, end := d.Span(len(metrics))
+
+	plain := storage.NewMemoryStorage(len(metrics), 24*time.Hour)
+	defer plain.Close()
+	if err := plain.SaveMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, shards := range []config.ShardConfig{
+		{Count: 4, By: storage.ShardByAgent},
+		{Count: 3, By: storage.ShardByTime, Interval: time.Minute},
+	} {
+		t.Run(shards.By, func(t *testing.T) {
+			// 分片的数据量不均匀，按分片数放大容量避免淘汰
+			sharded, err := storage.NewStorage(config.StorageConfig{
+				Type:       "memory",
+				MaxSize:    len(metrics) * shards.Count,
+				ExpireTime: 24 * time.Hour,
+				FilePath:   t.TempDir(),
+				Shards:     shards,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sharded.Close()
+			if err := sharded.SaveMetrics(metrics); err != nil {
+				t.Fatal(err)
+			}
+
+			queries := map[string]func(s storage.Storage) ([]processor.ProcessedMetric, error){
+				"latest": func(s storage.Storage) ([]processor.ProcessedMetric, error) {
+					return s.GetLatestMetrics(DefaultQueryLimit)
+				},
+				"agent": func(s storage.Storage) ([]processor.ProcessedMetric, error) {
+					return s.GetMetricsByAgentID(queryAgent, DefaultQueryLimit)
+				},
+				"type": func(s storage.Storage) ([]processor.ProcessedMetric, error) {
+					return s.GetMetricsByType("CPU_USAGE", DefaultQueryLimit)
+				},
+				"range": func(s storage.Storage) ([]processor.ProcessedMetric, error) {
+					return s.GetMetricsByTimeRange(start.Add(2*time.Minute), start.Add(3*time.Minute), DefaultQueryLimit)
+				},
+				"labels": func(s storage.Storage) ([]processor.ProcessedMetric, error) {
+					return s.GetMetricsByLabels(zoneMatcher, DefaultQueryLimit)
+				},
+				"sorted": func(s storage.Storage) ([]processor.ProcessedMetric, error) {
+					opts := storage.SortOptions{Field: storage.SortByValue}
+					return s.(storage.SortedQuerier).QuerySorted(storage.Filter{Start: start, End: end}, opts, DefaultQueryLimit)
+				},
+			}
+			for name, query := range queries {
+				want, err := query(plain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := query(sharded)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if len(got) != len(want) {
+					t.Fatalf("%s returned %d metrics, want %d", name, len(got), len(want))
+				}
+				for i := range want {
+					// 按值排序时比较值，其他查询按时间戳排序
+					if name == "sorted" && got[i].Value != want[i].Value || name != "sorted" && !got[i].Timestamp.Equal(want[i].Timestamp) {
+						t.Fatalf("%s: metric %d is %v=%v, want %v=%v", name, i, got[i].Timestamp, got[i].Value, want[i].Timestamp, want[i].Value)
+					}
+				}
+			}
+
+			q := storage.AggregateQuery{AgentID: queryAgent, Name: MetricName(0), Func: storage.AggregateAvg, Step: time.Minute, Start: start, End: end}
+			want, err := plain.Aggregate(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := sharded.Aggregate(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("aggregate returned %d points, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if !got[i].Timestamp.Equal(want[i].Timestamp) || math.Abs(got[i].Value-want[i].Value) > 1e-9 {
+					t.Errorf("aggregate point %d is %v=%v, want %v=%v", i, got[i].Timestamp, got[i].Value, want[i].Timestamp, want[i].Value)
+				}
+			}
+		})
+	}
+}
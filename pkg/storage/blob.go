@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"hash/maphash"
+	"unsafe"
+)
+
+// PayloadStats 负载去重统计
+type PayloadStats struct {
+	// Blobs 去重后保存的负载数
+	Blobs int `json:"blobs"`
+	// References 引用去重负载的数据条数
+	References int `json:"references"`
+	// Bytes 去重后负载占用的字节数
+	Bytes int64 `json:"bytes"`
+	// SavedBytes 与每条数据各保存一份相比节省的字节数
+	SavedBytes int64 `json:"saved_bytes"`
+}
+
+// blob 按内容去重的负载及其引用计数
+type blob struct {
+	hash uint64
+	data []byte
+	refs int
+}
+
+// blobStore 内容寻址的负载存储，相同内容的负载只保存一份
+//
+// 按内容哈希查找，哈希相同时比较内容；释放时按底层数组地址查找，不需要重新计算哈希。
+// 调用方负责加锁。
+type blobStore struct {
+	seed    maphash.Seed
+	minSize int
+	byHash  map[uint64][]*blob
+	byData  map[*byte]*blob
+	stats   PayloadStats
+}
+
+// newBlobStore 创建负载存储，小于minSize字节的负载不去重
+func newBlobStore(minSize int) *blobStore {
+	return &blobStore{
+		seed:    maphash.MakeSeed(),
+		minSize: max(minSize, 1),
+		byHash:  make(map[uint64][]*blob),
+		byData:  make(map[*byte]*blob),
+	}
+}
+
+// intern 返回与p内容相同的共享负载并增加引用
+func (s *blobStore) intern(p []byte) []byte {
+	if len(p) < s.minSize {
+		return p
+	}
+	if b, ok := s.byData[unsafe.SliceData(p)]; ok && len(b.data) == len(p) {
+		// 已经是共享负载，如删除数据后重建缓冲区时
+		s.ref(b)
+		return b.data
+	}
+
+	hash := maphash.Bytes(s.seed, p)
+	for _, b := range s.byHash[hash] {
+		if bytes.Equal(b.data, p) {
+			s.ref(b)
+			return b.data
+		}
+	}
+
+	b := &blob{hash: hash, data: p}
+	s.byHash[hash] = append(s.byHash[hash], b)
+	s.byData[unsafe.SliceData(p)] = b
+	s.stats.Blobs++
+	s.stats.Bytes += int64(len(p))
+	s.ref(b)
+	return p
+}
+
+// ref 增加一次引用
+func (s *blobStore) ref(b *blob) {
+	b.refs++
+	s.stats.References++
+	if b.refs > 1 {
+		s.stats.SavedBytes += int64(len(b.data))
+	}
+}
+
+// release 释放intern返回的负载的一次引用，没有引用时删除
+func (s *blobStore) release(p []byte) {
+	if len(p) < s.minSize {
+		return
+	}
+	b, ok := s.byData[unsafe.SliceData(p)]
+	if !ok {
+		return
+	}
+
+	b.refs--
+	s.stats.References--
+	if b.refs > 0 {
+		s.stats.SavedBytes -= int64(len(b.data))
+		return
+	}
+
+	delete(s.byData, unsafe.SliceData(b.data))
+	chain := s.byHash[b.hash]
+	for i := range chain {
+		if chain[i] == b {
+			chain = append(chain[:i], chain[i+1:]...)
+			break
+		}
+	}
+	if len(chain) == 0 {
+		delete(s.byHash, b.hash)
+	} else {
+		s.byHash[b.hash] = chain
+	}
+	s.stats.Blobs--
+	s.stats.Bytes -= int64(len(b.data))
+}
+
+// shared 判断负载是否由去重存储保存
+func (s *blobStore) shared(p []byte) bool {
+	if len(p) < s.minSize {
+		return false
+	}
+	_, ok := s.byData[unsafe.SliceData(p)]
+	return ok
+}
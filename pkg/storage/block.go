@@ -0,0 +1,1002 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/record"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/serialization"
+)
+
+// 块目录中的文件
+const (
+	blockDataFile  = "data"
+	blockIndexFile = "index.json"
+)
+
+// blockMaintenanceInterval 清理过期块、保存索引和关闭不再写入的块的间隔
+const blockMaintenanceInterval = time.Minute
+
+// blockIndex 块的索引，保存在块目录的index.json中
+//
+// Bytes是建立索引时数据文件的长度，启动时与实际长度不一致说明索引保存后又写入了数据，
+// 需要扫描数据文件重建索引。
+type blockIndex struct {
+	MinTime int64          `json:"min_time"`
+	MaxTime int64          `json:"max_time"`
+	Count   int            `json:"count"`
+	Bytes   int64          `json:"bytes"`
+	Agents  map[string]int `json:"agents"`
+	Types   map[string]int `json:"types"`
+	Names   map[string]int `json:"names"`
+}
+
+// add 把一条数据计入索引
+func (idx *blockIndex) add(m *processor.ProcessedMetric) {
+	ts := m.Timestamp.UnixNano()
+	if idx.Count == 0 || ts < idx.MinTime {
+		idx.MinTime = ts
+	}
+	if idx.Count == 0 || ts > idx.MaxTime {
+		idx.MaxTime = ts
+	}
+	idx.Count++
+	idx.Agents[m.AgentID]++
+	idx.Types[m.Type]++
+	idx.Names[m.Name]++
+}
+
+func newBlockIndex() blockIndex {
+	return blockIndex{
+		Agents: make(map[string]int),
+		Types:  make(map[string]int),
+		Names:  make(map[string]int),
+	}
+}
+
+// block 覆盖[start, start+duration)的数据块，数据文件由带校验和的记录组成，
+// 第一条记录是文件头，之后每条记录是一次写入的MetricSnapshot，按写入顺序追加
+type block struct {
+	start time.Time
+	end   time.Time
+	dir   string
+	index blockIndex
+	// format和codec 数据文件的序列化格式和压缩算法，由文件头决定，没有文件头的旧数据文件为不压缩的protobuf
+	format serialization.Format
+	codec  codec.Codec
+	// file 追加写入的文件，未写入或已关闭时为nil
+	file *os.File
+	// dirty 索引在保存后有变化
+	dirty bool
+	// records 数据文件中每条记录的位置，按写入顺序，用于从新到旧读取
+	records []recordRef
+}
+
+// recordRef 数据文件中一条记录的位置和长度(含记录头)
+type recordRef struct {
+	offset int64
+	size   int64
+}
+
+// overlaps 判断块中的数据是否可能落在[start, end]内，零值表示不限制
+func (b *block) overlaps(start, end time.Time) bool {
+	if b.index.Count == 0 {
+		return false
+	}
+	if !start.IsZero() && b.index.MaxTime < start.UnixNano() {
+		return false
+	}
+	if !end.IsZero() && b.index.MinTime > end.UnixNano() {
+		return false
+	}
+	return true
+}
+
+// mayMatch 按索引判断块中是否可能有满足过滤条件的数据
+func (b *block) mayMatch(filter Filter) bool {
+	if filter.AgentID != "" && b.index.Agents[filter.AgentID] == 0 {
+		return false
+	}
+	if filter.Type != "" && b.index.Types[filter.Type] == 0 {
+		return false
+	}
+	if filter.Name != nil && !b.hasName(filter.Name) {
+		return false
+	}
+	return b.overlaps(filter.Start, filter.End)
+}
+
+// hasName 按索引判断块中是否有满足指标名条件的数据
+func (b *block) hasName(m *NameMatcher) bool {
+	if m.Literal() {
+		return b.index.Names[m.Prefix()] > 0
+	}
+	for name := range b.index.Names {
+		if m.Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockStorage 按时间分块保存到磁盘的存储，类似TSDB的块
+//
+// 数据按时间戳写入对应时间段的块，每个块是file_path/blocks下的一个目录，包含数据文件和小的索引，
+// 查询时按索引跳过不相关的块。超过expire_time的块整体删除，超出max_size时删除最旧的块，
+// 因此数据最多会比expire_time多保留一个块的时长，max_size也按块粒度生效。
+// 查询结果按块从新到旧、块内按写入顺序从新到旧。
+type BlockStorage struct {
+	mu         sync.RWMutex
+	dir        string
+	duration   time.Duration
+	sync       bool
+	maxSize    int
+	expireTime time.Duration
+	clock      clock.Clock
+	// format和codec 新数据文件的序列化格式和压缩算法
+	format serialization.Format
+	codec  codec.Codec
+	// blocks 按起始时间升序
+	blocks    []*block
+	stop      chan struct{}
+	closeOnce sync.Once
+	evictions EvictionTracker
+	expiry    ExpiryHooks
+}
+
+// newBlockStorage 打开file_path/blocks下的块，索引缺失或过期的块扫描数据文件重建索引
+func newBlockStorage(cfg config.StorageConfig, clk clock.Clock) (Storage, error) {
+	if cfg.Block.Duration <= 0 {
+		return nil, fmt.Errorf("storage.block.duration must be positive")
+	}
+
+	format, err := serialization.Get(cfg.Serialization)
+	if err != nil {
+		return nil, err
+	}
+	c, err := codec.Get(cfg.Block.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(cfg.FilePath, "blocks")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create block directory: %w", err)
+	}
+
+	s := &BlockStorage{
+		dir:        dir,
+		duration:   cfg.Block.Duration,
+		sync:       cfg.Block.Sync,
+		maxSize:    cfg.MaxSize,
+		expireTime: cfg.ExpireTime,
+		clock:      clk,
+		format:     format,
+		codec:      c,
+		stop:       make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	// 启动时可能有已过期的块
+	s.CleanExpired()
+	go s.startMaintenanceTimer()
+
+	return s, nil
+}
+
+// load 加载目录中的块，目录名为块起始时间的Unix毫秒数
+func (s *BlockStorage) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read block directory: %w", err)
+	}
+
+	total := 0
+	for _, entry := range entries {
+		ms, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		start := time.UnixMilli(ms)
+		b := &block{start: start, end: start.Add(s.duration), dir: filepath.Join(s.dir, entry.Name())}
+		if err := s.loadIndex(b); err != nil {
+			return fmt.Errorf("failed to load block %s: %w", b.dir, err)
+		}
+		if b.index.Count == 0 {
+			os.RemoveAll(b.dir)
+			continue
+		}
+		if err := b.loadRecords(); err != nil {
+			return fmt.Errorf("failed to load block %s: %w", b.dir, err)
+		}
+		s.blocks = append(s.blocks, b)
+		total += b.index.Count
+	}
+	slices.SortFunc(s.blocks, func(a, b *block) int { return a.start.Compare(b.start) })
+
+	if len(s.blocks) > 0 {
+		log.Printf("Loaded %d blocks with %d metrics from %s", len(s.blocks), total, s.dir)
+	}
+	return nil
+}
+
+// loadIndex 读取块的索引，索引与数据文件不一致时重建
+func (s *BlockStorage) loadIndex(b *block) error {
+	info, err := os.Stat(filepath.Join(b.dir, blockDataFile))
+	if os.IsNotExist(err) {
+		b.index = newBlockIndex()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(b.dir, blockIndexFile))
+	if err == nil {
+		idx := newBlockIndex()
+		if json.Unmarshal(data, &idx) == nil && idx.Bytes == info.Size() {
+			b.index = idx
+			return nil
+		}
+	}
+	return s.rebuildIndex(b, info.Size())
+}
+
+// rebuildIndex 扫描数据文件重建索引，截断末尾写入不完整的记录以便继续追加
+func (s *BlockStorage) rebuildIndex(b *block, size int64) error {
+	path := filepath.Join(b.dir, blockDataFile)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	idx := newBlockIndex()
+	reader := record.NewReader(file)
+	err = readRecords(reader, func(metrics []processor.ProcessedMetric) {
+		for i := range metrics {
+			idx.add(&metrics[i])
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.Bytes = size
+	corruptions := reader.Corruptions()
+	for _, c := range corruptions {
+		log.Printf("Block %s: skipped %v", b.dir, c)
+	}
+	if n := len(corruptions); n > 0 {
+		last := corruptions[n-1]
+		if last.Offset+last.Length == size && last.Reason != "checksum mismatch" {
+			if err := os.Truncate(path, last.Offset); err != nil {
+				return err
+			}
+			idx.Bytes = last.Offset
+		}
+	}
+
+	b.index = idx
+	b.dirty = true
+	log.Printf("Rebuilt index of block %s (%d metrics)", b.dir, idx.Count)
+	return nil
+}
+
+// SaveMetrics 按时间戳把数据追加到对应的块
+func (s *BlockStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 保持每个块内的写入顺序
+	var order []time.Time
+	groups := make(map[time.Time][]processor.ProcessedMetric)
+	for i := range metrics {
+		start := metrics[i].Timestamp.Truncate(s.duration)
+		if _, ok := groups[start]; !ok {
+			order = append(order, start)
+		}
+		groups[start] = append(groups[start], metrics[i])
+	}
+
+	for _, start := range order {
+		if err := s.append(s.blockAt(start), groups[start]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockAt 返回从start开始的块，不存在时创建，调用方需持有写锁
+func (s *BlockStorage) blockAt(start time.Time) *block {
+	i, found := slices.BinarySearchFunc(s.blocks, start, func(b *block, t time.Time) int { return b.start.Compare(t) })
+	if found {
+		return s.blocks[i]
+	}
+
+	b := &block{
+		start:  start,
+		end:    start.Add(s.duration),
+		dir:    filepath.Join(s.dir, strconv.FormatInt(start.UnixMilli(), 10)),
+		index:  newBlockIndex(),
+		format: s.format,
+		codec:  s.codec,
+	}
+	s.blocks = slices.Insert(s.blocks, i, b)
+	return b
+}
+
+// append 把一组数据作为一条记录追加到块的数据文件，调用方需持有写锁
+func (s *BlockStorage) append(b *block, metrics []processor.ProcessedMetric) error {
+	if b.file == nil {
+		if err := os.MkdirAll(b.dir, 0o755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(b.dir, blockDataFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		b.file = file
+	}
+
+	chunk := &protocol.MetricSnapshot{Metrics: make([]*protocol.StoredMetric, len(metrics))}
+	for i := range metrics {
+		chunk.Metrics[i] = serialization.ToStored(&metrics[i])
+	}
+	data, err := encodeRecord(b.format, b.codec, chunk)
+	if err != nil {
+		return err
+	}
+
+	// 一次写入整条记录，读取时不会看到写了一半的记录，新数据文件先写文件头
+	var buf bytes.Buffer
+	writer := record.NewWriter(&buf)
+	if b.index.Bytes == 0 {
+		if err := writer.Write(newHeader(b.format, b.codec).Marshal()); err != nil {
+			return err
+		}
+	}
+	offset := b.index.Bytes + int64(buf.Len())
+	if err := writer.Write(data); err != nil {
+		return err
+	}
+	if _, err := b.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if s.sync {
+		if err := b.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	for i := range metrics {
+		b.index.add(&metrics[i])
+	}
+	b.records = append(b.records, recordRef{offset: offset, size: b.index.Bytes + int64(buf.Len()) - offset})
+	b.index.Bytes += int64(buf.Len())
+	b.dirty = true
+	return nil
+}
+
+// GetMetricsByAgentID 按Agent ID获取监控数据
+func (s *BlockStorage) GetMetricsByAgentID(agentID string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newest(limit, Filter{AgentID: agentID}, nil)
+}
+
+// GetMetricsByType 按指标类型获取监控数据
+func (s *BlockStorage) GetMetricsByType(metricType string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newest(limit, Filter{Type: metricType}, nil)
+}
+
+// GetLatestMetrics 获取最新的limit条数据，按从旧到新的顺序
+func (s *BlockStorage) GetLatestMetrics(limit int) ([]processor.ProcessedMetric, error) {
+	result, err := s.newest(limit, Filter{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(result)
+	return result, nil
+}
+
+// GetMetricsByTimeRange 按时间范围获取监控数据
+func (s *BlockStorage) GetMetricsByTimeRange(start, end time.Time, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newest(limit, Filter{Start: start, End: end}, nil)
+}
+
+// GetMetricsByLabels 获取满足全部标签匹配条件的数据
+func (s *BlockStorage) GetMetricsByLabels(matchers []*LabelMatcher, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newest(limit, Filter{}, func(m *processor.ProcessedMetric) bool {
+		return MatchLabels(m, matchers)
+	})
+}
+
+// QuerySorted 按条件过滤全部数据后排序，返回前limit条
+func (s *BlockStorage) QuerySorted(filter Filter, opts SortOptions, limit int) ([]processor.ProcessedMetric, error) {
+	s.mu.RLock()
+	result := make([]processor.ProcessedMetric, 0)
+	for _, b := range s.blocks {
+		if !b.mayMatch(filter) {
+			continue
+		}
+		metrics, err := readBlock(b)
+		if err != nil {
+			s.mu.RUnlock()
+			return nil, err
+		}
+		for i := range metrics {
+			if filter.Match(&metrics[i]) {
+				result = append(result, metrics[i])
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	SortMetrics(result, opts)
+	if limit >= 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// Aggregate 按从start开始、宽度为step的窗口聚合指标，只读取时间范围内且包含该指标的块
+func (s *BlockStorage) Aggregate(q AggregateQuery) ([]AggregatePoint, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	filter := Filter{AgentID: q.AgentID, Start: q.Start, End: q.End}
+	w := NewWindowAggregator(q)
+	for _, b := range s.blocks {
+		if b.index.Names[q.Name] == 0 || !b.mayMatch(filter) {
+			continue
+		}
+		metrics, err := readBlock(b)
+		if err != nil {
+			s.mu.RUnlock()
+			return nil, err
+		}
+		for i := range metrics {
+			w.Add(&metrics[i])
+		}
+	}
+	s.mu.RUnlock()
+
+	return w.Points(), nil
+}
+
+// DeleteMetricsByAgentID 删除Agent的全部数据
+func (s *BlockStorage) DeleteMetricsByAgentID(agentID string) (int, error) {
+	return s.deleteMatching(Filter{AgentID: agentID})
+}
+
+// DeleteMetricsByType 删除指定类型的全部数据
+func (s *BlockStorage) DeleteMetricsByType(metricType string) (int, error) {
+	return s.deleteMatching(Filter{Type: metricType})
+}
+
+// DeleteMetricsByTimeRange 删除时间戳在[start, end]内的数据，完全落在范围内的块整体删除
+func (s *BlockStorage) DeleteMetricsByTimeRange(start, end time.Time) (int, error) {
+	return s.deleteMatching(Filter{Start: start, End: end})
+}
+
+// deleteMatching 删除满足过滤条件的数据，部分匹配的块重写数据文件
+func (s *BlockStorage) deleteMatching(filter Filter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	kept := s.blocks[:0]
+	var firstErr error
+	for _, b := range s.blocks {
+		if firstErr != nil || !b.mayMatch(filter) {
+			kept = append(kept, b)
+			continue
+		}
+
+		// 块中的数据全部匹配时不需要读取数据文件
+		whole := (filter.AgentID == "" || b.index.Agents[filter.AgentID] == b.index.Count) &&
+			(filter.Type == "" || b.index.Types[filter.Type] == b.index.Count) &&
+			(filter.Start.IsZero() || b.index.MinTime >= filter.Start.UnixNano()) &&
+			(filter.End.IsZero() || b.index.MaxTime <= filter.End.UnixNano())
+		if whole {
+			deleted += b.index.Count
+			b.remove()
+			continue
+		}
+
+		n, err := s.rewrite(b, func(m *processor.ProcessedMetric) bool { return !filter.Match(m) })
+		if err != nil {
+			firstErr = err
+		}
+		deleted += n
+		if b.index.Count == 0 {
+			b.remove()
+			continue
+		}
+		kept = append(kept, b)
+	}
+	clear(s.blocks[len(kept):])
+	s.blocks = kept
+	return deleted, firstErr
+}
+
+// rewrite 只保留keep返回true的数据重写块的数据文件，返回删除的条数，调用方需持有写锁
+func (s *BlockStorage) rewrite(b *block, keep func(*processor.ProcessedMetric) bool) (int, error) {
+	metrics, err := readBlock(b)
+	if err != nil {
+		return 0, err
+	}
+	retained := slices.DeleteFunc(metrics, func(m processor.ProcessedMetric) bool { return !keep(&m) })
+	removed := b.index.Count - len(retained)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+
+	// 先写临时文件再重命名，失败时保留原数据文件
+	path := filepath.Join(b.dir, blockDataFile)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	idx := newBlockIndex()
+	buf := bufio.NewWriter(file)
+	writer := record.NewWriter(buf)
+	// 重写的数据文件使用当前配置的格式和压缩算法
+	if err := writer.Write(newHeader(s.format, s.codec).Marshal()); err != nil {
+		file.Close()
+		return 0, err
+	}
+	for i := 0; i < len(retained); i += snapshotChunk {
+		chunk := &protocol.MetricSnapshot{}
+		for j := i; j < len(retained) && j < i+snapshotChunk; j++ {
+			chunk.Metrics = append(chunk.Metrics, serialization.ToStored(&retained[j]))
+			idx.add(&retained[j])
+		}
+		data, err := encodeRecord(s.format, s.codec, chunk)
+		if err == nil {
+			err = writer.Write(data)
+		}
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+	if err := buf.Flush(); err == nil {
+		err = file.Sync()
+	}
+	info, statErr := file.Stat()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+
+	idx.Bytes = info.Size()
+	b.index = idx
+	b.dirty = true
+	if err := b.loadRecords(); err != nil {
+		return removed, err
+	}
+	return removed, b.saveIndex()
+}
+
+// Stats 按块索引汇总数据条数和时间范围，磁盘占用为所有块文件的大小
+func (s *BlockStorage) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{
+		Capacity: s.maxSize,
+		ByAgent:  make(map[string]int),
+		ByType:   make(map[string]int),
+	}
+	for _, b := range s.blocks {
+		if b.index.Count == 0 {
+			continue
+		}
+		oldest, newest := time.Unix(0, b.index.MinTime), time.Unix(0, b.index.MaxTime)
+		stats.add(Stats{
+			Total:     b.index.Count,
+			ByAgent:   b.index.Agents,
+			ByType:    b.index.Types,
+			Oldest:    &oldest,
+			Newest:    &newest,
+			DiskBytes: b.diskBytes(),
+		})
+	}
+	return stats, nil
+}
+
+// CleanExpired 整体删除最晚数据已过期的块，总数超出MaxSize时再删除最旧的块
+func (s *BlockStorage) CleanExpired() int {
+	now := s.clock.Now()
+	expiredTime := now.Add(-s.expireTime).UnixNano()
+
+	s.mu.Lock()
+	var expired, evicted []*block
+	total := 0
+	for _, b := range s.blocks {
+		total += b.index.Count
+	}
+loop:
+	for len(s.blocks) > 0 {
+		b := s.blocks[0]
+		switch {
+		case b.index.Count == 0 || b.index.MaxTime <= expiredTime:
+			expired = append(expired, b)
+		case s.maxSize > 0 && total > s.maxSize && len(s.blocks) > 1:
+			// 至少保留最新的块
+			evicted = append(evicted, b)
+			s.evictions.Add(b.index.Count, time.Unix(0, b.index.MinTime), time.Unix(0, b.index.MaxTime), mapKeys(b.index.Agents)...)
+		default:
+			break loop
+		}
+		total -= b.index.Count
+		if b.file != nil {
+			b.file.Close()
+			b.file = nil
+		}
+		s.blocks[0] = nil
+		s.blocks = s.blocks[1:]
+	}
+
+	var retainedSince time.Time
+	if len(s.blocks) > 0 {
+		retainedSince = time.Unix(0, s.blocks[0].index.MinTime)
+	}
+	s.mu.Unlock()
+
+	// 已从列表中移除的块不会再被访问，读取和删除不需要持有锁
+	removed, count := 0, 0
+	for _, b := range expired {
+		count += b.index.Count
+		if b.index.Count > 0 && s.expiry.Enabled() {
+			metrics, err := readBlock(b)
+			if err != nil {
+				log.Printf("Failed to read expired block %s: %v", b.dir, err)
+			}
+			s.expiry.Notify(metrics)
+		}
+		b.remove()
+	}
+	if len(expired) > 0 {
+		log.Printf("Deleted %d expired blocks with %d metrics", len(expired), count)
+	}
+
+	removed, count = count, 0
+	for _, b := range evicted {
+		count += b.index.Count
+		b.remove()
+	}
+	if len(evicted) > 0 {
+		log.Printf("Deleted %d blocks with %d metrics over max size %d", len(evicted), count, s.maxSize)
+		s.evictions.Flush(now, retainedSince, s.expireTime, true)
+	}
+	return removed + count
+}
+
+// OnEviction 注册因超出maxSize删除未过期的块时的事件回调
+func (s *BlockStorage) OnEviction(hook func(EvictionEvent)) {
+	s.evictions.OnEviction(hook)
+}
+
+// OnExpire 注册删除过期块前的回调
+func (s *BlockStorage) OnExpire(hook func([]processor.ProcessedMetric)) {
+	s.expiry.OnExpire(hook)
+}
+
+// Close 停止定时维护，保存索引并关闭数据文件
+func (s *BlockStorage) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var errs []error
+		for _, b := range s.blocks {
+			errs = append(errs, b.close(), b.saveIndex())
+		}
+		err = errors.Join(errs...)
+	})
+	return err
+}
+
+// startMaintenanceTimer 定时清理过期块、保存索引并关闭不再写入的块
+func (s *BlockStorage) startMaintenanceTimer() {
+	ticker := s.clock.NewTicker(blockMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.CleanExpired()
+			s.flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// flush 保存有变化的索引，关闭结束超过一个块时长的块的数据文件
+func (s *BlockStorage) flush() {
+	inactive := s.clock.Now().Add(-s.duration)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.blocks {
+		if b.end.Before(inactive) {
+			if err := b.close(); err != nil {
+				log.Printf("Failed to close block %s: %v", b.dir, err)
+			}
+		}
+		if err := b.saveIndex(); err != nil {
+			log.Printf("Failed to save index of block %s: %v", b.dir, err)
+		}
+	}
+}
+
+// newest 按块从新到旧、块内按写入顺序从新到旧返回满足条件的前limit条数据，
+// 按索引跳过不满足filter的块，match为nil时按filter匹配
+func (s *BlockStorage) newest(limit int, filter Filter, match func(*processor.ProcessedMetric) bool) ([]processor.ProcessedMetric, error) {
+	if match == nil {
+		match = filter.Match
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]processor.ProcessedMetric, 0)
+	for i := len(s.blocks) - 1; i >= 0 && len(result) < limit; i-- {
+		b := s.blocks[i]
+		if !b.mayMatch(filter) {
+			continue
+		}
+		err := b.readNewest(func(m *processor.ProcessedMetric) bool {
+			if match(m) {
+				result = append(result, *m)
+			}
+			return len(result) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// close 关闭追加写入的数据文件
+func (b *block) close() error {
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// saveIndex 先写临时文件再重命名保存有变化的索引
+func (b *block) saveIndex() error {
+	if !b.dirty || b.index.Count == 0 {
+		return nil
+	}
+	data, err := json.Marshal(&b.index)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.dir, blockIndexFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// remove 关闭并删除整个块目录
+func (b *block) remove() {
+	b.close()
+	if err := os.RemoveAll(b.dir); err != nil {
+		log.Printf("Failed to delete block %s: %v", b.dir, err)
+	}
+}
+
+// diskBytes 返回块目录中文件的总大小
+func (b *block) diskBytes() int64 {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// loadRecords 只读取记录头，找到数据文件中索引覆盖部分的每条记录，并按文件头确定数据文件的格式和压缩算法
+func (b *block) loadRecords() error {
+	file, err := os.Open(filepath.Join(b.dir, blockDataFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	b.records = b.records[:0]
+	b.format, _ = serialization.Get(serialization.Protobuf)
+	b.codec, _ = codec.Get(codec.None)
+	var header [8]byte
+	for offset := int64(0); offset < b.index.Bytes; {
+		if _, err := file.ReadAt(header[:], offset); err != nil {
+			return err
+		}
+		size := 8 + int64(binary.BigEndian.Uint32(header[:4]))
+		if size > record.MaxRecordSize || offset+size > b.index.Bytes {
+			// 与record.Reader一致，记录头损坏时无法定位之后的记录
+			break
+		}
+		if offset == 0 {
+			data := make([]byte, size-8)
+			if _, err := file.ReadAt(data, 8); err != nil {
+				return err
+			}
+			h, ok, err := serialization.ParseHeader(data)
+			if err == nil && ok {
+				b.format, b.codec, err = parseHeader(h)
+			}
+			if err != nil {
+				return err
+			}
+			if ok {
+				offset += size
+				continue
+			}
+		}
+		b.records = append(b.records, recordRef{offset: offset, size: size})
+		offset += size
+	}
+	return nil
+}
+
+// readNewest 从最新的记录开始按写入顺序从新到旧读取数据，fn返回false时停止，校验失败的记录被跳过
+func (b *block) readNewest(fn func(*processor.ProcessedMetric) bool) error {
+	file, err := os.Open(filepath.Join(b.dir, blockDataFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i := len(b.records) - 1; i >= 0; i-- {
+		ref := b.records[i]
+		buf := make([]byte, ref.size)
+		if _, err := file.ReadAt(buf, ref.offset); err != nil {
+			return err
+		}
+		data, err := record.NewReader(bytes.NewReader(buf)).Next()
+		if err == io.EOF {
+			// 校验失败
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		metrics, _ := decodeRecord(b.format, b.codec, data)
+		for j := len(metrics) - 1; j >= 0; j-- {
+			if !fn(&metrics[j]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// readBlock 按写入顺序读取块中的全部数据，只读取索引覆盖的部分
+func readBlock(b *block) ([]processor.ProcessedMetric, error) {
+	file, err := os.Open(filepath.Join(b.dir, blockDataFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	metrics := make([]processor.ProcessedMetric, 0, b.index.Count)
+	reader := record.NewReader(io.LimitReader(file, b.index.Bytes))
+	err = readRecords(reader, func(chunk []processor.ProcessedMetric) {
+		metrics = append(metrics, chunk...)
+	})
+	return metrics, err
+}
+
+// readRecords 从数据文件开头逐条解码记录，格式和压缩算法由文件头决定，无法解码的记录被跳过
+func readRecords(reader *record.Reader, fn func([]processor.ProcessedMetric)) error {
+	format, _ := serialization.Get(serialization.Protobuf)
+	c, _ := codec.Get(codec.None)
+	first := true
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if first {
+			first = false
+			h, ok, err := serialization.ParseHeader(data)
+			if err == nil && ok {
+				format, c, err = parseHeader(h)
+			}
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		}
+
+		if metrics, err := decodeRecord(format, c, data); err == nil {
+			fn(metrics)
+		}
+	}
+}
+
+// decodeRecord 解压并按format解码一条数据记录
+func decodeRecord(format serialization.Format, c codec.Codec, data []byte) ([]processor.ProcessedMetric, error) {
+	chunk, err := decodeSnapshot(format, c, data)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]processor.ProcessedMetric, len(chunk.Metrics))
+	for i, stored := range chunk.Metrics {
+		metrics[i] = serialization.FromStored(stored)
+	}
+	return metrics, nil
+}
+
+// mapKeys 返回map的键
+func mapKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// Compactor 支持删除重复数据的存储实现此接口
+type Compactor interface {
+	// Compact 删除Agent ID、指标名、标签和时间戳都相同的重复数据，保留最后写入的一条，
+	// 返回删除的条数。mergeConflicts为false时只删除值也相同的数据(Agent重试发送)，
+	// 为true时值不同的数据也合并为最后写入的一条。
+	Compact(mergeConflicts bool) (int, error)
+}
+
+// RunCompaction 按间隔压缩存储，直到stop关闭
+func RunCompaction(c Compactor, interval time.Duration, mergeConflicts bool, clk clock.Clock, stop <-chan struct{}) {
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			n, err := c.Compact(mergeConflicts)
+			if err != nil {
+				log.Printf("Failed to compact storage: %v", err)
+			} else if n > 0 {
+				log.Printf("Compaction removed %d duplicate metrics", n)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Compact 删除重复数据并重建环形缓冲区和索引
+func (s *MemoryStorage) Compact(mergeConflicts bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 从新到旧遍历，每个键只保留第一次遇到的数据
+	seen := make(map[string]struct{}, s.count)
+	keep := make([]bool, s.count)
+	removed := 0
+	for i := s.count - 1; i >= 0; i-- {
+		key := duplicateKey(s.at(i), !mergeConflicts)
+		if _, dup := seen[key]; dup {
+			removed++
+			continue
+		}
+		seen[key] = struct{}{}
+		keep[i] = true
+	}
+	if removed > 0 {
+		s.rebuild(keep, s.count-removed)
+	}
+	return removed, nil
+}
+
+// duplicateKey 由Agent ID、指标名、排序后的标签和时间戳组成的键，withValue为true时包含值
+func duplicateKey(m *processor.ProcessedMetric, withValue bool) string {
+	var b strings.Builder
+	b.WriteString(m.AgentID)
+	b.WriteByte(0)
+	b.WriteString(m.Name)
+	b.WriteByte(0)
+	b.WriteString(strconv.FormatInt(m.Timestamp.UnixNano(), 10))
+
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(m.Labels[k])
+	}
+
+	if withValue {
+		b.WriteByte(0)
+		b.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EvictionReasonMaxSize 因超出max_size删除未过期数据
+const EvictionReasonMaxSize = "max_size"
+
+// maxEventAgents 事件中列出的Agent数上限
+const maxEventAgents = 100
+
+// evictionEventInterval 同一存储两次淘汰事件的最小间隔，期间的淘汰合并到下一个事件
+const evictionEventInterval = time.Minute
+
+// EvictionEvent 未到过期时间的数据因存储容量不足被删除的事件
+//
+// EffectiveRetention小于ConfiguredRetention说明max_size使实际保留时长短于expire_time。
+type EvictionEvent struct {
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+	// From/To 被删除数据的时间范围
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Agents 被删除数据所属的Agent，最多列出maxEventAgents个
+	Agents     []string `json:"agents"`
+	AgentCount int      `json:"agent_count"`
+	// RetainedSince 删除后仍保留的最早数据时间
+	RetainedSince       time.Time `json:"retained_since"`
+	EffectiveRetention  string    `json:"effective_retention"`
+	ConfiguredRetention string    `json:"configured_retention"`
+	// Namespace 启用命名空间时被删除数据所在的命名空间
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// EvictionNotifier 会因容量不足删除数据的存储实现此接口
+type EvictionNotifier interface {
+	// OnEviction 注册淘汰事件回调，需在写入数据前注册
+	OnEviction(func(EvictionEvent))
+}
+
+// EvictionTracker 合并一段时间内的淘汰并按间隔生成事件，供存储实现嵌入
+type EvictionTracker struct {
+	mu       sync.Mutex
+	hooks    []func(EvictionEvent)
+	count    int
+	from     time.Time
+	to       time.Time
+	agents   map[string]struct{}
+	lastSent time.Time
+}
+
+// OnEviction 注册淘汰事件回调
+func (t *EvictionTracker) OnEviction(hook func(EvictionEvent)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hooks = append(t.hooks, hook)
+}
+
+// Add 记录被淘汰的count条数据，时间范围为[from, to]
+func (t *EvictionTracker) Add(count int, from, to time.Time, agents ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.hooks) == 0 || count <= 0 {
+		return
+	}
+	if t.count == 0 || from.Before(t.from) {
+		t.from = from
+	}
+	if t.count == 0 || to.After(t.to) {
+		t.to = to
+	}
+	t.count += count
+	if t.agents == nil {
+		t.agents = make(map[string]struct{})
+	}
+	for _, agentID := range agents {
+		t.agents[agentID] = struct{}{}
+	}
+}
+
+// Flush 距上次事件超过间隔或force时生成事件并调用回调，不能在持有存储锁时调用
+func (t *EvictionTracker) Flush(now, retainedSince time.Time, configured time.Duration, force bool) {
+	t.mu.Lock()
+	if t.count == 0 || (!force && now.Sub(t.lastSent) < evictionEventInterval) {
+		t.mu.Unlock()
+		return
+	}
+
+	agents := make([]string, 0, len(t.agents))
+	for agentID := range t.agents {
+		agents = append(agents, agentID)
+	}
+	sort.Strings(agents)
+	event := EvictionEvent{
+		Reason:              EvictionReasonMaxSize,
+		Time:                now,
+		Count:               t.count,
+		From:                t.from,
+		To:                  t.to,
+		AgentCount:          len(agents),
+		RetainedSince:       retainedSince,
+		EffectiveRetention:  now.Sub(retainedSince).Round(time.Second).String(),
+		ConfiguredRetention: configured.String(),
+	}
+	if len(agents) > maxEventAgents {
+		agents = agents[:maxEventAgents]
+	}
+	event.Agents = agents
+
+	t.count = 0
+	t.agents = nil
+	t.lastSent = now
+	hooks := t.hooks
+	t.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(event)
+	}
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"sync"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// ExpiryNotifier 按expire_time清理数据的存储实现此接口
+type ExpiryNotifier interface {
+	// OnExpire 注册回调，CleanExpired删除过期数据前用将被删除的数据调用，需在写入数据前注册
+	OnExpire(func([]processor.ProcessedMetric))
+}
+
+// ExpiryHooks 过期数据回调，供存储实现嵌入
+type ExpiryHooks struct {
+	mu    sync.Mutex
+	hooks []func([]processor.ProcessedMetric)
+}
+
+// OnExpire 注册过期数据回调
+func (h *ExpiryHooks) OnExpire(hook func([]processor.ProcessedMetric)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, hook)
+}
+
+// Enabled 是否注册了回调，没有回调时存储不需要在删除前取出过期数据
+func (h *ExpiryHooks) Enabled() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.hooks) > 0
+}
+
+// Notify 用过期数据调用回调，不能在持有存储锁时调用
+func (h *ExpiryHooks) Notify(metrics []processor.ProcessedMetric) {
+	if len(metrics) == 0 {
+		return
+	}
+	h.mu.Lock()
+	hooks := h.hooks
+	h.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(metrics)
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+)
+
+// Factory 根据存储配置创建存储后端
+type Factory func(cfg config.StorageConfig, clk clock.Clock) (Storage, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+func init() {
+	Register("memory", func(cfg config.StorageConfig, clk clock.Clock) (Storage, error) {
+		mem := NewMemoryStorageWithClock(cfg.MaxSize, cfg.ExpireTime, clk).(*MemoryStorage)
+		if cfg.PayloadDedup.Enabled {
+			mem.EnablePayloadDedup(cfg.PayloadDedup.MinSize)
+		}
+		switch {
+		case cfg.WAL.Enabled:
+			if cfg.Snapshot.Enabled {
+				log.Printf("Storage snapshot is ignored because the wal is enabled")
+			}
+			return newWALMemoryStorage(mem, cfg, clk)
+		case cfg.Snapshot.Enabled:
+			return newSnapshotMemoryStorage(mem, cfg, clk)
+		}
+		return mem, nil
+	})
+	Register("tiered", newTieredStorage)
+	Register("block", newBlockStorage)
+}
+
+// Register 注册存储后端，name对应配置中的storage.type，重复注册会panic
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("storage: Register called twice for backend " + name)
+	}
+	factories[name] = factory
+}
+
+// Backends 返回已注册的存储后端名称
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStorage 按cfg.Type创建已注册的存储后端
+func NewStorage(cfg config.StorageConfig) (Storage, error) {
+	return NewStorageWithClock(cfg, clock.Real())
+}
+
+// NewStorageWithClock 按cfg.Type创建使用指定时钟的存储后端
+func NewStorageWithClock(cfg config.StorageConfig, clk clock.Clock) (Storage, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[cfg.Type]
+	factoriesMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q (available: %s)", cfg.Type, strings.Join(Backends(), ", "))
+	}
+	if cfg.Shards.Count > 1 {
+		factory = shardedFactory(factory)
+	}
+	if len(cfg.Namespaces) > 0 {
+		return newNamespacedStorage(cfg, clk, factory)
+	}
+	return factory(cfg, clk)
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// ErrFreezeTooLarge 存储的数据超过冻结副本的条数上限
+var ErrFreezeTooLarge = errors.New("too many metrics to freeze")
+
+// Freeze 把src当前的全部数据复制到一个不会过期的内存存储，用于多次查询看到同一时刻的数据
+//
+// 内存存储在读锁下直接复制环形缓冲区，保持写入顺序；其他后端按时间范围读出全部数据，
+// 按时间戳从旧到新写入副本。数据超过maxMetrics条时返回ErrFreezeTooLarge。
+// 副本的负载与src共享，调用方用完后应调用Close。
+func Freeze(src Storage, maxMetrics int) (Storage, error) {
+	if m, ok := src.(*MemoryStorage); ok {
+		return m.freeze(maxMetrics)
+	}
+
+	stats, err := src.Stats()
+	if err != nil {
+		return nil, err
+	}
+	if stats.Total > maxMetrics {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFreezeTooLarge, stats.Total, maxMetrics)
+	}
+	// 统计之后可能有新写入的数据，多读一条用于判断是否超过上限
+	metrics, err := src.GetMetricsByTimeRange(time.Time{}, time.Unix(math.MaxInt32, 0), maxMetrics+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) > maxMetrics {
+		return nil, fmt.Errorf("%w: more than %d", ErrFreezeTooLarge, maxMetrics)
+	}
+
+	frozen := newFrozenStorage(len(metrics))
+	for i := len(metrics) - 1; i >= 0; i-- {
+		frozen.push(&metrics[i])
+	}
+	return frozen, nil
+}
+
+// freeze 在读锁下按写入顺序复制全部数据
+func (s *MemoryStorage) freeze(maxMetrics int) (Storage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.count > maxMetrics {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFreezeTooLarge, s.count, maxMetrics)
+	}
+	frozen := newFrozenStorage(s.count)
+	for i := 0; i < s.count; i++ {
+		frozen.push(s.at(i))
+	}
+	return frozen, nil
+}
+
+// newFrozenStorage 创建容量为size、不启动定时清理的内存存储，只由Freeze写入
+func newFrozenStorage(size int) *MemoryStorage {
+	return &MemoryStorage{
+		buf:     make([]processor.ProcessedMetric, size),
+		byAgent: make(map[string]*seqQueue),
+		byType:  make(map[string]*seqQueue),
+		clock:   clock.Real(),
+		stop:    make(chan struct{}),
+	}
+}
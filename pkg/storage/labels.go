@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// 标签匹配方式
+const (
+	MatchEqual     = "="
+	MatchNotEqual  = "!="
+	MatchRegexp    = "=~"
+	MatchNotRegexp = "!~"
+)
+
+// MetricNameLabel 匹配指标名而不是标签的名称
+const MetricNameLabel = "__name__"
+
+// labelNamePattern 合法的标签名
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LabelMatcher 标签匹配条件，不存在的标签按空字符串匹配
+type LabelMatcher struct {
+	Name  string
+	Type  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewLabelMatcher 创建标签匹配条件，正则表达式需匹配整个标签值
+func NewLabelMatcher(name, matchType, value string) (*LabelMatcher, error) {
+	if !labelNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid label name %q", name)
+	}
+
+	m := &LabelMatcher{Name: name, Type: matchType, Value: value}
+	switch matchType {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp for label %s: %w", name, err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("invalid match type %q", matchType)
+	}
+	return m, nil
+}
+
+// ParseLabelMatcher 解析name=value、name!=value、name=~regexp或name!~regexp形式的匹配条件，
+// 值可以用双引号括起
+func ParseLabelMatcher(s string) (*LabelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid label matcher %q", s)
+	}
+	name, rest := strings.TrimSpace(s[:i]), s[i:]
+
+	var matchType string
+	for _, t := range []string{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual} {
+		if strings.HasPrefix(rest, t) {
+			matchType = t
+			break
+		}
+	}
+	if matchType == "" {
+		return nil, fmt.Errorf("invalid label matcher %q", s)
+	}
+
+	value := strings.TrimSpace(rest[len(matchType):])
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted value in label matcher %q", s)
+		}
+		value = unquoted
+	}
+	return NewLabelMatcher(name, matchType, value)
+}
+
+// Matches 判断值是否满足条件
+func (m *LabelMatcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// Pattern 返回正则匹配使用的完整表达式，等值匹配返回空字符串
+func (m *LabelMatcher) Pattern() string {
+	if m.re == nil {
+		return ""
+	}
+	return m.re.String()
+}
+
+// String 返回匹配条件的文本形式
+func (m *LabelMatcher) String() string {
+	return m.Name + m.Type + strconv.Quote(m.Value)
+}
+
+// MatchLabels 判断指标是否满足全部匹配条件
+func MatchLabels(metric *processor.ProcessedMetric, matchers []*LabelMatcher) bool {
+	for _, m := range matchers {
+		value := metric.Labels[m.Name]
+		if m.Name == MetricNameLabel {
+			value = metric.Name
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// NameMatcher 指标名匹配条件，glob或正则表达式都需匹配整个指标名
+//
+// Prefix是所有能匹配的指标名的公共前缀，存储后端可以用它在读取数据前跳过不可能匹配的部分。
+type NameMatcher struct {
+	pattern string
+	re      *regexp.Regexp
+	prefix  string
+	// literal 只匹配等于prefix的指标名
+	literal bool
+}
+
+// NewNameGlob 创建glob形式的指标名匹配条件，*匹配任意字符串，?匹配单个字符，\转义下一个字符
+func NewNameGlob(pattern string) (*NameMatcher, error) {
+	var expr, prefix strings.Builder
+	literal := true
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+			continue
+		case r == '*' || r == '?':
+			literal = false
+			if r == '*' {
+				expr.WriteString(".*")
+			} else {
+				expr.WriteString(".")
+			}
+			continue
+		}
+		expr.WriteString(regexp.QuoteMeta(string(r)))
+		if literal {
+			prefix.WriteRune(r)
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("invalid name glob %q: trailing backslash", pattern)
+	}
+
+	m := &NameMatcher{pattern: "glob:" + pattern, prefix: prefix.String(), literal: literal}
+	if !literal {
+		m.re = regexp.MustCompile("^(?:" + expr.String() + ")$")
+	}
+	return m, nil
+}
+
+// NewNameRegexp 创建正则表达式形式的指标名匹配条件
+func NewNameRegexp(expr string) (*NameMatcher, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid name regexp: %w", err)
+	}
+	prefix, complete := re.LiteralPrefix()
+	m := &NameMatcher{pattern: "re:" + expr, prefix: prefix, literal: complete}
+	if !complete {
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches 判断指标名是否满足条件
+func (m *NameMatcher) Matches(name string) bool {
+	if m.literal {
+		return name == m.prefix
+	}
+	return strings.HasPrefix(name, m.prefix) && m.re.MatchString(name)
+}
+
+// Prefix 返回所有能匹配的指标名的公共前缀，可能为空
+func (m *NameMatcher) Prefix() string {
+	return m.prefix
+}
+
+// Pattern 返回匹配使用的完整正则表达式，只匹配Prefix本身时返回空字符串
+func (m *NameMatcher) Pattern() string {
+	if m.re == nil {
+		return ""
+	}
+	return m.re.String()
+}
+
+// Literal 判断条件是否只匹配Prefix本身
+func (m *NameMatcher) Literal() bool {
+	return m.literal
+}
+
+// String 返回匹配条件的文本形式
+func (m *NameMatcher) String() string {
+	return m.pattern
+}
+
+// MatchGlob 判断s是否匹配glob形式的pattern，语法与NewNameGlob相同，空pattern匹配任意字符串
+//
+// 用于按Agent ID、指标名、类型或标签值匹配规则，不编译也不分配内存。
+// 以\结尾的无效pattern不匹配任何字符串，配置中的pattern应在加载时用ValidateGlob检查。
+func MatchGlob(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	px, sx := 0, 0
+	// star 最近一个*在pattern中的位置，starSx 该*当前匹配到的s的末尾
+	star, starSx := -1, 0
+	for px < len(pattern) || sx < len(s) {
+		if px < len(pattern) {
+			c, w := utf8.DecodeRuneInString(pattern[px:])
+			switch c {
+			case '*':
+				star, starSx = px, sx
+				px += w
+				continue
+			case '?':
+				if sx < len(s) {
+					_, sw := utf8.DecodeRuneInString(s[sx:])
+					px += w
+					sx += sw
+					continue
+				}
+			default:
+				if c == '\\' {
+					if px+w == len(pattern) {
+						return false
+					}
+					var ew int
+					c, ew = utf8.DecodeRuneInString(pattern[px+w:])
+					w += ew
+				}
+				if sx < len(s) {
+					r, sw := utf8.DecodeRuneInString(s[sx:])
+					if r == c {
+						px += w
+						sx += sw
+						continue
+					}
+				}
+			}
+		}
+		// 不匹配时回到最近的*，让它多匹配一个字符
+		if star < 0 || starSx >= len(s) {
+			return false
+		}
+		_, sw := utf8.DecodeRuneInString(s[starSx:])
+		starSx += sw
+		px, sx = star+1, starSx
+	}
+	return true
+}
+
+// ValidateGlob 检查glob形式的pattern是否有效
+func ValidateGlob(pattern string) error {
+	_, err := NewNameGlob(pattern)
+	return err
+}
@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// DefaultNamespace 不匹配任何命名空间规则的数据所在的命名空间
+const DefaultNamespace = "default"
+
+// namespaceNamePattern 合法的命名空间名称，同时用作数据目录名
+var namespaceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Namespacer 按命名空间划分数据的存储实现此接口
+type Namespacer interface {
+	// Namespaces 返回所有命名空间名称，default在最前
+	Namespaces() []string
+	// Namespace 返回命名空间的存储，用于把查询限定在该命名空间
+	Namespace(name string) (Storage, bool)
+	// NamespaceOf 返回数据按路由规则写入的命名空间名称
+	NamespaceOf(m *processor.ProcessedMetric) string
+}
+
+// namespace 一个命名空间及其路由规则
+type namespace struct {
+	name    string
+	rules   []config.NamespaceRule
+	storage Storage
+}
+
+// NamespacedStorage 按路由规则把数据分到多个命名空间的存储
+//
+// 每个命名空间是一个独立的后端实例，有自己的max_size和expire_time，
+// 基础设施指标和应用指标不会争用同一个容量。写入时按顺序匹配命名空间的规则，
+// 都不匹配的数据写入default命名空间；不限定命名空间的查询合并所有命名空间的结果，
+// 按时间戳而不是写入顺序排列。
+type NamespacedStorage struct {
+	namespaces []*namespace
+	byName     map[string]*namespace
+}
+
+// newNamespacedStorage 为default和配置的每个命名空间创建后端实例
+//
+// default命名空间使用storage的配置和数据目录，其他命名空间的数据在file_path下以名称命名的子目录中。
+func newNamespacedStorage(cfg config.StorageConfig, clk clock.Clock, factory Factory) (Storage, error) {
+	s := &NamespacedStorage{byName: make(map[string]*namespace)}
+
+	base := cfg
+	base.Namespaces = nil
+	configs := []config.NamespaceConfig{{Name: DefaultNamespace}}
+	for _, ns := range cfg.Namespaces {
+		if !namespaceNamePattern.MatchString(ns.Name) {
+			s.Close()
+			return nil, fmt.Errorf("invalid namespace name %q", ns.Name)
+		}
+		if _, dup := s.byName[ns.Name]; dup || ns.Name == DefaultNamespace {
+			s.Close()
+			return nil, fmt.Errorf("duplicate namespace %q", ns.Name)
+		}
+		s.byName[ns.Name] = nil
+		configs = append(configs, ns)
+	}
+
+	for _, ns := range configs {
+		sub := base
+		if ns.Name != DefaultNamespace {
+			sub.FilePath = filepath.Join(base.FilePath, ns.Name)
+			if base.WAL.Dir != "" {
+				sub.WAL.Dir = filepath.Join(base.WAL.Dir, ns.Name)
+			}
+		}
+		if ns.MaxSize > 0 {
+			sub.MaxSize = ns.MaxSize
+		}
+		if ns.ExpireTime > 0 {
+			sub.ExpireTime = ns.ExpireTime
+		}
+
+		st, err := factory(sub, clk)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open namespace %s: %w", ns.Name, err)
+		}
+		n := &namespace{name: ns.Name, rules: ns.Match, storage: st}
+		s.namespaces = append(s.namespaces, n)
+		s.byName[ns.Name] = n
+	}
+	return s, nil
+}
+
+// Namespaces 返回所有命名空间名称，default在最前
+func (s *NamespacedStorage) Namespaces() []string {
+	names := make([]string, len(s.namespaces))
+	for i, ns := range s.namespaces {
+		names[i] = ns.name
+	}
+	return names
+}
+
+// Namespace 返回命名空间的存储
+func (s *NamespacedStorage) Namespace(name string) (Storage, bool) {
+	ns, ok := s.byName[name]
+	if !ok {
+		return nil, false
+	}
+	return ns.storage, true
+}
+
+// NamespaceOf 返回数据按路由规则写入的命名空间名称
+func (s *NamespacedStorage) NamespaceOf(m *processor.ProcessedMetric) string {
+	return s.route(m).name
+}
+
+// route 返回数据所属的命名空间，按配置顺序匹配第一个命名空间，都不匹配时返回default
+func (s *NamespacedStorage) route(m *processor.ProcessedMetric) *namespace {
+	for _, ns := range s.namespaces[1:] {
+		for i := range ns.rules {
+			if namespaceRuleMatches(&ns.rules[i], m) {
+				return ns
+			}
+		}
+	}
+	return s.namespaces[0]
+}
+
+// SaveMetrics 按路由规则把数据分组写入各命名空间，组内保持原有顺序
+func (s *NamespacedStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	if len(s.namespaces) == 1 {
+		return s.namespaces[0].storage.SaveMetrics(metrics)
+	}
+
+	batches := make(map[*namespace][]processor.ProcessedMetric)
+	for i := range metrics {
+		ns := s.route(&metrics[i])
+		batches[ns] = append(batches[ns], metrics[i])
+	}
+	var errs []error
+	for _, ns := range s.namespaces {
+		if batch, ok := batches[ns]; ok {
+			if err := ns.storage.SaveMetrics(batch); err != nil {
+				errs = append(errs, fmt.Errorf("namespace %s: %w", ns.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GetMetricsByAgentID 合并各命名空间的结果，按时间戳从新到旧
+func (s *NamespacedStorage) GetMetricsByAgentID(agentID string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByAgentID(agentID, limit)
+	})
+}
+
+// GetMetricsByType 合并各命名空间的结果，按时间戳从新到旧
+func (s *NamespacedStorage) GetMetricsByType(metricType string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByType(metricType, limit)
+	})
+}
+
+// GetLatestMetrics 返回所有命名空间中时间戳最新的limit条数据，按时间戳从旧到新
+func (s *NamespacedStorage) GetLatestMetrics(limit int) ([]processor.ProcessedMetric, error) {
+	merged, err := s.mergeNewest(limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetLatestMetrics(limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(merged)-1; i < j; i, j = i+1, j-1 {
+		merged[i], merged[j] = merged[j], merged[i]
+	}
+	return merged, nil
+}
+
+// GetMetricsByTimeRange 合并各命名空间的结果，按时间戳从新到旧
+func (s *NamespacedStorage) GetMetricsByTimeRange(start, end time.Time, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByTimeRange(start, end, limit)
+	})
+}
+
+// GetMetricsByLabels 合并各命名空间的结果，按时间戳从新到旧
+func (s *NamespacedStorage) GetMetricsByLabels(matchers []*LabelMatcher, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByLabels(matchers, limit)
+	})
+}
+
+// QuerySorted 在各命名空间中排序截断后合并，再整体排序截断
+func (s *NamespacedStorage) QuerySorted(filter Filter, opts SortOptions, limit int) ([]processor.ProcessedMetric, error) {
+	merged := make([]processor.ProcessedMetric, 0)
+	for _, ns := range s.namespaces {
+		sq, ok := ns.storage.(SortedQuerier)
+		if !ok {
+			return nil, fmt.Errorf("namespace %s does not support sorted queries", ns.name)
+		}
+		metrics, err := sq.QuerySorted(filter, opts, limit)
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, metrics...)
+	}
+	SortMetrics(merged, opts)
+	if limit >= 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
+
+// Aggregate 合并各命名空间同一窗口的聚合结果，平均值按样本数加权
+func (s *NamespacedStorage) Aggregate(q AggregateQuery) ([]AggregatePoint, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	results := make([][]AggregatePoint, 0, len(s.namespaces))
+	for _, ns := range s.namespaces {
+		points, err := ns.storage.Aggregate(q)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, points)
+	}
+	return mergeAggregates(q, results...), nil
+}
+
+// DeleteMetricsByAgentID 在所有命名空间中删除Agent的数据
+func (s *NamespacedStorage) DeleteMetricsByAgentID(agentID string) (int, error) {
+	return s.deleteAll(func(st Storage) (int, error) { return st.DeleteMetricsByAgentID(agentID) })
+}
+
+// DeleteMetricsByType 在所有命名空间中删除指定类型的数据
+func (s *NamespacedStorage) DeleteMetricsByType(metricType string) (int, error) {
+	return s.deleteAll(func(st Storage) (int, error) { return st.DeleteMetricsByType(metricType) })
+}
+
+// DeleteMetricsByTimeRange 在所有命名空间中删除时间范围内的数据
+func (s *NamespacedStorage) DeleteMetricsByTimeRange(start, end time.Time) (int, error) {
+	return s.deleteAll(func(st Storage) (int, error) { return st.DeleteMetricsByTimeRange(start, end) })
+}
+
+// Stats 汇总各命名空间的统计，Namespaces中是每个命名空间的统计
+func (s *NamespacedStorage) Stats() (Stats, error) {
+	total := Stats{
+		ByAgent:    make(map[string]int),
+		ByType:     make(map[string]int),
+		Namespaces: make(map[string]Stats, len(s.namespaces)),
+	}
+	for _, ns := range s.namespaces {
+		stats, err := ns.storage.Stats()
+		if err != nil {
+			return total, fmt.Errorf("namespace %s: %w", ns.name, err)
+		}
+		total.Namespaces[ns.name] = stats
+		total.add(stats)
+	}
+	return total, nil
+}
+
+// CleanExpired 按各命名空间的expire_time清理过期数据
+func (s *NamespacedStorage) CleanExpired() int {
+	removed := 0
+	for _, ns := range s.namespaces {
+		removed += ns.storage.CleanExpired()
+	}
+	return removed
+}
+
+// Compact 压缩支持压缩的命名空间
+func (s *NamespacedStorage) Compact(mergeConflicts bool) (int, error) {
+	removed := 0
+	for _, ns := range s.namespaces {
+		c, ok := ns.storage.(Compactor)
+		if !ok {
+			continue
+		}
+		n, err := c.Compact(mergeConflicts)
+		if err != nil {
+			return removed, fmt.Errorf("namespace %s: %w", ns.name, err)
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// OnEviction 注册各命名空间的淘汰事件回调，事件的Namespace为所属命名空间
+func (s *NamespacedStorage) OnEviction(hook func(EvictionEvent)) {
+	for _, ns := range s.namespaces {
+		if n, ok := ns.storage.(EvictionNotifier); ok {
+			name := ns.name
+			n.OnEviction(func(event EvictionEvent) {
+				event.Namespace = name
+				hook(event)
+			})
+		}
+	}
+}
+
+// OnExpire 注册各命名空间按expire_time删除数据前的回调
+func (s *NamespacedStorage) OnExpire(hook func([]processor.ProcessedMetric)) {
+	for _, ns := range s.namespaces {
+		if n, ok := ns.storage.(ExpiryNotifier); ok {
+			n.OnExpire(hook)
+		}
+	}
+}
+
+// Close 关闭所有命名空间
+func (s *NamespacedStorage) Close() error {
+	var errs []error
+	for _, ns := range s.namespaces {
+		if err := ns.storage.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("namespace %s: %w", ns.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mergeNewest 合并各命名空间按从新到旧返回的结果，按时间戳从新到旧取前limit条
+func (s *NamespacedStorage) mergeNewest(limit int, fetch func(Storage) ([]processor.ProcessedMetric, error)) ([]processor.ProcessedMetric, error) {
+	if len(s.namespaces) == 1 {
+		return fetch(s.namespaces[0].storage)
+	}
+
+	merged := make([]processor.ProcessedMetric, 0)
+	for _, ns := range s.namespaces {
+		metrics, err := fetch(ns.storage)
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, metrics...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp.After(merged[j].Timestamp)
+	})
+	if limit >= 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
+
+// deleteAll 在所有命名空间中执行删除并汇总删除的条数
+func (s *NamespacedStorage) deleteAll(del func(Storage) (int, error)) (int, error) {
+	deleted := 0
+	for _, ns := range s.namespaces {
+		n, err := del(ns.storage)
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf("namespace %s: %w", ns.name, err)
+		}
+	}
+	return deleted, nil
+}
+
+// namespaceRuleMatches 判断数据是否满足路由规则，规则的所有字段都需匹配
+func namespaceRuleMatches(rule *config.NamespaceRule, m *processor.ProcessedMetric) bool {
+	if !MatchGlob(rule.Agent, m.AgentID) || !MatchGlob(rule.Metric, m.Name) {
+		return false
+	}
+	for k, pattern := range rule.Labels {
+		v, ok := m.Labels[k]
+		if !ok || !MatchGlob(pattern, v) {
+			return false
+		}
+	}
+	return true
+}
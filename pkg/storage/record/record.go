@@ -0,0 +1,151 @@
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// headerSize 记录头长度：4字节数据长度 + 4字节CRC32C
+const headerSize = 8
+
+// MaxRecordSize 单条记录的最大长度，超过时视为记录头损坏
+const MaxRecordSize = 64 << 20
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrRecordTooLarge 写入的记录超过MaxRecordSize
+var ErrRecordTooLarge = errors.New("record too large")
+
+// Corruption 读取时发现的损坏区域
+type Corruption struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Reason string `json:"reason"`
+}
+
+// Error 实现error接口
+func (c Corruption) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d (%d bytes): %s", c.Offset, c.Length, c.Reason)
+}
+
+// Checksum 计算数据的CRC32C校验和
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// Writer 写入带长度和校验和的记录
+//
+// 记录格式为 4字节大端长度 | 4字节大端CRC32C | 数据，供WAL、快照等文件存储使用。
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter 创建记录写入器
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write 写入一条记录
+func (w *Writer) Write(data []byte) error {
+	if len(data) > MaxRecordSize {
+		return ErrRecordTooLarge
+	}
+
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], Checksum(data))
+	copy(buf[headerSize:], data)
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// Reader 读取并校验记录
+//
+// 校验和不匹配的记录会被跳过并记录在Corruptions中；记录头损坏或文件尾部写入不完整时
+// 无法定位下一条记录，剩余数据整体视为损坏，Next返回io.EOF。
+type Reader struct {
+	r           *bufio.Reader
+	offset      int64
+	corruptions []Corruption
+	done        bool
+}
+
+// NewReader 创建记录读取器
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next 返回下一条校验通过的记录，没有更多记录时返回io.EOF
+func (r *Reader) Next() ([]byte, error) {
+	for !r.done {
+		start := r.offset
+
+		var header [headerSize]byte
+		n, err := io.ReadFull(r.r, header[:])
+		r.offset += int64(n)
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, r.skipRest(start, "truncated record header", err)
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > MaxRecordSize {
+			return nil, r.skipRest(start, fmt.Sprintf("invalid record length %d", length), nil)
+		}
+
+		data := make([]byte, length)
+		n, err = io.ReadFull(r.r, data)
+		r.offset += int64(n)
+		if err != nil {
+			return nil, r.skipRest(start, "truncated record", err)
+		}
+
+		if Checksum(data) != checksum {
+			r.corruptions = append(r.corruptions, Corruption{
+				Offset: start,
+				Length: r.offset - start,
+				Reason: "checksum mismatch",
+			})
+			continue
+		}
+		return data, nil
+	}
+	return nil, io.EOF
+}
+
+// Corruptions 返回已发现的损坏区域
+func (r *Reader) Corruptions() []Corruption {
+	return r.corruptions
+}
+
+// Offset 返回已读取的字节数
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// skipRest 丢弃剩余数据并记录损坏，读取错误不是EOF类错误时原样返回
+func (r *Reader) skipRest(start int64, reason string, err error) error {
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	rest, err := io.Copy(io.Discard, r.r)
+	r.offset += rest
+	r.done = true
+	r.corruptions = append(r.corruptions, Corruption{
+		Offset: start,
+		Length: r.offset - start,
+		Reason: reason,
+	})
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
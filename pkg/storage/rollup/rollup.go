@@ -0,0 +1,357 @@
+package rollup
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// Point 一个降采样时间桶的聚合结果
+type Point struct {
+	AgentID   string    `json:"agent_id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Avg       float64   `json:"avg"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Count     int       `json:"count"`
+}
+
+// Query 降采样数据查询条件，AgentID和Name为空表示不过滤
+type Query struct {
+	AgentID string
+	Name    string
+	Start   time.Time
+	End     time.Time
+	Limit   int
+	// Visible 不为nil时只返回该函数接受的序列
+	Visible func(agentID, name string) bool
+}
+
+// bucket 时间桶内的累计值
+type bucket struct {
+	start time.Time
+	sum   float64
+	min   float64
+	max   float64
+	count int
+}
+
+// series 单个Agent和指标名的时间桶，按start升序排列
+type series struct {
+	agentID string
+	name    string
+	typ     string
+	buckets []bucket
+}
+
+// level 一个降采样级别
+type level struct {
+	resolution time.Duration
+	retention  time.Duration
+	lateness   time.Duration
+	series     map[string]*series
+	lastPrune  time.Time
+	// late 超出lateness被丢弃的迟到样本数
+	late int
+}
+
+// LevelStats 一个降采样级别的状态
+type LevelStats struct {
+	Resolution string `json:"resolution"`
+	Retention  string `json:"retention"`
+	Lateness   string `json:"lateness"`
+	Series     int    `json:"series"`
+	Buckets    int    `json:"buckets"`
+	// Late 时间戳早于当前时间减lateness而被丢弃的迟到样本数
+	Late int `json:"late"`
+}
+
+// Store 按Agent和指标名把原始数据聚合为多个分辨率的平均值
+//
+// 每个级别直接由原始数据聚合，保留时间通常比原始数据长得多，
+// 用于低成本地保留历史趋势。数据只保存在内存中，重启后丢失。
+// 迟到的数据在lateness内累加到已有的时间桶，超出的丢弃并计数；导入的历史数据通过Backfill写入，不受lateness限制。
+type Store struct {
+	mu     sync.RWMutex
+	clock  clock.Clock
+	levels []*level
+}
+
+// New 按配置的级别创建降采样存储，分辨率必须大于0且互不相同
+func New(cfg []config.RollupConfig, clk clock.Clock) (*Store, error) {
+	s := &Store{clock: clk}
+	seen := make(map[time.Duration]bool, len(cfg))
+	for _, c := range cfg {
+		if c.Resolution <= 0 {
+			return nil, fmt.Errorf("invalid rollup resolution %s", c.Resolution)
+		}
+		if c.Lateness < 0 {
+			return nil, fmt.Errorf("invalid rollup lateness %s", c.Lateness)
+		}
+		if seen[c.Resolution] {
+			return nil, fmt.Errorf("duplicate rollup resolution %s", c.Resolution)
+		}
+		seen[c.Resolution] = true
+		s.levels = append(s.levels, &level{
+			resolution: c.Resolution,
+			retention:  c.Retention,
+			lateness:   c.Lateness,
+			series:     make(map[string]*series),
+		})
+	}
+	return s, nil
+}
+
+// Resolutions 返回配置的分辨率
+func (s *Store) Resolutions() []time.Duration {
+	resolutions := make([]time.Duration, len(s.levels))
+	for i, l := range s.levels {
+		resolutions[i] = l.resolution
+	}
+	return resolutions
+}
+
+// Observe 把新写入的数据累加到各级别的时间桶，可作为接入钩子使用。
+// 时间戳早于当前时间减lateness的迟到数据不再修改已聚合的时间桶，丢弃并计数
+func (s *Store) Observe(metrics []processor.ProcessedMetric) {
+	s.observe(metrics, false)
+}
+
+// Backfill 把导入的历史数据累加到各级别的时间桶，不受lateness限制，超出保留时间的数据仍然忽略
+func (s *Store) Backfill(metrics []processor.ProcessedMetric) {
+	s.observe(metrics, true)
+}
+
+// observe 把数据累加到各级别的时间桶，backfill为true时不检查lateness
+func (s *Store) observe(metrics []processor.ProcessedMetric, backfill bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	for _, l := range s.levels {
+		cutoff := l.cutoff(now)
+		var horizon time.Time
+		if l.lateness > 0 && !backfill {
+			horizon = now.Add(-l.lateness)
+		}
+		for i := range metrics {
+			m := &metrics[i]
+			if !cutoff.IsZero() && m.Timestamp.Before(cutoff) {
+				continue
+			}
+			if !horizon.IsZero() && m.Timestamp.Before(horizon) {
+				l.late++
+				continue
+			}
+			l.add(m)
+		}
+		if now.Sub(l.lastPrune) >= l.resolution {
+			l.prune(cutoff)
+			l.lastPrune = now
+		}
+	}
+}
+
+// Stats 返回各级别的序列数、时间桶数和丢弃的迟到样本数
+func (s *Store) Stats() []LevelStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := make([]LevelStats, 0, len(s.levels))
+	for _, l := range s.levels {
+		st := LevelStats{
+			Resolution: l.resolution.String(),
+			Retention:  l.retention.String(),
+			Lateness:   l.lateness.String(),
+			Series:     len(l.series),
+			Late:       l.late,
+		}
+		for _, ser := range l.series {
+			st.Buckets += len(ser.buckets)
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// Query 返回指定分辨率在时间范围内的聚合结果，按时间从新到旧排列
+func (s *Store) Query(resolution time.Duration, q Query) ([]Point, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var l *level
+	for _, candidate := range s.levels {
+		if candidate.resolution == resolution {
+			l = candidate
+			break
+		}
+	}
+	if l == nil {
+		return nil, fmt.Errorf("resolution %s is not configured", resolution)
+	}
+
+	cutoff := l.cutoff(s.clock.Now())
+	points := make([]Point, 0)
+	for _, ser := range l.series {
+		if q.AgentID != "" && ser.agentID != q.AgentID {
+			continue
+		}
+		if q.Name != "" && ser.name != q.Name {
+			continue
+		}
+		if q.Visible != nil && !q.Visible(ser.agentID, ser.name) {
+			continue
+		}
+
+		// 桶覆盖[start, start+resolution)，与查询范围相交即返回
+		from := sort.Search(len(ser.buckets), func(i int) bool {
+			return ser.buckets[i].start.Add(l.resolution).After(q.Start)
+		})
+		for _, b := range ser.buckets[from:] {
+			if b.start.After(q.End) {
+				break
+			}
+			if !cutoff.IsZero() && b.start.Before(cutoff) {
+				continue
+			}
+			points = append(points, Point{
+				AgentID:   ser.agentID,
+				Name:      ser.name,
+				Type:      ser.typ,
+				Timestamp: b.start,
+				Avg:       b.sum / float64(b.count),
+				Min:       b.min,
+				Max:       b.max,
+				Count:     b.count,
+			})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		a, b := &points[i], &points[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		if a.AgentID != b.AgentID {
+			return a.AgentID < b.AgentID
+		}
+		return a.Name < b.Name
+	})
+	if q.Limit >= 0 && len(points) > q.Limit {
+		points = points[:q.Limit]
+	}
+	return points, nil
+}
+
+// DeleteByAgentID 删除Agent的全部降采样数据，返回删除的时间桶数
+func (s *Store) DeleteByAgentID(agentID string) int {
+	return s.delete(func(ser *series) bool { return ser.agentID == agentID }, time.Time{}, time.Time{})
+}
+
+// DeleteByType 删除指定类型的序列，返回删除的时间桶数
+func (s *Store) DeleteByType(metricType string) int {
+	return s.delete(func(ser *series) bool { return ser.typ == metricType }, time.Time{}, time.Time{})
+}
+
+// DeleteByTimeRange 删除与[start, end]相交的时间桶，返回删除的时间桶数
+//
+// 时间桶中只保存聚合值，部分落在范围内的桶也整体删除，以免继续返回已删除的数据。
+func (s *Store) DeleteByTimeRange(start, end time.Time) int {
+	return s.delete(func(*series) bool { return true }, start, end)
+}
+
+// delete 删除match接受的序列中与[start, end]相交的时间桶，start和end为零值时删除整个序列
+func (s *Store) delete(match func(*series) bool, start, end time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, l := range s.levels {
+		for key, ser := range l.series {
+			if !match(ser) {
+				continue
+			}
+			n := len(ser.buckets)
+			if !start.IsZero() || !end.IsZero() {
+				ser.buckets = slices.DeleteFunc(ser.buckets, func(b bucket) bool {
+					return b.start.Add(l.resolution).After(start) && !b.start.After(end)
+				})
+			} else {
+				ser.buckets = nil
+			}
+			deleted += n - len(ser.buckets)
+			if len(ser.buckets) == 0 {
+				delete(l.series, key)
+			}
+		}
+	}
+	return deleted
+}
+
+// cutoff 返回保留范围的起点，不限制保留时间时返回零值
+func (l *level) cutoff(now time.Time) time.Time {
+	if l.retention <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-l.retention)
+}
+
+// add 把一个样本累加到所在的时间桶
+func (l *level) add(m *processor.ProcessedMetric) {
+	key := m.AgentID + "\x00" + m.Name
+	ser, ok := l.series[key]
+	if !ok {
+		ser = &series{agentID: m.AgentID, name: m.Name}
+		l.series[key] = ser
+	}
+	ser.typ = m.Type
+
+	start := m.Timestamp.Truncate(l.resolution)
+	// 数据通常按时间顺序到达，先检查最后一个桶
+	n := len(ser.buckets)
+	i := n - 1
+	if n == 0 || ser.buckets[i].start.Before(start) {
+		ser.buckets = append(ser.buckets, bucket{start: start, min: m.Value, max: m.Value})
+		i = n
+	} else if !ser.buckets[i].start.Equal(start) {
+		i = sort.Search(n, func(i int) bool { return !ser.buckets[i].start.Before(start) })
+		if !ser.buckets[i].start.Equal(start) {
+			ser.buckets = append(ser.buckets, bucket{})
+			copy(ser.buckets[i+1:], ser.buckets[i:])
+			ser.buckets[i] = bucket{start: start, min: m.Value, max: m.Value}
+		}
+	}
+
+	b := &ser.buckets[i]
+	b.sum += m.Value
+	b.count++
+	b.min = min(b.min, m.Value)
+	b.max = max(b.max, m.Value)
+}
+
+// prune 删除超出保留时间的时间桶和已没有数据的序列
+func (l *level) prune(cutoff time.Time) {
+	if cutoff.IsZero() {
+		return
+	}
+	for key, ser := range l.series {
+		n := sort.Search(len(ser.buckets), func(i int) bool {
+			return !ser.buckets[i].start.Before(cutoff)
+		})
+		if n == len(ser.buckets) {
+			delete(l.series, key)
+			continue
+		}
+		if n > 0 {
+			ser.buckets = append(ser.buckets[:0], ser.buckets[n:]...)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package serialization
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// 内置序列化格式名称
+const (
+	Protobuf = "protobuf"
+	JSON     = "json"
+	Gob      = "gob"
+)
+
+// Version 当前的文件头版本，更高版本的文件无法读取
+const Version = 1
+
+// ErrUnknownFormat 未注册的序列化格式
+var ErrUnknownFormat = errors.New("unknown serialization format")
+
+// Format 快照、预写日志和块文件中一条记录的序列化格式
+type Format interface {
+	// Name 返回格式名称，与配置和文件头中的名称一致
+	Name() string
+	// Marshal 编码一条记录
+	Marshal(chunk *protocol.MetricSnapshot) ([]byte, error)
+	// Unmarshal 解码一条记录
+	Unmarshal(data []byte, chunk *protocol.MetricSnapshot) error
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = make(map[string]Format)
+)
+
+func init() {
+	Register(protobufFormat{})
+	Register(jsonFormat{})
+	Register(gobFormat{})
+}
+
+// Register 注册序列化格式，重复注册会panic
+func Register(f Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+
+	name := f.Name()
+	if _, dup := formats[name]; dup {
+		panic("serialization: Register called twice for " + name)
+	}
+	formats[name] = f
+}
+
+// Get 按名称查找序列化格式，空名称等同于protobuf
+func Get(name string) (Format, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = Protobuf
+	}
+
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownFormat, name)
+	}
+	return f, nil
+}
+
+// Names 返回已注册的序列化格式名称
+func Names() []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Header 文件的第一条记录，JSON编码，记录文件的版本和之后记录使用的格式
+//
+// 各格式的数据记录都不是文件的第一条记录，因此只有第一条以'{'开头的记录是文件头。
+// 没有文件头的旧快照和块文件使用protobuf格式；旧的预写日志段只有codec字段，版本为0。
+type Header struct {
+	Version int    `json:"version,omitempty"`
+	Format  string `json:"format,omitempty"`
+	// Codec 之后记录使用的压缩算法，为空表示不压缩
+	Codec string `json:"codec,omitempty"`
+}
+
+// NewHeader 返回使用格式f的当前版本文件头
+func NewHeader(f Format) Header {
+	return Header{Version: Version, Format: f.Name()}
+}
+
+// Marshal 编码文件头
+func (h Header) Marshal() []byte {
+	data, _ := json.Marshal(h)
+	return data
+}
+
+// ParseHeader 判断文件的第一条记录是否为文件头，是时返回解析结果，版本高于Version时返回错误
+func ParseHeader(data []byte) (Header, bool, error) {
+	if len(data) == 0 || data[0] != '{' {
+		return Header{}, false, nil
+	}
+	var h Header
+	if err := json.Unmarshal(data, &h); err != nil {
+		return Header{}, true, fmt.Errorf("invalid file header: %w", err)
+	}
+	if h.Version > Version {
+		return Header{}, true, fmt.Errorf("unsupported file version %d (newest supported is %d)", h.Version, Version)
+	}
+	return h, true, nil
+}
+
+// ToStored 转换为记录中的格式
+func ToStored(m *processor.ProcessedMetric) *protocol.StoredMetric {
+	return &protocol.StoredMetric{
+		AgentId:     m.AgentID,
+		TimestampNs: m.Timestamp.UnixNano(),
+		Name:        m.Name,
+		Value:       m.Value,
+		Labels:      m.Labels,
+		Type:        m.Type,
+		RawType:     m.RawType,
+		Payload:     m.Payload,
+		Provenance:  toStoredProvenance(m.Provenance),
+	}
+}
+
+// FromStored 从记录中的格式转换
+func FromStored(m *protocol.StoredMetric) processor.ProcessedMetric {
+	return processor.ProcessedMetric{
+		AgentID:    m.AgentId,
+		Timestamp:  time.Unix(0, m.TimestampNs),
+		Name:       m.Name,
+		Value:      m.Value,
+		Labels:     m.Labels,
+		Type:       m.Type,
+		RawType:    m.RawType,
+		Payload:    m.Payload,
+		Provenance: fromStoredProvenance(m.Provenance),
+	}
+}
+
+// toStoredProvenance 转换接入来源，未记录时返回nil
+func toStoredProvenance(p *processor.Provenance) *protocol.Provenance {
+	if p == nil {
+		return nil
+	}
+	return &protocol.Provenance{
+		BatchId:          p.BatchID,
+		ConnId:           p.ConnID,
+		Listener:         p.Listener,
+		SourceIp:         p.SourceIP,
+		ReceivedAtNs:     p.ReceivedAt.UnixNano(),
+		DecodeDurationNs: int64(p.DecodeDuration),
+	}
+}
+
+// fromStoredProvenance 从记录中的格式转换接入来源，未记录时返回nil
+func fromStoredProvenance(p *protocol.Provenance) *processor.Provenance {
+	if p == nil {
+		return nil
+	}
+	return &processor.Provenance{
+		BatchID:        p.BatchId,
+		ConnID:         p.ConnId,
+		Listener:       p.Listener,
+		SourceIP:       p.SourceIp,
+		ReceivedAt:     time.Unix(0, p.ReceivedAtNs),
+		DecodeDuration: time.Duration(p.DecodeDurationNs),
+	}
+}
+
+// protobufFormat protobuf编码的MetricSnapshot，体积最小、编解码最快
+type protobufFormat struct{}
+
+func (protobufFormat) Name() string { return Protobuf }
+
+func (protobufFormat) Marshal(chunk *protocol.MetricSnapshot) ([]byte, error) {
+	return proto.Marshal(chunk)
+}
+
+func (protobufFormat) Unmarshal(data []byte, chunk *protocol.MetricSnapshot) error {
+	return proto.Unmarshal(data, chunk)
+}
+
+// jsonFormat 按protobuf的JSON映射编码，便于用文本工具查看，负载为base64
+type jsonFormat struct{}
+
+func (jsonFormat) Name() string { return JSON }
+
+func (jsonFormat) Marshal(chunk *protocol.MetricSnapshot) ([]byte, error) {
+	return protojson.MarshalOptions{UseProtoNames: true}.Marshal(chunk)
+}
+
+func (jsonFormat) Unmarshal(data []byte, chunk *protocol.MetricSnapshot) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, chunk)
+}
+
+// gobFormat encoding/gob编码，每条记录独立编码并包含类型描述
+type gobFormat struct{}
+
+func (gobFormat) Name() string { return Gob }
+
+func (gobFormat) Marshal(chunk *protocol.MetricSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(chunk); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobFormat) Unmarshal(data []byte, chunk *protocol.MetricSnapshot) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(chunk)
+}
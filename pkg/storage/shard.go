@@ -0,0 +1,438 @@
+package storage
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// 分片方式
+const (
+	ShardByAgent = "agent"
+	ShardByTime  = "time"
+)
+
+// shard 一个分片
+type shard struct {
+	id      int
+	storage Storage
+}
+
+// ShardedStorage 按Agent ID或时间段把数据分到多个分片的存储
+//
+// 每个分片是一个独立的后端实例，写入和查询并行访问各分片，查询延迟不随分片数增长。
+// 各分片的结果先按时间戳排序，再用堆归并，取够limit条即停止，不需要对全部结果排序。
+// 按Agent分片时按Agent ID的查询和删除只访问一个分片；按时间分片时时间范围较短的查询只访问覆盖的分片。
+type ShardedStorage struct {
+	shards   []*shard
+	byTime   bool
+	interval time.Duration
+}
+
+// shardedFactory 返回把factory创建的后端分为cfg.Shards.Count个分片的工厂
+//
+// 第N个分片的数据在file_path下的shard-N子目录中。按Agent分片时各分片同时写入，容量为max_size按分片数均分后向上取整；
+// 按时间分片时新数据只写入当前时间段的分片，每个分片的容量为完整的max_size，即一个时间段最多保存max_size条数据。
+func shardedFactory(factory Factory) Factory {
+	return func(cfg config.StorageConfig, clk clock.Clock) (Storage, error) {
+		sc := cfg.Shards
+		if sc.By != ShardByAgent && sc.By != ShardByTime {
+			return nil, fmt.Errorf("invalid shard mode %q, must be %s or %s", sc.By, ShardByAgent, ShardByTime)
+		}
+		if sc.By == ShardByTime && sc.Interval <= 0 {
+			return nil, fmt.Errorf("shard interval must be positive")
+		}
+
+		s := &ShardedStorage{byTime: sc.By == ShardByTime, interval: sc.Interval}
+		base := cfg
+		base.Shards = config.ShardConfig{}
+		for i := 0; i < sc.Count; i++ {
+			sub := base
+			sub.FilePath = filepath.Join(base.FilePath, fmt.Sprintf("shard-%d", i))
+			if base.WAL.Dir != "" {
+				sub.WAL.Dir = filepath.Join(base.WAL.Dir, fmt.Sprintf("shard-%d", i))
+			}
+			if !s.byTime {
+				sub.MaxSize = (base.MaxSize + sc.Count - 1) / sc.Count
+			}
+
+			st, err := factory(sub, clk)
+			if err != nil {
+				s.Close()
+				return nil, fmt.Errorf("failed to open shard %d: %w", i, err)
+			}
+			s.shards = append(s.shards, &shard{id: i, storage: st})
+		}
+		return s, nil
+	}
+}
+
+// route 返回数据所属的分片
+func (s *ShardedStorage) route(m *processor.ProcessedMetric) *shard {
+	if s.byTime {
+		return s.shards[s.timeSlot(m.Timestamp)]
+	}
+	return s.agentShard(m.AgentID)
+}
+
+// agentShard 按Agent ID的FNV-1a哈希返回分片
+func (s *ShardedStorage) agentShard(agentID string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(agentID))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// timeSlot 返回时间戳所在时间段的分片序号
+func (s *ShardedStorage) timeSlot(t time.Time) int {
+	n := int64(len(s.shards))
+	return int((s.period(t)%n + n) % n)
+}
+
+// period 返回时间戳所在时间段自Unix纪元起的序号
+func (s *ShardedStorage) period(t time.Time) int64 {
+	p := t.UnixNano() / int64(s.interval)
+	if t.UnixNano()%int64(s.interval) < 0 {
+		p--
+	}
+	return p
+}
+
+// candidates 返回可能包含满足条件的数据的分片，agentID为空或start、end为零值时不按该条件排除
+func (s *ShardedStorage) candidates(agentID string, start, end time.Time) []*shard {
+	switch {
+	case !s.byTime && agentID != "":
+		return []*shard{s.agentShard(agentID)}
+	case s.byTime && !start.IsZero() && !end.IsZero() && !end.Before(start):
+		if end.Sub(start) >= s.interval*time.Duration(len(s.shards)) {
+			return s.shards
+		}
+		n := int64(len(s.shards))
+		var result []*shard
+		for p := s.period(start); p <= s.period(end); p++ {
+			result = append(result, s.shards[(p%n+n)%n])
+		}
+		return result
+	}
+	return s.shards
+}
+
+// SaveMetrics 按分片分组后并行写入，组内保持原有顺序
+func (s *ShardedStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	batches := make(map[*shard][]processor.ProcessedMetric)
+	for i := range metrics {
+		sh := s.route(&metrics[i])
+		batches[sh] = append(batches[sh], metrics[i])
+	}
+	if len(batches) == 1 {
+		for sh, batch := range batches {
+			return sh.storage.SaveMetrics(batch)
+		}
+	}
+
+	targets := make([]*shard, 0, len(batches))
+	for _, sh := range s.shards {
+		if _, ok := batches[sh]; ok {
+			targets = append(targets, sh)
+		}
+	}
+	_, err := fanOut(targets, func(sh *shard) (struct{}, error) {
+		return struct{}{}, sh.storage.SaveMetrics(batches[sh])
+	})
+	return err
+}
+
+// GetMetricsByAgentID 按时间戳从新到旧返回Agent的数据
+func (s *ShardedStorage) GetMetricsByAgentID(agentID string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(s.candidates(agentID, time.Time{}, time.Time{}), limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByAgentID(agentID, limit)
+	})
+}
+
+// GetMetricsByType 按时间戳从新到旧归并各分片的结果
+func (s *ShardedStorage) GetMetricsByType(metricType string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(s.shards, limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByType(metricType, limit)
+	})
+}
+
+// GetLatestMetrics 返回所有分片中时间戳最新的limit条数据，按时间戳从旧到新
+func (s *ShardedStorage) GetLatestMetrics(limit int) ([]processor.ProcessedMetric, error) {
+	merged, err := s.mergeNewest(s.shards, limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		metrics, err := st.GetLatestMetrics(limit)
+		reverse(metrics)
+		return metrics, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	reverse(merged)
+	return merged, nil
+}
+
+// reverse 原地反转数据的顺序
+func reverse(metrics []processor.ProcessedMetric) {
+	for i, j := 0, len(metrics)-1; i < j; i, j = i+1, j-1 {
+		metrics[i], metrics[j] = metrics[j], metrics[i]
+	}
+}
+
+// GetMetricsByTimeRange 按时间戳从新到旧归并覆盖该时间范围的分片的结果
+func (s *ShardedStorage) GetMetricsByTimeRange(start, end time.Time, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(s.candidates("", start, end), limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByTimeRange(start, end, limit)
+	})
+}
+
+// GetMetricsByLabels 按时间戳从新到旧归并各分片的结果
+func (s *ShardedStorage) GetMetricsByLabels(matchers []*LabelMatcher, limit int) ([]processor.ProcessedMetric, error) {
+	return s.mergeNewest(s.shards, limit, func(st Storage) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByLabels(matchers, limit)
+	})
+}
+
+// QuerySorted 在各分片中并行排序截断后按相同的顺序归并
+func (s *ShardedStorage) QuerySorted(filter Filter, opts SortOptions, limit int) ([]processor.ProcessedMetric, error) {
+	results, err := fanOut(s.candidates(filter.AgentID, filter.Start, filter.End), func(sh *shard) ([]processor.ProcessedMetric, error) {
+		sq, ok := sh.storage.(SortedQuerier)
+		if !ok {
+			return nil, fmt.Errorf("shard %d does not support sorted queries", sh.id)
+		}
+		return sq.QuerySorted(filter, opts, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeSorted(results, opts.less(), limit), nil
+}
+
+// Aggregate 合并各分片同一窗口的聚合结果，平均值按样本数加权
+func (s *ShardedStorage) Aggregate(q AggregateQuery) ([]AggregatePoint, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	results, err := fanOut(s.candidates(q.AgentID, q.Start, q.End), func(sh *shard) ([]AggregatePoint, error) {
+		return sh.storage.Aggregate(q)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeAggregates(q, results...), nil
+}
+
+// DeleteMetricsByAgentID 删除Agent的数据
+func (s *ShardedStorage) DeleteMetricsByAgentID(agentID string) (int, error) {
+	return s.deleteAll(s.candidates(agentID, time.Time{}, time.Time{}), func(st Storage) (int, error) {
+		return st.DeleteMetricsByAgentID(agentID)
+	})
+}
+
+// DeleteMetricsByType 在所有分片中删除指定类型的数据
+func (s *ShardedStorage) DeleteMetricsByType(metricType string) (int, error) {
+	return s.deleteAll(s.shards, func(st Storage) (int, error) { return st.DeleteMetricsByType(metricType) })
+}
+
+// DeleteMetricsByTimeRange 在覆盖该时间范围的分片中删除数据
+func (s *ShardedStorage) DeleteMetricsByTimeRange(start, end time.Time) (int, error) {
+	return s.deleteAll(s.candidates("", start, end), func(st Storage) (int, error) {
+		return st.DeleteMetricsByTimeRange(start, end)
+	})
+}
+
+// Stats 汇总各分片的统计
+func (s *ShardedStorage) Stats() (Stats, error) {
+	total := Stats{
+		ByAgent: make(map[string]int),
+		ByType:  make(map[string]int),
+	}
+	for _, sh := range s.shards {
+		stats, err := sh.storage.Stats()
+		if err != nil {
+			return total, fmt.Errorf("shard %d: %w", sh.id, err)
+		}
+		total.add(stats)
+	}
+	return total, nil
+}
+
+// CleanExpired 清理各分片的过期数据
+func (s *ShardedStorage) CleanExpired() int {
+	removed := 0
+	for _, sh := range s.shards {
+		removed += sh.storage.CleanExpired()
+	}
+	return removed
+}
+
+// Compact 压缩支持压缩的分片
+func (s *ShardedStorage) Compact(mergeConflicts bool) (int, error) {
+	removed := 0
+	for _, sh := range s.shards {
+		c, ok := sh.storage.(Compactor)
+		if !ok {
+			continue
+		}
+		n, err := c.Compact(mergeConflicts)
+		if err != nil {
+			return removed, fmt.Errorf("shard %d: %w", sh.id, err)
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// OnEviction 注册各分片的淘汰事件回调
+func (s *ShardedStorage) OnEviction(hook func(EvictionEvent)) {
+	for _, sh := range s.shards {
+		if n, ok := sh.storage.(EvictionNotifier); ok {
+			n.OnEviction(hook)
+		}
+	}
+}
+
+// OnExpire 注册各分片按expire_time删除数据前的回调
+func (s *ShardedStorage) OnExpire(hook func([]processor.ProcessedMetric)) {
+	for _, sh := range s.shards {
+		if n, ok := sh.storage.(ExpiryNotifier); ok {
+			n.OnExpire(hook)
+		}
+	}
+}
+
+// Close 关闭所有分片
+func (s *ShardedStorage) Close() error {
+	var errs []error
+	for _, sh := range s.shards {
+		if err := sh.storage.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", sh.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mergeNewest 在shards上并行查询，各分片的结果按时间戳从新到旧排序后归并，取前limit条。
+// 只有一个分片时同样排序，结果的顺序不随查询覆盖的分片数变化
+func (s *ShardedStorage) mergeNewest(shards []*shard, limit int, fetch func(Storage) ([]processor.ProcessedMetric, error)) ([]processor.ProcessedMetric, error) {
+	fetchSorted := func(sh *shard) ([]processor.ProcessedMetric, error) {
+		metrics, err := fetch(sh.storage)
+		// 分片按写入顺序返回，Agent补发的数据可能使时间戳不完全有序
+		byTime := func(i, j int) bool { return newestFirst(&metrics[i], &metrics[j]) }
+		if !sort.SliceIsSorted(metrics, byTime) {
+			sort.SliceStable(metrics, byTime)
+		}
+		return metrics, err
+	}
+	if len(shards) == 1 {
+		return fetchSorted(shards[0])
+	}
+
+	results, err := fanOut(shards, fetchSorted)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSorted(results, newestFirst, limit), nil
+}
+
+// newestFirst 按时间戳从新到旧排序
+func newestFirst(a, b *processor.ProcessedMetric) bool { return a.Timestamp.After(b.Timestamp) }
+
+// deleteAll 在shards上并行执行删除并汇总删除的条数
+func (s *ShardedStorage) deleteAll(shards []*shard, del func(Storage) (int, error)) (int, error) {
+	counts, err := fanOut(shards, func(sh *shard) (int, error) { return del(sh.storage) })
+	deleted := 0
+	for _, n := range counts {
+		deleted += n
+	}
+	return deleted, err
+}
+
+// fanOut 在各分片上并行执行fn，按分片顺序返回结果，出错的分片的错误合并返回
+func fanOut[T any](shards []*shard, fn func(*shard) (T, error)) ([]T, error) {
+	results := make([]T, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, sh := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if results[i], errs[i] = fn(sh); errs[i] != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", sh.id, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return results, errors.Join(errs...)
+}
+
+// mergeSorted 归并已按less排序的多个结果，取够limit条即停止，limit小于0时不限制。
+// 顺序相同的数据按结果的先后排列
+func mergeSorted(results [][]processor.ProcessedMetric, less func(a, b *processor.ProcessedMetric) bool, limit int) []processor.ProcessedMetric {
+	total := 0
+	h := &mergeHeap{less: less}
+	for i, r := range results {
+		total += len(r)
+		if len(r) > 0 {
+			h.cursors = append(h.cursors, mergeCursor{result: i, metrics: r})
+		}
+	}
+	if limit >= 0 && total > limit {
+		total = limit
+	}
+	heap.Init(h)
+
+	merged := make([]processor.ProcessedMetric, 0, total)
+	for len(merged) < total {
+		c := &h.cursors[0]
+		merged = append(merged, c.metrics[0])
+		if c.metrics = c.metrics[1:]; len(c.metrics) == 0 {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return merged
+}
+
+// mergeCursor 一个结果中尚未归并的数据
+type mergeCursor struct {
+	result  int
+	metrics []processor.ProcessedMetric
+}
+
+// mergeHeap 按各结果的下一条数据排序的最小堆
+type mergeHeap struct {
+	cursors []mergeCursor
+	less    func(a, b *processor.ProcessedMetric) bool
+}
+
+func (h *mergeHeap) Len() int { return len(h.cursors) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := &h.cursors[i], &h.cursors[j]
+	if h.less(&a.metrics[0], &b.metrics[0]) {
+		return true
+	}
+	if h.less(&b.metrics[0], &a.metrics[0]) {
+		return false
+	}
+	return a.result < b.result
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *mergeHeap) Push(x any) { h.cursors = append(h.cursors, x.(mergeCursor)) }
+
+func (h *mergeHeap) Pop() any {
+	last := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return last
+}
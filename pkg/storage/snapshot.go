@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/record"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/serialization"
+)
+
+// snapshotFile 内存存储快照文件名，位于storage.file_path目录下
+const snapshotFile = "metrics.snapshot"
+
+// snapshotChunk 每条快照记录包含的指标数
+const snapshotChunk = 4096
+
+// Snapshot 按格式format和压缩算法c把当前全部数据按从旧到新的顺序写入path，返回写入的条数
+//
+// 文件由带校验和的记录组成，第一条记录是文件头，之后每条记录是一个按format编码、再用c压缩的MetricSnapshot。
+// 启用负载去重时，同一记录中相同的负载只写一次，数据通过payload_ref引用。
+// 先写临时文件再重命名，写入失败不会破坏已有的快照。
+func (s *MemoryStorage) Snapshot(path string, format serialization.Format, c codec.Codec) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	n, err := s.writeSnapshot(file, format, c)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	return n, nil
+}
+
+// writeSnapshot 在读锁下编码全部数据并同步到磁盘
+func (s *MemoryStorage) writeSnapshot(file *os.File, format serialization.Format, c codec.Codec) (int, error) {
+	buf := bufio.NewWriter(file)
+	writer := record.NewWriter(buf)
+	if err := writer.Write(newHeader(format, c).Marshal()); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	count := s.count
+	chunk := &protocol.MetricSnapshot{}
+	refs := make(map[*byte]uint32)
+	for i := 0; i < count; i++ {
+		m := s.at(i)
+		stored := serialization.ToStored(m)
+		if s.payloads != nil && s.payloads.shared(m.Payload) {
+			ref, ok := refs[unsafe.SliceData(m.Payload)]
+			if !ok {
+				chunk.Payloads = append(chunk.Payloads, m.Payload)
+				ref = uint32(len(chunk.Payloads))
+				refs[unsafe.SliceData(m.Payload)] = ref
+			}
+			stored.Payload, stored.PayloadRef = nil, ref
+		}
+		chunk.Metrics = append(chunk.Metrics, stored)
+
+		if len(chunk.Metrics) == snapshotChunk || i == count-1 {
+			data, err := encodeRecord(format, c, chunk)
+			if err == nil {
+				err = writer.Write(data)
+			}
+			if err != nil {
+				s.mu.RUnlock()
+				return 0, err
+			}
+			chunk.Metrics = chunk.Metrics[:0]
+			chunk.Payloads = chunk.Payloads[:0]
+			clear(refs)
+		}
+	}
+	s.mu.RUnlock()
+
+	if err := buf.Flush(); err != nil {
+		return 0, err
+	}
+	return count, file.Sync()
+}
+
+// Restore 从快照文件追加数据，文件不存在时返回0，损坏的记录被跳过并写入日志
+//
+// 记录的格式和压缩算法由文件头决定，没有文件头的旧快照按不压缩的protobuf读取。
+func (s *MemoryStorage) Restore(path string) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	reader := record.NewReader(bufio.NewReader(file))
+	format, _ := serialization.Get(serialization.Protobuf)
+	c, _ := codec.Get(codec.None)
+	restored := 0
+	first := true
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("failed to read snapshot: %w", err)
+		}
+
+		if first {
+			first = false
+			h, ok, err := serialization.ParseHeader(data)
+			if err == nil && ok {
+				format, c, err = parseHeader(h)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("failed to read snapshot %s: %w", path, err)
+			}
+			if ok {
+				continue
+			}
+		}
+
+		chunk, err := decodeSnapshot(format, c, data)
+		if err != nil {
+			log.Printf("Skipping undecodable snapshot record in %s: %v", path, err)
+			continue
+		}
+
+		s.mu.Lock()
+		if len(s.buf) > 0 {
+			for _, stored := range chunk.Metrics {
+				m := serialization.FromStored(stored)
+				if ref := stored.PayloadRef; ref > 0 {
+					if int(ref) > len(chunk.Payloads) {
+						log.Printf("Snapshot %s: metric %s references missing payload %d", path, m.Name, ref)
+					} else {
+						m.Payload = chunk.Payloads[ref-1]
+					}
+				}
+				s.push(&m)
+			}
+		}
+		s.mu.Unlock()
+		restored += len(chunk.Metrics)
+	}
+
+	for _, c := range reader.Corruptions() {
+		log.Printf("Snapshot %s: skipped %v", path, c)
+	}
+	return restored, nil
+}
+
+// snapshotMemoryStorage 启动时从快照恢复、退出时写快照的内存存储，可选定时写快照
+type snapshotMemoryStorage struct {
+	*MemoryStorage
+	path   string
+	format serialization.Format
+	codec  codec.Codec
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newSnapshotMemoryStorage 从file_path下的快照恢复数据并启动定时快照
+func newSnapshotMemoryStorage(mem *MemoryStorage, cfg config.StorageConfig, clk clock.Clock) (Storage, error) {
+	format, err := serialization.Get(cfg.Serialization)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+	c, err := codec.Get(cfg.Snapshot.Compression)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+
+	path := filepath.Join(cfg.FilePath, snapshotFile)
+	n, err := mem.Restore(path)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+	if n > 0 {
+		// 快照中可能有已过期的部分
+		mem.CleanExpired()
+		log.Printf("Restored %d metrics from snapshot %s", n, path)
+	}
+
+	s := &snapshotMemoryStorage{
+		MemoryStorage: mem,
+		path:          path,
+		format:        format,
+		codec:         c,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go s.run(clk, cfg.Snapshot.Interval)
+	return s, nil
+}
+
+// run 按间隔写快照，interval<=0时只在退出时写
+func (s *snapshotMemoryStorage) run(clk clock.Clock, interval time.Duration) {
+	defer close(s.done)
+	if interval <= 0 {
+		<-s.stop
+		return
+	}
+
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if _, err := s.Snapshot(s.path, s.format, s.codec); err != nil {
+				log.Printf("Failed to snapshot metrics: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stats 内存存储的统计，磁盘占用为最近一次快照的大小
+func (s *snapshotMemoryStorage) Stats() (Stats, error) {
+	stats, err := s.MemoryStorage.Stats()
+	if info, statErr := os.Stat(s.path); statErr == nil {
+		stats.DiskBytes = info.Size()
+	}
+	return stats, err
+}
+
+// Close 停止定时快照并写出最终快照
+func (s *snapshotMemoryStorage) Close() error {
+	close(s.stop)
+	<-s.done
+	s.MemoryStorage.Close()
+
+	n, err := s.Snapshot(s.path, s.format, s.codec)
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote snapshot of %d metrics to %s", n, s.path)
+	return nil
+}
+
+// newHeader 返回使用格式format和压缩算法c的文件头
+func newHeader(format serialization.Format, c codec.Codec) serialization.Header {
+	h := serialization.NewHeader(format)
+	if c.Name() != codec.None {
+		h.Codec = c.Name()
+	}
+	return h
+}
+
+// parseHeader 按文件头查找之后记录使用的格式和压缩算法
+func parseHeader(h serialization.Header) (serialization.Format, codec.Codec, error) {
+	format, err := serialization.Get(h.Format)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := codec.Get(h.Codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return format, c, nil
+}
+
+// encodeRecord 按format编码一个MetricSnapshot并用c压缩
+func encodeRecord(format serialization.Format, c codec.Codec, chunk *protocol.MetricSnapshot) ([]byte, error) {
+	data, err := format.Marshal(chunk)
+	if err != nil || c.Name() == codec.None {
+		return data, err
+	}
+	return codec.Compress(c, data)
+}
+
+// decodeSnapshot 解压并按format解码一条记录
+func decodeSnapshot(format serialization.Format, c codec.Codec, data []byte) (*protocol.MetricSnapshot, error) {
+	if c.Name() != codec.None {
+		var err error
+		if data, err = codec.Decompress(c, data, 0); err != nil {
+			return nil, err
+		}
+	}
+	var chunk protocol.MetricSnapshot
+	if err := format.Unmarshal(data, &chunk); err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
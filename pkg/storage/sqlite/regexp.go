@@ -0,0 +1,62 @@
+package sqlite
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"modernc.org/sqlite"
+)
+
+// maxCachedPatterns 缓存的已编译正则表达式数量上限，超出时清空缓存
+const maxCachedPatterns = 256
+
+var (
+	patternsMu sync.Mutex
+	patterns   = make(map[string]*regexp.Regexp)
+)
+
+func init() {
+	// SQLite把X REGEXP Y转换为regexp(Y, X)，默认没有实现
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("regexp pattern must be text")
+		}
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := args[1].(type) {
+		case nil:
+			return re.MatchString(""), nil
+		case string:
+			return re.MatchString(v), nil
+		case []byte:
+			return re.Match(v), nil
+		default:
+			return re.MatchString(fmt.Sprint(v)), nil
+		}
+	})
+}
+
+// compilePattern 返回缓存的已编译正则表达式
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	patternsMu.Lock()
+	defer patternsMu.Unlock()
+
+	if re, ok := patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) >= maxCachedPatterns {
+		clear(patterns)
+	}
+	patterns[pattern] = re
+	return re, nil
+}
@@ -0,0 +1,663 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+	_ "modernc.org/sqlite"
+)
+
+// dbFile 数据库文件名，位于storage.file_path目录下
+const dbFile = "metrics.db"
+
+// pruneInterval 按MaxSize和ExpireTime清理数据的间隔
+const pruneInterval = time.Minute
+
+const schema = `
+CREATE TABLE IF NOT EXISTS metrics (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	agent_id  TEXT    NOT NULL,
+	timestamp INTEGER NOT NULL,
+	name      TEXT    NOT NULL,
+	value     REAL    NOT NULL,
+	labels    TEXT,
+	type      TEXT    NOT NULL,
+	raw_type  INTEGER NOT NULL,
+	payload   BLOB,
+	provenance TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_metrics_agent_id ON metrics (agent_id, id);
+CREATE INDEX IF NOT EXISTS idx_metrics_type ON metrics (type, id);
+CREATE INDEX IF NOT EXISTS idx_metrics_timestamp ON metrics (timestamp);
+CREATE INDEX IF NOT EXISTS idx_metrics_name ON metrics (name, id);
+`
+
+const columns = "agent_id, timestamp, name, value, labels, type, raw_type, payload, provenance"
+
+// expireBatchSize 注册了过期回调时每批取出的过期数据条数
+const expireBatchSize = 10000
+
+func init() {
+	storage.Register("sqlite", func(cfg config.StorageConfig, clk clock.Clock) (storage.Storage, error) {
+		return Open(filepath.Join(cfg.FilePath, dbFile), cfg.MaxSize, cfg.ExpireTime, clk)
+	})
+}
+
+// Storage 基于SQLite的持久化存储，时间戳以纳秒保存
+//
+// 查询结果的顺序与MemoryStorage一致：按写入顺序从新到旧，
+// GetLatestMetrics返回最新的limit条并按写入顺序从旧到新。
+type Storage struct {
+	db         *sql.DB
+	maxSize    int
+	expireTime time.Duration
+	clock      clock.Clock
+	stop       chan struct{}
+	closeOnce  sync.Once
+	evictions  storage.EvictionTracker
+	expiry     storage.ExpiryHooks
+}
+
+// Open 打开或创建path处的数据库，首次运行时建表和索引
+func Open(path string, maxSize int, expireTime time.Duration, clk clock.Clock) (*Storage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	// SQLite同一时间只允许一个写入者
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	// 数据库部分损坏时只报告问题，不阻止启动
+	checkIntegrity(db, path)
+
+	s := &Storage{
+		db:         db,
+		maxSize:    maxSize,
+		expireTime: expireTime,
+		clock:      clk,
+		stop:       make(chan struct{}),
+	}
+
+	// 启动定时清理的goroutine
+	go s.startPruneTimer()
+
+	return s, nil
+}
+
+// SaveMetrics 在一个事务中保存监控数据
+func (s *Storage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO metrics (" + columns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// 同一批数据的接入来源通常相同，只编码一次
+	var (
+		lastProvenance *processor.Provenance
+		provenance     []byte
+	)
+	for i := range metrics {
+		m := &metrics[i]
+		var labels []byte
+		if len(m.Labels) > 0 {
+			if labels, err = json.Marshal(m.Labels); err != nil {
+				return err
+			}
+		}
+		if m.Provenance != lastProvenance {
+			lastProvenance, provenance = m.Provenance, nil
+			if m.Provenance != nil {
+				if provenance, err = json.Marshal(m.Provenance); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := stmt.Exec(m.AgentID, m.Timestamp.UnixNano(), m.Name, m.Value, labels, m.Type, int32(m.RawType), m.Payload, provenance); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetMetricsByAgentID 按Agent ID获取监控数据
+func (s *Storage) GetMetricsByAgentID(agentID string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.query("SELECT "+columns+" FROM metrics WHERE agent_id = ? ORDER BY id DESC LIMIT ?", agentID, limit)
+}
+
+// GetMetricsByType 按指标类型获取监控数据
+func (s *Storage) GetMetricsByType(metricType string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.query("SELECT "+columns+" FROM metrics WHERE type = ? ORDER BY id DESC LIMIT ?", metricType, limit)
+}
+
+// GetLatestMetrics 获取最新的监控数据
+func (s *Storage) GetLatestMetrics(limit int) ([]processor.ProcessedMetric, error) {
+	return s.query("SELECT "+columns+" FROM (SELECT * FROM metrics ORDER BY id DESC LIMIT ?) ORDER BY id ASC", limit)
+}
+
+// GetMetricsByTimeRange 按时间范围获取监控数据
+func (s *Storage) GetMetricsByTimeRange(start, end time.Time, limit int) ([]processor.ProcessedMetric, error) {
+	return s.query("SELECT "+columns+" FROM metrics WHERE timestamp >= ? AND timestamp <= ? ORDER BY id DESC LIMIT ?",
+		start.UnixNano(), end.UnixNano(), limit)
+}
+
+// GetMetricsByLabels 在数据库中按标签匹配条件过滤，标签以JSON保存，不存在的标签按空字符串匹配
+func (s *Storage) GetMetricsByLabels(matchers []*storage.LabelMatcher, limit int) ([]processor.ProcessedMetric, error) {
+	var where []string
+	var args []interface{}
+	for _, m := range matchers {
+		col := "IFNULL(json_extract(labels, ?), '')"
+		if m.Name == storage.MetricNameLabel {
+			col = "name"
+		} else {
+			args = append(args, `$."`+m.Name+`"`)
+		}
+
+		switch m.Type {
+		case storage.MatchEqual:
+			where = append(where, col+" = ?")
+			args = append(args, m.Value)
+		case storage.MatchNotEqual:
+			where = append(where, col+" != ?")
+			args = append(args, m.Value)
+		case storage.MatchRegexp:
+			where = append(where, col+" REGEXP ?")
+			args = append(args, m.Pattern())
+		case storage.MatchNotRegexp:
+			where = append(where, "NOT ("+col+" REGEXP ?)")
+			args = append(args, m.Pattern())
+		default:
+			return nil, fmt.Errorf("invalid match type %q", m.Type)
+		}
+	}
+
+	query := "SELECT " + columns + " FROM metrics"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	return s.query(query, args...)
+}
+
+// Aggregate 在数据库中按时间窗口分组聚合
+func (s *Storage) Aggregate(q storage.AggregateQuery) ([]storage.AggregatePoint, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	// 直方图需要在内存中解析payload后合并
+	if q.HistogramFunc() {
+		query := "SELECT " + columns + " FROM metrics WHERE name = ? AND raw_type = ? AND timestamp >= ? AND timestamp <= ?"
+		args := []interface{}{q.Name, int32(protocol.MetricType_EXPONENTIAL_HISTOGRAM), q.Start.UnixNano(), q.End.UnixNano()}
+		if q.AgentID != "" {
+			query += " AND agent_id = ?"
+			args = append(args, q.AgentID)
+		}
+		metrics, err := s.query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		w := storage.NewWindowAggregator(q)
+		for i := range metrics {
+			w.Add(&metrics[i])
+		}
+		return w.Points(), nil
+	}
+
+	fn := "AVG(value)"
+	switch q.Func {
+	case storage.AggregateMin:
+		fn = "MIN(value)"
+	case storage.AggregateMax:
+		fn = "MAX(value)"
+	case storage.AggregateSum:
+		fn = "SUM(value)"
+	case storage.AggregateCount:
+		fn = "COUNT(*)"
+	}
+
+	query := "SELECT (timestamp - ?) / ? AS bucket, " + fn + ", COUNT(*) FROM metrics WHERE name = ? AND timestamp >= ? AND timestamp <= ?"
+	args := []interface{}{q.Start.UnixNano(), int64(q.Step), q.Name, q.Start.UnixNano(), q.End.UnixNano()}
+	if q.AgentID != "" {
+		query += " AND agent_id = ?"
+		args = append(args, q.AgentID)
+	}
+	query += " GROUP BY bucket ORDER BY bucket"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]storage.AggregatePoint, 0)
+	for rows.Next() {
+		var (
+			bucket int64
+			p      storage.AggregatePoint
+		)
+		if err := rows.Scan(&bucket, &p.Value, &p.Count); err != nil {
+			return nil, err
+		}
+		p.Timestamp = q.Start.Add(time.Duration(bucket) * q.Step)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// Stats 按Agent和类型统计数据条数，磁盘占用为数据库的页数乘页大小
+func (s *Storage) Stats() (storage.Stats, error) {
+	stats := storage.Stats{
+		Capacity: s.maxSize,
+		ByAgent:  make(map[string]int),
+		ByType:   make(map[string]int),
+	}
+
+	var oldest, newest sql.NullInt64
+	if err := s.db.QueryRow("SELECT COUNT(*), MIN(timestamp), MAX(timestamp) FROM metrics").Scan(&stats.Total, &oldest, &newest); err != nil {
+		return stats, err
+	}
+	if oldest.Valid {
+		o, n := time.Unix(0, oldest.Int64), time.Unix(0, newest.Int64)
+		stats.Oldest, stats.Newest = &o, &n
+	}
+
+	if err := s.countBy("agent_id", stats.ByAgent); err != nil {
+		return stats, err
+	}
+	if err := s.countBy("type", stats.ByType); err != nil {
+		return stats, err
+	}
+
+	var pages, pageSize int64
+	if err := s.db.QueryRow("SELECT page_count, page_size FROM pragma_page_count(), pragma_page_size()").Scan(&pages, &pageSize); err != nil {
+		return stats, err
+	}
+	stats.DiskBytes = pages * pageSize
+	return stats, nil
+}
+
+// countBy 按列分组统计数据条数
+func (s *Storage) countBy(column string, counts map[string]int) error {
+	rows, err := s.db.Query("SELECT " + column + ", COUNT(*) FROM metrics GROUP BY " + column)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			return err
+		}
+		counts[key] = n
+	}
+	return rows.Err()
+}
+
+// QuerySorted 在数据库中完成过滤、排序和截断
+func (s *Storage) QuerySorted(filter storage.Filter, opts storage.SortOptions, limit int) ([]processor.ProcessedMetric, error) {
+	var where []string
+	var args []interface{}
+	if filter.AgentID != "" {
+		where = append(where, "agent_id = ?")
+		args = append(args, filter.AgentID)
+	}
+	if filter.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, filter.Type)
+	}
+	if !filter.Start.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, filter.Start.UnixNano())
+	}
+	if !filter.End.IsZero() {
+		where = append(where, "timestamp <= ?")
+		args = append(args, filter.End.UnixNano())
+	}
+	if m := filter.Name; m != nil {
+		// 前缀转换为范围条件以使用name索引，其余部分用正则表达式匹配
+		switch {
+		case m.Literal():
+			where = append(where, "name = ?")
+			args = append(args, m.Prefix())
+		case m.Prefix() != "":
+			where = append(where, "name >= ?")
+			args = append(args, m.Prefix())
+			if upper, ok := prefixEnd(m.Prefix()); ok {
+				where = append(where, "name < ?")
+				args = append(args, upper)
+			}
+		}
+		if !m.Literal() {
+			where = append(where, "name REGEXP ?")
+			args = append(args, m.Pattern())
+		}
+	}
+
+	query := "SELECT " + columns + " FROM metrics"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	switch opts.Field {
+	case storage.SortByTimestamp, storage.SortByValue, storage.SortByName:
+	default:
+		return nil, fmt.Errorf("invalid sort field %q", opts.Field)
+	}
+
+	// 与storage.SortMetrics一致，相同值保持写入顺序
+	dir := "ASC"
+	if opts.Desc {
+		dir = "DESC"
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id ASC", opts.Field, dir)
+	if len(filter.Labels) == 0 && filter.Allow == nil {
+		query += " LIMIT ?"
+		args = append(args, limit)
+		return s.query(query, args...)
+	}
+
+	// 标签保存为JSON，标签和其他条件在读出后判断，之后再截断
+	metrics, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	matched := metrics[:0]
+	for i := range metrics {
+		if storage.MatchLabels(&metrics[i], filter.Labels) && (filter.Allow == nil || filter.Allow(&metrics[i])) {
+			matched = append(matched, metrics[i])
+		}
+	}
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+// prefixEnd 返回大于所有以prefix开头的字符串的最小字符串，prefix全为0xff时返回false
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// CleanExpired 删除过期数据和超出MaxSize的最旧数据
+func (s *Storage) CleanExpired() int {
+	expiredTime := s.clock.Now().Add(-s.expireTime)
+	if s.expiry.Enabled() {
+		if err := s.notifyExpired(expiredTime); err != nil {
+			log.Printf("Failed to read expired metrics: %v", err)
+			return 0
+		}
+	}
+	res, err := s.db.Exec("DELETE FROM metrics WHERE timestamp <= ?", expiredTime.UnixNano())
+	if err != nil {
+		log.Printf("Failed to clean expired metrics: %v", err)
+		return 0
+	}
+	expired, _ := res.RowsAffected()
+	if expired > 0 {
+		log.Printf("Cleaned %d expired metrics", expired)
+	}
+
+	if s.maxSize <= 0 {
+		return int(expired)
+	}
+	var lastID int64
+	err = s.db.QueryRow("SELECT id FROM metrics ORDER BY id DESC LIMIT 1 OFFSET ?", s.maxSize).Scan(&lastID)
+	if err == sql.ErrNoRows {
+		return int(expired)
+	}
+	if err != nil {
+		log.Printf("Failed to prune metrics over max size: %v", err)
+		return int(expired)
+	}
+	s.recordEvictions(lastID)
+
+	res, err = s.db.Exec("DELETE FROM metrics WHERE id <= ?", lastID)
+	if err != nil {
+		log.Printf("Failed to prune metrics over max size: %v", err)
+		return int(expired)
+	}
+	pruned, _ := res.RowsAffected()
+	if pruned > 0 {
+		log.Printf("Pruned %d metrics over max size %d", pruned, s.maxSize)
+	}
+
+	var retainedSince sql.NullInt64
+	s.db.QueryRow("SELECT MIN(timestamp) FROM metrics").Scan(&retainedSince)
+	s.evictions.Flush(s.clock.Now(), time.Unix(0, retainedSince.Int64), s.expireTime, true)
+	return int(expired + pruned)
+}
+
+// DeleteMetricsByAgentID 删除Agent的全部数据
+func (s *Storage) DeleteMetricsByAgentID(agentID string) (int, error) {
+	return s.delete("DELETE FROM metrics WHERE agent_id = ?", agentID)
+}
+
+// DeleteMetricsByType 删除指定类型的全部数据
+func (s *Storage) DeleteMetricsByType(metricType string) (int, error) {
+	return s.delete("DELETE FROM metrics WHERE type = ?", metricType)
+}
+
+// DeleteMetricsByTimeRange 删除时间戳在[start, end]内的数据
+func (s *Storage) DeleteMetricsByTimeRange(start, end time.Time) (int, error) {
+	return s.delete("DELETE FROM metrics WHERE timestamp BETWEEN ? AND ?", start.UnixNano(), end.UnixNano())
+}
+
+// delete 执行删除语句并返回删除的行数
+func (s *Storage) delete(query string, args ...interface{}) (int, error) {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// Compact 删除重复数据，每组保留id最大即最后写入的一条
+func (s *Storage) Compact(mergeConflicts bool) (int, error) {
+	group := "agent_id, name, IFNULL(labels, ''), timestamp"
+	if !mergeConflicts {
+		group += ", value"
+	}
+	res, err := s.db.Exec("DELETE FROM metrics WHERE id NOT IN (SELECT MAX(id) FROM metrics GROUP BY " + group + ")")
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// OnExpire 注册按expire_time删除数据前的回调
+func (s *Storage) OnExpire(hook func([]processor.ProcessedMetric)) {
+	s.expiry.OnExpire(hook)
+}
+
+// notifyExpired 按写入顺序分批取出不晚于expiredTime的数据并调用过期回调
+func (s *Storage) notifyExpired(expiredTime time.Time) error {
+	for offset := 0; ; offset += expireBatchSize {
+		metrics, err := s.query("SELECT "+columns+" FROM metrics WHERE timestamp <= ? ORDER BY id LIMIT ? OFFSET ?",
+			expiredTime.UnixNano(), expireBatchSize, offset)
+		if err != nil {
+			return err
+		}
+		s.expiry.Notify(metrics)
+		if len(metrics) < expireBatchSize {
+			return nil
+		}
+	}
+}
+
+// OnEviction 注册因超出maxSize删除未过期数据时的事件回调
+func (s *Storage) OnEviction(hook func(storage.EvictionEvent)) {
+	s.evictions.OnEviction(hook)
+}
+
+// recordEvictions 记录即将删除的id不大于lastID的数据的数量、时间范围和Agent
+func (s *Storage) recordEvictions(lastID int64) {
+	var count int
+	var from, to int64
+	if err := s.db.QueryRow("SELECT COUNT(*), MIN(timestamp), MAX(timestamp) FROM metrics WHERE id <= ?", lastID).Scan(&count, &from, &to); err != nil {
+		log.Printf("Failed to summarize evicted metrics: %v", err)
+		return
+	}
+
+	rows, err := s.db.Query("SELECT DISTINCT agent_id FROM metrics WHERE id <= ?", lastID)
+	if err != nil {
+		log.Printf("Failed to summarize evicted metrics: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var agents []string
+	for rows.Next() {
+		var agentID string
+		if err := rows.Scan(&agentID); err != nil {
+			break
+		}
+		agents = append(agents, agentID)
+	}
+	s.evictions.Add(count, time.Unix(0, from), time.Unix(0, to), agents...)
+}
+
+// Close 停止定时清理并关闭数据库
+func (s *Storage) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		err = s.db.Close()
+	})
+	return err
+}
+
+// startPruneTimer 定时清理数据
+func (s *Storage) startPruneTimer() {
+	ticker := s.clock.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.CleanExpired()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// migrate 为旧版本创建的数据库补充之后新增的列
+func migrate(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('metrics') WHERE name = 'provenance'").Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := db.Exec("ALTER TABLE metrics ADD COLUMN provenance TEXT"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIntegrity 执行quick_check并记录发现的损坏
+func checkIntegrity(db *sql.DB, path string) {
+	rows, err := db.Query("PRAGMA quick_check")
+	if err != nil {
+		log.Printf("Failed to check sqlite database %s: %v", path, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			log.Printf("Failed to check sqlite database %s: %v", path, err)
+			return
+		}
+		if msg != "ok" {
+			log.Printf("SQLite database %s is corrupt: %s", path, msg)
+		}
+	}
+}
+
+// query 执行查询并解码结果行
+func (s *Storage) query(query string, args ...interface{}) ([]processor.ProcessedMetric, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]processor.ProcessedMetric, 0)
+	for rows.Next() {
+		var (
+			m          processor.ProcessedMetric
+			ts         int64
+			labels     []byte
+			rawType    int32
+			provenance []byte
+		)
+		if err := rows.Scan(&m.AgentID, &ts, &m.Name, &m.Value, &labels, &m.Type, &rawType, &m.Payload, &provenance); err != nil {
+			return nil, err
+		}
+		m.Timestamp = time.Unix(0, ts)
+		m.RawType = protocol.MetricType(rawType)
+		if len(labels) > 0 {
+			if err := json.Unmarshal(labels, &m.Labels); err != nil {
+				return nil, err
+			}
+		}
+		if len(provenance) > 0 {
+			m.Provenance = &processor.Provenance{}
+			if err := json.Unmarshal(provenance, m.Provenance); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
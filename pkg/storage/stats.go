@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// 估算内存占用时使用的近似开销
+const (
+	mapOverhead      = 48
+	mapEntryOverhead = 2*int(unsafe.Sizeof("")) + 16
+)
+
+// Stats 存储统计
+type Stats struct {
+	Total int `json:"total"`
+	// Capacity 最多保存的数据条数，0表示不限制
+	Capacity int            `json:"capacity"`
+	ByAgent  map[string]int `json:"by_agent"`
+	ByType   map[string]int `json:"by_type"`
+	// Oldest和Newest 保存的数据中最早和最晚的时间戳，没有数据时为nil
+	Oldest *time.Time `json:"oldest,omitempty"`
+	Newest *time.Time `json:"newest,omitempty"`
+	// MemoryBytes 数据和索引占用内存的估算值，不在内存中保存数据的后端为0
+	MemoryBytes int64 `json:"memory_bytes,omitempty"`
+	// DiskBytes 持久化存储占用的磁盘空间
+	DiskBytes int64 `json:"disk_bytes,omitempty"`
+	// Namespaces 启用命名空间时每个命名空间的统计
+	Namespaces map[string]Stats `json:"namespaces,omitempty"`
+	// Tiers 冷热分层存储中热存储(hot)和冷存储(cold)的统计
+	Tiers map[string]Stats `json:"tiers,omitempty"`
+	// Payloads 启用负载去重时的去重统计
+	Payloads *PayloadStats `json:"payloads,omitempty"`
+}
+
+// add 把另一部分数据的统计累加到s，s的ByAgent和ByType不能为nil
+func (s *Stats) add(other Stats) {
+	s.Total += other.Total
+	s.Capacity += other.Capacity
+	s.MemoryBytes += other.MemoryBytes
+	s.DiskBytes += other.DiskBytes
+	for k, v := range other.ByAgent {
+		s.ByAgent[k] += v
+	}
+	for k, v := range other.ByType {
+		s.ByType[k] += v
+	}
+	if other.Oldest != nil && (s.Oldest == nil || other.Oldest.Before(*s.Oldest)) {
+		s.Oldest = other.Oldest
+	}
+	if other.Newest != nil && (s.Newest == nil || other.Newest.After(*s.Newest)) {
+		s.Newest = other.Newest
+	}
+	if other.Payloads != nil {
+		if s.Payloads == nil {
+			s.Payloads = &PayloadStats{}
+		}
+		s.Payloads.Blobs += other.Payloads.Blobs
+		s.Payloads.References += other.Payloads.References
+		s.Payloads.Bytes += other.Payloads.Bytes
+		s.Payloads.SavedBytes += other.Payloads.SavedBytes
+	}
+}
+
+// Stats 统计各Agent和类型的数据条数、时间范围和估算的内存占用
+func (s *MemoryStorage) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{
+		Total:    s.count,
+		Capacity: len(s.buf),
+		ByAgent:  make(map[string]int, len(s.byAgent)),
+		ByType:   make(map[string]int, len(s.byType)),
+	}
+	for agentID, q := range s.byAgent {
+		stats.ByAgent[agentID] = q.len()
+	}
+	for typ, q := range s.byType {
+		stats.ByType[typ] = q.len()
+	}
+
+	// 环形缓冲区预先分配，按容量计算
+	memory := int64(len(s.buf)) * int64(unsafe.Sizeof(processor.ProcessedMetric{}))
+	var oldest, newest time.Time
+	for i := 0; i < s.count; i++ {
+		m := s.at(i)
+		if oldest.IsZero() || m.Timestamp.Before(oldest) {
+			oldest = m.Timestamp
+		}
+		if m.Timestamp.After(newest) {
+			newest = m.Timestamp
+		}
+		memory += metricHeapSize(m)
+		if s.payloads != nil && s.payloads.shared(m.Payload) {
+			// 共享的负载在下面只计算一次
+			memory -= int64(cap(m.Payload))
+		}
+	}
+	if s.count > 0 {
+		stats.Oldest, stats.Newest = &oldest, &newest
+	}
+	if s.payloads != nil {
+		payloads := s.payloads.stats
+		stats.Payloads = &payloads
+		memory += payloads.Bytes
+	}
+
+	memory += indexSize(s.byAgent) + indexSize(s.byType)
+	stats.MemoryBytes = memory
+	return stats, nil
+}
+
+// metricHeapSize 估算一条数据在结构体之外引用的内存
+func metricHeapSize(m *processor.ProcessedMetric) int64 {
+	size := len(m.AgentID) + len(m.Name) + len(m.Type) + cap(m.Payload)
+	if m.Labels != nil {
+		size += mapOverhead
+		for k, v := range m.Labels {
+			size += mapEntryOverhead + len(k) + len(v)
+		}
+	}
+	return int64(size)
+}
+
+// indexSize 估算序号索引占用的内存
+func indexSize(index map[string]*seqQueue) int64 {
+	size := mapOverhead
+	for key, q := range index {
+		size += mapEntryOverhead + len(key) + int(unsafe.Sizeof(*q)) + cap(q.buf)*8
+	}
+	return int64(size)
+}
@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"fmt"
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
 	"github.com/konpure/Kon-Agent-export/pkg/processor"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,23 +17,167 @@ type Storage interface {
 	GetMetricsByType(metricType string, limit int) ([]processor.ProcessedMetric, error)
 	GetLatestMetrics(limit int) ([]processor.ProcessedMetric, error)
 	GetMetricsByTimeRange(start, end time.Time, limit int) ([]processor.ProcessedMetric, error)
-	CleanExpired()
+	// GetMetricsByLabels 获取满足全部标签匹配条件的数据，按写入顺序从新到旧
+	GetMetricsByLabels(matchers []*LabelMatcher, limit int) ([]processor.ProcessedMetric, error)
+	// Aggregate 按时间窗口聚合指标，结果按时间升序
+	Aggregate(q AggregateQuery) ([]AggregatePoint, error)
+	// DeleteMetricsByAgentID 删除Agent的全部数据，返回删除的条数
+	DeleteMetricsByAgentID(agentID string) (int, error)
+	// DeleteMetricsByType 删除指定类型的全部数据，返回删除的条数
+	DeleteMetricsByType(metricType string) (int, error)
+	// DeleteMetricsByTimeRange 删除时间戳在[start, end]内的数据，返回删除的条数
+	DeleteMetricsByTimeRange(start, end time.Time) (int, error)
+	// Stats 返回各Agent和类型的数据条数、时间范围和资源占用
+	Stats() (Stats, error)
+	// CleanExpired 删除过期数据和超出容量的最旧数据，返回删除的条数
+	CleanExpired() int
+	// Close 写出未持久化的数据并释放资源，之后不应再调用其他方法
+	Close() error
+}
+
+// 可排序字段
+const (
+	SortByTimestamp = "timestamp"
+	SortByValue     = "value"
+	SortByName      = "name"
+)
+
+// Filter 查询过滤条件，零值字段表示不过滤
+type Filter struct {
+	AgentID string
+	Type    string
+	Start   time.Time
+	End     time.Time
+	// Name 指标名匹配条件，nil表示不限制
+	Name *NameMatcher
+	// Labels 标签匹配条件，需满足全部条件
+	Labels []*LabelMatcher
+	// Allow 其他过滤条件(如访问控制)，在截断之前判断，nil表示不限制
+	Allow func(m *processor.ProcessedMetric) bool
+}
+
+// Match 判断指标是否满足过滤条件
+func (f *Filter) Match(m *processor.ProcessedMetric) bool {
+	if f.AgentID != "" && m.AgentID != f.AgentID {
+		return false
+	}
+	if f.Type != "" && m.Type != f.Type {
+		return false
+	}
+	if !f.Start.IsZero() && m.Timestamp.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && m.Timestamp.After(f.End) {
+		return false
+	}
+	if f.Name != nil && !f.Name.Matches(m.Name) {
+		return false
+	}
+	if f.Allow != nil && !f.Allow(m) {
+		return false
+	}
+	return MatchLabels(m, f.Labels)
+}
+
+// SortOptions 排序选项
+type SortOptions struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSortOptions 解析排序字段和方向，order为asc或desc，默认desc
+func ParseSortOptions(field, order string) (SortOptions, error) {
+	opts := SortOptions{Field: field, Desc: true}
+	switch field {
+	case SortByTimestamp, SortByValue, SortByName:
+	default:
+		return opts, fmt.Errorf("invalid sort_by %q", field)
+	}
+
+	switch strings.ToLower(order) {
+	case "", "desc":
+	case "asc":
+		opts.Desc = false
+	default:
+		return opts, fmt.Errorf("invalid order %q", order)
+	}
+	return opts, nil
+}
+
+// SortedQuerier 支持在存储层完成过滤、排序和截断的存储实现此接口，
+// 这样limit作用于排序后的全部匹配数据而不是最新的数据
+type SortedQuerier interface {
+	QuerySorted(filter Filter, opts SortOptions, limit int) ([]processor.ProcessedMetric, error)
+}
+
+// SortMetrics 按选项对指标原地排序，相同值保持原有顺序
+func SortMetrics(metrics []processor.ProcessedMetric, opts SortOptions) {
+	less := opts.less()
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return less(&metrics[i], &metrics[j])
+	})
+}
+
+// less 返回按选项排序时a是否排在b之前
+func (opts SortOptions) less() func(a, b *processor.ProcessedMetric) bool {
+	var less func(a, b *processor.ProcessedMetric) bool
+	switch opts.Field {
+	case SortByValue:
+		less = func(a, b *processor.ProcessedMetric) bool { return a.Value < b.Value }
+	case SortByName:
+		less = func(a, b *processor.ProcessedMetric) bool { return a.Name < b.Name }
+	default:
+		less = func(a, b *processor.ProcessedMetric) bool { return a.Timestamp.Before(b.Timestamp) }
+	}
+
+	if opts.Desc {
+		return func(a, b *processor.ProcessedMetric) bool { return less(b, a) }
+	}
+	return less
 }
 
 // MemoryStorage 内存存储实现
+//
+// 数据保存在容量为maxSize的环形缓冲区中，head为最旧数据的位置，
+// 写入和淘汰都是O(1)，预热后不再分配内存。
+// 每条数据按写入顺序分配递增的序号，最旧数据的序号为base。
+// byAgent和byType按序号升序记录每个Agent ID和类型的数据，
+// 按Agent ID或类型查询时只访问匹配的数据。
+// 启用负载去重后，内容相同的负载只保存一份，查询结果共享同一个切片。
 type MemoryStorage struct {
 	mu         sync.RWMutex
-	metrics    []processor.ProcessedMetric
-	maxSize    int
+	buf        []processor.ProcessedMetric
+	head       int
+	count      int
+	base       uint64
+	byAgent    map[string]*seqQueue
+	byType     map[string]*seqQueue
 	expireTime time.Duration
+	clock      clock.Clock
+	stop       chan struct{}
+	closeOnce  sync.Once
+	evictions  EvictionTracker
+	expiry     ExpiryHooks
+	payloads   *blobStore
 }
 
 // NewMemoryStorage 创建内存存储实例
 func NewMemoryStorage(maxSize int, expireTime time.Duration) Storage {
+	return NewMemoryStorageWithClock(maxSize, expireTime, clock.Real())
+}
+
+// NewMemoryStorageWithClock 创建使用指定时钟判断过期的内存存储实例
+func NewMemoryStorageWithClock(maxSize int, expireTime time.Duration, clk clock.Clock) Storage {
+	if maxSize < 0 {
+		maxSize = 0
+	}
 	storage := &MemoryStorage{
-		metrics:    make([]processor.ProcessedMetric, 0, maxSize),
-		maxSize:    maxSize,
+		buf:        make([]processor.ProcessedMetric, maxSize),
+		byAgent:    make(map[string]*seqQueue),
+		byType:     make(map[string]*seqQueue),
 		expireTime: expireTime,
+		clock:      clk,
+		stop:       make(chan struct{}),
 	}
 
 	// 启动定时清理过期数据的goroutine
@@ -38,23 +186,27 @@ func NewMemoryStorage(maxSize int, expireTime time.Duration) Storage {
 	return storage
 }
 
-// SaveMetrics 保存监控数据
-func (s *MemoryStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+// EnablePayloadDedup 按内容去重不小于minSize字节的负载，需在写入数据前调用
+func (s *MemoryStorage) EnablePayloadDedup(minSize int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.payloads = newBlobStore(minSize)
+}
 
-	// 添加新数据
-	s.metrics = append(s.metrics, metrics...)
+// SaveMetrics 保存监控数据，缓冲区已满时覆盖最旧的数据
+func (s *MemoryStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	s.mu.Lock()
 
-	// 限制存储大小
-	if len(s.metrics) > s.maxSize {
-		// 计算需要删除的数量
-		deleteCount := len(s.metrics) - s.maxSize
-		// 删除最旧的数据
-		s.metrics = s.metrics[deleteCount:]
+	if len(s.buf) > 0 {
+		for i := range metrics {
+			s.push(&metrics[i])
+		}
 	}
 
-	log.Printf("Saved %d metrics, total: %d", len(metrics), len(s.metrics))
+	log.Printf("Saved %d metrics, total: %d", len(metrics), s.count)
+	s.mu.Unlock()
+
+	s.flushEvictions(false)
 	return nil
 }
 
@@ -63,16 +215,7 @@ func (s *MemoryStorage) GetMetricsByAgentID(agentID string, limit int) ([]proces
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	result := make([]processor.ProcessedMetric, 0, limit)
-
-	// 从最新的数据开始遍历
-	for i := len(s.metrics) - 1; i >= 0 && len(result) < limit; i-- {
-		if s.metrics[i].AgentID == agentID {
-			result = append(result, s.metrics[i])
-		}
-	}
-
-	return result, nil
+	return s.collect(s.byAgent[agentID], limit), nil
 }
 
 // GetMetricsByType 按指标类型获取监控数据
@@ -80,16 +223,7 @@ func (s *MemoryStorage) GetMetricsByType(metricType string, limit int) ([]proces
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	result := make([]processor.ProcessedMetric, 0, limit)
-
-	// 从最新的数据开始遍历
-	for i := len(s.metrics) - 1; i >= 0 && len(result) < limit; i-- {
-		if s.metrics[i].Type == metricType {
-			result = append(result, s.metrics[i])
-		}
-	}
-
-	return result, nil
+	return s.collect(s.byType[metricType], limit), nil
 }
 
 // GetLatestMetrics 获取最新的监控数据
@@ -98,13 +232,18 @@ func (s *MemoryStorage) GetLatestMetrics(limit int) ([]processor.ProcessedMetric
 	defer s.mu.RUnlock()
 
 	// 确保limit不超过实际数据量
-	if limit > len(s.metrics) {
-		limit = len(s.metrics)
+	if limit > s.count {
+		limit = s.count
+	}
+	if limit < 0 {
+		limit = 0
 	}
 
-	// 获取最新的limit条数据
-	startIdx := len(s.metrics) - limit
-	result := s.metrics[startIdx:]
+	// 获取最新的limit条数据，按写入顺序从旧到新
+	result := make([]processor.ProcessedMetric, limit)
+	for i := range result {
+		result[i] = *s.at(s.count - limit + i)
+	}
 
 	return result, nil
 }
@@ -117,49 +256,347 @@ func (s *MemoryStorage) GetMetricsByTimeRange(start, end time.Time, limit int) (
 	result := make([]processor.ProcessedMetric, 0, limit)
 
 	// 从最新的数据开始遍历
-	for i := len(s.metrics) - 1; i >= 0 && len(result) < limit; i-- {
-		if (s.metrics[i].Timestamp.After(start) || s.metrics[i].Timestamp.Equal(start)) &&
-			(s.metrics[i].Timestamp.Before(end) || s.metrics[i].Timestamp.Equal(end)) {
-			result = append(result, s.metrics[i])
+	for i := s.count - 1; i >= 0 && len(result) < limit; i-- {
+		m := s.at(i)
+		if !m.Timestamp.Before(start) && !m.Timestamp.After(end) {
+			result = append(result, *m)
+		}
+	}
+
+	return result, nil
+}
+
+// GetMetricsByLabels 从新到旧扫描满足全部标签匹配条件的数据
+func (s *MemoryStorage) GetMetricsByLabels(matchers []*LabelMatcher, limit int) ([]processor.ProcessedMetric, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]processor.ProcessedMetric, 0)
+	for i := s.count - 1; i >= 0 && len(result) < limit; i-- {
+		if m := s.at(i); MatchLabels(m, matchers) {
+			result = append(result, *m)
 		}
 	}
+	return result, nil
+}
 
+// QuerySorted 按条件过滤全部数据后排序，返回前limit条
+func (s *MemoryStorage) QuerySorted(filter Filter, opts SortOptions, limit int) ([]processor.ProcessedMetric, error) {
+	s.mu.RLock()
+	result := make([]processor.ProcessedMetric, 0)
+	if q, ok := s.candidates(filter); ok {
+		for _, seq := range q.seqs() {
+			m := s.at(int(seq - s.base))
+			if filter.Match(m) {
+				result = append(result, *m)
+			}
+		}
+	} else {
+		for i := 0; i < s.count; i++ {
+			if m := s.at(i); filter.Match(m) {
+				result = append(result, *m)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	SortMetrics(result, opts)
+	if limit < 0 {
+		limit = 0
+	}
+	if len(result) > limit {
+		result = result[:limit]
+	}
 	return result, nil
 }
 
 // CleanExpired 清理过期数据
-func (s *MemoryStorage) CleanExpired() {
+func (s *MemoryStorage) CleanExpired() int {
+	expired, n := s.cleanExpired()
+	s.expiry.Notify(expired)
+	return n
+}
+
+// cleanExpired 删除过期数据并返回删除的条数，注册了过期回调时同时返回被删除的数据
+//
+// 导入的历史数据可能写在较新的数据之后，过期判断不依赖写入顺序：过期数据都在最前面时
+// 逐条移除，否则重建缓冲区。
+func (s *MemoryStorage) cleanExpired() ([]processor.ProcessedMetric, int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	now := time.Now()
+	now := s.clock.Now()
 	expiredTime := now.Add(-s.expireTime)
 
-	// 找到第一个未过期的索引
-	firstValidIdx := 0
-	for i, metric := range s.metrics {
-		if metric.Timestamp.After(expiredTime) {
-			firstValidIdx = i
-			break
+	// prefix为最前面连续过期的条数，removed为全部过期的条数
+	prefix, removed := 0, 0
+	for i := 0; i < s.count; i++ {
+		if s.at(i).Timestamp.After(expiredTime) {
+			continue
+		}
+		if prefix == i {
+			prefix++
 		}
+		removed++
+	}
+	if removed == 0 {
+		return nil, 0
 	}
 
-	// 删除过期数据
-	if firstValidIdx > 0 {
-		log.Printf("Cleaned %d expired metrics", firstValidIdx)
-		s.metrics = s.metrics[firstValidIdx:]
+	log.Printf("Cleaned %d expired metrics", removed)
+	var expired []processor.ProcessedMetric
+	if s.expiry.Enabled() {
+		expired = make([]processor.ProcessedMetric, 0, removed)
 	}
+	if prefix == removed {
+		for i := 0; i < removed; i++ {
+			if expired != nil {
+				expired = append(expired, *s.at(0))
+			}
+			s.evictOldest()
+		}
+		return expired, removed
+	}
+
+	keep := make([]bool, s.count)
+	for i := 0; i < s.count; i++ {
+		m := s.at(i)
+		if keep[i] = m.Timestamp.After(expiredTime); !keep[i] && expired != nil {
+			expired = append(expired, *m)
+		}
+	}
+	s.rebuild(keep, s.count-removed)
+	return expired, removed
+}
+
+// DeleteMetricsByAgentID 删除Agent的全部数据
+func (s *MemoryStorage) DeleteMetricsByAgentID(agentID string) (int, error) {
+	return s.deleteMatching(Filter{AgentID: agentID}), nil
+}
+
+// DeleteMetricsByType 删除指定类型的全部数据
+func (s *MemoryStorage) DeleteMetricsByType(metricType string) (int, error) {
+	return s.deleteMatching(Filter{Type: metricType}), nil
+}
+
+// DeleteMetricsByTimeRange 删除时间戳在[start, end]内的数据
+func (s *MemoryStorage) DeleteMetricsByTimeRange(start, end time.Time) (int, error) {
+	return s.deleteMatching(Filter{Start: start, End: end}), nil
+}
+
+// deleteMatching 删除满足过滤条件的数据，返回删除的条数
+func (s *MemoryStorage) deleteMatching(filter Filter) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keep := make([]bool, s.count)
+	removed := 0
+	for i := 0; i < s.count; i++ {
+		if filter.Match(s.at(i)) {
+			removed++
+		} else {
+			keep[i] = true
+		}
+	}
+	if removed > 0 {
+		s.rebuild(keep, s.count-removed)
+	}
+	return removed
 }
 
 // startCleanupTimer 启动定时清理计时器
 func (s *MemoryStorage) startCleanupTimer() {
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := s.clock.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			s.CleanExpired()
+			s.flushEvictions(true)
+		case <-s.stop:
+			return
 		}
 	}
 }
+
+// Close 停止定时清理，内存存储没有需要写出的数据
+func (s *MemoryStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+// OnEviction 注册因超出maxSize删除未过期数据时的事件回调
+func (s *MemoryStorage) OnEviction(hook func(EvictionEvent)) {
+	s.evictions.OnEviction(hook)
+}
+
+// OnExpire 注册按expire_time删除数据前的回调
+func (s *MemoryStorage) OnExpire(hook func([]processor.ProcessedMetric)) {
+	s.expiry.OnExpire(hook)
+}
+
+// flushEvictions 生成因容量不足删除数据的事件，force为false时按间隔合并
+func (s *MemoryStorage) flushEvictions(force bool) {
+	s.mu.RLock()
+	var retainedSince time.Time
+	if s.count > 0 {
+		retainedSince = s.at(0).Timestamp
+	}
+	s.mu.RUnlock()
+
+	s.evictions.Flush(s.clock.Now(), retainedSince, s.expireTime, force)
+}
+
+// at 返回从旧到新第i条数据，调用方需持有锁
+func (s *MemoryStorage) at(i int) *processor.ProcessedMetric {
+	return &s.buf[(s.head+i)%len(s.buf)]
+}
+
+// push 追加一条数据，缓冲区已满时先淘汰最旧的数据，调用方需持有写锁
+func (s *MemoryStorage) push(m *processor.ProcessedMetric) {
+	if s.count == len(s.buf) {
+		oldest := &s.buf[s.head]
+		s.evictions.Add(1, oldest.Timestamp, oldest.Timestamp, oldest.AgentID)
+		s.evictOldest()
+	}
+
+	seq := s.base + uint64(s.count)
+	s.count++
+	slot := s.at(s.count - 1)
+	*slot = *m
+	if s.payloads != nil {
+		slot.Payload = s.payloads.intern(m.Payload)
+	}
+	enqueue(s.byAgent, m.AgentID, seq)
+	enqueue(s.byType, m.Type, seq)
+}
+
+// rebuild 只保留keep中标记的数据，按原顺序重建环形缓冲区和索引，调用方需持有写锁
+func (s *MemoryStorage) rebuild(keep []bool, n int) {
+	kept := make([]processor.ProcessedMetric, 0, n)
+	var released [][]byte
+	for i := 0; i < s.count; i++ {
+		m := s.at(i)
+		if keep[i] {
+			kept = append(kept, *m)
+		}
+		if s.payloads != nil {
+			released = append(released, m.Payload)
+		}
+	}
+
+	clear(s.buf)
+	clear(s.byAgent)
+	clear(s.byType)
+	s.head, s.count = 0, 0
+	for i := range kept {
+		s.push(&kept[i])
+	}
+	// 保留的数据重新写入时已增加引用，最后释放重建前的全部引用
+	for _, p := range released {
+		s.payloads.release(p)
+	}
+}
+
+// evictOldest 删除最旧的一条数据并从索引中移除，调用方需持有写锁
+func (s *MemoryStorage) evictOldest() {
+	m := &s.buf[s.head]
+	dequeue(s.byAgent, m.AgentID)
+	dequeue(s.byType, m.Type)
+	if s.payloads != nil {
+		s.payloads.release(m.Payload)
+	}
+
+	// 释放标签和负载的引用
+	*m = processor.ProcessedMetric{}
+	s.head = (s.head + 1) % len(s.buf)
+	s.count--
+	s.base++
+}
+
+// collect 从新到旧返回序号队列中最多limit条数据，调用方需持有读锁
+func (s *MemoryStorage) collect(q *seqQueue, limit int) []processor.ProcessedMetric {
+	seqs := q.seqs()
+	if limit > len(seqs) {
+		limit = len(seqs)
+	}
+	if limit < 0 {
+		limit = 0
+	}
+
+	result := make([]processor.ProcessedMetric, 0, limit)
+	for i := len(seqs) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, *s.at(int(seqs[i] - s.base)))
+	}
+	return result
+}
+
+// candidates 返回可能满足过滤条件的数据序号，无法使用索引时返回false
+//
+// 同时指定Agent ID和类型时使用较短的队列。
+func (s *MemoryStorage) candidates(filter Filter) (*seqQueue, bool) {
+	switch {
+	case filter.AgentID != "" && filter.Type != "":
+		byAgent, byType := s.byAgent[filter.AgentID], s.byType[filter.Type]
+		if byType.len() < byAgent.len() {
+			return byType, true
+		}
+		return byAgent, true
+	case filter.AgentID != "":
+		return s.byAgent[filter.AgentID], true
+	case filter.Type != "":
+		return s.byType[filter.Type], true
+	}
+	return nil, false
+}
+
+// seqQueue 按升序保存序号的队列，出队只移动head，
+// 入队时底层数组已满且前部有空位则把数据移到前部，避免重新分配
+type seqQueue struct {
+	buf  []uint64
+	head int
+}
+
+// seqs 返回队列中的序号，nil队列返回nil
+func (q *seqQueue) seqs() []uint64 {
+	if q == nil {
+		return nil
+	}
+	return q.buf[q.head:]
+}
+
+// len 返回队列长度
+func (q *seqQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.buf) - q.head
+}
+
+// enqueue 向key对应的队列追加序号
+func enqueue(index map[string]*seqQueue, key string, seq uint64) {
+	q, ok := index[key]
+	if !ok {
+		q = &seqQueue{}
+		index[key] = q
+	}
+	if len(q.buf) == cap(q.buf) && q.head > 0 {
+		n := copy(q.buf, q.buf[q.head:])
+		q.buf = q.buf[:n]
+		q.head = 0
+	}
+	q.buf = append(q.buf, seq)
+}
+
+// dequeue 移除key对应队列中最旧的序号，队列为空时删除key
+func dequeue(index map[string]*seqQueue, key string) {
+	q := index[key]
+	if q.len() <= 1 {
+		delete(index, key)
+		return
+	}
+	q.head++
+}
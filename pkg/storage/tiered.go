@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// TieredStorage 冷热分层存储
+//
+// 最近hot_window内的数据保存在热存储(默认memory)，定时把更早的数据转移到冷存储(默认sqlite)。
+// 两层按时间戳严格划分：冷存储只保存早于boundary的数据，热存储只保存不早于boundary的数据，
+// 因此从新到旧的查询先读热存储，不足limit条时再用冷存储补足，时间范围查询只读涉及的层。
+// 关闭时热存储中的数据全部转移到冷存储。
+type TieredStorage struct {
+	// mu 转移数据时持有写锁，读写请求持有读锁，避免看到转移了一半的数据
+	mu        sync.RWMutex
+	hot       Storage
+	cold      Storage
+	clock     clock.Clock
+	hotWindow time.Duration
+	boundary  time.Time
+	closed    bool
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// newTieredStorage 按storage.tiered创建热存储和冷存储，并把热存储中已超出hot_window的数据转移到冷存储
+func newTieredStorage(cfg config.StorageConfig, clk clock.Clock) (Storage, error) {
+	tc := cfg.Tiered
+	if tc.HotWindow <= 0 || (cfg.ExpireTime > 0 && tc.HotWindow >= cfg.ExpireTime) {
+		return nil, fmt.Errorf("tiered hot_window %s must be positive and shorter than expire_time %s", tc.HotWindow, cfg.ExpireTime)
+	}
+	if tc.Hot == tc.Cold {
+		return nil, fmt.Errorf("tiered hot and cold backends must differ, both are %q", tc.Hot)
+	}
+	hotFactory, err := tierFactory(tc.Hot)
+	if err != nil {
+		return nil, err
+	}
+	coldFactory, err := tierFactory(tc.Cold)
+	if err != nil {
+		return nil, err
+	}
+
+	hotCfg := cfg
+	hotCfg.Type = tc.Hot
+	if tc.HotMaxSize > 0 {
+		hotCfg.MaxSize = tc.HotMaxSize
+	}
+	hot, err := hotFactory(hotCfg, clk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hot storage: %w", err)
+	}
+	coldCfg := cfg
+	coldCfg.Type = tc.Cold
+	cold, err := coldFactory(coldCfg, clk)
+	if err != nil {
+		hot.Close()
+		return nil, fmt.Errorf("failed to open cold storage: %w", err)
+	}
+
+	s := &TieredStorage{
+		hot:       hot,
+		cold:      cold,
+		clock:     clk,
+		hotWindow: tc.HotWindow,
+		stop:      make(chan struct{}),
+	}
+
+	// 上次关闭时热存储的数据已全部转移，冷存储中可能有hot_window内的数据，边界不能早于其中最新的数据
+	boundary := clk.Now().Add(-tc.HotWindow)
+	stats, err := cold.Stats()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to read cold storage stats: %w", err)
+	}
+	if stats.Newest != nil && !stats.Newest.Before(boundary) {
+		boundary = stats.Newest.Add(time.Nanosecond)
+	}
+	if err := s.spillBefore(boundary); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	go s.startSpillTimer(tc.SpillInterval)
+	return s, nil
+}
+
+// tierFactory 查找分层使用的存储后端
+func tierFactory(name string) (Factory, error) {
+	if name == "tiered" {
+		return nil, errors.New("tiered storage cannot be nested")
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown tiered backend %q", name)
+	}
+	return factory, nil
+}
+
+// SaveMetrics 早于边界的数据直接写入冷存储，其余写入热存储
+func (s *TieredStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	split := 0
+	for i := range metrics {
+		if metrics[i].Timestamp.Before(s.boundary) {
+			split++
+		}
+	}
+	if split == 0 {
+		return s.hot.SaveMetrics(metrics)
+	}
+	if split == len(metrics) {
+		return s.cold.SaveMetrics(metrics)
+	}
+
+	hot := make([]processor.ProcessedMetric, 0, len(metrics)-split)
+	cold := make([]processor.ProcessedMetric, 0, split)
+	for i := range metrics {
+		if metrics[i].Timestamp.Before(s.boundary) {
+			cold = append(cold, metrics[i])
+		} else {
+			hot = append(hot, metrics[i])
+		}
+	}
+	return errors.Join(s.hot.SaveMetrics(hot), s.cold.SaveMetrics(cold))
+}
+
+// GetMetricsByAgentID 先查热存储，不足limit条时用冷存储补足
+func (s *TieredStorage) GetMetricsByAgentID(agentID string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newestFirst(limit, func(st Storage, n int) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByAgentID(agentID, n)
+	})
+}
+
+// GetMetricsByType 先查热存储，不足limit条时用冷存储补足
+func (s *TieredStorage) GetMetricsByType(metricType string, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newestFirst(limit, func(st Storage, n int) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByType(metricType, n)
+	})
+}
+
+// GetLatestMetrics 返回最新的limit条数据，按时间从旧到新，热存储不足时在前面补上冷存储中最新的数据
+func (s *TieredStorage) GetLatestMetrics(limit int) ([]processor.ProcessedMetric, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	newer, err := s.hot.GetLatestMetrics(limit)
+	if err != nil || len(newer) >= limit {
+		return newer, err
+	}
+	older, err := s.cold.GetLatestMetrics(limit - len(newer))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]processor.ProcessedMetric, 0, len(older)+len(newer))
+	result = append(result, older...)
+	return append(result, newer...), nil
+}
+
+// GetMetricsByTimeRange 只查询与时间范围有交集的层，合并后从新到旧
+func (s *TieredStorage) GetMetricsByTimeRange(start, end time.Time, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newestFirst(limit, func(st Storage, n int) ([]processor.ProcessedMetric, error) {
+		if !s.overlaps(st, start, end) {
+			return nil, nil
+		}
+		return st.GetMetricsByTimeRange(start, end, n)
+	})
+}
+
+// GetMetricsByLabels 先查热存储，不足limit条时用冷存储补足
+func (s *TieredStorage) GetMetricsByLabels(matchers []*LabelMatcher, limit int) ([]processor.ProcessedMetric, error) {
+	return s.newestFirst(limit, func(st Storage, n int) ([]processor.ProcessedMetric, error) {
+		return st.GetMetricsByLabels(matchers, n)
+	})
+}
+
+// QuerySorted 在与时间范围有交集的层中排序截断后合并，再整体排序截断
+func (s *TieredStorage) QuerySorted(filter Filter, opts SortOptions, limit int) ([]processor.ProcessedMetric, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	merged := make([]processor.ProcessedMetric, 0)
+	for _, st := range []Storage{s.hot, s.cold} {
+		if !s.overlaps(st, filter.Start, filter.End) {
+			continue
+		}
+		sq, ok := st.(SortedQuerier)
+		if !ok {
+			return nil, errors.New("tiered backend does not support sorted queries")
+		}
+		metrics, err := sq.QuerySorted(filter, opts, limit)
+		if err != nil {
+			return nil, err
+		}
+		merged = append(merged, metrics...)
+	}
+	SortMetrics(merged, opts)
+	if limit >= 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
+
+// Aggregate 合并两层同一窗口的聚合结果，跨越边界的窗口平均值按样本数加权
+func (s *TieredStorage) Aggregate(q AggregateQuery) ([]AggregatePoint, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	results := make([][]AggregatePoint, 0, 2)
+	for _, st := range []Storage{s.hot, s.cold} {
+		if !s.overlaps(st, q.Start, q.End) {
+			continue
+		}
+		points, err := st.Aggregate(q)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, points)
+	}
+	return mergeAggregates(q, results...), nil
+}
+
+// DeleteMetricsByAgentID 在两层中删除Agent的数据
+func (s *TieredStorage) DeleteMetricsByAgentID(agentID string) (int, error) {
+	return s.deleteBoth(func(st Storage) (int, error) { return st.DeleteMetricsByAgentID(agentID) })
+}
+
+// DeleteMetricsByType 在两层中删除指定类型的数据
+func (s *TieredStorage) DeleteMetricsByType(metricType string) (int, error) {
+	return s.deleteBoth(func(st Storage) (int, error) { return st.DeleteMetricsByType(metricType) })
+}
+
+// DeleteMetricsByTimeRange 在两层中删除时间范围内的数据
+func (s *TieredStorage) DeleteMetricsByTimeRange(start, end time.Time) (int, error) {
+	return s.deleteBoth(func(st Storage) (int, error) { return st.DeleteMetricsByTimeRange(start, end) })
+}
+
+// Stats 汇总两层的统计，Tiers中是每一层的统计
+func (s *TieredStorage) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	total := Stats{
+		ByAgent: make(map[string]int),
+		ByType:  make(map[string]int),
+		Tiers:   make(map[string]Stats, 2),
+	}
+	for name, st := range map[string]Storage{"hot": s.hot, "cold": s.cold} {
+		stats, err := st.Stats()
+		if err != nil {
+			return total, fmt.Errorf("%s storage: %w", name, err)
+		}
+		total.Tiers[name] = stats
+		total.add(stats)
+	}
+	return total, nil
+}
+
+// CleanExpired 转移超出hot_window的数据后清理两层的过期数据
+func (s *TieredStorage) CleanExpired() int {
+	if err := s.spill(); err != nil {
+		log.Printf("Failed to spill metrics to cold storage: %v", err)
+	}
+	return s.hot.CleanExpired() + s.cold.CleanExpired()
+}
+
+// Compact 压缩支持压缩的层
+func (s *TieredStorage) Compact(mergeConflicts bool) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	removed := 0
+	for _, st := range []Storage{s.hot, s.cold} {
+		if c, ok := st.(Compactor); ok {
+			n, err := c.Compact(mergeConflicts)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// OnEviction 注册两层的淘汰事件回调
+func (s *TieredStorage) OnEviction(hook func(EvictionEvent)) {
+	for _, st := range []Storage{s.hot, s.cold} {
+		if n, ok := st.(EvictionNotifier); ok {
+			n.OnEviction(hook)
+		}
+	}
+}
+
+// OnExpire 注册两层按expire_time删除数据前的回调
+func (s *TieredStorage) OnExpire(hook func([]processor.ProcessedMetric)) {
+	for _, st := range []Storage{s.hot, s.cold} {
+		if n, ok := st.(ExpiryNotifier); ok {
+			n.OnExpire(hook)
+		}
+	}
+}
+
+// Close 把热存储中的数据全部转移到冷存储后关闭两层
+func (s *TieredStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var errs []error
+	stats, err := s.hot.Stats()
+	if err == nil && stats.Newest != nil {
+		err = s.spillBefore(stats.Newest.Add(time.Nanosecond))
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, s.hot.Close(), s.cold.Close())
+	return errors.Join(errs...)
+}
+
+// startSpillTimer 定时把超出hot_window的数据转移到冷存储
+func (s *TieredStorage) startSpillTimer(interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := s.spill(); err != nil {
+				log.Printf("Failed to spill metrics to cold storage: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// spill 把早于now-hot_window的数据转移到冷存储
+func (s *TieredStorage) spill() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	return s.spillBefore(s.clock.Now().Add(-s.hotWindow))
+}
+
+// spillBefore 把热存储中早于cutoff的数据写入冷存储后从热存储删除，并把边界移到cutoff，调用方需持有写锁
+func (s *TieredStorage) spillBefore(cutoff time.Time) error {
+	if !cutoff.After(s.boundary) {
+		return nil
+	}
+
+	stats, err := s.hot.Stats()
+	if err != nil {
+		return fmt.Errorf("failed to read hot storage stats: %w", err)
+	}
+	if stats.Oldest != nil && stats.Oldest.Before(cutoff) {
+		end := cutoff.Add(-time.Nanosecond)
+		metrics, err := s.hot.GetMetricsByTimeRange(time.Time{}, end, stats.Total)
+		if err != nil {
+			return fmt.Errorf("failed to read metrics to spill: %w", err)
+		}
+		// 热存储从新到旧返回，按写入顺序保存到冷存储
+		slices.Reverse(metrics)
+		if err := s.cold.SaveMetrics(metrics); err != nil {
+			return fmt.Errorf("failed to save metrics to cold storage: %w", err)
+		}
+		if _, err := s.hot.DeleteMetricsByTimeRange(time.Time{}, end); err != nil {
+			return fmt.Errorf("failed to delete spilled metrics from hot storage: %w", err)
+		}
+		log.Printf("Spilled %d metrics older than %s to cold storage", len(metrics), cutoff.Format(time.RFC3339))
+	}
+	s.boundary = cutoff
+	return nil
+}
+
+// overlaps 判断时间范围是否可能包含st中的数据，start和end为零值表示不限制
+func (s *TieredStorage) overlaps(st Storage, start, end time.Time) bool {
+	if st == s.hot {
+		return end.IsZero() || !end.Before(s.boundary)
+	}
+	return start.IsZero() || start.Before(s.boundary)
+}
+
+// newestFirst 先查询热存储，不足limit条时用冷存储中更早的数据补足
+func (s *TieredStorage) newestFirst(limit int, fetch func(st Storage, limit int) ([]processor.ProcessedMetric, error)) ([]processor.ProcessedMetric, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	newer, err := fetch(s.hot, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(newer) >= limit {
+		return newer, nil
+	}
+	older, err := fetch(s.cold, limit-len(newer))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]processor.ProcessedMetric, 0, len(newer)+len(older))
+	result = append(result, newer...)
+	return append(result, older...), nil
+}
+
+// deleteBoth 在两层中执行删除并汇总删除的条数
+func (s *TieredStorage) deleteBoth(del func(Storage) (int, error)) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deleted := 0
+	for _, st := range []Storage{s.hot, s.cold} {
+		n, err := del(st)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,505 @@
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/protocol"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/record"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/serialization"
+)
+
+// segmentExt 日志段文件扩展名
+const segmentExt = ".wal"
+
+// Options WAL选项
+type Options struct {
+	// Dir 日志段所在目录
+	Dir string
+	// SegmentSize 单个日志段达到该大小后切换到新段
+	SegmentSize int64
+	// Sync 每次追加后是否fsync
+	Sync bool
+	// MaxRecords 与Retention一起决定何时删除旧日志段，应与存储的MaxSize一致
+	MaxRecords int
+	// Retention 最新数据早于该时长的日志段会被删除，应与存储的ExpireTime一致
+	Retention time.Duration
+	// Clock 判断数据是否过期使用的时钟
+	Clock clock.Clock
+	// Codec 新日志段使用的压缩算法，nil表示不压缩
+	Codec codec.Codec
+	// Format 新日志段中批次的序列化格式，nil表示protobuf
+	Format serialization.Format
+	// ReplayDelete 回放删除记录，nil表示忽略删除记录
+	ReplayDelete func(Deletion) error
+}
+
+// Deletion 删除操作，零值字段表示不限制，回放时按写入顺序应用
+type Deletion struct {
+	AgentID string    `json:"agent_id,omitempty"`
+	Type    string    `json:"type,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// 版本1及以后的日志段中每条记录的第一个字节，之后是压缩后的记录内容
+const (
+	kindBatch  byte = 1
+	kindDelete byte = 2
+)
+
+// deleteRecord 删除记录，JSON编码，版本0的日志段中与批次记录(JSON数组)通过首字节区分
+type deleteRecord struct {
+	Delete Deletion `json:"delete"`
+}
+
+// entry 版本0的日志段中批次记录的单个指标
+//
+// 段头没有版本号的旧日志段中批次是entry的JSON数组，没有段头的更早的日志段中批次未压缩。
+type entry struct {
+	AgentID   string            `json:"a"`
+	Timestamp int64             `json:"t"`
+	Name      string            `json:"n"`
+	Value     float64           `json:"v"`
+	Labels    map[string]string `json:"l,omitempty"`
+	Type      string            `json:"y"`
+	RawType   int32             `json:"r"`
+	Payload   []byte            `json:"p,omitempty"`
+}
+
+// segment 日志段状态
+type segment struct {
+	id      uint64
+	path    string
+	size    int64
+	metrics int
+	maxTime time.Time
+}
+
+// WAL 以带校验和的记录追加写入指标批次的预写日志，启动时按顺序回放
+//
+// 每个日志段的第一条记录是段头，记录版本、压缩算法和序列化格式，之后每个批次是一条记录。
+// 旧日志段在其中的数据已超出MaxRecords或Retention后删除，因此回放得到的数据不少于内存存储中保留的数据。
+type WAL struct {
+	mu       sync.Mutex
+	opts     Options
+	segments []*segment
+	file     *os.File
+	writer   *record.Writer
+}
+
+// Open 打开dir下的WAL，先按顺序回放已有日志段，再创建新段用于追加
+//
+// 损坏的记录会被跳过并写入日志，不会导致启动失败。
+func Open(opts Options, replay func([]processor.ProcessedMetric) error) (*WAL, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+
+	if opts.Codec == nil {
+		opts.Codec, _ = codec.Get(codec.None)
+	}
+	if opts.Format == nil {
+		opts.Format, _ = serialization.Get(serialization.Protobuf)
+	}
+
+	w := &WAL{opts: opts}
+	ids, err := listSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	replayed := 0
+	for _, id := range ids {
+		seg, err := w.replaySegment(id, replay)
+		if err != nil {
+			return nil, err
+		}
+		w.segments = append(w.segments, seg)
+		replayed += seg.metrics
+	}
+	if len(ids) > 0 {
+		log.Printf("Replayed %d metrics from %d wal segments", replayed, len(ids))
+	}
+
+	// 不向可能写入不完整的旧段追加，总是从新段开始
+	var next uint64 = 1
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+	w.truncate()
+	return w, nil
+}
+
+// Append 追加一个批次
+func (w *WAL) Append(metrics []processor.ProcessedMetric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	chunk := &protocol.MetricSnapshot{Metrics: make([]*protocol.StoredMetric, len(metrics))}
+	var maxTime time.Time
+	for i := range metrics {
+		m := &metrics[i]
+		chunk.Metrics[i] = serialization.ToStored(m)
+		if m.Timestamp.After(maxTime) {
+			maxTime = m.Timestamp
+		}
+	}
+	data, err := w.opts.Format.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	if data, err = w.encode(kindBatch, data); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to append to wal: %w", err)
+	}
+	if w.opts.Sync {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync wal: %w", err)
+		}
+	}
+
+	seg := w.segments[len(w.segments)-1]
+	seg.size += int64(len(data)) + 8
+	seg.metrics += len(metrics)
+	if maxTime.After(seg.maxTime) {
+		seg.maxTime = maxTime
+	}
+
+	if w.opts.SegmentSize > 0 && seg.size >= w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendDelete 追加删除记录，使回放时不会恢复已删除的数据
+func (w *WAL) AppendDelete(d Deletion) error {
+	data, err := json.Marshal(deleteRecord{Delete: d})
+	if err != nil {
+		return err
+	}
+	if data, err = w.encode(kindDelete, data); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to append to wal: %w", err)
+	}
+	if w.opts.Sync {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync wal: %w", err)
+		}
+	}
+	w.segments[len(w.segments)-1].size += int64(len(data)) + 8
+	return nil
+}
+
+// encode 压缩记录内容并加上记录类型
+func (w *WAL) encode(kind byte, data []byte) ([]byte, error) {
+	data, err := codec.Compress(w.opts.Codec, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress wal record: %w", err)
+	}
+	return append([]byte{kind}, data...), nil
+}
+
+// Size 返回所有日志段的总大小
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var size int64
+	for _, seg := range w.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// Close 同步并关闭当前日志段
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
+
+// rotate 关闭当前段并创建新段，调用方需持有锁
+func (w *WAL) rotate() error {
+	current := w.segments[len(w.segments)-1]
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close wal segment: %w", err)
+	}
+	if err := w.openSegment(current.id + 1); err != nil {
+		return err
+	}
+	w.truncate()
+	return nil
+}
+
+// openSegment 创建新的日志段并设为当前段
+func (w *WAL) openSegment(id uint64) error {
+	path := segmentPath(w.opts.Dir, id)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment: %w", err)
+	}
+
+	h := serialization.NewHeader(w.opts.Format)
+	h.Codec = w.opts.Codec.Name()
+	data := h.Marshal()
+	writer := record.NewWriter(file)
+	if err := writer.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write wal segment header: %w", err)
+	}
+
+	w.file = file
+	w.writer = writer
+	w.segments = append(w.segments, &segment{id: id, path: path, size: int64(len(data)) + 8})
+	return nil
+}
+
+// truncate 删除数据已全部超出保留范围的旧段，当前段始终保留，调用方需持有锁
+func (w *WAL) truncate() {
+	var expiredBefore time.Time
+	if w.opts.Retention > 0 && w.opts.Clock != nil {
+		expiredBefore = w.opts.Clock.Now().Add(-w.opts.Retention)
+	}
+
+	// 从新到旧累计数据量，更新的段已经足够MaxRecords条时旧段可以删除
+	newer := w.segments[len(w.segments)-1].metrics
+	keepFrom := len(w.segments) - 1
+	for i := len(w.segments) - 2; i >= 0; i-- {
+		seg := w.segments[i]
+		if w.opts.MaxRecords > 0 && newer >= w.opts.MaxRecords {
+			break
+		}
+		if !expiredBefore.IsZero() && !seg.maxTime.After(expiredBefore) {
+			break
+		}
+		newer += seg.metrics
+		keepFrom = i
+	}
+
+	for _, seg := range w.segments[:keepFrom] {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove wal segment %s: %v", seg.path, err)
+		}
+	}
+	w.segments = append([]*segment(nil), w.segments[keepFrom:]...)
+}
+
+// replaySegment 读取一个日志段并把其中的批次交给replay
+func (w *WAL) replaySegment(id uint64, replay func([]processor.ProcessedMetric) error) (*segment, error) {
+	path := segmentPath(w.opts.Dir, id)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	defer file.Close()
+
+	seg := &segment{id: id, path: path}
+	reader := record.NewReader(file)
+	segCodec, _ := codec.Get(codec.None)
+	var h serialization.Header
+	var format serialization.Format
+	first := true
+	for {
+		data, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read wal segment %s: %w", path, err)
+		}
+
+		if first {
+			first = false
+			var ok bool
+			if h, ok, err = serialization.ParseHeader(data); ok {
+				if err == nil {
+					segCodec, err = codec.Get(h.Codec)
+				}
+				if err == nil && h.Version > 0 {
+					format, err = serialization.Get(h.Format)
+				}
+				if err != nil {
+					log.Printf("Skipping wal segment %s: %v", path, err)
+					break
+				}
+				continue
+			}
+		}
+
+		var metrics []processor.ProcessedMetric
+		var del *Deletion
+		if h.Version == 0 {
+			metrics, del, err = decodeLegacy(segCodec, data)
+		} else {
+			metrics, del, err = decode(segCodec, format, data)
+		}
+		if err != nil {
+			log.Printf("Skipping undecodable wal record in %s: %v", path, err)
+			continue
+		}
+
+		if del != nil {
+			if w.opts.ReplayDelete != nil {
+				if err := w.opts.ReplayDelete(*del); err != nil {
+					return nil, fmt.Errorf("failed to replay wal segment %s: %w", path, err)
+				}
+			}
+			continue
+		}
+
+		for i := range metrics {
+			if metrics[i].Timestamp.After(seg.maxTime) {
+				seg.maxTime = metrics[i].Timestamp
+			}
+		}
+		if err := replay(metrics); err != nil {
+			return nil, fmt.Errorf("failed to replay wal segment %s: %w", path, err)
+		}
+		seg.metrics += len(metrics)
+	}
+	seg.size = reader.Offset()
+
+	for _, c := range reader.Corruptions() {
+		log.Printf("WAL segment %s: skipped %v", path, c)
+	}
+	return seg, nil
+}
+
+// decode 解码版本1及以后的日志段中的记录，返回批次中的指标或删除操作
+func decode(c codec.Codec, format serialization.Format, data []byte) ([]processor.ProcessedMetric, *Deletion, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("empty record")
+	}
+	kind := data[0]
+	data, err := codec.Decompress(c, data[1:], 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch kind {
+	case kindBatch:
+		var chunk protocol.MetricSnapshot
+		if err := format.Unmarshal(data, &chunk); err != nil {
+			return nil, nil, err
+		}
+		metrics := make([]processor.ProcessedMetric, len(chunk.Metrics))
+		for i, stored := range chunk.Metrics {
+			metrics[i] = serialization.FromStored(stored)
+		}
+		return metrics, nil, nil
+	case kindDelete:
+		var rec deleteRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, nil, err
+		}
+		return nil, &rec.Delete, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown record kind %d", kind)
+	}
+}
+
+// decodeLegacy 解码版本0的日志段中的记录，批次是entry的JSON数组，删除记录是JSON对象
+func decodeLegacy(c codec.Codec, data []byte) ([]processor.ProcessedMetric, *Deletion, error) {
+	data, err := codec.Decompress(c, data, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(data) > 0 && data[0] == '{' {
+		var rec deleteRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, nil, err
+		}
+		return nil, &rec.Delete, nil
+	}
+
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, nil, err
+	}
+	metrics := make([]processor.ProcessedMetric, len(entries))
+	for i, e := range entries {
+		metrics[i] = processor.ProcessedMetric{
+			AgentID:   e.AgentID,
+			Timestamp: time.Unix(0, e.Timestamp),
+			Name:      e.Name,
+			Value:     e.Value,
+			Labels:    e.Labels,
+			Type:      e.Type,
+			RawType:   protocol.MetricType(e.RawType),
+			Payload:   e.Payload,
+		}
+	}
+	return metrics, nil, nil
+}
+
+// listSegments 返回目录下日志段的编号，按从旧到新排序
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wal directory: %w", err)
+	}
+
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// segmentPath 返回日志段文件路径
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", id, segmentExt))
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/codec"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/serialization"
+	"github.com/konpure/Kon-Agent-export/pkg/storage/wal"
+)
+
+// walMemoryStorage 写入内存前先追加到预写日志的内存存储，重启后从日志恢复数据
+type walMemoryStorage struct {
+	*MemoryStorage
+	wal *wal.WAL
+}
+
+// newWALMemoryStorage 打开预写日志并回放到内存存储
+func newWALMemoryStorage(mem *MemoryStorage, cfg config.StorageConfig, clk clock.Clock) (Storage, error) {
+	dir := cfg.WAL.Dir
+	if dir == "" {
+		dir = filepath.Join(cfg.FilePath, "wal")
+	}
+
+	c, err := codec.Get(cfg.WAL.Compression)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+	format, err := serialization.Get(cfg.Serialization)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+
+	w, err := wal.Open(wal.Options{
+		Dir:         dir,
+		SegmentSize: cfg.WAL.SegmentSize,
+		Sync:        cfg.WAL.Sync,
+		MaxRecords:  cfg.MaxSize,
+		Retention:   cfg.ExpireTime,
+		Clock:       clk,
+		Codec:       c,
+		Format:      format,
+		ReplayDelete: func(d wal.Deletion) error {
+			mem.deleteMatching(Filter{AgentID: d.AgentID, Type: d.Type, Start: d.Start, End: d.End})
+			return nil
+		},
+	}, mem.SaveMetrics)
+	if err != nil {
+		mem.Close()
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	// 回放的数据中可能有已过期的部分
+	mem.CleanExpired()
+
+	return &walMemoryStorage{MemoryStorage: mem, wal: w}, nil
+}
+
+// SaveMetrics 先写预写日志再写内存
+func (s *walMemoryStorage) SaveMetrics(metrics []processor.ProcessedMetric) error {
+	if err := s.wal.Append(metrics); err != nil {
+		return err
+	}
+	return s.MemoryStorage.SaveMetrics(metrics)
+}
+
+// DeleteMetricsByAgentID 记录删除操作后删除Agent的全部数据
+func (s *walMemoryStorage) DeleteMetricsByAgentID(agentID string) (int, error) {
+	return s.delete(Filter{AgentID: agentID})
+}
+
+// DeleteMetricsByType 记录删除操作后删除指定类型的全部数据
+func (s *walMemoryStorage) DeleteMetricsByType(metricType string) (int, error) {
+	return s.delete(Filter{Type: metricType})
+}
+
+// DeleteMetricsByTimeRange 记录删除操作后删除时间戳在[start, end]内的数据
+func (s *walMemoryStorage) DeleteMetricsByTimeRange(start, end time.Time) (int, error) {
+	return s.delete(Filter{Start: start, End: end})
+}
+
+// delete 先向预写日志追加删除记录，避免重启回放时恢复已删除的数据
+func (s *walMemoryStorage) delete(filter Filter) (int, error) {
+	if err := s.wal.AppendDelete(wal.Deletion{AgentID: filter.AgentID, Type: filter.Type, Start: filter.Start, End: filter.End}); err != nil {
+		return 0, err
+	}
+	return s.MemoryStorage.deleteMatching(filter), nil
+}
+
+// Stats 内存存储的统计，磁盘占用为预写日志的大小
+func (s *walMemoryStorage) Stats() (Stats, error) {
+	stats, err := s.MemoryStorage.Stats()
+	stats.DiskBytes = s.wal.Size()
+	return stats, err
+}
+
+// Close 停止内存存储并同步关闭预写日志
+func (s *walMemoryStorage) Close() error {
+	s.MemoryStorage.Close()
+	return s.wal.Close()
+}
@@ -0,0 +1,177 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// ErrTooManySubscribers 订阅者数量已达上限
+var ErrTooManySubscribers = errors.New("too many stream subscribers")
+
+// Filter 订阅条件，空字段匹配所有
+type Filter struct {
+	AgentID string
+	Name    string
+	Type    string
+}
+
+// Match 判断指标是否满足订阅条件
+func (f *Filter) Match(m *processor.ProcessedMetric) bool {
+	return (f.AgentID == "" || m.AgentID == f.AgentID) &&
+		(f.Name == "" || m.Name == f.Name) &&
+		(f.Type == "" || m.Type == f.Type)
+}
+
+// Event 带序号的指标，序号从1开始按发布顺序递增，服务器重启后重新计数
+type Event struct {
+	ID     uint64
+	Metric processor.ProcessedMetric
+}
+
+// Subscription 一个订阅者，从C读取满足条件的指标
+type Subscription struct {
+	C <-chan Event
+
+	ch      chan Event
+	filter  Filter
+	dropped atomic.Uint64
+}
+
+// Dropped 返回因订阅者读取过慢而丢弃的指标数
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Hub 把接入的指标分发给订阅者
+//
+// 发布不会阻塞接入路径，订阅者的缓冲区满时丢弃该订阅者的新指标。
+// 最近发布的指标保存在重放缓冲区中，断线重连的订阅者可以从上次收到的序号继续。
+type Hub struct {
+	mu             sync.RWMutex
+	buffer         int
+	maxSubscribers int
+	subs           map[*Subscription]struct{}
+	seq            uint64
+	replay         []Event
+	replayHead     int
+}
+
+// NewHub 创建分发器
+func NewHub(cfg config.StreamConfig) *Hub {
+	return &Hub{
+		buffer:         cfg.Buffer,
+		maxSubscribers: cfg.MaxSubscribers,
+		subs:           make(map[*Subscription]struct{}),
+		replay:         make([]Event, 0, max(cfg.Replay, 0)),
+	}
+}
+
+// Subscribe 按条件订阅，用完后需调用Unsubscribe
+func (h *Hub) Subscribe(filter Filter) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.subscribe(filter)
+}
+
+// Resume 按条件订阅，并返回重放缓冲区中序号大于lastID且满足条件的指标
+//
+// 重放和订阅在同一把锁内完成，重放的指标与之后从C读到的指标不重复也不遗漏。
+// 序号lastID之后的指标已有部分被移出重放缓冲区时complete为false；
+// lastID大于当前序号说明服务器已重启，返回缓冲区中的全部指标。
+func (h *Hub) Resume(filter Filter, lastID uint64) (sub *Subscription, replay []Event, complete bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sub, err = h.subscribe(filter); err != nil {
+		return nil, nil, false, err
+	}
+
+	if lastID > h.seq {
+		lastID, complete = 0, false
+	} else {
+		complete = h.oldest() <= lastID+1
+	}
+	for i := range h.replay {
+		ev := &h.replay[(h.replayHead+i)%len(h.replay)]
+		if ev.ID > lastID && filter.Match(&ev.Metric) {
+			replay = append(replay, *ev)
+		}
+	}
+	return sub, replay, complete, nil
+}
+
+// subscribe 添加订阅者，调用方需持有写锁
+func (h *Hub) subscribe(filter Filter) (*Subscription, error) {
+	if h.maxSubscribers > 0 && len(h.subs) >= h.maxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+	ch := make(chan Event, h.buffer)
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+	h.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// oldest 返回重放缓冲区中最早的序号，缓冲区为空时为下一个序号
+func (h *Hub) oldest() uint64 {
+	if len(h.replay) == 0 {
+		return h.seq + 1
+	}
+	return h.replay[h.replayHead].ID
+}
+
+// record 把指标加入重放缓冲区，缓冲区已满时覆盖最早的指标
+func (h *Hub) record(ev Event) {
+	if cap(h.replay) == 0 {
+		return
+	}
+	if len(h.replay) < cap(h.replay) {
+		h.replay = append(h.replay, ev)
+		return
+	}
+	h.replay[h.replayHead] = ev
+	h.replayHead = (h.replayHead + 1) % len(h.replay)
+}
+
+// Unsubscribe 取消订阅并关闭订阅者的通道
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Subscribers 返回当前订阅者数量
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+// Publish 为一批写入存储的指标分配序号并分发给满足条件的订阅者，应在数据写入存储后调用
+func (h *Hub) Publish(metrics []processor.ProcessedMetric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range metrics {
+		h.seq++
+		ev := Event{ID: h.seq, Metric: metrics[i]}
+		h.record(ev)
+		for sub := range h.subs {
+			if !sub.filter.Match(&ev.Metric) {
+				continue
+			}
+			select {
+			case sub.ch <- ev:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package timeline 按Agent记录连接、断开、身份校验失败和接入错误事件以及每个时间段写入的批次数，
+// 一次查询即可按时间顺序查看Agent在一段时间内的活动
+package timeline
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+)
+
+// ErrInvalidRange 查询的时间范围无效
+var ErrInvalidRange = errors.New("invalid time range")
+
+// 事件类型
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventAuthFailed   = "auth_failed"
+	EventIngestError  = "ingest_error"
+	// EventQuotaWarning 超出只告警的配额，EventQuotaExceeded 超出配额的数据被拒绝
+	EventQuotaWarning  = "quota_warning"
+	EventQuotaExceeded = "quota_exceeded"
+	// EventAlert 告警事件，由查询方合并SLA等告警记录时使用
+	EventAlert = "alert"
+)
+
+// Event 一个活动事件
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// Interval 一个时间段内写入存储的批次数和指标数
+type Interval struct {
+	Start   time.Time `json:"start"`
+	Batches uint64    `json:"batches"`
+	Metrics uint64    `json:"metrics"`
+}
+
+// Timeline 单个Agent在查询范围内的活动，Events按时间排序，Batches包含范围内的每个时间段
+type Timeline struct {
+	AgentID  string     `json:"agent_id"`
+	Start    time.Time  `json:"start"`
+	End      time.Time  `json:"end"`
+	Interval string     `json:"interval"`
+	Events   []Event    `json:"events"`
+	Batches  []Interval `json:"batches"`
+}
+
+// bucket 一个时间段的计数，slot为时间段序号，按序号对保留的时间段数取模存放
+type bucket struct {
+	slot    int64
+	batches uint64
+	metrics uint64
+}
+
+// history 单个Agent的事件和计数
+type history struct {
+	events  []Event
+	buckets []bucket
+	last    time.Time
+}
+
+// Recorder 记录各Agent的活动
+//
+// 事件和计数保留retention，每个Agent最多保留max_events个事件，超出时丢弃最旧的事件。
+// 保留时间内没有活动的Agent在下一个时间段开始时删除。
+type Recorder struct {
+	mu        sync.Mutex
+	clock     clock.Clock
+	interval  time.Duration
+	retention time.Duration
+	slots     int64
+	maxEvents int
+	agents    map[string]*history
+	pruned    int64
+}
+
+// NewRecorder 创建活动记录器
+func NewRecorder(cfg config.TimelineConfig, clk clock.Clock) *Recorder {
+	interval := max(cfg.Interval, time.Second)
+	return &Recorder{
+		clock:     clk,
+		interval:  interval,
+		retention: cfg.Retention,
+		slots:     max(int64(cfg.Retention/interval), 1),
+		maxEvents: cfg.MaxEvents,
+		agents:    make(map[string]*history),
+	}
+}
+
+// Observe 按Agent统计写入存储的一批数据，应在数据写入存储后调用
+func (r *Recorder) Observe(metrics []processor.ProcessedMetric) {
+	now := r.clock.Now()
+	slot := r.slot(now)
+
+	counts := make(map[string]uint64)
+	for i := range metrics {
+		if id := metrics[i].AgentID; id != "" {
+			counts[id]++
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(now, slot)
+	for id, n := range counts {
+		h := r.history(id, now)
+		b := &h.buckets[slot%r.slots]
+		if b.slot != slot {
+			*b = bucket{slot: slot}
+		}
+		b.batches++
+		b.metrics += n
+	}
+}
+
+// Record 记录Agent的一个事件
+func (r *Recorder) Record(agentID, eventType, remoteAddr, detail string) {
+	if agentID == "" {
+		return
+	}
+	now := r.clock.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(now, r.slot(now))
+	h := r.history(agentID, now)
+	if len(h.events) >= r.maxEvents {
+		h.events = append(h.events[:0], h.events[len(h.events)-r.maxEvents+1:]...)
+	}
+	h.events = append(h.events, Event{Time: now, Type: eventType, RemoteAddr: remoteAddr, Detail: detail})
+}
+
+// IngestFailed 记录Agent的数据处理或写入失败，用作接入错误钩子
+func (r *Recorder) IngestFailed(agentID string) {
+	r.Record(agentID, EventIngestError, "", "failed to process or store data")
+}
+
+// Timeline 返回Agent在[start, end)内的活动，范围超出保留时间的部分不输出，Agent没有记录时ok为false
+func (r *Recorder) Timeline(agentID string, start, end time.Time) (Timeline, bool, error) {
+	if !start.Before(end) {
+		return Timeline{}, false, ErrInvalidRange
+	}
+	now := r.clock.Now()
+	if oldest := now.Add(-r.retention); start.Before(oldest) {
+		start = oldest
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.agents[agentID]
+	if !ok || now.Sub(h.last) > r.retention {
+		return Timeline{}, false, nil
+	}
+
+	tl := Timeline{AgentID: agentID, Start: start, End: end, Interval: r.interval.String(), Events: []Event{}, Batches: []Interval{}}
+	for _, e := range h.events {
+		if !e.Time.Before(start) && e.Time.Before(end) {
+			tl.Events = append(tl.Events, e)
+		}
+	}
+	current := r.slot(now)
+	for slot := r.slot(start); slot <= r.slot(end.Add(-1)) && slot <= current; slot++ {
+		iv := Interval{Start: time.Unix(0, slot*int64(r.interval))}
+		if b := h.buckets[slot%r.slots]; b.slot == slot {
+			iv.Batches, iv.Metrics = b.batches, b.metrics
+		}
+		tl.Batches = append(tl.Batches, iv)
+	}
+	return tl, true, nil
+}
+
+// history 返回Agent的记录，不存在时创建，调用方需持有锁
+func (r *Recorder) history(agentID string, now time.Time) *history {
+	h, ok := r.agents[agentID]
+	if !ok {
+		h = &history{buckets: make([]bucket, r.slots)}
+		r.agents[agentID] = h
+	}
+	h.last = now
+	return h
+}
+
+// prune 每个时间段开始时删除过期的事件和保留时间内没有活动的Agent，调用方需持有锁
+func (r *Recorder) prune(now time.Time, slot int64) {
+	if slot == r.pruned {
+		return
+	}
+	r.pruned = slot
+	oldest := now.Add(-r.retention)
+	for id, h := range r.agents {
+		if h.last.Before(oldest) {
+			delete(r.agents, id)
+			continue
+		}
+		i := 0
+		for i < len(h.events) && h.events[i].Time.Before(oldest) {
+			i++
+		}
+		h.events = h.events[i:]
+	}
+}
+
+// slot 返回时间所在的时间段序号
+func (r *Recorder) slot(t time.Time) int64 {
+	return t.UnixNano() / int64(r.interval)
+}
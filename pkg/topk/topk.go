@@ -0,0 +1,244 @@
+package topk
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// AgentIDLabel 规则的标签为agent_id时按Agent统计
+const AgentIDLabel = "agent_id"
+
+// ErrNotTracked 查询的指标和标签没有匹配的规则或还没有数据
+var ErrNotTracked = errors.New("metric and label are not tracked")
+
+// Item 一个标签值的统计结果
+//
+// Sum为值的累计，可能高估但不会低估，真实值不小于Sum-Error；Samples为样本数，同样可能高估。
+type Item struct {
+	Value   string  `json:"value"`
+	Sum     float64 `json:"sum"`
+	Error   float64 `json:"error"`
+	Samples int     `json:"samples"`
+}
+
+// Result Top-K查询结果，Approximate为true表示有计数器被替换，结果是近似值
+type Result struct {
+	Metric      string    `json:"metric"`
+	Label       string    `json:"label"`
+	WindowStart time.Time `json:"window_start"`
+	Approximate bool      `json:"approximate"`
+	Capacity    int       `json:"capacity"`
+	Total       float64   `json:"total"`
+	Items       []Item    `json:"items"`
+}
+
+// counter Space-Saving算法的计数器
+type counter struct {
+	Item
+	index int
+}
+
+// summary 单个指标和标签组合的Space-Saving摘要，最多保留capacity个计数器
+//
+// 计数器已满时新值替换累计最小的计数器并继承其累计值，被继承的部分记为误差，
+// 因此累计最大的标签值总能保留，内存与标签基数无关。
+type summary struct {
+	capacity int
+	counters map[string]*counter
+	heap     counterHeap
+	total    float64
+	replaced bool
+}
+
+// newSummary 创建摘要
+func newSummary(capacity int) *summary {
+	return &summary{capacity: capacity, counters: make(map[string]*counter, capacity)}
+}
+
+// add 累计一个标签值的权重
+func (s *summary) add(value string, weight float64) {
+	s.total += weight
+	if c, ok := s.counters[value]; ok {
+		c.Sum += weight
+		c.Samples++
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+
+	if len(s.counters) < s.capacity {
+		c := &counter{Item: Item{Value: value, Sum: weight, Samples: 1}}
+		s.counters[value] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+
+	// 替换累计最小的计数器
+	c := s.heap[0]
+	delete(s.counters, c.Value)
+	s.replaced = true
+	c.Item = Item{Value: value, Sum: c.Sum + weight, Error: c.Sum, Samples: c.Samples + 1}
+	s.counters[value] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// top 返回累计最大的k个标签值
+func (s *summary) top(k int) []Item {
+	items := make([]Item, 0, len(s.counters))
+	for _, c := range s.counters {
+		items = append(items, c.Item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Sum != items[j].Sum {
+			return items[i].Sum > items[j].Sum
+		}
+		return items[i].Value < items[j].Value
+	})
+	if k > 0 && len(items) > k {
+		items = items[:k]
+	}
+	return items
+}
+
+// counterHeap 按累计值排列的最小堆
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].Sum < h[j].Sum }
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// key 指标名和标签的组合
+type key struct {
+	metric string
+	label  string
+}
+
+// Tracker 按规则统计指标在标签各取值上的累计值，回答"全网CPU最高的20个进程"这类查询
+//
+// 统计按固定窗口进行，窗口结束后从零开始，上一个窗口的结果仍可查询。
+// 数据只保存在内存中，重启后丢失。
+type Tracker struct {
+	mu          sync.Mutex
+	clock       clock.Clock
+	rules       []config.TopKRule
+	capacity    int
+	window      time.Duration
+	windowStart time.Time
+	current     map[key]*summary
+	previous    map[key]*summary
+	prevStart   time.Time
+}
+
+// NewTracker 创建Top-K统计
+func NewTracker(cfg config.TopKConfig, clk clock.Clock) *Tracker {
+	return &Tracker{
+		clock:       clk,
+		rules:       cfg.Rules,
+		capacity:    cfg.Capacity,
+		window:      cfg.Window,
+		windowStart: clk.Now(),
+		current:     make(map[key]*summary),
+	}
+}
+
+// Observe 统计写入的数据，值为负数或NaN的样本被忽略
+func (t *Tracker) Observe(metrics []processor.ProcessedMetric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate()
+	for i := range metrics {
+		m := &metrics[i]
+		if m.Value < 0 || math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		for _, rule := range t.rules {
+			if !storage.MatchGlob(rule.Metric, m.Name) {
+				continue
+			}
+			value, ok := m.Labels[rule.Label]
+			if rule.Label == AgentIDLabel && !ok {
+				value, ok = m.AgentID, true
+			}
+			if !ok {
+				continue
+			}
+
+			k := key{metric: m.Name, label: rule.Label}
+			s, ok := t.current[k]
+			if !ok {
+				s = newSummary(t.capacity)
+				t.current[k] = s
+			}
+			s.add(value, m.Value)
+		}
+	}
+}
+
+// Query 返回指标在标签上累计最大的k个取值，previous为true时查询上一个完整窗口
+func (t *Tracker) Query(metric, label string, k int, previous bool) (*Result, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rotate()
+	summaries, start := t.current, t.windowStart
+	if previous {
+		summaries, start = t.previous, t.prevStart
+	}
+	s, ok := summaries[key{metric: metric, label: label}]
+	if !ok {
+		return nil, ErrNotTracked
+	}
+
+	return &Result{
+		Metric:      metric,
+		Label:       label,
+		WindowStart: start,
+		Approximate: s.replaced,
+		Capacity:    s.capacity,
+		Total:       s.total,
+		Items:       s.top(k),
+	}, nil
+}
+
+// rotate 当前窗口结束时开始新窗口，调用方需持有锁
+func (t *Tracker) rotate() {
+	now := t.clock.Now()
+	if now.Sub(t.windowStart) < t.window {
+		return
+	}
+	elapsed := now.Sub(t.windowStart) / t.window
+	if elapsed == 1 {
+		t.previous, t.prevStart = t.current, t.windowStart
+	} else {
+		// 跳过了没有数据的窗口
+		t.previous, t.prevStart = nil, t.windowStart.Add((elapsed-1)*t.window)
+	}
+	t.windowStart = t.windowStart.Add(elapsed * t.window)
+	t.current = make(map[key]*summary)
+}
@@ -0,0 +1,284 @@
+package udf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ProcessFunc 模块必须导出的处理函数名
+//
+// 函数签名为 process(value f64, timestamp_ms i64, type i32) -> f64，
+// 返回值替换指标的值，返回NaN表示丢弃该指标。模块没有任何宿主导入，
+// 只能做纯计算。
+const ProcessFunc = "process"
+
+// 自定义错误
+var (
+	ErrModuleTooLarge  = errors.New("wasm module too large")
+	ErrInvalidName     = errors.New("invalid module name")
+	ErrModuleNotFound  = errors.New("wasm module not found")
+	ErrInvalidFunction = errors.New("module must export " + ProcessFunc + "(f64, i64, i32) -> f64")
+)
+
+// ModuleInfo 已加载模块的信息
+type ModuleInfo struct {
+	Name     string    `json:"name"`
+	Size     int       `json:"size"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Calls    uint64    `json:"calls"`
+	Dropped  uint64    `json:"dropped"`
+	Errors   uint64    `json:"errors"`
+}
+
+// Registry 管理用户上传的WASM模块，并作为一个处理阶段按加载顺序执行它们
+//
+// modules在修改时整体替换为新切片，Process在锁外遍历取到的旧切片不受影响。
+type Registry struct {
+	mu      sync.RWMutex
+	runtime wazero.Runtime
+	modules []*module
+	timeout time.Duration
+	maxSize int
+	clock   clock.Clock
+}
+
+// module 单个已编译并实例化的模块
+type module struct {
+	mu       sync.Mutex
+	name     string
+	size     int
+	loadedAt time.Time
+	compiled wazero.CompiledModule
+	instance api.Module
+	fn       api.Function
+	calls    uint64
+	dropped  uint64
+	errors   uint64
+	// closed 模块已被替换或卸载，仍持有旧切片的调用直接跳过
+	closed bool
+}
+
+// NewRegistry 创建WASM模块注册表
+func NewRegistry(cfg config.UDFConfig, clk clock.Clock) *Registry {
+	// 超时通过取消context中断执行，内存按64KiB页限制
+	runtimeConfig := wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(cfg.MemoryLimitPages)
+
+	return &Registry{
+		runtime: wazero.NewRuntimeWithConfig(context.Background(), runtimeConfig),
+		timeout: cfg.Timeout,
+		maxSize: cfg.MaxModuleSize,
+		clock:   clk,
+	}
+}
+
+// Name 实现processor.Stage接口
+func (r *Registry) Name() string {
+	return "udf"
+}
+
+// Load 编译并加载模块，同名模块会被替换并保持原来的执行位置
+func (r *Registry) Load(name string, binary []byte) error {
+	if name == "" {
+		return ErrInvalidName
+	}
+	if len(binary) > r.maxSize {
+		return ErrModuleTooLarge
+	}
+
+	ctx := context.Background()
+	compiled, err := r.runtime.CompileModule(ctx, binary)
+	if err != nil {
+		return fmt.Errorf("failed to compile module: %w", err)
+	}
+
+	m := &module{
+		name:     name,
+		size:     len(binary),
+		loadedAt: r.clock.Now(),
+		compiled: compiled,
+	}
+	if err := r.instantiate(ctx, m); err != nil {
+		compiled.Close(ctx)
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modules := slices.Clone(r.modules)
+	for i, old := range modules {
+		if old.name == name {
+			modules[i] = m
+			r.modules = modules
+			old.close(ctx)
+			return nil
+		}
+	}
+	r.modules = append(modules, m)
+	return nil
+}
+
+// MaxModuleSize 返回允许上传的模块大小上限
+func (r *Registry) MaxModuleSize() int {
+	return r.maxSize
+}
+
+// Remove 卸载模块
+func (r *Registry) Remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, m := range r.modules {
+		if m.name == name {
+			r.modules = slices.Delete(slices.Clone(r.modules), i, i+1)
+			m.close(context.Background())
+			return nil
+		}
+	}
+	return ErrModuleNotFound
+}
+
+// List 列出已加载模块，按执行顺序排列
+func (r *Registry) List() []ModuleInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	infos := make([]ModuleInfo, 0, len(r.modules))
+	for _, m := range r.modules {
+		m.mu.Lock()
+		infos = append(infos, ModuleInfo{
+			Name:     m.name,
+			Size:     m.size,
+			LoadedAt: m.loadedAt,
+			Calls:    m.calls,
+			Dropped:  m.dropped,
+			Errors:   m.errors,
+		})
+		m.mu.Unlock()
+	}
+	return infos
+}
+
+// Process 实现processor.Stage接口，依次执行所有模块
+func (r *Registry) Process(metric *processor.ProcessedMetric) (bool, error) {
+	r.mu.RLock()
+	modules := r.modules
+	r.mu.RUnlock()
+
+	for _, m := range modules {
+		value, err := r.call(m, metric)
+		if err != nil {
+			// 单个模块出错不影响数据，跳过该模块
+			log.Printf("WASM module %s failed: %v", m.name, err)
+			continue
+		}
+		if math.IsNaN(value) {
+			m.mu.Lock()
+			m.dropped++
+			m.mu.Unlock()
+			return false, nil
+		}
+		metric.Value = value
+	}
+	return true, nil
+}
+
+// Close 释放所有模块和运行时
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.modules = nil
+	return r.runtime.Close(context.Background())
+}
+
+// call 在超时限制内调用模块的处理函数
+func (r *Registry) call(m *module, metric *processor.ProcessedMetric) (float64, error) {
+	// 模块实例不能并发调用
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return metric.Value, nil
+	}
+	m.calls++
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	if m.instance == nil || m.instance.IsClosed() {
+		// 上次调用超时会关闭实例，这里重新实例化
+		if err := r.instantiate(ctx, m); err != nil {
+			m.errors++
+			return 0, err
+		}
+	}
+
+	results, err := m.fn.Call(ctx,
+		api.EncodeF64(metric.Value),
+		api.EncodeI64(metric.Timestamp.UnixMilli()),
+		api.EncodeI32(int32(metric.RawType)),
+	)
+	if err != nil {
+		m.errors++
+		return 0, err
+	}
+	return api.DecodeF64(results[0]), nil
+}
+
+// instantiate 实例化模块并校验导出函数签名
+func (r *Registry) instantiate(ctx context.Context, m *module) error {
+	// 匿名实例，允许同一模块多次实例化
+	instance, err := r.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return fmt.Errorf("failed to instantiate module: %w", err)
+	}
+
+	fn := instance.ExportedFunction(ProcessFunc)
+	if fn == nil || !validSignature(fn.Definition()) {
+		instance.Close(ctx)
+		return ErrInvalidFunction
+	}
+
+	m.instance = instance
+	m.fn = fn
+	return nil
+}
+
+// close 释放模块资源
+func (m *module) close(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	if m.instance != nil {
+		m.instance.Close(ctx)
+	}
+	m.compiled.Close(ctx)
+}
+
+// validSignature 检查处理函数签名
+func validSignature(def api.FunctionDefinition) bool {
+	params := def.ParamTypes()
+	results := def.ResultTypes()
+	return len(params) == 3 &&
+		params[0] == api.ValueTypeF64 &&
+		params[1] == api.ValueTypeI64 &&
+		params[2] == api.ValueTypeI32 &&
+		len(results) == 1 &&
+		results[0] == api.ValueTypeF64
+}
@@ -0,0 +1,388 @@
+// Package writehook 在数据写入存储成功后调用钩子，匹配选择器的数据交给钩子处理，
+// 用于新主机出现时更新CMDB等自定义的副作用。钩子可以是配置的webhook，也可以是程序中注册的Go实现
+package writehook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/konpure/Kon-Agent-export/pkg/clock"
+	"github.com/konpure/Kon-Agent-export/pkg/config"
+	"github.com/konpure/Kon-Agent-export/pkg/processor"
+	"github.com/konpure/Kon-Agent-export/pkg/storage"
+)
+
+// 触发方式
+const (
+	TriggerEvery     = "every"
+	TriggerFirstSeen = "first_seen"
+)
+
+// Event 交给钩子的一次事件
+type Event struct {
+	// Hook 钩子名称
+	Hook    string `json:"hook"`
+	Trigger string `json:"trigger"`
+	// Key first_seen时第一次出现的值
+	Key string `json:"key,omitempty"`
+	// Metrics 触发事件的数据，first_seen时为该值所在批次中匹配的数据
+	Metrics []processor.ProcessedMetric `json:"metrics"`
+	Time    time.Time                   `json:"time"`
+}
+
+// Hook 写入钩子，Handle返回错误时按配置重试，返回Permanent包装的错误时不重试
+type Hook interface {
+	Handle(ctx context.Context, event Event) error
+}
+
+// HookFunc 把函数用作Hook
+type HookFunc func(ctx context.Context, event Event) error
+
+// Handle 调用f
+func (f HookFunc) Handle(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+// Factory 根据钩子配置创建钩子
+type Factory func(cfg config.WriteHookConfig) (Hook, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+func init() {
+	Register("webhook", newWebhook)
+}
+
+// Register 注册钩子类型，name对应配置中钩子的type，重复注册会panic
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("writehook: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("writehook: Register called twice for type " + name)
+	}
+	factories[name] = factory
+}
+
+// permanentError 重试也不会成功的错误
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent 包装钩子返回的错误，表示重试也不会成功
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Stats 单个钩子的统计
+type Stats struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Queued 等待处理的事件数
+	Queued int `json:"queued"`
+	// Delivered 处理成功的事件数
+	Delivered uint64 `json:"delivered"`
+	// Failed 重试后仍失败而丢弃的事件数
+	Failed uint64 `json:"failed"`
+	// Dropped 队列已满而丢弃的事件数
+	Dropped uint64 `json:"dropped"`
+	// Retries 失败后的重试次数
+	Retries      uint64     `json:"retries"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// Dispatcher 把写入存储的数据按选择器分发给钩子
+//
+// Observe只做匹配并把事件放入各钩子的队列，不阻塞接入；每个钩子有自己的协程按顺序处理事件，
+// 慢的钩子不影响其他钩子。失败时按min_backoff到max_backoff指数退避重试。
+type Dispatcher struct {
+	clock   clock.Clock
+	runners []*runner
+
+	wg sync.WaitGroup
+	// ctx 在Close超时时取消，中断正在进行的调用和重试
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// runner 单个钩子的队列和处理协程
+type runner struct {
+	cfg   config.WriteHookConfig
+	hook  Hook
+	queue chan Event
+
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	stats Stats
+}
+
+// NewDispatcher 创建钩子并启动处理协程，钩子缺少名称、名称重复、类型未注册、触发方式未知或选择器无效时返回错误
+func NewDispatcher(cfg config.WriteHooksConfig, clk clock.Clock) (*Dispatcher, error) {
+	names := make(map[string]bool)
+	runners := make([]*runner, 0, len(cfg.Hooks))
+	for _, hc := range cfg.Hooks {
+		if hc.Name == "" {
+			return nil, errors.New("write hook name is required")
+		}
+		if names[hc.Name] {
+			return nil, fmt.Errorf("duplicate write hook %q", hc.Name)
+		}
+		names[hc.Name] = true
+
+		if err := validate(hc); err != nil {
+			return nil, fmt.Errorf("write hook %s: %w", hc.Name, err)
+		}
+		factoriesMu.RLock()
+		factory, ok := factories[hc.Type]
+		factoriesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("write hook %s: unknown type %q", hc.Name, hc.Type)
+		}
+		hook, err := factory(hc)
+		if err != nil {
+			return nil, fmt.Errorf("write hook %s: %w", hc.Name, err)
+		}
+		runners = append(runners, &runner{
+			cfg:   hc,
+			hook:  hook,
+			queue: make(chan Event, cfg.QueueSize),
+			seen:  make(map[string]struct{}),
+			stats: Stats{Name: hc.Name, Type: hc.Type},
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{clock: clk, runners: runners, ctx: ctx, cancel: cancel}
+	for _, r := range runners {
+		d.wg.Add(1)
+		go d.run(r)
+	}
+	return d, nil
+}
+
+// Observe 把一批写入存储的数据按选择器生成事件放入钩子的队列，用作接入钩子
+func (d *Dispatcher) Observe(metrics []processor.ProcessedMetric) {
+	now := d.clock.Now()
+	for _, r := range d.runners {
+		var matched []processor.ProcessedMetric
+		for i := range metrics {
+			if matches(&r.cfg.Match, &metrics[i]) {
+				matched = append(matched, metrics[i])
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		if r.cfg.Trigger == TriggerEvery {
+			r.enqueue(Event{Hook: r.cfg.Name, Trigger: TriggerEvery, Metrics: matched, Time: now})
+			continue
+		}
+		for _, key := range r.firstSeen(matched) {
+			var keyed []processor.ProcessedMetric
+			for i := range matched {
+				if v, ok := keyOf(r.cfg.Key, &matched[i]); ok && v == key {
+					keyed = append(keyed, matched[i])
+				}
+			}
+			r.enqueue(Event{Hook: r.cfg.Name, Trigger: TriggerFirstSeen, Key: key, Metrics: keyed, Time: now})
+		}
+	}
+}
+
+// Stats 按配置顺序返回各钩子的统计
+func (d *Dispatcher) Stats() []Stats {
+	stats := make([]Stats, 0, len(d.runners))
+	for _, r := range d.runners {
+		r.mu.Lock()
+		s := r.stats
+		r.mu.Unlock()
+		s.Queued = len(r.queue)
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// Close 处理完队列中剩余的事件后停止，ctx结束时放弃未处理的事件，Close之后不能再调用Observe
+func (d *Dispatcher) Close(ctx context.Context) error {
+	for _, r := range d.runners {
+		close(r.queue)
+	}
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		pending := 0
+		for _, s := range d.Stats() {
+			pending += s.Queued
+		}
+		d.cancel()
+		<-done
+		return fmt.Errorf("write_hooks: %d events not handled: %w", pending, ctx.Err())
+	}
+}
+
+// enqueue 放入事件，队列满时丢弃
+func (r *runner) enqueue(event Event) {
+	select {
+	case r.queue <- event:
+	default:
+		r.mu.Lock()
+		r.stats.Dropped++
+		r.mu.Unlock()
+	}
+}
+
+// firstSeen 返回matched中第一次出现的key值，按值排序，记住的值达到max_keys时先清空
+func (r *runner) firstSeen(matched []processor.ProcessedMetric) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	for i := range matched {
+		key, ok := keyOf(r.cfg.Key, &matched[i])
+		if !ok {
+			continue
+		}
+		if _, seen := r.seen[key]; seen {
+			continue
+		}
+		if len(r.seen) >= r.cfg.MaxKeys {
+			clear(r.seen)
+		}
+		r.seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// run 按顺序处理钩子的事件，队列关闭后退出
+func (d *Dispatcher) run(r *runner) {
+	defer d.wg.Done()
+	for event := range r.queue {
+		if d.ctx.Err() != nil {
+			continue
+		}
+		d.handle(r, event)
+	}
+}
+
+// handle 调用钩子，失败时指数退避重试
+func (d *Dispatcher) handle(r *runner, event Event) {
+	backoff := r.cfg.MinBackoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = r.call(d.ctx, event); err == nil {
+			now := d.clock.Now()
+			r.mu.Lock()
+			r.stats.Delivered++
+			r.stats.LastDelivery = &now
+			r.mu.Unlock()
+			return
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= r.cfg.MaxRetries {
+			break
+		}
+
+		r.mu.Lock()
+		r.stats.Retries++
+		r.mu.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-d.ctx.Done():
+		}
+		if d.ctx.Err() != nil {
+			break
+		}
+		backoff = min(backoff*2, r.cfg.MaxBackoff)
+	}
+
+	r.mu.Lock()
+	r.stats.Failed++
+	r.stats.LastError = err.Error()
+	r.mu.Unlock()
+	log.Printf("Write hook %s failed, dropping %s event: %v", r.cfg.Name, event.Trigger, err)
+}
+
+// call 以timeout为超时调用一次钩子，钩子panic时视为失败
+func (r *runner) call(ctx context.Context, event Event) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("hook panicked: %v", p)
+		}
+	}()
+	return r.hook.Handle(ctx, event)
+}
+
+// validate 检查触发方式和选择器的glob
+func validate(cfg config.WriteHookConfig) error {
+	switch cfg.Trigger {
+	case TriggerEvery, TriggerFirstSeen:
+	default:
+		return fmt.Errorf("unknown trigger %q", cfg.Trigger)
+	}
+
+	patterns := []string{cfg.Match.Agent, cfg.Match.Metric, cfg.Match.Type}
+	for _, v := range cfg.Match.Labels {
+		patterns = append(patterns, v)
+	}
+	for _, pattern := range patterns {
+		if err := storage.ValidateGlob(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches 判断数据是否满足选择器的所有条件
+func matches(match *config.WriteHookMatch, m *processor.ProcessedMetric) bool {
+	if !storage.MatchGlob(match.Agent, m.AgentID) || !storage.MatchGlob(match.Metric, m.Name) || !storage.MatchGlob(match.Type, m.Type) {
+		return false
+	}
+	for k, pattern := range match.Labels {
+		v, ok := m.Labels[k]
+		if !ok || !storage.MatchGlob(pattern, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// keyOf 返回first_seen判断的值，key为标签名且数据没有该标签时返回false
+func keyOf(key string, m *processor.ProcessedMetric) (string, bool) {
+	switch key {
+	case "agent_id":
+		return m.AgentID, true
+	case "metric":
+		return m.Name, true
+	case "type":
+		return m.Type, true
+	}
+	v, ok := m.Labels[key]
+	return v, ok
+}